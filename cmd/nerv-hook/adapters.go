@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Protocol translates between an agent framework's hook wire format and
+// NERV's HookInput/HookOutput, so one decision engine serves every agent
+type Protocol interface {
+	// ParseInput converts a raw event payload into a HookInput
+	ParseInput(event string, data []byte) (HookInput, error)
+	// FormatOutput converts a NERV result into the agent's response format
+	FormatOutput(event string, output HookOutput) ([]byte, error)
+}
+
+// protocols maps --protocol values to their adapters
+var protocols = map[string]Protocol{
+	"claude":    claudeProtocol{},
+	"cursor":    cursorProtocol{},
+	"openhands": openHandsProtocol{},
+	"aider":     aiderProtocol{},
+}
+
+// lookupProtocol returns the adapter for a --protocol value
+func lookupProtocol(name string) (Protocol, error) {
+	if p, ok := protocols[name]; ok {
+		return p, nil
+	}
+
+	names := make([]string, 0, len(protocols))
+	for n := range protocols {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown protocol %q (expected one of: %s)", name, strings.Join(names, ", "))
+}
+
+// decisionBehavior returns the behavior of an output, treating no decision as allow
+func decisionBehavior(output HookOutput) string {
+	if output.Decision == nil {
+		return "allow"
+	}
+	return output.Decision.Behavior
+}
+
+// decisionMessage returns the model-facing message of an output, if any
+func decisionMessage(output HookOutput) string {
+	if output.Decision == nil {
+		return ""
+	}
+	return output.Decision.Message
+}
+
+// claudeProtocol is the native Claude Code hook format
+type claudeProtocol struct{}
+
+func (claudeProtocol) ParseInput(event string, data []byte) (HookInput, error) {
+	input := HookInput{ProtocolVersion: claudeProtocolV1}
+	if len(data) == 0 {
+		return input, nil
+	}
+	if err := json.Unmarshal(data, &input); err != nil {
+		return input, err
+	}
+
+	version, unknown := detectClaudeVersion(data)
+	input.ProtocolVersion = version
+	if len(unknown) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: unrecognized %s input fields: %s\n", version, strings.Join(unknown, ", "))
+	}
+
+	return input, nil
+}
+
+func (claudeProtocol) FormatOutput(event string, output HookOutput) ([]byte, error) {
+	return json.Marshal(output)
+}
+
+// cursorProtocol handles Cursor agent hooks
+// (beforeShellExecution, beforeReadFile, beforeMCPExecution, afterFileEdit, stop)
+type cursorProtocol struct{}
+
+// cursorInput is the union of the Cursor hook payloads NERV understands
+type cursorInput struct {
+	ConversationID string `json:"conversation_id"`
+	HookEventName  string `json:"hook_event_name"`
+	Command        string `json:"command"`
+	Cwd            string `json:"cwd"`
+	FilePath       string `json:"file_path"`
+	ToolName       string `json:"tool_name"`
+	ToolInput      string `json:"tool_input"`
+	Status         string `json:"status"`
+}
+
+// cursorOutput is the Cursor permission response
+type cursorOutput struct {
+	Continue     *bool  `json:"continue,omitempty"`
+	Permission   string `json:"permission,omitempty"` // "allow", "deny", or "ask"
+	UserMessage  string `json:"userMessage,omitempty"`
+	AgentMessage string `json:"agentMessage,omitempty"`
+}
+
+func (cursorProtocol) ParseInput(event string, data []byte) (HookInput, error) {
+	var raw cursorInput
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return HookInput{}, err
+	}
+
+	input := HookInput{SessionID: raw.ConversationID, Cwd: raw.Cwd, ProtocolVersion: "cursor/1"}
+	switch raw.HookEventName {
+	case "beforeShellExecution":
+		input.ToolName = "Bash"
+		input.ToolInput = map[string]interface{}{"command": raw.Command}
+	case "beforeReadFile":
+		input.ToolName = "Read"
+		input.ToolInput = map[string]interface{}{"file_path": raw.FilePath}
+	case "afterFileEdit":
+		input.ToolName = "Edit"
+		input.ToolInput = map[string]interface{}{"file_path": raw.FilePath}
+	case "beforeMCPExecution":
+		input.ToolName = "mcp__" + raw.ToolName
+		var args map[string]interface{}
+		if json.Unmarshal([]byte(raw.ToolInput), &args) == nil {
+			input.ToolInput = args
+		}
+	case "stop":
+		input.StopReason = raw.Status
+	default:
+		return input, fmt.Errorf("unsupported cursor hook event %q", raw.HookEventName)
+	}
+
+	return input, nil
+}
+
+func (cursorProtocol) FormatOutput(event string, output HookOutput) ([]byte, error) {
+	output = unrewritable(output)
+	out := cursorOutput{
+		Continue:     output.Continue,
+		UserMessage:  output.SystemMessage,
+		AgentMessage: decisionMessage(output),
+	}
+	if event == "pre-tool-use" {
+		out.Permission = decisionBehavior(output)
+	}
+	if output.StopReason != "" {
+		out.UserMessage = output.StopReason
+	}
+	return json.Marshal(out)
+}
+
+// openHandsProtocol handles OpenHands actions forwarded by a confirmation-mode wrapper
+type openHandsProtocol struct{}
+
+// openHandsAction is an OpenHands event stream action
+type openHandsAction struct {
+	SessionID string                 `json:"sid"`
+	Action    string                 `json:"action"`
+	Args      map[string]interface{} `json:"args"`
+}
+
+// openHandsOutput tells the wrapper whether to confirm or reject the pending action
+type openHandsOutput struct {
+	ConfirmationState string `json:"confirmation_state"` // "confirmed" or "rejected"
+	Reason            string `json:"reason,omitempty"`
+	StopAgent         bool   `json:"stop_agent,omitempty"`
+}
+
+// openHandsTools maps OpenHands action types to their Claude tool equivalents
+var openHandsTools = map[string]string{
+	"run":         "Bash",
+	"run_ipython": "NotebookEdit",
+	"read":        "Read",
+	"write":       "Write",
+	"edit":        "Edit",
+	"browse":      "WebFetch",
+}
+
+func (openHandsProtocol) ParseInput(event string, data []byte) (HookInput, error) {
+	var raw openHandsAction
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return HookInput{}, err
+	}
+
+	input := HookInput{SessionID: raw.SessionID, ProtocolVersion: "openhands/1"}
+	if event == "session-start" {
+		return input, nil
+	}
+	if event == "stop" {
+		input.StopReason = raw.Action
+		return input, nil
+	}
+
+	toolName, ok := openHandsTools[raw.Action]
+	if !ok {
+		return input, fmt.Errorf("unsupported openhands action %q", raw.Action)
+	}
+	input.ToolName = toolName
+	input.ToolInput = map[string]interface{}{}
+	for k, v := range raw.Args {
+		input.ToolInput[k] = v
+	}
+	// OpenHands names file paths "path"; the engine expects Claude's "file_path"
+	if path, ok := raw.Args["path"]; ok {
+		input.ToolInput["file_path"] = path
+	}
+
+	return input, nil
+}
+
+func (openHandsProtocol) FormatOutput(event string, output HookOutput) ([]byte, error) {
+	output = unrewritable(output)
+	out := openHandsOutput{
+		ConfirmationState: "confirmed",
+		Reason:            decisionMessage(output),
+		StopAgent:         output.Continue != nil && !*output.Continue,
+	}
+	if decisionBehavior(output) != "allow" {
+		out.ConfirmationState = "rejected"
+	}
+	return json.Marshal(out)
+}
+
+// aiderProtocol handles events from an Aider wrapper script
+// The wrapper asks before shell commands and before files are edited
+type aiderProtocol struct{}
+
+// aiderEvent is the payload sent by the Aider wrapper
+type aiderEvent struct {
+	SessionID string `json:"session_id"`
+	Kind      string `json:"kind"` // "shell", "edit", or "read"
+	Command   string `json:"command"`
+	File      string `json:"file"`
+	Reason    string `json:"reason"`
+}
+
+// aiderOutput is the wrapper's go/no-go answer
+type aiderOutput struct {
+	Allow   bool   `json:"allow"`
+	Message string `json:"message,omitempty"`
+	Exit    bool   `json:"exit,omitempty"`
+}
+
+func (aiderProtocol) ParseInput(event string, data []byte) (HookInput, error) {
+	var raw aiderEvent
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return HookInput{}, err
+	}
+
+	input := HookInput{SessionID: raw.SessionID, StopReason: raw.Reason, ProtocolVersion: "aider/1"}
+	switch raw.Kind {
+	case "shell":
+		input.ToolName = "Bash"
+		input.ToolInput = map[string]interface{}{"command": raw.Command}
+	case "edit":
+		input.ToolName = "Edit"
+		input.ToolInput = map[string]interface{}{"file_path": raw.File}
+	case "read":
+		input.ToolName = "Read"
+		input.ToolInput = map[string]interface{}{"file_path": raw.File}
+	case "":
+		// Stop events carry no tool
+	default:
+		return input, fmt.Errorf("unsupported aider event kind %q", raw.Kind)
+	}
+
+	return input, nil
+}
+
+func (aiderProtocol) FormatOutput(event string, output HookOutput) ([]byte, error) {
+	output = unrewritable(output)
+	out := aiderOutput{
+		Allow:   decisionBehavior(output) == "allow",
+		Message: decisionMessage(output),
+		Exit:    output.Continue != nil && !*output.Continue,
+	}
+	if out.Message == "" {
+		out.Message = output.SystemMessage
+	}
+	return json.Marshal(out)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// anomalyBucket is the window denial bursts are counted in
+const anomalyBucket = 5 * time.Minute
+
+// anomalyBurstFactor is how many times a project's usual denials per bucket make a burst
+const anomalyBurstFactor = 3
+
+// AnomalyConfig turns on alerts for activity that's unusual for a project:
+// the first use of a tool category, the first access to a directory outside the
+// working tree, and a burst of denials
+// Each project's baseline is kept in activity_baselines as its calls are made
+type AnomalyConfig struct {
+	// Warmup is how many tool calls a project's baseline learns from before it alerts (default 200)
+	Warmup int64 `json:"warmup,omitempty"`
+	// BurstDenials is the fewest denials in five minutes that count as a burst (default 5)
+	BurstDenials int64 `json:"burst_denials,omitempty"`
+}
+
+// Validate reports anomaly settings that can't be applied
+func (c *AnomalyConfig) Validate() error {
+	if c != nil && (c.Warmup < 0 || c.BurstDenials < 0) {
+		return errors.New("warmup and burst_denials can't be negative")
+	}
+	return nil
+}
+
+func (c *AnomalyConfig) warmup() int64 {
+	if c.Warmup == 0 {
+		return 200
+	}
+	return c.Warmup
+}
+
+func (c *AnomalyConfig) burstDenials() int64 {
+	if c.BurstDenials == 0 {
+		return 5
+	}
+	return c.BurstDenials
+}
+
+// anomaly is one unusual thing a tool call did
+type anomaly struct {
+	kind   string
+	detail string
+}
+
+// anomalyAlerts updates the project's baseline with a decided pre-tool-use call
+// and alerts on anything unusual about it: a high-severity anomaly_detected
+// audit event, and a notice to the user
+func anomalyAlerts(db Store, projectID, taskID string, input HookInput, output HookOutput) HookOutput {
+	cfg := loadConfig().Anomalies
+	if cfg == nil || db == nil {
+		return output
+	}
+	anomalies := detectAnomalies(cfg, db, projectID, input, decisionBehavior(output) == "deny", time.Now())
+	if len(anomalies) == 0 {
+		return output
+	}
+
+	details := make([]string, len(anomalies))
+	for i, a := range anomalies {
+		details[i] = a.detail
+		logAudit(db, taskID, "anomaly_detected", fmt.Sprintf(`{"kind":%q,"severity":"high","detail":%q,"tool":%q,"session_id":%q,"project_id":%q}`,
+			a.kind, a.detail, input.ToolName, input.SessionID, projectID))
+	}
+	notice := "NERV: unusual activity: " + strings.Join(details, "; ")
+	fmt.Fprintln(os.Stderr, notice)
+	if output.SystemMessage != "" {
+		notice = output.SystemMessage + ". " + notice
+	}
+	output.SystemMessage = notice
+	return output
+}
+
+// detectAnomalies counts a call in the project's baseline and returns what was unusual about it
+// Nothing is unusual until the baseline has seen the warmup's worth of calls
+func detectAnomalies(cfg *AnomalyConfig, db Store, projectID string, input HookInput, denied bool, now time.Time) []anomaly {
+	calls, err := db.ObserveActivity(projectID, store.BaselineCalls, "", now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to update the activity baseline: %v\n", err)
+		return nil
+	}
+	learning := calls.Count < cfg.warmup()
+
+	var anomalies []anomaly
+	for _, category := range toolCategories(input) {
+		b, err := db.ObserveActivity(projectID, store.BaselineCategory, category, now)
+		if err == nil && b.Count == 0 && !learning {
+			anomalies = append(anomalies, anomaly{"new_tool", "first use of " + category + " in this project"})
+		}
+	}
+	if dir := outsideDir(input); dir != "" {
+		b, err := db.ObserveActivity(projectID, store.BaselinePath, dir, now)
+		if err == nil && b.Count == 0 && !learning {
+			anomalies = append(anomalies, anomaly{"new_path", "first access to " + dir})
+		}
+	}
+	if !denied {
+		return anomalies
+	}
+
+	total, err := db.ObserveActivity(projectID, store.BaselineDenials, "", now)
+	if err != nil {
+		return anomalies
+	}
+	start := now.Truncate(anomalyBucket)
+	bucket, err := db.ObserveActivity(projectID, store.BaselineDenials, strconv.FormatInt(start.UnixMilli(), 10), now)
+	if err != nil || learning {
+		return anomalies
+	}
+	usual := usualDenials(total, bucket, start)
+	threshold := max(cfg.burstDenials(), int64(math.Ceil(anomalyBurstFactor*usual)))
+	// Alert once, as the bucket reaches the threshold
+	if bucket.Count < threshold && bucket.Count+1 >= threshold {
+		anomalies = append(anomalies, anomaly{"denial_burst", fmt.Sprintf("%d denials in five minutes, against an average of %.1f", bucket.Count+1, usual)})
+	}
+	return anomalies
+}
+
+// usualDenials is the project's average denials per bucket before the one starting at start
+func usualDenials(total, bucket store.Baseline, start time.Time) float64 {
+	if total.Count == 0 {
+		return 0
+	}
+	buckets := float64(start.Sub(total.FirstSeen.Truncate(anomalyBucket)) / anomalyBucket)
+	return float64(total.Count-bucket.Count) / max(buckets, 1)
+}
+
+// toolCategories are what a call counts as in the baseline: its tool, or for
+// Bash each command it runs, such as Bash(curl)
+func toolCategories(input HookInput) []string {
+	if input.ToolName != "Bash" {
+		return []string{input.ToolName}
+	}
+	command, _ := input.ToolInput["command"].(string)
+	var categories []string
+	seen := map[string]bool{}
+	for _, args := range policy.CommandArgs(command) {
+		category := "Bash(" + path.Base(args[0]) + ")"
+		if !seen[category] {
+			seen[category] = true
+			categories = append(categories, category)
+		}
+	}
+	if len(categories) == 0 {
+		return []string{"Bash"}
+	}
+	return categories
+}
+
+// pathKeys are the tool inputs naming the path a file tool touches, and whether it names a directory
+var pathKeys = map[string]struct {
+	key string
+	dir bool
+}{
+	"Read":         {"file_path", false},
+	"Write":        {"file_path", false},
+	"Edit":         {"file_path", false},
+	"NotebookEdit": {"notebook_path", false},
+	"Grep":         {"path", true},
+	"Glob":         {"path", true},
+	"LS":           {"path", true},
+}
+
+// outsideDir returns the directory a file tool call touches, if it's outside the working directory
+// Directories inside it come and go with the work, so only those outside are tracked
+func outsideDir(input HookInput) string {
+	k, ok := pathKeys[input.ToolName]
+	p, _ := input.ToolInput[k.key].(string)
+	if !ok || p == "" || input.Cwd == "" {
+		return ""
+	}
+	p = expandHome(p)
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(input.Cwd, p)
+	}
+	p = filepath.Clean(p)
+	if !k.dir {
+		p = filepath.Dir(p)
+	}
+	if withinDir(p, input.Cwd) {
+		return ""
+	}
+	return p
+}
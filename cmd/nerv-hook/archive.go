@@ -0,0 +1,629 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// taskArchiveVersion is bumped when the archive format changes incompatibly
+const taskArchiveVersion = 1
+
+// taskArchive is everything NERV knows about a task, in one JSON document that
+// can be read without the state database
+type taskArchive struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+
+	Task    archivedTask     `json:"task"`
+	Project archivedProject  `json:"project"`
+	History []archivedChange `json:"history"`
+	Notes   []archivedNote   `json:"notes,omitempty"`
+	// Sessions carry the paths of their transcripts, which stay where the agent wrote them
+	Sessions  []archivedSession  `json:"sessions,omitempty"`
+	Approvals []archivedApproval `json:"approvals,omitempty"`
+	// Audit is the task's audit trail, oldest first
+	Audit []archivedEvent `json:"audit"`
+
+	// Changes is the task branch's diff at export time
+	Changes *archivedChanges `json:"changes,omitempty"`
+	// ReviewBundle is the bundle from the task's latest review, as the dashboard shows it
+	ReviewBundle json.RawMessage     `json:"review_bundle,omitempty"`
+	Verification *reviewVerification `json:"verification,omitempty"`
+}
+
+type archivedTask struct {
+	ID          string     `json:"id"`
+	ProjectID   string     `json:"project_id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description,omitempty"`
+	Status      string     `json:"status"`
+	Priority    string     `json:"priority,omitempty"`
+	Labels      []string   `json:"labels,omitempty"`
+	Repos       string     `json:"repos,omitempty"`
+	Branch      string     `json:"branch,omitempty"`
+	BranchHead  string     `json:"branch_head,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+type archivedProject struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	Goal string `json:"goal,omitempty"`
+}
+
+type archivedChange struct {
+	At       time.Time `json:"at"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Source   string    `json:"source,omitempty"`
+	Operator string    `json:"operator,omitempty"`
+}
+
+type archivedNote struct {
+	At       time.Time `json:"at"`
+	Body     string    `json:"body"`
+	Operator string    `json:"operator,omitempty"`
+}
+
+type archivedSession struct {
+	ID             string    `json:"id"`
+	StartedAt      time.Time `json:"started_at"`
+	LastSeenAt     time.Time `json:"last_seen_at"`
+	ActiveSeconds  int64     `json:"active_seconds"`
+	ToolCalls      int64     `json:"tool_calls"`
+	Tokens         int64     `json:"tokens"`
+	CostUSD        float64   `json:"cost_usd"`
+	TranscriptPath string    `json:"transcript_path,omitempty"`
+}
+
+type archivedApproval struct {
+	ID         int64      `json:"id"`
+	At         time.Time  `json:"at"`
+	Tool       string     `json:"tool"`
+	Input      string     `json:"input"`
+	Status     string     `json:"status"`
+	DenyReason string     `json:"deny_reason,omitempty"`
+	DecidedAt  *time.Time `json:"decided_at,omitempty"`
+	DecidedBy  string     `json:"decided_by,omitempty"`
+}
+
+type archivedEvent struct {
+	At       time.Time       `json:"at"`
+	Event    string          `json:"event"`
+	Details  json.RawMessage `json:"details,omitempty"`
+	Operator string          `json:"operator,omitempty"`
+}
+
+type archivedChanges struct {
+	Base          string       `json:"base,omitempty"`
+	Head          string       `json:"head,omitempty"`
+	Files         []reviewFile `json:"files,omitempty"`
+	Diff          string       `json:"diff,omitempty"`
+	DiffTruncated bool         `json:"diff_truncated,omitempty"`
+	GitError      string       `json:"git_error,omitempty"`
+}
+
+// optionalTime leaves a zero time out of the archive
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// finishedAt is when the task last changed status, or when it was created if it never has
+func (a taskArchive) finishedAt() time.Time {
+	if len(a.History) > 0 {
+		return a.History[len(a.History)-1].At
+	}
+	return a.Task.CreatedAt
+}
+
+// buildTaskArchive collects a task's record from the database and its repository
+func buildTaskArchive(st *store.DB, task store.Task) (taskArchive, error) {
+	a := taskArchive{
+		Version:    taskArchiveVersion,
+		ExportedAt: time.Now().UTC(),
+		Task:       taskJSON(task).archivedTask,
+		Project:    archivedProject{ID: task.ProjectID},
+	}
+	if project, err := st.GetProject(task.ProjectID); err == nil {
+		a.Project.Name, a.Project.Goal = project.Name, project.Goal
+	}
+
+	history, err := st.TaskHistory(task.ID)
+	if err != nil {
+		return a, err
+	}
+	for _, tr := range history {
+		a.History = append(a.History, archivedChange{At: tr.CreatedAt, From: tr.From, To: tr.To, Source: tr.Source, Operator: tr.Operator})
+	}
+
+	notes, err := st.ListTaskNotes(task.ID, 0)
+	if err != nil {
+		return a, err
+	}
+	for _, n := range notes {
+		a.Notes = append(a.Notes, archivedNote{At: n.CreatedAt, Body: n.Body, Operator: n.Operator})
+	}
+
+	sessions, err := st.ListSessions(task.ID)
+	if err != nil {
+		return a, err
+	}
+	for _, sess := range sessions {
+		a.Sessions = append(a.Sessions, sessionJSON(sess))
+	}
+
+	approvals, err := st.ListApprovals(task.ID)
+	if err != nil {
+		return a, err
+	}
+	for _, ap := range approvals {
+		a.Approvals = append(a.Approvals, approvalJSON(ap).archivedApproval)
+	}
+
+	events, err := taskAuditEvents(st, task)
+	if err != nil {
+		return a, err
+	}
+	for _, e := range events {
+		a.Audit = append(a.Audit, eventJSON(e).archivedEvent)
+	}
+
+	if dir := taskRepoDir(st, task); dir != "" && task.Branch != "" {
+		b := reviewBundle{Branch: task.Branch}
+		c := &archivedChanges{}
+		if err := b.addGit(dir); err != nil {
+			c.GitError = err.Error()
+		}
+		c.Base, c.Head, c.Files, c.Diff, c.DiffTruncated = b.Base, b.Head, b.Files, b.Diff, b.DiffTruncated
+		a.Changes = c
+	}
+
+	bundle, err := st.LatestReviewBundle(task.ID)
+	switch {
+	case err == nil:
+		a.ReviewBundle = json.RawMessage(bundle.Bundle)
+	case !errors.Is(err, store.ErrNotFound):
+		return a, err
+	}
+
+	v, err := st.LatestVerification(task.ID)
+	switch {
+	case err == nil:
+		a.Verification = &reviewVerification{At: v.CreatedAt, Passed: v.Passed}
+		json.Unmarshal([]byte(v.Steps), &a.Verification.Steps)
+	case !errors.Is(err, store.ErrNotFound):
+		return a, err
+	}
+	return a, nil
+}
+
+// taskRepoDir returns the checkout a task's branch can be read from: its
+// worktree, else its project's first registered directory, or "" if neither exists
+func taskRepoDir(st *store.DB, task store.Task) string {
+	if task.WorktreePath != "" {
+		if _, err := os.Stat(task.WorktreePath); err == nil {
+			return task.WorktreePath
+		}
+	}
+	repos, err := st.ListRepos(task.ProjectID)
+	if err != nil || len(repos) == 0 {
+		return ""
+	}
+	return repos[0].Path
+}
+
+// taskAuditEvents returns a task's audit events oldest first, including those
+// kept in its project's own database in per-project mode
+func taskAuditEvents(st *store.DB, task store.Task) ([]store.AuditEvent, error) {
+	events, err := st.ListAudit(store.AuditFilter{TaskID: task.ID})
+	if err != nil {
+		return nil, err
+	}
+	if project := openTaskProjectStore(task, "ro"); project != nil {
+		defer project.Close()
+		more, err := project.ListAudit(store.AuditFilter{TaskID: task.ID})
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, more...)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if !events[i].Timestamp.Equal(events[j].Timestamp) {
+			return events[i].Timestamp.Before(events[j].Timestamp)
+		}
+		return events[i].ID < events[j].ID
+	})
+	return events, nil
+}
+
+// openTaskProjectStore opens the task's project database in mode (ro or rw) if
+// per-project mode left one, or returns nil
+func openTaskProjectStore(task store.Task, mode string) *store.DB {
+	if task.ProjectID == "" || task.ProjectID != filepath.Base(task.ProjectID) {
+		return nil
+	}
+	path := projectDBPath(task.ProjectID)
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	project, err := store.OpenSQLite(path, mode, dbOptions())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open the project database: %v\n", err)
+		return nil
+	}
+	return project
+}
+
+// archiveDir is where task archive writes archived tasks
+func archiveDir() string {
+	return filepath.Join(nervDir, "archive")
+}
+
+// archivePath is the file a task is archived to
+func archivePath(taskID string) string {
+	return filepath.Join(archiveDir(), taskID+".json")
+}
+
+// writeTaskArchive writes an archive as indented JSON
+func writeTaskArchive(w io.Writer, a taskArchive) error {
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// readTaskArchive reads an archived task
+func readTaskArchive(path string) (taskArchive, error) {
+	var a taskArchive
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return a, err
+	}
+	if err := json.Unmarshal(data, &a); err != nil {
+		return a, fmt.Errorf("%s: %w", path, err)
+	}
+	if a.Version > taskArchiveVersion {
+		return a, fmt.Errorf("%s: archive version %d is newer than this binary understands (%d)", path, a.Version, taskArchiveVersion)
+	}
+	return a, nil
+}
+
+// runTaskExport implements `nerv-hook task export`
+// A task that has been archived is exported from its archive
+func runTaskExport(args []string) error {
+	fs := flag.NewFlagSet("task export", flag.ContinueOnError)
+	output := fs.String("o", "", "file to write the archive to (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: nerv-hook task export [-o FILE] <task-id>")
+	}
+
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	var a taskArchive
+	task, err := st.GetTask(fs.Arg(0))
+	switch {
+	case err == nil:
+		if a, err = buildTaskArchive(st, task); err != nil {
+			return err
+		}
+	case errors.Is(err, store.ErrNotFound):
+		if a, err = readTaskArchive(archivePath(fs.Arg(0))); errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("task not found: %s", fs.Arg(0))
+		} else if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	if *output == "" {
+		return writeTaskArchive(os.Stdout, a)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := writeTaskArchive(f, a); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported task %s to %s\n", a.Task.ID, *output)
+	return nil
+}
+
+// runTaskArchive implements `nerv-hook task archive`: move finished tasks out of
+// the state database, or list and show the ones already moved
+func runTaskArchive(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "list":
+			return runArchiveList(args[1:])
+		case "show":
+			return runArchiveShow(args[1:])
+		}
+	}
+
+	fs := flag.NewFlagSet("task archive", flag.ContinueOnError)
+	olderThan := fs.String("older-than", "30d", "archive done and abandoned tasks finished at least this long ago, e.g. 90d or 720h")
+	projectID := fs.String("project", "", "only tasks in this project")
+	dryRun := fs.Bool("dry-run", false, "list the tasks that would be archived without moving them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	age, err := parseAge(*olderThan)
+	if err != nil {
+		return fmt.Errorf("--older-than: %w", err)
+	}
+
+	st, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	if !*dryRun {
+		if err := actAsOperator(st); err != nil {
+			return err
+		}
+	}
+
+	var tasks []store.Task
+	if fs.NArg() > 0 {
+		// Tasks named on the command line only have to be finished
+		for _, id := range fs.Args() {
+			task, err := loadTask(st, id)
+			if err != nil {
+				return err
+			}
+			if task.Status != store.TaskDone && task.Status != store.TaskAbandoned {
+				return fmt.Errorf("task %s is %s; only done and abandoned tasks can be archived", task.ID, task.Status)
+			}
+			tasks = append(tasks, task)
+		}
+		age = 0
+	} else {
+		for _, status := range []string{store.TaskDone, store.TaskAbandoned} {
+			found, err := st.ListTasks(store.TaskFilter{ProjectID: *projectID, Status: status})
+			if err != nil {
+				return err
+			}
+			tasks = append(tasks, found...)
+		}
+	}
+
+	cutoff := time.Now().Add(-age)
+	archived := 0
+	for _, task := range tasks {
+		history, err := st.TaskHistory(task.ID)
+		if err != nil {
+			return err
+		}
+		finished := task.CreatedAt
+		if len(history) > 0 {
+			finished = history[len(history)-1].CreatedAt
+		}
+		if finished.After(cutoff) {
+			continue
+		}
+		if *dryRun {
+			fmt.Printf("%s\t%s\t%s\n", task.ID, task.Status, task.Title)
+			archived++
+			continue
+		}
+		a, err := buildTaskArchive(st, task)
+		if err != nil {
+			return fmt.Errorf("task %s: %w", task.ID, err)
+		}
+		if err := archiveTask(st, task, a); err != nil {
+			return fmt.Errorf("task %s: %w", task.ID, err)
+		}
+		archived++
+	}
+
+	switch {
+	case *dryRun:
+		fmt.Printf("%d tasks would be archived to %s\n", archived, archiveDir())
+	case archived == 0:
+		fmt.Println("No tasks to archive")
+	default:
+		fmt.Printf("Archived %d tasks to %s\n", archived, archiveDir())
+	}
+	return nil
+}
+
+// archiveTask writes a task's archive, then removes the task and its audit trail from the database
+// The file is written first, so a failure part way leaves the task where it was
+func archiveTask(st *store.DB, task store.Task, a taskArchive) error {
+	path := archivePath(task.ID)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := writeTaskArchive(f, a); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	details, _ := json.Marshal(map[string]interface{}{"path": path, "status": task.Status, "audit_events": len(a.Audit)})
+	if err := st.ArchiveTask(task.ID, string(details)); err != nil {
+		return err
+	}
+	if project := openTaskProjectStore(task, "rw"); project != nil {
+		defer project.Close()
+		if _, err := project.DeleteTaskAudit(task.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseAge accepts a Go duration or a whole number of days, e.g. 30d
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return d, nil
+}
+
+// loadArchives reads every archived task, most recently finished first
+func loadArchives() ([]taskArchive, error) {
+	paths, err := filepath.Glob(filepath.Join(archiveDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var archives []taskArchive
+	for _, path := range paths {
+		a, err := readTaskArchive(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %v\n", err)
+			continue
+		}
+		archives = append(archives, a)
+	}
+	sort.SliceStable(archives, func(i, j int) bool { return archives[i].finishedAt().After(archives[j].finishedAt()) })
+	return archives, nil
+}
+
+// runArchiveList implements `nerv-hook task archive list`
+func runArchiveList(args []string) error {
+	fs := flag.NewFlagSet("task archive list", flag.ContinueOnError)
+	projectID := fs.String("project", "", "only tasks in this project")
+	label := fs.String("label", "", "only tasks with this label")
+	search := fs.String("search", "", "only tasks whose title or description contains this text")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	archives, err := loadArchives()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPROJECT\tSTATUS\tFINISHED\tTITLE")
+	shown := 0
+	for _, a := range archives {
+		t := a.Task
+		if *projectID != "" && t.ProjectID != *projectID {
+			continue
+		}
+		if *label != "" && !slices.Contains(t.Labels, strings.ToLower(*label)) {
+			continue
+		}
+		if *search != "" && !strings.Contains(strings.ToLower(t.Title+"\n"+t.Description), strings.ToLower(*search)) {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.ID, t.ProjectID, t.Status, a.finishedAt().Local().Format("2006-01-02"), t.Title)
+		shown++
+	}
+	if shown == 0 {
+		fmt.Println("No archived tasks")
+		return nil
+	}
+	return w.Flush()
+}
+
+// runArchiveShow implements `nerv-hook task archive show`
+func runArchiveShow(args []string) error {
+	fs := flag.NewFlagSet("task archive show", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the whole archive")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: nerv-hook task archive show [--json] <task-id>")
+	}
+	a, err := readTaskArchive(archivePath(fs.Arg(0)))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no archived task %s", fs.Arg(0))
+	} else if err != nil {
+		return err
+	}
+	if *asJSON {
+		return writeTaskArchive(os.Stdout, a)
+	}
+
+	t := a.Task
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", t.ID)
+	fmt.Fprintf(w, "Title:\t%s\n", t.Title)
+	fmt.Fprintf(w, "Status:\t%s\n", t.Status)
+	project := a.Project.ID
+	if a.Project.Name != "" {
+		project += " (" + a.Project.Name + ")"
+	}
+	fmt.Fprintf(w, "Project:\t%s\n", project)
+	if t.Priority != "" {
+		fmt.Fprintf(w, "Priority:\t%s\n", t.Priority)
+	}
+	if len(t.Labels) > 0 {
+		fmt.Fprintf(w, "Labels:\t%s\n", strings.Join(t.Labels, " "))
+	}
+	if t.Description != "" {
+		fmt.Fprintf(w, "Description:\t%s\n", t.Description)
+	}
+	if t.Branch != "" {
+		fmt.Fprintf(w, "Branch:\t%s\n", t.Branch)
+	}
+	fmt.Fprintf(w, "Finished:\t%s\n", a.finishedAt().Local().Format("2006-01-02 15:04"))
+	if a.Changes != nil {
+		fmt.Fprintf(w, "Files changed:\t%d\n", len(a.Changes.Files))
+	}
+	fmt.Fprintf(w, "Sessions:\t%d\n", len(a.Sessions))
+	fmt.Fprintf(w, "Approvals:\t%d\n", len(a.Approvals))
+	fmt.Fprintf(w, "Audit events:\t%d\n", len(a.Audit))
+	fmt.Fprintf(w, "Archived:\t%s\n", a.ExportedAt.Local().Format("2006-01-02 15:04"))
+	for _, sess := range a.Sessions {
+		if sess.TranscriptPath != "" {
+			fmt.Fprintf(w, "Transcript:\t%s\n", sess.TranscriptPath)
+		}
+	}
+	return w.Flush()
+}
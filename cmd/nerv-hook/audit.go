@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// runAudit implements `nerv-hook audit`, listing recent audit events
+// It opens the database read-only, so it is safe to hand to observers
+func runAudit(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	taskID := fs.String("task", "", "only events for this task")
+	eventType := fs.String("type", "", "only events of this type, e.g. approval_requested")
+	operator := fs.String("operator", "", "only events attributed to this operator")
+	limit := fs.Int("limit", 50, "maximum number of events to show (0 for all)")
+	asJSON := fs.Bool("json", false, "print the events as JSON, oldest first")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	// In team mode the audit log is for operators, of any role
+	if err := readAsOperator(st); err != nil {
+		return err
+	}
+
+	events, err := st.ListAudit(store.AuditFilter{TaskID: *taskID, EventType: *eventType, Operator: *operator, Limit: *limit})
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		out := make([]jsonEvent, 0, len(events))
+		for i := len(events) - 1; i >= 0; i-- {
+			out = append(out, eventJSON(events[i]))
+		}
+		return printJSON(out)
+	}
+	if len(events) == 0 {
+		fmt.Println("No audit events")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tTASK\tEVENT\tOPERATOR\tDETAILS")
+	// Oldest first, so the most recent event is next to the prompt
+	for i := len(events) - 1; i >= 0; i-- {
+		e := events[i]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Timestamp.Local().Format("2006-01-02 15:04:05"), e.TaskID, e.EventType, e.Operator, e.Details)
+	}
+	return w.Flush()
+}
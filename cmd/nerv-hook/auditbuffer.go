@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// auditBuffer holds the audit events of one hook event and writes them in a single transaction
+// Reads of the audit log flush first, so the handlers still see their own
+// events; so does queueing an approval, whose approval_requested event is
+// written with it and must stay after the events before it
+type auditBuffer struct {
+	Store
+
+	mu      sync.Mutex
+	pending []store.AuditEvent
+}
+
+// bufferAudit wraps db so its audit events wait for Flush
+func bufferAudit(db Store) *auditBuffer {
+	return &auditBuffer{Store: db}
+}
+
+func (b *auditBuffer) LogAudit(taskID, eventType, details string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending = append(b.pending, store.AuditEvent{TaskID: taskID, EventType: eventType, Details: details})
+	return nil
+}
+
+// Flush writes the pending events; on failure they're reported and dropped,
+// as a failed LogAudit would have been
+func (b *auditBuffer) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.pending) == 0 {
+		return
+	}
+	if err := b.Store.LogAuditBatch(b.pending); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to log %d audit events: %v\n", len(b.pending), err)
+	}
+	b.pending = nil
+}
+
+func (b *auditBuffer) ListAudit(f store.AuditFilter) ([]store.AuditEvent, error) {
+	b.Flush()
+	return b.Store.ListAudit(f)
+}
+
+func (b *auditBuffer) SessionEvents(sessionID string, limit int) ([]string, error) {
+	b.Flush()
+	return b.Store.SessionEvents(sessionID, limit)
+}
+
+func (b *auditBuffer) SessionHalted(sessionID string) (bool, error) {
+	b.Flush()
+	return b.Store.SessionHalted(sessionID)
+}
+
+func (b *auditBuffer) SessionTripped(sessionID string) (bool, error) {
+	b.Flush()
+	return b.Store.SessionTripped(sessionID)
+}
+
+func (b *auditBuffer) SessionRewrote(sessionID, rule string) (bool, error) {
+	b.Flush()
+	return b.Store.SessionRewrote(sessionID, rule)
+}
+
+func (b *auditBuffer) QueueApproval(a store.Approval, auditDetails func(approvalID int64) string) (int64, error) {
+	b.Flush()
+	return b.Store.QueueApproval(a, auditDetails)
+}
+
+func (b *auditBuffer) DecideApproval(id int64, status, denyReason string) (store.Approval, error) {
+	b.Flush()
+	return b.Store.DecideApproval(id, status, denyReason)
+}
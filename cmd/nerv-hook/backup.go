@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/migrations"
+	"github.com/nerv/nerv-hook/internal/store"
+	"modernc.org/sqlite"
+)
+
+// backupTimeFormat stamps backup file names; it sorts chronologically
+const backupTimeFormat = "20060102-150405"
+
+// backupStepPages is how many pages each backup step copies before yielding the lock
+const backupStepPages = 256
+
+// sqliteBackuper is implemented by modernc.org/sqlite driver connections
+type sqliteBackuper interface {
+	NewBackup(dstURI string) (*sqlite.Backup, error)
+	NewRestore(srcURI string) (*sqlite.Backup, error)
+}
+
+// backupDir is where backups go unless --dir is given
+func backupDir() string {
+	return filepath.Join(nervDir, "backups")
+}
+
+// runBackup implements `nerv-hook backup`
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	dir := fs.String("dir", backupDir(), "directory to write the backup to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	st, err := openRawStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	dbFile, configFile, err := backupState(st, *dir, time.Now())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("State database: %s\n", dbFile)
+	if configFile != "" {
+		fmt.Printf("Permissions:    %s\n", configFile)
+	}
+	return nil
+}
+
+// backupState copies the live database with SQLite's online backup API, so
+// hooks and the dashboard can keep writing while it runs, and copies the
+// permissions file alongside it
+// Returns the paths written; configFile is empty if there was no permissions file
+func backupState(st *store.DB, dir string, now time.Time) (dbFile, configFile string, err error) {
+	if st.Dialect() != migrations.SQLite {
+		return "", "", fmt.Errorf("backups are only supported for the SQLite state database; use pg_dump for NERV_DB_URL")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+
+	stamp := now.Format(backupTimeFormat)
+	dbFile = filepath.Join(dir, fmt.Sprintf("state-%s.db", stamp))
+	if _, err := os.Stat(dbFile); err == nil {
+		return "", "", fmt.Errorf("backup already exists: %s", dbFile)
+	}
+
+	err = withSQLiteConn(st.SQL(), func(c sqliteBackuper) error {
+		backup, err := c.NewBackup(dbFile)
+		if err != nil {
+			return err
+		}
+		return runBackupSteps(backup)
+	})
+	if err != nil {
+		os.Remove(dbFile)
+		return "", "", fmt.Errorf("failed to back up %s: %w", st.Location(), err)
+	}
+	if err := os.Chmod(dbFile, 0600); err != nil {
+		return "", "", err
+	}
+
+	data, err := os.ReadFile(configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return dbFile, "", nil
+	}
+	if err != nil {
+		return dbFile, "", err
+	}
+	configFile = filepath.Join(dir, fmt.Sprintf("permissions-%s.json", stamp))
+	if err := os.WriteFile(configFile, data, 0600); err != nil {
+		return dbFile, "", err
+	}
+
+	return dbFile, configFile, nil
+}
+
+// runRestore implements `nerv-hook restore <state-TIMESTAMP.db>`
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	force := fs.Bool("force", false, "overwrite the current state database")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: nerv-hook restore [--force] <backup.db>")
+	}
+	src := fs.Arg(0)
+
+	if err := checkBackup(src); err != nil {
+		return fmt.Errorf("%s is not a usable backup: %w", src, err)
+	}
+
+	// The matching permissions file, if the backup has one
+	configSrc := filepath.Join(filepath.Dir(src), fmt.Sprintf("permissions-%s.json", backupStamp(src)))
+	if _, err := os.Stat(configSrc); err != nil {
+		configSrc = ""
+	}
+
+	if !*force {
+		fmt.Printf("This replaces %s with %s\n", dbPath, src)
+		if configSrc != "" {
+			fmt.Printf("and %s with %s\n", configPath, configSrc)
+		}
+		return fmt.Errorf("pass --force to restore")
+	}
+
+	st, err := store.OpenSQLite(dbPath, "rwc", dbOptions())
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	// Keep what's being replaced, in case the wrong backup was picked
+	previous, _, err := backupState(st, backupDir(), time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to save the current state before restoring: %w", err)
+	}
+	fmt.Printf("Saved current state to %s\n", previous)
+
+	err = withSQLiteConn(st.SQL(), func(c sqliteBackuper) error {
+		restore, err := c.NewRestore(src)
+		if err != nil {
+			return err
+		}
+		return runBackupSteps(restore)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore %s: %w", src, err)
+	}
+	fmt.Printf("Restored %s\n", dbPath)
+
+	if configSrc != "" {
+		data, err := os.ReadFile(configSrc)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(configPath, data, 0600); err != nil {
+			return err
+		}
+		fmt.Printf("Restored %s\n", configPath)
+	}
+
+	// The restored database registers the permissions file as it was at backup time
+	if err := registerConfig(st); err != nil {
+		return fmt.Errorf("failed to register %s: %w", configPath, err)
+	}
+
+	return nil
+}
+
+// checkBackup verifies a backup file is an intact SQLite database
+func checkBackup(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite", store.SQLiteDSN(path, "ro"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+	return nil
+}
+
+// withSQLiteConn runs fn with the driver connection behind one pooled connection
+func withSQLiteConn(db *sql.DB, fn func(c sqliteBackuper) error) error {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(sqliteBackuper)
+		if !ok {
+			return fmt.Errorf("database driver does not support online backup")
+		}
+		return fn(c)
+	})
+}
+
+// runBackupSteps copies pages in batches until done, then releases the backup
+func runBackupSteps(b *sqlite.Backup) error {
+	for {
+		more, err := b.Step(backupStepPages)
+		if err != nil {
+			b.Finish()
+			return err
+		}
+		if !more {
+			return b.Finish()
+		}
+	}
+}
+
+// pruneBackups removes all but the newest keep database backups in dir, along
+// with their permissions files
+func pruneBackups(dir string, keep int) error {
+	matches, err := filepath.Glob(filepath.Join(dir, "state-*.db"))
+	if err != nil || len(matches) <= keep {
+		return err
+	}
+
+	// Timestamps sort lexically, so the oldest come first
+	sort.Strings(matches)
+	for _, dbFile := range matches[:len(matches)-keep] {
+		if err := os.Remove(dbFile); err != nil {
+			return err
+		}
+		os.Remove(filepath.Join(dir, fmt.Sprintf("permissions-%s.json", backupStamp(dbFile))))
+	}
+	return nil
+}
+
+// backupStamp returns the timestamp in a state-TIMESTAMP.db file name
+func backupStamp(dbFile string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(filepath.Base(dbFile), "state-"), ".db")
+}
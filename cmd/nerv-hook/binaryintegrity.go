@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// An agent that can replace nerv-hook can switch off every check, so install
+// records the binary's checksum in hookBinaryRecord, under NERV_DIR where agents
+// can't write, and each hook event compares the registered binary with it
+// The hook compares size and modification time, hashing only when they differ;
+// doctor and nervd always hash
+
+// hookBinaryRecord is the file install records the hook binary in
+func hookBinaryRecord() string {
+	return filepath.Join(nervDir, "hook-binary.json")
+}
+
+// binaryRecord is the hook binary as registered; the dashboard writes the same file
+type binaryRecord struct {
+	Path    string `json:"path"`
+	SHA256  string `json:"sha256"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time_ms"`
+}
+
+// readBinaryRecord returns the registered hook binary, or ok false if none is
+func readBinaryRecord() (binaryRecord, bool) {
+	var rec binaryRecord
+	data, err := os.ReadFile(hookBinaryRecord())
+	if err != nil || json.Unmarshal(data, &rec) != nil || rec.Path == "" {
+		return rec, false
+	}
+	return rec, true
+}
+
+// recordHookBinary registers path as the hook binary
+func recordHookBinary(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	data, _ := json.MarshalIndent(binaryRecord{Path: path, SHA256: sum, Size: info.Size(), ModTime: info.ModTime().UnixMilli()}, "", "  ")
+	if err := os.MkdirAll(nervDir, 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(hookBinaryRecord(), append(data, '\n'), 0600)
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkHookBinary returns what's wrong with the registered hook binary, or "" if
+// it's intact or none is registered
+// Unless always is set, a binary whose size and modification time still match isn't hashed
+func checkHookBinary(always bool) string {
+	rec, ok := readBinaryRecord()
+	if !ok {
+		return ""
+	}
+	info, err := os.Stat(rec.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Sprintf("the hook binary %s is missing", rec.Path)
+	} else if err != nil {
+		return fmt.Sprintf("the hook binary %s can't be checked: %v", rec.Path, err)
+	}
+	if !always && info.Size() == rec.Size && info.ModTime().UnixMilli() == rec.ModTime {
+		return ""
+	}
+	sum, err := fileSHA256(rec.Path)
+	if err != nil {
+		return fmt.Sprintf("the hook binary %s can't be checked: %v", rec.Path, err)
+	}
+	if sum != rec.SHA256 {
+		return fmt.Sprintf("the hook binary %s has changed since it was installed", rec.Path)
+	}
+	return ""
+}
+
+// binaryIntegrityDeny reports whether NERV_BINARY_INTEGRITY=deny or the strict profile,
+// which deny every tool call while the hook binary doesn't match; the default only warns
+// The variable is read from the environment, since the binary in question may be the one reading it
+func binaryIntegrityDeny() bool {
+	return os.Getenv("NERV_BINARY_INTEGRITY") == "deny" || checkConfigIntegrity(nil).strict()
+}
+
+// binaryTampered adds a changed hook binary to an event's output
+func binaryTampered(command string, output HookOutput, problem string) HookOutput {
+	fmt.Fprintf(os.Stderr, "Warning: %s\n", problem)
+	notice := "NERV: " + problem + "; if you upgraded it, run nerv-hook install"
+	if output.SystemMessage != "" {
+		notice = output.SystemMessage + ". " + notice
+	}
+	output.SystemMessage = notice
+	if command == "pre-tool-use" && binaryIntegrityDeny() {
+		output.HookSpecificOutput = nil
+		output.Decision = &Decision{Behavior: "deny", Message: "NERV's hook binary has changed since it was installed, so every tool call is denied. Ask the user to reinstall it"}
+	}
+	return output
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// boardStatuses are the board's columns, in workflow order
+// Abandoned tasks only get a column with --abandoned
+var boardStatuses = []string{store.TaskTodo, store.TaskInProgress, store.TaskInterrupted, store.TaskBlocked, store.TaskReview, store.TaskDone}
+
+// boardColors color each column's heading and selected card
+var boardColors = map[string]string{
+	store.TaskTodo:        "\x1b[90m",
+	store.TaskInProgress:  "\x1b[34m",
+	store.TaskInterrupted: "\x1b[33m",
+	store.TaskBlocked:     "\x1b[31m",
+	store.TaskReview:      "\x1b[35m",
+	store.TaskDone:        "\x1b[32m",
+	store.TaskAbandoned:   "\x1b[90m",
+}
+
+const (
+	ansiReset   = "\x1b[0m"
+	ansiBold    = "\x1b[1m"
+	ansiReverse = "\x1b[7m"
+	ansiYellow  = "\x1b[33m"
+)
+
+const boardHelp = "←↑↓→/hjkl move  enter details  s start  r review  a approvals  q quit"
+
+// board is the state of `nerv-hook board` between redraws
+type board struct {
+	st     *store.DB
+	filter store.TaskFilter
+	// dir is the repository tasks are started in; worktree starts them in their own worktree instead
+	dir      string
+	worktree bool
+
+	statuses []string
+	columns  map[string][]store.Task
+	pending  map[string][]store.Approval
+	loadedAt time.Time
+
+	col, row int
+	// selected is the selected task's ID, which keeps the selection on it as tasks move
+	selected string
+	message  string
+
+	// overlay is shown instead of the board until it's dismissed
+	overlay       []string
+	overlayScroll int
+}
+
+// runBoard implements `nerv-hook board`, a kanban of tasks that redraws as they change
+func runBoard(args []string) error {
+	fs := flag.NewFlagSet("board", flag.ContinueOnError)
+	filterFlags := addTaskFilterFlags(fs)
+	interval := fs.Duration("interval", 2*time.Second, "how often to check for changes")
+	abandoned := fs.Bool("abandoned", false, "add a column for abandoned tasks")
+	worktree := fs.Bool("worktree", false, "start tasks in their own git worktree instead of switching branches here")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("usage: nerv-hook board [--project ID] [--label L,...] [--priority P] [--filter NAME] [--interval D] [--abandoned] [--worktree]")
+	}
+	if *interval <= 0 {
+		return errors.New("--interval must be positive")
+	}
+
+	st, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	filter, err := filterFlags.resolve(st)
+	if err != nil {
+		return err
+	}
+	// Every status has its own column, so a saved filter's status doesn't apply
+	filter.Status = ""
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	b := &board{st: st, filter: filter, dir: dir, worktree: *worktree, statuses: boardStatuses}
+	if *abandoned {
+		b.statuses = append(append([]string{}, boardStatuses...), store.TaskAbandoned)
+	}
+	if err := b.load(); err != nil {
+		return err
+	}
+
+	restore, err := rawTerminal(os.Stdin, os.Stdout)
+	if err != nil {
+		return fmt.Errorf("the board needs an interactive terminal: %w", err)
+	}
+	defer restore()
+	// Alternate screen with the cursor hidden, undone on the way out
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	keys := make(chan string)
+	go readKeys(os.Stdin, keys)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		width, height, err := terminalSize(os.Stdout)
+		if err != nil {
+			width, height = 120, 40
+		}
+		var frame bytes.Buffer
+		b.render(&frame, width, height)
+		os.Stdout.Write(frame.Bytes())
+
+		select {
+		case key, ok := <-keys:
+			if !ok || b.handleKey(key) {
+				return nil
+			}
+		case <-ticker.C:
+			if err := b.load(); err != nil {
+				b.message = err.Error()
+			}
+		}
+	}
+}
+
+// readKeys sends each keypress read from in, named by parseKeys, until in closes
+func readKeys(in io.Reader, keys chan<- string) {
+	defer close(keys)
+	buf := make([]byte, 64)
+	for {
+		n, err := in.Read(buf)
+		for _, key := range parseKeys(buf[:n]) {
+			keys <- key
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// parseKeys names the keys in one read from a raw terminal: arrows as up, down,
+// left and right, enter, esc, quit for Ctrl-C, and other characters as themselves
+func parseKeys(data []byte) []string {
+	var keys []string
+	for len(data) > 0 {
+		switch {
+		case len(data) >= 3 && data[0] == 0x1b && (data[1] == '[' || data[1] == 'O'):
+			if key, ok := map[byte]string{'A': "up", 'B': "down", 'C': "right", 'D': "left"}[data[2]]; ok {
+				keys = append(keys, key)
+			}
+			data = data[3:]
+		case data[0] == 0x1b:
+			keys = append(keys, "esc")
+			data = data[1:]
+		case data[0] == '\r' || data[0] == '\n':
+			keys = append(keys, "enter")
+			data = data[1:]
+		case data[0] == 3:
+			keys = append(keys, "quit")
+			data = data[1:]
+		default:
+			keys = append(keys, string(data[0]))
+			data = data[1:]
+		}
+	}
+	return keys
+}
+
+// load reads the tasks and pending approvals and puts the selection back on the selected task
+func (b *board) load() error {
+	tasks, err := b.st.ListTasks(b.filter)
+	if err != nil {
+		return err
+	}
+	approvals, err := b.st.PendingApprovals()
+	if err != nil {
+		return err
+	}
+	b.setTasks(tasks, approvals)
+	b.loadedAt = time.Now()
+	return nil
+}
+
+// setTasks sorts tasks into columns and finds the selected task again
+func (b *board) setTasks(tasks []store.Task, approvals []store.Approval) {
+	b.columns = map[string][]store.Task{}
+	for _, t := range tasks {
+		b.columns[t.Status] = append(b.columns[t.Status], t)
+	}
+	// Most urgent first, oldest first within a priority
+	for _, column := range b.columns {
+		sort.SliceStable(column, func(i, j int) bool {
+			return store.PriorityRank(column[i].Priority) > store.PriorityRank(column[j].Priority)
+		})
+	}
+	b.pending = map[string][]store.Approval{}
+	for _, a := range approvals {
+		b.pending[a.TaskID] = append(b.pending[a.TaskID], a)
+	}
+
+	for col, status := range b.statuses {
+		for row, t := range b.columns[status] {
+			if t.ID == b.selected {
+				b.col, b.row = col, row
+				return
+			}
+		}
+	}
+	b.clampRow()
+}
+
+// clampRow keeps the selection inside the current column
+func (b *board) clampRow() {
+	column := b.columns[b.statuses[b.col]]
+	b.row = max(0, min(b.row, len(column)-1))
+	b.selected = ""
+	if len(column) > 0 {
+		b.selected = column[b.row].ID
+	}
+}
+
+// current returns the selected task, if the column has any
+func (b *board) current() (store.Task, bool) {
+	column := b.columns[b.statuses[b.col]]
+	if b.row < len(column) {
+		return column[b.row], true
+	}
+	return store.Task{}, false
+}
+
+// handleKey applies a keypress and reports whether the board should close
+func (b *board) handleKey(key string) bool {
+	if b.overlay != nil {
+		switch key {
+		case "up", "k":
+			b.overlayScroll = max(0, b.overlayScroll-1)
+		case "down", "j":
+			b.overlayScroll++
+		case "quit":
+			return true
+		default:
+			b.overlay = nil
+		}
+		return false
+	}
+
+	b.message = ""
+	switch key {
+	case "q", "quit":
+		return true
+	case "left", "h":
+		b.col = max(0, b.col-1)
+		b.clampRow()
+	case "right", "l":
+		b.col = min(len(b.statuses)-1, b.col+1)
+		b.clampRow()
+	case "up", "k":
+		b.row--
+		b.clampRow()
+	case "down", "j":
+		b.row++
+		b.clampRow()
+	case "enter":
+		if task, ok := b.current(); ok {
+			b.showOverlay(b.details(task))
+		}
+	case "s":
+		b.act(b.start)
+	case "r":
+		b.act(b.review)
+	case "a":
+		b.act(b.approvals)
+	}
+	return false
+}
+
+// act runs a quick action on the selected task, reporting failures on the status line,
+// and reloads so the board shows the result
+func (b *board) act(action func(store.Task) error) {
+	task, ok := b.current()
+	if !ok {
+		b.message = "No task selected"
+		return
+	}
+	if err := action(task); err != nil {
+		b.message = err.Error()
+	}
+	if err := b.load(); err != nil {
+		b.message = err.Error()
+	}
+}
+
+// start moves the task to in_progress the way `task start` does
+func (b *board) start(task store.Task) error {
+	if err := actAsOperator(b.st); err != nil {
+		return err
+	}
+	if task.Status == store.TaskInProgress {
+		return fmt.Errorf("task %s is already %s", task.ID, store.TaskInProgress)
+	}
+	if !store.CanTransition(task.Status, store.TaskInProgress) {
+		return &store.TransitionError{From: task.Status, To: store.TaskInProgress}
+	}
+	task, err := startTask(b.st, task, b.dir, b.worktree && task.WorktreePath == "", false)
+	if err != nil {
+		return err
+	}
+	b.selected = task.ID
+	b.message = fmt.Sprintf("Started %s; launch an agent with nerv-hook run %s", task.ID, task.ID)
+	return nil
+}
+
+// review shows the task's review bundle, first moving an in-progress task to review
+func (b *board) review(task store.Task) error {
+	switch task.Status {
+	case store.TaskReview:
+	case store.TaskInProgress:
+		if err := actAsOperator(b.st); err != nil {
+			return err
+		}
+		if err := moveTask(b.st, task, store.TaskReview); err != nil {
+			return err
+		}
+		task.Status = store.TaskReview
+		b.selected = task.ID
+	default:
+		return fmt.Errorf("task %s is %s; only tasks in progress or in review have a review", task.ID, task.Status)
+	}
+
+	bundle, err := taskReviewBundle(b.st, task, task.Status != store.TaskReview)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	printReviewBundle(&out, bundle, false)
+	fmt.Fprintf(&out, "\nApprove or reject with: nerv-hook task review --approve|--reject --notes TEXT %s\n", task.ID)
+	b.showOverlay(strings.Split(out.String(), "\n"))
+	return nil
+}
+
+// approvals lists the task's pending approval requests
+func (b *board) approvals(task store.Task) error {
+	pending := b.pending[task.ID]
+	if len(pending) == 0 {
+		b.message = fmt.Sprintf("No pending approvals for %s", task.ID)
+		return nil
+	}
+	lines := []string{fmt.Sprintf("%d pending approvals for %s %s", len(pending), task.ID, task.Title), ""}
+	for _, a := range pending {
+		lines = append(lines, fmt.Sprintf("#%d  %s  %s  (waiting %s)", a.ID, a.CreatedAt.Local().Format("15:04:05"), a.ToolName,
+			formatDuration(time.Since(a.CreatedAt))))
+		lines = append(lines, "    "+firstLine(a.ToolInput))
+	}
+	lines = append(lines, "", "Decide them in the dashboard or with nerv approve <id> / nerv deny <id>")
+	b.showOverlay(lines)
+	return nil
+}
+
+// details describes a task for the enter key
+func (b *board) details(task store.Task) []string {
+	lines := []string{
+		task.Title,
+		"",
+		"ID:        " + task.ID,
+		"Project:   " + task.ProjectID,
+		"Status:    " + task.Status,
+		"Created:   " + task.CreatedAt.Local().Format("2006-01-02 15:04"),
+	}
+	if task.Priority != "" {
+		lines = append(lines, "Priority:  "+task.Priority)
+	}
+	if len(task.Labels) > 0 {
+		lines = append(lines, "Labels:    "+strings.Join(task.Labels, " "))
+	}
+	if task.ParentID != "" {
+		lines = append(lines, "Parent:    "+task.ParentID)
+	}
+	if children, err := b.st.ListTasks(store.TaskFilter{ParentID: task.ID}); err == nil && len(children) > 0 {
+		lines = append(lines, "Subtasks:  "+describeProgress(children))
+	}
+	if task.Branch != "" {
+		lines = append(lines, "Branch:    "+task.Branch+" "+shortSHA(task.BranchHead))
+	}
+	if task.WorktreePath != "" {
+		lines = append(lines, "Worktree:  "+task.WorktreePath)
+	}
+	if n := len(b.pending[task.ID]); n > 0 {
+		lines = append(lines, fmt.Sprintf("Approvals: %d pending", n))
+	}
+	if task.Description != "" {
+		lines = append(lines, "")
+		lines = append(lines, strings.Split(task.Description, "\n")...)
+	}
+	return lines
+}
+
+func (b *board) showOverlay(lines []string) {
+	b.overlay = lines
+	b.overlayScroll = 0
+}
+
+// render draws a full frame, overwriting the previous one in place
+func (b *board) render(w io.Writer, width, height int) {
+	var lines []string
+	if b.overlay != nil {
+		lines = b.renderOverlay(width, height)
+	} else {
+		lines = b.renderBoard(width, height)
+	}
+	fmt.Fprint(w, "\x1b[H")
+	for i, line := range lines {
+		if i > 0 {
+			fmt.Fprint(w, "\r\n")
+		}
+		fmt.Fprint(w, line, "\x1b[K")
+	}
+	fmt.Fprint(w, "\x1b[J")
+}
+
+func (b *board) renderOverlay(width, height int) []string {
+	visible := max(1, height-2)
+	b.overlayScroll = max(0, min(b.overlayScroll, len(b.overlay)-visible))
+	lines := []string{ansiBold + truncate("↑↓ scroll, any other key to go back", width) + ansiReset, ""}
+	for _, line := range b.overlay[b.overlayScroll:min(len(b.overlay), b.overlayScroll+visible)] {
+		lines = append(lines, truncate(strings.ReplaceAll(line, "\t", "  "), width))
+	}
+	return lines
+}
+
+func (b *board) renderBoard(width, height int) []string {
+	title := fmt.Sprintf("NERV board: %s, updated %s", describeFilter(b.filter), b.loadedAt.Format("15:04:05"))
+	lines := []string{ansiBold + truncate(title, width) + ansiReset, ""}
+
+	colWidth := max(8, width/len(b.statuses))
+	var heading strings.Builder
+	for _, status := range b.statuses {
+		label := fmt.Sprintf("%s (%d)", strings.ToUpper(strings.ReplaceAll(status, "_", " ")), len(b.columns[status]))
+		heading.WriteString(boardColors[status] + ansiBold + pad(truncate(label, colWidth-1), colWidth) + ansiReset)
+	}
+	lines = append(lines, heading.String(), strings.Repeat("─", min(width, colWidth*len(b.statuses))))
+
+	// Scroll every column together so the selected card stays in view
+	visible := max(1, height-len(lines)-2)
+	offset := max(0, b.row-visible+1)
+	for row := offset; row < offset+visible; row++ {
+		var line strings.Builder
+		for col, status := range b.statuses {
+			column := b.columns[status]
+			if row >= len(column) {
+				line.WriteString(strings.Repeat(" ", colWidth))
+				continue
+			}
+			line.WriteString(b.card(column[row], colWidth, col == b.col && row == b.row))
+		}
+		lines = append(lines, line.String())
+	}
+
+	footer := boardHelp
+	if b.message != "" {
+		footer = b.message
+	}
+	return append(lines, "", truncate(footer, width))
+}
+
+// card is one task's cell: the random part of its ID, a count of pending approvals, and its title
+func (b *board) card(t store.Task, width int, selected bool) string {
+	id := t.ID
+	if _, suffix, ok := strings.Cut(id, "-"); ok {
+		id = suffix
+	}
+	badge := ""
+	if n := len(b.pending[t.ID]); n > 0 {
+		badge = fmt.Sprintf("!%d ", n)
+	}
+	text := pad(truncate(id+" "+priorityMarks[t.Priority]+badge+t.Title, width-1), width-1)
+	if selected {
+		return ansiReverse + boardColors[t.Status] + text + ansiReset + " "
+	}
+	if badge != "" {
+		// Color the badge without throwing off the padding
+		text = strings.Replace(text, badge, ansiYellow+badge+ansiReset, 1)
+	}
+	return text + " "
+}
+
+// priorityMarks flag the priorities worth noticing on a card
+var priorityMarks = map[string]string{store.PriorityHigh: "↑ ", store.PriorityUrgent: "⇈ "}
+
+// truncate cuts s to width characters, marking the cut with an ellipsis
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if width <= 0 {
+		return ""
+	}
+	if len(runes) <= width {
+		return s
+	}
+	return string(runes[:width-1]) + "…"
+}
+
+// pad fills s with spaces to width characters
+func pad(s string, width int) string {
+	if n := width - len([]rune(s)); n > 0 {
+		return s + strings.Repeat(" ", n)
+	}
+	return s
+}
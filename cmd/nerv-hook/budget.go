@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// ModelPrice is what a model costs in US dollars per million tokens
+type ModelPrice struct {
+	Input      float64 `json:"input"`
+	Output     float64 `json:"output"`
+	CacheWrite float64 `json:"cache_write"`
+	CacheRead  float64 `json:"cache_read"`
+}
+
+// defaultPrices are list prices keyed by a substring of the model name
+// pricing in permissions.json adds to or overrides them
+var defaultPrices = map[string]ModelPrice{
+	"opus":   {Input: 15, Output: 75, CacheWrite: 18.75, CacheRead: 1.5},
+	"sonnet": {Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3},
+	"haiku":  {Input: 0.8, Output: 4, CacheWrite: 1, CacheRead: 0.08},
+}
+
+// modelPrice returns the price for a model, preferring the longest matching key
+func modelPrice(prices map[string]ModelPrice, model string) (ModelPrice, bool) {
+	model = strings.ToLower(model)
+	best := ""
+	for key := range prices {
+		if strings.Contains(model, strings.ToLower(key)) && len(key) > len(best) {
+			best = key
+		}
+	}
+	price, ok := prices[best]
+	return price, ok && best != ""
+}
+
+// prices returns the built-in prices with the configured ones applied
+func (c Config) prices() map[string]ModelPrice {
+	prices := make(map[string]ModelPrice, len(defaultPrices)+len(c.Pricing))
+	for k, v := range defaultPrices {
+		prices[k] = v
+	}
+	for k, v := range c.Pricing {
+		prices[k] = v
+	}
+	return prices
+}
+
+// transcriptEntry is the part of a Claude transcript line that carries usage
+type transcriptEntry struct {
+	Message struct {
+		ID    string `json:"id"`
+		Model string `json:"model"`
+		Usage *struct {
+			InputTokens         int64 `json:"input_tokens"`
+			OutputTokens        int64 `json:"output_tokens"`
+			CacheCreationTokens int64 `json:"cache_creation_input_tokens"`
+			CacheReadTokens     int64 `json:"cache_read_input_tokens"`
+		} `json:"usage"`
+	} `json:"message"`
+}
+
+// transcriptUsage totals the tokens and cost of the assistant messages in a Claude transcript
+// Tokens are input, cache writes, and output; cache reads are cheap and repeat on every
+// turn, so they count toward the cost but not the tokens
+// A message split across several lines is counted once
+func transcriptUsage(path string, prices map[string]ModelPrice) (tokens int64, cost float64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry transcriptEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil || entry.Message.Usage == nil {
+			continue
+		}
+		if id := entry.Message.ID; id != "" {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+		}
+
+		u := entry.Message.Usage
+		tokens += u.InputTokens + u.CacheCreationTokens + u.OutputTokens
+		if price, ok := modelPrice(prices, entry.Message.Model); ok {
+			cost += (float64(u.InputTokens)*price.Input +
+				float64(u.OutputTokens)*price.Output +
+				float64(u.CacheCreationTokens)*price.CacheWrite +
+				float64(u.CacheReadTokens)*price.CacheRead) / 1e6
+		}
+	}
+	return tokens, cost, scanner.Err()
+}
+
+// recordTranscriptUsage reads the session's transcript and stores its token count and cost
+func recordTranscriptUsage(db Store, input HookInput) {
+	if db == nil || input.SessionID == "" || input.TranscriptPath == "" {
+		return
+	}
+	tokens, cost, err := transcriptUsage(input.TranscriptPath, loadConfig().prices())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read token usage from the transcript: %v\n", err)
+		return
+	}
+	if err := db.SetSessionUsage(input.SessionID, tokens, cost); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record token usage: %v\n", err)
+	}
+}
+
+// applicableBudgets returns the budgets that cover a task, the tasks it's a subtask of, and its project
+func applicableBudgets(db Store, projectID, taskID string) []store.Budget {
+	scopes := []struct{ kind, id string }{{store.BudgetTask, taskID}}
+	if taskID != "" {
+		if task, err := db.GetTask(taskID); err == nil {
+			for _, parent := range taskAncestors(db, task) {
+				scopes = append(scopes, struct{ kind, id string }{store.BudgetTask, parent.ID})
+			}
+		}
+	}
+	scopes = append(scopes, struct{ kind, id string }{store.BudgetProject, projectID})
+
+	var budgets []store.Budget
+	for _, scope := range scopes {
+		if scope.id == "" {
+			continue
+		}
+		b, err := db.GetBudget(scope.kind, scope.id)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load the %s budget: %v\n", scope.kind, err)
+			continue
+		}
+		budgets = append(budgets, b)
+	}
+	return budgets
+}
+
+// checkBudgets returns a message for the first budget the task or project has gone over, and
+// whether that budget stops the session
+// Token and cost figures are refreshed from the transcript first if a budget limits them
+func checkBudgets(db Store, projectID, taskID string, input HookInput) (string, bool) {
+	if db == nil {
+		return "", false
+	}
+	budgets := applicableBudgets(db, projectID, taskID)
+	for _, b := range budgets {
+		if b.MaxTokens > 0 || b.MaxCostUSD > 0 {
+			recordTranscriptUsage(db, input)
+			break
+		}
+	}
+
+	for _, b := range budgets {
+		usage, err := db.BudgetUsage(b.Scope, b.ScopeID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to total budget usage: %v\n", err)
+			continue
+		}
+		if over := budgetOverrun(b, usage); over != "" {
+			return fmt.Sprintf("NERV budget exceeded: %s %s has used %s. Raise the budget with nerv-hook budget set to continue.", b.Scope, b.ScopeID, over), b.OnExceed == store.BudgetStop
+		}
+	}
+	return "", false
+}
+
+// budgetOverrun describes the first limit usage has reached, or returns "" if none
+func budgetOverrun(b store.Budget, u store.Usage) string {
+	switch {
+	case b.MaxToolCalls > 0 && u.ToolCalls >= b.MaxToolCalls:
+		return fmt.Sprintf("%d of %d tool calls", u.ToolCalls, b.MaxToolCalls)
+	case b.MaxTokens > 0 && u.Tokens >= b.MaxTokens:
+		return fmt.Sprintf("%d of %d tokens", u.Tokens, b.MaxTokens)
+	case b.MaxCostUSD > 0 && u.CostUSD >= b.MaxCostUSD:
+		return fmt.Sprintf("$%.2f of $%.2f", u.CostUSD, b.MaxCostUSD)
+	}
+	return ""
+}
+
+const budgetUsage = "usage: nerv-hook budget set|show|clear"
+
+// runBudget implements `nerv-hook budget`
+func runBudget(args []string) error {
+	if len(args) < 1 {
+		return errors.New(budgetUsage)
+	}
+
+	switch args[0] {
+	case "set":
+		return runBudgetSet(args[1:])
+	case "show":
+		return runBudgetShow(args[1:])
+	case "clear":
+		return runBudgetClear(args[1:])
+	default:
+		return errors.New(budgetUsage)
+	}
+}
+
+// budgetScopeFlags adds --task and --project to a budget subcommand
+func budgetScopeFlags(fs *flag.FlagSet) func() (string, string, error) {
+	taskID := fs.String("task", "", "the task the budget covers")
+	projectID := fs.String("project", "", "the project the budget covers, across all its tasks")
+	return func() (string, string, error) {
+		switch {
+		case *taskID != "" && *projectID != "":
+			return "", "", errors.New("pass --task or --project, not both")
+		case *taskID != "":
+			return store.BudgetTask, *taskID, nil
+		case *projectID != "":
+			return store.BudgetProject, *projectID, nil
+		}
+		return "", "", nil
+	}
+}
+
+// runBudgetSet creates or replaces a task's or project's budget
+func runBudgetSet(args []string) error {
+	fs := flag.NewFlagSet("budget set", flag.ContinueOnError)
+	scope := budgetScopeFlags(fs)
+	tokens := fs.Int64("tokens", 0, "most tokens the sessions may use (input, cache writes, and output)")
+	dollars := fs.Float64("dollars", 0, "most the sessions may cost, in US dollars")
+	toolCalls := fs.Int64("tool-calls", 0, "most tool calls the sessions may make")
+	onExceed := fs.String("on-exceed", store.BudgetDeny, "deny further tool calls, or stop the session")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	kind, id, err := scope()
+	if err != nil {
+		return err
+	}
+	if kind == "" || fs.NArg() != 0 {
+		return errors.New("usage: nerv-hook budget set --task ID | --project ID [--tokens N] [--dollars N] [--tool-calls N] [--on-exceed deny|stop]")
+	}
+	if *tokens <= 0 && *dollars <= 0 && *toolCalls <= 0 {
+		return errors.New("give at least one of --tokens, --dollars, or --tool-calls")
+	}
+
+	st, err := openOperatorStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	if err := checkBudgetScope(st, kind, id); err != nil {
+		return err
+	}
+	b := store.Budget{Scope: kind, ScopeID: id, MaxTokens: *tokens, MaxCostUSD: *dollars, MaxToolCalls: *toolCalls, OnExceed: *onExceed}
+	if err := st.SetBudget(b); err != nil {
+		return err
+	}
+	details, _ := json.Marshal(map[string]interface{}{
+		"scope": kind, "scope_id": id, "max_tokens": *tokens, "max_cost_usd": *dollars, "max_tool_calls": *toolCalls, "on_exceed": *onExceed,
+	})
+	taskID := ""
+	if kind == store.BudgetTask {
+		taskID = id
+	}
+	if err := st.LogAudit(taskID, "budget_set", string(details)); err != nil {
+		return err
+	}
+	fmt.Printf("Set the budget for %s %s\n", kind, id)
+	return nil
+}
+
+// checkBudgetScope makes sure the task or project a budget names exists
+func checkBudgetScope(st *store.DB, kind, id string) error {
+	var err error
+	if kind == store.BudgetTask {
+		_, err = loadTask(st, id)
+		return err
+	}
+	if _, err = st.GetProject(id); errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("project not found: %s", id)
+	}
+	return err
+}
+
+// runBudgetShow prints budgets alongside what has been used against them
+func runBudgetShow(args []string) error {
+	fs := flag.NewFlagSet("budget show", flag.ContinueOnError)
+	scope := budgetScopeFlags(fs)
+	asJSON := fs.Bool("json", false, "print the budgets and their usage as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	kind, id, err := scope()
+	if err != nil {
+		return err
+	}
+
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	var budgets []store.Budget
+	if kind != "" {
+		b, err := st.GetBudget(kind, id)
+		if errors.Is(err, store.ErrNotFound) {
+			return fmt.Errorf("%s %s has no budget", kind, id)
+		} else if err != nil {
+			return err
+		}
+		budgets = append(budgets, b)
+	} else if budgets, err = st.ListBudgets(); err != nil {
+		return err
+	}
+	if *asJSON {
+		out := make([]jsonBudget, 0, len(budgets))
+		for _, b := range budgets {
+			u, err := st.BudgetUsage(b.Scope, b.ScopeID)
+			if err != nil {
+				return err
+			}
+			out = append(out, jsonBudget{
+				Scope: b.Scope, ScopeID: b.ScopeID, MaxToolCalls: b.MaxToolCalls, MaxTokens: b.MaxTokens, MaxCostUSD: b.MaxCostUSD, OnExceed: b.OnExceed,
+				Used: jsonUsage{Sessions: u.Sessions, ToolCalls: u.ToolCalls, Tokens: u.Tokens, CostUSD: u.CostUSD},
+			})
+		}
+		return printJSON(out)
+	}
+	if len(budgets) == 0 {
+		fmt.Println("No budgets")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SCOPE\tID\tTOOL CALLS\tTOKENS\tCOST\tON EXCEED")
+	for _, b := range budgets {
+		u, err := st.BudgetUsage(b.Scope, b.ScopeID)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", b.Scope, b.ScopeID,
+			budgetCell(fmt.Sprint(u.ToolCalls), b.MaxToolCalls > 0, fmt.Sprint(b.MaxToolCalls)),
+			budgetCell(fmt.Sprint(u.Tokens), b.MaxTokens > 0, fmt.Sprint(b.MaxTokens)),
+			budgetCell(fmt.Sprintf("$%.2f", u.CostUSD), b.MaxCostUSD > 0, fmt.Sprintf("$%.2f", b.MaxCostUSD)),
+			b.OnExceed)
+	}
+	return w.Flush()
+}
+
+// budgetCell shows usage against a limit, or the usage alone if there is no limit
+func budgetCell(used string, limited bool, max string) string {
+	if !limited {
+		return used
+	}
+	return used + " / " + max
+}
+
+// runBudgetClear removes a task's or project's budget
+func runBudgetClear(args []string) error {
+	fs := flag.NewFlagSet("budget clear", flag.ContinueOnError)
+	scope := budgetScopeFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	kind, id, err := scope()
+	if err != nil {
+		return err
+	}
+	if kind == "" || fs.NArg() != 0 {
+		return errors.New("usage: nerv-hook budget clear --task ID | --project ID")
+	}
+
+	st, err := openOperatorStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	if err := st.DeleteBudget(kind, id); errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("%s %s has no budget", kind, id)
+	} else if err != nil {
+		return err
+	}
+	fmt.Printf("Cleared the budget for %s %s\n", kind, id)
+	return nil
+}
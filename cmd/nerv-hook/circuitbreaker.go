@@ -0,0 +1,134 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// CircuitBreakerConfig escalates a session that keeps running into denials,
+// which wastes its budget and can be a sign of prompt injection: the user is
+// told, the session's task is marked blocked, and the session may be stopped
+// It trips on its own count of denials in a window, unlike the consecutive
+// denials that always halt a session
+type CircuitBreakerConfig struct {
+	// Denials is how many denials in the window trip the breaker (default 10)
+	Denials int `json:"denials,omitempty"`
+	// SameSignature is how many denials of the same call trip it sooner (default 3)
+	SameSignature int `json:"same_signature,omitempty"`
+	// Window is how far back denials are counted, e.g. "10m" (default)
+	Window string `json:"window,omitempty"`
+	// Stop also ends the session, with continue=false
+	Stop bool `json:"stop,omitempty"`
+}
+
+// Validate reports circuit breaker settings that can't be applied
+func (c *CircuitBreakerConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Denials < 0 || c.SameSignature < 0 {
+		return errors.New("denials and same_signature can't be negative")
+	}
+	_, err := c.window()
+	return err
+}
+
+func (c *CircuitBreakerConfig) denials() int {
+	if c.Denials == 0 {
+		return 10
+	}
+	return c.Denials
+}
+
+func (c *CircuitBreakerConfig) sameSignature() int {
+	if c.SameSignature == 0 {
+		return 3
+	}
+	return c.SameSignature
+}
+
+// defaultBreakerWindow is the window denials are counted in unless one is configured
+const defaultBreakerWindow = "10m"
+
+func (c *CircuitBreakerConfig) window() (time.Duration, error) {
+	d, err := time.ParseDuration(cmp.Or(c.Window, defaultBreakerWindow))
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("window: %q is not a positive duration", c.Window)
+	}
+	return d, nil
+}
+
+// tripCircuitBreaker records a denied call and trips the breaker if the
+// session has now reached a limit, returning a notice for the user and whether
+// to stop the session
+// It trips once per session, the first time a limit is reached or passed, so
+// denials recorded at the same moment can't carry a session past it unseen. A
+// trip that stops the session halts it, as consecutive denials do
+func tripCircuitBreaker(db Store, taskID string, input HookInput, signature string) (string, bool) {
+	cfg := loadConfig().CircuitBreaker
+	if cfg == nil || db == nil || input.SessionID == "" {
+		return "", false
+	}
+	// An invalid window is skipped; doctor reports it
+	window, err := cfg.window()
+	if err != nil {
+		return "", false
+	}
+	now := time.Now()
+	if err := db.LogDenial(input.SessionID, signature, now); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record the denial: %v\n", err)
+		return "", false
+	}
+	signatures, err := db.DenialsSince(input.SessionID, now.Add(-window))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to count denials: %v\n", err)
+		return "", false
+	}
+	same := 0
+	for _, s := range signatures {
+		if s == signature {
+			same++
+		}
+	}
+	if len(signatures) < cfg.denials() && same < cfg.sameSignature() {
+		return "", false
+	}
+	if tripped, err := db.SessionTripped(input.SessionID); err != nil || tripped {
+		return "", false
+	}
+
+	notice := fmt.Sprintf("NERV circuit breaker: %d denied tool calls in the last %s, %d of them %s", len(signatures), cmp.Or(cfg.Window, defaultBreakerWindow), same, signature)
+	if taskID != "" {
+		if _, err := db.SetTaskStatus(taskID, store.TaskInProgress, store.TaskBlocked, "hook"); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to block the task: %v\n", err)
+		}
+		notice += "; the task is blocked for review"
+	}
+	if cfg.Stop {
+		notice += " and the session is stopped"
+	}
+	logAudit(db, taskID, "circuit_breaker_tripped", fmt.Sprintf(`{"session_id":%q,"denials":%d,"same_signature":%d,"signature":%q,"stopped":%t,"severity":"high"}`,
+		input.SessionID, len(signatures), same, signature, cfg.Stop))
+	if cfg.Stop {
+		logAudit(db, taskID, "session_halted", fmt.Sprintf(`{"session_id":%q,"denials":%d,"circuit_breaker":true}`, input.SessionID, len(signatures)))
+	}
+	fmt.Fprintln(os.Stderr, notice)
+	return notice, cfg.Stop
+}
+
+// joinNotices joins the non-empty notices for the user into one message
+func joinNotices(notices ...string) string {
+	var kept []string
+	for _, n := range notices {
+		if n != "" {
+			kept = append(kept, n)
+		}
+	}
+	return strings.Join(kept, ". ")
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+	"github.com/nerv/nerv-hook/pkg/approvals"
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// Transcript visibility levels for NERV output
+const (
+	// visibilityFull shows decision messages to the model and notes to the user
+	visibilityFull = "full"
+	// visibilityQuiet hides the hook output from the transcript but keeps model-facing messages
+	visibilityQuiet = "quiet"
+	// visibilityHidden also strips rule details and user notes, so the model only sees the outcome
+	visibilityHidden = "hidden"
+)
+
+// hiddenDenyMessage replaces deny messages when visibility is hidden
+const hiddenDenyMessage = "Denied by NERV policy"
+
+// Config is the hook configuration file (permissions.json)
+// Permission rules sit at the top level for compatibility; other sections are optional
+type Config struct {
+	policy.Rules
+
+	// SchemaVersion is the file's format; files without one are version 1
+	SchemaVersion int `json:"schema_version,omitempty"`
+
+	// Transcript maps a hook event (pre-tool-use, post-tool-use, stop) to its visibility
+	Transcript map[string]string `json:"transcript,omitempty"`
+
+	// Replication streams the state database to object storage while nervd runs
+	Replication *ReplicationConfig `json:"replication,omitempty"`
+
+	// Database controls how the state database is laid out
+	Database *DatabaseConfig `json:"database,omitempty"`
+
+	// Pricing sets model prices for budgets, keyed by part of the model name, e.g. "sonnet"
+	Pricing map[string]ModelPrice `json:"pricing,omitempty"`
+
+	// Tasks controls what nerv-hook task does in git and how nerv-hook run launches sessions
+	Tasks *TaskConfig `json:"tasks,omitempty"`
+
+	// GitHub connects projects to repositories for issue and pull request sync
+	GitHub *GitHubConfig `json:"github,omitempty"`
+
+	// Verify lists the commands that check a task's work before it goes to review
+	Verify *VerifyConfig `json:"verify,omitempty"`
+
+	// Trackers connects projects to Linear and Jira, which stay the source of truth for their tickets
+	Trackers *TrackersConfig `json:"trackers,omitempty"`
+
+	// Webhooks are sent task status changes by nervd
+	Webhooks []WebhookConfig `json:"webhooks,omitempty"`
+
+	// Notifiers tell people and services about task status changes; webhooks are one kind
+	Notifiers []NotifierConfig `json:"notifiers,omitempty"`
+
+	// Audit controls which tool calls are recorded
+	Audit *AuditConfig `json:"audit,omitempty"`
+
+	// Input limits the size of hook events and of the tool inputs stored from them
+	Input *InputConfig `json:"input,omitempty"`
+
+	// Approvals controls how often a hook waiting on an approval checks for the decision
+	Approvals *ApprovalConfig `json:"approvals,omitempty"`
+
+	// Sandbox runs some Bash commands in a container instead of on the host
+	Sandbox *SandboxConfig `json:"sandbox,omitempty"`
+
+	// RateLimits cap how often a session may call tools, e.g. 20 Bash calls a minute
+	RateLimits []RateLimitConfig `json:"rate_limits,omitempty"`
+
+	// Rewrites change dangerous arguments of Bash commands instead of denying them
+	Rewrites []RewriteRule `json:"rewrites,omitempty"`
+
+	// SensitiveFiles adjusts how reads of sensitive files, such as SSH keys and .env files, are guarded
+	SensitiveFiles *SensitiveFilesConfig `json:"sensitive_files,omitempty"`
+	// RedirectWrites sends writes outside the project into a directory of the session's own, reported when it stops
+	RedirectWrites *RedirectConfig `json:"redirect_writes,omitempty"`
+
+	// Tripwires are decoy paths; any tool call touching one is denied and raised as critical
+	Tripwires []string `json:"tripwires,omitempty"`
+
+	// CircuitBreaker escalates a session that keeps being denied, e.g. 3 denials of the same call in 10 minutes
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker,omitempty"`
+
+	// Anomalies alerts on activity that's unusual for a project, such as a tool it has never used
+	Anomalies *AnomalyConfig `json:"anomalies,omitempty"`
+
+	// Updates points nerv-hook self-update at another release feed
+	Updates *UpdatesConfig `json:"updates,omitempty"`
+
+	// Plugins are programs that check tool calls after NERV's own checks, and can ask about or deny them
+	Plugins []PluginConfig `json:"plugins,omitempty"`
+
+	// Scripts are programs run after some decisions, such as a denial, for side effects like paging someone
+	Scripts *ScriptsConfig `json:"scripts,omitempty"`
+
+	// Serve configures nerv-hook serve, the HTTP API, and how people sign in to it
+	Serve *ServeConfig `json:"serve,omitempty"`
+}
+
+// ApprovalConfig spaces out the checks a hook makes while it waits for an approval
+// Checks start at PollInterval and back off to PollMax, with jitter
+type ApprovalConfig struct {
+	// PollInterval is the first wait, e.g. "100ms"
+	PollInterval string `json:"poll_interval,omitempty"`
+	// PollMax is the longest wait between checks, e.g. "3s"
+	PollMax string `json:"poll_max,omitempty"`
+	// FailClosed denies a tool that needs approval when the request can't be queued,
+	// e.g. because the database is unavailable (default true); false allows it
+	FailClosed *bool `json:"fail_closed,omitempty"`
+	// Preview dry-runs a Bash command that needs approval, where it has a dry-run
+	// form such as git push --dry-run, and adds what it predicts to the approval's context
+	Preview bool `json:"preview,omitempty"`
+	// MaxPendingPerSession denies a session's calls that need approval while it has this many waiting (default no limit)
+	MaxPendingPerSession int `json:"max_pending_per_session,omitempty"`
+	// MaxPendingPerProject is MaxPendingPerSession for all of a project's tasks together
+	MaxPendingPerProject int `json:"max_pending_per_project,omitempty"`
+}
+
+// preview reports whether Bash commands needing approval get a dry run
+func (c *ApprovalConfig) preview() bool {
+	return c != nil && c.Preview
+}
+
+// failClosed reports whether an approval that can't be queued denies the tool
+func (c *ApprovalConfig) failClosed() bool {
+	return c == nil || c.FailClosed == nil || *c.FailClosed
+}
+
+// backoff converts the settings for approvals.WaitBackoff; a nil config means the defaults
+func (c *ApprovalConfig) backoff() (approvals.Backoff, error) {
+	b := approvals.DefaultBackoff
+	if c == nil {
+		return b, nil
+	}
+	for _, field := range []struct {
+		name  string
+		value string
+		set   *time.Duration
+	}{{"poll_interval", c.PollInterval, &b.Initial}, {"poll_max", c.PollMax, &b.Max}} {
+		if field.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(field.value)
+		if err != nil || d <= 0 {
+			return b, fmt.Errorf("%s: %q is not a positive duration", field.name, field.value)
+		}
+		*field.set = d
+	}
+	if b.Max < b.Initial {
+		return b, errors.New("poll_max is shorter than poll_interval")
+	}
+	return b, nil
+}
+
+// Validate reports approval settings that can't be applied
+func (c *ApprovalConfig) Validate() error {
+	if c != nil && (c.MaxPendingPerSession < 0 || c.MaxPendingPerProject < 0) {
+		return errors.New("max_pending_per_session and max_pending_per_project can't be negative")
+	}
+	_, err := c.backoff()
+	return err
+}
+
+// projectConfigFile is a repository's own NERV settings, relative to its root
+const projectConfigFile = ".nerv/permissions.json"
+
+// ProjectConfig is a registered repository's .nerv/permissions.json, written by project init
+// It can only add to the config file: its rules follow the global ones, where deny still wins
+type ProjectConfig struct {
+	policy.Rules
+
+	// Verify is the project's verification commands, used unless verify.projects in the config file lists some
+	Verify []string `json:"verify,omitempty"`
+}
+
+// loadProjectConfig merges the .nerv/permissions.json files of a project's registered directories
+// Files outside registered directories are never read, so a cloned repository can't grant itself rules
+func loadProjectConfig(db Store, projectID string) ProjectConfig {
+	var merged ProjectConfig
+	if db == nil || projectID == "" {
+		return merged
+	}
+	repos, err := db.ListRepos(projectID)
+	if err != nil {
+		return merged
+	}
+	for _, r := range repos {
+		cfg, err := readProjectConfig(r.Path)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				fmt.Fprintf(os.Stderr, "Ignoring %s: %v\n", filepath.Join(r.Path, projectConfigFile), err)
+			}
+			continue
+		}
+		merged.Allow = append(merged.Allow, cfg.Allow...)
+		merged.Deny = append(merged.Deny, cfg.Deny...)
+		merged.Verify = append(merged.Verify, cfg.Verify...)
+	}
+	return merged
+}
+
+// readProjectConfig reads the .nerv/permissions.json in dir
+func readProjectConfig(dir string) (ProjectConfig, error) {
+	var cfg ProjectConfig
+	data, err := os.ReadFile(filepath.Join(dir, projectConfigFile))
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, json.Unmarshal(data, &cfg)
+}
+
+// TaskConfig holds settings for the task commands
+type TaskConfig struct {
+	// BranchTemplate names the branch created when a task starts, e.g. nerv/{task_id}-{slug}
+	// Placeholders: {task_id}, {project_id}, {slug} (from the title)
+	BranchTemplate string `json:"branch_template,omitempty"`
+	// MaxConcurrent caps how many agent sessions nerv-hook run and nervd's queue keep going at once
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+	// MaxPerProject caps the sessions nervd's queue runs for any one project (0 means only MaxConcurrent applies)
+	MaxPerProject int `json:"max_per_project,omitempty"`
+	// ProjectLimits overrides MaxPerProject for individual projects, keyed by project ID
+	ProjectLimits map[string]int `json:"project_limits,omitempty"`
+	// QuietHours is when nervd's queue launches nothing, in local time
+	QuietHours *QuietHours `json:"quiet_hours,omitempty"`
+}
+
+// QuietHours is a daily window given as HH:MM times; a window may wrap past midnight
+type QuietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// projectLimit returns the queue's session cap for a project, or 0 if there is none
+func (c *TaskConfig) projectLimit(projectID string) int {
+	if c == nil {
+		return 0
+	}
+	if limit, ok := c.ProjectLimits[projectID]; ok {
+		return limit
+	}
+	return c.MaxPerProject
+}
+
+// quietHours returns the configured quiet hours, or nil if there are none
+func (c *TaskConfig) quietHours() *QuietHours {
+	if c == nil {
+		return nil
+	}
+	return c.QuietHours
+}
+
+// window returns the start and end as minutes after midnight
+func (q *QuietHours) window() (start, end int, err error) {
+	if start, err = parseClock(q.Start); err != nil {
+		return 0, 0, fmt.Errorf("quiet_hours start: %w", err)
+	}
+	if end, err = parseClock(q.End); err != nil {
+		return 0, 0, fmt.Errorf("quiet_hours end: %w", err)
+	}
+	return start, end, nil
+}
+
+// active reports whether t falls inside the quiet hours
+// Unset or invalid quiet hours are never active; doctor reports invalid ones
+func (q *QuietHours) active(t time.Time) bool {
+	if q == nil {
+		return false
+	}
+	start, end, err := q.window()
+	if err != nil || start == end {
+		return false
+	}
+	now := t.Hour()*60 + t.Minute()
+	if start < end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+// parseClock parses an HH:MM time of day into minutes after midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an HH:MM time", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Validate reports task settings that can't be applied
+func (c *TaskConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.MaxConcurrent < 0 || c.MaxPerProject < 0 {
+		return errors.New("max_concurrent and max_per_project can't be negative")
+	}
+	for id, limit := range c.ProjectLimits {
+		if limit < 0 {
+			return fmt.Errorf("project_limits: %s can't be negative", id)
+		}
+	}
+	if c.QuietHours != nil {
+		if _, _, err := c.QuietHours.window(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// branchTemplate returns the configured branch template or the default
+func (c *TaskConfig) branchTemplate() string {
+	if c == nil || c.BranchTemplate == "" {
+		return defaultBranchTemplate
+	}
+	return c.BranchTemplate
+}
+
+// maxConcurrent returns the configured run cap or the default
+func (c *TaskConfig) maxConcurrent() int {
+	if c == nil || c.MaxConcurrent <= 0 {
+		return defaultMaxConcurrent
+	}
+	return c.MaxConcurrent
+}
+
+// DatabaseConfig holds state database settings
+type DatabaseConfig struct {
+	// PerProject gives each project its own SQLite database for audit events;
+	// tasks and approvals stay in the global database the dashboard reads
+	PerProject bool `json:"per_project,omitempty"`
+
+	// MaxOpenConns and MaxIdleConns size each process's connection pool
+	MaxOpenConns int `json:"max_open_conns,omitempty"`
+	MaxIdleConns int `json:"max_idle_conns,omitempty"`
+	// JournalMode is the SQLite journal mode (default wal)
+	JournalMode string `json:"journal_mode,omitempty"`
+	// Synchronous is the SQLite synchronous level: off, normal, full, or extra
+	Synchronous string `json:"synchronous,omitempty"`
+}
+
+// options converts the settings for the store; a nil config means the defaults
+func (c *DatabaseConfig) options() store.Options {
+	if c == nil {
+		return store.Options{}
+	}
+	return store.Options{
+		MaxOpenConns: c.MaxOpenConns,
+		MaxIdleConns: c.MaxIdleConns,
+		JournalMode:  c.JournalMode,
+		Synchronous:  c.Synchronous,
+	}
+}
+
+// dbOptions returns the configured connection settings, applied to every state database this process opens
+func dbOptions() store.Options {
+	return loadConfig().Database.options()
+}
+
+// ReplicationConfig points litestream at an S3-compatible replica
+// Credentials come from the environment (AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY), never the file
+type ReplicationConfig struct {
+	// URL is the replica location, e.g. s3://bucket/nerv/state.db
+	URL string `json:"url"`
+	// Endpoint is set for S3-compatible services such as MinIO, R2, or B2
+	Endpoint string `json:"endpoint,omitempty"`
+	Region   string `json:"region,omitempty"`
+	// SyncInterval is how often WAL changes are shipped, e.g. "1s" (litestream's default)
+	SyncInterval string `json:"sync_interval,omitempty"`
+	// Litestream is the path to the litestream binary; defaults to looking it up on PATH
+	Litestream string `json:"litestream,omitempty"`
+}
+
+// validate reports the first section of the config that can't be applied, and why
+func (cfg Config) validate() (string, error) {
+	if cfg.SchemaVersion > configSchemaVersion {
+		return "schema_version", fmt.Errorf("schema version %d is newer than this nerv-hook supports (%d); upgrade nerv-hook", cfg.SchemaVersion, configSchemaVersion)
+	}
+	if cfg.Profile != "" && cfg.Profile != policy.ProfileStrict {
+		return "profile", fmt.Errorf("unknown profile %q (want strict)", cfg.Profile)
+	}
+	for _, s := range []struct {
+		section string
+		err     error
+	}{
+		{"database", cfg.Database.options().Validate()},
+		{"tasks", cfg.Tasks.Validate()},
+		{"verify", cfg.Verify.Validate()},
+		{"github", cfg.GitHub.Validate()},
+		{"trackers", cfg.Trackers.Validate()},
+		{"input", cfg.Input.Validate()},
+		{"approvals", cfg.Approvals.Validate()},
+		{"sandbox", cfg.Sandbox.Validate()},
+		{"sensitive_files", cfg.SensitiveFiles.Validate()},
+		{"redirect_writes", cfg.RedirectWrites.Validate()},
+		{"circuit_breaker", cfg.CircuitBreaker.Validate()},
+		{"anomalies", cfg.Anomalies.Validate()},
+		{"updates", cfg.Updates.Validate()},
+		{"rewrites", validateRewrites(cfg.Rewrites)},
+		{"rate_limits", validateRateLimits(cfg.RateLimits)},
+		{"webhooks", validateWebhooks(cfg.Webhooks)},
+		{"notifiers", validateNotifiers(cfg)},
+		{"plugins", validatePlugins(cfg.Plugins)},
+		{"scripts", cfg.Scripts.Validate()},
+		{"serve", cfg.Serve.Validate()},
+	} {
+		if s.err != nil {
+			return s.section, s.err
+		}
+	}
+	return "", nil
+}
+
+// loadConfig loads the hook configuration, falling back to defaults if the file is missing or invalid
+// An installed org policy is merged in either way
+func loadConfig() Config {
+	data, _ := os.ReadFile(configPath)
+	return parseConfig(data)
+}
+
+// parseConfig parses a permissions file's contents and merges in the org policy
+func parseConfig(data []byte) Config {
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		cfg = Config{Rules: policy.Default()}
+	}
+	return withOrgPolicy(cfg)
+}
+
+// transcriptVisibility returns the configured visibility for an event, defaulting to full
+func (c Config) transcriptVisibility(event string) string {
+	switch v := c.Transcript[event]; v {
+	case visibilityQuiet, visibilityHidden:
+		return v
+	default:
+		return visibilityFull
+	}
+}
+
+// applyTranscriptVisibility adjusts an output so it only reveals what the visibility allows
+// Decisions themselves are never changed, only what is said about them
+func applyTranscriptVisibility(output HookOutput, visibility string) HookOutput {
+	switch visibility {
+	case visibilityQuiet:
+		output.SuppressOutput = true
+	case visibilityHidden:
+		output.SuppressOutput = true
+		output.SystemMessage = ""
+		if output.Decision != nil && output.Decision.Message != "" {
+			decision := *output.Decision
+			if decision.Behavior == "allow" {
+				decision.Message = ""
+			} else {
+				decision.Message = hiddenDenyMessage
+			}
+			output.Decision = &decision
+		}
+	}
+	return output
+}
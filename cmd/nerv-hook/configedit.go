@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// `nerv-hook config` reads and changes the permissions file a key at a time,
+// so scripts don't have to edit its JSON. A key is a dotted path of the file's
+// JSON names, such as approvals.poll_max; a leading "permissions." names the
+// file itself, so permissions.allow is the allow list
+// A change is checked as doctor would check it before it's written, and the
+// file is replaced in one rename and registered, as saved by a person
+
+const configUsage = "usage: nerv-hook config get <key>|set <key> <value>|unset <key>|validate [FILE]|schema"
+
+// runConfig implements `nerv-hook config`
+func runConfig(args []string) error {
+	if len(args) < 1 {
+		return errors.New(configUsage)
+	}
+	if args[0] == "validate" {
+		return runConfigValidate(args[1:])
+	}
+
+	fs := flag.NewFlagSet("config "+args[0], flag.ContinueOnError)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	switch {
+	case args[0] == "get" && fs.NArg() == 1:
+		return runConfigGet(fs.Arg(0))
+	case args[0] == "set" && fs.NArg() == 2:
+		return runConfigEdit(fs.Arg(0), fs.Arg(1), false)
+	case args[0] == "unset" && fs.NArg() == 1:
+		return runConfigEdit(fs.Arg(0), "", true)
+	case args[0] == "schema" && fs.NArg() == 0:
+		_, err := os.Stdout.Write(permissionsSchema)
+		return err
+	default:
+		return errors.New(configUsage)
+	}
+}
+
+// configKey splits a key into the JSON names it's a path of
+func configKey(key string) ([]string, error) {
+	path := strings.Split(strings.TrimPrefix(key, "permissions."), ".")
+	if key == "" || key == "permissions" || slices.Contains(path, "") {
+		return nil, fmt.Errorf("%q is not a key such as approvals.poll_max", key)
+	}
+	return path, nil
+}
+
+// configKeyType returns the type of the setting a key names, checking every
+// part of it names a setting the hook reads
+// Below a map, any name is a key of the map
+func configKeyType(path []string) (reflect.Type, error) {
+	t := reflect.TypeOf(Config{})
+	for i, name := range path {
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Map:
+			t = t.Elem()
+		case reflect.Struct:
+			field, ok := jsonField(t, name)
+			if !ok {
+				return nil, fmt.Errorf("%s has no setting %s (it has %s)", configParent(path[:i]), name, strings.Join(jsonNames(t), ", "))
+			}
+			t = field
+		default:
+			return nil, fmt.Errorf("%s is a single value, with no settings under it", configParent(path[:i]))
+		}
+	}
+	return t, nil
+}
+
+func configParent(path []string) string {
+	if len(path) == 0 {
+		return "the permissions file"
+	}
+	return strings.Join(path, ".")
+}
+
+// jsonField finds a struct's field by its JSON name, looking through embedded structs
+func jsonField(t reflect.Type, name string) (reflect.Type, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			if ft, ok := jsonField(f.Type, name); ok {
+				return ft, true
+			}
+			continue
+		}
+		if jsonName(f) == name {
+			return f.Type, true
+		}
+	}
+	return nil, false
+}
+
+// jsonNames lists a struct's JSON names, sorted
+func jsonNames(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			names = append(names, jsonNames(f.Type)...)
+		} else if name := jsonName(f); name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// jsonName is a field's name in JSON, or "" if it isn't written
+func jsonName(f reflect.StructField) string {
+	if !f.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return f.Name
+	}
+	return name
+}
+
+// configValue reads a value given on the command line as JSON, or as a plain
+// string when that's what the setting takes
+func configValue(key string, t reflect.Type, value string) (interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(value), &v); err != nil || json.Unmarshal([]byte(value), reflect.New(t).Interface()) != nil {
+		if t.Kind() == reflect.String {
+			return value, nil
+		}
+		return nil, fmt.Errorf("%s takes %s, written as JSON", key, describeType(t))
+	}
+	return v, nil
+}
+
+// describeType names a setting's type for an error message
+func describeType(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int64, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice:
+		return "a list, e.g. [\"a\", \"b\"]"
+	default:
+		return "an object, e.g. {\"name\": \"value\"}"
+	}
+}
+
+// readConfigFile reads the permissions file as JSON objects, keeping numbers as written
+// A missing file reads as empty
+func readConfigFile() (map[string]interface{}, error) {
+	data, err := os.ReadFile(configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]interface{}{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%s does not parse (%v); fix it by hand first", configPath, err)
+	}
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+	return doc, nil
+}
+
+// runConfigGet prints the value a key has in the permissions file, as JSON
+func runConfigGet(key string) error {
+	path, err := configKey(key)
+	if err != nil {
+		return err
+	}
+	if _, err := configKeyType(path); err != nil {
+		return err
+	}
+	doc, err := readConfigFile()
+	if err != nil {
+		return err
+	}
+	var v interface{} = doc
+	for _, name := range path {
+		m, _ := v.(map[string]interface{})
+		if v = m[name]; v == nil {
+			return fmt.Errorf("%s is not set in %s", key, configPath)
+		}
+	}
+	out, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Println(string(out))
+	return nil
+}
+
+// runConfigEdit sets or removes a key, checks the file still applies, and writes it
+func runConfigEdit(key, value string, unset bool) error {
+	path, err := configKey(key)
+	if err != nil {
+		return err
+	}
+	t, err := configKeyType(path)
+	if err != nil {
+		return err
+	}
+	if org, err := loadOrgPolicy(); err == nil && org != nil && slices.Contains(org.protected, path[0]) {
+		return fmt.Errorf("%s is set by your organisation's policy and can't be changed here", path[0])
+	}
+	doc, err := readConfigFile()
+	if err != nil {
+		return err
+	}
+
+	// Walk to the object holding the key, making the objects on the way when setting
+	parent := doc
+	for _, name := range path[:len(path)-1] {
+		next, ok := parent[name].(map[string]interface{})
+		if !ok {
+			if unset {
+				return fmt.Errorf("%s is not set in %s", key, configPath)
+			}
+			next = map[string]interface{}{}
+			parent[name] = next
+		}
+		parent = next
+	}
+	last := path[len(path)-1]
+	if unset {
+		if _, ok := parent[last]; !ok {
+			return fmt.Errorf("%s is not set in %s", key, configPath)
+		}
+		delete(parent, last)
+	} else {
+		v, err := configValue(key, t, value)
+		if err != nil {
+			return err
+		}
+		parent[last] = v
+	}
+
+	if err := saveConfigFile(doc, "config_changed", map[string]interface{}{"key": key, "unset": unset}); err != nil {
+		return err
+	}
+	if unset {
+		fmt.Printf("Removed %s from %s\n", key, configPath)
+	} else {
+		fmt.Printf("Set %s in %s\n", key, configPath)
+	}
+	return nil
+}
+
+// saveConfigFile checks the permissions file as doctor would, writes it,
+// registers it, and logs the change as event, with details and the file's path
+func saveConfigFile(doc map[string]interface{}, event string, details map[string]interface{}) error {
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := checkConfigFile(data); err != nil {
+		return err
+	}
+	// In team mode only admins can change the rules, so that's checked before writing
+	st, openErr := openStore()
+	if openErr == nil {
+		defer st.Close()
+		if err := actAsAdmin(st, "edit policy"); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(configPath), 0700); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(configPath, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+
+	if openErr != nil {
+		return fmt.Errorf("wrote %s, but couldn't register it, so hooks will treat it as changed by hand: %v", configPath, openErr)
+	}
+	if err := registerConfig(st); err != nil {
+		return err
+	}
+	details["path"] = configPath
+	logged, _ := json.Marshal(details)
+	return st.LogAudit("", event, string(logged))
+}
+
+// checkConfigFile reports why permissions file contents wouldn't apply: a
+// setting the hook doesn't read, a value of the wrong type, or a section
+// doctor would fail
+func checkConfigFile(data []byte) error {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	// Keys such as init's $schema and $comment are kept but not checked
+	for name := range doc {
+		if strings.HasPrefix(name, "$") {
+			delete(doc, name)
+		}
+	}
+	stripped, _ := json.Marshal(doc)
+	dec := json.NewDecoder(bytes.NewReader(stripped))
+	dec.DisallowUnknownFields()
+	var cfg Config
+	if err := dec.Decode(&cfg); err != nil {
+		return fmt.Errorf("the change doesn't fit the permissions file: %v", err)
+	}
+	if section, err := cfg.validate(); err != nil {
+		return fmt.Errorf("the change leaves the %s section invalid: %v", section, err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces a file in one rename, so a reader never sees it half written
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nerv/nerv-hook/internal/store"
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// The permissions file is registered in the state database each time a person
+// saves it, through nerv permissions, the dashboard, or nerv-hook rules trust
+// A file whose checksum wasn't registered was changed some other way, perhaps
+// by an agent rewriting its own rules, and NERV_CONFIG_INTEGRITY says what to do
+const (
+	// integrityWarn uses the changed file, logging a warning on each tool call
+	integrityWarn = "warn"
+	// integrityFallback uses the rules of the file last registered (default)
+	integrityFallback = "fallback"
+	// integrityDeny denies every tool call until the file is registered
+	integrityDeny = "deny"
+)
+
+// integrityMode returns NERV_CONFIG_INTEGRITY, defaulting to fallback
+// It's read from the environment rather than the config file, which is what's in question
+func integrityMode() string {
+	switch mode := os.Getenv("NERV_CONFIG_INTEGRITY"); mode {
+	case integrityWarn, integrityDeny:
+		return mode
+	default:
+		return integrityFallback
+	}
+}
+
+// configChecksum is the hex sha256 of a permissions file's contents
+func configChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// configRecord keeps the registered checksum beside the database too, so the
+// read fast path can check the file without opening it; NERV_DIR is off limits
+// to agents, so they can't register a file by writing it
+func configRecord() string {
+	return filepath.Join(nervDir, "permissions.sha256")
+}
+
+// writeConfigRecord records checksum as the registered one
+func writeConfigRecord(checksum string) error {
+	if err := os.MkdirAll(nervDir, 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(configRecord(), []byte(checksum+"\n"), 0600)
+}
+
+// readConfigRecord returns the checksum configRecord holds, or "" if there's none
+func readConfigRecord() string {
+	data, _ := os.ReadFile(configRecord())
+	return strings.TrimSpace(string(data))
+}
+
+// configIntegrity compares the permissions file with the one last registered
+type configIntegrity struct {
+	// checksum is the file's as it is now; a missing file counts as empty
+	checksum string
+	// registered is the checksum last registered, or "" if none ever was
+	registered string
+	// knownGood is the registered file's contents
+	knownGood string
+}
+
+// checkConfigIntegrity reads the registration from the state database
+// Without a database, or before anything is registered, the file can't be checked and is trusted
+func checkConfigIntegrity(db Store) configIntegrity {
+	data, _ := os.ReadFile(configPath)
+	c := configIntegrity{checksum: configChecksum(data)}
+	if db == nil {
+		return c
+	}
+	c.registered, _ = db.GetSetting(store.SettingConfigChecksum)
+	if c.registered != "" {
+		c.knownGood, _ = db.GetSetting(store.SettingConfigKnownGood)
+	}
+	return c
+}
+
+// suspect reports whether the file changed since a person last saved it
+func (c configIntegrity) suspect() bool {
+	return c.registered != "" && c.checksum != c.registered
+}
+
+// strict reports whether the strict profile is in force: the file sets it, or
+// it's suspect and the file last registered set it, so an agent can't turn it off
+func (c configIntegrity) strict() bool {
+	if loadConfig().Profile == policy.ProfileStrict {
+		return true
+	}
+	return c.suspect() && parseConfig([]byte(c.knownGood)).Profile == policy.ProfileStrict
+}
+
+// mode is what's done with a suspect file: NERV_CONFIG_INTEGRITY, or deny under the strict profile
+func (c configIntegrity) mode() string {
+	if c.strict() {
+		return integrityDeny
+	}
+	return integrityMode()
+}
+
+// denyReason returns why every tool call is denied, or "" unless the file is suspect in deny mode
+func (c configIntegrity) denyReason() string {
+	if !c.suspect() || c.mode() != integrityDeny {
+		return ""
+	}
+	return fmt.Sprintf("NERV's permissions file (%s) was changed without being registered, so every tool call is denied. Ask the user to review it and run nerv-hook rules trust", configPath)
+}
+
+// rules returns the permission rules to check calls against, logging a suspect file
+func (c configIntegrity) rules(db Store, taskID string) policy.Rules {
+	if !c.suspect() {
+		return loadPermissions()
+	}
+
+	mode := c.mode()
+	tracef(1, "config: %s changed since it was registered; hooks %s", configPath, integrityAction(mode))
+	fmt.Fprintf(os.Stderr, "Warning: %s was changed without being registered (checksum %s, registered %s); hooks %s\n", configPath, c.checksum, c.registered, integrityAction(mode))
+	logAudit(db, taskID, "config_unregistered", fmt.Sprintf(`{"path":%q,"checksum":%q,"registered":%q,"mode":%q}`, configPath, c.checksum, c.registered, mode))
+	if mode == integrityWarn {
+		return loadPermissions()
+	}
+	return parseConfig([]byte(c.knownGood)).Rules
+}
+
+// registerConfig records the permissions file as saved by a person
+func registerConfig(st *store.DB) error {
+	data, err := os.ReadFile(configPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := st.SetSetting(store.SettingConfigChecksum, configChecksum(data)); err != nil {
+		return err
+	}
+	if err := st.SetSetting(store.SettingConfigKnownGood, string(data)); err != nil {
+		return err
+	}
+	return writeConfigRecord(configChecksum(data))
+}
+
+const rulesUsage = "usage: nerv-hook rules trust|status|add|replay"
+
+// runRules implements `nerv-hook rules`
+func runRules(args []string) error {
+	if len(args) < 1 {
+		return errors.New(rulesUsage)
+	}
+
+	switch args[0] {
+	case "trust":
+		return runRulesTrust(args[1:])
+	case "status":
+		return runRulesStatus(args[1:])
+	case "add":
+		return runRulesAdd(args[1:])
+	case "replay":
+		return runRulesReplay(args[1:])
+	default:
+		return errors.New(rulesUsage)
+	}
+}
+
+// runRulesTrust registers the permissions file after a person edits it by hand
+func runRulesTrust(args []string) error {
+	fs := flag.NewFlagSet("rules trust", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	st, err := openAdminStore("edit policy")
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	before := checkConfigIntegrity(st)
+	if err := registerConfig(st); err != nil {
+		return err
+	}
+	details, _ := json.Marshal(map[string]string{"path": configPath, "checksum": before.checksum, "previous": before.registered})
+	if err := st.LogAudit("", "config_registered", string(details)); err != nil {
+		return err
+	}
+	fmt.Printf("Registered %s (sha256 %s)\n", configPath, before.checksum)
+	return nil
+}
+
+// runRulesStatus reports whether the permissions file matches the one registered
+func runRulesStatus(args []string) error {
+	fs := flag.NewFlagSet("rules status", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the status as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	c := checkConfigIntegrity(st)
+	if *asJSON {
+		out := jsonRulesStatus{Path: configPath, Checksum: c.checksum, Registered: c.registered, Status: "registered"}
+		switch {
+		case c.registered == "":
+			out.Status = "unregistered"
+		case c.suspect():
+			out.Status, out.Action = "changed", c.mode()
+		}
+		return printJSON(out)
+	}
+	fmt.Printf("File:       %s\n", configPath)
+	fmt.Printf("Checksum:   %s\n", c.checksum)
+	switch {
+	case c.registered == "":
+		fmt.Println("Registered: never; run nerv-hook rules trust to start checking it")
+	case c.suspect():
+		fmt.Printf("Registered: %s\n", c.registered)
+		fmt.Printf("Status:     changed without being registered; hooks %s (NERV_CONFIG_INTEGRITY=%s)\n", integrityAction(c.mode()), integrityMode())
+	default:
+		fmt.Println("Status:     registered")
+	}
+	return nil
+}
+
+// integrityAction says what hooks do with a suspect file in a mode
+func integrityAction(mode string) string {
+	switch mode {
+	case integrityWarn:
+		return "use it and log a warning"
+	case integrityDeny:
+		return "deny every tool call"
+	default:
+		return "use the registered rules"
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// The permissions file's JSON Schema is published at schema/permissions.schema.json
+// and built into the binary. Editors read it through the file's $schema key
+// (nerv-hook init writes a copy next to the file), and `nerv-hook config
+// validate` checks a file against it, reporting each problem with its line and
+// column, before running the checks doctor runs
+// json.Unmarshal ignores keys it doesn't know, so without this a misspelt
+// setting silently leaves its default in place
+
+//go:embed schema/permissions.schema.json
+var permissionsSchema []byte
+
+// permissionsSchemaFile is the copy of the schema init writes next to the permissions file
+const permissionsSchemaFile = "permissions.schema.json"
+
+const configValidateUsage = "usage: nerv-hook config validate [--json] [FILE]"
+
+// jsonSchema is the part of JSON Schema the permissions file's schema uses
+// Unknown keywords fail to load, so the schema can't use one this doesn't check
+type jsonSchema struct {
+	Schema      string                 `json:"$schema,omitempty"`
+	Title       string                 `json:"title,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Ref         string                 `json:"$ref,omitempty"`
+	Type        string                 `json:"type,omitempty"`
+	Enum        []string               `json:"enum,omitempty"`
+	Minimum     *float64               `json:"minimum,omitempty"`
+	Properties  map[string]*jsonSchema `json:"properties,omitempty"`
+	// PatternProperties apply to the keys matching a regular expression that no property names
+	PatternProperties map[string]*jsonSchema `json:"patternProperties,omitempty"`
+	// AdditionalProperties applies to the remaining keys; false rejects them
+	AdditionalProperties *schemaOrFalse         `json:"additionalProperties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Definitions          map[string]*jsonSchema `json:"definitions,omitempty"`
+}
+
+// schemaOrFalse is a schema, or false for none allowed
+type schemaOrFalse struct {
+	schema *jsonSchema
+}
+
+func (s *schemaOrFalse) UnmarshalJSON(data []byte) error {
+	if string(data) == "false" {
+		return nil
+	}
+	return strictUnmarshal(data, &s.schema)
+}
+
+// strictUnmarshal decodes JSON, failing on keys v has no field for
+func strictUnmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// loadPermissionsSchema parses the built-in schema
+func loadPermissionsSchema() (*jsonSchema, error) {
+	var s jsonSchema
+	if err := strictUnmarshal(permissionsSchema, &s); err != nil {
+		return nil, fmt.Errorf("the built-in schema doesn't load: %v", err)
+	}
+	return &s, nil
+}
+
+// configProblem is one thing wrong with a permissions file
+type configProblem struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+	// Path is the dotted key of the setting, e.g. tasks.max_concurrent or webhooks[0].url
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p configProblem) String() string {
+	if p.Path == "" {
+		return fmt.Sprintf("%d:%d: %s", p.Line, p.Column, p.Message)
+	}
+	return fmt.Sprintf("%d:%d: %s: %s", p.Line, p.Column, p.Path, p.Message)
+}
+
+// jsonNode is a parsed JSON value and where it starts in the file
+type jsonNode struct {
+	offset int
+	// value is a string, json.Number, bool, or nil for the scalars
+	value   interface{}
+	kind    string
+	members []jsonMember
+	items   []*jsonNode
+}
+
+// jsonMember is an object's key, where it's written, and its value
+type jsonMember struct {
+	name   string
+	offset int
+	value  *jsonNode
+}
+
+// parseJSONNode parses a JSON document keeping each value's offset
+func parseJSONNode(data []byte) (*jsonNode, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	n, err := parseJSONValue(dec, data)
+	if err != nil {
+		return nil, err
+	}
+	offset := tokenStart(data, dec.InputOffset())
+	if _, err := dec.Token(); err == nil {
+		return nil, trailingDataError{offset: int(offset)}
+	}
+	return n, nil
+}
+
+// trailingDataError is JSON after the document's value, such as a second object
+type trailingDataError struct {
+	offset int
+}
+
+func (e trailingDataError) Error() string {
+	return "more JSON follows the file's value"
+}
+
+func parseJSONValue(dec *json.Decoder, data []byte) (*jsonNode, error) {
+	n := &jsonNode{offset: int(tokenStart(data, dec.InputOffset()))}
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok := tok.(type) {
+	case json.Delim:
+		if tok == '{' {
+			n.kind = "object"
+			for dec.More() {
+				offset := int(tokenStart(data, dec.InputOffset()))
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := parseJSONValue(dec, data)
+				if err != nil {
+					return nil, err
+				}
+				n.members = append(n.members, jsonMember{name: key.(string), offset: offset, value: value})
+			}
+		} else {
+			n.kind = "array"
+			for dec.More() {
+				item, err := parseJSONValue(dec, data)
+				if err != nil {
+					return nil, err
+				}
+				n.items = append(n.items, item)
+			}
+		}
+		// The closing delimiter
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	case string:
+		n.kind, n.value = "string", tok
+	case json.Number:
+		n.kind, n.value = "number", tok
+	case bool:
+		n.kind, n.value = "boolean", tok
+	case nil:
+		n.kind = "null"
+	}
+	return n, nil
+}
+
+// tokenStart skips the whitespace and separators before the next token
+func tokenStart(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) && strings.IndexByte(" \t\r\n,:", data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+// lineColumn converts a byte offset into a 1-based line and column, counting characters
+func lineColumn(data []byte, offset int) (int, int) {
+	offset = min(offset, len(data))
+	start := bytes.LastIndexByte(data[:offset], '\n') + 1
+	return bytes.Count(data[:offset], []byte("\n")) + 1, utf8.RuneCount(data[start:offset]) + 1
+}
+
+// validateConfigData checks permissions file contents against the schema,
+// then, if they fit it, as doctor would
+func validateConfigData(data []byte) ([]configProblem, error) {
+	schema, err := loadPermissionsSchema()
+	if err != nil {
+		return nil, err
+	}
+	problem := func(offset int, path, format string, args ...interface{}) configProblem {
+		line, column := lineColumn(data, offset)
+		return configProblem{Line: line, Column: column, Path: path, Message: fmt.Sprintf(format, args...)}
+	}
+
+	root, err := parseJSONNode(data)
+	if err != nil {
+		var syntax *json.SyntaxError
+		var trailing trailingDataError
+		if errors.As(err, &trailing) {
+			return []configProblem{problem(trailing.offset, "", "%v", err)}, nil
+		}
+		if errors.As(err, &syntax) {
+			// The offset is just past the character that's wrong
+			return []configProblem{problem(max(int(syntax.Offset)-1, 0), "", "%v", err)}, nil
+		}
+		return []configProblem{problem(len(data), "", "the file ends early")}, nil
+	}
+
+	var problems []configProblem
+	v := schemaValidator{root: schema, report: func(offset int, path, message string) {
+		problems = append(problems, problem(offset, path, "%s", message))
+	}}
+	v.check(schema, root, "")
+	if len(problems) > 0 {
+		return problems, nil
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return []configProblem{problem(0, "", "%v", err)}, nil
+	}
+	if section, err := cfg.validate(); err != nil {
+		offset := 0
+		for _, m := range root.members {
+			if m.name == section {
+				offset = m.offset
+			}
+		}
+		return []configProblem{problem(offset, section, "%v", err)}, nil
+	}
+	return nil, nil
+}
+
+// schemaValidator checks parsed JSON against a schema, reporting each problem
+type schemaValidator struct {
+	root   *jsonSchema
+	report func(offset int, path, message string)
+}
+
+// check checks a value and everything under it against s
+func (v schemaValidator) check(s *jsonSchema, n *jsonNode, path string) {
+	if s.Ref != "" {
+		name, ok := strings.CutPrefix(s.Ref, "#/definitions/")
+		if !ok || v.root.Definitions[name] == nil {
+			v.report(n.offset, path, "the schema refers to "+s.Ref+", which it doesn't define")
+			return
+		}
+		s = v.root.Definitions[name]
+	}
+	if s.Type != "" && !hasSchemaType(n, s.Type) {
+		v.report(n.offset, path, fmt.Sprintf("should be %s, not %s", schemaTypeName(s.Type), schemaTypeName(n.kind)))
+		return
+	}
+	if len(s.Enum) > 0 {
+		if value, _ := n.value.(string); !slices.Contains(s.Enum, value) {
+			v.report(n.offset, path, fmt.Sprintf("unknown value %s (want %s)", jsonText(n.value), orList(s.Enum)))
+		}
+	}
+	if number, ok := n.value.(json.Number); ok && s.Minimum != nil {
+		if f, err := number.Float64(); err == nil && f < *s.Minimum {
+			v.report(n.offset, path, fmt.Sprintf("can't be less than %v", *s.Minimum))
+		}
+	}
+	for i, item := range n.items {
+		if s.Items != nil {
+			v.check(s.Items, item, fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+	if n.kind != "object" {
+		return
+	}
+
+	seen := map[string]bool{}
+	for _, m := range n.members {
+		key := m.name
+		if path != "" {
+			key = path + "." + m.name
+		}
+		if seen[m.name] {
+			v.report(m.offset, key, "is set more than once; only the last applies")
+		}
+		seen[m.name] = true
+		if p := s.Properties[m.name]; p != nil {
+			v.check(p, m.value, key)
+			continue
+		}
+		if p := s.patternProperty(m.name); p != nil {
+			v.check(p, m.value, key)
+			continue
+		}
+		switch {
+		case s.AdditionalProperties == nil:
+		case s.AdditionalProperties.schema != nil:
+			v.check(s.AdditionalProperties.schema, m.value, key)
+		default:
+			v.report(m.offset, path, unknownSetting(path, m.name, s))
+		}
+	}
+	for _, name := range s.Required {
+		if !seen[name] {
+			v.report(n.offset, path, "is missing "+name)
+		}
+	}
+}
+
+// patternProperty returns the schema for keys matching one of the patterns, or nil
+func (s *jsonSchema) patternProperty(name string) *jsonSchema {
+	for pattern, p := range s.PatternProperties {
+		if re, err := regexp.Compile(pattern); err == nil && re.MatchString(name) {
+			return p
+		}
+	}
+	return nil
+}
+
+// hasSchemaType reports whether a value is of a schema type
+func hasSchemaType(n *jsonNode, t string) bool {
+	if t == "integer" {
+		number, _ := n.value.(json.Number)
+		_, err := number.Int64()
+		return n.kind == "number" && err == nil
+	}
+	return n.kind == t
+}
+
+// schemaTypeName names a type for an error message
+func schemaTypeName(t string) string {
+	switch t {
+	case "object", "array", "integer":
+		return "an " + t
+	case "boolean":
+		return "true or false"
+	case "null":
+		return "null"
+	default:
+		return "a " + t
+	}
+}
+
+// unknownSetting describes a key a section has no setting for, suggesting
+// the setting it's closest to when it looks like a typo
+func unknownSetting(path, name string, s *jsonSchema) string {
+	names := make([]string, 0, len(s.Properties))
+	for p := range s.Properties {
+		names = append(names, p)
+	}
+	sort.Strings(names)
+	message := "has no setting " + name
+	if path == "" {
+		message = "the permissions file " + message
+	}
+	best, distance := "", len(name)/3+1
+	for _, p := range names {
+		if d := editDistance(strings.ToLower(name), p); d < distance {
+			best, distance = p, d
+		}
+	}
+	if best != "" {
+		return message + "; did you mean " + best + "?"
+	}
+	return message + " (it has " + strings.Join(names, ", ") + ")"
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// orList joins words as "a, b, or c"
+func orList(words []string) string {
+	if len(words) < 3 {
+		return strings.Join(words, " or ")
+	}
+	return strings.Join(words[:len(words)-1], ", ") + ", or " + words[len(words)-1]
+}
+
+// jsonText writes a scalar as it appears in JSON
+func jsonText(v interface{}) string {
+	text, _ := json.Marshal(v)
+	return string(text)
+}
+
+// runConfigValidate implements `nerv-hook config validate`
+func runConfigValidate(args []string) error {
+	fs := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the problems as JSON; it still exits non-zero if there are any")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return errors.New(configValidateUsage)
+	}
+	file := configPath
+	if fs.NArg() == 1 {
+		file = fs.Arg(0)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	problems, err := validateConfigData(data)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		if err := printJSON(struct {
+			File     string          `json:"file"`
+			Valid    bool            `json:"valid"`
+			Problems []configProblem `json:"problems"`
+		}{file, len(problems) == 0, append([]configProblem{}, problems...)}); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range problems {
+			fmt.Printf("%s:%s\n", file, p)
+		}
+	}
+	switch len(problems) {
+	case 0:
+		if !*asJSON {
+			fmt.Printf("%s is valid\n", file)
+		}
+		return nil
+	case 1:
+		return fmt.Errorf("1 problem in %s", file)
+	default:
+		return fmt.Errorf("%d problems in %s", len(problems), file)
+	}
+}
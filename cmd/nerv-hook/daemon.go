@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/migrations"
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// daemonDialTimeout bounds how long a hook waits to reach nervd before handling the event itself
+const daemonDialTimeout = 500 * time.Millisecond
+
+// errDaemonUnavailable means no nervd is listening, so the hook handles the event in-process
+var errDaemonUnavailable = errors.New("nervd is not running")
+
+// errDaemonLost means the hook stopped hearing from nervd after nervd took the
+// event, or was interrupted while it waited; handling the event again here could
+// queue a second approval, so it isn't
+var errDaemonLost = errors.New("lost nervd after it took the event")
+
+// daemonRequest is one hook event sent to nervd
+type daemonRequest struct {
+	Event           string    `json:"event"`
+	ProjectID       string    `json:"project_id,omitempty"`
+	TaskID          string    `json:"task_id,omitempty"`
+	ProtocolVersion string    `json:"protocol_version,omitempty"`
+	RunID           string    `json:"run_id,omitempty"`
+	Input           HookInput `json:"input"`
+}
+
+// daemonResponse is nervd's answer to a daemonRequest
+// nervd first sends one with only Accepted set, once it has taken the event
+type daemonResponse struct {
+	Accepted bool       `json:"accepted,omitempty"`
+	Output   HookOutput `json:"output"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// runDaemon implements `nerv-hook daemon`, the long-running nervd process
+// It owns the database connection and serves hook events over a unix socket
+// until interrupted
+func runDaemon(args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	backupInterval := fs.Duration("backup-interval", 0, "back up the state database this often, e.g. 24h (0 disables)")
+	backupKeep := fs.Int("backup-keep", 7, "number of scheduled backups to keep")
+	checkpointInterval := fs.Duration("checkpoint-interval", 10*time.Minute, "checkpoint and truncate the WAL this often (0 disables)")
+	queueInterval := fs.Duration("queue-interval", 5*time.Second, "check the task queue for agents to launch this often (0 disables)")
+	githubInterval := fs.Duration("github-interval", 2*time.Minute, "sync projects connected to GitHub this often (0 disables)")
+	trackerInterval := fs.Duration("tracker-interval", 2*time.Minute, "sync projects with their Linear and Jira trackers this often (0 disables)")
+	webhookInterval := fs.Duration("webhook-interval", 10*time.Second, "send configured notifiers and webhooks task status changes this often (0 disables)")
+	statsInterval := fs.Duration("stats-interval", time.Minute, "roll new audit events up into usage statistics this often (0 disables)")
+	decisionCacheTTL := fs.Duration("decision-cache-ttl", time.Minute, "reuse a session's allow and deny outcomes for repeated calls this long (0 disables)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if problem := checkHookBinary(true); problem != "" {
+		fmt.Fprintf(os.Stderr, "nervd: warning: %s; if you upgraded it, run nerv-hook install\n", problem)
+	}
+
+	st, err := openStore()
+	if err != nil {
+		return err
+	}
+	router := newStoreRouter(st)
+	defer router.Close()
+
+	listener, err := listenUnix(socketPath)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	// Unblock Accept on shutdown; closing the listener also removes the socket file
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+
+	if cfg := loadConfig().Replication; cfg != nil && cfg.URL != "" {
+		if st.Dialect() == migrations.SQLite {
+			stop := superviseReplication(cfg)
+			defer stop()
+		} else {
+			fmt.Fprintln(os.Stderr, "nervd: ignoring replication config, it only applies to the SQLite state database")
+		}
+	}
+
+	if *checkpointInterval > 0 {
+		go scheduleCheckpoints(router, *checkpointInterval)
+	}
+
+	if *queueInterval > 0 {
+		go scheduleQueue(st, *queueInterval)
+	}
+
+	if *githubInterval > 0 {
+		go scheduleGitHubSync(st, *githubInterval)
+	}
+
+	if *trackerInterval > 0 {
+		go scheduleTrackerSync(st, *trackerInterval)
+	}
+
+	if *webhookInterval > 0 {
+		go scheduleNotifiers(st, *webhookInterval)
+	}
+
+	if *statsInterval > 0 {
+		go scheduleUsage(st, *statsInterval)
+	}
+
+	if *backupInterval > 0 {
+		go scheduleBackups(st, *backupInterval, *backupKeep)
+	}
+
+	if *decisionCacheTTL > 0 {
+		decisions = newDecisionCache(*decisionCacheTTL)
+	}
+
+	fmt.Fprintf(os.Stderr, "nervd listening on %s (database %s)\n", socketPath, st.Location())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go serveDaemonConn(router, conn)
+	}
+}
+
+// scheduleBackups backs up the state database every interval, keeping the newest keep backups
+func scheduleBackups(st *store.DB, interval time.Duration, keep int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		dbFile, _, err := backupState(st, backupDir(), now)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "nervd: scheduled backup failed: %v\n", err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "nervd: backed up state to %s\n", dbFile)
+
+		if err := pruneBackups(backupDir(), keep); err != nil {
+			fmt.Fprintf(os.Stderr, "nervd: failed to prune old backups: %v\n", err)
+		}
+	}
+}
+
+// scheduleCheckpoints truncates the WAL of every open SQLite database each interval
+// nervd keeps connections open indefinitely, which otherwise lets the WAL grow without bound
+func scheduleCheckpoints(router *storeRouter, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, st := range router.sqliteStores() {
+			if _, err := st.Checkpoint(); err != nil {
+				fmt.Fprintf(os.Stderr, "nervd: checkpoint of %s failed: %v\n", st.Location(), err)
+			}
+		}
+	}
+}
+
+// listenUnix listens on path, replacing a stale socket left by a daemon that exited uncleanly
+func listenUnix(path string) (net.Listener, error) {
+	if conn, err := net.DialTimeout("unix", path, daemonDialTimeout); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("nervd is already running on %s", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, socketError(err)
+	}
+	// Only the owner may submit events
+	if err := restrictSocket(path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// serveDaemonConn handles the single request on a hook connection
+// The hook sends nothing after its request, so a read that returns means it
+// hung up, and an approval it was waiting on is cancelled
+func serveDaemonConn(router *storeRouter, conn net.Conn) {
+	defer conn.Close()
+
+	var req daemonRequest
+	var resp daemonResponse
+	reader := bufio.NewReader(conn)
+	if err := json.NewDecoder(reader).Decode(&req); err != nil {
+		resp.Error = fmt.Sprintf("invalid request: %v", err)
+	} else if err := validateHookInput(req.Event, req.Input); err != nil {
+		resp.Error = err.Error()
+	} else if err := json.NewEncoder(conn).Encode(daemonResponse{Accepted: true}); err != nil {
+		return
+	} else {
+		ctx, hungUp := context.WithCancel(context.Background())
+		defer hungUp()
+		go func() {
+			for {
+				if _, err := reader.ReadByte(); err != nil {
+					break
+				}
+			}
+			hungUp()
+		}()
+
+		req.Input.ProtocolVersion = req.ProtocolVersion
+		req.Input.RunID = req.RunID
+		audit := bufferAudit(router.forProject(req.ProjectID))
+		db := withCaller(withProtocolVersion(audit, req.ProtocolVersion), ctx)
+		resp.Output = handleEvent(db, req.Event, req.ProjectID, req.TaskID, req.Input)
+		traceDecision(req.Event, req.Input, resp.Output)
+		// Written before replying, so the session's next event sees them
+		audit.Flush()
+		if ctx.Err() != nil {
+			// The hook is gone, so there's no one to reply to
+			return
+		}
+	}
+
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		fmt.Fprintf(os.Stderr, "nervd: failed to reply: %v\n", err)
+	}
+}
+
+// callDaemon sends an event to nervd and blocks until it decides, or ctx is done
+// Returns errDaemonUnavailable if nothing is listening on path, and errDaemonLost
+// once nervd has taken the event but didn't answer
+// Hanging up when ctx is done tells nervd to cancel an approval it's waiting on
+func callDaemon(ctx context.Context, path string, req daemonRequest) (HookOutput, error) {
+	conn, err := net.DialTimeout("unix", path, daemonDialTimeout)
+	if err != nil {
+		return HookOutput{}, errDaemonUnavailable
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return HookOutput{}, err
+	}
+
+	var resp daemonResponse
+	accepted := false
+	decoder := json.NewDecoder(conn)
+	for {
+		resp = daemonResponse{}
+		if err := decoder.Decode(&resp); err != nil {
+			if accepted || ctx.Err() != nil {
+				return HookOutput{}, fmt.Errorf("%w: %v", errDaemonLost, err)
+			}
+			return HookOutput{}, err
+		}
+		if !resp.Accepted {
+			break
+		}
+		accepted = true
+	}
+	if resp.Error != "" {
+		return HookOutput{}, errors.New(resp.Error)
+	}
+	return resp.Output, nil
+}
+
+// callerStore carries the context of the hook an event is handled for, so an
+// approval wait ends when the hook goes away
+type callerStore struct {
+	Store
+	ctx context.Context
+}
+
+// withCaller wraps db so approval waits end when ctx does
+func withCaller(db Store, ctx context.Context) Store {
+	if db == nil {
+		return db
+	}
+	return callerStore{Store: db, ctx: ctx}
+}
+
+// waitContext returns the context an approval wait on db ends with: the hook's,
+// when nervd handles the event, and this process's interrupt signals
+func waitContext(db Store) (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	if c, ok := db.(callerStore); ok {
+		ctx = c.ctx
+	}
+	return signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// debugDir is where NERV_PPROF and NERV_TIMINGS write, so a slow hook can be reported with data
+func debugDir() string {
+	return filepath.Join(nervDir, "debug")
+}
+
+// debugEnabled reports whether a debug variable is set to anything but empty or 0
+func debugEnabled(name string) bool {
+	v := os.Getenv(name)
+	return v != "" && v != "0"
+}
+
+// startProfile begins a CPU profile of this hook process when NERV_PPROF is set
+// The returned func stops it and writes a heap profile beside it
+func startProfile(command string) func() {
+	if !debugEnabled("NERV_PPROF") {
+		return func() {}
+	}
+	if err := os.MkdirAll(debugDir(), 0700); err != nil {
+		fmt.Fprintf(os.Stderr, "NERV_PPROF: %v\n", err)
+		return func() {}
+	}
+	name := fmt.Sprintf("%s-%s-%d", command, time.Now().Format("20060102-150405"), os.Getpid())
+	cpu, err := os.Create(filepath.Join(debugDir(), name+".cpu.pprof"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "NERV_PPROF: %v\n", err)
+		return func() {}
+	}
+	if err := pprof.StartCPUProfile(cpu); err != nil {
+		fmt.Fprintf(os.Stderr, "NERV_PPROF: %v\n", err)
+		cpu.Close()
+		return func() {}
+	}
+
+	return func() {
+		pprof.StopCPUProfile()
+		cpu.Close()
+		heap, err := os.Create(filepath.Join(debugDir(), name+".heap.pprof"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "NERV_PPROF: %v\n", err)
+			return
+		}
+		defer heap.Close()
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(heap); err != nil {
+			fmt.Fprintf(os.Stderr, "NERV_PPROF: %v\n", err)
+		}
+	}
+}
+
+// phaseTimings adds up how long one hook event spends in each phase
+// A nil *phaseTimings records nothing, so call sites don't check whether NERV_TIMINGS is set
+type phaseTimings struct {
+	mu     sync.Mutex
+	start  time.Time
+	phases map[string]time.Duration
+}
+
+// timings is the current hook event's phase timings, set only when NERV_TIMINGS is
+// nervd leaves it nil, since it handles many events at once
+var timings *phaseTimings
+
+// startTimings turns on phase timings for this hook process when NERV_TIMINGS is set
+func startTimings() {
+	if debugEnabled("NERV_TIMINGS") {
+		timings = &phaseTimings{start: time.Now(), phases: map[string]time.Duration{}}
+	}
+}
+
+// phase starts timing a phase; call the returned func when it ends
+func (t *phaseTimings) phase(name string) func() {
+	if t == nil {
+		return func() {}
+	}
+	begin := time.Now()
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.phases[name] += time.Since(begin)
+	}
+}
+
+// timingsRecord is one line of debug/timings.jsonl, in milliseconds
+type timingsRecord struct {
+	At     time.Time          `json:"at"`
+	Event  string             `json:"event"`
+	Tool   string             `json:"tool,omitempty"`
+	Total  float64            `json:"total_ms"`
+	Phases map[string]float64 `json:"phases"`
+}
+
+// write appends the event's timings to debug/timings.jsonl
+func (t *phaseTimings) write(command, tool string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	record := timingsRecord{At: t.start.UTC(), Event: command, Tool: tool, Total: milliseconds(time.Since(t.start)), Phases: map[string]float64{}}
+	for name, d := range t.phases {
+		record.Phases[name] = milliseconds(d)
+	}
+	t.mu.Unlock()
+
+	if err := os.MkdirAll(debugDir(), 0700); err != nil {
+		fmt.Fprintf(os.Stderr, "NERV_TIMINGS: %v\n", err)
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(debugDir(), "timings.jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "NERV_TIMINGS: %v\n", err)
+		return
+	}
+	defer f.Close()
+	line, _ := json.Marshal(record)
+	f.Write(append(line, '\n'))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// decisionCacheSize caps the entries kept; a full cache is emptied rather than tracking age
+const decisionCacheSize = 10000
+
+// decisionCache remembers rule outcomes per session in nervd, so an agent that reads
+// or greps hundreds of times doesn't reload the config and re-run the rules each call
+// Only allow and deny outcomes are kept; a call that needs approval always asks
+type decisionCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[decisionKey]cachedDecision
+}
+
+// decisions is nervd's cache; the hook process leaves it nil and checks every call
+var decisions *decisionCache
+
+// newDecisionCache returns a cache whose entries last ttl
+// The config files are checked on every hit, but registered repositories and
+// worktrees live in the database, so changes to them take up to ttl to apply
+func newDecisionCache(ttl time.Duration) *decisionCache {
+	return &decisionCache{ttl: ttl, entries: map[decisionKey]cachedDecision{}}
+}
+
+// decisionKey is everything a rule outcome depends on
+type decisionKey struct {
+	session, project, task, cwd string
+	tool, signature             string
+}
+
+type cachedDecision struct {
+	denyReason, allowRule string
+	files                 []fileStamp
+	expires               time.Time
+}
+
+// fileStamp is a config file as it was when a decision was cached
+type fileStamp struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+func stampFile(path string) fileStamp {
+	stamp := fileStamp{path: path}
+	if info, err := os.Stat(path); err == nil {
+		stamp.modTime, stamp.size = info.ModTime(), info.Size()
+	}
+	return stamp
+}
+
+// newDecisionKey keys a call by its rule signature, so repeated reads of one file
+// or greps in one directory share an entry
+// Tools that can need approval key on their whole input, since rules confining
+// edits to a worktree look at fields the signature leaves out
+func newDecisionKey(projectID, taskID string, input HookInput, toolInput string) decisionKey {
+	k := decisionKey{session: input.SessionID, project: projectID, task: taskID, cwd: input.Cwd, tool: input.ToolName}
+	if policy.RequiresApproval(input.ToolName) {
+		k.signature = toolInput
+	} else {
+		k.signature = policy.Signature(input.ToolName, toolInput)
+	}
+	return k
+}
+
+func (c *decisionCache) get(k decisionKey) (cachedDecision, bool) {
+	c.mu.Lock()
+	d, ok := c.entries[k]
+	c.mu.Unlock()
+	if !ok {
+		return d, false
+	}
+	if time.Now().After(d.expires) {
+		c.forget(k)
+		return d, false
+	}
+	for _, f := range d.files {
+		if stampFile(f.path) != f {
+			c.forget(k)
+			return d, false
+		}
+	}
+	return d, true
+}
+
+func (c *decisionCache) put(k decisionKey, d cachedDecision) {
+	d.expires = time.Now().Add(c.ttl)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= decisionCacheSize {
+		c.entries = map[decisionKey]cachedDecision{}
+	}
+	c.entries[k] = d
+}
+
+func (c *decisionCache) forget(k decisionKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, k)
+}
+
+// permissionFiles stamps the config files permissionRules reads for a project,
+// the org's policy bundle and key included
+// Reports false if the project's repositories can't be listed
+func permissionFiles(db Store, projectID string) ([]fileStamp, bool) {
+	files := []fileStamp{stampFile(configPath), stampFile(orgBundlePath()), stampFile(orgKeyPath())}
+	if db == nil || projectID == "" {
+		return files, true
+	}
+	repos, err := db.ListRepos(projectID)
+	if err != nil {
+		return nil, false
+	}
+	for _, r := range repos {
+		files = append(files, stampFile(filepath.Join(r.Path, projectConfigFile)))
+	}
+	return files, true
+}
+
+// cachedCheckPermission is checkPermission with the task's rules, reusing the
+// session's earlier outcome for the same call when nervd has one
+func cachedCheckPermission(db Store, projectID, taskID string, input HookInput, toolInput string) (bool, string, string) {
+	if decisions == nil || input.SessionID == "" {
+		return checkPermission(permissionRules(db, projectID, taskID, input.Cwd), taskWorkspace(db, taskID), input.ToolName, toolInput)
+	}
+
+	key := newDecisionKey(projectID, taskID, input, toolInput)
+	if d, ok := decisions.get(key); ok {
+		tracef(1, "rules: reusing the session's outcome for the same call")
+		return false, d.denyReason, d.allowRule
+	}
+	// Stamped before the rules are read, so an edit made in between invalidates the entry
+	files, ok := permissionFiles(db, projectID)
+	needsApproval, denyReason, allowRule := checkPermission(permissionRules(db, projectID, taskID, input.Cwd), taskWorkspace(db, taskID), input.ToolName, toolInput)
+	// Outcomes under a suspect config aren't kept, since registering it changes them without touching the file
+	if ok && !needsApproval && !checkConfigIntegrity(db).suspect() {
+		decisions.put(key, cachedDecision{denyReason: denyReason, allowRule: allowRule, files: files})
+	}
+	return needsApproval, denyReason, allowRule
+}
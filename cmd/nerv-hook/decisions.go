@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// decisionsDir is where deciders touch a marker named for the approval they just decided
+// It sits beside the state database, so the dashboard finds it from the database path
+func decisionsDir() string {
+	return filepath.Join(filepath.Dir(dbPath), "decisions")
+}
+
+// markDecision touches the marker for an approval, waking a hook waiting on it
+// A marker that can't be written only delays the decision until the hook's next poll
+func markDecision(approvalID int64) {
+	dir := decisionsDir()
+	if os.MkdirAll(dir, 0700) != nil {
+		return
+	}
+	os.WriteFile(filepath.Join(dir, strconv.FormatInt(approvalID, 10)), nil, 0600)
+}
+
+// watchDecision signals wake when the marker for an approval is written
+// stop closes the watcher and removes the marker; if watching isn't possible
+// the error is returned and the caller polls
+func watchDecision(approvalID int64) (wake <-chan struct{}, stop func(), err error) {
+	dir := decisionsDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, nil, err
+	}
+
+	marker := strconv.FormatInt(approvalID, 10)
+	signal := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Base(ev.Name) == marker && ev.Has(fsnotify.Create|fsnotify.Write) {
+					select {
+					case signal <- struct{}{}:
+					default:
+					}
+				}
+			case _, ok := <-watcher.Errors:
+				// A dropped event only delays the decision until the next poll
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	return signal, func() {
+		watcher.Close()
+		<-done
+		os.Remove(filepath.Join(dir, marker))
+	}, nil
+}
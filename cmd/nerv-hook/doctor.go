@@ -0,0 +1,459 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/nerv/nerv-hook/internal/migrations"
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// Doctor check outcomes
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// doctorCheck is the result of one environment check
+type doctorCheck struct {
+	name   string
+	status string
+	detail string
+	// fix tells the user what to do about a warning or failure
+	fix string
+}
+
+// runDoctor implements `nerv-hook doctor`
+// Each check reports what it found and, when something is wrong, how to fix it
+func runDoctor(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	projectDir := fs.String("project-dir", ".", "project whose .claude/settings.json is checked alongside the user settings")
+	asJSON := fs.Bool("json", false, "print the checks as JSON; it still exits non-zero if any fail")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	checks := []doctorCheck{
+		checkHookOnPath(),
+		checkHookRegistration(*projectDir),
+		checkPermissionsFile(),
+		checkOrgPolicy(),
+		checkPluginPrograms(),
+		checkHookBinaryRecord(),
+	}
+	checks = append(checks, checkDatabase()...)
+	checks = append(checks, checkDaemon())
+
+	failed := 0
+	out := make([]jsonCheck, 0, len(checks))
+	for _, c := range checks {
+		if c.status == checkFail {
+			failed++
+		}
+		check := jsonCheck{Name: c.name, Status: c.status, Detail: c.detail}
+		if c.status != checkOK {
+			check.Fix = c.fix
+		}
+		out = append(out, check)
+		if *asJSON {
+			continue
+		}
+		fmt.Printf("%-6s %-14s %s\n", "["+c.status+"]", c.name, c.detail)
+		if c.fix != "" && c.status != checkOK {
+			fmt.Printf("%-6s %-14s fix: %s\n", "", "", c.fix)
+		}
+	}
+	if *asJSON {
+		if err := printJSON(out); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// checkHookOnPath looks for nerv-hook on PATH, which the dashboard and docs assume
+func checkHookOnPath() doctorCheck {
+	c := doctorCheck{name: "binary"}
+	path, err := exec.LookPath("nerv-hook")
+	if err != nil {
+		c.status = checkWarn
+		c.detail = "nerv-hook is not on PATH"
+		if exe, err := os.Executable(); err == nil {
+			c.fix = fmt.Sprintf("add %s to PATH", filepath.Dir(exe))
+		}
+		return c
+	}
+	c.status = checkOK
+	c.detail = path
+	return c
+}
+
+// checkHookBinaryRecord hashes the hook binary and compares it with the one install recorded
+func checkHookBinaryRecord() doctorCheck {
+	c := doctorCheck{name: "hook binary", status: checkOK}
+	rec, ok := readBinaryRecord()
+	if !ok {
+		c.status = checkWarn
+		c.detail = "not recorded, so a replaced binary wouldn't be noticed"
+		c.fix = "run nerv-hook install"
+		return c
+	}
+	if problem := checkHookBinary(true); problem != "" {
+		c.status = checkFail
+		c.detail = problem
+		c.fix = "if you upgraded it, run nerv-hook install; otherwise reinstall NERV"
+		return c
+	}
+	c.detail = fmt.Sprintf("%s matches the installed checksum", rec.Path)
+	return c
+}
+
+// checkHookRegistration verifies every NERV hook is registered in the user or project Claude settings
+func checkHookRegistration(projectDir string) doctorCheck {
+	c := doctorCheck{name: "claude hooks"}
+
+	var settingsFiles []string
+	for _, scope := range []string{"user", "project"} {
+		path, err := claudeSettingsPath(installOptions{scope: scope, projectDir: projectDir})
+		if err == nil {
+			settingsFiles = append(settingsFiles, path)
+		}
+	}
+
+	// Hooks may have been installed from a binary that isn't named nerv-hook
+	self, _ := resolveHookBinary("")
+
+	var missing []string
+	var registeredIn []string
+	for _, reg := range nervHookRegistrations {
+		found := false
+		for _, path := range settingsFiles {
+			settings, err := readClaudeSettings(path)
+			if err != nil {
+				c.status = checkFail
+				c.detail = err.Error()
+				c.fix = "fix the JSON syntax, then run nerv-hook install"
+				return c
+			}
+			if command := registeredHookCommand(settings, reg, self); command != "" {
+				found = true
+				registeredIn = appendUnique(registeredIn, path)
+				if binary := hookCommandBinary(command); binary != "" {
+					if _, err := os.Stat(binary); err != nil {
+						c.status = checkFail
+						c.detail = fmt.Sprintf("%s runs %s, which does not exist", path, binary)
+						c.fix = "run nerv-hook install to point the hooks at this binary"
+						return c
+					}
+				}
+				break
+			}
+		}
+		if !found {
+			label := reg.Event
+			if reg.Matcher != "" {
+				label += " (" + reg.Matcher + ")"
+			}
+			missing = append(missing, label)
+		}
+	}
+
+	if len(missing) > 0 {
+		c.status = checkFail
+		c.detail = "not registered: " + strings.Join(missing, ", ")
+		c.fix = "run nerv-hook install (or --scope project for a single project)"
+		return c
+	}
+	c.status = checkOK
+	c.detail = "registered in " + strings.Join(registeredIn, ", ")
+	return c
+}
+
+// registeredHookCommand returns the command of the settings entry that runs reg, or ""
+func registeredHookCommand(settings map[string]interface{}, reg hookRegistration, hookPath string) string {
+	hooks, _ := settings["hooks"].(map[string]interface{})
+	entries, _ := hooks[reg.Event].([]interface{})
+	for _, entry := range entries {
+		m, _ := entry.(map[string]interface{})
+		matcher, _ := m["matcher"].(string)
+		if matcher != reg.Matcher {
+			continue
+		}
+		commands, _ := m["hooks"].([]interface{})
+		for _, c := range commands {
+			hook, _ := c.(map[string]interface{})
+			command, _ := hook["command"].(string)
+			isNerv := strings.Contains(command, "nerv-hook") || (hookPath != "" && strings.Contains(command, hookPath))
+			if isNerv && strings.HasSuffix(strings.TrimSpace(command), reg.Command) {
+				return command
+			}
+		}
+	}
+	return ""
+}
+
+// hookCommandBinary extracts the quoted binary path install writes at the start of a hook command
+func hookCommandBinary(command string) string {
+	if !strings.HasPrefix(command, `"`) {
+		return ""
+	}
+	end := strings.Index(command[1:], `"`)
+	if end < 0 {
+		return ""
+	}
+	return command[1 : end+1]
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// checkPermissionsFile makes sure the permissions file parses
+// loadConfig silently falls back to the defaults, so a typo would otherwise go unnoticed
+func checkPermissionsFile() doctorCheck {
+	c := doctorCheck{name: "permissions"}
+	data, err := os.ReadFile(configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		c.status = checkWarn
+		c.detail = configPath + " is missing, so the built-in defaults apply"
+		c.fix = "run nerv-hook init"
+		return c
+	}
+	if err != nil {
+		c.status = checkFail
+		c.detail = err.Error()
+		return c
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		c.status = checkFail
+		c.detail = fmt.Sprintf("%s does not parse (%v), so the built-in defaults apply", configPath, err)
+		c.fix = "fix the JSON, or reset it with nerv-hook init --force"
+		return c
+	}
+	if section, err := cfg.validate(); err != nil {
+		c.status = checkFail
+		c.detail = fmt.Sprintf("%s: %s: %v", configPath, section, err)
+		c.fix = "correct the " + section + " section"
+		if section == "profile" {
+			c.fix = "set profile to strict, or remove it for the default"
+		}
+		return c
+	}
+
+	// Keys the hook doesn't know are ignored, so a misspelt setting leaves its default
+	if problems, err := validateConfigData(data); err == nil && len(problems) > 0 {
+		c.status = checkWarn
+		c.detail = fmt.Sprintf("%s:%s", configPath, problems[0])
+		if len(problems) > 1 {
+			c.detail += fmt.Sprintf(" (and %d more)", len(problems)-1)
+		}
+		c.fix = "run nerv-hook config validate and correct the settings it reports"
+		return c
+	}
+
+	c.status = checkOK
+	c.detail = fmt.Sprintf("%s (%d allow, %d deny rules)", configPath, len(cfg.Allow), len(cfg.Deny))
+	return c
+}
+
+// checkPluginPrograms looks for each plugin's program, since a plugin that can't run
+// decides every call it covers with its on_error
+func checkPluginPrograms() doctorCheck {
+	c := doctorCheck{name: "plugins", status: checkOK}
+	plugins := loadConfig().Plugins
+	if len(plugins) == 0 {
+		c.detail = "none configured"
+		return c
+	}
+	var missing []string
+	for _, p := range plugins {
+		if p.Wasm != "" {
+			if _, err := os.Stat(p.Wasm); err != nil {
+				missing = append(missing, fmt.Sprintf("%s (%s)", p.Name, p.Wasm))
+			}
+			continue
+		}
+		// The permissions check reports a plugin without a command
+		if len(p.Command) == 0 {
+			continue
+		}
+		program := p.Command[0]
+		if p.Image != "" {
+			program = loadConfig().Sandbox.runtime()
+		}
+		if _, err := exec.LookPath(program); err != nil {
+			missing = append(missing, fmt.Sprintf("%s (%s)", p.Name, program))
+		}
+	}
+	if len(missing) > 0 {
+		c.status = checkWarn
+		c.detail = "can't find the program for " + strings.Join(missing, ", ") + ", so their on_error decides the calls they check"
+		c.fix = "install the programs, or correct the plugins' command or wasm"
+		return c
+	}
+	c.detail = fmt.Sprintf("%d configured", len(plugins))
+	return c
+}
+
+// checkOrgPolicy verifies the org policy bundle, if one is installed, and
+// reports protected sections the permissions file sets to no effect
+func checkOrgPolicy() doctorCheck {
+	c := doctorCheck{name: "org policy", status: checkOK}
+	org, err := loadOrgPolicy()
+	switch {
+	case err != nil:
+		c.status = checkFail
+		c.detail = err.Error() + "; hooks deny every tool call"
+		c.fix = fmt.Sprintf("reinstall the bundle and key your organisation issued at %s and %s", orgBundlePath(), orgKeyPath())
+	case org == nil:
+		c.detail = "none installed"
+	default:
+		data, _ := os.ReadFile(configPath)
+		if names := org.overridden(data); len(names) > 0 {
+			c.status = checkWarn
+			c.detail = fmt.Sprintf("%s sets %s, which the org policy protects, so its settings are ignored", configPath, strings.Join(names, ", "))
+			c.fix = "remove those sections from the permissions file"
+			return c
+		}
+		c.detail = "signed bundle verified and applied"
+	}
+	return c
+}
+
+// checkDatabase checks the state database opens, its schema is current, and reports pending approvals
+func checkDatabase() []doctorCheck {
+	c := doctorCheck{name: "database"}
+	st, err := openUncheckedStore(true)
+	if err != nil {
+		c.status = checkFail
+		c.detail = err.Error()
+		c.fix = "run nerv-hook init"
+		return []doctorCheck{c}
+	}
+	defer st.Close()
+
+	current, err := migrations.Current(st.SQL(), st.Dialect())
+	if err != nil {
+		c.status = checkFail
+		c.detail = fmt.Sprintf("%s: %v", st.Location(), err)
+		return []doctorCheck{c}
+	}
+	latest := migrations.Latest(st.Dialect())
+	switch {
+	case current < latest:
+		c.status = checkWarn
+		c.detail = fmt.Sprintf("%s is at schema version %d, this binary expects %d", st.Location(), current, latest)
+		c.fix = "run nerv-hook migrate (hooks also migrate on their next run)"
+	case current > latest:
+		c.status = checkFail
+		c.detail = fmt.Sprintf("%s is at schema version %d, newer than this binary (%d)", st.Location(), current, latest)
+		c.fix = "upgrade nerv-hook"
+	default:
+		c.status = checkOK
+		c.detail = fmt.Sprintf("%s (schema version %d)", st.Location(), current)
+	}
+
+	approvals := doctorCheck{name: "approvals", status: checkOK}
+	pending, err := st.PendingApprovalCount()
+	switch {
+	case err != nil:
+		approvals.status = checkFail
+		approvals.detail = err.Error()
+	case pending > 0:
+		approvals.status = checkWarn
+		approvals.detail = fmt.Sprintf("%d waiting for a decision; agents are blocked until they are answered", pending)
+		approvals.fix = "review them in the NERV dashboard or with nerv approvals"
+	default:
+		approvals.detail = "none pending"
+	}
+
+	return []doctorCheck{c, approvals, checkProjectConfigs(st), checkConfigRegistered(st)}
+}
+
+// checkConfigRegistered compares the permissions file with the one a person last saved
+func checkConfigRegistered(st *store.DB) doctorCheck {
+	c := doctorCheck{name: "registration", status: checkOK}
+	integrity := checkConfigIntegrity(st)
+	switch {
+	case integrity.registered == "":
+		c.status = checkWarn
+		c.detail = "the permissions file has never been registered, so changes to it aren't noticed"
+		c.fix = "review it, then run nerv-hook rules trust"
+	case integrity.suspect():
+		c.status = checkFail
+		c.detail = fmt.Sprintf("%s changed without being registered; hooks %s", configPath, integrityAction(integrityMode()))
+		c.fix = "review the file; if the change is yours, run nerv-hook rules trust"
+	default:
+		c.detail = "the permissions file matches the one last saved"
+	}
+	return c
+}
+
+// checkProjectConfigs parses each registered directory's .nerv/permissions.json
+// The hook skips one that doesn't parse, so its rules silently stop applying
+func checkProjectConfigs(st *store.DB) doctorCheck {
+	c := doctorCheck{name: "project files", status: checkOK}
+	repos, err := st.ListRepos("")
+	if err != nil {
+		c.status = checkFail
+		c.detail = err.Error()
+		return c
+	}
+	found := 0
+	for _, r := range repos {
+		if _, err := readProjectConfig(r.Path); errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			c.status = checkFail
+			c.detail = fmt.Sprintf("%s: %v", filepath.Join(r.Path, projectConfigFile), err)
+			c.fix = "fix the JSON, or rewrite it with nerv-hook project init --force"
+			return c
+		}
+		found++
+	}
+	c.detail = fmt.Sprintf("%d of %d registered directories have %s", found, len(repos), projectConfigFile)
+	return c
+}
+
+// checkDaemon reports whether nervd is answering on its socket
+// The daemon is optional, so only a stale socket is worth a warning
+func checkDaemon() doctorCheck {
+	c := doctorCheck{name: "daemon"}
+	if _, err := os.Stat(socketPath); errors.Is(err, os.ErrNotExist) {
+		c.status = checkOK
+		c.detail = "not running (optional; hooks handle events themselves)"
+		return c
+	}
+
+	conn, err := net.DialTimeout("unix", socketPath, daemonDialTimeout)
+	if err != nil {
+		c.status = checkWarn
+		c.detail = fmt.Sprintf("%s exists but nervd is not answering", socketPath)
+		c.fix = "start nerv-hook daemon, which replaces the stale socket"
+		return c
+	}
+	conn.Close()
+
+	c.status = checkOK
+	c.detail = "nervd is listening on " + socketPath
+	return c
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nerv/nerv-hook/internal/store"
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// checkPermission checks if a tool use needs approval or should be denied
+// A non-empty workspace confines file edits to that directory
+// Returns (needsApproval, denyReason, allowRule) where allowRule is the allow rule that matched, if any
+func checkPermission(rules policy.Rules, workspace, toolName, toolInput string) (bool, string, string) {
+	rules.Workspace = workspace
+	result := traceCheck(rules, toolName, toolInput)
+	return result.NeedsApproval, result.DenyReason, result.AllowRule
+}
+
+// withHome returns rules that know the user's home directory, so destructive
+// commands naming it by its path are caught
+func withHome(rules policy.Rules) policy.Rules {
+	if home, err := os.UserHomeDir(); err == nil && rules.Home == "" {
+		rules.Home = filepath.ToSlash(home)
+	}
+	return rules
+}
+
+// loadPermissions loads permission rules from config file
+func loadPermissions() policy.Rules {
+	return loadConfig().Rules
+}
+
+// permissionRules returns the rules for a task's sessions: the config file's,
+// followed by those in the .nerv/permissions.json of each of the project's repos
+// cwd, where the call is made, resolves relative paths and picks the repo whose
+// rules apply in full; see repoRules
+func permissionRules(db Store, projectID, taskID, cwd string) policy.Rules {
+	rules := checkConfigIntegrity(db).rules(db, taskID)
+	rules.Dir = cwd
+	worktrees := taskWorktrees(db, taskID)
+	for _, w := range worktrees {
+		rules.Workspaces = append(rules.Workspaces, w.Path)
+	}
+	if len(rules.Workspaces) > 0 {
+		tracef(1, "rules: file edits confined to %s", strings.Join(rules.Workspaces, ", "))
+	}
+	if db == nil || projectID == "" {
+		return rules
+	}
+	repos, err := db.ListRepos(projectID)
+	if err != nil {
+		return rules
+	}
+	for _, r := range repos {
+		cfg, err := readProjectConfig(r.Path)
+		traceProjectConfig(r.Path, cfg.Allow, cfg.Deny, err)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				fmt.Fprintf(os.Stderr, "Ignoring %s: %v\n", filepath.Join(r.Path, projectConfigFile), err)
+			}
+			continue
+		}
+		roots := []string{r.Path}
+		for _, w := range worktrees {
+			if w.RepoID == r.ID {
+				roots = append(roots, w.Path)
+			}
+		}
+		allow, deny := repoRules(cfg.Rules, roots, cwd)
+		rules.Allow = append(rules.Allow, allow...)
+		rules.Deny = append(rules.Deny, deny...)
+	}
+	return rules
+}
+
+// repoRules scopes one repo's rules to the repo
+// File rules with relative paths are anchored to each of roots, the repo and
+// the task's worktree of it. Other allow rules, such as Bash, apply only to
+// calls made inside one of roots, so one repo's rules don't grant commands in
+// another; deny rules always apply. With no cwd, everything applies as written
+func repoRules(rules policy.Rules, roots []string, cwd string) (allow, deny []string) {
+	inside := cwd == ""
+	for _, root := range roots {
+		inside = inside || withinDir(cwd, root)
+	}
+	scope := func(list []string, always bool) []string {
+		var scoped []string
+		for _, rule := range list {
+			if anchored := anchorFileRule(rule, roots); anchored != nil {
+				scoped = append(scoped, anchored...)
+				if inside {
+					scoped = append(scoped, rule)
+				}
+			} else if always || inside {
+				scoped = append(scoped, rule)
+			}
+		}
+		return scoped
+	}
+	return scope(rules.Allow, false), scope(rules.Deny, true)
+}
+
+// anchorFileRule rewrites a file rule with a relative path, e.g. Edit(src/*),
+// into one rule per root; it returns nil for any other rule
+func anchorFileRule(rule string, roots []string) []string {
+	open := strings.Index(rule, "(")
+	if open < 0 || !strings.HasSuffix(rule, ")") {
+		return nil
+	}
+	tool, path := rule[:open], rule[open+1:len(rule)-1]
+	if _, ok := fileRuleTools[tool]; !ok || path == "" || filepath.IsAbs(path) || strings.HasPrefix(path, "~") || strings.HasPrefix(path, "*") {
+		return nil
+	}
+	anchored := make([]string, len(roots))
+	for i, root := range roots {
+		anchored[i] = fmt.Sprintf("%s(%s)", tool, filepath.Join(root, path))
+	}
+	return anchored
+}
+
+// fileRuleTools are the tools whose rules name a file path
+var fileRuleTools = map[string]bool{"Read": true, "Write": true, "Edit": true, "NotebookEdit": true}
+
+// taskWorktrees returns the worktrees a task has in the project's repos
+func taskWorktrees(db Store, taskID string) []store.TaskWorktree {
+	if db == nil || taskID == "" {
+		return nil
+	}
+	worktrees, err := db.ListTaskWorktrees(taskID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list the task's worktrees: %v\n", err)
+	}
+	return worktrees
+}
+
+// taskWorkspace returns the worktree a task was started in, or "" if it has none
+func taskWorkspace(db Store, taskID string) string {
+	if db == nil || taskID == "" {
+		return ""
+	}
+	task, err := db.GetTask(taskID)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			fmt.Fprintf(os.Stderr, "Failed to load task: %v\n", err)
+		}
+		return ""
+	}
+	return task.WorktreePath
+}
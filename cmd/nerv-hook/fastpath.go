@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// AuditConfig controls which tool calls the hook records
+type AuditConfig struct {
+	// Reads records read-only tool calls (default true)
+	// When false, a Read, Grep, Glob, or LS outside sensitive directories that
+	// no deny rule matches is allowed without the full check: it isn't
+	// counted toward the session's tool calls or budgets, and a halted session
+	// can still read
+	Reads *bool `json:"reads,omitempty"`
+}
+
+// reads reports whether read-only tool calls go through the database
+func (c *AuditConfig) reads() bool {
+	return c == nil || c.Reads == nil || *c.Reads
+}
+
+// readOnlyTools are the tools the fast path may allow, and the input key holding the path each reads
+var readOnlyTools = map[string]string{
+	"Read": "file_path",
+	"Grep": "path",
+	"Glob": "path",
+	"LS":   "path",
+}
+
+// fastReadDecision decides a read-only tool call from the config alone, before
+// opening the database
+// It reports false whenever the call needs the full check: reads are audited,
+// the tool can change something, a plugin checks it, the path is sensitive or
+// NERV's own, a rule denies it, or the config changed since it was registered
+func fastReadDecision(cfg Config, input HookInput) (HookOutput, bool) {
+	key, ok := readOnlyTools[input.ToolName]
+	if !ok || cfg.Audit.reads() || rateLimited(cfg.RateLimits, input.ToolName) || cfg.Anomalies != nil || pluginsCover(cfg.Plugins, input.ToolName) {
+		return HookOutput{}, false
+	}
+	path, _ := input.ToolInput[key].(string)
+	if selfProtection(input.ToolName, input.ToolInput, input.Cwd) != "" {
+		return HookOutput{}, false
+	}
+	if _, action := sensitiveFile(cfg.SensitiveFiles, input.ToolName, input.ToolInput, input.Cwd); action != "" {
+		return HookOutput{}, false
+	}
+	// A read of a file the session redirected reads the copy, which needs the project's directories to decide
+	if cfg.RedirectWrites != nil && input.ToolName == "Read" {
+		return HookOutput{}, false
+	}
+	if sensitiveRead(input.Cwd, path) || tripwire(cfg.Tripwires, input.ToolName, input.ToolInput, input.Cwd) != "" || orgPolicyDenyReason() != "" || cfg.SchemaVersion > configSchemaVersion {
+		return HookOutput{}, false
+	}
+	// A config an agent rewrote could have turned read auditing off and dropped
+	// the deny rules, so only a registered one is trusted here
+	if !fastConfigRegistered() {
+		return HookOutput{}, false
+	}
+
+	// Only the deny rules of the repository's own config apply here, since
+	// finding its allow rules needs the project's registered directories
+	rules := cfg.Rules
+	rules.Dir = input.Cwd
+	rules.Deny = slices.Concat(rules.Deny, nearestProjectConfig(input.Cwd).Deny)
+	toolInput, _ := json.Marshal(input.ToolInput)
+	result := traceCheck(rules, input.ToolName, string(toolInput))
+	if result.DenyReason != "" || result.NeedsApproval {
+		return HookOutput{}, false
+	}
+	tracef(1, "fast path: %s allowed without opening the database", input.ToolName)
+	return HookOutput{SystemMessage: autoAllowMessage(result.AllowRule, 0)}, true
+}
+
+// fastConfigRegistered reports whether the permissions file is the one last
+// registered, or none ever was
+// The record in NERV_DIR answers without opening the database; only when it's
+// missing or out of date, as after the dashboard registers a file, is the
+// database asked, and the record brought up to date. A database it can't read counts as no
+func fastConfigRegistered() bool {
+	data, _ := os.ReadFile(configPath)
+	checksum := configChecksum(data)
+	if readConfigRecord() == checksum {
+		return true
+	}
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return false
+	}
+	defer st.Close()
+	c := checkConfigIntegrity(st)
+	if c.suspect() {
+		return false
+	}
+	if c.registered != "" {
+		writeConfigRecord(c.registered)
+	}
+	return true
+}
+
+// sensitiveDirs are never read on the fast path, whatever the rules say
+func sensitiveDirs() []string {
+	dirs := []string{nervDir, filepath.Dir(dbPath)}
+	if home, err := os.UserHomeDir(); err == nil {
+		for _, d := range []string{".ssh", ".aws", ".gnupg", ".kube", ".docker", ".config/gcloud"} {
+			dirs = append(dirs, filepath.Join(home, d))
+		}
+	}
+	// Windows keeps gcloud's credentials in %APPDATA% instead
+	if config, err := os.UserConfigDir(); err == nil && runtime.GOOS == "windows" {
+		dirs = append(dirs, filepath.Join(config, "gcloud"))
+	}
+	return dirs
+}
+
+// sensitiveRead reports whether path, resolved against cwd, is or is inside a
+// sensitive directory, as written or with its symlinks resolved
+// A path starting with ~ is treated as sensitive rather than guessed at
+func sensitiveRead(cwd, path string) bool {
+	if path == "" {
+		path = cwd
+	}
+	if strings.HasPrefix(path, "~") {
+		return true
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(cwd, path)
+	}
+	paths := []string{filepath.Clean(path), canonicalPath(path)}
+	for _, dir := range sensitiveDirs() {
+		for _, d := range []string{dir, canonicalPath(dir)} {
+			if within(d, paths[0]) || within(d, paths[1]) {
+				return true
+			}
+		}
+	}
+	for _, p := range paths {
+		if base := filepath.Base(p); base == ".env" || strings.HasPrefix(base, ".env.") {
+			return true
+		}
+	}
+	return false
+}
+
+// nearestProjectConfig reads the .nerv/permissions.json in dir or the closest directory above it
+func nearestProjectConfig(dir string) ProjectConfig {
+	for dir != "" {
+		if cfg, err := readProjectConfig(dir); err == nil {
+			return cfg
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return ProjectConfig{}
+}
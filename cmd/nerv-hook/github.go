@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultGitHubAPI is api.github.com; github.api_url overrides it for GitHub Enterprise
+const defaultGitHubAPI = "https://api.github.com"
+
+// defaultGitHubTokenEnv holds the token when a project names neither a token variable nor an app
+const defaultGitHubTokenEnv = "GITHUB_TOKEN"
+
+// githubTimeout bounds each GitHub API request
+const githubTimeout = 30 * time.Second
+
+// GitHubConfig connects projects to GitHub repositories
+// Credentials come from the environment or a key file, never the config itself
+type GitHubConfig struct {
+	// APIURL is the REST API root, for GitHub Enterprise (default https://api.github.com)
+	APIURL string `json:"api_url,omitempty"`
+	// Projects maps a project ID to its repository
+	Projects map[string]*GitHubProject `json:"projects,omitempty"`
+}
+
+// GitHubProject is one project's repository and how to authenticate to it
+type GitHubProject struct {
+	// Repo is owner/name
+	Repo string `json:"repo"`
+	// TokenEnv names the environment variable holding a token (default GITHUB_TOKEN)
+	TokenEnv string `json:"token_env,omitempty"`
+	// App authenticates as a GitHub App installation instead of with a token
+	App *GitHubApp `json:"app,omitempty"`
+	// Label limits the issues imported as tasks to ones carrying it
+	Label string `json:"label,omitempty"`
+	// DraftPR opens a draft pull request from the task's branch when a session stops
+	DraftPR bool `json:"draft_pr,omitempty"`
+	// Base is the branch pull requests target (default the repository's default branch)
+	Base string `json:"base,omitempty"`
+}
+
+// GitHubApp identifies a GitHub App installation
+type GitHubApp struct {
+	AppID          int64 `json:"app_id"`
+	InstallationID int64 `json:"installation_id"`
+	// PrivateKeyPath is the app's PEM private key
+	PrivateKeyPath string `json:"private_key_path"`
+}
+
+// project returns a project's GitHub settings, or nil if it isn't connected
+func (c *GitHubConfig) project(projectID string) *GitHubProject {
+	if c == nil {
+		return nil
+	}
+	return c.Projects[projectID]
+}
+
+// apiURL returns the configured API root or the default
+func (c *GitHubConfig) apiURL() string {
+	if c == nil || c.APIURL == "" {
+		return defaultGitHubAPI
+	}
+	return strings.TrimSuffix(c.APIURL, "/")
+}
+
+// Validate reports GitHub settings that can't be used
+func (c *GitHubConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.APIURL != "" {
+		if u, err := url.Parse(c.APIURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("api_url %q is not a URL", c.APIURL)
+		}
+	}
+	for id, p := range c.Projects {
+		if p == nil {
+			return fmt.Errorf("projects: %s has no settings", id)
+		}
+		if owner, name, ok := strings.Cut(p.Repo, "/"); !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("projects: %s: repo %q is not owner/name", id, p.Repo)
+		}
+		if p.App != nil && (p.App.AppID <= 0 || p.App.InstallationID <= 0 || p.App.PrivateKeyPath == "") {
+			return fmt.Errorf("projects: %s: app needs app_id, installation_id and private_key_path", id)
+		}
+		if p.App != nil && p.TokenEnv != "" {
+			return fmt.Errorf("projects: %s: use either token_env or app, not both", id)
+		}
+	}
+	return nil
+}
+
+// githubClient calls the GitHub REST API for one repository
+type githubClient struct {
+	api   string
+	repo  string
+	token func() (string, error)
+	http  *http.Client
+}
+
+// newGitHubClient returns a client for a project's repository
+func newGitHubClient(cfg *GitHubConfig, p *GitHubProject) *githubClient {
+	c := &githubClient{api: cfg.apiURL(), repo: p.Repo, http: &http.Client{Timeout: githubTimeout}}
+	if p.App != nil {
+		app := *p.App
+		c.token = func() (string, error) { return installationToken(c, app) }
+	} else {
+		env := p.TokenEnv
+		if env == "" {
+			env = defaultGitHubTokenEnv
+		}
+		c.token = func() (string, error) {
+			if token := os.Getenv(env); token != "" {
+				return token, nil
+			}
+			return "", fmt.Errorf("%s is not set", env)
+		}
+	}
+	return c
+}
+
+// githubError is a failed API response
+type githubError struct {
+	Status  int
+	Message string
+}
+
+func (e *githubError) Error() string {
+	return fmt.Sprintf("GitHub API: %d %s", e.Status, e.Message)
+}
+
+// isGitHubStatus reports whether err is an API response with this status
+func isGitHubStatus(err error, status int) bool {
+	var gerr *githubError
+	return errors.As(err, &gerr) && gerr.Status == status
+}
+
+// do sends a request with the repository's credentials and decodes the JSON response into out
+// path is relative to the API root; "{repo}" in it is replaced with the repository
+func (c *githubClient) do(method, path string, body, out interface{}) error {
+	token, err := c.token()
+	if err != nil {
+		return err
+	}
+	return c.send(method, strings.ReplaceAll(path, "{repo}", c.repo), "token "+token, body, out)
+}
+
+func (c *githubClient) send(method, path, auth string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.api+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	req.Header.Set("Authorization", auth)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var msg struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&msg)
+		return &githubError{Status: resp.StatusCode, Message: msg.Message}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// githubIssue is the part of an issue the sync uses
+type githubIssue struct {
+	Number  int    `json:"number"`
+	Title   string `json:"title"`
+	Body    string `json:"body"`
+	State   string `json:"state"`
+	HTMLURL string `json:"html_url"`
+	// PullRequest is set when the "issue" is a pull request
+	PullRequest *json.RawMessage `json:"pull_request,omitempty"`
+}
+
+// openIssues lists the repository's open issues, leaving out pull requests
+func (c *githubClient) openIssues(label string) ([]githubIssue, error) {
+	query := url.Values{"state": {"open"}, "per_page": {"100"}}
+	if label != "" {
+		query.Set("labels", label)
+	}
+
+	var issues []githubIssue
+	for page := 1; ; page++ {
+		query.Set("page", fmt.Sprint(page))
+		var batch []githubIssue
+		if err := c.do("GET", "/repos/{repo}/issues?"+query.Encode(), nil, &batch); err != nil {
+			return nil, err
+		}
+		for _, issue := range batch {
+			if issue.PullRequest == nil {
+				issues = append(issues, issue)
+			}
+		}
+		if len(batch) < 100 {
+			return issues, nil
+		}
+	}
+}
+
+// issue loads one issue
+func (c *githubClient) issue(number int) (githubIssue, error) {
+	var issue githubIssue
+	err := c.do("GET", fmt.Sprintf("/repos/{repo}/issues/%d", number), nil, &issue)
+	return issue, err
+}
+
+// installationTokens caches app installation tokens until shortly before they expire
+var installationTokens = struct {
+	sync.Mutex
+	tokens map[int64]cachedToken
+}{tokens: map[int64]cachedToken{}}
+
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+// installationToken returns a token for a GitHub App installation, minting one with the app's key if needed
+func installationToken(c *githubClient, app GitHubApp) (string, error) {
+	installationTokens.Lock()
+	defer installationTokens.Unlock()
+	if cached, ok := installationTokens.tokens[app.InstallationID]; ok && time.Until(cached.expires) > time.Minute {
+		return cached.token, nil
+	}
+
+	jwt, err := appJWT(app, time.Now())
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := c.send("POST", fmt.Sprintf("/app/installations/%d/access_tokens", app.InstallationID), "Bearer "+jwt, nil, &resp); err != nil {
+		return "", fmt.Errorf("app installation token: %w", err)
+	}
+	installationTokens.tokens[app.InstallationID] = cachedToken{token: resp.Token, expires: resp.ExpiresAt}
+	return resp.Token, nil
+}
+
+// appJWT signs the short-lived JWT a GitHub App exchanges for an installation token
+func appJWT(app GitHubApp, now time.Time) (string, error) {
+	data, err := os.ReadFile(app.PrivateKeyPath)
+	if err != nil {
+		return "", err
+	}
+	key, err := parseRSAKey(data)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", app.PrivateKeyPath, err)
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	// Backdated a minute for clock drift; GitHub allows at most ten minutes
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": fmt.Sprint(app.AppID),
+	})
+	signing := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signing + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// parseRSAKey reads a PEM RSA private key in PKCS#1 (what GitHub issues) or PKCS#8 form
+func parseRSAKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not RSA")
+	}
+	return key, nil
+}
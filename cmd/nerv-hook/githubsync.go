@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+const githubUsage = "usage: nerv-hook github sync|status"
+
+// githubStatusLabel is the issue label that mirrors a task's status, e.g. nerv:in_progress
+const githubStatusLabel = "nerv:"
+
+// runGitHub implements `nerv-hook github`
+func runGitHub(args []string) error {
+	if len(args) < 1 {
+		return errors.New(githubUsage)
+	}
+
+	switch args[0] {
+	case "sync":
+		return runGitHubSync(args[1:])
+	case "status":
+		return runGitHubStatus(args[1:])
+	default:
+		return errors.New(githubUsage)
+	}
+}
+
+// runGitHubSync syncs connected projects once, the same pass nervd makes on a schedule
+func runGitHubSync(args []string) error {
+	fs := flag.NewFlagSet("github sync", flag.ContinueOnError)
+	projectID := fs.String("project", "", "sync only this project (default every connected project)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg := loadConfig().GitHub
+	projects, err := githubProjects(cfg, *projectID)
+	if err != nil {
+		return err
+	}
+
+	st, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	failed := 0
+	for _, id := range projects {
+		result, err := syncGitHubProject(st, cfg, id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Project %s: %v\n", id, err)
+			failed++
+			continue
+		}
+		fmt.Printf("Project %s (%s): %d imported, %d issues updated, %d closed on GitHub, %d reopened on GitHub\n",
+			id, cfg.project(id).Repo, result.Imported, result.Updated, result.Closed, result.Reopened)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d projects failed to sync", failed, len(projects))
+	}
+	return nil
+}
+
+// runGitHubStatus lists the tasks linked to issues and pull requests
+func runGitHubStatus(args []string) error {
+	fs := flag.NewFlagSet("github status", flag.ContinueOnError)
+	projectID := fs.String("project", "", "only this project's tasks")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	links, err := st.ListGitHubLinks(*projectID)
+	if err != nil {
+		return err
+	}
+	if len(links) == 0 {
+		fmt.Println("No tasks are linked to GitHub")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK\tPROJECT\tREPO\tISSUE\tPR\tSTATUS\tON GITHUB")
+	for _, l := range links {
+		issue, pr, synced := "-", "-", l.SyncedStatus
+		if l.IssueNumber > 0 {
+			issue = fmt.Sprintf("#%d", l.IssueNumber)
+		}
+		if l.PRNumber > 0 {
+			pr = fmt.Sprintf("#%d", l.PRNumber)
+		}
+		if synced == "" {
+			synced = "-"
+		} else if synced != l.Status {
+			synced += " (pending)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", l.TaskID, l.ProjectID, l.Repo, issue, pr, l.Status, synced)
+	}
+	return w.Flush()
+}
+
+// githubProjects returns the connected projects to sync, in a stable order
+func githubProjects(cfg *GitHubConfig, only string) ([]string, error) {
+	if only != "" {
+		if cfg.project(only) == nil {
+			return nil, fmt.Errorf("project %s isn't connected to GitHub; add it under github.projects in %s", only, configPath)
+		}
+		return []string{only}, nil
+	}
+	if cfg == nil || len(cfg.Projects) == 0 {
+		return nil, fmt.Errorf("no projects are connected to GitHub; add them under github.projects in %s", configPath)
+	}
+	var ids []string
+	for id := range cfg.Projects {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// scheduleGitHubSync syncs every connected project each interval
+// Settings are reread each time, so projects can be connected while nervd runs
+func scheduleGitHubSync(st *store.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cfg := loadConfig().GitHub
+		if cfg == nil {
+			continue
+		}
+		projects, _ := githubProjects(cfg, "")
+		for _, id := range projects {
+			if _, err := syncGitHubProject(st, cfg, id); err != nil {
+				fmt.Fprintf(os.Stderr, "nervd: github: project %s: %v\n", id, err)
+			}
+		}
+	}
+}
+
+// githubSyncResult counts what one sync changed
+type githubSyncResult struct {
+	Imported int
+	Updated  int
+	Closed   int
+	Reopened int
+}
+
+// syncGitHubProject makes one pass in each direction for a project
+// Open issues without a task are imported, issues closed or reopened on GitHub
+// move their task, and task status changes made anywhere are written back to the issue
+func syncGitHubProject(st *store.DB, cfg *GitHubConfig, projectID string) (githubSyncResult, error) {
+	var result githubSyncResult
+	p := cfg.project(projectID)
+	client := newGitHubClient(cfg, p)
+
+	issues, err := client.openIssues(p.Label)
+	if err != nil {
+		return result, err
+	}
+	open := map[int]bool{}
+	for _, issue := range issues {
+		open[issue.Number] = true
+
+		link, err := st.GitHubLinkForIssue(p.Repo, issue.Number)
+		if errors.Is(err, store.ErrNotFound) {
+			if err := importIssue(st, projectID, p.Repo, issue); err != nil {
+				return result, err
+			}
+			result.Imported++
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		// Closed by NERV and since reopened on GitHub
+		if finished(link.Status) && link.SyncedStatus == link.Status {
+			if err := moveFromGitHub(st, link, store.TaskTodo, "github_issue_reopened"); err != nil {
+				return result, err
+			}
+			result.Reopened++
+		}
+	}
+
+	links, err := st.ListGitHubLinks(projectID)
+	if err != nil {
+		return result, err
+	}
+	for _, link := range links {
+		if link.IssueNumber == 0 || link.Repo != p.Repo {
+			continue
+		}
+
+		// Not in the open list: closed on GitHub, or only relabelled
+		if !open[link.IssueNumber] && !finished(link.Status) && !finished(link.SyncedStatus) {
+			issue, err := client.issue(link.IssueNumber)
+			if err != nil {
+				return result, err
+			}
+			if issue.State == "closed" {
+				to := store.TaskAbandoned
+				if link.Status == store.TaskReview {
+					to = store.TaskDone
+				}
+				if err := moveFromGitHub(st, link, to, "github_issue_closed"); err != nil {
+					return result, err
+				}
+				result.Closed++
+				continue
+			}
+		}
+
+		if link.Status == link.SyncedStatus {
+			continue
+		}
+		if err := pushIssueStatus(client, link); err != nil {
+			return result, fmt.Errorf("issue #%d: %w", link.IssueNumber, err)
+		}
+		if err := st.MarkGitHubSynced(link.TaskID, link.Status); err != nil {
+			return result, err
+		}
+		details, _ := json.Marshal(map[string]interface{}{"repo": link.Repo, "issue": link.IssueNumber, "status": link.Status})
+		logAudit(st, link.TaskID, "github_issue_updated", string(details))
+		result.Updated++
+	}
+	return result, nil
+}
+
+// finished reports whether a task status closes its issue
+func finished(status string) bool {
+	return status == store.TaskDone || status == store.TaskAbandoned
+}
+
+// importIssue creates a todo task for an issue
+func importIssue(st *store.DB, projectID, repo string, issue githubIssue) error {
+	description := strings.TrimSpace(issue.Body)
+	if description != "" {
+		description += "\n\n"
+	}
+	description += issue.HTMLURL
+
+	task := store.Task{ID: store.NewID(), ProjectID: projectID, Title: issue.Title, Description: description}
+	details, _ := json.Marshal(map[string]interface{}{"projectId": projectID, "title": task.Title, "source": "github", "repo": repo, "issue": issue.Number})
+	return st.ImportIssueTask(task, repo, issue.Number, string(details))
+}
+
+// moveFromGitHub applies a status change made on GitHub, if the state machine allows it,
+// and marks the issue synced so the change isn't echoed back
+func moveFromGitHub(st *store.DB, link store.GitHubLink, to, eventType string) error {
+	moved := false
+	if store.CanTransition(link.Status, to) {
+		var err error
+		if moved, err = st.SetTaskStatus(link.TaskID, link.Status, to, "github"); err != nil {
+			return err
+		}
+	}
+	if moved {
+		details, _ := json.Marshal(map[string]string{"status": to, "source": "github"})
+		logAudit(st, link.TaskID, "task_status_changed", string(details))
+	} else {
+		to = link.Status
+	}
+
+	details, _ := json.Marshal(map[string]interface{}{"repo": link.Repo, "issue": link.IssueNumber, "status": to})
+	logAudit(st, link.TaskID, eventType, string(details))
+	return st.MarkGitHubSynced(link.TaskID, to)
+}
+
+// pushIssueStatus writes a task's status to its issue: a nerv:<status> label,
+// a comment, and the open or closed state
+func pushIssueStatus(c *githubClient, link store.GitHubLink) error {
+	issuePath := fmt.Sprintf("/repos/{repo}/issues/%d", link.IssueNumber)
+
+	if link.SyncedStatus != "" {
+		err := c.do("DELETE", issuePath+"/labels/"+url.PathEscape(githubStatusLabel+link.SyncedStatus), nil, nil)
+		if err != nil && !isGitHubStatus(err, 404) {
+			return err
+		}
+	}
+	if err := c.do("POST", issuePath+"/labels", map[string][]string{"labels": {githubStatusLabel + link.Status}}, nil); err != nil {
+		return err
+	}
+	comment := fmt.Sprintf("NERV task `%s` is now **%s**.", link.TaskID, link.Status)
+	if err := c.do("POST", issuePath+"/comments", map[string]string{"body": comment}, nil); err != nil {
+		return err
+	}
+
+	switch {
+	case link.Status == store.TaskDone:
+		return c.do("PATCH", issuePath, map[string]string{"state": "closed", "state_reason": "completed"}, nil)
+	case link.Status == store.TaskAbandoned:
+		return c.do("PATCH", issuePath, map[string]string{"state": "closed", "state_reason": "not_planned"}, nil)
+	case finished(link.SyncedStatus):
+		return c.do("PATCH", issuePath, map[string]string{"state": "open"}, nil)
+	}
+	return nil
+}
+
+// recordDraftPR pushes a task's branch and opens a draft pull request for it, if the
+// project asks for one; called from the stop hook, so failures are reported, not returned
+func recordDraftPR(db Store, taskID string) {
+	cfg := loadConfig().GitHub
+	task, err := db.GetTask(taskID)
+	if err != nil || task.Branch == "" {
+		return
+	}
+	p := cfg.project(task.ProjectID)
+	if p == nil || !p.DraftPR {
+		return
+	}
+	dir := task.WorktreePath
+	if dir == "" {
+		if dir, err = os.Getwd(); err != nil {
+			return
+		}
+	}
+
+	link, err := db.GetGitHubLink(taskID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		fmt.Fprintf(os.Stderr, "Failed to load the task's GitHub link: %v\n", err)
+		return
+	}
+	if _, err := git(dir, "push", "--set-upstream", "origin", task.Branch); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to push %s: %v\n", task.Branch, err)
+		return
+	}
+	// The push updated the pull request that's already open
+	if link.PRNumber > 0 {
+		return
+	}
+
+	pr, err := openPullRequest(newGitHubClient(cfg, p), p, task, link.IssueNumber)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open a draft pull request: %v\n", err)
+		return
+	}
+	if err := db.SetGitHubPR(taskID, p.Repo, pr.Number); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record pull request #%d: %v\n", pr.Number, err)
+		return
+	}
+	details, _ := json.Marshal(map[string]interface{}{"repo": p.Repo, "pr": pr.Number, "url": pr.HTMLURL, "branch": task.Branch})
+	logAudit(db, taskID, "github_pr_opened", string(details))
+}
+
+// githubPull is the part of a pull request the sync uses
+type githubPull struct {
+	Number  int    `json:"number"`
+	HTMLURL string `json:"html_url"`
+}
+
+// openPullRequest returns the open pull request from the task's branch, opening a draft one if there isn't one
+func openPullRequest(c *githubClient, p *GitHubProject, task store.Task, issueNumber int) (githubPull, error) {
+	owner, _, _ := strings.Cut(p.Repo, "/")
+	query := url.Values{"head": {owner + ":" + task.Branch}, "state": {"open"}}
+	var existing []githubPull
+	if err := c.do("GET", "/repos/{repo}/pulls?"+query.Encode(), nil, &existing); err != nil {
+		return githubPull{}, err
+	}
+	if len(existing) > 0 {
+		return existing[0], nil
+	}
+
+	base := p.Base
+	if base == "" {
+		var repo struct {
+			DefaultBranch string `json:"default_branch"`
+		}
+		if err := c.do("GET", "/repos/{repo}", nil, &repo); err != nil {
+			return githubPull{}, err
+		}
+		base = repo.DefaultBranch
+	}
+
+	body := fmt.Sprintf("Opened by NERV for task `%s`.", task.ID)
+	if issueNumber > 0 {
+		body += fmt.Sprintf("\n\nCloses #%d", issueNumber)
+	}
+	var pr githubPull
+	err := c.do("POST", "/repos/{repo}/pulls", map[string]interface{}{
+		"title": task.Title,
+		"head":  task.Branch,
+		"base":  base,
+		"body":  body,
+		"draft": true,
+	}, &pr)
+	return pr, err
+}
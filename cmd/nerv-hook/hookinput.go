@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// Defaults for InputConfig
+const (
+	defaultMaxInputBytes = 16 << 20
+	defaultMaxFieldBytes = 64 << 10
+)
+
+// InputConfig bounds the hook events nerv-hook reads and what it keeps of them
+type InputConfig struct {
+	// MaxBytes is the largest event read from stdin (default 16 MiB)
+	// A larger pre-tool-use event is refused like malformed input
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+	// MaxFieldBytes is the longest tool_input string stored in approvals and the audit log (default 64 KiB)
+	// A longer one keeps its start and the SHA-256 of the whole value
+	MaxFieldBytes int `json:"max_field_bytes,omitempty"`
+}
+
+func (c *InputConfig) maxBytes() int64 {
+	if c == nil || c.MaxBytes <= 0 {
+		return defaultMaxInputBytes
+	}
+	return c.MaxBytes
+}
+
+func (c *InputConfig) maxFieldBytes() int {
+	if c == nil || c.MaxFieldBytes <= 0 {
+		return defaultMaxFieldBytes
+	}
+	return c.MaxFieldBytes
+}
+
+// Validate reports input limits that can't be applied
+func (c *InputConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.MaxBytes < 0 {
+		return fmt.Errorf("max_bytes: %d is negative", c.MaxBytes)
+	}
+	if c.MaxFieldBytes < 0 {
+		return fmt.Errorf("max_field_bytes: %d is negative", c.MaxFieldBytes)
+	}
+	return nil
+}
+
+// errInputTooLarge is returned by readHookInput for an event over the size limit
+var errInputTooLarge = errors.New("hook input exceeds the size limit")
+
+// cappedReader fails with errInputTooLarge once more than n bytes have been read
+type cappedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.n < 0 {
+		return 0, errInputTooLarge
+	}
+	if int64(len(p)) > c.n+1 {
+		p = p[:c.n+1]
+	}
+	n, err := c.r.Read(p)
+	c.n -= int64(n)
+	if c.n < 0 {
+		return n, errInputTooLarge
+	}
+	return n, err
+}
+
+// readHookInput decodes one JSON event from r, reading at most max bytes
+// Empty input returns no data and no error, as the agent may send nothing
+func readHookInput(r io.Reader, max int64) ([]byte, error) {
+	var raw json.RawMessage
+	capped := &cappedReader{r: r, n: max}
+	err := json.NewDecoder(capped).Decode(&raw)
+	// The decoder can finish a value on the byte that went over the limit
+	if capped.n < 0 {
+		return nil, fmt.Errorf("%w of %d bytes", errInputTooLarge, max)
+	}
+	if err == io.EOF {
+		return nil, nil
+	}
+	return raw, err
+}
+
+// storedToolInput encodes a tool input for approvals and the audit log
+// String fields over max bytes are truncated, except the one rules match on,
+// so a stored approval still shows the reviewer the whole command or path
+func storedToolInput(toolName string, toolInput map[string]interface{}, max int) string {
+	keep := signatureFields[toolName]
+	var truncated map[string]interface{}
+	for key, value := range toolInput {
+		s, ok := value.(string)
+		if !ok || len(s) <= max || key == keep {
+			continue
+		}
+		if truncated == nil {
+			truncated = make(map[string]interface{}, len(toolInput))
+			for k, v := range toolInput {
+				truncated[k] = v
+			}
+		}
+		truncated[key] = truncateField(s, max)
+	}
+	if truncated == nil {
+		truncated = toolInput
+	}
+	data, _ := json.Marshal(truncated)
+	return string(data)
+}
+
+// truncateField cuts s to at most max bytes on a rune boundary and notes its full size and hash
+func truncateField(s string, max int) string {
+	cut := max
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	sum := sha256.Sum256([]byte(s))
+	return fmt.Sprintf("%s…[truncated %d bytes, sha256:%s]", s[:cut], len(s), hex.EncodeToString(sum[:]))
+}
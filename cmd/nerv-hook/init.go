@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/nerv/nerv-hook/internal/migrations"
+	"github.com/nerv/nerv-hook/internal/store"
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// permissionsComment documents the permissions file inline
+// JSON has no comments, so it lives under a key both the hook and dashboard ignore
+var permissionsComment = []string{
+	"NERV permission rules for the nerv-hook binary.",
+	"Rules look like Tool or Tool(pattern): * matches anything, e.g. Bash(npm test:*) or Read(~/.ssh/*).",
+	"deny is checked first and always wins; allow runs without asking.",
+	"Bash, Write, Edit and NotebookEdit need approval unless an allow rule matches; other tools run freely.",
+	"transcript sets per-event visibility of NERV messages: full (default), quiet, or hidden.",
+}
+
+// runInit implements `nerv-hook init`
+func runInit(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	force := fs.Bool("force", false, "overwrite an existing permissions file with the defaults")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := setUpNerv(os.Stdout, *force); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Println("Next steps:")
+	fmt.Println("  1. Review the rules in", configPath)
+	fmt.Println("  2. Register the hooks with Claude Code:  nerv-hook install")
+	fmt.Println("  3. Register your project directory:      nerv-hook project add .")
+	fmt.Println("  4. Start Claude Code with NERV_TASK_ID set, or launch it from the NERV dashboard")
+	return nil
+}
+
+// setUpNerv creates the NERV directory, state database and permissions file,
+// reporting each to out; it's safe to run again
+func setUpNerv(out io.Writer, force bool) error {
+	// --config and --db may point outside the NERV directory
+	for _, dir := range []string{nervDir, filepath.Dir(configPath), filepath.Dir(dbPath)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+	fmt.Fprintf(out, "NERV directory: %s\n", nervDir)
+
+	location, version, err := initDatabase()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "State database: %s (schema version %d)\n", location, version)
+
+	written, err := writeDefaultPermissions(force)
+	if err != nil {
+		return err
+	}
+	if written {
+		fmt.Fprintf(out, "Permissions:    %s (defaults written)\n", configPath)
+	} else {
+		fmt.Fprintf(out, "Permissions:    %s (kept existing, use --force to reset)\n", configPath)
+	}
+
+	// Rewritten every time, so editors see the settings of the binary that's installed
+	schemaPath := filepath.Join(filepath.Dir(configPath), permissionsSchemaFile)
+	if err := os.WriteFile(schemaPath, permissionsSchema, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Schema:         %s\n", schemaPath)
+	return registerInitConfig(written)
+}
+
+// registerInitConfig registers the permissions file init wrote, or an existing
+// one if none has been registered yet, so hooks start checking it
+func registerInitConfig(written bool) error {
+	st, err := openRawStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	if !written {
+		if registered, _ := st.GetSetting(store.SettingConfigChecksum); registered != "" {
+			return nil
+		}
+	}
+	return registerConfig(st)
+}
+
+// initDatabase creates the state database if needed and applies all migrations
+// With NERV_DB_URL set the PostgreSQL database must already exist; only its tables are created
+// Returns where the database lives and the resulting schema version
+func initDatabase() (string, int, error) {
+	var st *store.DB
+	var err error
+	if os.Getenv("NERV_DB_URL") != "" {
+		st, err = openRawStore()
+	} else {
+		st, err = store.OpenSQLite(dbPath, "rwc", dbOptions())
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	defer st.Close()
+
+	if _, err := st.Migrate(); err != nil {
+		return "", 0, err
+	}
+
+	version, err := migrations.Current(st.SQL(), st.Dialect())
+	return st.Location(), version, err
+}
+
+// writeDefaultPermissions writes the default permissions file unless one already exists
+func writeDefaultPermissions(force bool) (bool, error) {
+	if _, err := os.Stat(configPath); err == nil && !force {
+		return false, nil
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	perms := policy.Default()
+	doc := struct {
+		Schema     string            `json:"$schema"`
+		Comment    []string          `json:"$comment"`
+		Allow      []string          `json:"allow"`
+		Deny       []string          `json:"deny"`
+		Transcript map[string]string `json:"transcript"`
+	}{
+		Schema:  "./" + permissionsSchemaFile,
+		Comment: permissionsComment,
+		Allow:   perms.Allow,
+		Deny:    perms.Deny,
+		Transcript: map[string]string{
+			"pre-tool-use":  visibilityFull,
+			"post-tool-use": visibilityFull,
+			"stop":          visibilityFull,
+		},
+	}
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return false, err
+	}
+
+	return true, os.WriteFile(configPath, append(data, '\n'), 0600)
+}
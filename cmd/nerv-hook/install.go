@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// hookTimeoutSeconds is the Claude hook timeout written by install
+// Must exceed the 10 minute approval wait in handlePreToolUse
+const hookTimeoutSeconds = 660
+
+// hookRegistration describes one hook entry NERV registers in Claude settings
+type hookRegistration struct {
+	Event   string // Claude hook event name
+	Matcher string // Tool matcher, empty for events without tools
+	Command string // nerv-hook subcommand
+}
+
+// nervHookRegistrations mirrors generateHookConfig in src/main/hooks.ts
+var nervHookRegistrations = []hookRegistration{
+	{Event: "PreToolUse", Matcher: "Bash", Command: "pre-tool-use"},
+	{Event: "PreToolUse", Matcher: "Write|Edit", Command: "pre-tool-use"},
+	{Event: "PostToolUse", Matcher: "Bash|Write|Edit", Command: "post-tool-use"},
+	{Event: "SessionStart", Command: "session-start"},
+	{Event: "UserPromptSubmit", Command: "user-prompt-submit"},
+	{Event: "Stop", Command: "stop"},
+}
+
+// installOptions holds the flags shared by install and uninstall
+type installOptions struct {
+	scope      string
+	projectDir string
+	hookPath   string
+	timeout    int
+}
+
+// parseInstallFlags parses install/uninstall flags
+func parseInstallFlags(name string, args []string) (installOptions, error) {
+	var opts installOptions
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&opts.scope, "scope", "user", "settings to modify: user (~/.claude/settings.json) or project (.claude/settings.json)")
+	fs.StringVar(&opts.projectDir, "project-dir", ".", "project root used with --scope project")
+	fs.StringVar(&opts.hookPath, "hook-path", "", "path to the nerv-hook binary (defaults to this executable)")
+	fs.IntVar(&opts.timeout, "timeout", hookTimeoutSeconds, "hook timeout in seconds")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+
+	if opts.scope != "user" && opts.scope != "project" {
+		return opts, fmt.Errorf("invalid scope %q (expected user or project)", opts.scope)
+	}
+
+	return opts, nil
+}
+
+// claudeSettingsPath returns the Claude settings file for the selected scope
+func claudeSettingsPath(opts installOptions) (string, error) {
+	if opts.scope == "project" {
+		dir, err := filepath.Abs(opts.projectDir)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, ".claude", "settings.json"), nil
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".claude", "settings.json"), nil
+}
+
+// resolveHookBinary returns the absolute path of the hook binary and verifies it is runnable
+func resolveHookBinary(hookPath string) (string, error) {
+	if hookPath == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return "", fmt.Errorf("cannot determine nerv-hook path: %w", err)
+		}
+		hookPath = exe
+	}
+
+	abs, err := filepath.Abs(hookPath)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = resolved
+	}
+
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", fmt.Errorf("nerv-hook binary not found: %w", err)
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("nerv-hook path is a directory: %s", abs)
+	}
+	if filepath.Ext(abs) != ".exe" && info.Mode().Perm()&0111 == 0 {
+		return "", fmt.Errorf("nerv-hook binary is not executable: %s", abs)
+	}
+
+	return abs, nil
+}
+
+// runInstall registers the NERV hooks in Claude settings
+func runInstall(args []string) error {
+	opts, err := parseInstallFlags("install", args)
+	if err != nil {
+		return err
+	}
+
+	hookPath, err := resolveHookBinary(opts.hookPath)
+	if err != nil {
+		return err
+	}
+
+	settingsPath, err := claudeSettingsPath(opts)
+	if err != nil {
+		return err
+	}
+
+	settings, err := readClaudeSettings(settingsPath)
+	if err != nil {
+		return err
+	}
+
+	// Hooks must find the same state as the install command was pointed at
+	// Arguments are quoted without escapes, so a Windows path's backslashes
+	// reach the hook as written whether cmd or a POSIX shell runs it
+	globalArgs := ""
+	for _, arg := range pathOverrideArgs() {
+		globalArgs += fmt.Sprintf(` "%s"`, arg)
+	}
+
+	hooks := removeNervHooks(settings, hookPath)
+	for _, reg := range nervHookRegistrations {
+		entry := map[string]interface{}{
+			"hooks": []interface{}{
+				map[string]interface{}{
+					"type":    "command",
+					"command": fmt.Sprintf(`"%s"%s %s`, hookPath, globalArgs, reg.Command),
+					"timeout": opts.timeout,
+				},
+			},
+		}
+		if reg.Matcher != "" {
+			entry["matcher"] = reg.Matcher
+		}
+		entries, _ := hooks[reg.Event].([]interface{})
+		hooks[reg.Event] = append(entries, entry)
+	}
+	settings["hooks"] = hooks
+
+	if err := writeClaudeSettings(settingsPath, settings); err != nil {
+		return err
+	}
+
+	// Hooks warn once the binary no longer matches what was installed
+	if err := recordHookBinary(hookPath); err != nil {
+		return fmt.Errorf("failed to record the hook binary: %w", err)
+	}
+
+	fmt.Printf("Registered NERV hooks in %s\n", settingsPath)
+	fmt.Printf("Hook binary: %s\n", hookPath)
+	return nil
+}
+
+// runUninstall removes the NERV hooks from Claude settings, leaving other hooks intact
+func runUninstall(args []string) error {
+	opts, err := parseInstallFlags("uninstall", args)
+	if err != nil {
+		return err
+	}
+
+	settingsPath, err := claudeSettingsPath(opts)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(settingsPath); errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("No Claude settings at %s, nothing to uninstall\n", settingsPath)
+		return nil
+	}
+
+	settings, err := readClaudeSettings(settingsPath)
+	if err != nil {
+		return err
+	}
+
+	// The binary may already be gone, so only resolve its path best-effort
+	hookPath := opts.hookPath
+	if hookPath == "" {
+		hookPath, _ = os.Executable()
+	}
+
+	hooks := removeNervHooks(settings, hookPath)
+	if len(hooks) == 0 {
+		delete(settings, "hooks")
+	} else {
+		settings["hooks"] = hooks
+	}
+
+	if err := writeClaudeSettings(settingsPath, settings); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed NERV hooks from %s\n", settingsPath)
+	return nil
+}
+
+// readClaudeSettings loads a Claude settings file, returning an empty object if it doesn't exist
+func readClaudeSettings(path string) (map[string]interface{}, error) {
+	settings := map[string]interface{}{}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return settings, nil
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		// Refuse to overwrite a file we can't parse
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return settings, nil
+}
+
+// writeClaudeSettings writes the settings atomically via a temp file and rename
+func writeClaudeSettings(path string, settings map[string]interface{}) error {
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".settings-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	// CreateTemp makes the file 0600; keep the mode of the settings file it replaces
+	if info, err := os.Stat(path); err == nil {
+		if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// removeNervHooks strips every hook entry that invokes nerv-hook (by name or at hookPath)
+// Returns the remaining hooks object with empty events dropped
+func removeNervHooks(settings map[string]interface{}, hookPath string) map[string]interface{} {
+	hooks, _ := settings["hooks"].(map[string]interface{})
+	if hooks == nil {
+		return map[string]interface{}{}
+	}
+
+	for event, value := range hooks {
+		entries, ok := value.([]interface{})
+		if !ok {
+			continue
+		}
+
+		var kept []interface{}
+		for _, entry := range entries {
+			if !isNervHookEntry(entry, hookPath) {
+				kept = append(kept, entry)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(hooks, event)
+		} else {
+			hooks[event] = kept
+		}
+	}
+
+	return hooks
+}
+
+// isNervHookEntry reports whether a matcher entry only runs nerv-hook commands
+func isNervHookEntry(entry interface{}, hookPath string) bool {
+	m, ok := entry.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	commands, ok := m["hooks"].([]interface{})
+	if !ok || len(commands) == 0 {
+		return false
+	}
+
+	for _, c := range commands {
+		hook, ok := c.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		command, _ := hook["command"].(string)
+		if !strings.Contains(command, "nerv-hook") && (hookPath == "" || !strings.Contains(command, hookPath)) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,266 @@
+// Package migrations owns the hook's schema changes to the NERV state database
+//
+// Migrations are versioned SQL files embedded from sql/<dialect>/ and named
+// NNNN_description.sql. Applied versions are tracked in hook_schema_version,
+// separate from the dashboard's schema_version table, so the two migration
+// sequences never collide on version numbers. SQLite and PostgreSQL keep
+// parallel sequences with the same version numbers.
+package migrations
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed sql/sqlite/*.sql sql/postgres/*.sql
+var files embed.FS
+
+// Dialect selects the SQL flavour of a migration sequence
+type Dialect string
+
+const (
+	SQLite   Dialect = "sqlite"
+	Postgres Dialect = "postgres"
+)
+
+// placeholder returns the nth (1-based) bind parameter for the dialect
+func (d Dialect) placeholder(n int) string {
+	if d == Postgres {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// Migration is one versioned schema change
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Status describes a migration and whether it has been applied
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt string
+}
+
+const createVersionTable = `CREATE TABLE IF NOT EXISTS hook_schema_version (
+  version INTEGER PRIMARY KEY,
+  name TEXT NOT NULL,
+  applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+)`
+
+// All returns every embedded migration for the dialect in version order
+func All(d Dialect) ([]Migration, error) {
+	dir := path.Join("sql", string(d))
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+
+		prefix, rest, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: expected NNNN_name.sql", name)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: invalid version: %w", name, err)
+		}
+
+		data, err := files.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, Migration{Version: version, Name: rest, SQL: string(data)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d", migrations[i].Version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// Latest returns the highest version known to this binary
+func Latest(d Dialect) int {
+	migrations, err := All(d)
+	if err != nil || len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// versionTableExists reports whether hook_schema_version has been created
+// Current and List check rather than create it, so they work on read-only connections
+func versionTableExists(db *sql.DB, d Dialect) (bool, error) {
+	query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'hook_schema_version'"
+	if d == Postgres {
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'hook_schema_version'"
+	}
+	var n int
+	err := db.QueryRow(query).Scan(&n)
+	return n > 0, err
+}
+
+// Current returns the highest applied version, or 0 for a fresh database
+func Current(db *sql.DB, d Dialect) (int, error) {
+	if exists, err := versionTableExists(db, d); err != nil || !exists {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(version) FROM hook_schema_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// TooNewError is returned for a database a newer release has migrated past
+// what this binary knows, whose tables it may misread or damage
+type TooNewError struct {
+	Current int
+	Latest  int
+}
+
+func (e *TooNewError) Error() string {
+	return fmt.Sprintf("the state database is at schema version %d, newer than this binary supports (%d); upgrade nerv-hook to the release that migrated it", e.Current, e.Latest)
+}
+
+// Check returns a *TooNewError if the database is ahead of this binary
+func Check(db *sql.DB, d Dialect) error {
+	current, err := Current(db, d)
+	if err != nil {
+		return err
+	}
+	if latest := Latest(d); current > latest {
+		return &TooNewError{Current: current, Latest: latest}
+	}
+	return nil
+}
+
+// List returns every migration with its applied state
+func List(db *sql.DB, d Dialect) ([]Status, error) {
+	migrations, err := All(d)
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]string{}
+	exists, err := versionTableExists(db, d)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return statusOf(migrations, applied), nil
+	}
+
+	rows, err := db.Query("SELECT version, applied_at FROM hook_schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var appliedAt sql.NullString
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt.String
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return statusOf(migrations, applied), nil
+}
+
+// statusOf pairs each migration with its applied_at time, if it has one
+func statusOf(migrations []Migration, applied map[int]string) []Status {
+	statuses := make([]Status, 0, len(migrations))
+	for _, m := range migrations {
+		appliedAt, ok := applied[m.Version]
+		statuses = append(statuses, Status{Migration: m, Applied: ok, AppliedAt: appliedAt})
+	}
+	return statuses
+}
+
+// Up applies every pending migration, each in its own transaction
+// Returns the migrations that were applied by this call
+func Up(db *sql.DB, d Dialect) ([]Migration, error) {
+	migrations, err := All(d)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(createVersionTable); err != nil {
+		return nil, err
+	}
+	current, err := Current(db, d)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+
+		ok, err := apply(db, d, m)
+		if err != nil {
+			return applied, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		if ok {
+			applied = append(applied, m)
+		}
+	}
+
+	return applied, nil
+}
+
+// apply runs one migration, skipping it if another process applied it first
+func apply(db *sql.DB, d Dialect, m Migration) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow("SELECT COUNT(*) FROM hook_schema_version WHERE version = "+d.placeholder(1), m.Version).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	if exists > 0 {
+		return false, nil
+	}
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(
+		fmt.Sprintf("INSERT INTO hook_schema_version (version, name) VALUES (%s, %s)", d.placeholder(1), d.placeholder(2)),
+		m.Version, m.Name,
+	); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
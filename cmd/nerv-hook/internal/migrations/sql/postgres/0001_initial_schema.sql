@@ -0,0 +1,69 @@
+-- Tables the hook reads and writes, for a shared PostgreSQL database
+-- Columns mirror the SQLite schema so both backends store the same rows
+
+CREATE TABLE IF NOT EXISTS projects (
+  id TEXT PRIMARY KEY,
+  name TEXT NOT NULL,
+  goal TEXT,
+  created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS cycles (
+  id TEXT PRIMARY KEY,
+  project_id TEXT REFERENCES projects(id) ON DELETE CASCADE,
+  cycle_number INTEGER NOT NULL,
+  goal TEXT,
+  status TEXT DEFAULT 'active',
+  learnings TEXT,
+  completed_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS tasks (
+  id TEXT PRIMARY KEY,
+  project_id TEXT REFERENCES projects(id) ON DELETE CASCADE,
+  cycle_id TEXT REFERENCES cycles(id) ON DELETE CASCADE,
+  title TEXT NOT NULL,
+  description TEXT,
+  task_type TEXT DEFAULT 'implementation',
+  status TEXT DEFAULT 'todo',
+  repos TEXT,
+  worktree_path TEXT,
+  session_id TEXT,
+  created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+  completed_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS approvals (
+  id BIGSERIAL PRIMARY KEY,
+  task_id TEXT REFERENCES tasks(id) ON DELETE CASCADE,
+  tool_name TEXT NOT NULL,
+  tool_input TEXT,
+  context TEXT,
+  status TEXT DEFAULT 'pending',
+  deny_reason TEXT,
+  created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+  decided_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+  id BIGSERIAL PRIMARY KEY,
+  timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+  task_id TEXT,
+  event_type TEXT NOT NULL,
+  details TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_tasks_project ON tasks(project_id);
+CREATE INDEX IF NOT EXISTS idx_tasks_status ON tasks(status);
+CREATE INDEX IF NOT EXISTS idx_approvals_task ON approvals(task_id);
+CREATE INDEX IF NOT EXISTS idx_approvals_status ON approvals(status);
+
+-- details is free-form text; this reads a JSON field without failing on rows that aren't JSON
+-- (the SQLite equivalent is json_valid + json_extract)
+CREATE OR REPLACE FUNCTION nerv_json_field(doc TEXT, field TEXT) RETURNS TEXT AS $$
+BEGIN
+  RETURN doc::jsonb ->> field;
+EXCEPTION WHEN others THEN
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql IMMUTABLE;
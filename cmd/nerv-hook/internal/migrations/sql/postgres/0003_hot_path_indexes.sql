@@ -0,0 +1,8 @@
+-- Indexes for the queries run on every hook invocation and dashboard refresh
+
+CREATE INDEX IF NOT EXISTS idx_approvals_status_task ON approvals(status, task_id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_task_time ON audit_log(task_id, timestamp);
+CREATE INDEX IF NOT EXISTS idx_tasks_session ON tasks(session_id);
+
+-- Must match the expression in store.sessionMatch exactly to be used
+CREATE INDEX IF NOT EXISTS idx_audit_log_session ON audit_log((nerv_json_field(details, 'session_id')));
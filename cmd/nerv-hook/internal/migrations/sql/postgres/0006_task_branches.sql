@@ -0,0 +1,4 @@
+-- The git branch a task works on, and the commit it pointed at when the last session stopped
+
+ALTER TABLE tasks ADD COLUMN branch TEXT;
+ALTER TABLE tasks ADD COLUMN branch_head TEXT;
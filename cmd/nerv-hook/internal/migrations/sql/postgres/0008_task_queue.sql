@@ -0,0 +1,11 @@
+-- Tasks waiting for nervd to launch an agent for them, highest priority first, then oldest
+-- A task leaves the queue when its run starts
+
+CREATE TABLE IF NOT EXISTS task_queue (
+  task_id TEXT PRIMARY KEY REFERENCES tasks(id) ON DELETE CASCADE,
+  priority INTEGER NOT NULL DEFAULT 0,
+  prompt TEXT,
+  enqueued_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_task_queue_order ON task_queue(priority DESC, enqueued_at);
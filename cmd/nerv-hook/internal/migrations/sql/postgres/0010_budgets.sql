@@ -0,0 +1,18 @@
+-- Spending limits for a task or a project (scope is 'task' or 'project'), and the
+-- per-session usage they're checked against
+-- A NULL limit isn't enforced; on_exceed is 'deny' (refuse tool calls) or 'stop' (end the session)
+
+CREATE TABLE IF NOT EXISTS budgets (
+  scope TEXT NOT NULL,
+  scope_id TEXT NOT NULL,
+  max_tokens BIGINT,
+  max_cost_usd DOUBLE PRECISION,
+  max_tool_calls INTEGER,
+  on_exceed TEXT NOT NULL DEFAULT 'deny',
+  updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (scope, scope_id)
+);
+
+ALTER TABLE sessions ADD COLUMN tool_calls INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE sessions ADD COLUMN tokens BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE sessions ADD COLUMN cost_usd DOUBLE PRECISION NOT NULL DEFAULT 0;
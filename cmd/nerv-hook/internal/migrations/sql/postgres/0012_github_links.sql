@@ -0,0 +1,15 @@
+-- Links between tasks and the GitHub issues and pull requests they sync with
+-- A task imported from an issue has issue_number; a task whose draft PR was opened has pr_number
+-- synced_status is the task status last written to the issue, so changes made
+-- anywhere (hook, CLI, dashboard) are pushed on the next sync
+
+CREATE TABLE IF NOT EXISTS github_links (
+  task_id TEXT PRIMARY KEY REFERENCES tasks(id) ON DELETE CASCADE,
+  repo TEXT NOT NULL,
+  issue_number BIGINT,
+  pr_number BIGINT,
+  synced_status TEXT,
+  synced_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_github_links_issue ON github_links(repo, issue_number);
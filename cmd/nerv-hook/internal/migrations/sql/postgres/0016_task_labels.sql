@@ -0,0 +1,18 @@
+-- Task priority and labels, and named task filters saved from the CLI
+-- task_filters.filter is the JSON of a store.TaskFilter
+
+ALTER TABLE tasks ADD COLUMN priority TEXT;
+
+CREATE TABLE IF NOT EXISTS task_labels (
+  task_id TEXT NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+  label TEXT NOT NULL,
+  PRIMARY KEY (task_id, label)
+);
+
+CREATE INDEX IF NOT EXISTS idx_task_labels_label ON task_labels(label);
+
+CREATE TABLE IF NOT EXISTS task_filters (
+  name TEXT PRIMARY KEY,
+  filter TEXT NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
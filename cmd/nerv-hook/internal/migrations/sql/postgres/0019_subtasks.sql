@@ -0,0 +1,5 @@
+-- Subtasks: a task can be split into child tasks, which go with it when it's deleted
+
+ALTER TABLE tasks ADD COLUMN parent_id TEXT REFERENCES tasks(id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS idx_tasks_parent ON tasks(parent_id);
@@ -0,0 +1,11 @@
+-- When each tool call was denied and what it was, so the hook can tell a
+-- session that keeps hammering denied calls; see the circuit breaker
+
+CREATE TABLE IF NOT EXISTS tool_denials (
+  id BIGSERIAL PRIMARY KEY,
+  session_id TEXT NOT NULL,
+  signature TEXT NOT NULL,
+  denied_at_ms BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_tool_denials_session ON tool_denials(session_id, denied_at_ms);
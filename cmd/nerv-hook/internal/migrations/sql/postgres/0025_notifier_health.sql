@@ -0,0 +1,11 @@
+-- How each configured notifier's deliveries are going, for nerv-hook status
+-- Keyed by the notifier's name in the config file, like webhook_cursors;
+-- failures counts the deliveries that failed since the last one that didn't
+
+CREATE TABLE IF NOT EXISTS notifier_health (
+  notifier TEXT PRIMARY KEY,
+  last_sent_at TIMESTAMPTZ,
+  last_error TEXT,
+  last_error_at TIMESTAMPTZ,
+  failures INTEGER NOT NULL DEFAULT 0
+);
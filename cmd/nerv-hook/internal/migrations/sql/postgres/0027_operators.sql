@@ -0,0 +1,21 @@
+-- Operators: the people sharing one NERV instance in team mode, keyed by the
+-- name they run commands as (NERV_USER, or their login name)
+-- Once any is registered, only registered operators can change state, and what
+-- they change is attributed to them: operator on audit events, task status
+-- changes, and notes, and decided_by on approvals
+
+CREATE TABLE IF NOT EXISTS users (
+  name TEXT PRIMARY KEY,
+  email TEXT,
+  role TEXT NOT NULL DEFAULT 'operator',
+  created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+  created_by TEXT,
+  disabled_at TIMESTAMPTZ
+);
+
+ALTER TABLE audit_log ADD COLUMN operator TEXT;
+ALTER TABLE task_transitions ADD COLUMN operator TEXT;
+ALTER TABLE task_notes ADD COLUMN operator TEXT;
+ALTER TABLE approvals ADD COLUMN decided_by TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_operator ON audit_log(operator);
@@ -0,0 +1,9 @@
+-- Roles: admins edit policy and manage operators, approvers decide approvals
+-- and act on tasks, viewers read. An approver may be limited to approvals up
+-- to a risk level (low, medium, high), which nerv-hook records on each
+-- approval when it's queued; a NULL max_risk means no limit
+
+UPDATE users SET role = 'approver' WHERE role = 'operator';
+
+ALTER TABLE users ADD COLUMN max_risk TEXT;
+ALTER TABLE approvals ADD COLUMN risk TEXT;
@@ -0,0 +1,15 @@
+-- Logins to nerv-hook serve through an OpenID Connect provider
+-- id is the SHA-256 of the session cookie, so the table alone can't be used to
+-- sign in; issuer and subject identify the person to the provider
+
+CREATE TABLE IF NOT EXISTS logins (
+  id TEXT PRIMARY KEY,
+  operator TEXT NOT NULL,
+  issuer TEXT,
+  subject TEXT,
+  created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+  expires_at TIMESTAMPTZ NOT NULL,
+  last_seen_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_logins_operator ON logins(operator);
@@ -0,0 +1,11 @@
+-- How far through audit_log's alerts each configured notifier has delivered
+-- Alerts are the audit events a person should hear about at once, such as
+-- tripwire_triggered; keyed by the notifier's name, like webhook_cursors
+
+CREATE TABLE IF NOT EXISTS alert_cursors (
+  notifier TEXT PRIMARY KEY,
+  audit_id BIGINT NOT NULL,
+  updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_event_type ON audit_log(event_type);
@@ -0,0 +1,60 @@
+-- Tables the hook reads and writes
+-- Definitions match version 1 of src/core/migrations.ts so the dashboard
+-- can keep migrating a database the hook created
+
+CREATE TABLE IF NOT EXISTS projects (
+  id TEXT PRIMARY KEY,
+  name TEXT NOT NULL,
+  goal TEXT,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS cycles (
+  id TEXT PRIMARY KEY,
+  project_id TEXT REFERENCES projects(id) ON DELETE CASCADE,
+  cycle_number INTEGER NOT NULL,
+  goal TEXT,
+  status TEXT DEFAULT 'active',
+  learnings TEXT,
+  completed_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS tasks (
+  id TEXT PRIMARY KEY,
+  project_id TEXT REFERENCES projects(id) ON DELETE CASCADE,
+  cycle_id TEXT REFERENCES cycles(id) ON DELETE CASCADE,
+  title TEXT NOT NULL,
+  description TEXT,
+  task_type TEXT DEFAULT 'implementation',
+  status TEXT DEFAULT 'todo',
+  repos TEXT,
+  worktree_path TEXT,
+  session_id TEXT,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  completed_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS approvals (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  task_id TEXT REFERENCES tasks(id) ON DELETE CASCADE,
+  tool_name TEXT NOT NULL,
+  tool_input TEXT,
+  context TEXT,
+  status TEXT DEFAULT 'pending',
+  deny_reason TEXT,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  decided_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  task_id TEXT,
+  event_type TEXT NOT NULL,
+  details TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_tasks_project ON tasks(project_id);
+CREATE INDEX IF NOT EXISTS idx_tasks_status ON tasks(status);
+CREATE INDEX IF NOT EXISTS idx_approvals_task ON approvals(task_id);
+CREATE INDEX IF NOT EXISTS idx_approvals_status ON approvals(status);
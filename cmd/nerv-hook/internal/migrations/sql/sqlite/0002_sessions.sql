@@ -0,0 +1,11 @@
+-- Agent sessions seen by the hook, linked to the project and task they ran under
+-- The dashboard's schema has no sessions table, so this one is owned by the hook
+
+CREATE TABLE IF NOT EXISTS sessions (
+  id TEXT PRIMARY KEY,
+  project_id TEXT REFERENCES projects(id) ON DELETE SET NULL,
+  task_id TEXT REFERENCES tasks(id) ON DELETE SET NULL,
+  started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_task ON sessions(task_id);
@@ -0,0 +1,15 @@
+-- Indexes for the queries run on every hook invocation and dashboard refresh
+-- approvals(status, task_id) serves the pending lists and pre-approval lookups;
+-- audit_log(task_id, timestamp) serves per-task audit views; the session
+-- expression index serves the denial and halt checks, which match on the
+-- session_id inside details; tasks(session_id) serves session-to-task lookups
+
+CREATE INDEX IF NOT EXISTS idx_approvals_status_task ON approvals(status, task_id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_task_time ON audit_log(task_id, timestamp);
+CREATE INDEX IF NOT EXISTS idx_tasks_session ON tasks(session_id);
+
+-- Must match the expression in store.sessionMatch exactly to be used
+-- json_valid guards rows whose details aren't JSON, which json_extract would reject
+CREATE INDEX IF NOT EXISTS idx_audit_log_session ON audit_log(
+  (CASE WHEN json_valid(details) THEN json_extract(details, '$.session_id') END)
+);
@@ -0,0 +1,17 @@
+-- Project directories and CLI preferences, for deriving the project from the cwd
+-- Definitions match src/core/migrations.ts (repos in version 1, settings in
+-- version 7) so the dashboard and hook read the same rows
+
+CREATE TABLE IF NOT EXISTS repos (
+  id TEXT PRIMARY KEY,
+  project_id TEXT REFERENCES projects(id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  path TEXT NOT NULL,
+  stack TEXT
+);
+
+CREATE TABLE IF NOT EXISTS settings (
+  key TEXT PRIMARY KEY,
+  value TEXT,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,13 @@
+-- History of task status changes made through the store's state machine
+-- Owned by the hook; the dashboard's own status writes aren't recorded here
+
+CREATE TABLE IF NOT EXISTS task_transitions (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  task_id TEXT NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+  from_status TEXT NOT NULL,
+  to_status TEXT NOT NULL,
+  source TEXT,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_task_transitions_task ON task_transitions(task_id, id);
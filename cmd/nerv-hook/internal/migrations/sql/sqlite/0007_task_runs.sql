@@ -0,0 +1,17 @@
+-- Agent processes launched by nerv-hook run, linked to the session the hook sees once it starts
+-- ended_at stays NULL while the process runs, which is how the concurrency cap counts slots
+
+CREATE TABLE IF NOT EXISTS task_runs (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  task_id TEXT NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+  pid INTEGER,
+  mode TEXT NOT NULL,
+  session_id TEXT,
+  log_path TEXT,
+  started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  ended_at TIMESTAMP,
+  exit_code INTEGER
+);
+
+CREATE INDEX IF NOT EXISTS idx_task_runs_task ON task_runs(task_id);
+CREATE INDEX IF NOT EXISTS idx_task_runs_active ON task_runs(ended_at);
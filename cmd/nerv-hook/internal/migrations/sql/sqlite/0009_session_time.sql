@@ -0,0 +1,7 @@
+-- Time tracking for sessions: last_seen_at is the latest hook event, ended_at the
+-- latest stop (cleared when the session carries on), and active_seconds the time
+-- between events that weren't idle or waiting on the user
+
+ALTER TABLE sessions ADD COLUMN last_seen_at TIMESTAMP;
+ALTER TABLE sessions ADD COLUMN ended_at TIMESTAMP;
+ALTER TABLE sessions ADD COLUMN active_seconds INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,18 @@
+-- Spending limits for a task or a project (scope is 'task' or 'project'), and the
+-- per-session usage they're checked against
+-- A NULL limit isn't enforced; on_exceed is 'deny' (refuse tool calls) or 'stop' (end the session)
+
+CREATE TABLE IF NOT EXISTS budgets (
+  scope TEXT NOT NULL,
+  scope_id TEXT NOT NULL,
+  max_tokens INTEGER,
+  max_cost_usd REAL,
+  max_tool_calls INTEGER,
+  on_exceed TEXT NOT NULL DEFAULT 'deny',
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (scope, scope_id)
+);
+
+ALTER TABLE sessions ADD COLUMN tool_calls INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE sessions ADD COLUMN tokens INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE sessions ADD COLUMN cost_usd REAL NOT NULL DEFAULT 0;
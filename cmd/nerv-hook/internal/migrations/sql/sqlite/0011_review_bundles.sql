@@ -0,0 +1,27 @@
+-- Review requests and the bundles the hook builds for them
+-- task_reviews matches src/main/database-migrations.ts (version 8), so reviews
+-- requested and decided here show up in the dashboard and the other way round
+-- A bundle is JSON: diff, files touched, commands run, approvals, and test results
+
+CREATE TABLE IF NOT EXISTS task_reviews (
+  id TEXT PRIMARY KEY,
+  task_id TEXT NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+  status TEXT NOT NULL DEFAULT 'pending',
+  reviewer_notes TEXT,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  decided_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_task_reviews_task ON task_reviews(task_id);
+CREATE INDEX IF NOT EXISTS idx_task_reviews_status ON task_reviews(status);
+
+CREATE TABLE IF NOT EXISTS review_bundles (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  task_id TEXT NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+  review_id TEXT REFERENCES task_reviews(id) ON DELETE SET NULL,
+  head TEXT,
+  bundle TEXT NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_review_bundles_task ON review_bundles(task_id);
@@ -0,0 +1,17 @@
+-- Links between tasks and the Linear or Jira tickets they were imported from
+-- tracker names the connector (linear, or jira:<site>); external_id is the ticket's ID there
+-- synced_status is the task status last written to the ticket and tracker_state the
+-- ticket state last seen, so a change on either side is noticed on the next sync
+
+CREATE TABLE IF NOT EXISTS tracker_links (
+  task_id TEXT PRIMARY KEY REFERENCES tasks(id) ON DELETE CASCADE,
+  tracker TEXT NOT NULL,
+  external_id TEXT NOT NULL,
+  ticket_key TEXT,
+  url TEXT,
+  synced_status TEXT,
+  tracker_state TEXT,
+  synced_at TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_tracker_links_ticket ON tracker_links(tracker, external_id);
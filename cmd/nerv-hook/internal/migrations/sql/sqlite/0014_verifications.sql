@@ -0,0 +1,14 @@
+-- Results of the verification commands run when a session stops
+-- steps is JSON: each command with its exit code, duration, and the tail of its output
+
+CREATE TABLE IF NOT EXISTS verifications (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  task_id TEXT NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+  head TEXT,
+  passed INTEGER NOT NULL,
+  steps TEXT NOT NULL,
+  duration_ms INTEGER NOT NULL DEFAULT 0,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_verifications_task ON verifications(task_id);
@@ -0,0 +1,13 @@
+-- Notes and constraints users attach to a task, which the hook passes to the task's sessions
+-- sessions.notes_seen is the newest note a session has been given
+
+CREATE TABLE IF NOT EXISTS task_notes (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  task_id TEXT NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+  body TEXT NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_task_notes_task ON task_notes(task_id);
+
+ALTER TABLE sessions ADD COLUMN notes_seen INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,11 @@
+-- The worktrees of a task, one per registered repository it spans
+-- tasks.worktree_path stays the one sessions start in; tasks.repos lists the
+-- repository names a task spans, comma-separated
+
+CREATE TABLE IF NOT EXISTS task_worktrees (
+  task_id TEXT NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+  repo_id TEXT NOT NULL REFERENCES repos(id) ON DELETE CASCADE,
+  path TEXT NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (task_id, repo_id)
+);
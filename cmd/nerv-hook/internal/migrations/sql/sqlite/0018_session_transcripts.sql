@@ -0,0 +1,3 @@
+-- Where each session's agent transcript is, so an exported or archived task can point to it
+
+ALTER TABLE sessions ADD COLUMN transcript_path TEXT;
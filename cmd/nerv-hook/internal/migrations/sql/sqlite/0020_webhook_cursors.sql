@@ -0,0 +1,9 @@
+-- How far through task_transitions each configured webhook has delivered
+-- Keyed by the webhook's name in the config file; nervd advances a cursor as
+-- each transition is sent, so a restart resumes where delivery stopped
+
+CREATE TABLE IF NOT EXISTS webhook_cursors (
+  webhook TEXT PRIMARY KEY,
+  transition_id INTEGER NOT NULL,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,11 @@
+-- When each rate-limited tool call was made, so the hook can count a session's
+-- calls in a window; only tools a configured rate limit covers are recorded
+
+CREATE TABLE IF NOT EXISTS tool_calls (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  session_id TEXT NOT NULL,
+  tool_name TEXT NOT NULL,
+  called_at_ms INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_tool_calls_session ON tool_calls(session_id, tool_name, called_at_ms);
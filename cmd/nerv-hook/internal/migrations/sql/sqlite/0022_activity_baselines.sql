@@ -0,0 +1,12 @@
+-- How often each project has used each tool category, touched each directory
+-- outside its working tree, and been denied, for anomaly detection
+
+CREATE TABLE IF NOT EXISTS activity_baselines (
+  project_id TEXT NOT NULL,
+  kind TEXT NOT NULL,
+  key TEXT NOT NULL,
+  count INTEGER NOT NULL DEFAULT 0,
+  first_seen_ms INTEGER NOT NULL,
+  last_seen_ms INTEGER NOT NULL,
+  PRIMARY KEY (project_id, kind, key)
+);
@@ -0,0 +1,6 @@
+-- Which session asked for each approval, so the hook can cap how many one
+-- session has waiting; see max_pending in the approvals settings
+
+ALTER TABLE approvals ADD COLUMN session_id TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_approvals_status_session ON approvals(status, session_id);
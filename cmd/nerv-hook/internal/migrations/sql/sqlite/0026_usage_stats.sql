@@ -0,0 +1,22 @@
+-- Tool usage rolled up from audit_log by day, project, and kind, so nerv-hook
+-- stats and the dashboard's usage view don't scan the whole log
+-- nervd folds new audit rows in as they're written; usage_stats_cursor keeps
+-- the last one folded in. day is YYYY-MM-DD in UTC, and kind is tool, command,
+-- funnel, or denial
+
+CREATE TABLE IF NOT EXISTS usage_stats (
+  day TEXT NOT NULL,
+  project_id TEXT NOT NULL DEFAULT '',
+  kind TEXT NOT NULL,
+  key TEXT NOT NULL,
+  count INTEGER NOT NULL DEFAULT 0,
+  PRIMARY KEY (day, project_id, kind, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_usage_stats_kind_day ON usage_stats(kind, day);
+
+CREATE TABLE IF NOT EXISTS usage_stats_cursor (
+  id INTEGER PRIMARY KEY CHECK (id = 1),
+  audit_id INTEGER NOT NULL,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
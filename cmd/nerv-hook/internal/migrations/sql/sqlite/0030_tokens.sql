@@ -0,0 +1,18 @@
+-- API tokens for nerv-hook serve, each acting as an operator within its scopes
+-- Only the SHA-256 of a token is kept; id is the public part, shown in lists and
+-- used to revoke it
+
+CREATE TABLE IF NOT EXISTS tokens (
+  id TEXT PRIMARY KEY,
+  hash TEXT NOT NULL UNIQUE,
+  name TEXT,
+  operator TEXT NOT NULL,
+  scopes TEXT NOT NULL,
+  created_by TEXT,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  expires_at TIMESTAMP NOT NULL,
+  last_used_at TIMESTAMP,
+  revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_tokens_operator ON tokens(operator);
@@ -0,0 +1,8 @@
+-- Operators registered by signing in to nerv-hook serve are bound to the
+-- provider's issuer and subject, which never change, rather than to a name or
+-- email the provider lets people pick
+
+ALTER TABLE users ADD COLUMN oidc_issuer TEXT;
+ALTER TABLE users ADD COLUMN oidc_subject TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_oidc ON users(oidc_issuer, oidc_subject);
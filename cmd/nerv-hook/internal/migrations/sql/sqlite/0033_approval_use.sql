@@ -0,0 +1,4 @@
+-- When an approval granted ahead of time was taken by the tool call it covered;
+-- each covers one call, so a used one is never taken again
+
+ALTER TABLE approvals ADD COLUMN used_at TIMESTAMP;
@@ -0,0 +1,187 @@
+// Package nervtest provides state databases, config directories, and hook
+// payloads for tests, so the decision flow can be exercised end to end without
+// touching ~/.nerv
+package nervtest
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+	"github.com/nerv/nerv-hook/pkg/approvals"
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// OpenMemoryDB returns an in-memory state database with the full schema
+// It is closed when the test ends
+func OpenMemoryDB(t testing.TB) *store.DB {
+	t.Helper()
+	db, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrated(t, db)
+}
+
+// OpenTempDB returns a file-backed state database in a temporary directory
+// Use it when a test needs WAL mode or more than one connection
+func OpenTempDB(t testing.TB) *store.DB {
+	t.Helper()
+	db, err := store.OpenSQLite(filepath.Join(t.TempDir(), "state.db"), "rwc", store.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrated(t, db)
+}
+
+func migrated(t testing.TB, db *store.DB) *store.DB {
+	t.Helper()
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Dir is a throwaway NERV directory
+type Dir struct {
+	Root       string
+	ConfigPath string
+	DBPath     string
+}
+
+// NewDir creates a NERV directory with rules written to permissions.json and a
+// migrated state.db, and points NERV_DIR at it for the rest of the test
+func NewDir(t testing.TB, rules policy.Rules) Dir {
+	t.Helper()
+	root := t.TempDir()
+	dir := Dir{
+		Root:       root,
+		ConfigPath: filepath.Join(root, "permissions.json"),
+		DBPath:     filepath.Join(root, "state.db"),
+	}
+
+	data, err := json.Marshal(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir.ConfigPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := store.OpenSQLite(dir.DBPath, "rwc", store.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, ok := t.(interface{ Setenv(key, value string) }); ok {
+		s.Setenv("NERV_DIR", root)
+	}
+	return dir
+}
+
+// SeedTask creates a project and an in-progress task in it
+func SeedTask(t testing.TB, db *store.DB, projectID, taskID string) store.Task {
+	t.Helper()
+	if _, err := db.GetProject(projectID); err != nil {
+		if err := db.CreateProject(store.Project{ID: projectID, Name: projectID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	task := store.Task{ID: taskID, ProjectID: projectID, Title: taskID, Status: store.TaskInProgress}
+	if err := db.CreateTask(task); err != nil {
+		t.Fatal(err)
+	}
+	task, err := db.GetTask(taskID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
+
+// PreToolUse builds a Claude Code PreToolUse payload
+func PreToolUse(sessionID, toolName string, toolInput map[string]interface{}) []byte {
+	return payload(map[string]interface{}{
+		"session_id":      sessionID,
+		"hook_event_name": "PreToolUse",
+		"tool_name":       toolName,
+		"tool_input":      toolInput,
+	})
+}
+
+// PostToolUse builds a Claude Code PostToolUse payload
+func PostToolUse(sessionID, toolName string, toolInput map[string]interface{}) []byte {
+	return payload(map[string]interface{}{
+		"session_id":      sessionID,
+		"hook_event_name": "PostToolUse",
+		"tool_name":       toolName,
+		"tool_input":      toolInput,
+	})
+}
+
+// Stop builds a Claude Code Stop payload
+func Stop(sessionID, reason string) []byte {
+	return payload(map[string]interface{}{
+		"session_id":      sessionID,
+		"hook_event_name": "Stop",
+		"stop_reason":     reason,
+	})
+}
+
+// Bash is the tool_input of a Bash call
+func Bash(command string) map[string]interface{} {
+	return map[string]interface{}{"command": command}
+}
+
+// File is the tool_input of a Read, Write, or Edit call
+func File(path string) map[string]interface{} {
+	return map[string]interface{}{"file_path": path}
+}
+
+func payload(fields map[string]interface{}) []byte {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// Dashboard stands in for a person answering approvals
+// It decides every pending approval the same way until the test ends
+func Dashboard(t testing.TB, db *store.DB, status, denyReason string) {
+	t.Helper()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(approvals.DefaultBackoff.Initial / 2):
+			}
+
+			pending, err := db.PendingApprovals()
+			if err != nil {
+				continue
+			}
+			for _, a := range pending {
+				db.DecideApproval(a.ID, status, denyReason)
+			}
+		}
+	}()
+
+	// Registered after the database's cleanup, so it runs first
+	t.Cleanup(func() {
+		close(done)
+		<-stopped
+	})
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/migrations"
+	"github.com/nerv/nerv-hook/pkg/approvals"
+)
+
+const approvalColumns = "id, task_id, tool_name, tool_input, context, status, deny_reason, created_at, decided_at, session_id, decided_by, risk"
+
+func scanApproval(row interface{ Scan(...interface{}) error }) (Approval, error) {
+	var a Approval
+	err := row.Scan(&a.ID, textColumn{&a.TaskID}, &a.ToolName, compressedColumn{&a.ToolInput},
+		compressedColumn{&a.Context}, textColumn{&a.Status}, textColumn{&a.DenyReason},
+		timeColumn{&a.CreatedAt}, timeColumn{&a.DecidedAt}, textColumn{&a.SessionID}, textColumn{&a.DecidedBy}, textColumn{&a.Risk})
+	return a, err
+}
+
+// QueueApproval inserts a pending approval and its approval_requested audit row atomically
+// auditDetails builds the audit details once the approval's ID is known
+func (s *DB) QueueApproval(a Approval, auditDetails func(approvalID int64) string) (int64, error) {
+	var id int64
+	err := retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		id, err = s.insertReturningID(tx,
+			"INSERT INTO approvals (task_id, tool_name, tool_input, context, status, session_id, risk) VALUES (?, ?, ?, ?, 'pending', ?, ?)",
+			nullable(a.TaskID), a.ToolName, compressText(a.ToolInput), compressText(a.Context), nullable(a.SessionID), nullable(a.Risk),
+		)
+		if err != nil {
+			return err
+		}
+
+		if err := s.insertAudit(tx, a.TaskID, "approval_requested", auditDetails(id)); err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	})
+	return id, err
+}
+
+// GetApproval loads an approval by ID, returning ErrNotFound if it doesn't exist
+func (s *DB) GetApproval(id int64) (Approval, error) {
+	// Prepared once, since the hook polls this while it waits for a decision
+	stmt, err := s.prepare("SELECT " + approvalColumns + " FROM approvals WHERE id = ?")
+	if err != nil {
+		return Approval{}, err
+	}
+	a, err := scanApproval(stmt.QueryRow(id))
+	return a, notFound(err)
+}
+
+// DecideApproval approves, denies, or cancels a pending approval and records an
+// approval_resolved audit event, or approval_cancelled for a cancellation
+// The update only applies while the approval is still pending; if another surface
+// decided it first, the existing decision stands, an approval_conflict event is
+// recorded, and a *approvals.ConflictError carrying that decision is returned
+func (s *DB) DecideApproval(id int64, status, denyReason string) (Approval, error) {
+	if status != approvals.Approved && status != approvals.Denied && status != approvals.Cancelled {
+		return Approval{}, fmt.Errorf("invalid approval decision %q", status)
+	}
+
+	var conflict bool
+	err := retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Exec(
+			s.rebind("UPDATE approvals SET status = ?, deny_reason = ?, decided_at = ?, decided_by = ? WHERE id = ? AND status = 'pending'"),
+			status, nullable(denyReason), time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), nullable(s.operator), id,
+		)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		var taskID, current string
+		if err := tx.QueryRow(s.rebind("SELECT task_id, status FROM approvals WHERE id = ?"), id).Scan(textColumn{&taskID}, textColumn{&current}); err != nil {
+			return notFound(err)
+		}
+
+		conflict = n == 0
+		if conflict {
+			err = s.insertAudit(tx, taskID, "approval_conflict",
+				fmt.Sprintf(`{"approval_id":%d,"attempted":%q,"current":%q}`, id, status, current))
+		} else if status == approvals.Cancelled {
+			err = s.insertAudit(tx, taskID, "approval_cancelled",
+				fmt.Sprintf(`{"approval_id":%d,"reason":%q}`, id, denyReason))
+		} else {
+			err = s.insertAudit(tx, taskID, "approval_resolved",
+				fmt.Sprintf(`{"approval_id":%d,"status":%q,"deny_reason":%q}`, id, status, denyReason))
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return Approval{}, err
+	}
+
+	a, err := s.GetApproval(id)
+	if err != nil {
+		return Approval{}, err
+	}
+	if conflict {
+		return a, &approvals.ConflictError{Current: a}
+	}
+	return a, nil
+}
+
+// PendingApprovalCount returns the number of approvals waiting for a decision
+func (s *DB) PendingApprovalCount() (int, error) {
+	var count int
+	err := s.queryRow("SELECT COUNT(*) FROM approvals WHERE status = 'pending'").Scan(&count)
+	return count, err
+}
+
+// PendingApprovalsFor returns how many approvals a session, and the tasks of a
+// project, have waiting for a decision; an empty ID counts 0
+func (s *DB) PendingApprovalsFor(sessionID, projectID string) (session, project int, err error) {
+	if sessionID != "" {
+		err = s.queryRow("SELECT COUNT(*) FROM approvals WHERE status = 'pending' AND session_id = ?", sessionID).Scan(&session)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if projectID != "" {
+		err = s.queryRow(`SELECT COUNT(*) FROM approvals a JOIN tasks t ON t.id = a.task_id
+			WHERE a.status = 'pending' AND t.project_id = ?`, projectID).Scan(&project)
+	}
+	return session, project, err
+}
+
+// PendingApprovals returns the approvals waiting for a decision, oldest first
+func (s *DB) PendingApprovals() ([]Approval, error) {
+	rows, err := s.query("SELECT " + approvalColumns + " FROM approvals WHERE status = 'pending' ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	return collectApprovals(rows)
+}
+
+// ListApprovals returns a task's approval requests, decided or not, oldest first
+func (s *DB) ListApprovals(taskID string) ([]Approval, error) {
+	rows, err := s.query("SELECT "+approvalColumns+" FROM approvals WHERE task_id = ? ORDER BY id", taskID)
+	if err != nil {
+		return nil, err
+	}
+	return collectApprovals(rows)
+}
+
+// ApprovedSince returns a task's approved requests for a tool decided at or after since
+func (s *DB) ApprovedSince(taskID, toolName string, since time.Time) ([]Approval, error) {
+	// decided_at holds the dashboard's ISO timestamps; julianday compares them as instants
+	query := "SELECT " + approvalColumns + ` FROM approvals
+		 WHERE task_id = ? AND tool_name = ? AND status = 'approved'
+		   AND julianday(decided_at) >= julianday(?)`
+	if s.dialect == migrations.Postgres {
+		query = "SELECT " + approvalColumns + ` FROM approvals
+		 WHERE task_id = ? AND tool_name = ? AND status = 'approved'
+		   AND decided_at >= ?`
+	}
+
+	rows, err := s.query(query, taskID, toolName, since.UTC().Format("2006-01-02T15:04:05.000Z"))
+	if err != nil {
+		return nil, err
+	}
+	return collectApprovals(rows)
+}
+
+// UseApproval marks an approved request used, reporting false if it already was
+// or isn't approved; only one caller can take a request
+func (s *DB) UseApproval(id int64) (bool, error) {
+	result, err := s.exec("UPDATE approvals SET used_at = ? WHERE id = ? AND status = 'approved' AND used_at IS NULL",
+		time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func collectApprovals(rows *sql.Rows) ([]Approval, error) {
+	defer rows.Close()
+
+	var approvals []Approval
+	for rows.Next() {
+		a, err := scanApproval(rows)
+		if err != nil {
+			return nil, err
+		}
+		approvals = append(approvals, a)
+	}
+	return approvals, rows.Err()
+}
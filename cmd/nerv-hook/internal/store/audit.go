@@ -0,0 +1,193 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/nerv/nerv-hook/internal/migrations"
+)
+
+// AuditFilter narrows ListAudit; empty fields match everything
+type AuditFilter struct {
+	TaskID    string
+	EventType string
+	// Operator matches events attributed to an operator
+	Operator string
+	// Limit caps the number of events returned; 0 means no limit
+	Limit int
+}
+
+const auditColumns = "id, timestamp, task_id, event_type, details, operator"
+
+func scanAuditEvent(row interface{ Scan(...interface{}) error }) (AuditEvent, error) {
+	var e AuditEvent
+	err := row.Scan(&e.ID, timeColumn{&e.Timestamp}, textColumn{&e.TaskID}, &e.EventType, textColumn{&e.Details}, textColumn{&e.Operator})
+	return e, err
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertAudit writes one audit row, either directly or as part of a transaction,
+// attributed to the handle's operator if it has one
+func (s *DB) insertAudit(ex execer, taskID, eventType, details string) error {
+	_, err := ex.Exec(
+		s.rebind("INSERT INTO audit_log (task_id, event_type, details, operator) VALUES (?, ?, ?, ?)"),
+		taskID, eventType, details, nullable(s.operator),
+	)
+	return err
+}
+
+// LogAudit appends one audit_log row
+func (s *DB) LogAudit(taskID, eventType, details string) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	return retryOnBusy(func() error {
+		return s.insertAudit(s.db, taskID, eventType, details)
+	})
+}
+
+// LogAuditBatch appends audit_log rows in one transaction, in order
+// Only TaskID, EventType, and Details are used; the rows are stamped when they're written
+func (s *DB) LogAuditBatch(events []AuditEvent) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	return retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		for _, e := range events {
+			if err := s.insertAudit(tx, e.TaskID, e.EventType, e.Details); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// DeleteTaskAudit removes a task's audit events, returning how many there were
+func (s *DB) DeleteTaskAudit(taskID string) (int64, error) {
+	result, err := s.exec("DELETE FROM audit_log WHERE task_id = ?", taskID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ListAudit returns the audit events matching f, newest first
+func (s *DB) ListAudit(f AuditFilter) ([]AuditEvent, error) {
+	var where []string
+	var args []interface{}
+	if f.TaskID != "" {
+		where = append(where, "task_id = ?")
+		args = append(args, f.TaskID)
+	}
+	if f.EventType != "" {
+		where = append(where, "event_type = ?")
+		args = append(args, f.EventType)
+	}
+	if f.Operator != "" {
+		where = append(where, "operator = ?")
+		args = append(args, f.Operator)
+	}
+
+	query := "SELECT " + auditColumns + " FROM audit_log"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		e, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// sessionMatch is the WHERE clause matching audit rows by the session_id in their details
+// The expressions match the idx_audit_log_session indexes, so lookups don't scan the log
+func (s *DB) sessionMatch() string {
+	return s.detailMatch("session_id")
+}
+
+// detailMatch is a condition comparing a field of an event's JSON details with a parameter
+func (s *DB) detailMatch(field string) string {
+	if s.dialect == migrations.Postgres {
+		return "nerv_json_field(details, '" + field + "') = ?"
+	}
+	return "(CASE WHEN json_valid(details) THEN json_extract(details, '$." + field + "') END) = ?"
+}
+
+// SessionEvents returns the most recent audit event types for a session, newest first
+func (s *DB) SessionEvents(sessionID string, limit int) ([]string, error) {
+	rows, err := s.query("SELECT event_type FROM audit_log WHERE "+s.sessionMatch()+" ORDER BY id DESC LIMIT ?", sessionID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []string
+	for rows.Next() {
+		var eventType string
+		if err := rows.Scan(&eventType); err != nil {
+			return nil, err
+		}
+		events = append(events, eventType)
+	}
+	return events, rows.Err()
+}
+
+// SessionRewrote reports whether an input_rewritten event for a rewrite rule was recorded for a session
+func (s *DB) SessionRewrote(sessionID, rule string) (bool, error) {
+	var found int
+	err := s.queryRow("SELECT 1 FROM audit_log WHERE event_type = 'input_rewritten' AND "+s.sessionMatch()+" AND "+s.detailMatch("rule")+" LIMIT 1", sessionID, rule).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SessionHalted reports whether a session_halted event was recorded for a session
+func (s *DB) SessionHalted(sessionID string) (bool, error) {
+	return s.sessionLogged(sessionID, "session_halted")
+}
+
+// SessionTripped reports whether a circuit_breaker_tripped event was recorded for a session
+func (s *DB) SessionTripped(sessionID string) (bool, error) {
+	return s.sessionLogged(sessionID, "circuit_breaker_tripped")
+}
+
+// sessionLogged reports whether an event of a type was recorded for a session
+func (s *DB) sessionLogged(sessionID, eventType string) (bool, error) {
+	var found int
+	err := s.queryRow("SELECT 1 FROM audit_log WHERE event_type = ? AND "+s.sessionMatch()+" LIMIT 1", eventType, sessionID).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
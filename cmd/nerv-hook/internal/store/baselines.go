@@ -0,0 +1,42 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Activity baseline kinds
+const (
+	// BaselineCalls counts every tool call, under the key ""
+	BaselineCalls = "calls"
+	// BaselineCategory counts calls by tool category, such as Edit or Bash(curl)
+	BaselineCategory = "category"
+	// BaselinePath counts calls by the directory they touch
+	BaselinePath = "path"
+	// BaselineDenials counts denials, in total under the key "" and otherwise by the start of a time bucket
+	BaselineDenials = "denials"
+)
+
+// ObserveActivity counts one occurrence in a project's baseline and returns the
+// baseline as it was before; one never seen before comes back with Count 0
+func (s *DB) ObserveActivity(projectID, kind, key string, at time.Time) (Baseline, error) {
+	b := Baseline{ProjectID: projectID, Kind: kind, Key: key}
+	var first, last int64
+	err := s.queryRow("SELECT count, first_seen_ms, last_seen_ms FROM activity_baselines WHERE project_id = ? AND kind = ? AND key = ?",
+		projectID, kind, key).Scan(&b.Count, &first, &last)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return b, err
+	default:
+		b.FirstSeen, b.LastSeen = time.UnixMilli(first), time.UnixMilli(last)
+	}
+
+	_, err = s.exec(
+		`INSERT INTO activity_baselines (project_id, kind, key, count, first_seen_ms, last_seen_ms) VALUES (?, ?, ?, 1, ?, ?)
+		 ON CONFLICT (project_id, kind, key) DO UPDATE SET count = activity_baselines.count + 1, last_seen_ms = excluded.last_seen_ms`,
+		projectID, kind, key, at.UnixMilli(), at.UnixMilli(),
+	)
+	return b, err
+}
@@ -0,0 +1,136 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const budgetColumns = "scope, scope_id, max_tokens, max_cost_usd, max_tool_calls, on_exceed"
+
+func scanBudget(row interface{ Scan(...interface{}) error }) (Budget, error) {
+	var b Budget
+	var maxTokens, maxToolCalls sql.NullInt64
+	var maxCost sql.NullFloat64
+	err := row.Scan(&b.Scope, &b.ScopeID, &maxTokens, &maxCost, &maxToolCalls, &b.OnExceed)
+	b.MaxTokens = maxTokens.Int64
+	b.MaxCostUSD = maxCost.Float64
+	b.MaxToolCalls = maxToolCalls.Int64
+	return b, err
+}
+
+// limit stores a zero limit as NULL, meaning unenforced
+func limit[T int64 | float64](v T) interface{} {
+	if v <= 0 {
+		return nil
+	}
+	return v
+}
+
+// SetBudget creates or replaces the budget for a task or project
+func (s *DB) SetBudget(b Budget) error {
+	if b.Scope != BudgetTask && b.Scope != BudgetProject {
+		return fmt.Errorf("invalid budget scope %q", b.Scope)
+	}
+	if b.OnExceed == "" {
+		b.OnExceed = BudgetDeny
+	}
+	if b.OnExceed != BudgetDeny && b.OnExceed != BudgetStop {
+		return fmt.Errorf("invalid on_exceed %q (want %s or %s)", b.OnExceed, BudgetDeny, BudgetStop)
+	}
+
+	_, err := s.exec(
+		`INSERT INTO budgets (scope, scope_id, max_tokens, max_cost_usd, max_tool_calls, on_exceed, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		 ON CONFLICT (scope, scope_id) DO UPDATE SET max_tokens = excluded.max_tokens,
+		   max_cost_usd = excluded.max_cost_usd, max_tool_calls = excluded.max_tool_calls,
+		   on_exceed = excluded.on_exceed, updated_at = excluded.updated_at`,
+		b.Scope, b.ScopeID, limit(b.MaxTokens), limit(b.MaxCostUSD), limit(b.MaxToolCalls), b.OnExceed,
+	)
+	return err
+}
+
+// GetBudget loads a task's or project's budget, returning ErrNotFound if it has none
+func (s *DB) GetBudget(scope, scopeID string) (Budget, error) {
+	b, err := scanBudget(s.queryRow("SELECT "+budgetColumns+" FROM budgets WHERE scope = ? AND scope_id = ?", scope, scopeID))
+	return b, notFound(err)
+}
+
+// DeleteBudget removes a budget, returning ErrNotFound if there wasn't one
+func (s *DB) DeleteBudget(scope, scopeID string) error {
+	result, err := s.exec("DELETE FROM budgets WHERE scope = ? AND scope_id = ?", scope, scopeID)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+// ListBudgets returns every budget, projects before tasks
+func (s *DB) ListBudgets() ([]Budget, error) {
+	rows, err := s.query("SELECT " + budgetColumns + " FROM budgets ORDER BY scope, scope_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var budgets []Budget
+	for rows.Next() {
+		b, err := scanBudget(rows)
+		if err != nil {
+			return nil, err
+		}
+		budgets = append(budgets, b)
+	}
+	return budgets, rows.Err()
+}
+
+// BudgetUsage sums the usage of every session in a task or project
+// A task's usage includes its subtasks', at any depth, since their budgets roll up to it
+func (s *DB) BudgetUsage(scope, scopeID string) (Usage, error) {
+	const totals = "SELECT COUNT(*), COALESCE(SUM(tool_calls), 0), COALESCE(SUM(tokens), 0), COALESCE(SUM(cost_usd), 0) FROM sessions"
+	query := totals + " WHERE project_id = ?"
+	if scope != BudgetProject {
+		query = `WITH RECURSIVE subtree (id) AS (
+		   SELECT CAST(? AS TEXT)
+		   UNION SELECT t.id FROM tasks t JOIN subtree ON t.parent_id = subtree.id
+		 ) ` + totals + " WHERE task_id IN (SELECT id FROM subtree)"
+	}
+
+	var u Usage
+	err := s.queryRow(query, scopeID).Scan(&u.Sessions, &u.ToolCalls, &u.Tokens, &u.CostUSD)
+	return u, err
+}
+
+// CountToolCall adds a tool call to a session's usage
+func (s *DB) CountToolCall(sessionID string) error {
+	_, err := s.exec("UPDATE sessions SET tool_calls = tool_calls + 1 WHERE id = ?", sessionID)
+	return err
+}
+
+// LogToolCall records when a session called a tool, for rate limits
+func (s *DB) LogToolCall(sessionID, toolName string, at time.Time) error {
+	_, err := s.exec("INSERT INTO tool_calls (session_id, tool_name, called_at_ms) VALUES (?, ?, ?)", sessionID, toolName, at.UnixMilli())
+	return err
+}
+
+// ToolCallsSince counts a session's recorded calls at or after since to any of tools, or to any tool if none are given
+func (s *DB) ToolCallsSince(sessionID string, tools []string, since time.Time) (int, error) {
+	query := "SELECT COUNT(*) FROM tool_calls WHERE session_id = ? AND called_at_ms >= ?"
+	args := []interface{}{sessionID, since.UnixMilli()}
+	if len(tools) > 0 {
+		query += " AND tool_name IN (?" + strings.Repeat(", ?", len(tools)-1) + ")"
+		for _, tool := range tools {
+			args = append(args, tool)
+		}
+	}
+	var n int
+	err := s.queryRow(query, args...).Scan(&n)
+	return n, err
+}
+
+// SetSessionUsage records a session's token count and cost so far, replacing the previous figures
+func (s *DB) SetSessionUsage(sessionID string, tokens int64, costUSD float64) error {
+	_, err := s.exec("UPDATE sessions SET tokens = ?, cost_usd = ? WHERE id = ?", tokens, costUSD, sessionID)
+	return err
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"encoding/base64"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressThreshold is the size above which tool inputs, approval context, and review bundles are compressed
+const compressThreshold = 4 << 10
+
+// compressedPrefix marks a value stored as zstd, then base64 so it still fits a TEXT column
+// The dashboard reads these columns too and decodes the same prefix
+const compressedPrefix = "zstd:"
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func zstdCodecs() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		// Both are only used through EncodeAll and DecodeAll, which are safe for concurrent use
+		zstdEncoder, _ = zstd.NewWriter(nil)
+		zstdDecoder, _ = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+// compressText returns s as stored: compressed when it's over compressThreshold and that makes it smaller
+func compressText(s string) string {
+	if len(s) <= compressThreshold {
+		return s
+	}
+	enc, _ := zstdCodecs()
+	packed := compressedPrefix + base64.StdEncoding.EncodeToString(enc.EncodeAll([]byte(s), nil))
+	if len(packed) >= len(s) {
+		return s
+	}
+	return packed
+}
+
+// decompressText reverses compressText
+// A value that only looks compressed is returned unchanged, since it was stored as written
+func decompressText(s string) string {
+	if !strings.HasPrefix(s, compressedPrefix) {
+		return s
+	}
+	data, err := base64.StdEncoding.DecodeString(s[len(compressedPrefix):])
+	if err != nil {
+		return s
+	}
+	_, dec := zstdCodecs()
+	plain, err := dec.DecodeAll(data, nil)
+	if err != nil {
+		return s
+	}
+	return string(plain)
+}
+
+// compressedColumn scans a TEXT column written with compressText
+type compressedColumn struct{ s *string }
+
+func (c compressedColumn) Scan(src interface{}) error {
+	if err := (textColumn{c.s}).Scan(src); err != nil {
+		return err
+	}
+	*c.s = decompressText(*c.s)
+	return nil
+}
@@ -0,0 +1,28 @@
+package store
+
+import "time"
+
+// LogDenial records when a session's tool call was denied, under the call's signature
+func (s *DB) LogDenial(sessionID, signature string, at time.Time) error {
+	_, err := s.exec("INSERT INTO tool_denials (session_id, signature, denied_at_ms) VALUES (?, ?, ?)", sessionID, signature, at.UnixMilli())
+	return err
+}
+
+// DenialsSince returns the signatures of a session's calls denied at or after since, oldest first
+func (s *DB) DenialsSince(sessionID string, since time.Time) ([]string, error) {
+	rows, err := s.query("SELECT signature FROM tool_denials WHERE session_id = ? AND denied_at_ms >= ? ORDER BY id", sessionID, since.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var signatures []string
+	for rows.Next() {
+		var signature string
+		if err := rows.Scan(&signature); err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, signature)
+	}
+	return signatures, rows.Err()
+}
@@ -0,0 +1,119 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const githubLinkColumns = "l.task_id, t.project_id, t.status, l.repo, l.issue_number, l.pr_number, l.synced_status, l.synced_at"
+
+func scanGitHubLink(row interface{ Scan(...interface{}) error }) (GitHubLink, error) {
+	var l GitHubLink
+	var issue, pr sql.NullInt64
+	err := row.Scan(&l.TaskID, textColumn{&l.ProjectID}, &l.Status, &l.Repo, &issue, &pr, textColumn{&l.SyncedStatus}, timeColumn{&l.SyncedAt})
+	l.IssueNumber = int(issue.Int64)
+	l.PRNumber = int(pr.Int64)
+	return l, err
+}
+
+// ImportIssueTask creates a task for a GitHub issue and links the two atomically, with a
+// task_created audit event; the link starts synced at the task's status
+// auditDetails are the task_created details
+func (s *DB) ImportIssueTask(t Task, repo string, issueNumber int, auditDetails string) error {
+	if t.TaskType == "" {
+		t.TaskType = "implementation"
+	}
+	if t.Status == "" {
+		t.Status = TaskTodo
+	}
+
+	return retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(
+			s.rebind(`INSERT INTO tasks (id, project_id, title, description, task_type, status) VALUES (?, ?, ?, ?, ?, ?)`),
+			t.ID, nullable(t.ProjectID), t.Title, nullable(t.Description), t.TaskType, t.Status,
+		); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(
+			s.rebind("INSERT INTO github_links (task_id, repo, issue_number, synced_status, synced_at) VALUES (?, ?, ?, ?, ?)"),
+			t.ID, repo, issueNumber, t.Status, time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		); err != nil {
+			return err
+		}
+		if err := s.insertAudit(tx, t.ID, "task_created", auditDetails); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// GetGitHubLink returns a task's GitHub link, returning ErrNotFound if it has none
+func (s *DB) GetGitHubLink(taskID string) (GitHubLink, error) {
+	l, err := scanGitHubLink(s.queryRow("SELECT "+githubLinkColumns+" FROM github_links l JOIN tasks t ON t.id = l.task_id WHERE l.task_id = ?", taskID))
+	return l, notFound(err)
+}
+
+// GitHubLinkForIssue returns the link for an issue, returning ErrNotFound if no task was imported from it
+func (s *DB) GitHubLinkForIssue(repo string, issueNumber int) (GitHubLink, error) {
+	l, err := scanGitHubLink(s.queryRow(
+		"SELECT "+githubLinkColumns+" FROM github_links l JOIN tasks t ON t.id = l.task_id WHERE l.repo = ? AND l.issue_number = ?",
+		repo, issueNumber,
+	))
+	return l, notFound(err)
+}
+
+// ListGitHubLinks returns the GitHub links of a project's tasks, or of every project if projectID is empty
+func (s *DB) ListGitHubLinks(projectID string) ([]GitHubLink, error) {
+	query := "SELECT " + githubLinkColumns + " FROM github_links l JOIN tasks t ON t.id = l.task_id"
+	var args []interface{}
+	if projectID != "" {
+		query += " WHERE t.project_id = ?"
+		args = append(args, projectID)
+	}
+
+	rows, err := s.query(query+" ORDER BY l.repo, l.issue_number, l.task_id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []GitHubLink
+	for rows.Next() {
+		l, err := scanGitHubLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+// MarkGitHubSynced records the task status last written to the task's issue
+func (s *DB) MarkGitHubSynced(taskID, status string) error {
+	result, err := s.exec("UPDATE github_links SET synced_status = ?, synced_at = ? WHERE task_id = ?",
+		status, time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), taskID)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+// SetGitHubPR records the pull request opened for a task, linking the task if it wasn't already
+func (s *DB) SetGitHubPR(taskID, repo string, prNumber int) error {
+	if prNumber <= 0 {
+		return fmt.Errorf("invalid pull request number %d", prNumber)
+	}
+	_, err := s.exec(
+		`INSERT INTO github_links (task_id, repo, pr_number) VALUES (?, ?, ?)
+		 ON CONFLICT (task_id) DO UPDATE SET pr_number = excluded.pr_number`,
+		taskID, repo, prNumber,
+	)
+	return err
+}
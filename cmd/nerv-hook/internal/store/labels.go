@@ -0,0 +1,157 @@
+package store
+
+import (
+	"encoding/json"
+	"slices"
+)
+
+// taskPriorities lists the priorities lowest first
+var taskPriorities = []string{PriorityLow, PriorityMedium, PriorityHigh, PriorityUrgent}
+
+// IsTaskPriority reports whether priority is one of the known priorities
+func IsTaskPriority(priority string) bool {
+	return slices.Contains(taskPriorities, priority)
+}
+
+// PriorityRank orders priorities: 0 for none, then 1 (low) through 4 (urgent)
+func PriorityRank(priority string) int {
+	return slices.Index(taskPriorities, priority) + 1
+}
+
+// loadLabels fills in the labels of tasks from the task_labels rows matching where
+func (s *DB) loadLabels(tasks []Task, where string, args ...interface{}) error {
+	rows, err := s.query("SELECT task_id, label FROM task_labels WHERE "+where+" ORDER BY label", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	byID := make(map[string]*Task, len(tasks))
+	for i := range tasks {
+		byID[tasks[i].ID] = &tasks[i]
+	}
+	for rows.Next() {
+		var taskID, label string
+		if err := rows.Scan(&taskID, &label); err != nil {
+			return err
+		}
+		if t, ok := byID[taskID]; ok {
+			t.Labels = append(t.Labels, label)
+		}
+	}
+	return rows.Err()
+}
+
+// SetTaskPriority sets a task's priority, or clears it when priority is empty,
+// and logs task_priority_changed in the same transaction
+func (s *DB) SetTaskPriority(taskID, priority string) error {
+	return retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Exec(s.rebind("UPDATE tasks SET priority = ? WHERE id = ?"), nullable(priority), taskID)
+		if err != nil {
+			return err
+		}
+		if err := requireRow(result); err != nil {
+			return err
+		}
+		details, _ := json.Marshal(map[string]string{"priority": priority})
+		if err := s.insertAudit(tx, taskID, "task_priority_changed", string(details)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// SetTaskLabels adds and removes a task's labels and logs task_labels_changed in
+// the same transaction, returning ErrNotFound if the task doesn't exist
+func (s *DB) SetTaskLabels(taskID string, add, remove []string) error {
+	return retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var exists int
+		if err := tx.QueryRow(s.rebind("SELECT 1 FROM tasks WHERE id = ?"), taskID).Scan(&exists); err != nil {
+			return notFound(err)
+		}
+		for _, label := range add {
+			if _, err := tx.Exec(s.rebind("INSERT INTO task_labels (task_id, label) VALUES (?, ?) ON CONFLICT DO NOTHING"), taskID, label); err != nil {
+				return err
+			}
+		}
+		for _, label := range remove {
+			if _, err := tx.Exec(s.rebind("DELETE FROM task_labels WHERE task_id = ? AND label = ?"), taskID, label); err != nil {
+				return err
+			}
+		}
+		details, _ := json.Marshal(map[string][]string{"added": add, "removed": remove})
+		if err := s.insertAudit(tx, taskID, "task_labels_changed", string(details)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// SaveTaskFilter stores a filter under name, replacing any filter saved under it before
+func (s *DB) SaveTaskFilter(name string, f TaskFilter) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(
+		`INSERT INTO task_filters (name, filter, created_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+		 ON CONFLICT (name) DO UPDATE SET filter = excluded.filter, created_at = excluded.created_at`,
+		name, string(data),
+	)
+	return err
+}
+
+// GetTaskFilter loads a saved filter, returning ErrNotFound if there's none by that name
+func (s *DB) GetTaskFilter(name string) (SavedFilter, error) {
+	var data string
+	sf := SavedFilter{Name: name}
+	err := s.queryRow("SELECT filter, created_at FROM task_filters WHERE name = ?", name).Scan(&data, timeColumn{&sf.CreatedAt})
+	if err != nil {
+		return sf, notFound(err)
+	}
+	return sf, json.Unmarshal([]byte(data), &sf.Filter)
+}
+
+// ListTaskFilters returns the saved filters by name
+func (s *DB) ListTaskFilters() ([]SavedFilter, error) {
+	rows, err := s.query("SELECT name, filter, created_at FROM task_filters ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var filters []SavedFilter
+	for rows.Next() {
+		var sf SavedFilter
+		var data string
+		if err := rows.Scan(&sf.Name, &data, timeColumn{&sf.CreatedAt}); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &sf.Filter); err != nil {
+			return nil, err
+		}
+		filters = append(filters, sf)
+	}
+	return filters, rows.Err()
+}
+
+// DeleteTaskFilter removes a saved filter, returning ErrNotFound if there's none by that name
+func (s *DB) DeleteTaskFilter(name string) error {
+	result, err := s.exec("DELETE FROM task_filters WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/migrations"
+)
+
+// Login is a logins row: an operator signed in to nerv-hook serve
+type Login struct {
+	// ID is the SHA-256 of the session cookie, in hex
+	ID       string
+	Operator string
+	// Issuer and Subject identify the person to the OpenID Connect provider
+	Issuer     string
+	Subject    string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastSeenAt time.Time
+}
+
+// Expired reports whether the login has run out at now
+func (l Login) Expired(now time.Time) bool {
+	return !now.Before(l.ExpiresAt)
+}
+
+const loginColumns = "id, operator, issuer, subject, created_at, expires_at, last_seen_at"
+
+func scanLogin(row interface{ Scan(...interface{}) error }) (Login, error) {
+	var l Login
+	err := row.Scan(&l.ID, &l.Operator, textColumn{&l.Issuer}, textColumn{&l.Subject},
+		timeColumn{&l.CreatedAt}, timeColumn{&l.ExpiresAt}, timeColumn{&l.LastSeenAt})
+	return l, err
+}
+
+// CreateLogin records a login
+func (s *DB) CreateLogin(l Login) error {
+	_, err := s.exec("INSERT INTO logins (id, operator, issuer, subject, expires_at) VALUES (?, ?, ?, ?, ?)",
+		l.ID, l.Operator, nullable(l.Issuer), nullable(l.Subject), l.ExpiresAt.UTC().Format("2006-01-02T15:04:05.000Z"))
+	return err
+}
+
+// GetLogin loads a login, expired or not, returning ErrNotFound if there's none
+func (s *DB) GetLogin(id string) (Login, error) {
+	l, err := scanLogin(s.queryRow("SELECT "+loginColumns+" FROM logins WHERE id = ?", id))
+	return l, notFound(err)
+}
+
+// TouchLogin records that a login was used at the given time
+func (s *DB) TouchLogin(id string, at time.Time) error {
+	_, err := s.exec("UPDATE logins SET last_seen_at = ? WHERE id = ?", at.UTC().Format("2006-01-02T15:04:05.000Z"), id)
+	return err
+}
+
+// ListLogins returns the logins that haven't expired at now, newest first
+func (s *DB) ListLogins(now time.Time) ([]Login, error) {
+	// expires_at holds ISO timestamps; julianday compares them as instants
+	query := "SELECT " + loginColumns + " FROM logins WHERE julianday(expires_at) > julianday(?)"
+	if s.dialect == migrations.Postgres {
+		query = "SELECT " + loginColumns + " FROM logins WHERE expires_at > ?"
+	}
+
+	rows, err := s.query(query+" ORDER BY created_at DESC, id", now.UTC().Format("2006-01-02T15:04:05.000Z"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logins []Login
+	for rows.Next() {
+		l, err := scanLogin(rows)
+		if err != nil {
+			return nil, err
+		}
+		logins = append(logins, l)
+	}
+	return logins, rows.Err()
+}
+
+// DeleteLogin ends a login, returning ErrNotFound if there's no such login
+func (s *DB) DeleteLogin(id string) error {
+	result, err := s.exec("DELETE FROM logins WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+// DeleteOperatorLogins ends all of an operator's logins, returning how many there were
+func (s *DB) DeleteOperatorLogins(operator string) (int64, error) {
+	result, err := s.exec("DELETE FROM logins WHERE operator = ?", operator)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteExpiredLogins removes the logins that have expired by now, returning how many there were
+func (s *DB) DeleteExpiredLogins(now time.Time) (int64, error) {
+	query := "DELETE FROM logins WHERE julianday(expires_at) <= julianday(?)"
+	if s.dialect == migrations.Postgres {
+		query = "DELETE FROM logins WHERE expires_at <= ?"
+	}
+	result, err := s.exec(query, now.UTC().Format("2006-01-02T15:04:05.000Z"))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,18 @@
+package store
+
+// Checkpoint copies the SQLite WAL into the database and truncates it to zero bytes
+// Reports busy if readers kept it from finishing
+func (s *DB) Checkpoint() (bool, error) {
+	var busy, logFrames, checkpointed int
+	err := s.db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logFrames, &checkpointed)
+	return busy != 0, err
+}
+
+// PageCounts returns a SQLite database's total and free page counts
+func (s *DB) PageCounts() (pages, free int64, err error) {
+	if err = s.db.QueryRow("PRAGMA page_count").Scan(&pages); err != nil {
+		return
+	}
+	err = s.db.QueryRow("PRAGMA freelist_count").Scan(&free)
+	return
+}
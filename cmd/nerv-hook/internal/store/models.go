@@ -0,0 +1,356 @@
+package store
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nerv/nerv-hook/pkg/approvals"
+)
+
+// Task statuses shared with the dashboard
+const (
+	TaskTodo       = "todo"
+	TaskInProgress = "in_progress"
+	// TaskInterrupted is set by the dashboard when a session dies mid-task
+	TaskInterrupted = "interrupted"
+	TaskReview      = "review"
+	TaskDone        = "done"
+	// TaskBlocked is waiting on something outside the agent's control
+	TaskBlocked = "blocked"
+	// TaskAbandoned was dropped without being finished
+	TaskAbandoned = "abandoned"
+)
+
+// Task priorities, lowest first; a task without one has an empty priority
+const (
+	PriorityLow    = "low"
+	PriorityMedium = "medium"
+	PriorityHigh   = "high"
+	PriorityUrgent = "urgent"
+)
+
+// Project is a projects row
+type Project struct {
+	ID        string
+	Name      string
+	Goal      string
+	CreatedAt time.Time
+}
+
+// TaskTransition is a task_transitions row: one recorded status change
+type TaskTransition struct {
+	ID     int64
+	TaskID string
+	From   string
+	To     string
+	Source string
+	// Operator is who made the change, if it was made by a registered operator
+	Operator  string
+	CreatedAt time.Time
+}
+
+// Repo is a repos row: a directory that belongs to a project
+type Repo struct {
+	ID        string
+	ProjectID string
+	Name      string
+	Path      string
+}
+
+// Task is a tasks row
+type Task struct {
+	ID           string
+	ProjectID    string
+	CycleID      string
+	Title        string
+	Description  string
+	TaskType     string
+	Status       string
+	Repos        string
+	WorktreePath string
+	SessionID    string
+	CreatedAt    time.Time
+	CompletedAt  time.Time
+	// Branch is the git branch the task works on; BranchHead is the commit it
+	// pointed at when the last session stopped
+	Branch     string
+	BranchHead string
+	Priority   string
+	// Labels are sorted; they're kept in task_labels
+	Labels []string
+	// ParentID is the task this one is a subtask of, if any
+	ParentID string
+}
+
+// TaskWorktree is a task_worktrees row: the task's worktree in one of its project's repos
+type TaskWorktree struct {
+	TaskID    string
+	RepoID    string
+	Path      string
+	CreatedAt time.Time
+}
+
+// SavedFilter is a task_filters row: a task list filter saved under a name
+type SavedFilter struct {
+	Name      string
+	Filter    TaskFilter
+	CreatedAt time.Time
+}
+
+// TaskRun is a task_runs row: one agent process launched for a task
+type TaskRun struct {
+	ID        int64
+	TaskID    string
+	ProjectID string
+	PID       int
+	Mode      string
+	SessionID string
+	LogPath   string
+	StartedAt time.Time
+	// EndedAt is zero while the process is running
+	EndedAt time.Time
+	// ExitCode is -1 when the process was found dead rather than waited for
+	ExitCode int
+}
+
+// QueuedTask is a task_queue entry: a task waiting for nervd to launch its agent
+type QueuedTask struct {
+	TaskID    string
+	ProjectID string
+	Priority  int
+	// Prompt overrides the prompt built from the task when set
+	Prompt     string
+	EnqueuedAt time.Time
+}
+
+// Session is an agent session the hook has seen
+type Session struct {
+	ID        string
+	ProjectID string
+	TaskID    string
+	StartedAt time.Time
+	// LastSeenAt is the session's latest hook event
+	LastSeenAt time.Time
+	// EndedAt is the latest stop, zero while the agent is working
+	EndedAt time.Time
+	// Active is the time between hook events, leaving out idle gaps and waits for the user
+	Active time.Duration
+	// ToolCalls counts the session's pre-tool-use events, allowed or not
+	ToolCalls int64
+	// Tokens and CostUSD are read from the agent's transcript
+	Tokens  int64
+	CostUSD float64
+	// NotesSeen is the ID of the newest task note the session has been given
+	NotesSeen int64
+	// TranscriptPath is the agent's JSONL transcript, as its hooks last reported it
+	TranscriptPath string
+}
+
+// WallClock is how long the session has run, from its first hook event to its last
+func (s Session) WallClock() time.Duration {
+	end := s.LastSeenAt
+	if s.EndedAt.After(end) {
+		end = s.EndedAt
+	}
+	if end.Before(s.StartedAt) {
+		return 0
+	}
+	return end.Sub(s.StartedAt)
+}
+
+// Budget scopes and what happens when a budget is exceeded
+const (
+	BudgetTask    = "task"
+	BudgetProject = "project"
+
+	BudgetDeny = "deny"
+	BudgetStop = "stop"
+)
+
+// Budget is a budgets row: limits on what a task's or project's sessions may use
+// A zero limit isn't enforced
+type Budget struct {
+	Scope        string
+	ScopeID      string
+	MaxTokens    int64
+	MaxCostUSD   float64
+	MaxToolCalls int64
+	OnExceed     string
+}
+
+// Usage is what sessions have used, summed over a task or project
+type Usage struct {
+	Sessions  int
+	ToolCalls int64
+	Tokens    int64
+	CostUSD   float64
+}
+
+// Baseline is how often a project has done one kind of thing, such as use a tool category
+type Baseline struct {
+	ProjectID string
+	Kind      string
+	Key       string
+	Count     int64
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// Review statuses, matching the dashboard's task_reviews
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+// Review is a task_reviews row: one request to review a task's work, and its decision
+type Review struct {
+	ID        string
+	TaskID    string
+	Status    string
+	Notes     string
+	CreatedAt time.Time
+	DecidedAt time.Time
+}
+
+// ReviewBundle is a review_bundles row: what a task's work looked like when it entered review
+// Bundle is JSON; its shape belongs to whoever built it
+type ReviewBundle struct {
+	ID        int64
+	TaskID    string
+	ReviewID  string
+	Head      string
+	Bundle    string
+	CreatedAt time.Time
+}
+
+// GitHubLink is a github_links row: the GitHub issue and pull request a task syncs with
+// IssueNumber and PRNumber are 0 when there isn't one; Status is the task's current status
+type GitHubLink struct {
+	TaskID       string
+	ProjectID    string
+	Status       string
+	Repo         string
+	IssueNumber  int
+	PRNumber     int
+	SyncedStatus string
+	SyncedAt     time.Time
+}
+
+// TrackerLink is a tracker_links row: the Linear or Jira ticket a task was imported from
+// Status is the task's current status
+type TrackerLink struct {
+	TaskID       string
+	ProjectID    string
+	Status       string
+	Tracker      string
+	ExternalID   string
+	Key          string
+	URL          string
+	SyncedStatus string
+	TrackerState string
+	SyncedAt     time.Time
+}
+
+// Approval is an approvals row
+// The type is shared with pkg/approvals so the store can back an approvals.Queue
+type Approval = approvals.Approval
+
+// AuditEvent is an audit_log row
+type AuditEvent struct {
+	ID        int64
+	Timestamp time.Time
+	TaskID    string
+	EventType string
+	Details   string
+	// Operator is who the event is attributed to; empty for agents and the hook
+	Operator string
+}
+
+// timestampLayouts are the formats timestamps arrive in: SQLite's
+// CURRENT_TIMESTAMP, the dashboard's ISO strings, and driver-formatted values
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999Z07:00",
+}
+
+// timeColumn scans a nullable timestamp column in whatever form the driver returns it
+// Unparseable values read as the zero time rather than failing the whole row
+type timeColumn struct{ t *time.Time }
+
+func (c timeColumn) Scan(src interface{}) error {
+	*c.t = time.Time{}
+	var s string
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case time.Time:
+		*c.t = v
+		return nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("unsupported timestamp type %T", src)
+	}
+
+	s = strings.TrimSpace(s)
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			*c.t = t
+			return nil
+		}
+	}
+	return nil
+}
+
+// textColumn scans a nullable text column, reading NULL as ""
+type textColumn struct{ s *string }
+
+func (c textColumn) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*c.s = ""
+	case string:
+		*c.s = v
+	case []byte:
+		*c.s = string(v)
+	default:
+		*c.s = fmt.Sprint(v)
+	}
+	return nil
+}
+
+// nullable stores "" as NULL, matching how the dashboard leaves optional columns unset
+func nullable(s string) driver.Value {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// Verification is a verifications row: one run of a project's verification commands against a task
+// Steps is JSON, written and read by the hook
+type Verification struct {
+	ID         int64
+	TaskID     string
+	Head       string
+	Passed     bool
+	Steps      string
+	DurationMS int64
+	CreatedAt  time.Time
+}
+
+// TaskNote is a task_notes row: a note or constraint a user attached to a task
+type TaskNote struct {
+	ID        int64
+	TaskID    string
+	Body      string
+	Operator  string
+	CreatedAt time.Time
+}
@@ -0,0 +1,74 @@
+package store
+
+import "encoding/json"
+
+// AddTaskNote attaches a note to a task and logs task_note_added in the same transaction
+func (s *DB) AddTaskNote(taskID, body string) (TaskNote, error) {
+	note := TaskNote{TaskID: taskID, Body: body, Operator: s.operator}
+	err := retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if note.ID, err = s.insertReturningID(tx, "INSERT INTO task_notes (task_id, body, operator) VALUES (?, ?, ?)", taskID, body, nullable(s.operator)); err != nil {
+			return err
+		}
+		details, _ := json.Marshal(map[string]interface{}{"noteId": note.ID, "note": body})
+		if err := s.insertAudit(tx, taskID, "task_note_added", string(details)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	return note, err
+}
+
+// ListTaskNotes returns a task's notes oldest first, leaving out those up to afterID
+func (s *DB) ListTaskNotes(taskID string, afterID int64) ([]TaskNote, error) {
+	rows, err := s.query("SELECT id, task_id, body, operator, created_at FROM task_notes WHERE task_id = ? AND id > ? ORDER BY id", taskID, afterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notes []TaskNote
+	for rows.Next() {
+		var n TaskNote
+		if err := rows.Scan(&n.ID, &n.TaskID, &n.Body, textColumn{&n.Operator}, timeColumn{&n.CreatedAt}); err != nil {
+			return nil, err
+		}
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
+
+// DeleteTaskNote removes one of a task's notes, returning ErrNotFound if the task has no such note
+func (s *DB) DeleteTaskNote(taskID string, id int64) error {
+	return retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Exec(s.rebind("DELETE FROM task_notes WHERE id = ? AND task_id = ?"), id, taskID)
+		if err != nil {
+			return err
+		}
+		if err := requireRow(result); err != nil {
+			return err
+		}
+		details, _ := json.Marshal(map[string]int64{"noteId": id})
+		if err := s.insertAudit(tx, taskID, "task_note_removed", string(details)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// MarkSessionNotesSeen records that a session has been given the notes up to noteID
+func (s *DB) MarkSessionNotesSeen(sessionID string, noteID int64) error {
+	_, err := s.exec("UPDATE sessions SET notes_seen = ? WHERE id = ? AND notes_seen < ?", noteID, sessionID, noteID)
+	return err
+}
@@ -0,0 +1,49 @@
+package store
+
+const projectColumns = "id, name, goal, created_at"
+
+func scanProject(row interface{ Scan(...interface{}) error }) (Project, error) {
+	var p Project
+	err := row.Scan(&p.ID, &p.Name, textColumn{&p.Goal}, timeColumn{&p.CreatedAt})
+	return p, err
+}
+
+// CreateProject inserts a project
+func (s *DB) CreateProject(p Project) error {
+	_, err := s.exec("INSERT INTO projects (id, name, goal) VALUES (?, ?, ?)", p.ID, p.Name, nullable(p.Goal))
+	return err
+}
+
+// GetProject loads a project by ID, returning ErrNotFound if it doesn't exist
+func (s *DB) GetProject(id string) (Project, error) {
+	p, err := scanProject(s.queryRow("SELECT "+projectColumns+" FROM projects WHERE id = ?", id))
+	return p, notFound(err)
+}
+
+// ListProjects returns every project, oldest first
+func (s *DB) ListProjects() ([]Project, error) {
+	rows, err := s.query("SELECT " + projectColumns + " FROM projects ORDER BY created_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var projects []Project
+	for rows.Next() {
+		p, err := scanProject(rows)
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, p)
+	}
+	return projects, rows.Err()
+}
+
+// DeleteProject removes a project; its cycles and tasks go with it
+func (s *DB) DeleteProject(id string) error {
+	result, err := s.exec("DELETE FROM projects WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
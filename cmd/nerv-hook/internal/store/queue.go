@@ -0,0 +1,43 @@
+package store
+
+// EnqueueTask adds a task to the run queue, or updates its priority and prompt if it's already queued
+func (s *DB) EnqueueTask(taskID string, priority int, prompt string) error {
+	_, err := s.exec(
+		`INSERT INTO task_queue (task_id, priority, prompt) VALUES (?, ?, ?)
+		 ON CONFLICT (task_id) DO UPDATE SET priority = excluded.priority, prompt = excluded.prompt`,
+		taskID, priority, nullable(prompt),
+	)
+	return err
+}
+
+// DequeueTask removes a task from the run queue, returning ErrNotFound if it wasn't queued
+func (s *DB) DequeueTask(taskID string) error {
+	result, err := s.exec("DELETE FROM task_queue WHERE task_id = ?", taskID)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+// QueuedTasks returns the run queue in launch order: highest priority first, then oldest
+func (s *DB) QueuedTasks() ([]QueuedTask, error) {
+	rows, err := s.query(
+		`SELECT q.task_id, t.project_id, q.priority, q.prompt, q.enqueued_at
+		 FROM task_queue q JOIN tasks t ON t.id = q.task_id
+		 ORDER BY q.priority DESC, q.enqueued_at, q.task_id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var queue []QueuedTask
+	for rows.Next() {
+		var q QueuedTask
+		if err := rows.Scan(&q.TaskID, &q.ProjectID, &q.Priority, textColumn{&q.Prompt}, timeColumn{&q.EnqueuedAt}); err != nil {
+			return nil, err
+		}
+		queue = append(queue, q)
+	}
+	return queue, rows.Err()
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// CreateRepo registers a directory under a project
+func (s *DB) CreateRepo(r Repo) error {
+	_, err := s.exec("INSERT INTO repos (id, project_id, name, path) VALUES (?, ?, ?, ?)",
+		r.ID, r.ProjectID, r.Name, r.Path)
+	return err
+}
+
+// ListRepos returns the repos of projectID, or of every project if it is empty
+func (s *DB) ListRepos(projectID string) ([]Repo, error) {
+	query := "SELECT id, project_id, name, path FROM repos"
+	var args []interface{}
+	if projectID != "" {
+		query += " WHERE project_id = ?"
+		args = append(args, projectID)
+	}
+
+	rows, err := s.query(query+" ORDER BY path", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var repos []Repo
+	for rows.Next() {
+		var r Repo
+		if err := rows.Scan(&r.ID, textColumn{&r.ProjectID}, &r.Name, &r.Path); err != nil {
+			return nil, err
+		}
+		repos = append(repos, r)
+	}
+	return repos, rows.Err()
+}
+
+// ProjectForDir returns the project whose repo contains dir, preferring the
+// deepest match so nested repos win over their parents
+// Returns ErrNotFound if dir is outside every registered repo
+func (s *DB) ProjectForDir(dir string) (string, error) {
+	repos, err := s.ListRepos("")
+	if err != nil {
+		return "", err
+	}
+
+	var best Repo
+	for _, r := range repos {
+		rel, err := filepath.Rel(r.Path, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if len(r.Path) > len(best.Path) {
+			best = r
+		}
+	}
+	if best.ProjectID == "" {
+		return "", ErrNotFound
+	}
+	return best.ProjectID, nil
+}
+
+// AddTaskWorktree records a task's worktree for a repo, replacing any earlier one
+func (s *DB) AddTaskWorktree(w TaskWorktree) error {
+	_, err := s.exec(
+		`INSERT INTO task_worktrees (task_id, repo_id, path) VALUES (?, ?, ?)
+		 ON CONFLICT (task_id, repo_id) DO UPDATE SET path = excluded.path, created_at = CURRENT_TIMESTAMP`,
+		w.TaskID, w.RepoID, w.Path,
+	)
+	return err
+}
+
+// ListTaskWorktrees returns a task's worktrees by path
+func (s *DB) ListTaskWorktrees(taskID string) ([]TaskWorktree, error) {
+	rows, err := s.query("SELECT task_id, repo_id, path, created_at FROM task_worktrees WHERE task_id = ? ORDER BY path", taskID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var worktrees []TaskWorktree
+	for rows.Next() {
+		var w TaskWorktree
+		if err := rows.Scan(&w.TaskID, &w.RepoID, &w.Path, timeColumn{&w.CreatedAt}); err != nil {
+			return nil, err
+		}
+		worktrees = append(worktrees, w)
+	}
+	return worktrees, rows.Err()
+}
+
+// DeleteTaskWorktree forgets a task's worktree for a repo
+func (s *DB) DeleteTaskWorktree(taskID, repoID string) error {
+	result, err := s.exec("DELETE FROM task_worktrees WHERE task_id = ? AND repo_id = ?", taskID, repoID)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Write retries on top of busy_timeout, for when the hook, dashboard, and CLI
+// all contend for the same database file
+const (
+	writeRetryAttempts  = 5
+	writeRetryBaseDelay = 50 * time.Millisecond
+)
+
+// isBusyError reports whether err is SQLITE_BUSY or SQLITE_LOCKED (including extended codes)
+func isBusyError(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	code := sqliteErr.Code() & 0xff
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
+
+// retryOnBusy runs fn, retrying with jittered exponential backoff while the database is locked
+func retryOnBusy(fn func() error) error {
+	delay := writeRetryBaseDelay
+	var err error
+	for attempt := 1; attempt <= writeRetryAttempts; attempt++ {
+		if err = fn(); err == nil || !isBusyError(err) {
+			return err
+		}
+		if attempt < writeRetryAttempts {
+			time.Sleep(delay + time.Duration(rand.Int63n(int64(delay))))
+			delay *= 2
+		}
+	}
+	return fmt.Errorf("database still locked after %d attempts: %w", writeRetryAttempts, err)
+}
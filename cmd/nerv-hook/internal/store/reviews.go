@@ -0,0 +1,125 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const reviewColumns = "id, task_id, status, reviewer_notes, created_at, decided_at"
+
+func scanReview(row interface{ Scan(...interface{}) error }) (Review, error) {
+	var r Review
+	err := row.Scan(&r.ID, &r.TaskID, &r.Status, textColumn{&r.Notes}, timeColumn{&r.CreatedAt}, timeColumn{&r.DecidedAt})
+	return r, err
+}
+
+// RequestReview returns the task's pending review, opening one if there isn't one
+// A new review is recorded with a review_requested audit event, as the dashboard does
+func (s *DB) RequestReview(taskID string) (Review, error) {
+	if r, err := s.pendingReview(taskID); !errors.Is(err, ErrNotFound) {
+		return r, err
+	}
+
+	id := NewID()
+	err := retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(s.rebind("INSERT INTO task_reviews (id, task_id, status) VALUES (?, ?, 'pending')"), id, taskID); err != nil {
+			return err
+		}
+		if err := s.insertAudit(tx, taskID, "review_requested", fmt.Sprintf(`{"reviewId":%q}`, id)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return Review{}, err
+	}
+	return s.GetReview(id)
+}
+
+func (s *DB) pendingReview(taskID string) (Review, error) {
+	r, err := scanReview(s.queryRow("SELECT "+reviewColumns+" FROM task_reviews WHERE task_id = ? AND status = 'pending' ORDER BY created_at DESC LIMIT 1", taskID))
+	return r, notFound(err)
+}
+
+// GetReview loads a review by ID, returning ErrNotFound if it doesn't exist
+func (s *DB) GetReview(id string) (Review, error) {
+	r, err := scanReview(s.queryRow("SELECT "+reviewColumns+" FROM task_reviews WHERE id = ?", id))
+	return r, notFound(err)
+}
+
+// LatestReview returns a task's most recent review, returning ErrNotFound if it has none
+func (s *DB) LatestReview(taskID string) (Review, error) {
+	r, err := scanReview(s.queryRow("SELECT "+reviewColumns+" FROM task_reviews WHERE task_id = ? ORDER BY created_at DESC, id DESC LIMIT 1", taskID))
+	return r, notFound(err)
+}
+
+// DecideReview approves or rejects a pending review and records a review_approved
+// or review_rejected audit event, with the same details the dashboard logs
+// Returns ErrNotFound if there's no pending review with this ID
+func (s *DB) DecideReview(id, status, notes string) error {
+	if status != ReviewApproved && status != ReviewRejected {
+		return fmt.Errorf("invalid review decision %q", status)
+	}
+
+	return retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var taskID string
+		if err := tx.QueryRow(s.rebind("SELECT task_id FROM task_reviews WHERE id = ? AND status = 'pending'"), id).Scan(&taskID); err != nil {
+			return notFound(err)
+		}
+		if _, err := tx.Exec(
+			s.rebind("UPDATE task_reviews SET status = ?, reviewer_notes = ?, decided_at = ? WHERE id = ?"),
+			status, nullable(notes), time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), id,
+		); err != nil {
+			return err
+		}
+		if err := s.insertAudit(tx, taskID, "review_"+status, fmt.Sprintf(`{"reviewId":%q,"notes":%q}`, id, notes)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// SaveReviewBundle stores a bundle for a task, returning its ID
+func (s *DB) SaveReviewBundle(b ReviewBundle) (int64, error) {
+	var id int64
+	err := retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		id, err = s.insertReturningID(tx,
+			"INSERT INTO review_bundles (task_id, review_id, head, bundle) VALUES (?, ?, ?, ?)",
+			b.TaskID, nullable(b.ReviewID), nullable(b.Head), compressText(b.Bundle),
+		)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	return id, err
+}
+
+// LatestReviewBundle returns the newest bundle for a task, returning ErrNotFound if it has none
+func (s *DB) LatestReviewBundle(taskID string) (ReviewBundle, error) {
+	var b ReviewBundle
+	err := s.queryRow(
+		"SELECT id, task_id, review_id, head, bundle, created_at FROM review_bundles WHERE task_id = ? ORDER BY id DESC LIMIT 1",
+		taskID,
+	).Scan(&b.ID, &b.TaskID, textColumn{&b.ReviewID}, textColumn{&b.Head}, compressedColumn{&b.Bundle}, timeColumn{&b.CreatedAt})
+	return b, notFound(err)
+}
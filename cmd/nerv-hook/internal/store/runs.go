@@ -0,0 +1,92 @@
+package store
+
+import "database/sql"
+
+// runColumns selects from task_runs r joined to its task t
+const runColumns = "r.id, r.task_id, t.project_id, r.pid, r.mode, r.session_id, r.log_path, r.started_at, r.ended_at, r.exit_code"
+
+const runFrom = " FROM task_runs r JOIN tasks t ON t.id = r.task_id"
+
+func scanRun(row interface{ Scan(...interface{}) error }) (TaskRun, error) {
+	var r TaskRun
+	var pid, exitCode sql.NullInt64
+	err := row.Scan(&r.ID, &r.TaskID, &r.ProjectID, &pid, &r.Mode, textColumn{&r.SessionID}, textColumn{&r.LogPath},
+		timeColumn{&r.StartedAt}, timeColumn{&r.EndedAt}, &exitCode)
+	r.PID = int(pid.Int64)
+	r.ExitCode = -1
+	if exitCode.Valid {
+		r.ExitCode = int(exitCode.Int64)
+	}
+	return r, err
+}
+
+// CreateRun records an agent launch before its process starts, so the process can be given the run ID
+func (s *DB) CreateRun(taskID, mode, logPath string) (int64, error) {
+	var id int64
+	err := retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		id, err = s.insertReturningID(tx, "INSERT INTO task_runs (task_id, mode, log_path) VALUES (?, ?, ?)",
+			taskID, mode, nullable(logPath))
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	return id, err
+}
+
+// SetRunPID records the process ID once the agent has started
+func (s *DB) SetRunPID(id int64, pid int) error {
+	result, err := s.exec("UPDATE task_runs SET pid = ? WHERE id = ?", pid, id)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+// FinishRun marks a run ended; exitCode -1 records that the process was found dead
+func (s *DB) FinishRun(id int64, exitCode int) error {
+	var code interface{}
+	if exitCode >= 0 {
+		code = exitCode
+	}
+	_, err := s.exec("UPDATE task_runs SET ended_at = CURRENT_TIMESTAMP, exit_code = ? WHERE id = ? AND ended_at IS NULL", code, id)
+	return err
+}
+
+// LinkRunSession ties a run to the agent session the hook saw it start
+// Only the first session is kept, so later calls are cheap no-ops
+func (s *DB) LinkRunSession(id int64, sessionID string) error {
+	_, err := s.exec("UPDATE task_runs SET session_id = ? WHERE id = ? AND session_id IS NULL", sessionID, id)
+	return err
+}
+
+// GetRun loads a run by ID, returning ErrNotFound if it doesn't exist
+func (s *DB) GetRun(id int64) (TaskRun, error) {
+	r, err := scanRun(s.queryRow("SELECT "+runColumns+runFrom+" WHERE r.id = ?", id))
+	return r, notFound(err)
+}
+
+// ActiveRuns returns the runs that haven't been marked ended, oldest first
+func (s *DB) ActiveRuns() ([]TaskRun, error) {
+	rows, err := s.query("SELECT " + runColumns + runFrom + " WHERE r.ended_at IS NULL ORDER BY r.id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []TaskRun
+	for rows.Next() {
+		r, err := scanRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
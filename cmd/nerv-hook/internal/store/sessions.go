@@ -0,0 +1,141 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/migrations"
+)
+
+// SessionIdleGap is the longest gap between hook events that still counts as active time
+// Anything longer is taken to be the agent sitting idle rather than working
+const SessionIdleGap = 5 * time.Minute
+
+const sessionColumns = "id, project_id, task_id, started_at, last_seen_at, ended_at, active_seconds, tool_calls, tokens, cost_usd, notes_seen, transcript_path"
+
+func scanSession(row interface{ Scan(...interface{}) error }) (Session, error) {
+	var sess Session
+	var activeSeconds int64
+	err := row.Scan(&sess.ID, textColumn{&sess.ProjectID}, textColumn{&sess.TaskID}, timeColumn{&sess.StartedAt},
+		timeColumn{&sess.LastSeenAt}, timeColumn{&sess.EndedAt}, &activeSeconds, &sess.ToolCalls, &sess.Tokens, &sess.CostUSD, &sess.NotesSeen, textColumn{&sess.TranscriptPath})
+	sess.Active = time.Duration(activeSeconds) * time.Second
+	return sess, err
+}
+
+// CreateSession records a session
+func (s *DB) CreateSession(sess Session) error {
+	_, err := s.exec("INSERT INTO sessions (id, project_id, task_id) VALUES (?, ?, ?)",
+		sess.ID, nullable(sess.ProjectID), nullable(sess.TaskID))
+	return err
+}
+
+// GetSession loads a session by ID, returning ErrNotFound if it doesn't exist
+func (s *DB) GetSession(id string) (Session, error) {
+	sess, err := scanSession(s.queryRow("SELECT "+sessionColumns+" FROM sessions WHERE id = ?", id))
+	return sess, notFound(err)
+}
+
+// TouchSession records a hook event for a session at the given time, creating the session on its first event
+// The gap since the previous event is added to the session's active time unless it
+// exceeds SessionIdleGap or follows a stop, when the agent was waiting on the user
+// stopped marks the event as a stop; the next event clears it again
+func (s *DB) TouchSession(sess Session, at time.Time, stopped bool) error {
+	now := at.UTC().Format("2006-01-02T15:04:05.000Z")
+	var endedAt interface{}
+	if stopped {
+		endedAt = now
+	}
+
+	return retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var lastSeen, lastStop time.Time
+		err = tx.QueryRow(s.rebind("SELECT last_seen_at, ended_at FROM sessions WHERE id = ?"), sess.ID).
+			Scan(timeColumn{&lastSeen}, timeColumn{&lastStop})
+		if errors.Is(err, sql.ErrNoRows) {
+			_, err = tx.Exec(s.rebind(
+				`INSERT INTO sessions (id, project_id, task_id, started_at, last_seen_at, ended_at, transcript_path)
+				 VALUES (?, ?, ?, ?, ?, ?, ?)`),
+				sess.ID, nullable(sess.ProjectID), nullable(sess.TaskID), now, now, endedAt, nullable(sess.TranscriptPath))
+			if err != nil {
+				return err
+			}
+			return tx.Commit()
+		}
+		if err != nil {
+			return err
+		}
+
+		var activeSeconds int64
+		if gap := at.Sub(lastSeen); !lastSeen.IsZero() && lastStop.IsZero() && gap > 0 && gap <= SessionIdleGap {
+			activeSeconds = int64(gap.Round(time.Second) / time.Second)
+		}
+		_, err = tx.Exec(s.rebind(
+			`UPDATE sessions SET last_seen_at = ?, ended_at = ?, active_seconds = active_seconds + ?,
+			   project_id = COALESCE(project_id, ?), task_id = COALESCE(task_id, ?),
+			   transcript_path = COALESCE(?, transcript_path)
+			 WHERE id = ?`),
+			now, endedAt, activeSeconds, nullable(sess.ProjectID), nullable(sess.TaskID), nullable(sess.TranscriptPath), sess.ID)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// ActiveSessions returns the sessions that haven't stopped and have had a hook
+// event since the given time, most recently seen first
+func (s *DB) ActiveSessions(since time.Time) ([]Session, error) {
+	// last_seen_at holds ISO timestamps; julianday compares them as instants
+	query := "SELECT " + sessionColumns + " FROM sessions WHERE ended_at IS NULL AND julianday(last_seen_at) >= julianday(?)"
+	if s.dialect == migrations.Postgres {
+		query = "SELECT " + sessionColumns + " FROM sessions WHERE ended_at IS NULL AND last_seen_at >= ?"
+	}
+
+	rows, err := s.query(query+" ORDER BY last_seen_at DESC, id", since.UTC().Format("2006-01-02T15:04:05.000Z"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		sess, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// ListSessions returns a task's sessions oldest first, or every session linked to a task if taskID is empty
+func (s *DB) ListSessions(taskID string) ([]Session, error) {
+	query := "SELECT " + sessionColumns + " FROM sessions WHERE task_id IS NOT NULL"
+	var args []interface{}
+	if taskID != "" {
+		query = "SELECT " + sessionColumns + " FROM sessions WHERE task_id = ?"
+		args = append(args, taskID)
+	}
+
+	rows, err := s.query(query+" ORDER BY started_at, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		sess, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
@@ -0,0 +1,34 @@
+package store
+
+// Settings keys shared with the dashboard
+const (
+	// SettingCurrentProject is the project used when none is given or derivable
+	SettingCurrentProject = "current_project_id"
+	// SettingConfigChecksum is the sha256 of the permissions file as a person last saved it
+	SettingConfigChecksum = "permissions_config_sha256"
+	// SettingConfigKnownGood is the permissions file as a person last saved it
+	SettingConfigKnownGood = "permissions_config_known_good"
+)
+
+// GetSetting returns a settings value, or ErrNotFound if it isn't set
+func (s *DB) GetSetting(key string) (string, error) {
+	var value string
+	err := s.queryRow("SELECT value FROM settings WHERE key = ?", key).Scan(textColumn{&value})
+	return value, notFound(err)
+}
+
+// SetSetting stores a settings value, replacing any previous one
+func (s *DB) SetSetting(key, value string) error {
+	_, err := s.exec(
+		`INSERT INTO settings (key, value, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+		 ON CONFLICT (key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+		key, value,
+	)
+	return err
+}
+
+// DeleteSetting removes a settings value; removing one that isn't set is not an error
+func (s *DB) DeleteSetting(key string) error {
+	_, err := s.exec("DELETE FROM settings WHERE key = ?", key)
+	return err
+}
@@ -0,0 +1,343 @@
+// Package store is the data layer for the NERV state database
+//
+// It wraps database/sql with typed models and CRUD for projects, tasks,
+// sessions, approvals, and audit events, so the hook, CLI commands, and nervd
+// share one set of queries. Queries are written once with ? placeholders and
+// rebound for PostgreSQL.
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	_ "github.com/lib/pq"
+	"github.com/nerv/nerv-hook/internal/migrations"
+	_ "modernc.org/sqlite"
+)
+
+// BusyTimeoutMillis is how long SQLite itself waits on a locked database
+// before returning SQLITE_BUSY
+const BusyTimeoutMillis = 5000
+
+// ErrNotFound is returned when a looked-up row doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// ErrReadOnly is returned by writes on a database opened read-only
+var ErrReadOnly = errors.New("database is open read-only")
+
+// DB is a connection pool to the state database
+type DB struct {
+	db       *sql.DB
+	dialect  migrations.Dialect
+	location string
+	readOnly bool
+	// operator is who writes through this handle are attributed to; see SetOperator
+	operator string
+
+	// stmts is shared with the handles As makes
+	stmts *statements
+}
+
+// statements caches prepared statements by query
+type statements struct {
+	mu     sync.Mutex
+	byText map[string]*sql.Stmt
+}
+
+// Options tunes how a state database is opened; the zero value keeps the defaults
+type Options struct {
+	// MaxOpenConns and MaxIdleConns size the connection pool; 0 leaves database/sql's defaults
+	MaxOpenConns int
+	MaxIdleConns int
+	// JournalMode is the SQLite journal mode, wal unless set
+	JournalMode string
+	// Synchronous is the SQLite synchronous level (off, normal, full, or extra); empty keeps SQLite's default
+	Synchronous string
+}
+
+var (
+	journalModes      = []string{"wal", "delete", "truncate", "persist", "memory", "off"}
+	synchronousLevels = []string{"off", "normal", "full", "extra"}
+)
+
+// Validate reports settings SQLite wouldn't accept
+func (o Options) Validate() error {
+	if o.MaxOpenConns < 0 || o.MaxIdleConns < 0 {
+		return fmt.Errorf("connection limits can't be negative")
+	}
+	if o.JournalMode != "" && !slices.Contains(journalModes, strings.ToLower(o.JournalMode)) {
+		return fmt.Errorf("unknown journal mode %q (expected one of %s)", o.JournalMode, strings.Join(journalModes, ", "))
+	}
+	if o.Synchronous != "" && !slices.Contains(synchronousLevels, strings.ToLower(o.Synchronous)) {
+		return fmt.Errorf("unknown synchronous level %q (expected one of %s)", o.Synchronous, strings.Join(synchronousLevels, ", "))
+	}
+	return nil
+}
+
+func (o Options) journalMode() string {
+	if o.JournalMode == "" {
+		return "wal"
+	}
+	return strings.ToLower(o.JournalMode)
+}
+
+// applyPool sizes the connection pool
+func (o Options) applyPool(db *sql.DB) {
+	if o.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(o.MaxOpenConns)
+	}
+	if o.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(o.MaxIdleConns)
+	}
+}
+
+// SQLiteDSN builds the connection string for a SQLite database with the given open mode (ro, rw, or rwc)
+// busy_timeout and foreign_keys are set per connection via _pragma so every pooled connection gets them
+func SQLiteDSN(path, mode string) string {
+	return fmt.Sprintf("file:%s?mode=%s&_pragma=busy_timeout(%d)&_pragma=foreign_keys(1)", path, mode, BusyTimeoutMillis)
+}
+
+// OpenSQLite opens a SQLite state database
+// Mode ro opens it read-only: SQLite rejects writes, and the store's write methods return ErrReadOnly
+func OpenSQLite(path, mode string, opts Options) (*DB, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	dsn := SQLiteDSN(path, mode)
+	if opts.Synchronous != "" {
+		dsn += fmt.Sprintf("&_pragma=synchronous(%s)", strings.ToLower(opts.Synchronous))
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	opts.applyPool(db)
+
+	// The journal mode is stored in the file, so it is set once rather than per connection
+	// Switching it is a write, so read-only connections keep whatever the file has
+	if mode != "ro" {
+		want := opts.journalMode()
+		var got string
+		if err := db.QueryRow("PRAGMA journal_mode = " + want).Scan(&got); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to open %s: %w", path, err)
+		}
+		if !strings.EqualFold(got, want) {
+			db.Close()
+			return nil, fmt.Errorf("failed to open %s: journal mode is %s, could not switch to %s", path, got, want)
+		}
+	} else if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	s := newDB(db, migrations.SQLite, path)
+	s.readOnly = mode == "ro"
+	return s, nil
+}
+
+// OpenMemory opens a private in-memory SQLite database, for tests
+// The pool is limited to one connection, since each connection to an in-memory database starts empty
+func OpenMemory() (*DB, error) {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file::memory:?_pragma=busy_timeout(%d)&_pragma=foreign_keys(1)", BusyTimeoutMillis))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	return newDB(db, migrations.SQLite, ":memory:"), nil
+}
+
+// OpenPostgres connects to a PostgreSQL state database given a postgres:// URL
+// With readOnly set, sessions default to read-only transactions so the server rejects writes too
+// Only the pool sizes in opts apply; the SQLite settings are ignored
+func OpenPostgres(dbURL string, readOnly bool, opts Options) (*DB, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database URL: %w", err)
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return nil, fmt.Errorf("unsupported database URL scheme %q (expected postgres://)", u.Scheme)
+	}
+
+	connURL := *u
+	if readOnly {
+		// lib/pq passes unrecognized URL parameters to the server as session settings
+		q := connURL.Query()
+		q.Set("default_transaction_read_only", "on")
+		connURL.RawQuery = q.Encode()
+	}
+
+	db, err := sql.Open("postgres", connURL.String())
+	if err != nil {
+		return nil, err
+	}
+	opts.applyPool(db)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %w", u.Redacted(), err)
+	}
+
+	s := newDB(db, migrations.Postgres, u.Redacted())
+	s.readOnly = readOnly
+	return s, nil
+}
+
+func newDB(db *sql.DB, dialect migrations.Dialect, location string) *DB {
+	return &DB{
+		db:       db,
+		dialect:  dialect,
+		location: location,
+		stmts:    &statements{byText: map[string]*sql.Stmt{}},
+	}
+}
+
+// As returns a handle on the same database whose writes are attributed to
+// operator, for a server acting for several people at once; see SetOperator
+// It shares this handle's connections, so close this one rather than it
+func (s *DB) As(operator string) *DB {
+	c := *s
+	c.operator = operator
+	return &c
+}
+
+// SQL returns the underlying pool, for maintenance commands that need raw access
+func (s *DB) SQL() *sql.DB {
+	return s.db
+}
+
+// Dialect reports whether this is a SQLite or PostgreSQL database
+func (s *DB) Dialect() migrations.Dialect {
+	return s.dialect
+}
+
+// Location is the SQLite file path, or the PostgreSQL URL with any password redacted
+func (s *DB) Location() string {
+	return s.location
+}
+
+// ReadOnly reports whether the database was opened read-only
+func (s *DB) ReadOnly() bool {
+	return s.readOnly
+}
+
+// Migrate applies pending schema migrations for the database's dialect
+func (s *DB) Migrate() ([]migrations.Migration, error) {
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	return migrations.Up(s.db, s.dialect)
+}
+
+// Close releases cached statements and the connection pool
+func (s *DB) Close() error {
+	s.stmts.mu.Lock()
+	for _, stmt := range s.stmts.byText {
+		stmt.Close()
+	}
+	s.stmts.byText = map[string]*sql.Stmt{}
+	s.stmts.mu.Unlock()
+
+	return s.db.Close()
+}
+
+// rebind rewrites ? placeholders as $1, $2, ... for PostgreSQL
+func (s *DB) rebind(query string) string {
+	if s.dialect != migrations.Postgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// prepare returns a cached prepared statement, preparing it on first use
+// The hook polls the same queries repeatedly, so each is parsed once per process
+func (s *DB) prepare(query string) (*sql.Stmt, error) {
+	s.stmts.mu.Lock()
+	defer s.stmts.mu.Unlock()
+
+	if stmt, ok := s.stmts.byText[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := s.db.Prepare(s.rebind(query))
+	if err != nil {
+		return nil, err
+	}
+	s.stmts.byText[query] = stmt
+	return stmt, nil
+}
+
+// exec runs a write statement, retrying while the database is locked
+func (s *DB) exec(query string, args ...interface{}) (sql.Result, error) {
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	var result sql.Result
+	err := retryOnBusy(func() error {
+		var err error
+		result, err = s.db.Exec(s.rebind(query), args...)
+		return err
+	})
+	return result, err
+}
+
+// begin starts a write transaction
+func (s *DB) begin() (*sql.Tx, error) {
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	return s.db.Begin()
+}
+
+// queryRow runs a single-row query
+func (s *DB) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRow(s.rebind(query), args...)
+}
+
+// query runs a multi-row query
+func (s *DB) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.Query(s.rebind(query), args...)
+}
+
+// insertReturningID runs an INSERT and returns the new row's id
+// PostgreSQL drivers don't support LastInsertId, so it uses RETURNING there
+func (s *DB) insertReturningID(tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	if s.dialect == migrations.Postgres {
+		var id int64
+		err := tx.QueryRow(s.rebind(query+" RETURNING id"), args...).Scan(&id)
+		return id, err
+	}
+
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// notFound maps sql.ErrNoRows to ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,1201 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/migrations"
+	"github.com/nerv/nerv-hook/pkg/approvals"
+)
+
+// openTestDB opens a migrated SQLite database in a temporary directory
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "state.db"), "rwc", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// openTestPostgres opens the PostgreSQL database at NERV_TEST_POSTGRES_URL in
+// a fresh schema that's dropped afterwards, skipping the test if it's unset
+func openTestPostgres(t *testing.T) (db *DB, dbURL string) {
+	t.Helper()
+	base := os.Getenv("NERV_TEST_POSTGRES_URL")
+	if base == "" {
+		t.Skip("NERV_TEST_POSTGRES_URL is not set")
+	}
+	admin, err := OpenPostgres(base, false, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := fmt.Sprintf("nerv_test_%d", time.Now().UnixNano())
+	if _, err := admin.SQL().Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.SQL().Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	// lib/pq passes unrecognized URL parameters to the server as session settings
+	u, err := url.Parse(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	db, err = OpenPostgres(u.String(), false, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, u.String()
+}
+
+func TestProjects(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.CreateProject(Project{ID: "p1", Name: "Alpha", Goal: "Ship it"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateProject(Project{ID: "p2", Name: "Beta"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateProject(Project{ID: "p1", Name: "Duplicate"}); err == nil {
+		t.Error("creating a duplicate project succeeded")
+	}
+
+	p, err := db.GetProject("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "Alpha" || p.Goal != "Ship it" || p.CreatedAt.IsZero() {
+		t.Errorf("GetProject = %+v", p)
+	}
+
+	projects, err := db.ListProjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(projects) != 2 {
+		t.Fatalf("ListProjects returned %d projects, want 2", len(projects))
+	}
+
+	if err := db.DeleteProject("p2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetProject("p2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetProject after delete: err = %v, want ErrNotFound", err)
+	}
+	if err := db.DeleteProject("p2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteProject of a missing project: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestTasks(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.CreateProject(Project{ID: "p1", Name: "Alpha"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTask(Task{ID: "t1", ProjectID: "p1", Title: "First", Description: "Do the thing"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTask(Task{ID: "t2", ProjectID: "p1", Title: "Second", Status: TaskInProgress}); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := db.GetTask("t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Title != "First" || task.Description != "Do the thing" || task.Status != TaskTodo || task.TaskType != "implementation" {
+		t.Errorf("GetTask = %+v", task)
+	}
+	if _, err := db.GetTask("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetTask of a missing task: err = %v, want ErrNotFound", err)
+	}
+
+	inProgress, err := db.ListTasks(TaskFilter{ProjectID: "p1", Status: TaskInProgress})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inProgress) != 1 || inProgress[0].ID != "t2" {
+		t.Errorf("ListTasks(in_progress) = %+v", inProgress)
+	}
+
+	// Only moves from the expected status
+	if moved, err := db.SetTaskStatus("t1", TaskInProgress, TaskReview, "test"); err != nil || moved {
+		t.Errorf("SetTaskStatus from the wrong status = %v, %v", moved, err)
+	}
+	if moved, err := db.SetTaskStatus("t2", TaskInProgress, TaskReview, "test"); err != nil || !moved {
+		t.Errorf("SetTaskStatus = %v, %v", moved, err)
+	}
+
+	// Becoming done stamps completed_at; leaving done clears it
+	if _, err := db.SetTaskStatus("t2", TaskReview, TaskDone, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if done, err := db.GetTask("t2"); err != nil || done.CompletedAt.IsZero() {
+		t.Errorf("done task CompletedAt = %v, %v", done.CompletedAt, err)
+	}
+	if _, err := db.SetTaskStatus("t2", TaskDone, TaskTodo, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if reopened, err := db.GetTask("t2"); err != nil || !reopened.CompletedAt.IsZero() {
+		t.Errorf("reopened task CompletedAt = %v, %v", reopened.CompletedAt, err)
+	}
+
+	// Deleting the project removes its tasks
+	if err := db.DeleteProject("p1"); err != nil {
+		t.Fatal(err)
+	}
+	tasks, err := db.ListTasks(TaskFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 0 {
+		t.Errorf("ListTasks after deleting the project = %+v", tasks)
+	}
+}
+
+func TestTaskStateMachine(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.CreateProject(Project{ID: "p1", Name: "Alpha"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTask(Task{ID: "t1", ProjectID: "p1", Title: "First"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTask(Task{ID: "t2", ProjectID: "p1", Title: "Bogus", Status: "finished"}); err == nil {
+		t.Error("creating a task with an unknown status succeeded")
+	}
+
+	// Skipping straight to done is rejected and leaves the task alone
+	var transitionErr *TransitionError
+	if _, err := db.SetTaskStatus("t1", TaskTodo, TaskDone, "test"); !errors.As(err, &transitionErr) {
+		t.Errorf("todo → done = %v, want a TransitionError", err)
+	}
+	if task, _ := db.GetTask("t1"); task.Status != TaskTodo {
+		t.Errorf("status after a rejected move = %q", task.Status)
+	}
+
+	for _, step := range [][2]string{
+		{TaskTodo, TaskInProgress},
+		{TaskInProgress, TaskBlocked},
+		{TaskBlocked, TaskInProgress},
+		{TaskInProgress, TaskReview},
+		{TaskReview, TaskDone},
+	} {
+		if moved, err := db.SetTaskStatus("t1", step[0], step[1], "test"); err != nil || !moved {
+			t.Fatalf("%s → %s = %v, %v", step[0], step[1], moved, err)
+		}
+	}
+	if _, err := db.SetTaskStatus("t1", TaskDone, TaskAbandoned, "test"); !errors.As(err, &transitionErr) {
+		t.Errorf("done → abandoned = %v, want a TransitionError", err)
+	}
+
+	history, err := db.TaskHistory("t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 5 || history[0].From != TaskTodo || history[4].To != TaskDone || history[0].Source != "test" {
+		t.Errorf("TaskHistory = %+v", history)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.CreateSession(Session{ID: "s1"}); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := db.GetSession("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.ProjectID != "" || sess.TaskID != "" || sess.StartedAt.IsZero() {
+		t.Errorf("GetSession = %+v", sess)
+	}
+	if _, err := db.GetSession("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetSession of a missing session: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSessionTime(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.CreateProject(Project{ID: "p1", Name: "Alpha"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTask(Task{ID: "t1", ProjectID: "p1", Title: "Timed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2026, 1, 2, 9, 0, 0, 0, time.UTC)
+	sess := Session{ID: "s1", ProjectID: "p1", TaskID: "t1"}
+	for _, ev := range []struct {
+		after   time.Duration
+		stopped bool
+	}{
+		{0, false},
+		{2 * time.Minute, false},  // active
+		{3 * time.Minute, true},   // active, then the agent stops
+		{10 * time.Minute, false}, // waiting on the user
+		{20 * time.Minute, false}, // idle gap
+		{21 * time.Minute, true},  // active
+	} {
+		if err := db.TouchSession(sess, start.Add(ev.after), ev.stopped); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sessions, err := db.ListSessions("t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("ListSessions = %+v, want one session", sessions)
+	}
+	got := sessions[0]
+	if got.Active != 4*time.Minute {
+		t.Errorf("Active = %v, want 4m", got.Active)
+	}
+	if got.WallClock() != 21*time.Minute {
+		t.Errorf("WallClock = %v, want 21m", got.WallClock())
+	}
+	if got.EndedAt.IsZero() {
+		t.Error("EndedAt is zero after a stop")
+	}
+
+	// A stopped session isn't active; its next event makes it active again
+	if active, err := db.ActiveSessions(start); err != nil || len(active) != 0 {
+		t.Errorf("ActiveSessions after a stop = %+v, %v, want none", active, err)
+	}
+	if err := db.TouchSession(sess, start.Add(22*time.Minute), false); err != nil {
+		t.Fatal(err)
+	}
+	if active, err := db.ActiveSessions(start.Add(22 * time.Minute)); err != nil || len(active) != 1 {
+		t.Errorf("ActiveSessions = %+v, %v, want s1", active, err)
+	}
+	if active, _ := db.ActiveSessions(start.Add(23 * time.Minute)); len(active) != 0 {
+		t.Errorf("ActiveSessions since after its last event = %+v, want none", active)
+	}
+}
+
+func TestQueueApproval(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.CreateProject(Project{ID: "p1", Name: "Alpha"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTask(Task{ID: "t1", ProjectID: "p1", Title: "First"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.QueueApproval(Approval{TaskID: "t1", SessionID: "s1", ToolName: "Bash", ToolInput: "rm -rf build"}, func(approvalID int64) string {
+		return `{"session_id":"s1"}`
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := db.GetApproval(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Status != approvals.Pending || a.Decided() || a.ToolInput != "rm -rf build" {
+		t.Errorf("GetApproval = %+v", a)
+	}
+	if n, err := db.PendingApprovalCount(); err != nil || n != 1 {
+		t.Errorf("PendingApprovalCount = %d, %v", n, err)
+	}
+	if session, project, err := db.PendingApprovalsFor("s1", "p1"); err != nil || session != 1 || project != 1 {
+		t.Errorf("PendingApprovalsFor = %d, %d, %v, want 1, 1", session, project, err)
+	}
+	if session, project, err := db.PendingApprovalsFor("s2", "p2"); err != nil || session != 0 || project != 0 {
+		t.Errorf("PendingApprovalsFor another session = %d, %d, %v, want 0, 0", session, project, err)
+	}
+
+	// The approval_requested event is written with the approval
+	events, err := db.SessionEvents("s1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0] != "approval_requested" {
+		t.Errorf("SessionEvents = %v", events)
+	}
+
+	// Decide it the way the dashboard does
+	decidedAt := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	if _, err := db.SQL().Exec("UPDATE approvals SET status = 'approved', decided_at = ? WHERE id = ?", decidedAt, id); err != nil {
+		t.Fatal(err)
+	}
+	a, err = db.GetApproval(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Decided() || a.Status != approvals.Approved {
+		t.Errorf("GetApproval after decision = %+v", a)
+	}
+
+	recent, err := db.ApprovedSince("t1", "Bash", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 1 || recent[0].ID != id {
+		t.Errorf("ApprovedSince = %+v", recent)
+	}
+	later, err := db.ApprovedSince("t1", "Bash", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(later) != 0 {
+		t.Errorf("ApprovedSince a future time = %+v", later)
+	}
+
+	// Only one caller takes an approval
+	if used, err := db.UseApproval(id); err != nil || !used {
+		t.Errorf("UseApproval = %v, %v, want it taken", used, err)
+	}
+	if used, err := db.UseApproval(id); err != nil || used {
+		t.Errorf("UseApproval again = %v, %v, want it already used", used, err)
+	}
+}
+
+func TestDecideApprovalConflict(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.CreateTask(Task{ID: "t1", Title: "First"}); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := db.QueueApproval(Approval{TaskID: "t1", ToolName: "Bash", ToolInput: "rm -rf build"}, func(int64) string { return "{}" })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := db.DecideApproval(id, approvals.Approved, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Decided() || a.Status != approvals.Approved {
+		t.Errorf("DecideApproval = %+v", a)
+	}
+
+	// A second surface deciding the same request loses and sees the first decision
+	_, err = db.DecideApproval(id, approvals.Denied, "too risky")
+	var conflict *approvals.ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("second DecideApproval: err = %v, want ConflictError", err)
+	}
+	if conflict.Current.Status != approvals.Approved || conflict.Current.DenyReason != "" {
+		t.Errorf("ConflictError.Current = %+v", conflict.Current)
+	}
+
+	resolved, err := db.ListAudit(AuditFilter{EventType: "approval_resolved"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflicts, err := db.ListAudit(AuditFilter{EventType: "approval_conflict"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resolved) != 1 || len(conflicts) != 1 {
+		t.Errorf("audit has %d approval_resolved and %d approval_conflict events, want 1 each", len(resolved), len(conflicts))
+	}
+
+	if _, err := db.DecideApproval(id+100, approvals.Approved, ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DecideApproval of a missing approval: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	db := openTestDB(t)
+
+	for _, e := range []struct{ eventType, details string }{
+		{"tool_denied", `{"session_id":"s1"}`},
+		{"tool_allowed", `{"session_id":"s2"}`},
+		{"session_halted", `{"session_id":"s1"}`},
+		{"hook_error", "not json"},
+	} {
+		if err := db.LogAudit("t1", e.eventType, e.details); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events, err := db.SessionEvents("s1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0] != "session_halted" || events[1] != "tool_denied" {
+		t.Errorf("SessionEvents = %v, want newest first", events)
+	}
+
+	if halted, err := db.SessionHalted("s1"); err != nil || !halted {
+		t.Errorf("SessionHalted(s1) = %v, %v", halted, err)
+	}
+	if halted, err := db.SessionHalted("s2"); err != nil || halted {
+		t.Errorf("SessionHalted(s2) = %v, %v", halted, err)
+	}
+
+	listed, err := db.ListAudit(AuditFilter{TaskID: "t1", Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 3 || listed[0].EventType != "hook_error" || listed[0].Timestamp.IsZero() {
+		t.Errorf("ListAudit = %+v", listed)
+	}
+
+	batch := []AuditEvent{{TaskID: "t2", EventType: "tool_allowed"}, {TaskID: "t2", EventType: "session_stopped"}}
+	if err := db.LogAuditBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if listed, err := db.ListAudit(AuditFilter{TaskID: "t2"}); err != nil || len(listed) != 2 || listed[0].EventType != "session_stopped" {
+		t.Errorf("ListAudit after LogAuditBatch = %+v, %v", listed, err)
+	}
+}
+
+func TestQueryPlansUseIndexes(t *testing.T) {
+	db := openTestDB(t)
+
+	queries := map[string]string{
+		"session events":     "SELECT event_type FROM audit_log WHERE " + db.sessionMatch() + " ORDER BY id DESC LIMIT 3",
+		"session halted":     "SELECT 1 FROM audit_log WHERE event_type = 'session_halted' AND " + db.sessionMatch() + " LIMIT 1",
+		"decision poll":      "SELECT " + approvalColumns + " FROM approvals WHERE id = ?",
+		"pre-approvals":      "SELECT " + approvalColumns + " FROM approvals WHERE task_id = ? AND tool_name = ? AND status = 'approved' AND julianday(decided_at) >= julianday(?)",
+		"pending count":      "SELECT COUNT(*) FROM approvals WHERE status = 'pending'",
+		"dashboard pending":  "SELECT * FROM approvals WHERE task_id = ? AND status = 'pending' ORDER BY created_at ASC",
+		"dashboard task log": "SELECT * FROM audit_log WHERE task_id = ? ORDER BY timestamp DESC",
+		"session task":       "SELECT id FROM tasks WHERE session_id = ?",
+		"alerts":             "SELECT " + auditColumns + " FROM audit_log WHERE id > ? AND event_type IN (?, ?) ORDER BY id LIMIT 100",
+	}
+
+	for name, query := range queries {
+		rows, err := db.SQL().Query("EXPLAIN QUERY PLAN "+query, "x", "x", "x")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var plan []string
+		for rows.Next() {
+			var id, parent, notused int
+			var detail string
+			if err := rows.Scan(&id, &parent, &notused, &detail); err != nil {
+				t.Fatal(err)
+			}
+			plan = append(plan, detail)
+		}
+		rows.Close()
+
+		for _, step := range plan {
+			if strings.HasPrefix(step, "SCAN ") {
+				t.Errorf("%s does a full table scan: %v", name, plan)
+			}
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	rw, err := OpenSQLite(path, "rwc", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	if _, err := rw.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.CreateProject(Project{ID: "p1", Name: "Alpha"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.CreateTask(Task{ID: "t1", ProjectID: "p1", Title: "First"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := OpenSQLite(path, "ro", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if !ro.ReadOnly() {
+		t.Fatal("ro database doesn't report ReadOnly")
+	}
+
+	if _, err := ro.GetTask("t1"); err != nil {
+		t.Fatalf("read on ro database: %v", err)
+	}
+
+	writes := map[string]error{
+		"CreateProject": ro.CreateProject(Project{ID: "p2", Name: "Beta"}),
+		"LogAudit":      ro.LogAudit("t1", "tool_call", "{}"),
+	}
+	_, writes["SetTaskStatus"] = ro.SetTaskStatus("t1", TaskTodo, TaskInProgress, "test")
+	_, writes["QueueApproval"] = ro.QueueApproval(Approval{TaskID: "t1", ToolName: "Bash"}, func(int64) string { return "{}" })
+	_, writes["DecideApproval"] = ro.DecideApproval(1, "approved", "")
+	_, writes["Migrate"] = ro.Migrate()
+	for name, err := range writes {
+		if !errors.Is(err, ErrReadOnly) {
+			t.Errorf("%s on ro database = %v, want ErrReadOnly", name, err)
+		}
+	}
+
+	// SQLite enforces it too, for raw access through SQL()
+	if _, err := ro.SQL().Exec("DELETE FROM tasks"); err == nil {
+		t.Error("raw DELETE on ro database succeeded")
+	}
+}
+
+func TestOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	db, err := OpenSQLite(path, "rwc", Options{MaxOpenConns: 3, JournalMode: "truncate", Synchronous: "normal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var mode string
+	if err := db.SQL().QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil || mode != "truncate" {
+		t.Errorf("journal_mode = %q, %v; want truncate", mode, err)
+	}
+
+	// Per-connection settings must hold on every pooled connection, not just the first
+	conns := make([]*sql.Conn, 3)
+	for i := range conns {
+		conn, err := db.SQL().Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+
+		var synchronous, foreignKeys int
+		if err := conn.QueryRowContext(context.Background(), "PRAGMA synchronous").Scan(&synchronous); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.QueryRowContext(context.Background(), "PRAGMA foreign_keys").Scan(&foreignKeys); err != nil {
+			t.Fatal(err)
+		}
+		if synchronous != 1 || foreignKeys != 1 {
+			t.Errorf("connection %d: synchronous = %d, foreign_keys = %d; want 1, 1", i, synchronous, foreignKeys)
+		}
+	}
+
+	for _, opts := range []Options{{JournalMode: "fast"}, {Synchronous: "sometimes"}, {MaxOpenConns: -1}} {
+		if _, err := OpenSQLite(path, "rw", opts); err == nil {
+			t.Errorf("OpenSQLite with %+v succeeded", opts)
+		}
+	}
+}
+
+func TestRepos(t *testing.T) {
+	db := openTestDB(t)
+
+	for _, p := range []Project{{ID: "p1", Name: "Alpha"}, {ID: "p2", Name: "Beta"}} {
+		if err := db.CreateProject(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := filepath.Join(t.TempDir(), "src")
+	for _, r := range []Repo{
+		{ID: "r1", ProjectID: "p1", Name: "app", Path: filepath.Join(root, "app")},
+		{ID: "r2", ProjectID: "p2", Name: "vendor", Path: filepath.Join(root, "app", "vendor")},
+	} {
+		if err := db.CreateRepo(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for dir, want := range map[string]string{
+		filepath.Join(root, "app"):                  "p1",
+		filepath.Join(root, "app", "cmd"):           "p1",
+		filepath.Join(root, "app", "vendor", "lib"): "p2",
+		filepath.Join(root, "application"):          "",
+		root:                                        "",
+	} {
+		got, err := db.ProjectForDir(dir)
+		if want == "" {
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("ProjectForDir(%s) = %q, %v; want ErrNotFound", dir, got, err)
+			}
+		} else if got != want || err != nil {
+			t.Errorf("ProjectForDir(%s) = %q, %v; want %s", dir, got, err, want)
+		}
+	}
+
+	if _, err := db.GetSetting(SettingCurrentProject); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetSetting before it is set = %v", err)
+	}
+	for _, id := range []string{"p1", "p2"} {
+		if err := db.SetSetting(SettingCurrentProject, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := db.GetSetting(SettingCurrentProject); got != "p2" || err != nil {
+		t.Errorf("GetSetting = %q, %v; want p2", got, err)
+	}
+
+	// Repos go with their project
+	if err := db.DeleteProject("p1"); err != nil {
+		t.Fatal(err)
+	}
+	if repos, err := db.ListRepos(""); err != nil || len(repos) != 1 {
+		t.Errorf("ListRepos after deleting p1 = %+v, %v", repos, err)
+	}
+}
+
+func TestTaskWorktrees(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.CreateProject(Project{ID: "p1", Name: "Alpha"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []Repo{{ID: "r1", ProjectID: "p1", Name: "api", Path: "/src/api"}, {ID: "r2", ProjectID: "p1", Name: "web", Path: "/src/web"}} {
+		if err := db.CreateRepo(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.CreateTask(Task{ID: "t1", ProjectID: "p1", Title: "Span"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetTaskRepos("t1", "api,web"); err != nil {
+		t.Fatal(err)
+	}
+	if task, _ := db.GetTask("t1"); task.Repos != "api,web" {
+		t.Errorf("Repos = %q", task.Repos)
+	}
+
+	for _, w := range []TaskWorktree{
+		{TaskID: "t1", RepoID: "r2", Path: "/src/web-worktrees/old"},
+		{TaskID: "t1", RepoID: "r1", Path: "/src/api-worktrees/t1"},
+		{TaskID: "t1", RepoID: "r2", Path: "/src/web-worktrees/t1"},
+	} {
+		if err := db.AddTaskWorktree(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	worktrees, err := db.ListTaskWorktrees("t1")
+	if err != nil || len(worktrees) != 2 || worktrees[1].Path != "/src/web-worktrees/t1" {
+		t.Fatalf("ListTaskWorktrees = %+v, %v; want one per repo, the later replacing the earlier", worktrees, err)
+	}
+
+	if err := db.DeleteTaskWorktree("t1", "r1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteTask("t1"); err != nil {
+		t.Fatal(err)
+	}
+	if worktrees, err := db.ListTaskWorktrees("t1"); err != nil || len(worktrees) != 0 {
+		t.Errorf("ListTaskWorktrees after deleting the task = %+v, %v", worktrees, err)
+	}
+}
+
+func TestTaskRuns(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.CreateProject(Project{ID: "p1", Name: "Alpha"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTask(Task{ID: "t1", ProjectID: "p1", Title: "Run"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := db.CreateRun("t1", "headless", "/tmp/run-t1.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := db.CreateRun("t1", "interactive", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetRunPID(first, 4242); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetRunPID(999, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetRunPID on a missing run = %v, want ErrNotFound", err)
+	}
+
+	// Only the first session a run reports is kept
+	for _, session := range []string{"s1", "s2"} {
+		if err := db.LinkRunSession(first, session); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.FinishRun(second, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	active, err := db.ActiveRuns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 1 || active[0].ID != first {
+		t.Fatalf("ActiveRuns = %+v, want only run %d", active, first)
+	}
+	if r := active[0]; r.PID != 4242 || r.SessionID != "s1" || r.LogPath != "/tmp/run-t1.log" || r.Mode != "headless" || !r.EndedAt.IsZero() {
+		t.Errorf("active run = %+v", r)
+	}
+
+	if err := db.FinishRun(first, 3); err != nil {
+		t.Fatal(err)
+	}
+	r, err := db.GetRun(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ExitCode != 3 || r.EndedAt.IsZero() {
+		t.Errorf("finished run = %+v, want exit code 3 and an end time", r)
+	}
+	if r, err := db.GetRun(second); err != nil || r.ExitCode != -1 {
+		t.Errorf("run found dead = %+v, %v; want exit code -1", r, err)
+	}
+}
+
+func TestTaskQueue(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.CreateProject(Project{ID: "p1", Name: "Alpha"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"t1", "t2", "t3"} {
+		if err := db.CreateTask(Task{ID: id, ProjectID: "p1", Title: id}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.EnqueueTask(id, 0, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Queueing again reprioritizes rather than duplicating
+	if err := db.EnqueueTask("t3", 5, "Fix it"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DequeueTask("t2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DequeueTask("t2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DequeueTask twice = %v, want ErrNotFound", err)
+	}
+
+	queue, err := db.QueuedTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 2 || queue[0].TaskID != "t3" || queue[1].TaskID != "t1" {
+		t.Fatalf("QueuedTasks = %+v, want t3 then t1", queue)
+	}
+	if q := queue[0]; q.Priority != 5 || q.Prompt != "Fix it" || q.ProjectID != "p1" {
+		t.Errorf("queued t3 = %+v", q)
+	}
+}
+
+func TestReviews(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.CreateProject(Project{ID: "p1", Name: "Alpha"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTask(Task{ID: "t1", ProjectID: "p1", Title: "t1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	review, err := db.RequestReview("t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A pending review is reused, not duplicated
+	if again, err := db.RequestReview("t1"); err != nil || again.ID != review.ID {
+		t.Errorf("RequestReview again = %+v, %v, want review %s", again, err, review.ID)
+	}
+
+	if _, err := db.SaveReviewBundle(ReviewBundle{TaskID: "t1", ReviewID: review.ID, Head: "abc", Bundle: `{"n":1}`}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SaveReviewBundle(ReviewBundle{TaskID: "t1", ReviewID: review.ID, Bundle: `{"n":2}`}); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := db.LatestReviewBundle("t1"); err != nil || b.Bundle != `{"n":2}` || b.ReviewID != review.ID {
+		t.Errorf("LatestReviewBundle = %+v, %v", b, err)
+	}
+
+	if err := db.DecideReview(review.ID, ReviewRejected, "needs tests"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DecideReview(review.ID, ReviewApproved, ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DecideReview after a decision = %v, want ErrNotFound", err)
+	}
+	latest, err := db.LatestReview("t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Status != ReviewRejected || latest.Notes != "needs tests" || latest.DecidedAt.IsZero() {
+		t.Errorf("LatestReview = %+v", latest)
+	}
+
+	if next, err := db.RequestReview("t1"); err != nil || next.ID == review.ID {
+		t.Errorf("RequestReview after a decision = %+v, %v, want a new review", next, err)
+	}
+}
+
+func TestTaskNotes(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.CreateProject(Project{ID: "p1", Name: "Alpha"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTask(Task{ID: "t1", ProjectID: "p1", Title: "t1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := db.AddTaskNote("t1", "don't touch the migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := db.AddTaskNote("t1", "use the v2 API")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notes, err := db.ListTaskNotes("t1", 0); err != nil || len(notes) != 2 || notes[0].ID != first.ID {
+		t.Errorf("ListTaskNotes = %+v, %v", notes, err)
+	}
+	if notes, err := db.ListTaskNotes("t1", first.ID); err != nil || len(notes) != 1 || notes[0].Body != "use the v2 API" {
+		t.Errorf("ListTaskNotes after %d = %+v, %v", first.ID, notes, err)
+	}
+
+	if err := db.DeleteTaskNote("t1", first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteTaskNote("t1", first.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteTaskNote twice = %v, want ErrNotFound", err)
+	}
+	if notes, _ := db.ListTaskNotes("t1", 0); len(notes) != 1 || notes[0].ID != second.ID {
+		t.Errorf("notes after delete = %+v", notes)
+	}
+}
+
+func TestTaskLabelsAndFilters(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.CreateProject(Project{ID: "p1", Name: "Alpha"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTask(Task{ID: "t1", ProjectID: "p1", Title: "t1", Priority: PriorityHigh, Labels: []string{"infra", "ci"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTask(Task{ID: "t2", ProjectID: "p1", Title: "t2", Labels: []string{"infra"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTask(Task{ID: "t3", ProjectID: "p1", Title: "t3", Priority: "someday"}); err == nil {
+		t.Error("CreateTask accepted an unknown priority")
+	}
+
+	if task, err := db.GetTask("t1"); err != nil || task.Priority != PriorityHigh || !slices.Equal(task.Labels, []string{"ci", "infra"}) {
+		t.Errorf("GetTask = %+v, %v", task, err)
+	}
+	ids := func(f TaskFilter) []string {
+		t.Helper()
+		tasks, err := db.ListTasks(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, task := range tasks {
+			ids = append(ids, task.ID)
+		}
+		return ids
+	}
+	if got := ids(TaskFilter{Labels: []string{"infra"}}); !slices.Equal(got, []string{"t1", "t2"}) {
+		t.Errorf("label infra = %v", got)
+	}
+	if got := ids(TaskFilter{Labels: []string{"infra", "ci"}}); !slices.Equal(got, []string{"t1"}) {
+		t.Errorf("labels infra,ci = %v", got)
+	}
+	if got := ids(TaskFilter{Priority: PriorityHigh}); !slices.Equal(got, []string{"t1"}) {
+		t.Errorf("priority high = %v", got)
+	}
+
+	if err := db.SetTaskLabels("t2", []string{"docs"}, []string{"infra"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetTaskPriority("t1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(TaskFilter{Labels: []string{"infra"}, Priority: PriorityHigh}); len(got) != 0 {
+		t.Errorf("after changes = %v", got)
+	}
+	if err := db.SetTaskLabels("missing", []string{"x"}, nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetTaskLabels on a missing task = %v, want ErrNotFound", err)
+	}
+
+	if err := db.SaveTaskFilter("docs", TaskFilter{ProjectID: "p1", Labels: []string{"docs"}}); err != nil {
+		t.Fatal(err)
+	}
+	sf, err := db.GetTaskFilter("docs")
+	if err != nil || sf.Filter.ProjectID != "p1" || !slices.Equal(sf.Filter.Labels, []string{"docs"}) {
+		t.Errorf("GetTaskFilter = %+v, %v", sf, err)
+	}
+	if got := ids(sf.Filter); !slices.Equal(got, []string{"t2"}) {
+		t.Errorf("saved filter = %v", got)
+	}
+	if err := db.DeleteTaskFilter("docs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetTaskFilter("docs"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetTaskFilter after delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSubtasks(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.CreateProject(Project{ID: "p1", Name: "Alpha"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range []Task{
+		{ID: "t1", ProjectID: "p1", Title: "Plan"},
+		{ID: "t2", ProjectID: "p1", ParentID: "t1", Title: "Step one"},
+		{ID: "t3", ProjectID: "p1", ParentID: "t2", Title: "Step one, part a"},
+		{ID: "t4", ProjectID: "p1", Title: "Unrelated"},
+	} {
+		if err := db.CreateTask(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if child, _ := db.GetTask("t2"); child.ParentID != "t1" {
+		t.Errorf("ParentID = %q", child.ParentID)
+	}
+	children, err := db.ListTasks(TaskFilter{ParentID: "t1"})
+	if err != nil || len(children) != 1 || children[0].ID != "t2" {
+		t.Errorf("ListTasks of t1's subtasks = %+v, %v", children, err)
+	}
+
+	// A task's usage includes its subtasks' sessions, at any depth
+	for _, sess := range []Session{{ID: "s1", ProjectID: "p1", TaskID: "t1"}, {ID: "s3", ProjectID: "p1", TaskID: "t3"}, {ID: "s4", ProjectID: "p1", TaskID: "t4"}} {
+		if err := db.TouchSession(sess, time.Now(), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if usage, err := db.BudgetUsage(BudgetTask, "t1"); err != nil || usage.Sessions != 2 {
+		t.Errorf("BudgetUsage(t1) = %+v, %v; want its own session and t3's", usage, err)
+	}
+	if usage, err := db.BudgetUsage(BudgetTask, "t2"); err != nil || usage.Sessions != 1 {
+		t.Errorf("BudgetUsage(t2) = %+v, %v; want t3's session", usage, err)
+	}
+
+	// Deleting a task deletes its subtasks
+	if err := db.DeleteTask("t1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetTask("t3"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetTask of a deleted task's subtask: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestCompressedPayloads(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.CreateProject(Project{ID: "p1", Name: "Alpha"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTask(Task{ID: "t1", ProjectID: "p1", Title: "t1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	content := strings.Repeat("package main\n\nfunc main() {}\n", 1000)
+	toolInput := fmt.Sprintf(`{"file_path":"main.go","content":%q}`, content)
+	id, err := db.QueueApproval(Approval{TaskID: "t1", ToolName: "Write", ToolInput: toolInput, Context: "small"}, func(int64) string { return "{}" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored, storedContext string
+	if err := db.SQL().QueryRow("SELECT tool_input, context FROM approvals WHERE id = ?", id).Scan(&stored, &storedContext); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, compressedPrefix) || len(stored) >= len(toolInput)/10 {
+		t.Errorf("stored tool_input is %d bytes of %d, want it compressed", len(stored), len(toolInput))
+	}
+	if storedContext != "small" {
+		t.Errorf("stored context = %q, want it left alone", storedContext)
+	}
+	if a, err := db.GetApproval(id); err != nil || a.ToolInput != toolInput {
+		t.Errorf("GetApproval tool input is %d bytes, %v; want the original %d", len(a.ToolInput), err, len(toolInput))
+	}
+
+	bundle := fmt.Sprintf(`{"diff":%q}`, strings.Repeat("+ a line\n", 2000))
+	if _, err := db.SaveReviewBundle(ReviewBundle{TaskID: "t1", Bundle: bundle}); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := db.LatestReviewBundle("t1"); err != nil || b.Bundle != bundle {
+		t.Errorf("LatestReviewBundle = %d bytes, %v; want the original %d", len(b.Bundle), err, len(bundle))
+	}
+
+	// A value written by the dashboard that only looks compressed reads back as written
+	if got := decompressText("zstd:not base64!"); got != "zstd:not base64!" {
+		t.Errorf("decompressText = %q", got)
+	}
+}
+
+func TestLogins(t *testing.T) {
+	db := openTestDB(t)
+	now := time.Now()
+
+	for _, l := range []Login{
+		{ID: "a", Operator: "alice", Issuer: "https://idp.test", Subject: "u1", ExpiresAt: now.Add(time.Hour)},
+		{ID: "b", Operator: "alice", ExpiresAt: now.Add(-time.Minute)},
+		{ID: "c", Operator: "bob", ExpiresAt: now.Add(time.Hour)},
+	} {
+		if err := db.CreateLogin(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := db.GetLogin("a")
+	if err != nil || l.Subject != "u1" || l.Expired(now) || !l.LastSeenAt.IsZero() {
+		t.Fatalf("GetLogin = %+v, %v", l, err)
+	}
+	if l, _ := db.GetLogin("b"); !l.Expired(now) {
+		t.Error("login b isn't expired")
+	}
+	if err := db.TouchLogin("a", now); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := db.GetLogin("a"); l.LastSeenAt.IsZero() {
+		t.Error("TouchLogin didn't record last_seen_at")
+	}
+
+	if logins, err := db.ListLogins(now); err != nil || len(logins) != 2 {
+		t.Errorf("ListLogins = %+v, %v; want the 2 unexpired", logins, err)
+	}
+	if n, err := db.DeleteExpiredLogins(now); err != nil || n != 1 {
+		t.Errorf("DeleteExpiredLogins = %d, %v; want 1", n, err)
+	}
+	if n, err := db.DeleteOperatorLogins("alice"); err != nil || n != 1 {
+		t.Errorf("DeleteOperatorLogins = %d, %v; want 1", n, err)
+	}
+	if err := db.DeleteLogin("c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetLogin("c"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetLogin after delete: err = %v, want ErrNotFound", err)
+	}
+	if err := db.DeleteLogin("c"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleting a missing login: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	db := openTestDB(t)
+	now := time.Now()
+
+	if err := db.CreateToken(Token{ID: "t1", Hash: "h1", Name: "deploy-bot", Operator: "bob", Scopes: []string{"approvals:write", "audit:read"}, CreatedBy: "alice", ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateToken(Token{ID: "t2", Hash: "h2", Operator: "carol", Scopes: []string{"audit:read"}, ExpiresAt: now.Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateToken(Token{ID: "t3", Hash: "h1", Operator: "carol", Scopes: []string{"audit:read"}, ExpiresAt: now.Add(time.Hour)}); err == nil {
+		t.Error("two tokens were stored with the same hash")
+	}
+
+	tok, err := db.TokenByHash("h1")
+	if err != nil || tok.ID != "t1" || !slices.Equal(tok.Scopes, []string{"approvals:write", "audit:read"}) || tok.CreatedBy != "alice" || !tok.Usable(now) {
+		t.Fatalf("TokenByHash = %+v, %v", tok, err)
+	}
+	if tok, _ := db.GetToken("t2"); tok.Usable(now) {
+		t.Error("an expired token is usable")
+	}
+	if err := db.TouchToken("t1", now); err != nil {
+		t.Fatal(err)
+	}
+	if tok, _ := db.GetToken("t1"); tok.LastUsedAt.IsZero() {
+		t.Error("TouchToken didn't record last_used_at")
+	}
+
+	if tokens, err := db.ListTokens("carol"); err != nil || len(tokens) != 1 || tokens[0].ID != "t2" {
+		t.Errorf("ListTokens(carol) = %+v, %v", tokens, err)
+	}
+	if tokens, err := db.ListTokens(""); err != nil || len(tokens) != 2 {
+		t.Errorf("ListTokens = %+v, %v; want both", tokens, err)
+	}
+	if err := db.RevokeToken("t1", now); err != nil {
+		t.Fatal(err)
+	}
+	if tok, _ := db.GetToken("t1"); tok.Usable(now) {
+		t.Error("a revoked token is usable")
+	}
+	if err := db.RevokeToken("t1", now); !errors.Is(err, ErrNotFound) {
+		t.Errorf("revoking twice: err = %v, want ErrNotFound", err)
+	}
+	if _, err := db.TokenByHash("nope"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("TokenByHash(nope): err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestPostgres(t *testing.T) {
+	if _, err := OpenPostgres("mysql://localhost/nerv", false, Options{}); err == nil || !strings.Contains(err.Error(), "unsupported database URL scheme") {
+		t.Errorf("mysql URL: err = %v", err)
+	}
+	db, dbURL := openTestPostgres(t)
+	if db.Dialect() != migrations.Postgres {
+		t.Fatalf("dialect = %v", db.Dialect())
+	}
+	if u, _ := url.Parse(dbURL); u.User != nil {
+		if password, ok := u.User.Password(); ok && strings.Contains(db.Location(), password) {
+			t.Errorf("location = %q, want the password redacted", db.Location())
+		}
+	}
+
+	applied, err := db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) == 0 || applied[len(applied)-1].Version != migrations.Latest(migrations.Postgres) {
+		t.Fatalf("applied %d migrations, want up to %d", len(applied), migrations.Latest(migrations.Postgres))
+	}
+	if again, err := db.Migrate(); err != nil || len(again) != 0 {
+		t.Errorf("second Migrate = %d migrations, %v, want none", len(again), err)
+	}
+
+	if err := db.CreateProject(Project{ID: "p1", Name: "Alpha"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTask(Task{ID: "t1", ProjectID: "p1", Title: "First"}); err != nil {
+		t.Fatal(err)
+	}
+	if moved, err := db.SetTaskStatus("t1", TaskTodo, TaskInProgress, "test"); err != nil || !moved {
+		t.Errorf("SetTaskStatus = %v, %v", moved, err)
+	}
+	if task, err := db.GetTask("t1"); err != nil || task.Status != TaskInProgress {
+		t.Errorf("GetTask = %+v, %v", task, err)
+	}
+	if err := db.LogAudit("t1", "tool_denied", `{"tool":"Bash"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read-only handles are refused writes by the server as well as the store
+	ro, err := OpenPostgres(dbURL, true, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if _, err := ro.Migrate(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("read-only Migrate: err = %v, want ErrReadOnly", err)
+	}
+	if _, err := ro.SQL().Exec("DELETE FROM tasks"); err == nil {
+		t.Error("the server accepted a write on a read-only handle")
+	}
+	if task, err := ro.GetTask("t1"); err != nil || task.Title != "First" {
+		t.Errorf("read-only GetTask = %+v, %v", task, err)
+	}
+}
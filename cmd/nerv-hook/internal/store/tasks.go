@@ -0,0 +1,233 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const taskColumns = "id, project_id, cycle_id, title, description, task_type, status, repos, worktree_path, session_id, created_at, completed_at, branch, branch_head, priority, parent_id"
+
+func scanTask(row interface{ Scan(...interface{}) error }) (Task, error) {
+	var t Task
+	err := row.Scan(&t.ID, textColumn{&t.ProjectID}, textColumn{&t.CycleID}, &t.Title,
+		textColumn{&t.Description}, textColumn{&t.TaskType}, textColumn{&t.Status},
+		textColumn{&t.Repos}, textColumn{&t.WorktreePath}, textColumn{&t.SessionID},
+		timeColumn{&t.CreatedAt}, timeColumn{&t.CompletedAt}, textColumn{&t.Branch}, textColumn{&t.BranchHead}, textColumn{&t.Priority}, textColumn{&t.ParentID})
+	return t, err
+}
+
+// TaskFilter narrows ListTasks; empty fields match everything
+type TaskFilter struct {
+	ProjectID string `json:"project,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Priority  string `json:"priority,omitempty"`
+	// Labels match tasks that have every one of them
+	Labels []string `json:"labels,omitempty"`
+	// ParentID matches the subtasks of one task
+	ParentID string `json:"parent,omitempty"`
+}
+
+// NewID generates an ID in the dashboard's format: Unix milliseconds and a random base-36 suffix
+func NewID() string {
+	const digits = "0123456789abcdefghijklmnopqrstuvwxyz"
+	suffix := make([]byte, 7)
+	for i := range suffix {
+		suffix[i] = digits[rand.Intn(len(digits))]
+	}
+	return fmt.Sprintf("%d-%s", time.Now().UnixMilli(), suffix)
+}
+
+// CreateTask inserts a task, defaulting its type to implementation and status to todo
+func (s *DB) CreateTask(t Task) error {
+	if t.TaskType == "" {
+		t.TaskType = "implementation"
+	}
+	if t.Status == "" {
+		t.Status = TaskTodo
+	}
+	if !IsTaskStatus(t.Status) {
+		return fmt.Errorf("unknown task status %q", t.Status)
+	}
+	if t.Priority != "" && !IsTaskPriority(t.Priority) {
+		return fmt.Errorf("unknown task priority %q", t.Priority)
+	}
+	return retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		_, err = tx.Exec(s.rebind(
+			`INSERT INTO tasks (id, project_id, cycle_id, title, description, task_type, status, repos, worktree_path, session_id, priority, parent_id)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			t.ID, nullable(t.ProjectID), nullable(t.CycleID), t.Title, nullable(t.Description),
+			t.TaskType, t.Status, nullable(t.Repos), nullable(t.WorktreePath), nullable(t.SessionID), nullable(t.Priority), nullable(t.ParentID),
+		)
+		if err != nil {
+			return err
+		}
+		for _, label := range t.Labels {
+			if _, err := tx.Exec(s.rebind("INSERT INTO task_labels (task_id, label) VALUES (?, ?) ON CONFLICT DO NOTHING"), t.ID, label); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// GetTask loads a task by ID, returning ErrNotFound if it doesn't exist
+func (s *DB) GetTask(id string) (Task, error) {
+	stmt, err := s.prepare("SELECT " + taskColumns + " FROM tasks WHERE id = ?")
+	if err != nil {
+		return Task{}, err
+	}
+	t, err := scanTask(stmt.QueryRow(id))
+	if err != nil {
+		return t, notFound(err)
+	}
+	tasks := []Task{t}
+	err = s.loadLabels(tasks, "task_id = ?", id)
+	return tasks[0], err
+}
+
+// ListTasks returns the tasks matching f, oldest first
+func (s *DB) ListTasks(f TaskFilter) ([]Task, error) {
+	var where []string
+	var args []interface{}
+	if f.ProjectID != "" {
+		where = append(where, "project_id = ?")
+		args = append(args, f.ProjectID)
+	}
+	if f.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, f.Status)
+	}
+	if f.Priority != "" {
+		where = append(where, "priority = ?")
+		args = append(args, f.Priority)
+	}
+	if f.ParentID != "" {
+		where = append(where, "parent_id = ?")
+		args = append(args, f.ParentID)
+	}
+	for _, label := range f.Labels {
+		where = append(where, "id IN (SELECT task_id FROM task_labels WHERE label = ?)")
+		args = append(args, label)
+	}
+
+	cond := "1 = 1"
+	if len(where) > 0 {
+		cond = strings.Join(where, " AND ")
+	}
+	rows, err := s.query("SELECT "+taskColumns+" FROM tasks WHERE "+cond+" ORDER BY created_at, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []Task
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if len(tasks) == 0 {
+		return tasks, nil
+	}
+	return tasks, s.loadLabels(tasks, "task_id IN (SELECT id FROM tasks WHERE "+cond+")", args...)
+}
+
+// SetTaskWorktree records the git worktree a task runs in; an empty path clears it
+func (s *DB) SetTaskWorktree(id, path string) error {
+	result, err := s.exec("UPDATE tasks SET worktree_path = ? WHERE id = ?", nullable(path), id)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+// SetTaskBranch records the git branch a task works on
+func (s *DB) SetTaskBranch(id, branch string) error {
+	result, err := s.exec("UPDATE tasks SET branch = ? WHERE id = ?", nullable(branch), id)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+// SetTaskBranchHead records the commit the task's branch pointed at when a session stopped
+func (s *DB) SetTaskBranchHead(id, sha string) error {
+	result, err := s.exec("UPDATE tasks SET branch_head = ? WHERE id = ?", nullable(sha), id)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+// SetTaskRepos records the repos a task spans, as a comma-separated list of repo names
+func (s *DB) SetTaskRepos(id, repos string) error {
+	result, err := s.exec("UPDATE tasks SET repos = ? WHERE id = ?", nullable(repos), id)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+// DeleteTask removes a task and its approvals
+func (s *DB) DeleteTask(id string) error {
+	result, err := s.exec("DELETE FROM tasks WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+// ArchiveTask removes a task and its audit trail from the database once it has
+// been written to an archive, leaving one task_archived entry with auditDetails
+// Sessions stay, no longer linked to a task, so project usage still counts them
+func (s *DB) ArchiveTask(id, auditDetails string) error {
+	return retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(s.rebind("DELETE FROM audit_log WHERE task_id = ?"), id); err != nil {
+			return err
+		}
+		result, err := tx.Exec(s.rebind("DELETE FROM tasks WHERE id = ?"), id)
+		if err != nil {
+			return err
+		}
+		if err := requireRow(result); err != nil {
+			return err
+		}
+		if err := s.insertAudit(tx, id, "task_archived", auditDetails); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// requireRow turns a statement that touched no rows into ErrNotFound
+func requireRow(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"strings"
+	"time"
+)
+
+// Token is a tokens row: a credential for nerv-hook serve that acts as an operator within its scopes
+type Token struct {
+	// ID is the token's public part, used to list and revoke it
+	ID string
+	// Hash is the SHA-256 of the whole token, in hex
+	Hash     string
+	Name     string
+	Operator string
+	Scopes   []string
+	// CreatedBy is the operator who issued it, who may be an admin issuing it for someone else
+	CreatedBy  string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+	RevokedAt  time.Time
+}
+
+// Usable reports whether the token is neither revoked nor expired at now
+func (t Token) Usable(now time.Time) bool {
+	return t.RevokedAt.IsZero() && now.Before(t.ExpiresAt)
+}
+
+const tokenColumns = "id, hash, name, operator, scopes, created_by, created_at, expires_at, last_used_at, revoked_at"
+
+func scanToken(row interface{ Scan(...interface{}) error }) (Token, error) {
+	var t Token
+	var scopes string
+	err := row.Scan(&t.ID, &t.Hash, textColumn{&t.Name}, &t.Operator, &scopes, textColumn{&t.CreatedBy},
+		timeColumn{&t.CreatedAt}, timeColumn{&t.ExpiresAt}, timeColumn{&t.LastUsedAt}, timeColumn{&t.RevokedAt})
+	t.Scopes = strings.Fields(scopes)
+	return t, err
+}
+
+// CreateToken records a token; the token itself is never stored, only its hash
+func (s *DB) CreateToken(t Token) error {
+	_, err := s.exec("INSERT INTO tokens (id, hash, name, operator, scopes, created_by, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		t.ID, t.Hash, nullable(t.Name), t.Operator, strings.Join(t.Scopes, " "), nullable(t.CreatedBy), t.ExpiresAt.UTC().Format("2006-01-02T15:04:05.000Z"))
+	return err
+}
+
+// GetToken loads a token by its ID, returning ErrNotFound if there's none
+func (s *DB) GetToken(id string) (Token, error) {
+	t, err := scanToken(s.queryRow("SELECT "+tokenColumns+" FROM tokens WHERE id = ?", id))
+	return t, notFound(err)
+}
+
+// TokenByHash loads the token with the given hash, usable or not, returning ErrNotFound if there's none
+func (s *DB) TokenByHash(hash string) (Token, error) {
+	t, err := scanToken(s.queryRow("SELECT "+tokenColumns+" FROM tokens WHERE hash = ?", hash))
+	return t, notFound(err)
+}
+
+// TouchToken records that a token was used at the given time
+func (s *DB) TouchToken(id string, at time.Time) error {
+	_, err := s.exec("UPDATE tokens SET last_used_at = ? WHERE id = ?", at.UTC().Format("2006-01-02T15:04:05.000Z"), id)
+	return err
+}
+
+// ListTokens returns every token, revoked and expired ones included, newest first
+// An empty operator lists everyone's
+func (s *DB) ListTokens(operator string) ([]Token, error) {
+	query, args := "SELECT "+tokenColumns+" FROM tokens", []interface{}{}
+	if operator != "" {
+		query += " WHERE operator = ?"
+		args = append(args, operator)
+	}
+	rows, err := s.query(query+" ORDER BY created_at DESC, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []Token
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeToken revokes a token at the given time, returning ErrNotFound if there's
+// no such token or it was already revoked
+func (s *DB) RevokeToken(id string, at time.Time) error {
+	result, err := s.exec("UPDATE tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", at.UTC().Format("2006-01-02T15:04:05.000Z"), id)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
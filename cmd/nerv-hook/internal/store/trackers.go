@@ -0,0 +1,95 @@
+package store
+
+import "time"
+
+const trackerLinkColumns = "l.task_id, t.project_id, t.status, l.tracker, l.external_id, l.ticket_key, l.url, l.synced_status, l.tracker_state, l.synced_at"
+
+func scanTrackerLink(row interface{ Scan(...interface{}) error }) (TrackerLink, error) {
+	var l TrackerLink
+	err := row.Scan(&l.TaskID, textColumn{&l.ProjectID}, &l.Status, &l.Tracker, &l.ExternalID, textColumn{&l.Key},
+		textColumn{&l.URL}, textColumn{&l.SyncedStatus}, textColumn{&l.TrackerState}, timeColumn{&l.SyncedAt})
+	return l, err
+}
+
+// ImportTicketTask creates a task for a tracker ticket and links the two atomically, with a
+// task_created audit event; the link starts synced at the task's status and the ticket's state
+func (s *DB) ImportTicketTask(t Task, link TrackerLink, auditDetails string) error {
+	if t.TaskType == "" {
+		t.TaskType = "implementation"
+	}
+	if t.Status == "" {
+		t.Status = TaskTodo
+	}
+
+	return retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(
+			s.rebind(`INSERT INTO tasks (id, project_id, title, description, task_type, status) VALUES (?, ?, ?, ?, ?, ?)`),
+			t.ID, nullable(t.ProjectID), t.Title, nullable(t.Description), t.TaskType, t.Status,
+		); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(
+			s.rebind(`INSERT INTO tracker_links (task_id, tracker, external_id, ticket_key, url, synced_status, tracker_state, synced_at)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+			t.ID, link.Tracker, link.ExternalID, nullable(link.Key), nullable(link.URL), t.Status,
+			nullable(link.TrackerState), time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		); err != nil {
+			return err
+		}
+		if err := s.insertAudit(tx, t.ID, "task_created", auditDetails); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// TrackerLinkForTicket returns the link for a ticket, returning ErrNotFound if no task was imported from it
+func (s *DB) TrackerLinkForTicket(tracker, externalID string) (TrackerLink, error) {
+	l, err := scanTrackerLink(s.queryRow(
+		"SELECT "+trackerLinkColumns+" FROM tracker_links l JOIN tasks t ON t.id = l.task_id WHERE l.tracker = ? AND l.external_id = ?",
+		tracker, externalID,
+	))
+	return l, notFound(err)
+}
+
+// ListTrackerLinks returns the tracker links of a project's tasks, or of every project if projectID is empty
+func (s *DB) ListTrackerLinks(projectID string) ([]TrackerLink, error) {
+	query := "SELECT " + trackerLinkColumns + " FROM tracker_links l JOIN tasks t ON t.id = l.task_id"
+	var args []interface{}
+	if projectID != "" {
+		query += " WHERE t.project_id = ?"
+		args = append(args, projectID)
+	}
+
+	rows, err := s.query(query+" ORDER BY l.tracker, l.ticket_key, l.task_id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []TrackerLink
+	for rows.Next() {
+		l, err := scanTrackerLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+// MarkTrackerSynced records the task status last written to a ticket and the ticket state last seen
+func (s *DB) MarkTrackerSynced(taskID, status, trackerState string) error {
+	result, err := s.exec("UPDATE tracker_links SET synced_status = ?, tracker_state = ?, synced_at = ? WHERE task_id = ?",
+		status, nullable(trackerState), time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), taskID)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
@@ -0,0 +1,122 @@
+package store
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// taskTransitions lists the statuses each task status may move to
+// The main path is todo → in_progress → review → done; the rest let work
+// pause, resume, be sent back, or be dropped
+var taskTransitions = map[string][]string{
+	TaskTodo:        {TaskInProgress, TaskBlocked, TaskAbandoned},
+	TaskInProgress:  {TaskReview, TaskInterrupted, TaskBlocked, TaskAbandoned},
+	TaskInterrupted: {TaskInProgress, TaskAbandoned},
+	TaskBlocked:     {TaskTodo, TaskInProgress, TaskAbandoned},
+	TaskReview:      {TaskDone, TaskInProgress, TaskTodo, TaskAbandoned},
+	TaskDone:        {TaskTodo},
+	TaskAbandoned:   {TaskTodo},
+}
+
+// TransitionError is returned when a status change isn't allowed by the state machine
+type TransitionError struct {
+	From, To string
+}
+
+func (e *TransitionError) Error() string {
+	if _, ok := taskTransitions[e.From]; !ok {
+		return fmt.Sprintf("unknown task status %q", e.From)
+	}
+	if _, ok := taskTransitions[e.To]; !ok {
+		return fmt.Sprintf("unknown task status %q", e.To)
+	}
+	return fmt.Sprintf("can't move a task from %s to %s (from %s it can go to %s)", e.From, e.To, e.From, strings.Join(taskTransitions[e.From], ", "))
+}
+
+// IsTaskStatus reports whether status is one the state machine knows
+func IsTaskStatus(status string) bool {
+	_, ok := taskTransitions[status]
+	return ok
+}
+
+// CanTransition reports whether a task may move from one status to another
+func CanTransition(from, to string) bool {
+	return slices.Contains(taskTransitions[from], to)
+}
+
+// NextStatuses returns the statuses a task in from may move to
+func NextStatuses(from string) []string {
+	return slices.Clone(taskTransitions[from])
+}
+
+// SetTaskStatus moves a task from one status to another and records the change in task_transitions
+// Returns a *TransitionError if the state machine doesn't allow the move, and
+// reports false without error if the task wasn't in the from status
+// completed_at is stamped when the task becomes done and cleared otherwise
+func (s *DB) SetTaskStatus(id, from, to, source string) (bool, error) {
+	if !CanTransition(from, to) {
+		return false, &TransitionError{From: from, To: to}
+	}
+
+	var completedAt interface{}
+	if to == TaskDone {
+		completedAt = time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	}
+
+	var moved bool
+	err := retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Exec(s.rebind("UPDATE tasks SET status = ?, completed_at = ? WHERE id = ? AND status = ?"), to, completedAt, id, from)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if moved = n > 0; !moved {
+			return nil
+		}
+
+		if _, err := tx.Exec(s.rebind("INSERT INTO task_transitions (task_id, from_status, to_status, source, operator) VALUES (?, ?, ?, ?, ?)"),
+			id, from, to, nullable(source), nullable(s.operator)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	return moved, err
+}
+
+const transitionColumns = "id, task_id, from_status, to_status, source, operator, created_at"
+
+func scanTransition(row interface{ Scan(...interface{}) error }) (TaskTransition, error) {
+	var tr TaskTransition
+	err := row.Scan(&tr.ID, &tr.TaskID, &tr.From, &tr.To, textColumn{&tr.Source}, textColumn{&tr.Operator}, timeColumn{&tr.CreatedAt})
+	return tr, err
+}
+
+// TaskHistory returns a task's recorded status changes, oldest first
+func (s *DB) TaskHistory(id string) ([]TaskTransition, error) {
+	rows, err := s.query("SELECT "+transitionColumns+" FROM task_transitions WHERE task_id = ? ORDER BY id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []TaskTransition
+	for rows.Next() {
+		tr, err := scanTransition(rows)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, tr)
+	}
+	return history, rows.Err()
+}
@@ -0,0 +1,136 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// Kinds of usage counted in usage_stats
+const (
+	// UsageTool counts the calls that ran, by tool
+	UsageTool = "tool"
+	// UsageCommand counts the Bash commands that ran, by program
+	UsageCommand = "command"
+	// UsageFunnel counts calls at each step from being asked about to being decided
+	UsageFunnel = "funnel"
+	// UsageDenial counts denials, by reason
+	UsageDenial = "denial"
+)
+
+// UsageCount is how many times something was counted on a day in a project
+type UsageCount struct {
+	// Day is YYYY-MM-DD in UTC
+	Day       string
+	ProjectID string
+	Kind      string
+	Key       string
+	Count     int64
+}
+
+// UsageFilter narrows Usage; empty fields match everything
+type UsageFilter struct {
+	// Since is the first day counted, YYYY-MM-DD
+	Since     string
+	ProjectID string
+	Kind      string
+}
+
+// UsageCursor returns the last audit row folded into usage_stats, or 0 if none has been
+func (s *DB) UsageCursor() (int64, error) {
+	var id int64
+	err := s.queryRow("SELECT audit_id FROM usage_stats_cursor WHERE id = 1").Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return id, err
+}
+
+// AuditSince returns up to limit audit events recorded after afterID, oldest first
+func (s *DB) AuditSince(afterID int64, limit int) ([]AuditEvent, error) {
+	rows, err := s.query("SELECT "+auditColumns+" FROM audit_log WHERE id > ? ORDER BY id LIMIT ?", afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		e, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// AddUsage adds counts to usage_stats and moves the cursor to auditID in one
+// transaction, so each audit row is counted exactly once
+func (s *DB) AddUsage(counts []UsageCount, auditID int64) error {
+	return retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		for _, c := range counts {
+			if _, err := tx.Exec(s.rebind(
+				`INSERT INTO usage_stats (day, project_id, kind, key, count) VALUES (?, ?, ?, ?, ?)
+				 ON CONFLICT (day, project_id, kind, key) DO UPDATE SET count = usage_stats.count + excluded.count`),
+				c.Day, c.ProjectID, c.Kind, c.Key, c.Count,
+			); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(s.rebind(
+			`INSERT INTO usage_stats_cursor (id, audit_id, updated_at) VALUES (1, ?, CURRENT_TIMESTAMP)
+			 ON CONFLICT (id) DO UPDATE SET audit_id = excluded.audit_id, updated_at = excluded.updated_at`),
+			auditID,
+		); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// Usage returns the counts matching f, by day, project, kind, and key
+func (s *DB) Usage(f UsageFilter) ([]UsageCount, error) {
+	var where []string
+	var args []interface{}
+	if f.Since != "" {
+		where = append(where, "day >= ?")
+		args = append(args, f.Since)
+	}
+	if f.ProjectID != "" {
+		where = append(where, "project_id = ?")
+		args = append(args, f.ProjectID)
+	}
+	if f.Kind != "" {
+		where = append(where, "kind = ?")
+		args = append(args, f.Kind)
+	}
+
+	query := "SELECT day, project_id, kind, key, count FROM usage_stats"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY day, project_id, kind, key"
+
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []UsageCount
+	for rows.Next() {
+		var c UsageCount
+		if err := rows.Scan(&c.Day, &c.ProjectID, &c.Kind, &c.Key, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,174 @@
+package store
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/nerv/nerv-hook/pkg/approvals"
+)
+
+// Operator roles
+const (
+	// RoleAdmin can do everything an approver can, edit policy, and register and disable operators
+	RoleAdmin = "admin"
+	// RoleApprover can decide approvals, up to their MaxRisk, and act on tasks
+	RoleApprover = "approver"
+	// RoleViewer can read the audit log and everything else, but change nothing
+	RoleViewer = "viewer"
+)
+
+// Roles lists the operator roles, most privileged first
+var Roles = []string{RoleAdmin, RoleApprover, RoleViewer}
+
+// RoleAtLeast reports whether role is as privileged as least
+func RoleAtLeast(role, least string) bool {
+	i := slices.Index(Roles, role)
+	return i >= 0 && i <= slices.Index(Roles, least)
+}
+
+// User is a users row: an operator sharing this NERV instance
+type User struct {
+	Name      string
+	Email     string
+	Role      string
+	CreatedAt time.Time
+	// CreatedBy is the admin who registered the operator; empty for the first
+	CreatedBy  string
+	DisabledAt time.Time
+	// MaxRisk is the riskiest approval an approver may decide, one of
+	// approvals.Risks; empty means any
+	MaxRisk string
+	// OIDCIssuer and OIDCSubject identify an operator registered by signing in
+	// to nerv-hook serve; both are empty for one registered from the command line
+	OIDCIssuer  string
+	OIDCSubject string
+}
+
+// Disabled reports whether the operator has been disabled
+func (u User) Disabled() bool {
+	return !u.DisabledAt.IsZero()
+}
+
+// CanDecide reports whether the operator may decide an approval of the given risk
+func (u User) CanDecide(risk string) bool {
+	switch u.Role {
+	case RoleAdmin:
+		return true
+	case RoleApprover:
+		return u.MaxRisk == "" || approvals.RiskWithin(risk, u.MaxRisk)
+	default:
+		return false
+	}
+}
+
+const userColumns = "name, email, role, created_at, created_by, disabled_at, max_risk, oidc_issuer, oidc_subject"
+
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	var u User
+	err := row.Scan(&u.Name, textColumn{&u.Email}, &u.Role, timeColumn{&u.CreatedAt}, textColumn{&u.CreatedBy}, timeColumn{&u.DisabledAt}, textColumn{&u.MaxRisk},
+		textColumn{&u.OIDCIssuer}, textColumn{&u.OIDCSubject})
+	return u, err
+}
+
+// SetOperator attributes what's written through this handle from now on to an
+// operator: audit events, task status changes and notes are stamped with the
+// name. The hook and nervd leave it unset, since agents act for no one in particular
+func (s *DB) SetOperator(name string) {
+	s.operator = name
+}
+
+// Operator returns who writes are attributed to, or "" if no one
+func (s *DB) Operator() string {
+	return s.operator
+}
+
+// CreateUser registers an operator
+func (s *DB) CreateUser(u User) error {
+	if err := checkRole(u.Role, u.MaxRisk); err != nil {
+		return err
+	}
+	_, err := s.exec("INSERT INTO users (name, email, role, created_by, max_risk, oidc_issuer, oidc_subject) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		u.Name, nullable(u.Email), u.Role, nullable(u.CreatedBy), nullable(u.MaxRisk), nullable(u.OIDCIssuer), nullable(u.OIDCSubject))
+	return err
+}
+
+// checkRole rejects unknown roles and risk levels, and a risk limit on anyone but an approver
+func checkRole(role, maxRisk string) error {
+	if !slices.Contains(Roles, role) {
+		return fmt.Errorf("invalid role %q", role)
+	}
+	if maxRisk != "" && !slices.Contains(approvals.Risks, maxRisk) {
+		return fmt.Errorf("invalid risk level %q", maxRisk)
+	}
+	if maxRisk != "" && role != RoleApprover {
+		return fmt.Errorf("only approvers can be limited to a risk level, not %ss", role)
+	}
+	return nil
+}
+
+// GetUser loads an operator by name, returning ErrNotFound if there's none
+func (s *DB) GetUser(name string) (User, error) {
+	u, err := scanUser(s.queryRow("SELECT "+userColumns+" FROM users WHERE name = ?", name))
+	return u, notFound(err)
+}
+
+// UserByIdentity loads the operator an OpenID Connect provider's subject was
+// registered as, returning ErrNotFound if there's none
+func (s *DB) UserByIdentity(issuer, subject string) (User, error) {
+	u, err := scanUser(s.queryRow("SELECT "+userColumns+" FROM users WHERE oidc_issuer = ? AND oidc_subject = ?", issuer, subject))
+	return u, notFound(err)
+}
+
+// ListUsers returns every operator, disabled ones included, in the order they were registered
+func (s *DB) ListUsers() ([]User, error) {
+	rows, err := s.query("SELECT " + userColumns + " FROM users ORDER BY created_at, name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// CountUsers returns how many operators are registered, disabled ones included
+// Team mode is on once there's one
+func (s *DB) CountUsers() (int, error) {
+	var n int
+	err := s.queryRow("SELECT COUNT(*) FROM users").Scan(&n)
+	return n, err
+}
+
+// SetUserRole changes an operator's role and risk limit, returning ErrNotFound
+// if there's no such operator
+func (s *DB) SetUserRole(name, role, maxRisk string) error {
+	if err := checkRole(role, maxRisk); err != nil {
+		return err
+	}
+	result, err := s.exec("UPDATE users SET role = ?, max_risk = ? WHERE name = ?", role, nullable(maxRisk), name)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+// SetUserDisabled disables or re-enables an operator, returning ErrNotFound if there's no such operator
+func (s *DB) SetUserDisabled(name string, disabled bool) error {
+	var at interface{}
+	if disabled {
+		at = time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	}
+	result, err := s.exec("UPDATE users SET disabled_at = ? WHERE name = ?", at, name)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
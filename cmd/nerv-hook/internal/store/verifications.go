@@ -0,0 +1,39 @@
+package store
+
+// SaveVerification stores a verification run and returns its ID
+func (s *DB) SaveVerification(v Verification) (int64, error) {
+	passed := 0
+	if v.Passed {
+		passed = 1
+	}
+	var id int64
+	err := retryOnBusy(func() error {
+		tx, err := s.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		id, err = s.insertReturningID(tx,
+			"INSERT INTO verifications (task_id, head, passed, steps, duration_ms) VALUES (?, ?, ?, ?, ?)",
+			v.TaskID, nullable(v.Head), passed, v.Steps, v.DurationMS,
+		)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	return id, err
+}
+
+// LatestVerification returns a task's newest verification run, returning ErrNotFound if it has none
+func (s *DB) LatestVerification(taskID string) (Verification, error) {
+	var v Verification
+	var passed int
+	err := s.queryRow(
+		"SELECT id, task_id, head, passed, steps, duration_ms, created_at FROM verifications WHERE task_id = ? ORDER BY id DESC LIMIT 1",
+		taskID,
+	).Scan(&v.ID, &v.TaskID, textColumn{&v.Head}, &passed, &v.Steps, &v.DurationMS, timeColumn{&v.CreatedAt})
+	v.Passed = passed != 0
+	return v, notFound(err)
+}
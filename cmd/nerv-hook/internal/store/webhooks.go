@@ -0,0 +1,152 @@
+package store
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// TransitionsSince returns up to limit status changes recorded after afterID, oldest first
+func (s *DB) TransitionsSince(afterID int64, limit int) ([]TaskTransition, error) {
+	rows, err := s.query("SELECT "+transitionColumns+" FROM task_transitions WHERE id > ? ORDER BY id LIMIT ?", afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transitions []TaskTransition
+	for rows.Next() {
+		tr, err := scanTransition(rows)
+		if err != nil {
+			return nil, err
+		}
+		transitions = append(transitions, tr)
+	}
+	return transitions, rows.Err()
+}
+
+// LastTransitionID returns the ID of the newest recorded status change, or 0 if there are none
+func (s *DB) LastTransitionID() (int64, error) {
+	var id sql.NullInt64
+	err := s.queryRow("SELECT MAX(id) FROM task_transitions").Scan(&id)
+	return id.Int64, err
+}
+
+// WebhookCursor returns the last transition a webhook was sent, or ErrNotFound if it has never run
+func (s *DB) WebhookCursor(webhook string) (int64, error) {
+	var id int64
+	err := s.queryRow("SELECT transition_id FROM webhook_cursors WHERE webhook = ?", webhook).Scan(&id)
+	return id, notFound(err)
+}
+
+// SetWebhookCursor records the last transition a webhook was sent
+func (s *DB) SetWebhookCursor(webhook string, transitionID int64) error {
+	_, err := s.exec(
+		`INSERT INTO webhook_cursors (webhook, transition_id, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+		 ON CONFLICT (webhook) DO UPDATE SET transition_id = excluded.transition_id, updated_at = excluded.updated_at`,
+		webhook, transitionID,
+	)
+	return err
+}
+
+// AlertsSince returns up to limit audit events of the given types recorded after afterID, oldest first
+func (s *DB) AlertsSince(afterID int64, eventTypes []string, limit int) ([]AuditEvent, error) {
+	if len(eventTypes) == 0 {
+		return nil, nil
+	}
+	args := []interface{}{afterID}
+	for _, t := range eventTypes {
+		args = append(args, t)
+	}
+	args = append(args, limit)
+	rows, err := s.query("SELECT "+auditColumns+" FROM audit_log WHERE id > ? AND event_type IN (?"+strings.Repeat(", ?", len(eventTypes)-1)+") ORDER BY id LIMIT ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		e, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// LastAuditID returns the ID of the newest audit event, or 0 if there are none
+func (s *DB) LastAuditID() (int64, error) {
+	var id sql.NullInt64
+	err := s.queryRow("SELECT MAX(id) FROM audit_log").Scan(&id)
+	return id.Int64, err
+}
+
+// AlertCursor returns the last audit event a notifier was sent as an alert, or ErrNotFound if it has never run
+func (s *DB) AlertCursor(notifier string) (int64, error) {
+	var id int64
+	err := s.queryRow("SELECT audit_id FROM alert_cursors WHERE notifier = ?", notifier).Scan(&id)
+	return id, notFound(err)
+}
+
+// SetAlertCursor records the last audit event a notifier was sent as an alert
+func (s *DB) SetAlertCursor(notifier string, auditID int64) error {
+	_, err := s.exec(
+		`INSERT INTO alert_cursors (notifier, audit_id, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+		 ON CONFLICT (notifier) DO UPDATE SET audit_id = excluded.audit_id, updated_at = excluded.updated_at`,
+		notifier, auditID,
+	)
+	return err
+}
+
+// NotifierHealth is how a notifier's deliveries are going
+type NotifierHealth struct {
+	Notifier string
+	// LastSentAt is zero until a delivery succeeds
+	LastSentAt  time.Time
+	LastError   string
+	LastErrorAt time.Time
+	// Failures counts the deliveries that failed since the last one that didn't
+	Failures int64
+}
+
+// RecordNotifierSent notes a notifier's successful delivery, clearing its failures
+func (s *DB) RecordNotifierSent(notifier string) error {
+	_, err := s.exec(
+		`INSERT INTO notifier_health (notifier, last_sent_at, failures) VALUES (?, CURRENT_TIMESTAMP, 0)
+		 ON CONFLICT (notifier) DO UPDATE SET last_sent_at = excluded.last_sent_at, failures = 0`,
+		notifier,
+	)
+	return err
+}
+
+// RecordNotifierFailure notes a notifier's failed delivery and why it failed
+func (s *DB) RecordNotifierFailure(notifier, message string) error {
+	_, err := s.exec(
+		`INSERT INTO notifier_health (notifier, last_error, last_error_at, failures) VALUES (?, ?, CURRENT_TIMESTAMP, 1)
+		 ON CONFLICT (notifier) DO UPDATE SET last_error = excluded.last_error, last_error_at = excluded.last_error_at,
+		 failures = notifier_health.failures + 1`,
+		notifier, message,
+	)
+	return err
+}
+
+// ListNotifierHealth returns the health of every notifier that has delivered or failed, by name
+func (s *DB) ListNotifierHealth() ([]NotifierHealth, error) {
+	rows, err := s.query("SELECT notifier, last_sent_at, last_error, last_error_at, failures FROM notifier_health ORDER BY notifier")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var health []NotifierHealth
+	for rows.Next() {
+		var h NotifierHealth
+		if err := rows.Scan(&h.Notifier, timeColumn{&h.LastSentAt}, textColumn{&h.LastError}, timeColumn{&h.LastErrorAt}, &h.Failures); err != nil {
+			return nil, err
+		}
+		health = append(health, h)
+	}
+	return health, rows.Err()
+}
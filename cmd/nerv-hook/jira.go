@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// defaultJiraStatuses are the states of Jira's default workflow
+var defaultJiraStatuses = map[string]string{
+	"in_progress": "In Progress",
+	"done":        "Done",
+}
+
+// JiraConfig imports the Jira issues assigned to the token's user
+type JiraConfig struct {
+	// URL is the site, e.g. https://acme.atlassian.net
+	URL string `json:"url"`
+	// Email authenticates to Jira Cloud with an API token; without it the token
+	// is sent as a Data Center personal access token
+	Email string `json:"email,omitempty"`
+	// TokenEnv names the environment variable holding the token (default JIRA_API_TOKEN)
+	TokenEnv string `json:"token_env,omitempty"`
+	// Project limits imports to one Jira project, by key
+	Project string `json:"project,omitempty"`
+	// JQL replaces the query for tickets to import
+	// (default: assigned to the token's user and not done)
+	JQL     string         `json:"jql,omitempty"`
+	Mapping TrackerMapping `json:"mapping,omitempty"`
+}
+
+func (c *JiraConfig) validate() error {
+	if u, err := url.Parse(c.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("url %q is not a URL", c.URL)
+	}
+	return c.Mapping.validate()
+}
+
+// jql is the query for tickets to import
+func (c *JiraConfig) jql() string {
+	if c.JQL != "" {
+		return c.JQL
+	}
+	q := "assignee = currentUser() AND statusCategory != Done"
+	if c.Project != "" {
+		q += fmt.Sprintf(" AND project = %q", c.Project)
+	}
+	return q + " ORDER BY created"
+}
+
+// jiraConnector talks to Jira's REST API, version 2, which takes plain-text comments
+type jiraConnector struct {
+	cfg  *JiraConfig
+	site string
+}
+
+func newJiraConnector(cfg *JiraConfig) *jiraConnector {
+	site := strings.TrimSuffix(cfg.URL, "/")
+	return &jiraConnector{cfg: cfg, site: site}
+}
+
+func (c *jiraConnector) name() string {
+	u, _ := url.Parse(c.site)
+	return "jira:" + u.Host
+}
+
+func (c *jiraConnector) mapping() TrackerMapping { return c.cfg.Mapping }
+func (c *jiraConnector) statuses() map[string]string {
+	return c.cfg.Mapping.statuses(defaultJiraStatuses)
+}
+
+// fields are the issue fields requested, including the mapped ones
+func (c *jiraConnector) fields() (title, description string, all string) {
+	title = field(c.cfg.Mapping.Title, "summary")
+	description = field(c.cfg.Mapping.Description, "description")
+	return title, description, strings.Join([]string{"status", title, description}, ",")
+}
+
+type jiraIssue struct {
+	ID     string                     `json:"id"`
+	Key    string                     `json:"key"`
+	Fields map[string]json.RawMessage `json:"fields"`
+}
+
+// toTicket converts an issue, applying the field mapping
+func (c *jiraConnector) toTicket(issue jiraIssue) ticket {
+	title, description, _ := c.fields()
+	var status struct {
+		Name string `json:"name"`
+	}
+	json.Unmarshal(issue.Fields["status"], &status)
+	return ticket{
+		ID:          issue.ID,
+		Key:         issue.Key,
+		URL:         c.site + "/browse/" + issue.Key,
+		State:       status.Name,
+		Title:       jiraFieldText(issue.Fields[title]),
+		Description: jiraFieldText(issue.Fields[description]),
+	}
+}
+
+// jiraFieldText renders a field value as text: strings as they are, options and
+// users by their value or name, anything else as JSON
+func jiraFieldText(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var named struct {
+		Value       string `json:"value"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	}
+	if json.Unmarshal(raw, &named) == nil {
+		for _, v := range []string{named.Value, named.Name, named.DisplayName} {
+			if v != "" {
+				return v
+			}
+		}
+	}
+	return string(raw)
+}
+
+// do sends a request with the configured credentials
+func (c *jiraConnector) do(method, path string, body, out interface{}) error {
+	token, err := envToken(c.cfg.TokenEnv, "JIRA_API_TOKEN")
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	if c.cfg.Email != "" {
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.cfg.Email+":"+token)))
+	}
+	if err := trackerRequest(method, c.site+"/rest/api/2"+path, header, body, out); err != nil {
+		return fmt.Errorf("Jira: %w", err)
+	}
+	return nil
+}
+
+func (c *jiraConnector) assigned() ([]ticket, error) {
+	_, _, fields := c.fields()
+	var tickets []ticket
+	for start := 0; ; {
+		query := url.Values{"jql": {c.cfg.jql()}, "fields": {fields}, "startAt": {fmt.Sprint(start)}, "maxResults": {"100"}}
+		var page struct {
+			Issues []jiraIssue `json:"issues"`
+			Total  int         `json:"total"`
+		}
+		if err := c.do("GET", "/search?"+query.Encode(), nil, &page); err != nil {
+			return nil, err
+		}
+		for _, issue := range page.Issues {
+			tickets = append(tickets, c.toTicket(issue))
+		}
+		start += len(page.Issues)
+		if len(page.Issues) == 0 || start >= page.Total {
+			return tickets, nil
+		}
+	}
+}
+
+func (c *jiraConnector) ticket(id string) (ticket, error) {
+	_, _, fields := c.fields()
+	var issue jiraIssue
+	if err := c.do("GET", "/issue/"+url.PathEscape(id)+"?fields="+url.QueryEscape(fields), nil, &issue); err != nil {
+		return ticket{}, err
+	}
+	return c.toTicket(issue), nil
+}
+
+// setState moves an issue through the workflow transition that leads to state
+func (c *jiraConnector) setState(t ticket, state string) error {
+	var resp struct {
+		Transitions []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+			To   struct {
+				Name string `json:"name"`
+			} `json:"to"`
+		} `json:"transitions"`
+	}
+	path := "/issue/" + url.PathEscape(t.ID) + "/transitions"
+	if err := c.do("GET", path, nil, &resp); err != nil {
+		return err
+	}
+	for _, tr := range resp.Transitions {
+		if strings.EqualFold(tr.To.Name, state) || strings.EqualFold(tr.Name, state) {
+			return c.do("POST", path, map[string]interface{}{"transition": map[string]string{"id": tr.ID}}, nil)
+		}
+	}
+	return fmt.Errorf("%s has no transition from %q to %q; check mapping.statuses", t.Key, t.State, state)
+}
+
+func (c *jiraConnector) addComment(t ticket, body string) error {
+	return c.do("POST", "/issue/"+url.PathEscape(t.ID)+"/comment", map[string]string{"body": body}, nil)
+}
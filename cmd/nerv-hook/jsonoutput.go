@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// The commands that list or show things take --json and print what they show
+// as JSON for scripts. Field names are snake_case, times are RFC 3339, and
+// lists print as [] when empty. The structures are documented and only gain
+// fields; tasks, status changes, sessions, approvals and audit events have
+// the shapes they have in a task archive
+
+// printJSON writes v to stdout, indented
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// jsonTask is a task as the task commands print it
+type jsonTask struct {
+	archivedTask
+	ParentID string `json:"parent_id,omitempty"`
+}
+
+func taskJSON(t store.Task) jsonTask {
+	return jsonTask{
+		archivedTask: archivedTask{
+			ID: t.ID, ProjectID: t.ProjectID, Title: t.Title, Description: t.Description,
+			Status: t.Status, Priority: t.Priority, Labels: t.Labels, Repos: t.Repos,
+			Branch: t.Branch, BranchHead: t.BranchHead, CreatedAt: t.CreatedAt, CompletedAt: optionalTime(t.CompletedAt),
+		},
+		ParentID: t.ParentID,
+	}
+}
+
+func sessionJSON(sess store.Session) archivedSession {
+	return archivedSession{
+		ID: sess.ID, StartedAt: sess.StartedAt, LastSeenAt: sess.LastSeenAt, ActiveSeconds: int64(sess.Active.Seconds()),
+		ToolCalls: sess.ToolCalls, Tokens: sess.Tokens, CostUSD: sess.CostUSD, TranscriptPath: sess.TranscriptPath,
+	}
+}
+
+// jsonApproval is an approval request, with the task and session that made it
+type jsonApproval struct {
+	archivedApproval
+	TaskID    string `json:"task_id,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+	Risk      string `json:"risk,omitempty"`
+}
+
+func approvalJSON(a store.Approval) jsonApproval {
+	return jsonApproval{
+		archivedApproval: archivedApproval{
+			ID: a.ID, At: a.CreatedAt, Tool: a.ToolName, Input: a.ToolInput, Status: a.Status, DenyReason: a.DenyReason, DecidedAt: optionalTime(a.DecidedAt), DecidedBy: a.DecidedBy,
+		},
+		TaskID:    a.TaskID,
+		SessionID: a.SessionID,
+		Risk:      a.Risk,
+	}
+}
+
+// jsonEvent is an audit event; details are kept as the JSON they were logged as
+type jsonEvent struct {
+	ID     int64  `json:"id"`
+	TaskID string `json:"task_id,omitempty"`
+	archivedEvent
+}
+
+func eventJSON(e store.AuditEvent) jsonEvent {
+	ev := jsonEvent{ID: e.ID, TaskID: e.TaskID, archivedEvent: archivedEvent{At: e.Timestamp, Event: e.EventType, Operator: e.Operator}}
+	if json.Valid([]byte(e.Details)) {
+		ev.Details = json.RawMessage(e.Details)
+	} else if e.Details != "" {
+		ev.Details, _ = json.Marshal(e.Details)
+	}
+	return ev
+}
+
+// jsonTaskDetail is a task as task show prints it
+type jsonTaskDetail struct {
+	jsonTask
+	Worktrees []string `json:"worktrees"`
+	// Subtasks are the IDs of the task's subtasks
+	Subtasks         []string          `json:"subtasks"`
+	Sessions         []archivedSession `json:"sessions"`
+	WallClockSeconds int64             `json:"wall_clock_seconds"`
+	ActiveSeconds    int64             `json:"active_seconds"`
+}
+
+func taskDetailJSON(task store.Task, sessions []store.Session, worktrees []store.TaskWorktree, children []store.Task) jsonTaskDetail {
+	d := jsonTaskDetail{jsonTask: taskJSON(task), Worktrees: []string{}, Subtasks: []string{}, Sessions: []archivedSession{}}
+	if task.WorktreePath != "" {
+		d.Worktrees = append(d.Worktrees, task.WorktreePath)
+	}
+	for _, wt := range worktrees {
+		if wt.Path != task.WorktreePath {
+			d.Worktrees = append(d.Worktrees, wt.Path)
+		}
+	}
+	for _, c := range children {
+		d.Subtasks = append(d.Subtasks, c.ID)
+	}
+	for _, sess := range sessions {
+		d.Sessions = append(d.Sessions, sessionJSON(sess))
+	}
+	wall, active := sessionTotals(sessions)
+	d.WallClockSeconds, d.ActiveSeconds = int64(wall.Seconds()), int64(active.Seconds())
+	return d
+}
+
+// jsonTaskTime is one task's row in task report
+type jsonTaskTime struct {
+	TaskID           string `json:"task_id"`
+	Status           string `json:"status"`
+	Title            string `json:"title"`
+	Sessions         int    `json:"sessions"`
+	WallClockSeconds int64  `json:"wall_clock_seconds"`
+	ActiveSeconds    int64  `json:"active_seconds"`
+}
+
+// jsonProject is a project as project list prints it
+type jsonProject struct {
+	ID    string   `json:"id"`
+	Name  string   `json:"name"`
+	Goal  string   `json:"goal,omitempty"`
+	Paths []string `json:"paths"`
+	// Default marks the project used when no other applies
+	Default bool `json:"default"`
+}
+
+// jsonQueued is a task waiting in the queue, in launch order
+type jsonQueued struct {
+	TaskID     string    `json:"task_id"`
+	ProjectID  string    `json:"project_id"`
+	Title      string    `json:"title"`
+	Priority   int       `json:"priority"`
+	Prompt     string    `json:"prompt,omitempty"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+}
+
+// jsonBudget is a budget and what's been used against it; a zero limit is no limit
+type jsonBudget struct {
+	Scope        string    `json:"scope"`
+	ScopeID      string    `json:"scope_id"`
+	MaxToolCalls int64     `json:"max_tool_calls"`
+	MaxTokens    int64     `json:"max_tokens"`
+	MaxCostUSD   float64   `json:"max_cost_usd"`
+	OnExceed     string    `json:"on_exceed"`
+	Used         jsonUsage `json:"used"`
+}
+
+type jsonUsage struct {
+	Sessions  int     `json:"sessions"`
+	ToolCalls int64   `json:"tool_calls"`
+	Tokens    int64   `json:"tokens"`
+	CostUSD   float64 `json:"cost_usd"`
+}
+
+// jsonRulesStatus is whether the permissions file matches the one registered
+// Status is registered, unregistered (never registered), or changed; a changed
+// file has the Action hooks take: fallback, warn, or deny
+type jsonRulesStatus struct {
+	Path       string `json:"path"`
+	Checksum   string `json:"checksum"`
+	Registered string `json:"registered,omitempty"`
+	Status     string `json:"status"`
+	Action     string `json:"action,omitempty"`
+}
+
+// jsonCheck is one of doctor's checks; Status is ok, warn, or fail
+type jsonCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Fix    string `json:"fix,omitempty"`
+}
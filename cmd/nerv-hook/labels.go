@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// taskFilterFlags are the flags that narrow a task listing, shared by task list and board
+type taskFilterFlags struct {
+	project, labels, priority, saved *string
+}
+
+// addTaskFilterFlags registers --project, --label, --priority and --filter on fs
+func addTaskFilterFlags(fs *flag.FlagSet) *taskFilterFlags {
+	return &taskFilterFlags{
+		project:  fs.String("project", "", "only tasks in this project"),
+		labels:   fs.String("label", "", "only tasks with all of these comma-separated labels"),
+		priority: fs.String("priority", "", "only tasks with this priority: low, medium, high, or urgent"),
+		saved:    fs.String("filter", "", "start from the filter saved under this name; other flags override its fields"),
+	}
+}
+
+// resolve builds the filter, loading the saved one first if --filter was given
+func (f *taskFilterFlags) resolve(st *store.DB) (store.TaskFilter, error) {
+	var filter store.TaskFilter
+	if *f.saved != "" {
+		sf, err := st.GetTaskFilter(*f.saved)
+		if errors.Is(err, store.ErrNotFound) {
+			return filter, fmt.Errorf("no filter named %q; see nerv-hook task filter list", *f.saved)
+		} else if err != nil {
+			return filter, err
+		}
+		filter = sf.Filter
+	}
+	if *f.project != "" {
+		filter.ProjectID = *f.project
+	}
+	if *f.priority != "" {
+		if !store.IsTaskPriority(*f.priority) {
+			return filter, fmt.Errorf("--priority: unknown priority %q", *f.priority)
+		}
+		filter.Priority = *f.priority
+	}
+	if *f.labels != "" {
+		labels, err := parseLabels(*f.labels)
+		if err != nil {
+			return filter, fmt.Errorf("--label: %w", err)
+		}
+		filter.Labels = labels
+	}
+	return filter, nil
+}
+
+// parseLabels splits a comma-separated list into sorted, lowercase, distinct labels
+func parseLabels(list string) ([]string, error) {
+	var labels []string
+	for _, label := range strings.Split(list, ",") {
+		label = strings.ToLower(strings.TrimSpace(label))
+		if label == "" {
+			continue
+		}
+		if strings.ContainsAny(label, " \t") {
+			return nil, fmt.Errorf("label %q contains spaces", label)
+		}
+		labels = append(labels, label)
+	}
+	if len(labels) == 0 {
+		return nil, errors.New("no labels given")
+	}
+	sort.Strings(labels)
+	return slices.Compact(labels), nil
+}
+
+// parsePriority accepts a priority name, or none to clear it
+func parsePriority(priority string) (string, error) {
+	priority = strings.ToLower(priority)
+	if priority == "none" {
+		return "", nil
+	}
+	if !store.IsTaskPriority(priority) {
+		return "", fmt.Errorf("unknown priority %q: use low, medium, high, urgent, or none", priority)
+	}
+	return priority, nil
+}
+
+// describeFilter summarizes a filter for headings, e.g. "project p1, label infra"
+func describeFilter(f store.TaskFilter) string {
+	var parts []string
+	if f.ProjectID != "" {
+		parts = append(parts, "project "+f.ProjectID)
+	}
+	if f.Status != "" {
+		parts = append(parts, "status "+f.Status)
+	}
+	if f.Priority != "" {
+		parts = append(parts, "priority "+f.Priority)
+	}
+	if len(f.Labels) > 0 {
+		parts = append(parts, "label "+strings.Join(f.Labels, ","))
+	}
+	if len(parts) == 0 {
+		return "all tasks"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// runTaskLabel implements `nerv-hook task label`: add labels, remove them, or list them
+func runTaskLabel(args []string) error {
+	fs := flag.NewFlagSet("task label", flag.ContinueOnError)
+	remove := fs.Bool("remove", false, "remove the labels instead of adding them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || (*remove && fs.NArg() < 2) {
+		return errors.New("usage: nerv-hook task label [--remove] <task-id> [LABEL...]")
+	}
+
+	st, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	task, err := loadTask(st, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 1 {
+		if len(task.Labels) == 0 {
+			fmt.Printf("Task %s has no labels\n", task.ID)
+		} else {
+			fmt.Println(strings.Join(task.Labels, " "))
+		}
+		return nil
+	}
+
+	labels, err := parseLabels(strings.Join(fs.Args()[1:], ","))
+	if err != nil {
+		return err
+	}
+	if err := actAsOperator(st); err != nil {
+		return err
+	}
+	if *remove {
+		err = st.SetTaskLabels(task.ID, nil, labels)
+	} else {
+		err = st.SetTaskLabels(task.ID, labels, nil)
+	}
+	if err != nil {
+		return err
+	}
+	if task, err = st.GetTask(task.ID); err != nil {
+		return err
+	}
+	fmt.Printf("Task %s labels: %s\n", task.ID, strings.Join(task.Labels, " "))
+	return nil
+}
+
+// runTaskPriority implements `nerv-hook task priority`
+func runTaskPriority(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: nerv-hook task priority <task-id> low|medium|high|urgent|none")
+	}
+	priority, err := parsePriority(args[1])
+	if err != nil {
+		return err
+	}
+
+	st, err := openOperatorStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	task, err := loadTask(st, args[0])
+	if err != nil {
+		return err
+	}
+	if err := st.SetTaskPriority(task.ID, priority); err != nil {
+		return err
+	}
+	if priority == "" {
+		fmt.Printf("Task %s has no priority\n", task.ID)
+	} else {
+		fmt.Printf("Task %s is %s priority\n", task.ID, priority)
+	}
+	return nil
+}
+
+// runTaskFilter implements `nerv-hook task filter`, managing filters saved with task list --save
+func runTaskFilter(args []string) error {
+	const usage = "usage: nerv-hook task filter list | task filter delete NAME"
+	if len(args) < 1 {
+		return errors.New(usage)
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		st, err := openReadOnlyStore()
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+
+		filters, err := st.ListTaskFilters()
+		if err != nil {
+			return err
+		}
+		if len(filters) == 0 {
+			fmt.Println("No saved filters; save one with nerv-hook task list --save NAME")
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tFILTER")
+		for _, sf := range filters {
+			fmt.Fprintf(w, "%s\t%s\n", sf.Name, describeFilter(sf.Filter))
+		}
+		return w.Flush()
+	case args[0] == "delete" && len(args) == 2:
+		st, err := openOperatorStore()
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+
+		if err := st.DeleteTaskFilter(args[1]); errors.Is(err, store.ErrNotFound) {
+			return fmt.Errorf("no filter named %q", args[1])
+		} else if err != nil {
+			return err
+		}
+		fmt.Printf("Deleted filter %s\n", args[1])
+		return nil
+	}
+	return errors.New(usage)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// defaultLinearAPI is Linear's GraphQL endpoint
+const defaultLinearAPI = "https://api.linear.app/graphql"
+
+// defaultLinearStatuses are Linear's default workflow states
+var defaultLinearStatuses = map[string]string{
+	"in_progress": "In Progress",
+	"review":      "In Review",
+	"done":        "Done",
+	"abandoned":   "Canceled",
+}
+
+// LinearConfig imports the Linear issues assigned to the API key's user
+type LinearConfig struct {
+	// TokenEnv names the environment variable holding a personal API key (default LINEAR_API_KEY)
+	TokenEnv string `json:"token_env,omitempty"`
+	// Team limits imports to one team, by key, e.g. ENG
+	Team string `json:"team,omitempty"`
+	// APIURL overrides the GraphQL endpoint
+	APIURL  string         `json:"api_url,omitempty"`
+	Mapping TrackerMapping `json:"mapping,omitempty"`
+}
+
+// linearConnector talks to Linear's GraphQL API
+type linearConnector struct {
+	cfg *LinearConfig
+}
+
+func newLinearConnector(cfg *LinearConfig) *linearConnector {
+	return &linearConnector{cfg: cfg}
+}
+
+func (c *linearConnector) name() string            { return "linear" }
+func (c *linearConnector) mapping() TrackerMapping { return c.cfg.Mapping }
+func (c *linearConnector) statuses() map[string]string {
+	return c.cfg.Mapping.statuses(defaultLinearStatuses)
+}
+
+// linearIssueFields are the issue fields every query selects
+const linearIssueFields = "id identifier title description url state { name } team { id }"
+
+type linearIssue struct {
+	ID          string `json:"id"`
+	Identifier  string `json:"identifier"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	URL         string `json:"url"`
+	State       struct {
+		Name string `json:"name"`
+	} `json:"state"`
+	Team struct {
+		ID string `json:"id"`
+	} `json:"team"`
+}
+
+// toTicket converts an issue, applying the field mapping
+// Linear issues only have title, description, and identifier to map from
+func (c *linearConnector) toTicket(issue linearIssue) ticket {
+	fields := map[string]string{"title": issue.Title, "description": issue.Description, "identifier": issue.Identifier}
+	return ticket{
+		ID:          issue.ID,
+		Key:         issue.Identifier,
+		URL:         issue.URL,
+		State:       issue.State.Name,
+		Title:       fields[field(c.cfg.Mapping.Title, "title")],
+		Description: fields[field(c.cfg.Mapping.Description, "description")],
+		Scope:       issue.Team.ID,
+	}
+}
+
+// query runs a GraphQL request and decodes its data into out
+func (c *linearConnector) query(query string, variables map[string]interface{}, out interface{}) error {
+	token, err := envToken(c.cfg.TokenEnv, "LINEAR_API_KEY")
+	if err != nil {
+		return err
+	}
+	api := c.cfg.APIURL
+	if api == "" {
+		api = defaultLinearAPI
+	}
+
+	var resp struct {
+		Data   interface{} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	resp.Data = out
+	header := http.Header{"Authorization": {token}}
+	if err := trackerRequest("POST", api, header, map[string]interface{}{"query": query, "variables": variables}, &resp); err != nil {
+		return fmt.Errorf("Linear: %w", err)
+	}
+	if len(resp.Errors) > 0 {
+		return fmt.Errorf("Linear: %s", resp.Errors[0].Message)
+	}
+	return nil
+}
+
+func (c *linearConnector) assigned() ([]ticket, error) {
+	filter := map[string]interface{}{
+		"state": map[string]interface{}{"type": map[string]interface{}{"nin": []string{"completed", "canceled"}}},
+	}
+	if c.cfg.Team != "" {
+		filter["team"] = map[string]interface{}{"key": map[string]interface{}{"eq": c.cfg.Team}}
+	}
+
+	var tickets []ticket
+	after := interface{}(nil)
+	for {
+		var data struct {
+			Viewer struct {
+				AssignedIssues struct {
+					Nodes    []linearIssue `json:"nodes"`
+					PageInfo struct {
+						HasNextPage bool   `json:"hasNextPage"`
+						EndCursor   string `json:"endCursor"`
+					} `json:"pageInfo"`
+				} `json:"assignedIssues"`
+			} `json:"viewer"`
+		}
+		err := c.query(`query($filter: IssueFilter, $after: String) {
+			viewer { assignedIssues(filter: $filter, first: 100, after: $after) {
+				nodes { `+linearIssueFields+` } pageInfo { hasNextPage endCursor } } } }`,
+			map[string]interface{}{"filter": filter, "after": after}, &data)
+		if err != nil {
+			return nil, err
+		}
+		for _, issue := range data.Viewer.AssignedIssues.Nodes {
+			tickets = append(tickets, c.toTicket(issue))
+		}
+		page := data.Viewer.AssignedIssues.PageInfo
+		if !page.HasNextPage {
+			return tickets, nil
+		}
+		after = page.EndCursor
+	}
+}
+
+func (c *linearConnector) ticket(id string) (ticket, error) {
+	var data struct {
+		Issue *linearIssue `json:"issue"`
+	}
+	if err := c.query(`query($id: String!) { issue(id: $id) { `+linearIssueFields+` } }`, map[string]interface{}{"id": id}, &data); err != nil {
+		return ticket{}, err
+	}
+	if data.Issue == nil {
+		return ticket{}, fmt.Errorf("Linear issue %s not found", id)
+	}
+	return c.toTicket(*data.Issue), nil
+}
+
+func (c *linearConnector) setState(t ticket, state string) error {
+	var states struct {
+		WorkflowStates struct {
+			Nodes []struct {
+				ID string `json:"id"`
+			} `json:"nodes"`
+		} `json:"workflowStates"`
+	}
+	err := c.query(`query($team: ID!, $name: String!) {
+		workflowStates(filter: { team: { id: { eq: $team } }, name: { eqIgnoreCase: $name } }) { nodes { id } } }`,
+		map[string]interface{}{"team": t.Scope, "name": state}, &states)
+	if err != nil {
+		return err
+	}
+	if len(states.WorkflowStates.Nodes) == 0 {
+		return fmt.Errorf("%s's team has no %q state; check mapping.statuses", t.Key, state)
+	}
+
+	var updated struct {
+		IssueUpdate struct {
+			Success bool `json:"success"`
+		} `json:"issueUpdate"`
+	}
+	err = c.query(`mutation($id: String!, $state: String!) { issueUpdate(id: $id, input: { stateId: $state }) { success } }`,
+		map[string]interface{}{"id": t.ID, "state": states.WorkflowStates.Nodes[0].ID}, &updated)
+	if err == nil && !updated.IssueUpdate.Success {
+		err = errors.New("Linear didn't update the issue")
+	}
+	return err
+}
+
+func (c *linearConnector) addComment(t ticket, body string) error {
+	var created struct {
+		CommentCreate struct {
+			Success bool `json:"success"`
+		} `json:"commentCreate"`
+	}
+	err := c.query(`mutation($id: String!, $body: String!) { commentCreate(input: { issueId: $id, body: $body }) { success } }`,
+		map[string]interface{}{"id": t.ID, "body": body}, &created)
+	if err == nil && !created.CommentCreate.Success {
+		err = errors.New("Linear didn't add the comment")
+	}
+	return err
+}
@@ -1,33 +1,70 @@
 // nerv-hook is the NERV permission hook binary for Claude Code
-// It handles PreToolUse, PostToolUse, and Stop events from Claude Code hooks
+// It handles PreToolUse, PostToolUse, and Stop events from Claude Code hooks,
+// and from other agent frameworks through the adapters in adapters.go
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	_ "modernc.org/sqlite"
+	"github.com/nerv/nerv-hook/internal/migrations"
+	"github.com/nerv/nerv-hook/internal/store"
+	"github.com/nerv/nerv-hook/pkg/approvals"
+	"github.com/nerv/nerv-hook/pkg/policy"
 )
 
 // HookInput represents the JSON input from Claude Code hooks
 type HookInput struct {
-	SessionID    string                 `json:"session_id"`
-	ToolName     string                 `json:"tool_name"`
-	ToolInput    map[string]interface{} `json:"tool_input"`
-	StopReason   string                 `json:"stop_reason,omitempty"`
-	StopGenIndex int                    `json:"stop_gen_index,omitempty"`
+	SessionID     string                 `json:"session_id"`
+	HookEventName string                 `json:"hook_event_name,omitempty"`
+	ToolName      string                 `json:"tool_name"`
+	ToolInput     map[string]interface{} `json:"tool_input"`
+	StopReason    string                 `json:"stop_reason,omitempty"`
+	StopGenIndex  int                    `json:"stop_gen_index,omitempty"`
+	// TranscriptPath is the agent's JSONL transcript, read for token usage
+	TranscriptPath string `json:"transcript_path,omitempty"`
+	// ToolResponse is the tool's result, sent with post-tool-use
+	ToolResponse map[string]interface{} `json:"tool_response,omitempty"`
+	// Cwd is the agent's working directory; the hook's own is filled in when the agent doesn't send it
+	Cwd string `json:"cwd,omitempty"`
+
+	// ProtocolVersion is detected by the protocol adapter, e.g. "claude/2"
+	ProtocolVersion string `json:"-"`
+	// RunID is NERV_RUN_ID, set when `nerv-hook run` launched the session
+	RunID string `json:"-"`
 }
 
 // HookOutput represents the JSON output to Claude Code hooks
 type HookOutput struct {
-	Decision *Decision `json:"decision,omitempty"`
+	Continue   *bool     `json:"continue,omitempty"`   // false terminates the session
+	StopReason string    `json:"stopReason,omitempty"` // shown to the user when continue is false
+	Decision   *Decision `json:"decision,omitempty"`
+	// SystemMessage is a non-blocking warning shown to the user, never to the model
+	SystemMessage string `json:"systemMessage,omitempty"`
+	// SuppressOutput hides the hook's stdout from the Claude transcript
+	SuppressOutput bool `json:"suppressOutput,omitempty"`
+	// HookSpecificOutput carries event-specific fields such as added context
+	HookSpecificOutput *HookSpecificOutput `json:"hookSpecificOutput,omitempty"`
+}
+
+// HookSpecificOutput is the per-event part of a hook's response
+type HookSpecificOutput struct {
+	HookEventName string `json:"hookEventName"`
+	// AdditionalContext is added to the model's context (SessionStart, UserPromptSubmit)
+	AdditionalContext string `json:"additionalContext,omitempty"`
+	// PermissionDecision and UpdatedInput allow a PreToolUse call with its input replaced
+	PermissionDecision string                 `json:"permissionDecision,omitempty"`
+	UpdatedInput       map[string]interface{} `json:"updatedInput,omitempty"`
 }
 
 // Decision represents a permission decision
@@ -36,153 +73,531 @@ type Decision struct {
 	Message  string `json:"message,omitempty"`
 }
 
-// PermissionRule represents a permission allow/deny rule
-type PermissionRule struct {
-	Pattern string
-	Regex   *regexp.Regexp
-}
+// criticalDenialLimit is the number of consecutive rule denials in one session
+// after which NERV stops the session instead of letting the agent keep probing
+const criticalDenialLimit = 3
 
 // Global config paths
 var (
 	nervDir    string
 	configPath string
 	dbPath     string
+	socketPath string
 )
 
+// init picks the NERV directory: NERV_DIR if set, otherwise ~/.nerv
+// main may still override configPath and dbPath from --config and --db
 func init() {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		homeDir = "."
+	dir := os.Getenv("NERV_DIR")
+	if dir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			homeDir = "."
+		}
+		dir = filepath.Join(homeDir, ".nerv")
 	}
-	nervDir = filepath.Join(homeDir, ".nerv")
+	setNervDir(dir)
+}
+
+// setNervDir points every state path at dir
+func setNervDir(dir string) {
+	nervDir = dir
 	configPath = filepath.Join(nervDir, "permissions.json")
 	dbPath = filepath.Join(nervDir, "state.db")
+	socketPath = filepath.Join(nervDir, "nervd.sock")
+}
+
+// pathOverrideArgs returns the --config and --db flags given on the command line
+func pathOverrideArgs() []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "db" {
+			args = append(args, "--"+f.Name+"="+f.Value.String())
+		}
+	})
+	return args
+}
+
+// cliCommands are administrative commands run by humans
+// Unlike hook events they don't read an event from stdin
+var cliCommands = map[string]func(args []string) error{
+	"install":     runInstall,
+	"uninstall":   runUninstall,
+	"mcp":         runMCP,
+	"migrate":     runMigrate,
+	"init":        runInit,
+	"daemon":      runDaemon,
+	"backup":      runBackup,
+	"restore":     runRestore,
+	"replicate":   runReplicate,
+	"db":          runDB,
+	"doctor":      runDoctor,
+	"audit":       runAudit,
+	"task":        runTask,
+	"project":     runProject,
+	"budget":      runBudget,
+	"run":         runRun,
+	"queue":       runQueue,
+	"github":      runGitHub,
+	"tracker":     runTracker,
+	"board":       runBoard,
+	"webhook":     runNotify,
+	"notify":      runNotify,
+	"rules":       runRules,
+	"org":         runOrg,
+	"config":      runConfig,
+	"status":      runStatus,
+	"stats":       runStats,
+	"serve":       runServe,
+	"token":       runToken,
+	"user":        runUser,
+	"version":     runVersion,
+	"self-update": runSelfUpdate,
+	"simulate":    runSimulate,
 }
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Fprintln(os.Stderr, "Usage: nerv-hook <command>")
-		fmt.Fprintln(os.Stderr, "Commands: pre-tool-use, post-tool-use, stop")
+	protocolName := flag.String("protocol", "claude", "hook wire format: claude, cursor, openhands, or aider")
+	flag.StringVar(&configPath, "config", configPath, "permissions file (default under NERV_DIR or ~/.nerv)")
+	flag.StringVar(&dbPath, "db", dbPath, "SQLite state database (default under NERV_DIR or ~/.nerv)")
+	verbose := flag.Bool("v", false, "trace config layers, signatures and decisions to stderr (or NERV_DEBUG=1)")
+	veryVerbose := flag.Bool("vv", false, "also trace every rule tried and whether it matched (or NERV_DEBUG=2)")
+	flag.Parse()
+	startTrace(*verbose, *veryVerbose)
+
+	if flag.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: nerv-hook [-v|-vv] [--protocol name] [--config path] [--db path] <command>")
+		fmt.Fprintln(os.Stderr, "Hook events: pre-tool-use, post-tool-use, session-start, user-prompt-submit, stop")
+		fmt.Fprintln(os.Stderr, "Commands: version, self-update, init, install, uninstall, daemon, mcp, migrate, backup, restore, replicate, db, doctor, audit, task, project, run, queue, budget, github, tracker, board, notify, webhook, rules, org, config, status, stats, serve, token, user, simulate")
 		os.Exit(1)
 	}
 
-	command := os.Args[1]
+	command := flag.Arg(0)
+
+	if run, ok := cliCommands[command]; ok {
+		traceConfig(loadConfig())
+		if err := run(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	// Read JSON input from stdin
-	inputData, err := io.ReadAll(os.Stdin)
+	switch command {
+	case "pre-tool-use", "post-tool-use", "session-start", "user-prompt-submit", "stop":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
+		os.Exit(1)
+	}
+
+	protocol, err := lookupProtocol(*protocolName)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read stdin: %v\n", err)
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
+	// NERV_PPROF and NERV_TIMINGS write profiles and phase timings to debugDir
+	stopProfile := startProfile(command)
+	startTimings()
+
+	done := timings.phase("config")
+	cfg := loadConfig()
+	done()
+	traceConfig(cfg)
+
+	// Read JSON input from stdin; an event too large to handle is refused like a malformed one
 	var input HookInput
-	if len(inputData) > 0 {
-		if err := json.Unmarshal(inputData, &input); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to parse input JSON: %v\n", err)
+	done = timings.phase("read")
+	inputData, inputErr := readHookInput(os.Stdin, cfg.Input.maxBytes())
+	done()
+	done = timings.phase("parse")
+	if inputErr == nil {
+		input, inputErr = protocol.ParseInput(command, inputData)
+	}
+	if inputErr == nil {
+		inputErr = validateHookInput(command, input)
+	}
+	done()
+	if inputErr != nil {
+		fmt.Fprintf(os.Stderr, "Rejected hook input: %v\n", inputErr)
+		// Only pre-tool-use can refuse the tool; elsewhere just fail the hook
+		if command != "pre-tool-use" {
 			os.Exit(1)
 		}
 	}
 
-	// Get environment variables
-	projectID := os.Getenv("NERV_PROJECT_ID")
-	taskID := os.Getenv("NERV_TASK_ID")
+	if input.Cwd == "" {
+		input.Cwd, _ = os.Getwd()
+	}
 
-	// Open database
-	db, err := openDatabase()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
-		// Continue without database - just log to stderr
+	// A harmless read needs no database when reads aren't audited
+	output, fast := HookOutput{}, false
+	if command == "pre-tool-use" && inputErr == nil {
+		output, fast = fastReadDecision(cfg, input)
+	}
+
+	// NERV_PROJECT_ID wins; otherwise the project is derived from the working directory
+	var projectID, taskID string
+	if !fast {
+		done = timings.phase("project_lookup")
+		projectID = lookupProjectID()
+		done()
+		taskID = os.Getenv("NERV_TASK_ID")
+		input.RunID = os.Getenv("NERV_RUN_ID")
 	}
-	defer func() {
-		if db != nil {
-			db.Close()
+
+	// Hand the event to nervd when it's running; otherwise handle it here
+	// A traced event is always handled here, so the trace shows every step
+	daemonErr := errDaemonUnavailable
+	if fast {
+		daemonErr = nil
+	} else if traceLevel > 0 {
+		tracef(1, "%s: handled by this process rather than nervd, for the trace", command)
+	} else if inputErr == nil {
+		done = timings.phase("daemon")
+		// A hook killed while nervd waits on an approval hangs up, and nervd cancels it
+		ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		output, daemonErr = callDaemon(ctx, socketPath, daemonRequest{
+			Event:           command,
+			ProjectID:       projectID,
+			TaskID:          taskID,
+			ProtocolVersion: input.ProtocolVersion,
+			RunID:           input.RunID,
+			Input:           input,
+		})
+		stopSignals()
+		done()
+		if errors.Is(daemonErr, errDaemonLost) {
+			fmt.Fprintf(os.Stderr, "nervd request failed: %v\n", daemonErr)
+		} else if daemonErr != nil && daemonErr != errDaemonUnavailable {
+			fmt.Fprintf(os.Stderr, "nervd request failed, handling event locally: %v\n", daemonErr)
 		}
-	}()
+	}
+	if errors.Is(daemonErr, errDaemonLost) {
+		output = daemonLost(command)
+	} else if daemonErr != nil {
+		output = processEvent(command, projectID, taskID, input, inputErr)
+	}
+	traceDecision(command, input, output)
 
-	var output HookOutput
+	if problem := checkHookBinary(false); problem != "" {
+		output = binaryTampered(command, output, problem)
+	}
 
-	switch command {
-	case "pre-tool-use":
-		output = handlePreToolUse(db, projectID, taskID, input)
-	case "post-tool-use":
-		handlePostToolUse(db, projectID, taskID, input)
-		output = HookOutput{} // Empty response
-	case "stop":
-		handleStop(db, projectID, taskID, input)
-		output = HookOutput{} // Empty response
-	default:
-		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
+	output = applyTranscriptVisibility(output, cfg.transcriptVisibility(command))
+
+	// Write JSON output to stdout in the agent's format
+	outputData, err := protocol.FormatOutput(command, output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to format output: %v\n", err)
 		os.Exit(1)
 	}
-
-	// Write JSON output to stdout
-	outputData, _ := json.Marshal(output)
 	fmt.Println(string(outputData))
+
+	stopProfile()
+	timings.write(command, input.ToolName)
 }
 
-// openDatabase opens the NERV SQLite database
-func openDatabase() (*sql.DB, error) {
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("database not found: %s", dbPath)
+// daemonLost is the output for an event nervd took but didn't answer
+// nervd may still be handling it, so a tool call is denied rather than checked again
+func daemonLost(command string) HookOutput {
+	if command != "pre-tool-use" {
+		return HookOutput{}
 	}
+	return HookOutput{Decision: &Decision{Behavior: "deny", Message: "NERV lost track of this call before deciding it; try again"}}
+}
 
-	db, err := sql.Open("sqlite", dbPath+"?mode=rw")
+// processEvent opens the database and handles one event in this process
+// inputErr is set when the event failed validation and must be refused
+func processEvent(command, projectID, taskID string, input HookInput, inputErr error) HookOutput {
+	// Open database
+	var db Store
+	done := timings.phase("db_open")
+	st, err := openStore()
+	done()
 	if err != nil {
-		return nil, err
+		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+		// A database a newer release migrated may be misread, so nothing runs against it
+		var tooNew *migrations.TooNewError
+		if command == "pre-tool-use" && errors.As(err, &tooNew) {
+			return HookOutput{Decision: &Decision{
+				Behavior: "deny",
+				Message:  fmt.Sprintf("NERV's state database was upgraded by a newer release (schema version %d, this nerv-hook supports %d), so every tool call is denied. Ask the user to upgrade nerv-hook", tooNew.Current, tooNew.Latest),
+			}}
+		}
+		// The strict profile runs nothing it can't record
+		if command == "pre-tool-use" && checkConfigIntegrity(nil).strict() {
+			return HookOutput{Decision: &Decision{
+				Behavior: "deny",
+				Message:  "NERV's strict profile denies tool calls while its database is unavailable. Ask the user to run nerv-hook doctor",
+			}}
+		}
+		// Continue without database - just log to stderr
+	} else {
+		router := newStoreRouter(st)
+		defer router.Close()
+		// The event's audit rows go in one transaction when it's handled
+		audit := bufferAudit(router.forProject(projectID))
+		defer func() {
+			defer timings.phase("audit_flush")()
+			audit.Flush()
+		}()
+		db = withProtocolVersion(audit, input.ProtocolVersion)
 	}
 
-	// Enable WAL mode and foreign keys
-	db.Exec("PRAGMA journal_mode = WAL")
-	db.Exec("PRAGMA foreign_keys = ON")
+	if inputErr != nil {
+		// Malformed input would build an empty signature that matches no rule, so refuse it
+		logAudit(db, taskID, "input_rejected", fmt.Sprintf(`{"event":"%s","error":%q}`, command, inputErr.Error()))
+		return HookOutput{
+			Decision: &Decision{
+				Behavior: "deny",
+				Message:  fmt.Sprintf("NERV rejected malformed hook input: %v", inputErr),
+			},
+		}
+	}
 
-	return db, nil
+	done = timings.phase("handle")
+	defer done()
+	return handleEvent(db, command, projectID, taskID, input)
+}
+
+// handleEvent runs the handler for a validated hook event
+// Shared by the in-process path and nervd
+func handleEvent(db Store, command, projectID, taskID string, input HookInput) HookOutput {
+	linkRunSession(db, input)
+	projectID, taskID = attributeSession(db, projectID, taskID, input)
+	trackSession(db, command, projectID, taskID, input)
+
+	switch command {
+	case "pre-tool-use":
+		return anomalyAlerts(db, projectID, taskID, input, handlePreToolUse(db, projectID, taskID, input))
+	case "post-tool-use":
+		return handlePostToolUse(db, projectID, taskID, input)
+	case "session-start":
+		return handleSessionStart(db, taskID, input)
+	case "user-prompt-submit":
+		return handleUserPromptSubmit(db, taskID, input)
+	case "stop":
+		handleStop(db, projectID, taskID, input)
+		return redirectReport(input)
+	}
+	return HookOutput{} // Empty response
 }
 
 // handlePreToolUse handles PreToolUse hook events
 // Returns a decision to allow, deny, or block the tool use
-func handlePreToolUse(db *sql.DB, projectID, taskID string, input HookInput) HookOutput {
+func handlePreToolUse(db Store, projectID, taskID string, input HookInput) HookOutput {
 	toolName := input.ToolName
 	toolInputJSON, _ := json.Marshal(input.ToolInput)
 	toolInputStr := string(toolInputJSON)
+	// What's stored keeps large fields short; rules still see the whole input
+	storedInput := storedToolInput(toolName, input.ToolInput, loadConfig().Input.maxFieldBytes())
+
+	// A decoy is never touched by accident, so it's caught before anything else
+	if decoy := tripwire(loadConfig().Tripwires, toolName, input.ToolInput, input.Cwd); decoy != "" {
+		return trippedOutput(db, taskID, decoy, input)
+	}
+
+	// A halted session stays halted, even if the agent is resumed
+	if sessionHalted(db, input.SessionID) {
+		output := stopSession(haltedStopReason())
+		output.Decision = &Decision{
+			Behavior: "deny",
+			Message:  haltedStopReason(),
+		}
+		return output
+	}
+
+	// A budget that's been used up refuses every tool, even ones the rules allow
+	if message, stop := checkBudgets(db, projectID, taskID, input); message != "" {
+		logAudit(db, taskID, "budget_exceeded", fmt.Sprintf(`{"tool":%q,"session_id":%q,"message":%q}`, toolName, input.SessionID, message))
+		output := HookOutput{Decision: &Decision{Behavior: "deny", Message: message}}
+		if stop {
+			output.Continue = stopSession(message).Continue
+			output.StopReason = message
+		}
+		return output
+	}
+	if db != nil && input.SessionID != "" {
+		if err := db.CountToolCall(input.SessionID); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to count the tool call: %v\n", err)
+		}
+	}
+	// A session calling tools faster than a rate limit allows is asked about or denied
+	rateLimit, rateDeny := checkRateLimits(db, input.SessionID, toolName, loadConfig().RateLimits)
+	if rateLimit != "" {
+		logAudit(db, taskID, "rate_limited", fmt.Sprintf(`{"tool":%q,"session_id":%q,"message":%q,"deny":%t}`, toolName, input.SessionID, rateLimit, rateDeny))
+	}
+
+	// Rewrite rules fix a command's arguments first, so the checks below see what will run
+	rewritten := rewriteInput(db, taskID, loadConfig().Rewrites, input)
+	if rewritten != nil {
+		input.ToolInput = rewritten
+		toolInputJSON, _ = json.Marshal(rewritten)
+		toolInputStr = string(toolInputJSON)
+		storedInput = storedToolInput(toolName, rewritten, loadConfig().Input.maxFieldBytes())
+	}
 
 	// Check if this tool needs approval based on permissions
-	needsApproval, denyReason := checkPermission(toolName, toolInputStr)
+	done := timings.phase("permission_check")
+	// NERV's own state is off limits whatever the rules say
+	needsApproval, allowRule := false, ""
+	denyReason := selfProtection(toolName, input.ToolInput, input.Cwd)
+	if denyReason == "" {
+		denyReason = orgPolicyDenyReason()
+	}
+	if denyReason == "" {
+		denyReason = configSchemaDenyReason()
+	}
+	// Reads of sensitive files are asked about or denied whatever the rules say
+	sensitive, sensitiveAction := sensitiveFile(loadConfig().SensitiveFiles, toolName, input.ToolInput, input.Cwd)
+	if denyReason == "" && sensitiveAction == sensitiveDeny {
+		denyReason = sensitiveMessage(sensitive, toolName, input.ToolInput)
+	}
+	if denyReason == "" {
+		denyReason = checkConfigIntegrity(db).denyReason()
+	}
+	if denyReason == "" && rateDeny {
+		denyReason = rateLimit
+	}
+	// Writes outside the project go to the session's own directory instead, where only deny rules apply
+	var redirected map[string]interface{}
+	if denyReason == "" {
+		redirected, denyReason = redirectedInput(db, projectID, taskID, input, toolInputStr)
+	}
+	if denyReason == "" && redirected == nil {
+		needsApproval, denyReason, allowRule = cachedCheckPermission(db, projectID, taskID, input, toolInputStr)
+	}
+	if denyReason == "" && (rateLimit != "" || sensitiveAction == sensitiveAsk) {
+		needsApproval, allowRule = true, ""
+	}
+	// Plugins add a team's own checks; they can ask about a call or deny it, never allow more
+	var pluginNote string
+	if denyReason == "" {
+		var pluginAsk bool
+		pluginAsk, denyReason, pluginNote = checkPlugins(db, projectID, taskID, input, toolInputStr, loadConfig().Plugins)
+		if pluginAsk {
+			needsApproval, allowRule = true, ""
+		}
+	}
+	// Commands the sandbox takes run in a container, or not at all
+	var sandboxed map[string]interface{}
+	if denyReason == "" {
+		sandboxed, denyReason = sandboxedInput(loadConfig().Sandbox, toolName, input.ToolInput, input.Cwd)
+	}
+	done()
+	// An allowed call runs with whatever input replaces its own
+	updated, updateNote := rewritten, "running the command as rewritten"
+	if sandboxed != nil {
+		updated, updateNote = sandboxed, "running this command in a container"
+	}
+	if redirected != nil {
+		updated, updateNote = redirected, "redirecting this file outside the project to "+redirected[redirectTools[toolName].key].(string)
+	}
 
 	if denyReason != "" {
-		// Explicitly denied by rule
-		logAudit(db, taskID, "tool_denied", fmt.Sprintf(`{"tool":"%s","reason":"%s"}`, toolName, denyReason))
-		return HookOutput{
-			Decision: &Decision{
-				Behavior: "deny",
-				Message:  denyReason,
-			},
+		// Explicitly denied by rule; the input is kept so nerv-hook rules replay can re-check the call
+		logAudit(db, taskID, "tool_denied", fmt.Sprintf(`{"tool":%q,"reason":%q,"input":%s,"session_id":%q}`, toolName, denyReason, storedInput, input.SessionID))
+		runScripts(db, scriptEvent{Outcome: outcomeDeny, ToolName: toolName, ToolInput: json.RawMessage(storedInput), Reason: denyReason,
+			SessionID: input.SessionID, TaskID: taskID, ProjectID: projectID, Cwd: input.Cwd})
+		decision := &Decision{
+			Behavior: "deny",
+			Message:  denyReason,
 		}
+
+		// Hard policy trip: stop the session rather than let the agent keep probing
+		halted := consecutiveDenials(db, input.SessionID, criticalDenialLimit) >= criticalDenialLimit
+		// A session that keeps being denied is escalated, if a circuit breaker is configured
+		breaker, stop := tripCircuitBreaker(db, taskID, input, policy.Signature(toolName, storedInput))
+		notice := joinNotices(rateLimit, breaker)
+		if halted {
+			logAudit(db, taskID, "session_halted", fmt.Sprintf(`{"session_id":"%s","denials":%d}`, input.SessionID, criticalDenialLimit))
+			output := stopSession(haltedStopReason())
+			output.Decision = decision
+			output.SystemMessage = notice
+			return output
+		}
+		if stop {
+			output := stopSession(breaker)
+			output.Decision = decision
+			output.SystemMessage = notice
+			return output
+		}
+
+		// A rate limit or tripped breaker is also shown to the user, who may want to look at what the agent is doing
+		return HookOutput{Decision: decision, SystemMessage: notice}
 	}
 
 	if needsApproval {
-		// Queue approval request and wait for decision
-		approvalID := queueApproval(db, taskID, toolName, toolInputStr, "")
-		if approvalID <= 0 {
-			// Failed to queue, just allow (fail open for now)
-			logAudit(db, taskID, "approval_queue_failed", fmt.Sprintf(`{"tool":"%s"}`, toolName))
-			return HookOutput{}
+		// What made the call risky, for the scripts run if it's allowed anyway
+		exposure := exposureNote(toolName, input.ToolInput)
+		risks := riskNotes(exposure, sensitiveNote(sensitive, sensitiveAction), pluginNote)
+		scriptFor := func(outcome string, approvalID int64, reason string) scriptEvent {
+			return scriptEvent{Outcome: outcome, ToolName: toolName, ToolInput: json.RawMessage(storedInput), Reason: reason, Risks: risks,
+				ApprovalID: approvalID, SessionID: input.SessionID, TaskID: taskID, ProjectID: projectID, Cwd: input.Cwd}
 		}
 
-		logAudit(db, taskID, "approval_requested", fmt.Sprintf(`{"approval_id":%d,"tool":"%s"}`, approvalID, toolName))
+		// The agent may have asked ahead via nerv_request_permission
+		if preApprovalID := findPreApproval(db, taskID, toolName, storedInput); preApprovalID > 0 {
+			logAudit(db, taskID, "approval_reused", fmt.Sprintf(`{"approval_id":%d,"tool":"%s","session_id":"%s"}`, preApprovalID, toolName, input.SessionID))
+			if len(risks) > 0 {
+				runScripts(db, scriptFor(outcomeHighRiskAllow, preApprovalID, ""))
+			}
+			return updatedOutput(HookOutput{
+				Decision: &Decision{
+					Behavior: "allow",
+				},
+			}, updated, updateNote)
+		}
+
+		// A session or project with too many requests waiting can't add more
+		if message := pendingLimit(db, projectID, input.SessionID); message != "" {
+			return refusePending(db, taskID, projectID, toolName, input.SessionID, message)
+		}
+
+		// Queue approval request and wait for decision
+		done = timings.phase("preview")
+		preview := previewNote(toolName, input.ToolInput, input.Cwd)
+		done()
+		risk := approvalRisk(toolName, risks)
+		approvalID, err := queueApproval(db, taskID, input.SessionID, toolName, storedInput, joinContext(rateLimit, sensitiveNote(sensitive, sensitiveAction), pluginNote, exposure, preview, approvalNotes(db, taskID)), risk, func(id int64) string {
+			return fmt.Sprintf(`{"approval_id":%d,"tool":"%s","session_id":"%s","risk":"%s"}`, id, toolName, input.SessionID, risk)
+		})
+		if err != nil {
+			return updatedOutput(approvalQueueFailed(db, taskID, toolName, input.SessionID, err), updated, updateNote)
+		}
 
 		// Poll for decision (wait up to 10 minutes, user can take their time)
-		decision, denyReason := pollForDecision(db, approvalID, 10*time.Minute)
+		done = timings.phase("approval_wait")
+		// A hook interrupted while it waits cancels the approval and denies the call,
+		// rather than leaving a pending approval no one is waiting for
+		ctx, stopSignals := waitContext(db)
+		decision, denyReason := pollForDecision(ctx, db, approvalID, 10*time.Minute)
+		stopSignals()
+		done()
 
 		switch decision {
 		case "approved":
 			logAudit(db, taskID, "approval_granted", fmt.Sprintf(`{"approval_id":%d}`, approvalID))
-			return HookOutput{
+			if len(risks) > 0 {
+				runScripts(db, scriptFor(outcomeHighRiskAllow, approvalID, ""))
+			}
+			return updatedOutput(HookOutput{
 				Decision: &Decision{
 					Behavior: "allow",
 				},
+			}, updated, updateNote)
+		case approvals.Cancelled:
+			// The cancellation was audited when it was recorded
+			return HookOutput{
+				Decision: &Decision{
+					Behavior: "deny",
+					Message:  denyReason,
+				},
 			}
 		case "denied":
 			logAudit(db, taskID, "approval_denied", fmt.Sprintf(`{"approval_id":%d,"reason":"%s"}`, approvalID, denyReason))
+			runScripts(db, scriptFor(outcomeDeny, approvalID, denyReason))
 			return HookOutput{
 				Decision: &Decision{
 					Behavior: "deny",
@@ -192,6 +607,7 @@ func handlePreToolUse(db *sql.DB, projectID, taskID string, input HookInput) Hoo
 		default:
 			// Timeout or error - deny by default
 			logAudit(db, taskID, "approval_timeout", fmt.Sprintf(`{"approval_id":%d}`, approvalID))
+			runScripts(db, scriptFor(outcomeTimeout, approvalID, "Approval request timed out"))
 			return HookOutput{
 				Decision: &Decision{
 					Behavior: "deny",
@@ -202,239 +618,503 @@ func handlePreToolUse(db *sql.DB, projectID, taskID string, input HookInput) Hoo
 	}
 
 	// Auto-approved (safe tool or matches allow rule)
-	return HookOutput{}
+	return updatedOutput(HookOutput{
+		SystemMessage: autoAllowMessage(allowRule, countPendingApprovals(db)),
+	}, updated, updateNote)
+}
+
+// exposureNote highlights the secrets a Bash command would reveal from the environment,
+// so whoever decides the approval sees why it was asked for
+func exposureNote(toolName string, toolInput map[string]interface{}) string {
+	if toolName != "Bash" {
+		return ""
+	}
+	command, _ := toolInput["command"].(string)
+	exposed := policy.EnvExposure(command)
+	if len(exposed) == 0 {
+		return ""
+	}
+	return "Possible secret exfiltration, this command reveals: " + strings.Join(exposed, ", ")
+}
+
+// joinContext joins the non-empty parts of an approval's context with blank lines
+func joinContext(parts ...string) string {
+	var kept []string
+	for _, p := range parts {
+		if p != "" {
+			kept = append(kept, p)
+		}
+	}
+	return strings.Join(kept, "\n\n")
+}
+
+// autoAllowMessage builds the user-facing note for an auto-approved tool use
+// Returns an empty string when there is nothing worth telling the user
+func autoAllowMessage(allowRule string, pending int) string {
+	var parts []string
+	if allowRule != "" {
+		parts = append(parts, fmt.Sprintf("auto-allowed by rule %s", allowRule))
+	}
+	switch {
+	case pending == 1:
+		parts = append(parts, "1 approval pending")
+	case pending > 1:
+		parts = append(parts, fmt.Sprintf("%d approvals pending", pending))
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+	return "NERV: " + strings.Join(parts, ", ")
 }
 
 // handlePostToolUse handles PostToolUse hook events
 // Used for logging and formatters
-func handlePostToolUse(db *sql.DB, projectID, taskID string, input HookInput) {
+func handlePostToolUse(db Store, projectID, taskID string, input HookInput) HookOutput {
 	toolName := input.ToolName
-	toolInputJSON, _ := json.Marshal(input.ToolInput)
+	toolInput := storedToolInput(toolName, input.ToolInput, loadConfig().Input.maxFieldBytes())
+
+	details := fmt.Sprintf(`{"tool":"%s","input":%s,"session_id":"%s"}`, toolName, toolInput, input.SessionID)
+	// Test runs keep their outcome and the end of their output for the review bundle
+	if run := toolTestRun(input); run != nil {
+		testJSON, _ := json.Marshal(run)
+		details = strings.TrimSuffix(details, "}") + `,"test":` + string(testJSON) + "}"
+	}
+	logAudit(db, taskID, "tool_completed", details)
+
+	if sessionHalted(db, input.SessionID) {
+		return stopSession(haltedStopReason())
+	}
+
+	return HookOutput{}
+}
+
+// stopSession returns an output that terminates the Claude session
+func stopSession(reason string) HookOutput {
+	cont := false
+	return HookOutput{
+		Continue:   &cont,
+		StopReason: reason,
+	}
+}
+
+// haltedStopReason is the stop reason shown for sessions halted by a policy trip
+func haltedStopReason() string {
+	return "NERV stopped this session after it kept running into denied tool calls. Review the task before starting a new session."
+}
+
+// consecutiveDenials counts the rule denials at the tail of a session's audit trail
+// Looks at no more than limit events
+func consecutiveDenials(db Store, sessionID string, limit int) int {
+	if db == nil || sessionID == "" {
+		return 0
+	}
+
+	events, err := db.SessionEvents(sessionID, limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to query denials: %v\n", err)
+		return 0
+	}
+
+	count := 0
+	for _, eventType := range events {
+		if eventType != "tool_denied" {
+			break
+		}
+		count++
+	}
+
+	return count
+}
+
+// sessionHalted reports whether a session was already stopped by a policy trip
+func sessionHalted(db Store, sessionID string) bool {
+	if db == nil || sessionID == "" {
+		return false
+	}
+
+	halted, err := db.SessionHalted(sessionID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to query session state: %v\n", err)
+	}
 
-	logAudit(db, taskID, "tool_completed", fmt.Sprintf(`{"tool":"%s","input":%s}`, toolName, string(toolInputJSON)))
+	return halted
 }
 
 // handleStop handles Stop hook events
 // Updates task status when Claude session ends
-func handleStop(db *sql.DB, projectID, taskID string, input HookInput) {
+func handleStop(db Store, projectID, taskID string, input HookInput) {
 	logAudit(db, taskID, "session_stop", fmt.Sprintf(`{"reason":"%s"}`, input.StopReason))
+	recordTranscriptUsage(db, input)
 
 	if db == nil || taskID == "" {
 		return
 	}
 
-	// Update task status to 'review' when Claude stops
-	_, err := db.Exec(
-		"UPDATE tasks SET status = 'review' WHERE id = ? AND status = 'in_progress'",
-		taskID,
-	)
+	recordBranchHead(db, taskID)
+
+	// An in-progress task goes to review, or to blocked if its verification fails;
+	// the state machine leaves any other status alone
+	to := verifyOnStop(db, projectID, taskID)
+	moved, err := db.SetTaskStatus(taskID, store.TaskInProgress, to, "hook")
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to update task status: %v\n", err)
 	}
+	if moved && to == store.TaskReview {
+		recordReviewBundle(db, taskID)
+		recordDraftPR(db, taskID)
+	}
 }
 
-// checkPermission checks if a tool use needs approval or should be denied
-// Returns (needsApproval, denyReason)
-func checkPermission(toolName, toolInput string) (bool, string) {
-	// Load permission rules
-	permissions := loadPermissions()
-
-	// Build the tool signature for matching
-	toolSignature := buildToolSignature(toolName, toolInput)
-
-	// Check deny rules first
-	for _, rule := range permissions.Deny {
-		if matchesRule(rule, toolSignature) {
-			return false, fmt.Sprintf("Blocked by rule: %s", rule)
+// recordBranchHead stores the commit the task's branch points at, so review sees exactly what the session left
+func recordBranchHead(db Store, taskID string) {
+	task, err := db.GetTask(taskID)
+	if err != nil || task.Branch == "" {
+		return
+	}
+	dir := task.WorktreePath
+	if dir == "" {
+		if dir, err = os.Getwd(); err != nil {
+			return
 		}
 	}
 
-	// Check allow rules
-	for _, rule := range permissions.Allow {
-		if matchesRule(rule, toolSignature) {
-			return false, "" // Allowed, no approval needed
-		}
+	sha, err := branchHead(dir, task.Branch)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the head of %s: %v\n", task.Branch, err)
+		return
 	}
+	if sha == task.BranchHead {
+		return
+	}
+	if err := db.SetTaskBranchHead(taskID, sha); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record the branch head: %v\n", err)
+		return
+	}
+	logAudit(db, taskID, "branch_head_recorded", fmt.Sprintf(`{"branch":%q,"sha":%q}`, task.Branch, sha))
+}
 
-	// Default: needs approval for potentially dangerous tools
-	dangerousTools := map[string]bool{
-		"Bash":        true,
-		"Write":       true,
-		"Edit":        true,
-		"NotebookEdit": true,
+// trackSession records the event against its session for time tracking
+func trackSession(db Store, command, projectID, taskID string, input HookInput) {
+	if db == nil || input.SessionID == "" {
+		return
 	}
+	sess := store.Session{ID: input.SessionID, ProjectID: projectID, TaskID: taskID, TranscriptPath: input.TranscriptPath}
+	if err := db.TouchSession(sess, time.Now(), command == "stop"); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record session activity: %v\n", err)
+	}
+}
 
-	if dangerousTools[toolName] {
-		return true, ""
+// attributeSession fills in the project and task for an event that came without them,
+// as when a session was started by hand without NERV_TASK_ID
+// A session keeps the task it was first seen with; until it has one, the task is
+// taken from the in-progress task whose worktree or branch the agent is working in
+func attributeSession(db Store, projectID, taskID string, input HookInput) (string, string) {
+	if db == nil || input.SessionID == "" || (projectID != "" && taskID != "") {
+		return projectID, taskID
 	}
 
-	// Safe tools (Read, Grep, Glob, etc.) - auto-allow
-	return false, ""
-}
+	sess, err := db.GetSession(input.SessionID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		fmt.Fprintf(os.Stderr, "Failed to load the session: %v\n", err)
+		return projectID, taskID
+	}
+	if projectID == "" {
+		projectID = sess.ProjectID
+	}
+	if taskID == "" {
+		taskID = sess.TaskID
+	}
+	if taskID != "" {
+		return projectID, taskID
+	}
 
-// Permissions represents the permission configuration
-type Permissions struct {
-	Allow []string `json:"allow"`
-	Deny  []string `json:"deny"`
+	task, source := taskForCheckout(db, projectID, input.Cwd)
+	if task.ID == "" {
+		return projectID, taskID
+	}
+	if projectID == "" {
+		projectID = task.ProjectID
+	}
+	logAudit(db, task.ID, "session_attributed", fmt.Sprintf(`{"session_id":%q,"source":%q,"cwd":%q}`, input.SessionID, source, input.Cwd))
+	return projectID, task.ID
 }
 
-// loadPermissions loads permission rules from config file
-func loadPermissions() Permissions {
-	defaultPerms := Permissions{
-		Allow: []string{
-			"Read",
-			"Grep",
-			"Glob",
-			"LS",
-			"Bash(npm test:*)",
-			"Bash(npm run:*)",
-			"Bash(git log:*)",
-			"Bash(git diff:*)",
-			"Bash(git status)",
-		},
-		Deny: []string{
-			// Critical system protection (PRD Section 7)
-			"Bash(rm -rf /)",
-			"Bash(rm -rf /*)",
-			"Bash(sudo:*)",
-			"Read(~/.ssh/*)",
-			// Git safety - require explicit approval (PRD Section 25)
-			"Bash(git push:*)",
-			"Bash(git checkout:*)",
-			"Bash(git reset:*)",
-			"Bash(git rebase:*)",
-			// NERV state protection (PRD Section 22)
-			"Read(~/.nerv/*)",
-			"Write(~/.nerv/*)",
-			"Edit(~/.nerv/*)",
-			"Bash(nerv-hook:*)",
-			"Bash(*~/.nerv*)",
-		},
+// taskForCheckout finds the in-progress task being worked on in dir: the one with
+// a worktree containing dir, or else the only one whose branch dir has checked out
+// source says which matched; the task is empty if none did
+func taskForCheckout(db Store, projectID, dir string) (task store.Task, source string) {
+	if dir == "" {
+		return task, ""
+	}
+	tasks, err := db.ListTasks(store.TaskFilter{ProjectID: projectID, Status: store.TaskInProgress})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list tasks: %v\n", err)
+		return task, ""
 	}
 
-	data, err := os.ReadFile(configPath)
+	byBranch := map[string][]store.Task{}
+	for _, t := range tasks {
+		if t.WorktreePath != "" && withinDir(dir, t.WorktreePath) {
+			return t, "worktree"
+		}
+		if t.Branch != "" {
+			byBranch[t.Branch] = append(byBranch[t.Branch], t)
+		}
+	}
+	// A task spanning several repos has a worktree in each
+	for _, t := range tasks {
+		if t.Repos == "" {
+			continue
+		}
+		for _, w := range taskWorktrees(db, t.ID) {
+			if withinDir(dir, w.Path) {
+				return t, "worktree"
+			}
+		}
+	}
+	if len(byBranch) == 0 {
+		return task, ""
+	}
+	branch, err := git(dir, "rev-parse", "--abbrev-ref", "HEAD")
 	if err != nil {
-		return defaultPerms
+		return task, ""
 	}
+	if matches := byBranch[branch]; len(matches) == 1 {
+		return matches[0], "branch"
+	}
+	return task, ""
+}
 
-	var perms Permissions
-	if err := json.Unmarshal(data, &perms); err != nil {
-		return defaultPerms
+// withinDir reports whether path is root or inside it
+func withinDir(path, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// linkRunSession records which agent session a launched run turned into
+func linkRunSession(db Store, input HookInput) {
+	if db == nil || input.RunID == "" || input.SessionID == "" {
+		return
 	}
+	runID, err := strconv.ParseInt(input.RunID, 10, 64)
+	if err != nil {
+		return
+	}
+	if err := db.LinkRunSession(runID, input.SessionID); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to link run %d to its session: %v\n", runID, err)
+	}
+}
 
-	return perms
+// approvalRisk rates a call that needs approval, so an approver can be limited
+// to the ones they're trusted with: high if anything made it risky (see
+// riskNotes), medium for tools that run commands or change files, low otherwise
+func approvalRisk(toolName string, risks []string) string {
+	switch {
+	case len(risks) > 0:
+		return approvals.RiskHigh
+	case policy.RequiresApproval(toolName):
+		return approvals.RiskMedium
+	default:
+		return approvals.RiskLow
+	}
 }
 
-// buildToolSignature builds a string signature for matching against rules
-func buildToolSignature(toolName, toolInput string) string {
-	// For Bash commands, extract the command
-	if toolName == "Bash" {
-		var input map[string]interface{}
-		if err := json.Unmarshal([]byte(toolInput), &input); err == nil {
-			if cmd, ok := input["command"].(string); ok {
-				return fmt.Sprintf("Bash(%s)", cmd)
-			}
-		}
+// queueApproval inserts an approval request and its approval_requested audit entry
+// in one transaction, so an approval never exists without its audit trail
+// auditDetails builds the audit details once the approval ID is known
+func queueApproval(db Store, taskID, sessionID, toolName, toolInput, context, risk string, auditDetails func(approvalID int64) string) (int64, error) {
+	if db == nil {
+		return 0, errors.New("database not available")
 	}
 
-	// For file operations, extract the path
-	if toolName == "Read" || toolName == "Write" || toolName == "Edit" {
-		var input map[string]interface{}
-		if err := json.Unmarshal([]byte(toolInput), &input); err == nil {
-			if path, ok := input["file_path"].(string); ok {
-				return fmt.Sprintf("%s(%s)", toolName, path)
-			}
-		}
+	id, err := db.QueueApproval(store.Approval{
+		TaskID:    taskID,
+		SessionID: sessionID,
+		ToolName:  toolName,
+		ToolInput: toolInput,
+		Context:   context,
+		Risk:      risk,
+	}, auditDetails)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to insert approval: %v\n", err)
+		return 0, err
 	}
 
-	return toolName
+	return id, nil
 }
 
-// matchesRule checks if a tool signature matches a permission rule
-func matchesRule(rule, signature string) bool {
-	// Convert rule pattern to regex
-	// * matches any characters
-	// : is a separator for command prefixes
-	pattern := regexp.QuoteMeta(rule)
-	pattern = strings.ReplaceAll(pattern, `\*`, ".*")
-	pattern = strings.ReplaceAll(pattern, `\:`, ":")
-	pattern = "^" + pattern + "$"
+// approvalQueueFailed decides a tool whose approval request couldn't be queued
+// It's denied unless approvals are set to fail open, which the strict profile ignores;
+// either way the user is told the queue is broken
+func approvalQueueFailed(db Store, taskID, toolName, sessionID string, err error) HookOutput {
+	failClosed := loadConfig().Approvals.failClosed() || checkConfigIntegrity(db).strict()
+	logAudit(db, taskID, "approval_queue_failed", fmt.Sprintf(`{"tool":%q,"session_id":%q,"error":%q,"fail_closed":%t}`, toolName, sessionID, err.Error(), failClosed))
 
-	re, err := regexp.Compile(pattern)
-	if err != nil {
-		return false
+	notice := fmt.Sprintf("NERV: the approval queue is broken (%v); run nerv-hook doctor", err)
+	if !failClosed {
+		return HookOutput{SystemMessage: notice + ". " + toolName + " was allowed without approval"}
+	}
+	return HookOutput{
+		SystemMessage: notice,
+		Decision: &Decision{
+			Behavior: "deny",
+			Message:  fmt.Sprintf("NERV couldn't queue an approval request for %s, so it was denied. Ask the user to fix the NERV approval queue", toolName),
+		},
 	}
+}
+
+// pendingLimit returns why a new approval request is refused, or "" while the
+// session and project have fewer waiting than approvals settings allow
+func pendingLimit(db Store, projectID, sessionID string) string {
+	cfg := loadConfig().Approvals
+	if db == nil || cfg == nil || (cfg.MaxPendingPerSession == 0 && cfg.MaxPendingPerProject == 0) {
+		return ""
+	}
+	session, project, err := db.PendingApprovalsFor(sessionID, projectID)
+	switch {
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "Failed to count pending approvals: %v\n", err)
+	case sessionID != "" && cfg.MaxPendingPerSession > 0 && session >= cfg.MaxPendingPerSession:
+		return fmt.Sprintf("Too many pending requests: this session is at its limit of %d pending approvals", cfg.MaxPendingPerSession)
+	case projectID != "" && cfg.MaxPendingPerProject > 0 && project >= cfg.MaxPendingPerProject:
+		return fmt.Sprintf("Too many pending requests: this project is at its limit of %d pending approvals", cfg.MaxPendingPerProject)
+	}
+	return ""
+}
 
-	return re.MatchString(signature)
+// refusePending denies a call that needs approval because too many are
+// waiting, alerting the operator: a high-severity approval_backpressure audit
+// event, and a notice to the user
+func refusePending(db Store, taskID, projectID, toolName, sessionID, message string) HookOutput {
+	logAudit(db, taskID, "approval_backpressure", fmt.Sprintf(`{"tool":%q,"session_id":%q,"project_id":%q,"message":%q,"severity":"high"}`,
+		toolName, sessionID, projectID, message))
+	notice := "NERV: " + message + "; decide or deny them to let the agent go on"
+	fmt.Fprintln(os.Stderr, notice)
+	return HookOutput{
+		Decision:      &Decision{Behavior: "deny", Message: message + ". Wait for the pending ones to be decided before asking for more"},
+		SystemMessage: notice,
+	}
 }
 
-// queueApproval inserts an approval request into the database
-func queueApproval(db *sql.DB, taskID, toolName, toolInput, context string) int64 {
+// pollForDecision waits for an approval decision from the dashboard, checking less often the longer it waits
+// unless the decider touches the approval's marker in decisionsDir
+// If ctx is done first the approval is cancelled
+func pollForDecision(ctx context.Context, db Store, approvalID int64, timeout time.Duration) (string, string) {
 	if db == nil {
-		return 0
+		return "denied", "Database not available"
 	}
 
-	result, err := db.Exec(
-		"INSERT INTO approvals (task_id, tool_name, tool_input, context, status) VALUES (?, ?, ?, ?, 'pending')",
-		taskID, toolName, toolInput, context,
-	)
+	backoff, err := loadConfig().Approvals.backoff()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to insert approval: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Ignoring approvals settings: %v\n", err)
+		backoff = approvals.DefaultBackoff
+	}
+	// A decider that touches the approval's marker wakes the wait at once; polling covers the rest
+	wake, stop, err := watchDecision(approvalID)
+	if err == nil {
+		defer stop()
+	}
+	approval, err := approvals.WaitContext(ctx, db, approvalID, timeout, backoff, wake)
+	if err != nil && ctx.Err() != nil {
+		return cancelApproval(db, approvalID)
+	}
+	if err != nil {
+		return "timeout", "Approval request timed out"
+	}
+	return approval.Status, approval.DenyReason
+}
+
+// cancelApproval cancels an approval the hook stopped waiting for, returning
+// the decision that stands: cancelled, or whatever was decided just before
+func cancelApproval(db Store, approvalID int64) (string, string) {
+	const reason = "The hook was interrupted while waiting for approval"
+	approval, err := db.DecideApproval(approvalID, approvals.Cancelled, reason)
+	var conflict *approvals.ConflictError
+	switch {
+	case errors.As(err, &conflict):
+		return conflict.Current.Status, conflict.Current.DenyReason
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "Failed to cancel approval %d: %v\n", approvalID, err)
+		return approvals.Cancelled, reason
+	}
+	return approval.Status, approval.DenyReason
+}
+
+// countPendingApprovals returns the number of approvals waiting for a decision
+func countPendingApprovals(db Store) int {
+	if db == nil {
 		return 0
 	}
 
-	id, err := result.LastInsertId()
+	count, err := db.PendingApprovalCount()
 	if err != nil {
 		return 0
 	}
 
-	return id
+	return count
 }
 
-// pollForDecision waits for an approval decision from the dashboard
-func pollForDecision(db *sql.DB, approvalID int64, timeout time.Duration) (string, string) {
+// logAudit logs an event to the audit log
+func logAudit(db Store, taskID, eventType, details string) {
 	if db == nil {
-		return "denied", "Database not available"
+		return
 	}
 
-	deadline := time.Now().Add(timeout)
-	pollInterval := 200 * time.Millisecond
-
-	for time.Now().Before(deadline) {
-		var status, denyReason string
-		var decidedAt sql.NullString
+	if err := db.LogAudit(taskID, eventType, details); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to log audit event: %v\n", err)
+	}
+}
 
-		err := db.QueryRow(
-			"SELECT status, deny_reason, decided_at FROM approvals WHERE id = ?",
-			approvalID,
-		).Scan(&status, &denyReason, &decidedAt)
+// protocolTaggedStore tags the audit rows it writes with the protocol version of the event being handled
+type protocolTaggedStore struct {
+	Store
+	version string
+}
 
-		if err != nil {
-			time.Sleep(pollInterval)
-			continue
-		}
+// withProtocolVersion wraps db so audit rows record protocolVersion
+func withProtocolVersion(db Store, protocolVersion string) Store {
+	if db == nil || protocolVersion == "" {
+		return db
+	}
+	return protocolTaggedStore{Store: db, version: protocolVersion}
+}
 
-		if status != "pending" && decidedAt.Valid {
-			return status, denyReason
-		}
+func (s protocolTaggedStore) LogAudit(taskID, eventType, details string) error {
+	return s.Store.LogAudit(taskID, eventType, tagAuditDetails(details, s.version))
+}
 
-		time.Sleep(pollInterval)
+func (s protocolTaggedStore) LogAuditBatch(events []store.AuditEvent) error {
+	tagged := make([]store.AuditEvent, len(events))
+	for i, e := range events {
+		e.Details = tagAuditDetails(e.Details, s.version)
+		tagged[i] = e
 	}
+	return s.Store.LogAuditBatch(tagged)
+}
 
-	return "timeout", "Approval request timed out"
+func (s protocolTaggedStore) QueueApproval(a store.Approval, auditDetails func(approvalID int64) string) (int64, error) {
+	return s.Store.QueueApproval(a, func(approvalID int64) string {
+		return tagAuditDetails(auditDetails(approvalID), s.version)
+	})
 }
 
-// logAudit logs an event to the audit log
-func logAudit(db *sql.DB, taskID, eventType, details string) {
-	if db == nil {
-		return
+// tagAuditDetails adds the detected protocol version to a JSON details object
+// Details that aren't a JSON object are stored unchanged
+func tagAuditDetails(details, protocolVersion string) string {
+	if protocolVersion == "" {
+		return details
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(details), &fields); err != nil || fields == nil {
+		return details
 	}
+	fields["protocol"] = protocolVersion
 
-	_, err := db.Exec(
-		"INSERT INTO audit_log (task_id, event_type, details) VALUES (?, ?, ?)",
-		taskID, eventType, details,
-	)
+	tagged, err := json.Marshal(fields)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to log audit event: %v\n", err)
+		return details
 	}
+	return string(tagged)
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/migrations"
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// dbStats describes the on-disk state of a SQLite database
+type dbStats struct {
+	FileBytes int64
+	WALBytes  int64
+	Pages     int64
+	FreePages int64
+}
+
+// fragmentation is the share of pages on the freelist, which VACUUM reclaims
+func (s dbStats) fragmentation() float64 {
+	if s.Pages == 0 {
+		return 0
+	}
+	return float64(s.FreePages) / float64(s.Pages)
+}
+
+func (s dbStats) String() string {
+	return fmt.Sprintf("%s + %s WAL, %d pages, %.1f%% free",
+		formatBytes(s.FileBytes), formatBytes(s.WALBytes), s.Pages, s.fragmentation()*100)
+}
+
+// runDB implements `nerv-hook db maintain`
+func runDB(args []string) error {
+	if len(args) < 1 || args[0] != "maintain" {
+		return fmt.Errorf("usage: nerv-hook db maintain [--no-vacuum]")
+	}
+
+	fs := flag.NewFlagSet("db maintain", flag.ContinueOnError)
+	noVacuum := fs.Bool("no-vacuum", false, "skip VACUUM, which briefly locks out writers while it rewrites the file")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	st, err := openRawStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	if st.Dialect() != migrations.SQLite {
+		return fmt.Errorf("db maintain only applies to the SQLite state database; use your PostgreSQL maintenance tooling for NERV_DB_URL")
+	}
+
+	if err := maintainDatabase(st, !*noVacuum); err != nil {
+		return err
+	}
+
+	// Per-project databases grow the same way
+	projectDBs, _ := filepath.Glob(filepath.Join(nervDir, "projects", "*", "state.db"))
+	for _, path := range projectDBs {
+		project, err := store.OpenSQLite(path, "rw", dbOptions())
+		if err != nil {
+			return err
+		}
+		err = maintainDatabase(project, !*noVacuum)
+		project.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// maintainDatabase optionally vacuums, refreshes planner statistics, then
+// checkpoints and truncates the WAL, printing sizes before and after
+func maintainDatabase(st *store.DB, vacuum bool) error {
+	fmt.Println(st.Location())
+
+	before, err := databaseStats(st)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("  before:     %s\n", before)
+
+	start := time.Now()
+	if vacuum {
+		if _, err := st.SQL().Exec("VACUUM"); err != nil {
+			return fmt.Errorf("vacuum failed: %w", err)
+		}
+		fmt.Println("  vacuum:     done")
+	}
+
+	if _, err := st.SQL().Exec("ANALYZE"); err != nil {
+		return fmt.Errorf("analyze failed: %w", err)
+	}
+	fmt.Println("  analyze:    done")
+
+	// Last, since VACUUM and ANALYZE write through the WAL too
+	busy, err := st.Checkpoint()
+	if err != nil {
+		return fmt.Errorf("checkpoint failed: %w", err)
+	}
+	if busy {
+		fmt.Println("  checkpoint: incomplete, another connection is reading; run again when NERV is idle")
+	} else {
+		fmt.Println("  checkpoint: WAL truncated")
+	}
+
+	after, err := databaseStats(st)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("  after:      %s (%s)\n", after, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// databaseStats reads the page counts and file sizes of a SQLite database
+func databaseStats(st *store.DB) (dbStats, error) {
+	var stats dbStats
+	var err error
+	if stats.Pages, stats.FreePages, err = st.PageCounts(); err != nil {
+		return stats, err
+	}
+	if info, err := os.Stat(st.Location()); err == nil {
+		stats.FileBytes = info.Size()
+	}
+	if info, err := os.Stat(st.Location() + "-wal"); err == nil {
+		stats.WALBytes = info.Size()
+	}
+	return stats, nil
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. 1.5 MiB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+	"github.com/nerv/nerv-hook/pkg/approvals"
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// mcpProtocolVersion is the MCP revision this server speaks
+const mcpProtocolVersion = "2024-11-05"
+
+// mcpPermissionWait is how long nerv_request_permission blocks for a human decision
+// Shorter than the hook wait so MCP clients don't time out the call
+const mcpPermissionWait = 2 * time.Minute
+
+// mcpRequest is a JSON-RPC 2.0 request or notification
+type mcpRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// mcpResponse is a JSON-RPC 2.0 response
+type mcpResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *mcpError       `json:"error,omitempty"`
+}
+
+// mcpError is a JSON-RPC 2.0 error object
+type mcpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// mcpTool describes a tool in the tools/list response
+type mcpTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"inputSchema"`
+}
+
+// mcpContent is a text block in a tools/call result
+type mcpContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// mcpToolResult is the tools/call result
+type mcpToolResult struct {
+	Content []mcpContent `json:"content"`
+	IsError bool         `json:"isError,omitempty"`
+}
+
+// mcpTools lists the tools NERV exposes to the agent
+var mcpTools = []mcpTool{
+	{
+		Name:        "nerv_get_task",
+		Description: "Get the NERV task this session is working on (title, description, status, worktree, parent, and subtasks with progress).",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"task_id": map[string]interface{}{"type": "string", "description": "Task ID (defaults to the current task)"},
+			},
+		},
+	},
+	{
+		Name:        "nerv_create_subtask",
+		Description: "Split the current NERV task into smaller pieces of work: create a subtask of it. Subtasks inherit the task's notes and budgets, and the task's progress counts their completion.",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"title":       map[string]interface{}{"type": "string", "description": "Short title for the subtask"},
+				"description": map[string]interface{}{"type": "string", "description": "What the subtask should accomplish and how to tell it's done"},
+			},
+			"required": []string{"title"},
+		},
+	},
+	{
+		Name:        "nerv_list_constraints",
+		Description: "List the permission rules NERV enforces: denied patterns, auto-allowed patterns, and tools that need human approval.",
+		InputSchema: map[string]interface{}{"type": "object", "properties": map[string]interface{}{}},
+	},
+	{
+		Name:        "nerv_request_permission",
+		Description: "Ask a human for approval before attempting an action that needs it. Explain why in rationale. An approved request covers the matching tool call for 10 minutes.",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"tool_name":  map[string]interface{}{"type": "string", "description": "Tool you intend to call, e.g. Bash"},
+				"tool_input": map[string]interface{}{"type": "object", "description": "Input you intend to pass, e.g. {\"command\": \"git push\"}"},
+				"rationale":  map[string]interface{}{"type": "string", "description": "Why the action is needed"},
+			},
+			"required": []string{"tool_name", "tool_input", "rationale"},
+		},
+	},
+}
+
+// runMCP serves the NERV MCP tools over stdio until stdin closes
+func runMCP(args []string) error {
+	var db Store
+	if st, err := openStore(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+	} else {
+		router := newStoreRouter(st)
+		db = router.forProject(resolveProjectID(st))
+		defer router.Close()
+	}
+
+	return serveMCP(db, os.Getenv("NERV_TASK_ID"), os.Stdin, os.Stdout)
+}
+
+// serveMCP reads newline-delimited JSON-RPC messages from r and writes responses to w
+func serveMCP(db Store, taskID string, r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	encoder := json.NewEncoder(w)
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var req mcpRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			encoder.Encode(mcpResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &mcpError{Code: -32700, Message: "Parse error"}})
+			continue
+		}
+
+		// Notifications get no response
+		if len(req.ID) == 0 {
+			continue
+		}
+
+		resp := mcpResponse{JSONRPC: "2.0", ID: req.ID}
+		switch req.Method {
+		case "initialize":
+			resp.Result = map[string]interface{}{
+				"protocolVersion": mcpProtocolVersion,
+				"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+				"serverInfo":      map[string]interface{}{"name": "nerv", "version": "1.0.0"},
+			}
+		case "ping":
+			resp.Result = map[string]interface{}{}
+		case "tools/list":
+			resp.Result = map[string]interface{}{"tools": mcpTools}
+		case "tools/call":
+			var params struct {
+				Name      string                 `json:"name"`
+				Arguments map[string]interface{} `json:"arguments"`
+			}
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				resp.Error = &mcpError{Code: -32602, Message: "Invalid params"}
+				break
+			}
+			resp.Result = callMCPTool(db, taskID, params.Name, params.Arguments)
+		default:
+			resp.Error = &mcpError{Code: -32601, Message: fmt.Sprintf("Method not found: %s", req.Method)}
+		}
+
+		if err := encoder.Encode(resp); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// callMCPTool dispatches a tools/call request
+func callMCPTool(db Store, taskID, name string, args map[string]interface{}) mcpToolResult {
+	switch name {
+	case "nerv_get_task":
+		if id, ok := args["task_id"].(string); ok && id != "" {
+			taskID = id
+		}
+		return mcpGetTask(db, taskID)
+	case "nerv_create_subtask":
+		return mcpCreateSubtask(db, taskID, args)
+	case "nerv_list_constraints":
+		return mcpListConstraints(db, taskID)
+	case "nerv_request_permission":
+		return mcpRequestPermission(db, taskID, args)
+	default:
+		return mcpErrorResult(fmt.Sprintf("Unknown tool: %s", name))
+	}
+}
+
+// mcpTextResult wraps a value as a JSON text result
+func mcpTextResult(v interface{}) mcpToolResult {
+	data, _ := json.MarshalIndent(v, "", "  ")
+	return mcpToolResult{Content: []mcpContent{{Type: "text", Text: string(data)}}}
+}
+
+// mcpErrorResult builds a tool-level error result
+func mcpErrorResult(message string) mcpToolResult {
+	return mcpToolResult{Content: []mcpContent{{Type: "text", Text: message}}, IsError: true}
+}
+
+// mcpGetTask returns the task row for taskID
+func mcpGetTask(db Store, taskID string) mcpToolResult {
+	if taskID == "" {
+		return mcpErrorResult("No task is associated with this session (NERV_TASK_ID is not set)")
+	}
+	if db == nil {
+		return mcpErrorResult("NERV database not available")
+	}
+
+	task, err := db.GetTask(taskID)
+	if errors.Is(err, store.ErrNotFound) {
+		return mcpErrorResult(fmt.Sprintf("Task not found: %s", taskID))
+	}
+	if err != nil {
+		return mcpErrorResult(fmt.Sprintf("Failed to load task: %v", err))
+	}
+
+	result := map[string]interface{}{
+		"id":            task.ID,
+		"title":         task.Title,
+		"description":   task.Description,
+		"status":        task.Status,
+		"worktree_path": task.WorktreePath,
+	}
+	if task.ParentID != "" {
+		result["parent_id"] = task.ParentID
+	}
+	if children, err := db.ListTasks(store.TaskFilter{ParentID: task.ID}); err == nil && len(children) > 0 {
+		subtasks := make([]map[string]string, len(children))
+		for i, c := range children {
+			subtasks[i] = map[string]string{"id": c.ID, "title": c.Title, "status": c.Status}
+		}
+		result["subtasks"] = subtasks
+		result["progress"] = describeProgress(children)
+	}
+	return mcpTextResult(result)
+}
+
+// mcpCreateSubtask adds a subtask to the session's task
+func mcpCreateSubtask(db Store, taskID string, args map[string]interface{}) mcpToolResult {
+	if taskID == "" {
+		return mcpErrorResult("No task is associated with this session (NERV_TASK_ID is not set)")
+	}
+	if db == nil {
+		return mcpErrorResult("NERV database not available")
+	}
+	title, _ := args["title"].(string)
+	description, _ := args["description"].(string)
+
+	parent, err := db.GetTask(taskID)
+	if errors.Is(err, store.ErrNotFound) {
+		return mcpErrorResult(fmt.Sprintf("Task not found: %s", taskID))
+	}
+	if err != nil {
+		return mcpErrorResult(fmt.Sprintf("Failed to load task: %v", err))
+	}
+	task, err := createSubtask(db, parent, title, description, "mcp")
+	if err != nil {
+		return mcpErrorResult(fmt.Sprintf("Failed to create the subtask: %v", err))
+	}
+	return mcpTextResult(map[string]interface{}{"id": task.ID, "title": task.Title, "parent_id": parent.ID, "status": task.Status})
+}
+
+// mcpProjectID is the project whose rules apply: the task's, or else the one for the working directory
+func mcpProjectID(db Store, taskID string) string {
+	if db != nil && taskID != "" {
+		if task, err := db.GetTask(taskID); err == nil && task.ProjectID != "" {
+			return task.ProjectID
+		}
+	}
+	return lookupProjectID()
+}
+
+// mcpPermissionRules returns the rules for the session the server belongs to
+// Claude Code starts the server in the session's directory, so that's where calls are made
+func mcpPermissionRules(db Store, taskID string) policy.Rules {
+	cwd, _ := os.Getwd()
+	return permissionRules(db, mcpProjectID(db, taskID), taskID, cwd)
+}
+
+// mcpListConstraints returns the active permission rules
+func mcpListConstraints(db Store, taskID string) mcpToolResult {
+	permissions := mcpPermissionRules(db, taskID)
+
+	return mcpTextResult(map[string]interface{}{
+		"deny":              permissions.Deny,
+		"allow":             permissions.Allow,
+		"requires_approval": policy.ApprovalTools(),
+		"notes":             "Deny rules are checked first and cannot be approved. Anything else on the approval list waits for a human; use nerv_request_permission to ask ahead with a rationale.",
+	})
+}
+
+// mcpRequestPermission queues a rationale-backed approval and waits briefly for a decision
+func mcpRequestPermission(db Store, taskID string, args map[string]interface{}) mcpToolResult {
+	toolName, _ := args["tool_name"].(string)
+	rationale, _ := args["rationale"].(string)
+	toolInput, _ := args["tool_input"].(map[string]interface{})
+	if toolName == "" || rationale == "" {
+		return mcpErrorResult("tool_name and rationale are required")
+	}
+
+	toolInputJSON, _ := json.Marshal(toolInput)
+	toolInputStr := string(toolInputJSON)
+
+	needsApproval, denyReason := false, selfProtection(toolName, toolInput, "")
+	if denyReason == "" {
+		denyReason = checkConfigIntegrity(db).denyReason()
+	}
+	if denyReason == "" {
+		needsApproval, denyReason, _ = checkPermission(mcpPermissionRules(db, taskID), taskWorkspace(db, taskID), toolName, toolInputStr)
+	}
+	if denyReason != "" {
+		return mcpTextResult(map[string]interface{}{"status": "denied", "reason": denyReason + " (deny rules cannot be approved)"})
+	}
+	if !needsApproval {
+		return mcpTextResult(map[string]interface{}{"status": "allowed", "reason": "No approval needed"})
+	}
+	if db == nil {
+		return mcpErrorResult("NERV database not available")
+	}
+
+	projectID := ""
+	if task, err := db.GetTask(taskID); err == nil {
+		projectID = task.ProjectID
+	}
+	if message := pendingLimit(db, projectID, ""); message != "" {
+		output := refusePending(db, taskID, projectID, toolName, "", message)
+		return mcpTextResult(map[string]interface{}{"status": "denied", "reason": output.Decision.Message})
+	}
+
+	storedInput := storedToolInput(toolName, toolInput, loadConfig().Input.maxFieldBytes())
+	exposure := exposureNote(toolName, toolInput)
+	risk := approvalRisk(toolName, riskNotes(exposure))
+	approvalID, err := queueApproval(db, taskID, "", toolName, storedInput, joinContext(approvals.PreApprovalContext(rationale), exposure), risk, func(id int64) string {
+		return fmt.Sprintf(`{"approval_id":%d,"tool":"%s","source":"mcp","risk":"%s"}`, id, toolName, risk)
+	})
+	if err != nil {
+		return mcpErrorResult("Failed to queue approval request")
+	}
+
+	decision, reason := pollForDecision(context.Background(), db, approvalID, mcpPermissionWait)
+	switch decision {
+	case "approved":
+		return mcpTextResult(map[string]interface{}{"status": "approved", "approval_id": approvalID})
+	case "denied":
+		return mcpTextResult(map[string]interface{}{"status": "denied", "approval_id": approvalID, "reason": reason})
+	default:
+		return mcpTextResult(map[string]interface{}{
+			"status":      "pending",
+			"approval_id": approvalID,
+			"reason":      "No decision yet; if you attempt the action it will wait on this request",
+		})
+	}
+}
+
+// findPreApproval takes a recent approval granted ahead of time (via MCP) for
+// the same tool input, returning its ID, or 0 if there is none
+func findPreApproval(db Store, taskID, toolName, toolInput string) int64 {
+	if db == nil {
+		return 0
+	}
+
+	id, err := approvals.FindPreApproval(db, taskID, toolName, toolInput)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to look up pre-approvals: %v\n", err)
+		return 0
+	}
+	return id
+}
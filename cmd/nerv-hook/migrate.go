@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nerv/nerv-hook/internal/migrations"
+)
+
+// runMigrate implements `nerv-hook migrate status|up`
+func runMigrate(args []string) error {
+	if len(args) != 1 || (args[0] != "status" && args[0] != "up") {
+		return fmt.Errorf("usage: nerv-hook migrate status|up")
+	}
+
+	open := openRawStore
+	if args[0] == "status" {
+		open = openReadOnlyStore
+	}
+	st, err := open()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	if args[0] == "up" {
+		applied, err := migrations.Up(st.SQL(), st.Dialect())
+		for _, m := range applied {
+			fmt.Printf("Applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Printf("Schema is up to date (version %d)\n", migrations.Latest(st.Dialect()))
+		}
+		return nil
+	}
+
+	statuses, err := migrations.List(st.SQL(), st.Dialect())
+	if err != nil {
+		return err
+	}
+	for _, s := range statuses {
+		state := "pending"
+		if s.Applied {
+			state = "applied " + s.AppliedAt
+		}
+		fmt.Printf("%04d  %-30s  %s\n", s.Version, s.Name, state)
+	}
+	return nil
+}
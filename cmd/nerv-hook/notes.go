@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// handleSessionStart gives a session on a task all of the task's notes
+// A resumed or compacted session has lost what it was told before, so it gets them again
+func handleSessionStart(db Store, taskID string, input HookInput) HookOutput {
+	return taskNotesContext(db, "SessionStart", taskID, input.SessionID, 0)
+}
+
+// handleUserPromptSubmit gives a session the notes added to its task since it last got them
+func handleUserPromptSubmit(db Store, taskID string, input HookInput) HookOutput {
+	if db == nil || taskID == "" || input.SessionID == "" {
+		return HookOutput{}
+	}
+	sess, err := db.GetSession(input.SessionID)
+	if err != nil {
+		return HookOutput{}
+	}
+	return taskNotesContext(db, "UserPromptSubmit", taskID, input.SessionID, sess.NotesSeen)
+}
+
+// taskNotesContext adds the notes after afterID of the task, and of the tasks it's
+// a subtask of, to the agent's context and marks them seen by the session
+func taskNotesContext(db Store, event, taskID, sessionID string, afterID int64) HookOutput {
+	if db == nil || taskID == "" {
+		return HookOutput{}
+	}
+	groups, err := inheritedNotes(db, taskID, afterID)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			fmt.Fprintf(os.Stderr, "Failed to load task notes: %v\n", err)
+		}
+		return HookOutput{}
+	}
+	if len(groups) == 0 {
+		return HookOutput{}
+	}
+	count, latest := 0, int64(0)
+	for _, g := range groups {
+		count += len(g.notes)
+		latest = max(latest, g.notes[len(g.notes)-1].ID)
+	}
+
+	intro := fmt.Sprintf("The user attached these notes to NERV task %s. Follow them while you work on it:", taskID)
+	if afterID > 0 {
+		intro = fmt.Sprintf("The user added notes to NERV task %s. Follow them from now on:", taskID)
+	}
+	if sessionID != "" {
+		if err := db.MarkSessionNotesSeen(sessionID, latest); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to record the notes given to the session: %v\n", err)
+		}
+	}
+	logAudit(db, taskID, "task_notes_injected", fmt.Sprintf(`{"session_id":%q,"event":%q,"notes":%d}`, sessionID, event, count))
+	return HookOutput{HookSpecificOutput: &HookSpecificOutput{
+		HookEventName:     event,
+		AdditionalContext: intro + "\n" + formatNoteGroups(taskID, groups),
+	}}
+}
+
+// approvalNotes is the approval context for a task with notes, so whoever decides
+// a request can weigh it against the task's constraints
+func approvalNotes(db Store, taskID string) string {
+	if db == nil || taskID == "" {
+		return ""
+	}
+	groups, err := inheritedNotes(db, taskID, 0)
+	if err != nil || len(groups) == 0 {
+		return ""
+	}
+	return "Task notes:\n" + formatNoteGroups(taskID, groups)
+}
+
+// taskNoteGroup is the notes of one task
+type taskNoteGroup struct {
+	task  store.Task
+	notes []store.TaskNote
+}
+
+// inheritedNotes returns the notes after afterID of a task and of each task it's
+// a subtask of, the task's own first, leaving out tasks without any
+// A parent's constraints apply to all of its subtasks
+func inheritedNotes(db Store, taskID string, afterID int64) ([]taskNoteGroup, error) {
+	task, err := db.GetTask(taskID)
+	if err != nil {
+		return nil, err
+	}
+	var groups []taskNoteGroup
+	for _, t := range append([]store.Task{task}, taskAncestors(db, task)...) {
+		notes, err := db.ListTaskNotes(t.ID, afterID)
+		if err != nil {
+			return nil, err
+		}
+		if len(notes) > 0 {
+			groups = append(groups, taskNoteGroup{task: t, notes: notes})
+		}
+	}
+	return groups, nil
+}
+
+// formatNoteGroups lists the groups' notes, heading those inherited from a parent task
+func formatNoteGroups(taskID string, groups []taskNoteGroup) string {
+	parts := make([]string, len(groups))
+	for i, g := range groups {
+		parts[i] = formatTaskNotes(g.notes)
+		if g.task.ID != taskID {
+			parts[i] = fmt.Sprintf("From parent task %s (%s):\n%s", g.task.ID, g.task.Title, parts[i])
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// formatTaskNotes lists notes one per bullet
+func formatTaskNotes(notes []store.TaskNote) string {
+	lines := make([]string, len(notes))
+	for i, n := range notes {
+		lines[i] = "- " + strings.ReplaceAll(strings.TrimSpace(n.Body), "\n", "\n  ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// runTaskNote implements `nerv-hook task note`: add a note, list them, or remove one
+func runTaskNote(args []string) error {
+	fs := flag.NewFlagSet("task note", flag.ContinueOnError)
+	remove := fs.Int64("delete", 0, "remove the note with this ID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 || (*remove != 0 && fs.NArg() != 1) {
+		return errors.New("usage: nerv-hook task note <task-id> [TEXT] | task note --delete NOTE-ID <task-id>")
+	}
+
+	st, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	task, err := loadTask(st, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *remove != 0 || fs.NArg() == 2 {
+		if err := actAsOperator(st); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case *remove != 0:
+		if err := st.DeleteTaskNote(task.ID, *remove); errors.Is(err, store.ErrNotFound) {
+			return fmt.Errorf("task %s has no note %d", task.ID, *remove)
+		} else if err != nil {
+			return err
+		}
+		fmt.Printf("Removed note %d from task %s\n", *remove, task.ID)
+	case fs.NArg() == 2:
+		body := strings.TrimSpace(fs.Arg(1))
+		if body == "" {
+			return errors.New("the note is empty")
+		}
+		note, err := st.AddTaskNote(task.ID, body)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added note %d to task %s; its sessions get it with their next prompt\n", note.ID, task.ID)
+	default:
+		notes, err := st.ListTaskNotes(task.ID, 0)
+		if err != nil {
+			return err
+		}
+		if len(notes) == 0 {
+			fmt.Printf("Task %s has no notes\n", task.ID)
+			return nil
+		}
+		for _, n := range notes {
+			body := n.Body
+			if n.Operator != "" {
+				body += "  (" + n.Operator + ")"
+			}
+			fmt.Printf("%-4s %s  %s\n", strconv.FormatInt(n.ID, 10), n.CreatedAt.Local().Format("2006-01-02 15:04"),
+				strings.ReplaceAll(body, "\n", "\n                       "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,648 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// Notifiers tell people and other services when tasks start, go to review,
+// finish, or get blocked, and alert them to audit events that need someone at
+// once, such as a tripwire going off. Each kind of notifier registers a
+// constructor in notifierKinds, and the config's notifiers and webhooks are
+// built from their settings. nervd fans each status change in task_transitions
+// and each alert in audit_log out to every notifier that wants it. Each
+// notifier goes at its own pace: its progress is kept in webhook_cursors and
+// alert_cursors under its name, and how its deliveries are going in
+// notifier_health, which nerv-hook status shows
+
+const notifyUsage = "usage: nerv-hook notify deliver|test"
+
+// notifyBatch is how many transitions a delivery pass reads at a time
+const notifyBatch = 100
+
+// notifyAttempts is how many times a delivery is tried in one pass before it waits for the next
+const notifyAttempts = 3
+
+// notifyRetryDelay is the pause before a delivery's second try; it doubles after each
+var notifyRetryDelay = 2 * time.Second
+
+// notifyEvents maps the task statuses notifiers are told about to their event names
+var notifyEvents = map[string]string{
+	store.TaskInProgress: "started",
+	store.TaskReview:     "review",
+	store.TaskDone:       "done",
+	store.TaskBlocked:    "blocked",
+}
+
+// alertEvents maps the audit events notifiers are alerted to, which need a person at once, to their event names
+var alertEvents = map[string]string{
+	"tripwire_triggered":      "tripwire",
+	"anomaly_detected":        "anomaly",
+	"circuit_breaker_tripped": "circuit_breaker",
+	"approval_backpressure":   "backpressure",
+}
+
+// Notifier sends notifications of task status changes and alerts somewhere
+type Notifier interface {
+	// Name identifies the notifier; its progress and health are kept under it
+	Name() string
+	// Wants reports whether the notifier is told about an event in a project
+	Wants(event, projectID string) bool
+	// Notify sends one notification; id stays the same when it's retried, so a receiver can drop repeats
+	// An error with a retryable method returning false means the notification will never be taken
+	Notify(id string, n notification) error
+}
+
+// NotifierConfig is a notifier of any kind
+type NotifierConfig struct {
+	// Name identifies the notifier; delivery progress is kept under it
+	Name string `json:"name"`
+	// Type is the kind of notifier, e.g. webhook
+	Type string `json:"type"`
+	// Events limits the notifier to some of started, review, done, blocked,
+	// tripwire, anomaly, circuit_breaker, and backpressure (default all)
+	Events []string `json:"events,omitempty"`
+	// Projects limits the notifier to some projects' tasks (default every project)
+	Projects []string `json:"projects,omitempty"`
+	// Settings are the kind's own, e.g. url and secret_env for a webhook
+	Settings json.RawMessage `json:"settings,omitempty"`
+}
+
+// notifierKinds builds a notifier of each kind from its config
+var notifierKinds = map[string]func(NotifierConfig) (Notifier, error){
+	"webhook": newWebhookNotifier,
+}
+
+// notifierFilter is the events and projects a notifier is told about, the same for every kind
+type notifierFilter struct {
+	events   []string
+	projects []string
+}
+
+func (f notifierFilter) Wants(event, projectID string) bool {
+	if len(f.events) > 0 && !slices.Contains(f.events, event) {
+		return false
+	}
+	return len(f.projects) == 0 || slices.Contains(f.projects, projectID)
+}
+
+// buildNotifiers builds the configured notifiers, the webhooks first
+func buildNotifiers(cfg Config) ([]Notifier, error) {
+	var notifiers []Notifier
+	names := map[string]bool{}
+	add := func(n Notifier) error {
+		if names[n.Name()] {
+			return fmt.Errorf("more than one notifier or webhook is named %s", n.Name())
+		}
+		names[n.Name()] = true
+		notifiers = append(notifiers, n)
+		return nil
+	}
+	for _, w := range cfg.Webhooks {
+		if err := add(webhookNotifier{w}); err != nil {
+			return nil, err
+		}
+	}
+	for i, c := range cfg.Notifiers {
+		if c.Name == "" {
+			return nil, fmt.Errorf("notifier %d has no name", i+1)
+		}
+		build, ok := notifierKinds[c.Type]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown type %q (want %s)", c.Name, c.Type, orList(notifierKindNames()))
+		}
+		for _, event := range c.Events {
+			if !isNotifyEvent(event) {
+				return nil, fmt.Errorf("%s: unknown event %q (want %s)", c.Name, event, orList(notifyEventNames()))
+			}
+		}
+		n, err := build(c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", c.Name, err)
+		}
+		if err := add(n); err != nil {
+			return nil, err
+		}
+	}
+	return notifiers, nil
+}
+
+// validateNotifiers reports notifiers that can't be built
+func validateNotifiers(cfg Config) error {
+	_, err := buildNotifiers(cfg)
+	return err
+}
+
+// notifierKindNames returns the registered kinds, sorted
+func notifierKindNames() []string {
+	var kinds []string
+	for kind := range notifierKinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func isNotifyEvent(event string) bool {
+	return slices.Contains(notifyEventNames(), event)
+}
+
+// notifyEventNames returns every event a notifier can be told about, task events first
+func notifyEventNames() []string {
+	names := []string{"started", "review", "done", "blocked"}
+	var alerts []string
+	for _, e := range alertEvents {
+		alerts = append(alerts, e)
+	}
+	sort.Strings(alerts)
+	return append(names, alerts...)
+}
+
+// findNotifier returns the configured notifier with a name
+func findNotifier(notifiers []Notifier, name string) (Notifier, error) {
+	for _, n := range notifiers {
+		if n.Name() == name {
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("no notifier or webhook is named %s; add it under notifiers in %s", name, configPath)
+}
+
+// notification describes a status change and the task it happened to, or an
+// alert and the task it was raised in, if any
+// Text is a one-line summary, which chat services such as Slack post as the message
+type notification struct {
+	Event      string                  `json:"event"`
+	Text       string                  `json:"text"`
+	Task       *notificationTask       `json:"task,omitempty"`
+	Transition *notificationTransition `json:"transition,omitempty"`
+	Alert      *notificationAlert      `json:"alert,omitempty"`
+}
+
+// notificationTask summarizes the task as it is when the notification is sent
+type notificationTask struct {
+	ID          string   `json:"id"`
+	ProjectID   string   `json:"project_id,omitempty"`
+	ParentID    string   `json:"parent_id,omitempty"`
+	Title       string   `json:"title"`
+	Description string   `json:"description,omitempty"`
+	Status      string   `json:"status"`
+	Priority    string   `json:"priority,omitempty"`
+	Labels      []string `json:"labels,omitempty"`
+	Branch      string   `json:"branch,omitempty"`
+	BranchHead  string   `json:"branch_head,omitempty"`
+	Sessions    int      `json:"sessions"`
+	ToolCalls   int64    `json:"tool_calls"`
+	Tokens      int64    `json:"tokens"`
+	CostUSD     float64  `json:"cost_usd"`
+}
+
+type notificationTransition struct {
+	ID     int64  `json:"id"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Source string `json:"source,omitempty"`
+	// Operator is who made the change, in team mode
+	Operator string    `json:"operator,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// notificationAlert is the audit event behind an alert
+type notificationAlert struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	Severity  string          `json:"severity,omitempty"`
+	SessionID string          `json:"session_id,omitempty"`
+	Details   json.RawMessage `json:"details,omitempty"`
+	At        time.Time       `json:"at"`
+}
+
+// buildNotification describes a status change and the task it happened to
+func buildNotification(st *store.DB, event string, task store.Task, tr store.TaskTransition) notification {
+	return notification{
+		Event:      event,
+		Text:       fmt.Sprintf("NERV task %s %s: %s", task.ID, notifyVerb(event), task.Title),
+		Task:       summarizeTask(st, task),
+		Transition: &notificationTransition{ID: tr.ID, From: tr.From, To: tr.To, Source: tr.Source, Operator: tr.Operator, At: tr.CreatedAt},
+	}
+}
+
+// buildAlert describes an alert and the task it was raised in; task is zero when there's none
+func buildAlert(st *store.DB, event string, task store.Task, e store.AuditEvent) notification {
+	var details struct {
+		Severity  string `json:"severity"`
+		SessionID string `json:"session_id"`
+		Path      string `json:"path"`
+		Tool      string `json:"tool"`
+		Detail    string `json:"detail"`
+		Denials   int    `json:"denials"`
+		Message   string `json:"message"`
+	}
+	json.Unmarshal([]byte(e.Details), &details)
+
+	var text string
+	switch e.EventType {
+	case "tripwire_triggered":
+		text = fmt.Sprintf("NERV tripwire %s was touched by %s", details.Path, details.Tool)
+	case "anomaly_detected":
+		text = "NERV noticed something unusual: " + details.Detail
+	case "circuit_breaker_tripped":
+		text = fmt.Sprintf("NERV's circuit breaker tripped after %d denials in session %s", details.Denials, details.SessionID)
+	case "approval_backpressure":
+		text = "NERV approvals are backing up: " + details.Message
+	}
+	n := notification{
+		Event: event,
+		Alert: &notificationAlert{ID: e.ID, Type: e.EventType, Severity: details.Severity, SessionID: details.SessionID, Details: json.RawMessage(e.Details), At: e.Timestamp},
+	}
+	if !json.Valid(n.Alert.Details) {
+		n.Alert.Details = nil
+	}
+	if task.ID != "" {
+		text += fmt.Sprintf(" (task %s: %s)", task.ID, task.Title)
+		n.Task = summarizeTask(st, task)
+	}
+	n.Text = text
+	return n
+}
+
+// summarizeTask describes a task as it is now, with what it has used
+func summarizeTask(st *store.DB, task store.Task) *notificationTask {
+	summary := notificationTask{
+		ID: task.ID, ProjectID: task.ProjectID, ParentID: task.ParentID, Title: task.Title, Description: task.Description,
+		Status: task.Status, Priority: task.Priority, Labels: task.Labels, Branch: task.Branch, BranchHead: task.BranchHead,
+	}
+	if usage, err := st.BudgetUsage(store.BudgetTask, task.ID); err == nil {
+		summary.Sessions, summary.ToolCalls, summary.Tokens, summary.CostUSD = usage.Sessions, usage.ToolCalls, usage.Tokens, usage.CostUSD
+	}
+	return &summary
+}
+
+func notifyVerb(event string) string {
+	switch event {
+	case "review":
+		return "is ready for review"
+	case "done":
+		return "is done"
+	case "blocked":
+		return "is blocked"
+	default:
+		return event
+	}
+}
+
+// rejected reports whether a notifier's error means the notification will never be taken
+func rejected(err error) bool {
+	var r interface{ retryable() bool }
+	return errors.As(err, &r) && !r.retryable()
+}
+
+// sendNotification tries a notification until it's sent, rejected, or out of attempts,
+// pausing longer after each failure, and records how it went in the notifier's health
+func sendNotification(st *store.DB, n Notifier, id string, payload notification) error {
+	delay := notifyRetryDelay
+	var err error
+	for attempt := 1; attempt <= notifyAttempts; attempt++ {
+		if err = n.Notify(id, payload); err == nil || rejected(err) {
+			break
+		}
+		if attempt < notifyAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	if err != nil {
+		if err := st.RecordNotifierFailure(n.Name(), err.Error()); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to record notifier %s's health: %v\n", n.Name(), err)
+		}
+		return err
+	}
+	if err := st.RecordNotifierSent(n.Name()); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record notifier %s's health: %v\n", n.Name(), err)
+	}
+	return nil
+}
+
+// deliverNotifier sends a notifier the status changes and alerts recorded since its cursors
+func deliverNotifier(st *store.DB, n Notifier) (int, error) {
+	sent, err := deliverTransitions(st, n)
+	if err != nil {
+		return sent, err
+	}
+	alerts, err := deliverAlerts(st, n)
+	return sent + alerts, err
+}
+
+// deliverTransitions sends a notifier the status changes recorded since its cursor, in order
+// A notifier seen for the first time starts from the newest change rather than
+// replaying history. A failure that may pass stops the pass, so the change is
+// retried next time; one the receiver rejects outright is logged and skipped
+func deliverTransitions(st *store.DB, n Notifier) (sent int, err error) {
+	cursor, err := st.WebhookCursor(n.Name())
+	if errors.Is(err, store.ErrNotFound) {
+		last, err := st.LastTransitionID()
+		if err != nil {
+			return 0, err
+		}
+		return 0, st.SetWebhookCursor(n.Name(), last)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		transitions, err := st.TransitionsSince(cursor, notifyBatch)
+		if err != nil || len(transitions) == 0 {
+			return sent, err
+		}
+		for _, tr := range transitions {
+			if event, ok := notifyEvents[tr.To]; ok {
+				task, err := st.GetTask(tr.TaskID)
+				if err != nil && !errors.Is(err, store.ErrNotFound) {
+					return sent, err
+				}
+				if err == nil && n.Wants(event, task.ProjectID) {
+					err := sendNotification(st, n, strconv.FormatInt(tr.ID, 10), buildNotification(st, event, task, tr))
+					if rejected(err) {
+						details, _ := json.Marshal(map[string]string{"notifier": n.Name(), "event": event, "error": err.Error()})
+						if err := st.LogAudit(task.ID, "notification_failed", string(details)); err != nil {
+							return sent, err
+						}
+					} else if err != nil {
+						return sent, fmt.Errorf("task %s %s: %w", task.ID, event, err)
+					} else {
+						sent++
+					}
+				}
+			}
+			cursor = tr.ID
+			if err := st.SetWebhookCursor(n.Name(), cursor); err != nil {
+				return sent, err
+			}
+		}
+	}
+}
+
+// deliverAlerts sends a notifier the alerts logged since its cursor, in order,
+// the same way deliverTransitions sends status changes
+// An alert's project is its task's, or the one it names when it has no task
+func deliverAlerts(st *store.DB, n Notifier) (sent int, err error) {
+	cursor, err := st.AlertCursor(n.Name())
+	if errors.Is(err, store.ErrNotFound) {
+		last, err := st.LastAuditID()
+		if err != nil {
+			return 0, err
+		}
+		return 0, st.SetAlertCursor(n.Name(), last)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	types := make([]string, 0, len(alertEvents))
+	for t := range alertEvents {
+		types = append(types, t)
+	}
+	for {
+		alerts, err := st.AlertsSince(cursor, types, notifyBatch)
+		if err != nil || len(alerts) == 0 {
+			return sent, err
+		}
+		for _, e := range alerts {
+			event := alertEvents[e.EventType]
+			var task store.Task
+			var details struct {
+				ProjectID string `json:"project_id"`
+			}
+			json.Unmarshal([]byte(e.Details), &details)
+			projectID := details.ProjectID
+			if e.TaskID != "" {
+				t, err := st.GetTask(e.TaskID)
+				if err != nil && !errors.Is(err, store.ErrNotFound) {
+					return sent, err
+				}
+				if err == nil {
+					task, projectID = t, t.ProjectID
+				}
+			}
+			if n.Wants(event, projectID) {
+				err := sendNotification(st, n, "alert-"+strconv.FormatInt(e.ID, 10), buildAlert(st, event, task, e))
+				if rejected(err) {
+					details, _ := json.Marshal(map[string]string{"notifier": n.Name(), "event": event, "error": err.Error()})
+					if err := st.LogAudit(e.TaskID, "notification_failed", string(details)); err != nil {
+						return sent, err
+					}
+				} else if err != nil {
+					return sent, fmt.Errorf("alert %d %s: %w", e.ID, event, err)
+				} else {
+					sent++
+				}
+			}
+			cursor = e.ID
+			if err := st.SetAlertCursor(n.Name(), cursor); err != nil {
+				return sent, err
+			}
+		}
+	}
+}
+
+// deliverNotifiers runs a delivery pass for each notifier at the same time, so
+// one that's slow or down doesn't hold up the rest, and returns each one's result
+func deliverNotifiers(st *store.DB, notifiers []Notifier) ([]int, []error) {
+	sent, errs := make([]int, len(notifiers)), make([]error, len(notifiers))
+	var wg sync.WaitGroup
+	for i, n := range notifiers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sent[i], errs[i] = deliverNotifier(st, n)
+		}()
+	}
+	wg.Wait()
+	return sent, errs
+}
+
+// scheduleNotifiers delivers each configured notifier's pending status changes each interval
+// Settings are reread each time, so notifiers can be added while nervd runs
+func scheduleNotifiers(st *store.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		notifiers, err := buildNotifiers(loadConfig())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "nervd: notifiers: %v\n", err)
+			continue
+		}
+		_, errs := deliverNotifiers(st, notifiers)
+		for i, err := range errs {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "nervd: notifier %s: %v\n", notifiers[i].Name(), err)
+			}
+		}
+	}
+}
+
+// runNotify implements `nerv-hook notify`, and `nerv-hook webhook` from before other notifiers
+func runNotify(args []string) error {
+	if len(args) < 1 {
+		return errors.New(notifyUsage)
+	}
+
+	switch args[0] {
+	case "deliver":
+		return runNotifyDeliver(args[1:])
+	case "test":
+		return runNotifyTest(args[1:])
+	default:
+		return errors.New(notifyUsage)
+	}
+}
+
+// runNotifyDeliver sends pending status changes once, the same pass nervd makes on a schedule
+func runNotifyDeliver(args []string) error {
+	fs := flag.NewFlagSet("notify deliver", flag.ContinueOnError)
+	name := fs.String("name", "", "deliver only this notifier (default every configured notifier)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	notifiers, err := buildNotifiers(loadConfig())
+	if err != nil {
+		return err
+	}
+	if len(notifiers) == 0 {
+		return fmt.Errorf("no notifiers are configured; add them under notifiers in %s", configPath)
+	}
+	if *name != "" {
+		n, err := findNotifier(notifiers, *name)
+		if err != nil {
+			return err
+		}
+		notifiers = []Notifier{n}
+	}
+
+	st, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	failed := 0
+	sent, errs := deliverNotifiers(st, notifiers)
+	for i, n := range notifiers {
+		if errs[i] != nil {
+			fmt.Fprintf(os.Stderr, "Notifier %s: %v\n", n.Name(), errs[i])
+			failed++
+		}
+		fmt.Printf("Notifier %s: %d sent\n", n.Name(), sent[i])
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d notifiers failed; undelivered changes are retried on the next pass", failed, len(notifiers))
+	}
+	return nil
+}
+
+// runNotifyTest sends a notifier a made-up done event, without touching its cursor or health
+func runNotifyTest(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: nerv-hook notify test <name>")
+	}
+	notifiers, err := buildNotifiers(loadConfig())
+	if err != nil {
+		return err
+	}
+	n, err := findNotifier(notifiers, args[0])
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	payload := notification{
+		Event:      "done",
+		Text:       "NERV notifier test: task test is done",
+		Task:       &notificationTask{ID: "test", Title: "Notifier test", Status: store.TaskDone},
+		Transition: &notificationTransition{From: store.TaskReview, To: store.TaskDone, Source: "test", At: now},
+	}
+	if err := n.Notify("test", payload); err != nil {
+		return err
+	}
+	fmt.Printf("Sent a test notification to %s\n", n.Name())
+	return nil
+}
+
+// notifierStatus is how one configured notifier's deliveries are going, for nerv-hook status
+type notifierStatus struct {
+	Name string `json:"name"`
+	// Status is ok, failing, or idle for a notifier that hasn't sent anything yet
+	Status      string     `json:"status"`
+	LastSentAt  *time.Time `json:"last_sent_at,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	Failures    int64      `json:"failures"`
+}
+
+// notifierStatuses joins the configured notifiers with their recorded health
+func notifierStatuses(st *store.DB, cfg Config) ([]notifierStatus, error) {
+	notifiers, err := buildNotifiers(cfg)
+	if err != nil {
+		return nil, err
+	}
+	health, err := st.ListNotifierHealth()
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]store.NotifierHealth{}
+	for _, h := range health {
+		byName[h.Notifier] = h
+	}
+
+	statuses := []notifierStatus{}
+	for _, n := range notifiers {
+		h, ok := byName[n.Name()]
+		s := notifierStatus{Name: n.Name(), Status: "idle", LastError: h.LastError, Failures: h.Failures}
+		if !h.LastSentAt.IsZero() {
+			s.LastSentAt = &h.LastSentAt
+		}
+		if !h.LastErrorAt.IsZero() {
+			s.LastErrorAt = &h.LastErrorAt
+		}
+		switch {
+		case !ok:
+		case h.Failures > 0:
+			s.Status = "failing"
+		case s.LastSentAt != nil:
+			s.Status = "ok"
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+// describeNotifier sums up a notifier's status in a line, with times relative to now
+func describeNotifier(s notifierStatus, now time.Time) string {
+	var parts []string
+	switch s.Status {
+	case "failing":
+		parts = append(parts, fmt.Sprintf("failing, %d in a row: %s", s.Failures, strings.TrimSpace(tail(s.LastError, 120))))
+	case "idle":
+		parts = append(parts, "nothing sent yet")
+	default:
+		parts = append(parts, "ok")
+	}
+	if s.LastSentAt != nil {
+		parts = append(parts, "last sent "+formatDuration(now.Sub(*s.LastSentAt))+" ago")
+	}
+	return strings.Join(parts, ", ")
+}
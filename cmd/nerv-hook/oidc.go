@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// nerv-hook serve signs people in with an OpenID Connect provider, such as
+// Okta, Entra ID, Google Workspace, or Keycloak, using the authorization code
+// flow with PKCE. The ID token the provider returns is checked here against
+// the keys it publishes, and a claim listing the person's groups picks their
+// NERV role, so who may approve agents' actions follows the corporate directory
+
+// oidcTimeout bounds each request to the provider
+const oidcTimeout = 10 * time.Second
+
+// oidcClockSkew is how far the provider's clock may be from ours
+const oidcClockSkew = time.Minute
+
+// defaultOIDCSecretEnv holds the client secret when the config doesn't name a variable
+const defaultOIDCSecretEnv = "NERV_OIDC_CLIENT_SECRET"
+
+// OIDCConfig connects nerv-hook serve to an OpenID Connect provider
+type OIDCConfig struct {
+	// Issuer is the provider's issuer URL, e.g. https://acme.okta.com
+	Issuer string `json:"issuer"`
+	// ClientID is the client registered with the provider for NERV
+	ClientID string `json:"client_id"`
+	// ClientSecretEnv names the environment variable holding the client secret
+	// (default NERV_OIDC_CLIENT_SECRET); a public client, with no secret, relies on PKCE alone
+	ClientSecretEnv string `json:"client_secret_env,omitempty"`
+	// Scopes are requested besides openid (default email and profile, plus groups if RolesClaim is groups)
+	Scopes []string `json:"scopes,omitempty"`
+	// UsernameClaim is the claim holding the operator name (default preferred_username, then email)
+	UsernameClaim string `json:"username_claim,omitempty"`
+	// RolesClaim is the claim listing the person's groups or roles (default groups)
+	RolesClaim string `json:"roles_claim,omitempty"`
+	// Roles maps a NERV role to the RolesClaim values that grant it; the most privileged match wins
+	Roles map[string][]string `json:"roles,omitempty"`
+	// DefaultRole is given to someone none of whose values match; empty turns them away
+	DefaultRole string `json:"default_role,omitempty"`
+}
+
+// Validate reports settings nerv-hook serve couldn't sign anyone in with
+func (c *OIDCConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Issuer == "" || c.ClientID == "" {
+		return errors.New("oidc needs an issuer and a client_id")
+	}
+	u, err := url.Parse(c.Issuer)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && !(u.Scheme == "http" && isLoopback(u.Hostname()))) {
+		return fmt.Errorf("oidc issuer %q is not an https URL", c.Issuer)
+	}
+	for role := range c.Roles {
+		if !slices.Contains(store.Roles, role) {
+			return fmt.Errorf("oidc roles: unknown role %q (expected one of %s)", role, strings.Join(store.Roles, ", "))
+		}
+	}
+	if c.DefaultRole != "" && !slices.Contains(store.Roles, c.DefaultRole) {
+		return fmt.Errorf("oidc default_role: unknown role %q (expected one of %s)", c.DefaultRole, strings.Join(store.Roles, ", "))
+	}
+	if len(c.Roles) == 0 && c.DefaultRole == "" {
+		return errors.New("oidc needs roles or a default_role, or no one could sign in")
+	}
+	return nil
+}
+
+// isLoopback reports whether host is this machine, where plain http is allowed for testing
+func isLoopback(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+func (c *OIDCConfig) clientSecret() string {
+	env := c.ClientSecretEnv
+	if env == "" {
+		env = defaultOIDCSecretEnv
+	}
+	return os.Getenv(env)
+}
+
+func (c *OIDCConfig) rolesClaim() string {
+	if c.RolesClaim != "" {
+		return c.RolesClaim
+	}
+	return "groups"
+}
+
+func (c *OIDCConfig) scopes() []string {
+	scopes := c.Scopes
+	if scopes == nil {
+		scopes = []string{"email", "profile"}
+		if c.rolesClaim() == "groups" {
+			scopes = append(scopes, "groups")
+		}
+	}
+	return append([]string{"openid"}, slices.DeleteFunc(slices.Clone(scopes), func(s string) bool { return s == "openid" })...)
+}
+
+// username returns the operator name claims give, or ""
+// An email is only used if the provider verified it, since many let people enter any address
+func (c *OIDCConfig) username(claims map[string]interface{}) string {
+	names := []string{"preferred_username", "email"}
+	if c.UsernameClaim != "" {
+		names = []string{c.UsernameClaim}
+	}
+	for _, name := range names {
+		if s, ok := claims[name].(string); ok && s != "" && (name != "email" || emailVerified(claims)) {
+			return s
+		}
+	}
+	return ""
+}
+
+// emailVerified reports whether claims say their email was verified
+// Some providers send the flag as a string
+func emailVerified(claims map[string]interface{}) bool {
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// role returns the NERV role claims grant: the most privileged one any of the
+// roles claim's values maps to, or DefaultRole if none does
+func (c *OIDCConfig) role(claims map[string]interface{}) string {
+	var values []string
+	switch v := claims[c.rolesClaim()].(type) {
+	case string:
+		values = []string{v}
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	for _, role := range store.Roles {
+		for _, want := range c.Roles[role] {
+			if slices.Contains(values, want) {
+				return role
+			}
+		}
+	}
+	return c.DefaultRole
+}
+
+// oidcDiscovery is the part of the provider's /.well-known/openid-configuration nerv-hook reads
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider talks to the provider, caching its configuration and keys
+type oidcProvider struct {
+	cfg    *OIDCConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	// keysFetched limits refetching the keys for an ID token signed with one we don't know
+	keysFetched time.Time
+}
+
+func newOIDCProvider(cfg *OIDCConfig) *oidcProvider {
+	return &oidcProvider{cfg: cfg, client: &http.Client{Timeout: oidcTimeout}}
+}
+
+// getJSON fetches a provider document into v
+func (p *oidcProvider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover returns the provider's configuration, fetching it the first time
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	// The issuer must be exactly the one configured, or its tokens could claim any other
+	if d.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("oidc discovery: the provider is %q, not the configured issuer %q", d.Issuer, p.cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("oidc discovery: the provider's configuration is missing an endpoint")
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// authURL is where a person is sent to sign in
+func (p *oidcProvider) authURL(ctx context.Context, redirectURI, state, nonce, verifier string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("scope", strings.Join(p.cfg.scopes(), " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// exchange trades an authorization code for the person's ID token
+func (p *oidcProvider) exchange(ctx context.Context, code, redirectURI, verifier string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {p.cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if secret := p.cfg.clientSecret(); secret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(secret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oidc token exchange: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("oidc token exchange: %w", err)
+	}
+	if body.Error != "" {
+		return "", fmt.Errorf("oidc token exchange: %s %s", body.Error, body.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc token exchange: %s", resp.Status)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("oidc token exchange: the provider returned no ID token")
+	}
+	return body.IDToken, nil
+}
+
+// verify checks an ID token's signature and claims, returning the claims
+func (p *oidcProvider) verify(ctx context.Context, idToken, nonce string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("the ID token is not a signed JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("the ID token's header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("the ID token's signature: %w", err)
+	}
+	key, err := p.key(ctx, header.Kid, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWS(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("the ID token's claims: %w", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != p.cfg.Issuer {
+		return nil, fmt.Errorf("the ID token was issued by %q, not %q", iss, p.cfg.Issuer)
+	}
+	var audience []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				audience = append(audience, s)
+			}
+		}
+	}
+	if !slices.Contains(audience, p.cfg.ClientID) {
+		return nil, errors.New("the ID token is for another client")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.cfg.ClientID {
+		return nil, errors.New("the ID token was given to another client")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(oidcClockSkew)) {
+		return nil, errors.New("the ID token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("the ID token isn't valid yet")
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("the ID token is for another sign-in")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("the ID token has no subject")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// key returns the provider's signing key with the given ID, refetching the
+// provider's keys, at most once a minute, if it has rotated to one we don't have
+func (p *oidcProvider) key(ctx context.Context, kid string, now time.Time) (crypto.PublicKey, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if p.keys != nil && now.Sub(p.keysFetched) < time.Minute {
+		return nil, fmt.Errorf("the ID token is signed with an unknown key %q", kid)
+	}
+
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("oidc keys: %w", err)
+	}
+	p.keys = map[string]crypto.PublicKey{}
+	p.keysFetched = now
+	for _, raw := range set.Keys {
+		// Keys for encryption, or of kinds we can't use, are skipped
+		if k, id, err := parseJWK(raw); err == nil {
+			p.keys[id] = k
+		}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("the ID token is signed with an unknown key %q", kid)
+}
+
+// parseJWK reads an RSA or EC signing key from a JSON Web Key, with its ID
+func parseJWK(raw json.RawMessage) (crypto.PublicKey, string, error) {
+	var k struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &k); err != nil {
+		return nil, "", err
+	}
+	if k.Use != "" && k.Use != "sig" {
+		return nil, "", fmt.Errorf("key %q is not for signing", k.Kid)
+	}
+	decode := func(s string) ([]byte, error) { return base64.RawURLEncoding.DecodeString(s) }
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, "", err
+		}
+		e, err := decode(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, "", fmt.Errorf("key %q has a bad exponent", k.Kid)
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < 2048 {
+			return nil, "", fmt.Errorf("key %q is shorter than 2048 bits", k.Kid)
+		}
+		return key, k.Kid, nil
+	case "EC":
+		curves := map[string]struct {
+			curve elliptic.Curve
+			ecdh  ecdh.Curve
+		}{"P-256": {elliptic.P256(), ecdh.P256()}, "P-384": {elliptic.P384(), ecdh.P384()}, "P-521": {elliptic.P521(), ecdh.P521()}}
+		c, ok := curves[k.Crv]
+		if !ok {
+			return nil, "", fmt.Errorf("key %q is on an unsupported curve %q", k.Kid, k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, "", err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, "", err
+		}
+		size := (c.curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, "", fmt.Errorf("key %q has a bad point", k.Kid)
+		}
+		// crypto/ecdh checks the point is on the curve
+		if _, err := c.ecdh.NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, "", fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		return &ecdsa.PublicKey{Curve: c.curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, k.Kid, nil
+	default:
+		return nil, "", fmt.Errorf("key %q is of an unsupported type %q", k.Kid, k.Kty)
+	}
+}
+
+// verifyJWS checks a JWS signature; alg comes from the token, so it must also fit the key
+// Symmetric algorithms and none are refused, since anyone with the client ID could forge those
+func verifyJWS(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	if len(alg) != 5 {
+		return fmt.Errorf("the ID token is signed with an unsupported algorithm %q", alg)
+	}
+	hash, ok := hashes[alg[2:]]
+	if !ok {
+		return fmt.Errorf("the ID token is signed with an unsupported algorithm %q", alg)
+	}
+	var digest []byte
+	switch hash {
+	case crypto.SHA256:
+		d := sha256.Sum256(signed)
+		digest = d[:]
+	case crypto.SHA384:
+		d := sha512.Sum384(signed)
+		digest = d[:]
+	default:
+		d := sha512.Sum512(signed)
+		digest = d[:]
+	}
+
+	bad := errors.New("the ID token's signature doesn't match")
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			if rsa.VerifyPKCS1v15(k, hash, digest, sig) != nil {
+				return bad
+			}
+			return nil
+		case "PS":
+			if rsa.VerifyPSS(k, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) != nil {
+				return bad
+			}
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(sig) != 2*size || k.Curve.Params().BitSize != map[crypto.Hash]int{crypto.SHA256: 256, crypto.SHA384: 384, crypto.SHA512: 521}[hash] {
+			break
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return bad
+		}
+		return nil
+	}
+	return fmt.Errorf("the ID token's algorithm %q doesn't fit its key", alg)
+}
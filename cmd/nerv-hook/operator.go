@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+	"github.com/nerv/nerv-hook/pkg/approvals"
+)
+
+// Team mode lets several people share one NERV instance, usually through a
+// central PostgreSQL database (NERV_DB_URL). It starts when the first operator
+// is registered; from then on commands must be run by a registered operator,
+// and what they change is attributed to them
+// Each operator has a role: admins edit policy and manage operators, approvers
+// decide approvals up to their risk limit and act on tasks, and viewers read
+// An operator is the OS account running the command, by its login name; roles
+// are only as strong as the accounts, so nothing the caller sets can change it
+
+const userUsage = "usage: nerv-hook user add|list|role|disable|enable|whoami"
+
+// operatorNamePattern is what an operator name may look like
+var operatorNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@-]{0,63}$`)
+
+// operatorName returns who is running this command: the login name of the OS account
+// A variable so tests can run commands as different people
+var operatorName = func() string {
+	if u, err := user.Current(); err == nil {
+		// Windows login names come as DOMAIN\name
+		return u.Username[strings.LastIndex(u.Username, `\`)+1:]
+	}
+	return ""
+}
+
+// currentOperator returns the registered operator running this command
+// ok is false outside team mode, when there are no operators to be
+func currentOperator(st *store.DB) (u store.User, ok bool, err error) {
+	n, err := st.CountUsers()
+	if err != nil || n == 0 {
+		return store.User{}, false, err
+	}
+	name := operatorName()
+	u, err = st.GetUser(name)
+	if errors.Is(err, store.ErrNotFound) {
+		return u, true, fmt.Errorf("%q isn't a registered operator; ask an admin to run nerv-hook user add %s", name, name)
+	}
+	if err != nil {
+		return u, true, err
+	}
+	if u.Disabled() {
+		return u, true, fmt.Errorf("operator %s is disabled", u.Name)
+	}
+	return u, true, nil
+}
+
+// actAsOperator attributes what st writes from now on to the operator running
+// this command. In team mode it refuses viewers and anyone not registered;
+// otherwise it does nothing
+func actAsOperator(st *store.DB) error {
+	return actAs(st, store.RoleApprover, "change anything")
+}
+
+// actAsAdmin is actAsOperator for what only admins may do, such as edit policy
+func actAsAdmin(st *store.DB, what string) error {
+	return actAs(st, store.RoleAdmin, what)
+}
+
+// actAs attributes what st writes to the operator running this command, if
+// their role is at least role; what is the action refused otherwise
+func actAs(st *store.DB, role, what string) error {
+	u, ok, err := currentOperator(st)
+	if err != nil || !ok {
+		return err
+	}
+	if !store.RoleAtLeast(u.Role, role) {
+		return fmt.Errorf("%s is a%s %s and can't %s", u.Name, article(u.Role), u.Role, what)
+	}
+	st.SetOperator(u.Name)
+	return nil
+}
+
+// readAsOperator refuses, in team mode, anyone who isn't a registered operator
+// Every role may read
+func readAsOperator(st *store.DB) error {
+	_, _, err := currentOperator(st)
+	return err
+}
+
+// openOperatorStore opens the state database for a command that changes state, as the operator running it
+func openOperatorStore() (*store.DB, error) {
+	st, err := openStore()
+	if err != nil {
+		return nil, err
+	}
+	if err := actAsOperator(st); err != nil {
+		st.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// runUser implements `nerv-hook user`
+func runUser(args []string) error {
+	if len(args) < 1 {
+		return errors.New(userUsage)
+	}
+
+	switch args[0] {
+	case "add":
+		return runUserAdd(args[1:])
+	case "list":
+		return runUserList(args[1:])
+	case "role":
+		return runUserRole(args[1:])
+	case "disable":
+		return runUserDisable(args[1:], true)
+	case "enable":
+		return runUserDisable(args[1:], false)
+	case "whoami":
+		return runUserWhoami(args[1:])
+	default:
+		return errors.New(userUsage)
+	}
+}
+
+// openAdminStore opens the state database as the admin running a command that
+// only admins may run; what is what it does, for the error given anyone else
+// Before the first operator is registered anyone counts as one, so team mode can be set up
+func openAdminStore(what string) (*store.DB, error) {
+	st, err := openStore()
+	if err != nil {
+		return nil, err
+	}
+	if err := actAsAdmin(st, what); err != nil {
+		st.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// article is "n" before a role starting with a vowel, for "an admin" and "an approver"
+func article(role string) string {
+	if strings.ContainsAny(role[:1], "aeiou") {
+		return "n"
+	}
+	return ""
+}
+
+// runUserAdd registers an operator
+func runUserAdd(args []string) error {
+	fs := flag.NewFlagSet("user add", flag.ContinueOnError)
+	email := fs.String("email", "", "the operator's email address")
+	role := fs.String("role", store.RoleApprover, "the operator's `ROLE`: "+strings.Join(store.Roles, ", "))
+	maxRisk := fs.String("max-risk", "", "the riskiest approval an approver may decide, as a `LEVEL`: "+strings.Join(approvals.Risks, ", ")+" (default any)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: nerv-hook user add [--email ADDRESS] [--role admin|approver|viewer] [--max-risk low|medium|high] <name>")
+	}
+	name := fs.Arg(0)
+	if !operatorNamePattern.MatchString(name) {
+		return fmt.Errorf("%q isn't a valid operator name: use letters, digits, '.', '_', '@' and '-', up to 64 characters", name)
+	}
+	if !slices.Contains(store.Roles, *role) {
+		return fmt.Errorf("unknown role %q (expected one of %s)", *role, strings.Join(store.Roles, ", "))
+	}
+	if *maxRisk != "" && !slices.Contains(approvals.Risks, *maxRisk) {
+		return fmt.Errorf("unknown risk level %q (expected one of %s)", *maxRisk, strings.Join(approvals.Risks, ", "))
+	}
+
+	st, err := openAdminStore("manage operators")
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	n, err := st.CountUsers()
+	if err != nil {
+		return err
+	}
+	// Someone has to be able to register the rest, so the first operator is an
+	// admin, and has to be whoever is registering them
+	first := n == 0
+	if first {
+		if me := operatorName(); name != me {
+			return fmt.Errorf("the first operator must be you, %s, so that someone can manage the rest", me)
+		}
+		*role, *maxRisk = store.RoleAdmin, ""
+	}
+	if _, err := st.GetUser(name); err == nil {
+		return fmt.Errorf("operator %s is already registered", name)
+	}
+	if err := st.CreateUser(store.User{Name: name, Email: *email, Role: *role, CreatedBy: st.Operator(), MaxRisk: *maxRisk}); err != nil {
+		return err
+	}
+	details, _ := json.Marshal(map[string]string{"user": name, "role": *role, "max_risk": *maxRisk})
+	if err := st.LogAudit("", "user_added", string(details)); err != nil {
+		return err
+	}
+
+	fmt.Printf("Registered %s as a%s %s\n", name, article(*role), roleSummary(*role, *maxRisk))
+	if first {
+		fmt.Println("Team mode is on: from now on only registered operators can change anything")
+	}
+	return nil
+}
+
+// jsonUser is an operator
+type jsonUser struct {
+	Name       string     `json:"name"`
+	Email      string     `json:"email,omitempty"`
+	Role       string     `json:"role"`
+	CreatedAt  time.Time  `json:"created_at"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	DisabledAt *time.Time `json:"disabled_at,omitempty"`
+	MaxRisk    string     `json:"max_risk,omitempty"`
+}
+
+// runUserList lists the registered operators
+func runUserList(args []string) error {
+	fs := flag.NewFlagSet("user list", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the operators as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	users, err := st.ListUsers()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		out := make([]jsonUser, 0, len(users))
+		for _, u := range users {
+			out = append(out, jsonUser{Name: u.Name, Email: u.Email, Role: u.Role, CreatedAt: u.CreatedAt, CreatedBy: u.CreatedBy, DisabledAt: optionalTime(u.DisabledAt), MaxRisk: u.MaxRisk})
+		}
+		return printJSON(out)
+	}
+	if len(users) == 0 {
+		fmt.Println("No operators; team mode is off. Register the first, who becomes an admin, with nerv-hook user add NAME")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tROLE\tEMAIL\tADDED")
+	for _, u := range users {
+		role := roleSummary(u.Role, u.MaxRisk)
+		if u.Disabled() {
+			role += " (disabled)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", u.Name, role, u.Email, u.CreatedAt.Local().Format("2006-01-02"))
+	}
+	return w.Flush()
+}
+
+// runUserRole changes an operator's role, and an approver's risk limit
+func runUserRole(args []string) error {
+	fs := flag.NewFlagSet("user role", flag.ContinueOnError)
+	maxRisk := fs.String("max-risk", "", "the riskiest approval an approver may decide, as a `LEVEL`: "+strings.Join(approvals.Risks, ", ")+" (default any)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 || !slices.Contains(store.Roles, fs.Arg(1)) {
+		return errors.New("usage: nerv-hook user role [--max-risk low|medium|high] <name> admin|approver|viewer")
+	}
+	name, role := fs.Arg(0), fs.Arg(1)
+	if *maxRisk != "" && !slices.Contains(approvals.Risks, *maxRisk) {
+		return fmt.Errorf("unknown risk level %q (expected one of %s)", *maxRisk, strings.Join(approvals.Risks, ", "))
+	}
+
+	st, err := openAdminStore("manage operators")
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	u, err := st.GetUser(name)
+	if errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("no operator named %s", name)
+	} else if err != nil {
+		return err
+	}
+	if u.Role == store.RoleAdmin && role != store.RoleAdmin {
+		if err := keepAnAdmin(st, name); err != nil {
+			return err
+		}
+	}
+	if err := st.SetUserRole(name, role, *maxRisk); err != nil {
+		return err
+	}
+	details, _ := json.Marshal(map[string]string{"user": name, "role": role, "max_risk": *maxRisk, "previous": u.Role})
+	if err := st.LogAudit("", "user_role_changed", string(details)); err != nil {
+		return err
+	}
+	fmt.Printf("%s is now a%s %s\n", name, article(role), roleSummary(role, *maxRisk))
+	return nil
+}
+
+// runUserDisable disables an operator, or re-enables one
+// Disabled operators keep their history but can't run commands that change state
+func runUserDisable(args []string, disable bool) error {
+	verb := "enable"
+	if disable {
+		verb = "disable"
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: nerv-hook user %s <name>", verb)
+	}
+	name := args[0]
+
+	st, err := openAdminStore("manage operators")
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	u, err := st.GetUser(name)
+	if errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("no operator named %s", name)
+	} else if err != nil {
+		return err
+	}
+	if disable && u.Role == store.RoleAdmin && !u.Disabled() {
+		if err := keepAnAdmin(st, name); err != nil {
+			return err
+		}
+	}
+	if err := st.SetUserDisabled(name, disable); err != nil {
+		return err
+	}
+	// A disabled operator is signed out of nerv-hook serve too
+	if disable {
+		if _, err := st.DeleteOperatorLogins(name); err != nil {
+			return err
+		}
+	}
+	details, _ := json.Marshal(map[string]string{"user": name})
+	if err := st.LogAudit("", "user_"+verb+"d", string(details)); err != nil {
+		return err
+	}
+	fmt.Printf("Operator %s is %sd\n", name, verb)
+	return nil
+}
+
+// keepAnAdmin refuses to take away the last enabled admin, who'd be needed to manage everyone else
+func keepAnAdmin(st *store.DB, name string) error {
+	users, err := st.ListUsers()
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if u.Name != name && u.Role == store.RoleAdmin && !u.Disabled() {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is the only enabled admin; make someone else an admin first", name)
+}
+
+// runUserWhoami prints the operator this command line acts as
+func runUserWhoami(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: nerv-hook user whoami")
+	}
+
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	u, ok, err := currentOperator(st)
+	if !ok && err == nil {
+		fmt.Printf("%s (team mode is off)\n", operatorName())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s, a%s %s\n", u.Name, article(u.Role), roleSummary(u.Role, u.MaxRisk))
+	return nil
+}
+
+// roleSummary is a role, with an approver's risk limit if they have one
+func roleSummary(role, maxRisk string) string {
+	if maxRisk == "" {
+		return role
+	}
+	return fmt.Sprintf("%s of up to %s risk", role, maxRisk)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// An organisation can hand out a baseline policy as a bundle signed with its
+// ed25519 key, placed with the org's public key under NERV_DIR, where agents
+// can't write. The bundle's settings fill in whatever the permissions file
+// leaves out, its deny rules are always added, and the sections it protects can
+// only come from it, so editing them locally changes nothing
+// A bundle that doesn't verify denies every tool call rather than being skipped
+
+// orgBundlePath is where the org's signed policy bundle is installed
+func orgBundlePath() string {
+	return filepath.Join(nervDir, "org-policy.json")
+}
+
+// orgKeyPath is where the org's public key is installed, as base64
+func orgKeyPath() string {
+	return filepath.Join(nervDir, "org-policy.pub")
+}
+
+// orgBundle is the file nerv-hook org sign writes
+type orgBundle struct {
+	// Policy is a permissions file with a protected list of the sections only it may set
+	Policy json.RawMessage `json:"policy"`
+	// Signature is the base64 ed25519 signature of Policy, exactly as written
+	Signature string `json:"signature"`
+}
+
+// orgPolicy is a verified bundle's policy
+type orgPolicy struct {
+	// sections are the policy's top-level settings, keyed as in the permissions file
+	sections map[string]json.RawMessage
+	// protected are the sections a local edit can't change
+	protected []string
+}
+
+// orgCache keeps the last bundle verified, so each loadConfig doesn't verify it again
+var orgCache struct {
+	sync.Mutex
+	key, bundle []byte
+	policy      *orgPolicy
+	err         error
+}
+
+// loadOrgPolicy reads and verifies the installed bundle
+// It returns nil without an error when neither the bundle nor the key is installed
+func loadOrgPolicy() (*orgPolicy, error) {
+	key, keyErr := os.ReadFile(orgKeyPath())
+	bundle, bundleErr := os.ReadFile(orgBundlePath())
+	switch {
+	case errors.Is(keyErr, os.ErrNotExist) && errors.Is(bundleErr, os.ErrNotExist):
+		return nil, nil
+	case keyErr != nil:
+		return nil, fmt.Errorf("the org key can't be read: %w", keyErr)
+	case bundleErr != nil:
+		return nil, fmt.Errorf("the org policy bundle can't be read: %w", bundleErr)
+	}
+
+	orgCache.Lock()
+	defer orgCache.Unlock()
+	if orgCache.key == nil || !bytes.Equal(orgCache.key, key) || !bytes.Equal(orgCache.bundle, bundle) {
+		orgCache.key, orgCache.bundle = key, bundle
+		orgCache.policy, orgCache.err = verifyOrgBundle(key, bundle)
+	}
+	return orgCache.policy, orgCache.err
+}
+
+// verifyOrgBundle checks a bundle's signature against the org's public key and parses its policy
+func verifyOrgBundle(key, data []byte) (*orgPolicy, error) {
+	pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(key)))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("the org key is not a base64 ed25519 public key")
+	}
+	var bundle orgBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, fmt.Errorf("the org policy bundle does not parse: %v", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(bundle.Signature)
+	if err != nil || !ed25519.Verify(pub, bundle.Policy, sig) {
+		return nil, errors.New("the org policy bundle's signature doesn't match the org key")
+	}
+
+	org := &orgPolicy{}
+	if err := json.Unmarshal(bundle.Policy, &org.sections); err != nil {
+		return nil, fmt.Errorf("the org policy does not parse: %v", err)
+	}
+	if p, ok := org.sections["protected"]; ok {
+		if err := json.Unmarshal(p, &org.protected); err != nil {
+			return nil, fmt.Errorf("the org policy's protected list does not parse: %v", err)
+		}
+		delete(org.sections, "protected")
+	}
+	return org, nil
+}
+
+// unset reports whether a section is missing or null
+func unset(v json.RawMessage) bool {
+	return len(v) == 0 || string(v) == "null"
+}
+
+// apply merges the org policy into a config: deny rules are added to the
+// config's, protected sections replace its own, and other sections fill in
+// those it leaves unset
+func (o *orgPolicy) apply(cfg Config) (Config, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return cfg, err
+	}
+	var local map[string]json.RawMessage
+	if err := json.Unmarshal(data, &local); err != nil {
+		return cfg, err
+	}
+
+	for name, value := range o.sections {
+		if name == "deny" {
+			continue
+		}
+		if slices.Contains(o.protected, name) || unset(local[name]) {
+			local[name] = value
+		}
+	}
+	for _, name := range o.protected {
+		if _, ok := o.sections[name]; !ok {
+			delete(local, name)
+		}
+	}
+	var deny []string
+	if err := json.Unmarshal(o.sections["deny"], &deny); len(o.sections["deny"]) > 0 && err != nil {
+		return cfg, fmt.Errorf("org deny rules: %v", err)
+	}
+	if deny = slices.Concat(deny, cfg.Deny); deny != nil {
+		local["deny"], _ = json.Marshal(deny)
+	}
+
+	data, _ = json.Marshal(local)
+	var merged Config
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return cfg, fmt.Errorf("the org policy doesn't fit the permissions file: %v", err)
+	}
+	return merged, nil
+}
+
+// overridden returns the protected sections a permissions file sets differently from the org policy
+func (o *orgPolicy) overridden(data []byte) []string {
+	var local map[string]json.RawMessage
+	if json.Unmarshal(data, &local) != nil {
+		return nil
+	}
+	var names []string
+	for _, name := range o.protected {
+		if name == "deny" || unset(local[name]) {
+			continue
+		}
+		if !jsonEqual(local[name], o.sections[name]) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// jsonEqual reports whether two JSON values are the same, ignoring layout
+func jsonEqual(a, b json.RawMessage) bool {
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	ja, _ := json.Marshal(x)
+	jb, _ := json.Marshal(y)
+	return bytes.Equal(ja, jb)
+}
+
+// withOrgPolicy merges the installed org policy into a config
+// A bundle that can't be used leaves the config as it is; orgPolicyDenyReason stops tool calls instead
+func withOrgPolicy(cfg Config) Config {
+	org, err := loadOrgPolicy()
+	if err != nil || org == nil {
+		return cfg
+	}
+	merged, err := org.apply(cfg)
+	if err != nil {
+		return cfg
+	}
+	return merged
+}
+
+// orgPolicyDenyReason returns why every tool call is denied, or "" unless an
+// installed org policy can't be applied
+func orgPolicyDenyReason() string {
+	org, err := loadOrgPolicy()
+	if err == nil && org != nil {
+		_, err = org.apply(Config{Rules: policy.Default()})
+	}
+	if err == nil {
+		return ""
+	}
+	return fmt.Sprintf("NERV's org policy can't be applied (%v), so every tool call is denied. Ask the user to reinstall it", err)
+}
+
+const orgUsage = "usage: nerv-hook org keygen <name>|sign --key <file> <policy.json>|status"
+
+// runOrg implements `nerv-hook org`
+func runOrg(args []string) error {
+	if len(args) < 1 {
+		return errors.New(orgUsage)
+	}
+
+	switch args[0] {
+	case "keygen":
+		return runOrgKeygen(args[1:])
+	case "sign":
+		return runOrgSign(args[1:])
+	case "status":
+		return runOrgStatus(args[1:])
+	default:
+		return errors.New(orgUsage)
+	}
+}
+
+// runOrgKeygen writes a new signing key to <name>.key and its public key to <name>.pub
+func runOrgKeygen(args []string) error {
+	fs := flag.NewFlagSet("org keygen", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: nerv-hook org keygen <name>")
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	name := fs.Arg(0)
+	if err := os.WriteFile(name+".key", []byte(base64.StdEncoding.EncodeToString(priv)+"\n"), 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(name+".pub", []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s.key (keep it private) and %s.pub (install it as %s)\n", name, name, orgKeyPath())
+	return nil
+}
+
+// runOrgSign writes a signed bundle of a policy file to stdout
+func runOrgSign(args []string) error {
+	fs := flag.NewFlagSet("org sign", flag.ContinueOnError)
+	keyFile := fs.String("key", "", "signing key written by nerv-hook org keygen")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *keyFile == "" {
+		return errors.New("usage: nerv-hook org sign --key <file> <policy.json>")
+	}
+
+	key, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	priv, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(key)))
+	if err != nil || len(priv) != ed25519.PrivateKeySize {
+		return fmt.Errorf("%s is not a key written by nerv-hook org keygen", *keyFile)
+	}
+	policyData, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, policyData); err != nil {
+		return fmt.Errorf("%s does not parse: %v", fs.Arg(0), err)
+	}
+	var check struct {
+		Protected []string `json:"protected"`
+	}
+	if err := json.Unmarshal(compact.Bytes(), &check); err != nil {
+		return fmt.Errorf("%s: protected must be a list of section names", fs.Arg(0))
+	}
+
+	bundle := orgBundle{Policy: compact.Bytes(), Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, compact.Bytes()))}
+	out, _ := json.MarshalIndent(bundle, "", "  ")
+	_, err = fmt.Printf("%s\n", out)
+	return err
+}
+
+// runOrgStatus reports whether the installed org policy verifies, and what it protects
+func runOrgStatus(args []string) error {
+	fs := flag.NewFlagSet("org status", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	org, err := loadOrgPolicy()
+	fmt.Printf("Bundle:    %s\n", orgBundlePath())
+	switch {
+	case err != nil:
+		fmt.Printf("Status:    %v; hooks deny every tool call\n", err)
+	case org == nil:
+		fmt.Println("Status:    none installed")
+	default:
+		fmt.Println("Status:    signature verified")
+		if len(org.protected) > 0 {
+			fmt.Printf("Protected: %s\n", strings.Join(org.protected, ", "))
+		}
+		data, _ := os.ReadFile(configPath)
+		if names := org.overridden(data); len(names) > 0 {
+			fmt.Printf("Ignored:   %s sets %s, which only the org policy may\n", configPath, strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+// Package approvals is NERV's human-in-the-loop approval flow
+//
+// A tool call that policy says needs approval is queued as a pending request;
+// a person approves or denies it from the dashboard or another surface, and
+// the caller waits for that decision. Storage is left to the caller through
+// the Queue interface.
+package approvals
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Approval statuses
+const (
+	Pending  = "pending"
+	Approved = "approved"
+	Denied   = "denied"
+	// Cancelled is set when whatever was waiting for the decision stopped first
+	Cancelled = "cancelled"
+)
+
+// Risk levels, set on an approval when it's queued
+const (
+	RiskLow    = "low"
+	RiskMedium = "medium"
+	// RiskHigh is a call that would expose secrets, touch a sensitive file, or
+	// that a plugin asked about
+	RiskHigh = "high"
+)
+
+// Risks lists the risk levels, lowest first
+var Risks = []string{RiskLow, RiskMedium, RiskHigh}
+
+// RiskWithin reports whether risk is no higher than max
+// An unknown risk, like that of an approval queued before risks were recorded, counts as high
+func RiskWithin(risk, max string) bool {
+	level := slices.Index(Risks, risk)
+	if level < 0 {
+		level = len(Risks) - 1
+	}
+	return level <= slices.Index(Risks, max)
+}
+
+// PollInterval was how often Wait checked for a decision
+//
+// Deprecated: Wait backs off between checks; see DefaultBackoff
+const PollInterval = 200 * time.Millisecond
+
+// Backoff spaces out the checks Wait makes: the first comes after Initial, and
+// each later one doubles the delay up to Max. Every delay is moved by up to
+// Jitter of itself either way, so hooks waiting together don't read the
+// database in step
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	// Jitter is a fraction from 0 to 1
+	Jitter float64
+}
+
+// DefaultBackoff answers quick decisions quickly and checks every 3s or so on long waits
+var DefaultBackoff = Backoff{Initial: 100 * time.Millisecond, Max: 3 * time.Second, Jitter: 0.2}
+
+// Delay returns how long to wait before check number attempt, counting from 0
+// Zero fields fall back to DefaultBackoff's
+func (b Backoff) Delay(attempt int) time.Duration {
+	if b.Initial <= 0 {
+		b.Initial = DefaultBackoff.Initial
+	}
+	if b.Max <= 0 {
+		b.Max = DefaultBackoff.Max
+	}
+	if b.Max < b.Initial {
+		b.Max = b.Initial
+	}
+	b.Jitter = min(max(b.Jitter, 0), 1)
+
+	d := b.Initial
+	for i := 0; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	d = min(d, b.Max)
+	return d + time.Duration((rand.Float64()*2-1)*b.Jitter*float64(d))
+}
+
+// PreApprovalPrefix marks approvals an agent asked for ahead of time with a rationale
+const PreApprovalPrefix = "Requested via MCP:"
+
+// PreApprovalWindow is how long an approval granted ahead of time covers the matching tool call
+const PreApprovalWindow = 10 * time.Minute
+
+// ErrTimeout is returned by Wait when no decision arrived in time
+var ErrTimeout = errors.New("approval request timed out")
+
+// ConflictError is returned when a decision loses to one another surface already recorded
+type ConflictError struct {
+	// Current is the approval as decided by the winner
+	Current Approval
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("approval %d was already %s", e.Current.ID, e.Current.Status)
+}
+
+// Approval is one request for a human decision on a tool call
+type Approval struct {
+	ID     int64
+	TaskID string
+	// SessionID is the agent session that asked, if known
+	SessionID  string
+	ToolName   string
+	ToolInput  string
+	Context    string
+	Status     string
+	DenyReason string
+	CreatedAt  time.Time
+	DecidedAt  time.Time
+	// DecidedBy is the operator who decided it, in team mode
+	DecidedBy string
+	// Risk is one of Risks, or empty for an approval queued before risks were recorded
+	Risk string
+}
+
+// Decided reports whether the request has been approved, denied, or cancelled
+func (a Approval) Decided() bool {
+	return a.Status != Pending && !a.DecidedAt.IsZero()
+}
+
+// Queue stores approval requests
+type Queue interface {
+	// QueueApproval inserts a pending approval and its approval_requested audit
+	// event atomically; auditDetails builds the event's details once the ID is known
+	QueueApproval(a Approval, auditDetails func(approvalID int64) string) (int64, error)
+	// GetApproval loads an approval by ID
+	GetApproval(id int64) (Approval, error)
+	// ApprovedSince returns a task's approved requests for a tool decided at or after since
+	ApprovedSince(taskID, toolName string, since time.Time) ([]Approval, error)
+	// UseApproval marks an approved request used, reporting false if it already was
+	UseApproval(id int64) (bool, error)
+}
+
+// Wait polls q until the approval is decided or timeout passes, spacing its checks with DefaultBackoff
+// Lookup errors are retried until the deadline; the result is then ErrTimeout
+func Wait(q Queue, id int64, timeout time.Duration) (Approval, error) {
+	return WaitBackoff(q, id, timeout, DefaultBackoff)
+}
+
+// WaitBackoff is Wait with its checks spaced by b
+// The last check is made at the deadline, however long the delay before it was
+func WaitBackoff(q Queue, id int64, timeout time.Duration, b Backoff) (Approval, error) {
+	return WaitNotify(q, id, timeout, b, nil)
+}
+
+// WaitNotify is WaitBackoff that also checks each time wake receives, so a
+// decider that can signal doesn't have to wait for the next scheduled check
+// A nil wake only polls
+func WaitNotify(q Queue, id int64, timeout time.Duration, b Backoff, wake <-chan struct{}) (Approval, error) {
+	return WaitContext(context.Background(), q, id, timeout, b, wake)
+}
+
+// WaitContext is WaitNotify that gives up with ctx's error once ctx is done
+func WaitContext(ctx context.Context, q Queue, id int64, timeout time.Duration, b Backoff, wake <-chan struct{}) (Approval, error) {
+	deadline := time.Now().Add(timeout)
+	for attempt := 0; ; attempt++ {
+		a, err := q.GetApproval(id)
+		if err == nil && a.Decided() {
+			return a, nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return Approval{}, ErrTimeout
+		}
+		timer := time.NewTimer(min(b.Delay(attempt), remaining))
+		select {
+		case <-timer.C:
+		case <-wake:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return Approval{}, ctx.Err()
+		}
+	}
+}
+
+// PreApprovalContext is the context recorded for a request made ahead of time
+func PreApprovalContext(rationale string) string {
+	return PreApprovalPrefix + " " + rationale
+}
+
+// FindPreApproval takes an approval granted ahead of time within
+// PreApprovalWindow for the same tool input, returning its ID, or 0 if there is none
+// Each covers one tool call: the one taken is marked used, and a used one is skipped
+func FindPreApproval(q Queue, taskID, toolName, toolInput string) (int64, error) {
+	approvals, err := q.ApprovedSince(taskID, toolName, time.Now().Add(-PreApprovalWindow))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, approval := range approvals {
+		if !strings.HasPrefix(approval.Context, PreApprovalPrefix) || !sameInput(toolName, approval.ToolInput, toolInput) {
+			continue
+		}
+		used, err := q.UseApproval(approval.ID)
+		if err != nil {
+			return 0, err
+		}
+		if used {
+			return approval.ID, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// sameInput reports whether two stored tool inputs ask for the same call
+// Every field counts, so a Write's content does, except a Bash description,
+// which only says what the command is for
+func sameInput(toolName, approved, input string) bool {
+	var a, b map[string]interface{}
+	if json.Unmarshal([]byte(approved), &a) != nil || json.Unmarshal([]byte(input), &b) != nil {
+		return approved == input
+	}
+	if toolName == "Bash" {
+		delete(a, "description")
+		delete(b, "description")
+	}
+	return reflect.DeepEqual(a, b)
+}
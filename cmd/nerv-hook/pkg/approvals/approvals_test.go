@@ -0,0 +1,75 @@
+package approvals
+
+import (
+	"testing"
+	"time"
+)
+
+// memoryQueue is a Queue of approvals already decided
+type memoryQueue struct {
+	approvals []Approval
+	used      map[int64]bool
+}
+
+func (q *memoryQueue) QueueApproval(a Approval, auditDetails func(approvalID int64) string) (int64, error) {
+	a.ID = int64(len(q.approvals) + 1)
+	q.approvals = append(q.approvals, a)
+	return a.ID, nil
+}
+
+func (q *memoryQueue) GetApproval(id int64) (Approval, error) {
+	return q.approvals[id-1], nil
+}
+
+func (q *memoryQueue) ApprovedSince(taskID, toolName string, since time.Time) ([]Approval, error) {
+	var found []Approval
+	for _, a := range q.approvals {
+		if a.TaskID == taskID && a.ToolName == toolName && a.Status == Approved && !a.DecidedAt.Before(since) {
+			found = append(found, a)
+		}
+	}
+	return found, nil
+}
+
+func (q *memoryQueue) UseApproval(id int64) (bool, error) {
+	if q.used[id] {
+		return false, nil
+	}
+	q.used[id] = true
+	return true, nil
+}
+
+func TestFindPreApproval(t *testing.T) {
+	q := &memoryQueue{used: map[int64]bool{}}
+	grant := func(toolName, toolInput, context string) int64 {
+		id, _ := q.QueueApproval(Approval{TaskID: "t1", ToolName: toolName, ToolInput: toolInput, Context: context, Status: Approved, DecidedAt: time.Now()}, nil)
+		return id
+	}
+	deploy := grant("Bash", `{"command":"make deploy"}`, PreApprovalContext("release"))
+	write := grant("Write", `{"content":"package main","file_path":"/repo/main.go"}`, PreApprovalContext("scaffold"))
+	grant("NotebookEdit", `{"new_source":"x = 1","notebook_path":"/repo/a.ipynb"}`, PreApprovalContext("fix"))
+	grant("Bash", `{"command":"make release"}`, "asked by a hook")
+
+	for _, tc := range []struct {
+		name, toolName, toolInput string
+		want                      int64
+	}{
+		{"a different command", "Bash", `{"command":"make deploy-all"}`, 0},
+		{"the same command with a description", "Bash", `{"command":"make deploy","description":"Deploy"}`, deploy},
+		{"the same command again", "Bash", `{"command":"make deploy"}`, 0},
+		{"a write of other content", "Write", `{"content":"package evil","file_path":"/repo/main.go"}`, 0},
+		{"the same write", "Write", `{"file_path":"/repo/main.go","content":"package main"}`, write},
+		{"a bare-name tool with other input", "NotebookEdit", `{"new_source":"import os","notebook_path":"/repo/a.ipynb"}`, 0},
+		{"an approval a hook asked for", "Bash", `{"command":"make release"}`, 0},
+		{"another task", "Write", `{"content":"package main","file_path":"/repo/main.go"}`, 0},
+	} {
+		taskID := "t1"
+		if tc.name == "another task" {
+			taskID = "t2"
+		}
+		id, err := FindPreApproval(q, taskID, tc.toolName, tc.toolInput)
+		if err != nil || id != tc.want {
+			t.Errorf("%s: FindPreApproval = %d, %v, want %d", tc.name, id, err, tc.want)
+		}
+	}
+}
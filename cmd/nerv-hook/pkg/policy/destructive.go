@@ -0,0 +1,363 @@
+package policy
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// Destructive reports why a shell command line would wreck the machine, or "" if it wouldn't
+// It reads the argv of each command rather than matching text, so rm -fr /,
+// rm -rf //, and sudo /bin/rm -r -- ~ are caught as surely as rm -rf /
+// Only clear-cut cases are reported: recursive rm, chmod, or chown of / or a
+// top-level directory or a home directory, mkfs, and dd onto a device
+func Destructive(command string) string {
+	return DestructiveFor("", command)
+}
+
+// DestructiveFor is Destructive for a user whose home directory is home, so
+// the home directory is caught when it's named by its path as well as by ~ or $HOME
+func DestructiveFor(home, command string) string {
+	for _, args := range CommandArgs(command) {
+		if reason := destructiveArgs(args, home); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// maxShellDepth bounds how far sh -c '...' is unwrapped
+const maxShellDepth = 4
+
+// CommandArgs returns the argv of every command a shell command line would run
+// Variable assignments and wrappers such as sudo and env are dropped, and the
+// scripts given to sh -c are split in turn
+func CommandArgs(command string) [][]string {
+	return commandArgs(command, 0)
+}
+
+// ShellWords returns the words of every simple command in a command line as
+// written, with its assignments and wrappers, so D=~/.nerv is seen as well
+// as the $D/state.db that uses it; the scripts given to sh -c are split in turn
+func ShellWords(command string) [][]string {
+	return shellWords(command, 0)
+}
+
+func shellWords(line string, depth int) [][]string {
+	var all [][]string
+	for _, words := range shellCommands(line) {
+		all = append(all, words)
+		if args := unwrapCommand(words); len(args) > 0 && isShell(path.Base(args[0])) && depth < maxShellDepth {
+			if script := shellScript(args[1:]); script != "" {
+				all = append(all, shellWords(script, depth+1)...)
+			}
+		}
+	}
+	return all
+}
+
+func commandArgs(line string, depth int) [][]string {
+	var all [][]string
+	for _, args := range shellCommands(line) {
+		args = unwrapCommand(args)
+		if len(args) == 0 {
+			continue
+		}
+		all = append(all, args)
+		if isShell(path.Base(args[0])) && depth < maxShellDepth {
+			if script := shellScript(args[1:]); script != "" {
+				all = append(all, commandArgs(script, depth+1)...)
+			}
+		}
+	}
+	return all
+}
+
+func destructiveArgs(args []string, home string) string {
+	name, rest := path.Base(args[0]), args[1:]
+
+	switch {
+	case name == "rm":
+		if hasFlag(rest, "rR", "recursive") {
+			if target := criticalTarget(operands(rest), home); target != "" {
+				return "rm -r of " + target
+			}
+		}
+	case name == "chmod" || name == "chown" || name == "chgrp":
+		if hasFlag(rest, "R", "recursive") {
+			if target := criticalTarget(operands(rest), home); target != "" {
+				return name + " -R of " + target
+			}
+		}
+	case name == "mkfs" || strings.HasPrefix(name, "mkfs."):
+		return name + " formats a filesystem"
+	case name == "dd":
+		for _, arg := range rest {
+			if device, ok := strings.CutPrefix(arg, "of="); ok && strings.HasPrefix(path.Clean(device), "/dev/") && !harmlessDevices[path.Clean(device)] {
+				return "dd onto " + device
+			}
+		}
+	}
+	return ""
+}
+
+// harmlessDevices are the /dev files dd may write to
+var harmlessDevices = map[string]bool{
+	"/dev/null":   true,
+	"/dev/zero":   true,
+	"/dev/stdout": true,
+	"/dev/stderr": true,
+	"/dev/tty":    true,
+}
+
+// shellCommands splits a command line into the argv of each simple command
+// It follows POSIX quoting and treats ; & | newlines, parentheses, and backquotes
+// as separators, so commands inside $(...) are seen too, except for the & of
+// redirections such as 2>&1 and &>log; nothing is expanded, so $HOME and ~ stay as written
+func shellCommands(line string) [][]string {
+	var commands [][]string
+	var args []string
+	var word strings.Builder
+	inWord := false
+
+	endWord := func() {
+		if inWord {
+			args = append(args, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	endCommand := func() {
+		endWord()
+		if len(args) > 0 {
+			commands = append(commands, args)
+			args = nil
+		}
+	}
+
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; c {
+		case '\\':
+			if i+1 < len(line) {
+				i++
+				if line[i] != '\n' {
+					word.WriteByte(line[i])
+					inWord = true
+				}
+			}
+		case '\'':
+			inWord = true
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				word.WriteString(line[i+1:])
+				i = len(line)
+				continue
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+		case '"':
+			inWord = true
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) && strings.IndexByte("$`\"\\\n", line[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(line[i])
+			}
+		case ' ', '\t':
+			endWord()
+		case '&':
+			if inWord && strings.HasSuffix(word.String(), ">") || inWord && strings.HasSuffix(word.String(), "<") || i+1 < len(line) && line[i+1] == '>' {
+				word.WriteByte(c)
+				inWord = true
+				continue
+			}
+			endCommand()
+		case ';', '|', '\n', '(', ')', '`':
+			endCommand()
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	endCommand()
+	return commands
+}
+
+// wrapperOptions are commands that run the rest of their arguments as a command,
+// with the short options of each that take a value
+var wrapperOptions = map[string]string{
+	"sudo":    "CDghpRrTtUu",
+	"doas":    "Cu",
+	"env":     "CSu",
+	"command": "",
+	"builtin": "",
+	"exec":    "a",
+	"nohup":   "",
+	"time":    "fo",
+	"nice":    "n",
+	"ionice":  "cnp",
+	"xargs":   "adEILnPs",
+	"timeout": "ks",
+}
+
+// reservedWords start a compound command, or a command within one, so
+// { rm -rf /; } and if true; then rm -rf /; fi both run rm
+var reservedWords = map[string]bool{
+	"{": true, "}": true, "!": true,
+	"if": true, "then": true, "elif": true, "else": true,
+	"do": true, "while": true, "until": true, "for": true, "case": true,
+}
+
+// unwrapCommand drops reserved words, variable assignments and wrappers such
+// as sudo or env, so /usr/bin/sudo -u root /bin/rm -r x is /bin/rm -r x
+// A wrapper given no command runs as itself, as env does to print the environment
+func unwrapCommand(args []string) []string {
+	var wrapper []string
+	for len(args) > 0 {
+		if reservedWords[args[0]] || isAssignment(args[0]) {
+			args = args[1:]
+			continue
+		}
+		name := path.Base(args[0])
+		valued, ok := wrapperOptions[name]
+		if !ok {
+			return args
+		}
+		wrapper = args
+		args = args[1:]
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-" {
+			option := args[0]
+			args = args[1:]
+			if option == "--" {
+				break
+			}
+			// -u root takes the next argument; -uroot and --user=root don't
+			if len(option) == 2 && strings.IndexByte(valued, option[1]) >= 0 && len(args) > 0 {
+				args = args[1:]
+			}
+		}
+		// timeout's duration comes before the command
+		if name == "timeout" && len(args) > 0 {
+			args = args[1:]
+		}
+	}
+	return wrapper
+}
+
+// isAssignment reports whether a word is a NAME=value prefix to a command
+func isAssignment(word string) bool {
+	name, _, ok := strings.Cut(word, "=")
+	if !ok || name == "" {
+		return false
+	}
+	for i, c := range name {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func isShell(name string) bool {
+	switch name {
+	case "sh", "bash", "zsh", "dash", "ksh":
+		return true
+	}
+	return false
+}
+
+// shellScript returns the script of sh -c SCRIPT, or "" if the shell isn't given one
+func shellScript(args []string) string {
+	for i, arg := range args {
+		if !strings.HasPrefix(arg, "-") || arg == "--" {
+			return ""
+		}
+		if !strings.HasPrefix(arg, "--") && strings.Contains(arg, "c") && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// hasFlag reports whether args set one of the short flags or the long one, before any --
+func hasFlag(args []string, short, long string) bool {
+	for _, arg := range args {
+		switch {
+		case arg == "--":
+			return false
+		case arg == "--"+long:
+			return true
+		case strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") && strings.ContainsAny(arg[1:], short):
+			return true
+		}
+	}
+	return false
+}
+
+// operands returns the arguments that aren't options
+func operands(args []string) []string {
+	var out []string
+	for i, arg := range args {
+		if arg == "--" {
+			return append(out, args[i+1:]...)
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			out = append(out, arg)
+		}
+	}
+	return out
+}
+
+// homeSpellings are the unexpanded ways a command names the home directory,
+// Windows' user profile included
+var homeSpellings = []string{"~", "$HOME", "${HOME}", "$USERPROFILE", "${USERPROFILE}", "%USERPROFILE%"}
+
+// homeParents are the directories that hold users' home directories
+var homeParents = []string{"/home", "/Users"}
+
+// criticalTarget returns the first path that is /, a top-level directory, or a
+// home directory: homeDir, spelled out or as ~ or $HOME, or any directly under
+// /home or /Users
+// Trailing /* and /. and repeated slashes don't change the answer, and a
+// Windows drive such as C:/ counts as /
+func criticalTarget(paths []string, homeDir string) string {
+	if homeDir != "" {
+		homeDir = path.Clean(homeDir)
+	}
+	for _, p := range paths {
+		home := false
+		for _, h := range homeSpellings {
+			if p == h || strings.HasPrefix(p, h+"/") {
+				p, home = "/"+p[len(h):], true
+				break
+			}
+		}
+		drive := ""
+		if !home && len(p) >= 2 && p[1] == ':' && isDriveLetter(p[0]) && (len(p) == 2 || p[2] == '/') {
+			drive, p = p[:2], "/"+p[2:]
+		}
+		if !strings.HasPrefix(p, "/") {
+			continue
+		}
+		clean := path.Clean(p)
+		if strings.HasSuffix(clean, "/*") {
+			clean = path.Dir(clean)
+		}
+		switch {
+		case clean == "/" && home || !home && drive+clean == homeDir:
+			return "the home directory"
+		case clean == "/":
+			return drive + "/"
+		case !home && strings.Count(clean, "/") == 1 && clean != "/*":
+			return drive + clean
+		case !home && slices.Contains(homeParents, path.Dir(clean)) && path.Base(clean) != "*":
+			return drive + clean
+		}
+	}
+	return ""
+}
+
+// isDriveLetter reports whether c can name a Windows drive
+func isDriveLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
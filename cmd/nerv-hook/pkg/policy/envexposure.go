@@ -0,0 +1,168 @@
+package policy
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// WholeEnvironment is what EnvExposure reports for a dump of every variable sent to a network tool
+const WholeEnvironment = "the whole environment"
+
+// EnvExposure returns what a shell command line would reveal from the environment,
+// or nil if nothing: the sensitive-looking variables it prints or sends over the
+// network, and WholeEnvironment when it dumps the environment in a command line
+// that also runs a network tool
+// Prompt-injected exfiltration tends to look like this, so Check sends such
+// commands for approval even when an allow rule matches them
+func EnvExposure(command string) []string {
+	found := map[string]bool{}
+	dumps, sends := false, false
+	for _, args := range exposureArgs(command, 0) {
+		name, rest := path.Base(args[0]), args[1:]
+		switch {
+		case printsVariables[name]:
+			for _, v := range variableRefs(rest) {
+				found[v] = true
+			}
+		case name == "printenv" || declaresVariables[name]:
+			named := operands(rest)
+			if len(named) == 0 {
+				dumps = true
+			}
+			// export and declare only print the variables they're given with -p
+			if name != "printenv" && !hasFlag(rest, "p", "") {
+				named = nil
+			}
+			for _, v := range named {
+				if SensitiveVariable(v) {
+					found[v] = true
+				}
+			}
+		case networkTools[name]:
+			sends = true
+			for _, v := range variableRefs(rest) {
+				found[v] = true
+			}
+		case name == "env" || name == "set":
+			dumps = dumps || len(rest) == 0
+		}
+		for _, arg := range rest {
+			if strings.HasSuffix(arg, "/environ") {
+				dumps = true
+			}
+		}
+	}
+
+	var exposed []string
+	for v := range found {
+		exposed = append(exposed, v)
+	}
+	sort.Strings(exposed)
+	if dumps && sends {
+		exposed = append(exposed, WholeEnvironment)
+	}
+	return exposed
+}
+
+// printsVariables are commands that print their arguments
+var printsVariables = map[string]bool{
+	"echo":   true,
+	"printf": true,
+	"print":  true,
+}
+
+// declaresVariables are shell builtins that print every exported variable given no arguments
+var declaresVariables = map[string]bool{
+	"export":  true,
+	"declare": true,
+	"typeset": true,
+}
+
+// networkTools are commands that can send data off the machine
+var networkTools = map[string]bool{
+	"curl":    true,
+	"wget":    true,
+	"nc":      true,
+	"ncat":    true,
+	"netcat":  true,
+	"socat":   true,
+	"telnet":  true,
+	"ssh":     true,
+	"scp":     true,
+	"sftp":    true,
+	"rsync":   true,
+	"ftp":     true,
+	"http":    true,
+	"https":   true,
+	"xh":      true,
+	"openssl": true,
+}
+
+// exposureArgs is CommandArgs, plus the commands substituted into words with
+// $(...) or backquotes, which the shell's quoting would otherwise hide
+func exposureArgs(command string, depth int) [][]string {
+	all := CommandArgs(command)
+	if depth >= maxShellDepth {
+		return all
+	}
+	for _, args := range all {
+		for _, arg := range args {
+			if strings.Contains(arg, "$(") || strings.Contains(arg, "`") {
+				all = append(all, exposureArgs(arg, depth+1)...)
+			}
+		}
+	}
+	return all
+}
+
+// variableRef matches $NAME and ${NAME...} in a word
+var variableRef = regexp.MustCompile(`\$\{?([A-Za-z_][A-Za-z0-9_]*)`)
+
+// variableRefs returns the sensitive-looking variables referenced in args
+func variableRefs(args []string) []string {
+	var refs []string
+	for _, arg := range args {
+		for _, m := range variableRef.FindAllStringSubmatch(arg, -1) {
+			if SensitiveVariable(m[1]) {
+				refs = append(refs, m[1])
+			}
+		}
+	}
+	return refs
+}
+
+// sensitiveParts are the words of a variable name that suggest it holds a secret
+var sensitiveParts = map[string]bool{
+	"TOKEN":       true,
+	"TOKENS":      true,
+	"SECRET":      true,
+	"SECRETS":     true,
+	"PASSWORD":    true,
+	"PASSWD":      true,
+	"PASS":        true,
+	"KEY":         true,
+	"APIKEY":      true,
+	"CREDENTIAL":  true,
+	"CREDENTIALS": true,
+	"AUTH":        true,
+	"COOKIE":      true,
+	"PAT":         true,
+	"DSN":         true,
+}
+
+// SensitiveVariable reports whether an environment variable's name suggests it holds a secret,
+// such as GITHUB_TOKEN, AWS_SECRET_ACCESS_KEY, or a database URL like NERV_DB_URL
+func SensitiveVariable(name string) bool {
+	parts := strings.Split(strings.ToUpper(name), "_")
+	for i, part := range parts {
+		if sensitiveParts[part] {
+			return true
+		}
+		if part == "URL" && i > 0 && (parts[i-1] == "DB" || parts[i-1] == "DATABASE") {
+			return true
+		}
+	}
+	return false
+}
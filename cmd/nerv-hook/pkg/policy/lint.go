@@ -0,0 +1,82 @@
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// regexpEscape finds regular expression escapes such as \d or \., which a pattern matches literally
+var regexpEscape = regexp.MustCompile(`\\[dDsSwWb.+?()\[\]{}]`)
+
+// knownTools are the agent tools rules are usually written for
+// A rule for any other tool still works; Lint only asks whether it's misspelled
+var knownTools = map[string]bool{
+	"Bash": true, "Read": true, "Write": true, "Edit": true, "MultiEdit": true, "NotebookEdit": true,
+	"NotebookRead": true, "Grep": true, "Glob": true, "LS": true, "WebFetch": true, "WebSearch": true,
+	"Task": true, "TodoWrite": true,
+}
+
+// argumentTools are the tools whose signature includes an argument a rule's pattern can match
+var argumentTools = map[string]string{
+	"Bash":  "command",
+	"Read":  "path",
+	"Write": "path",
+	"Edit":  "path",
+}
+
+// Lint returns the mistakes in a rule that would make it match something other
+// than what it looks like it should, or nothing at all
+// It's empty for a rule that's well formed
+func Lint(rule string) []string {
+	rule = strings.TrimSpace(rule)
+	if rule == "" {
+		return []string{"the rule is empty"}
+	}
+
+	tool, pattern, hasPattern := strings.Cut(rule, "(")
+	var problems []string
+	switch {
+	case hasPattern && !strings.HasSuffix(pattern, ")"):
+		problems = append(problems, fmt.Sprintf("%q has no closing parenthesis; write Tool(pattern)", rule))
+	case !hasPattern && strings.Contains(rule, ")"):
+		problems = append(problems, fmt.Sprintf("%q has no opening parenthesis; write Tool(pattern)", rule))
+	}
+	pattern = strings.TrimSuffix(pattern, ")")
+
+	switch {
+	case tool == "":
+		problems = append(problems, "the rule names no tool; write Tool or Tool(pattern)")
+	case strings.ContainsAny(tool, " \t"):
+		problems = append(problems, fmt.Sprintf("tool %q has a space in it; write Tool(pattern), e.g. Bash(npm test*)", tool))
+	case !knownTools[tool] && !strings.HasPrefix(tool, "mcp__") && !strings.Contains(tool, "*"):
+		if known := caseless(tool); known != "" {
+			problems = append(problems, fmt.Sprintf("tool names are case-sensitive; %s is written %s", tool, known))
+		} else {
+			problems = append(problems, fmt.Sprintf("%s is not a tool NERV knows; check the spelling, or ignore this for a tool it doesn't list", tool))
+		}
+	}
+	if !hasPattern {
+		return problems
+	}
+
+	if _, ok := argumentTools[tool]; !ok && knownTools[tool] {
+		problems = append(problems, fmt.Sprintf("%s calls are matched by the tool name alone, so %s never matches; write %s", tool, rule, tool))
+	} else if pattern == "" {
+		problems = append(problems, fmt.Sprintf("the pattern is empty, so %s only matches an empty %s; write %s or %s(*)", rule, argumentTools[tool], tool, tool))
+	}
+	if strings.Contains(pattern, ".*") || strings.HasPrefix(pattern, "^") || strings.HasSuffix(pattern, "$") || regexpEscape.MatchString(pattern) {
+		problems = append(problems, "patterns aren't regular expressions: * is the only wildcard, and . ^ $ \\ match themselves")
+	}
+	return problems
+}
+
+// caseless returns the known tool a name matches but for case, or ""
+func caseless(name string) string {
+	for tool := range knownTools {
+		if strings.EqualFold(tool, name) {
+			return tool
+		}
+	}
+	return ""
+}
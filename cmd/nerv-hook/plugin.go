@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// Plugins are programs a team adds to check tool calls, such as a license
+// scanner or an internal classifier, without changing nerv-hook. Each plugin
+// the config lists is run for the pre-tool-use calls it covers, after NERV's
+// own checks have passed. It's sent a pluginRequest as JSON on stdin and
+// answers with a pluginResponse on stdout
+// A plugin can only make a call stricter: it can send the call for approval or
+// deny it, but its allow doesn't skip an approval NERV asks for
+
+// pluginProtocol names the request and response shapes; a change that breaks plugins gets a new version
+const pluginProtocol = "nerv-plugin/1"
+
+// Plugin decisions, from least to most strict
+const (
+	pluginAllow = "allow"
+	pluginAsk   = "ask"
+	pluginDeny  = "deny"
+)
+
+// pluginTimeout bounds a plugin run without a timeout of its own
+const pluginTimeout = 2 * time.Second
+
+// pluginOutputLimit is the most a plugin may write to stdout
+const pluginOutputLimit = 64 << 10
+
+// pluginEnv are the environment variables every plugin gets, where set
+// Anything else, such as a token the agent's session has, is passed only if the plugin's env lists it
+var pluginEnv = []string{"PATH", "HOME", "USERPROFILE", "TMPDIR", "TEMP", "TMP", "SYSTEMROOT", "LANG", "LC_ALL"}
+
+// PluginConfig is a program that checks tool calls
+type PluginConfig struct {
+	// Name identifies the plugin in denials, approvals, and the audit log
+	Name string `json:"name"`
+	// Command is the program and its arguments, e.g. ["/opt/acme/license-check", "--strict"]
+	Command []string `json:"command"`
+	// Tools limits the plugin to some tools, e.g. ["Write", "Edit"] (default every tool)
+	Tools []string `json:"tools,omitempty"`
+	// Timeout bounds each run, e.g. "500ms" (default 2s)
+	Timeout string `json:"timeout,omitempty"`
+	// OnError is what happens to the call when the plugin fails, times out, or
+	// answers something other than a response: ask (default), deny, or allow
+	OnError string `json:"on_error,omitempty"`
+	// AskAbove and DenyAbove turn the score a plugin answers with into a decision,
+	// e.g. 0.5 and 0.9; a score at or below both allows the call
+	AskAbove  *float64 `json:"ask_above,omitempty"`
+	DenyAbove *float64 `json:"deny_above,omitempty"`
+	// Env names more environment variables the plugin is given, e.g. ["ACME_API_TOKEN"]
+	Env []string `json:"env,omitempty"`
+	// Image runs the plugin in a container of that image, with no network and
+	// the working directory mounted read-only, using the sandbox's runtime
+	Image string `json:"image,omitempty"`
+	// Wasm is a WebAssembly module run inside nerv-hook instead of Command; see wasmplugin.go
+	Wasm string `json:"wasm,omitempty"`
+}
+
+// pluginRequest is what a plugin reads on stdin
+type pluginRequest struct {
+	Protocol  string                 `json:"protocol"`
+	Event     string                 `json:"event"`
+	ToolName  string                 `json:"tool_name"`
+	ToolInput map[string]interface{} `json:"tool_input"`
+	// Signature is the call as rules see it, e.g. Bash(npm test)
+	Signature string `json:"signature"`
+	SessionID string `json:"session_id,omitempty"`
+	TaskID    string `json:"task_id,omitempty"`
+	ProjectID string `json:"project_id,omitempty"`
+	Cwd       string `json:"cwd,omitempty"`
+}
+
+// pluginResponse is what a plugin writes to stdout
+// It gives a decision, a score between 0 and 1 for the config's thresholds, or both
+type pluginResponse struct {
+	Decision string   `json:"decision,omitempty"`
+	Score    *float64 `json:"score,omitempty"`
+	// Reason is shown to the agent on a denial and to the user on an approval
+	Reason string `json:"reason,omitempty"`
+}
+
+// pluginVerdict is how a plugin decided a call
+type pluginVerdict struct {
+	plugin   string
+	decision string
+	reason   string
+	score    *float64
+	// err is why the plugin couldn't decide, when its on_error decided instead
+	err      error
+	duration time.Duration
+}
+
+// covers reports whether the plugin checks calls to a tool
+func (p PluginConfig) covers(toolName string) bool {
+	return len(p.Tools) == 0 || slices.Contains(p.Tools, toolName)
+}
+
+// timeout returns the configured timeout or the default
+func (p PluginConfig) timeout() time.Duration {
+	if d, err := time.ParseDuration(p.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return pluginTimeout
+}
+
+// onError returns the decision made when the plugin can't decide
+func (p PluginConfig) onError() string {
+	if p.OnError == "" {
+		return pluginAsk
+	}
+	return p.OnError
+}
+
+// validatePlugins reports plugins that can't be run
+func validatePlugins(plugins []PluginConfig) error {
+	names := map[string]bool{}
+	for i, p := range plugins {
+		if p.Name == "" {
+			return fmt.Errorf("plugin %d has no name", i+1)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("more than one plugin is named %s", p.Name)
+		}
+		names[p.Name] = true
+		switch {
+		case p.Wasm != "" && (len(p.Command) > 0 || p.Image != ""):
+			return fmt.Errorf("%s: a wasm plugin has no command or image", p.Name)
+		case p.Wasm == "" && (len(p.Command) == 0 || p.Command[0] == ""):
+			return fmt.Errorf("%s: command is empty", p.Name)
+		}
+		if p.Timeout != "" {
+			if d, err := time.ParseDuration(p.Timeout); err != nil || d <= 0 {
+				return fmt.Errorf("%s: timeout: %q is not a positive duration", p.Name, p.Timeout)
+			}
+		}
+		switch p.OnError {
+		case "", pluginAllow, pluginAsk, pluginDeny:
+		default:
+			return fmt.Errorf("%s: unknown on_error %q (want ask, deny, or allow)", p.Name, p.OnError)
+		}
+		for _, threshold := range []*float64{p.AskAbove, p.DenyAbove} {
+			if threshold != nil && (*threshold < 0 || *threshold > 1) {
+				return fmt.Errorf("%s: ask_above and deny_above are scores between 0 and 1", p.Name)
+			}
+		}
+		if p.AskAbove != nil && p.DenyAbove != nil && *p.AskAbove > *p.DenyAbove {
+			return fmt.Errorf("%s: ask_above is higher than deny_above", p.Name)
+		}
+	}
+	return nil
+}
+
+// pluginsCover reports whether any plugin checks calls to a tool
+func pluginsCover(plugins []PluginConfig, toolName string) bool {
+	for _, p := range plugins {
+		if p.covers(toolName) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPlugins runs the plugins covering a call, all at once, and combines
+// their verdicts: any deny denies the call, and any ask sends it for approval
+// It returns whether to ask, why the call is denied, and a note for the approval
+func checkPlugins(db Store, projectID, taskID string, input HookInput, toolInput string, plugins []PluginConfig) (bool, string, string) {
+	var covering []PluginConfig
+	for _, p := range plugins {
+		if p.covers(input.ToolName) {
+			covering = append(covering, p)
+		}
+	}
+	if len(covering) == 0 {
+		return false, "", ""
+	}
+	request, _ := json.Marshal(pluginRequest{
+		Protocol:  pluginProtocol,
+		Event:     "pre-tool-use",
+		ToolName:  input.ToolName,
+		ToolInput: input.ToolInput,
+		Signature: policy.Signature(input.ToolName, toolInput),
+		SessionID: input.SessionID,
+		TaskID:    taskID,
+		ProjectID: projectID,
+		Cwd:       input.Cwd,
+	})
+
+	verdicts := make([]pluginVerdict, len(covering))
+	var wg sync.WaitGroup
+	for i, p := range covering {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			verdicts[i] = runPlugin(p, request, input.Cwd)
+		}()
+	}
+	wg.Wait()
+
+	ask, denyReason := false, ""
+	var notes []string
+	for _, v := range verdicts {
+		tracef(1, "plugin %s: %s in %s", v.plugin, v.decision, v.duration.Round(time.Millisecond))
+		if v.decision != pluginAllow || v.err != nil {
+			logAudit(db, taskID, "plugin_decision", v.auditDetails(input))
+		}
+		switch v.decision {
+		case pluginDeny:
+			if denyReason == "" {
+				denyReason = "Blocked by plugin " + v.plugin + ": " + v.describe()
+			}
+		case pluginAsk:
+			ask = true
+			notes = append(notes, "Plugin "+v.plugin+": "+v.describe())
+		}
+	}
+	return ask, denyReason, strings.Join(notes, "\n")
+}
+
+// describe says why the plugin decided as it did
+func (v pluginVerdict) describe() string {
+	reason := v.reason
+	if v.err != nil {
+		reason = v.err.Error()
+	}
+	if reason == "" {
+		reason = "no reason given"
+	}
+	if v.score != nil {
+		reason += fmt.Sprintf(" (score %.2f)", *v.score)
+	}
+	return reason
+}
+
+// auditDetails is the plugin_decision event's details
+func (v pluginVerdict) auditDetails(input HookInput) string {
+	details := map[string]interface{}{
+		"plugin":      v.plugin,
+		"tool":        input.ToolName,
+		"decision":    v.decision,
+		"reason":      v.reason,
+		"session_id":  input.SessionID,
+		"duration_ms": v.duration.Milliseconds(),
+	}
+	if v.score != nil {
+		details["score"] = *v.score
+	}
+	if v.err != nil {
+		details["error"] = v.err.Error()
+	}
+	data, _ := json.Marshal(details)
+	return string(data)
+}
+
+// runPlugin runs a plugin on a request and turns its response into a decision
+func runPlugin(p PluginConfig, request []byte, cwd string) pluginVerdict {
+	start := time.Now()
+	v := pluginVerdict{plugin: p.Name}
+	response, err := execPlugin(p, request, cwd)
+	if err == nil {
+		v.decision, v.err = response.verdict(p)
+		v.reason, v.score = response.Reason, response.Score
+	} else {
+		v.err = err
+	}
+	if v.err != nil {
+		v.decision = p.onError()
+	}
+	v.duration = time.Since(start)
+	return v
+}
+
+// verdict returns the response's decision, from the score when it doesn't give one
+func (r pluginResponse) verdict(p PluginConfig) (string, error) {
+	if r.Score != nil && (*r.Score < 0 || *r.Score > 1) {
+		return "", fmt.Errorf("answered with score %v, outside 0 to 1", *r.Score)
+	}
+	switch r.Decision {
+	case pluginAllow, pluginAsk, pluginDeny:
+		return r.Decision, nil
+	case "":
+	default:
+		return "", fmt.Errorf("answered with unknown decision %q (want allow, ask, or deny)", r.Decision)
+	}
+	if r.Score == nil {
+		return "", errors.New("answered with neither a decision nor a score")
+	}
+	switch {
+	case p.DenyAbove != nil && *r.Score > *p.DenyAbove:
+		return pluginDeny, nil
+	case p.AskAbove != nil && *r.Score > *p.AskAbove:
+		return pluginAsk, nil
+	default:
+		return pluginAllow, nil
+	}
+}
+
+// execPlugin runs a plugin with the request on stdin and reads its response
+func execPlugin(p PluginConfig, request []byte, cwd string) (pluginResponse, error) {
+	if p.Wasm != "" {
+		// Compiling isn't timed, since it happens once and the result is cached
+		if _, _, err := compiledWasmPlugin(p.Wasm); err != nil {
+			return pluginResponse{}, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout())
+	defer cancel()
+
+	stdout, stderr := &cappedBuffer{limit: pluginOutputLimit}, &cappedBuffer{limit: pluginOutputLimit}
+	var err error
+	if p.Wasm != "" {
+		err = runWasmPlugin(ctx, p, request, stdout, stderr)
+	} else {
+		cmd := pluginCommand(ctx, p, cwd)
+		cmd.Stdin = bytes.NewReader(request)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		cmd.WaitDelay = time.Second
+		err = cmd.Run()
+	}
+	var response pluginResponse
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return response, fmt.Errorf("timed out after %s", p.timeout())
+	case err != nil:
+		message := strings.TrimSpace(tail(stderr.String(), 200))
+		if message != "" {
+			return response, fmt.Errorf("%v: %s", err, message)
+		}
+		return response, err
+	case stdout.over:
+		return response, fmt.Errorf("wrote more than %d KiB", pluginOutputLimit>>10)
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return response, fmt.Errorf("answered with something other than a response: %v", err)
+	}
+	return response, nil
+}
+
+// pluginCommand builds the command that runs a plugin, in its container if it has an image
+func pluginCommand(ctx context.Context, p PluginConfig, cwd string) *exec.Cmd {
+	var names []string
+	for _, name := range slices.Concat(pluginEnv, p.Env) {
+		if _, ok := os.LookupEnv(name); ok {
+			names = append(names, name)
+		}
+	}
+	if p.Image == "" {
+		cmd := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...)
+		if info, err := os.Stat(cwd); err == nil && info.IsDir() {
+			cmd.Dir = cwd
+		}
+		cmd.Env = []string{"NERV_PLUGIN_PROTOCOL=" + pluginProtocol}
+		for _, name := range names {
+			cmd.Env = append(cmd.Env, name+"="+os.Getenv(name))
+		}
+		return cmd
+	}
+
+	args := []string{loadConfig().Sandbox.runtime(), "run", "--rm", "-i", "--network=none", "--read-only", "-e", "NERV_PLUGIN_PROTOCOL=" + pluginProtocol}
+	if cwd != "" {
+		args = append(args, "-v", cwd+":"+cwd+":ro", "-w", cwd)
+	}
+	// The container gets only these variables, by name, so their values stay
+	// out of the runtime's arguments; the runtime itself needs the hook's whole environment
+	for _, name := range names {
+		args = append(args, "-e", name)
+	}
+	args = append(append(args, p.Image), p.Command...)
+	return exec.CommandContext(ctx, args[0], args[1:]...)
+}
+
+// cappedBuffer keeps up to limit bytes of what's written to it, noting when there was more
+type cappedBuffer struct {
+	bytes.Buffer
+	limit int
+	over  bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); len(p) > room {
+		b.over = true
+		b.Buffer.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
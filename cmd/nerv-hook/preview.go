@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// previewTimeout bounds a dry run, which delays the approval request by as much
+const previewTimeout = 10 * time.Second
+
+// previewOutputLimit caps the dry run output kept in an approval's context
+const previewOutputLimit = 4000
+
+// previewFileLimit caps the files counted for an rm preview
+const previewFileLimit = 10000
+
+// dryRuns rewrite a command to its own dry-run form, given its argv
+// Each returns nil when the command has no dry run or already is one
+var dryRuns = map[string]func(args []string) []string{
+	"git": func(args []string) []string {
+		if len(args) < 2 {
+			return nil
+		}
+		switch args[1] {
+		case "push", "clean", "rm":
+			return withFlag(args, 2, "--dry-run", "-n", "--dry-run")
+		}
+		return nil
+	},
+	"rsync": func(args []string) []string {
+		return withFlag(args, 1, "--dry-run", "-n", "--dry-run", "--itemize-changes")
+	},
+	"make": func(args []string) []string {
+		return withFlag(args, 1, "--dry-run", "-n", "--dry-run")
+	},
+	"npm": func(args []string) []string {
+		if len(args) > 1 && args[1] == "publish" {
+			return withFlag(args, 2, "--dry-run", "", "--dry-run")
+		}
+		return nil
+	},
+	"cargo": func(args []string) []string {
+		if len(args) > 1 && args[1] == "publish" {
+			return withFlag(args, 2, "--dry-run", "", "--dry-run")
+		}
+		return nil
+	},
+	"kubectl": func(args []string) []string {
+		if len(args) > 1 && (args[1] == "apply" || args[1] == "delete" || args[1] == "create") {
+			return withFlag(args, 2, "--dry-run", "", "--dry-run=server")
+		}
+		return nil
+	},
+	"terraform": func(args []string) []string {
+		if len(args) > 1 && args[1] == "apply" && !slices.ContainsFunc(args[2:], isPlanFile) {
+			plan := append([]string{args[0], "plan"}, args[2:]...)
+			return slices.DeleteFunc(plan, func(a string) bool { return a == "-auto-approve" || a == "--auto-approve" })
+		}
+		return nil
+	},
+}
+
+// withFlag inserts flags at i unless the command already has long or short
+func withFlag(args []string, i int, long, short string, flags ...string) []string {
+	for _, arg := range args[i:] {
+		if arg == "--" {
+			break
+		}
+		if strings.HasPrefix(arg, long) || (short != "" && arg == short) {
+			return nil
+		}
+	}
+	return slices.Concat(args[:i], flags, args[i:])
+}
+
+func isPlanFile(arg string) bool {
+	return !strings.HasPrefix(arg, "-")
+}
+
+// previewNote predicts what a Bash command needing approval would do, for the approval's context
+// Where the command has a dry-run form it's run in cwd; rm's targets are counted instead
+// Only single commands whose words need no shell expansion are previewed; anything
+// else, and any preview that fails to start, gets no note
+func previewNote(toolName string, toolInput map[string]interface{}, cwd string) string {
+	if toolName != "Bash" || !loadConfig().Approvals.preview() {
+		return ""
+	}
+	command, _ := toolInput["command"].(string)
+	all := policy.CommandArgs(command)
+	if len(all) != 1 {
+		return ""
+	}
+	args := all[0]
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "$`") {
+			return ""
+		}
+	}
+
+	if path.Base(args[0]) == "rm" {
+		return rmPreview(args[1:], cwd)
+	}
+	dryRun, ok := dryRuns[path.Base(args[0])]
+	if !ok {
+		return ""
+	}
+	preview := dryRun(args)
+	if preview == nil {
+		return ""
+	}
+	for _, arg := range preview {
+		if strings.ContainsAny(arg, "*?[~") {
+			return ""
+		}
+	}
+	return runPreview(preview, cwd)
+}
+
+// runPreview runs a dry-run command and reports its output
+func runPreview(args []string, cwd string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), previewTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = cwd
+	// A dry run that would prompt for credentials fails instead of hanging
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	var result string
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		result = fmt.Sprintf("timed out after %s", previewTimeout)
+	case errors.As(err, &exitErr):
+		result = fmt.Sprintf("exit %d", exitErr.ExitCode())
+	case err != nil:
+		// Not installed, most likely; the approval goes ahead without a preview
+		return ""
+	default:
+		result = "exit 0"
+	}
+	output := strings.TrimSpace(tail(out.String(), previewOutputLimit))
+	if output == "" {
+		output = "(no output)"
+	}
+	return fmt.Sprintf("Dry run (%s, %s):\n%s", strings.Join(args, " "), result, output)
+}
+
+// rmPreview counts what rm would remove, resolving globs and ~ as the shell would
+func rmPreview(args []string, cwd string) string {
+	recursive := false
+	var targets []string
+	for i, arg := range args {
+		if arg == "--" {
+			targets = append(targets, args[i+1:]...)
+			break
+		}
+		if strings.HasPrefix(arg, "-") && arg != "-" {
+			recursive = recursive || arg == "--recursive" || (!strings.HasPrefix(arg, "--") && strings.ContainsAny(arg[1:], "rR"))
+			continue
+		}
+		targets = append(targets, arg)
+	}
+	if len(targets) == 0 {
+		return ""
+	}
+
+	var lines []string
+	files, dirs := 0, 0
+	for _, target := range targets {
+		p := expandHome(target)
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(cwd, p)
+		}
+		matches, _ := filepath.Glob(p)
+		if len(matches) == 0 {
+			lines = append(lines, fmt.Sprintf("%s: doesn't exist", target))
+			continue
+		}
+		for _, m := range matches {
+			info, err := os.Lstat(m)
+			if err != nil {
+				continue
+			}
+			if !info.IsDir() {
+				files++
+				continue
+			}
+			if !recursive {
+				lines = append(lines, fmt.Sprintf("%s: directory, which rm refuses without -r", m))
+				continue
+			}
+			f, d := countTree(m)
+			files, dirs = files+f, dirs+d
+			lines = append(lines, fmt.Sprintf("%s: directory, %s", m, countSummary(f, d)))
+		}
+	}
+	lines = append([]string{"rm would remove " + countSummary(files, dirs)}, lines...)
+	return "Preview:\n" + strings.Join(lines, "\n")
+}
+
+// countTree counts the files and directories under root, including it, up to previewFileLimit
+func countTree(root string) (files, dirs int) {
+	filepath.WalkDir(root, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			dirs++
+		} else {
+			files++
+		}
+		if files+dirs >= previewFileLimit {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return files, dirs
+}
+
+func countSummary(files, dirs int) string {
+	s := fmt.Sprintf("%d files and %d directories", files, dirs)
+	if files+dirs >= previewFileLimit {
+		s = "at least " + s
+	}
+	return s
+}
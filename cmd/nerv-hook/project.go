@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+const projectUsage = "usage: nerv-hook project init|add|list|remove|set-default"
+
+// runProject implements `nerv-hook project`
+func runProject(args []string) error {
+	if len(args) < 1 {
+		return errors.New(projectUsage)
+	}
+
+	switch args[0] {
+	case "init":
+		return runProjectInit(args[1:])
+	case "add":
+		return runProjectAdd(args[1:])
+	case "list":
+		return runProjectList(args[1:])
+	case "remove":
+		return runProjectRemove(args[1:])
+	case "set-default":
+		return runProjectSetDefault(args[1:])
+	default:
+		return errors.New(projectUsage)
+	}
+}
+
+// runProjectAdd registers a directory, creating a project for it unless --project names an existing one
+func runProjectAdd(args []string) error {
+	fs := flag.NewFlagSet("project add", flag.ContinueOnError)
+	name := fs.String("name", "", "project name (default the directory name)")
+	goal := fs.String("goal", "", "what the project is for")
+	existing := fs.String("project", "", "add the directory to this existing project instead of creating one")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: nerv-hook project add [--name NAME] [--goal TEXT] [--project ID] <path>")
+	}
+
+	dir, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	st, err := openOperatorStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	projectID, err := registerProjectDir(st, dir, *name, *goal, *existing)
+	if err != nil {
+		return err
+	}
+	reportProjectConfig(dir)
+
+	fmt.Println(projectID)
+	return nil
+}
+
+// registerProjectDir adds dir to the existing project, or to a new project
+// named name (default the directory name) when existing is empty
+// Returns the project's ID
+func registerProjectDir(st *store.DB, dir, name, goal, existing string) (string, error) {
+	repos, err := st.ListRepos("")
+	if err != nil {
+		return "", err
+	}
+	for _, r := range repos {
+		if r.Path == dir {
+			return "", fmt.Errorf("%s is already registered to project %s", dir, r.ProjectID)
+		}
+	}
+
+	projectID := existing
+	if projectID != "" {
+		if _, err := st.GetProject(projectID); errors.Is(err, store.ErrNotFound) {
+			return "", fmt.Errorf("project not found: %s", projectID)
+		} else if err != nil {
+			return "", err
+		}
+	} else {
+		project := store.Project{ID: store.NewID(), Name: name, Goal: goal}
+		if project.Name == "" {
+			project.Name = filepath.Base(dir)
+		}
+		if err := st.CreateProject(project); err != nil {
+			return "", err
+		}
+		details, _ := json.Marshal(map[string]string{"name": project.Name, "path": dir, "source": "cli"})
+		if err := st.LogAudit("", "project_created", string(details)); err != nil {
+			return "", err
+		}
+		projectID = project.ID
+	}
+
+	if err := st.CreateRepo(store.Repo{ID: store.NewID(), ProjectID: projectID, Name: filepath.Base(dir), Path: dir}); err != nil {
+		return "", err
+	}
+	return projectID, nil
+}
+
+// reportProjectConfig points out the rules a newly registered directory brings
+// with it, since registering is what makes the hook apply them
+func reportProjectConfig(dir string) {
+	cfg, err := readProjectConfig(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	path := filepath.Join(dir, projectConfigFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s does not parse and will be ignored: %v\n", path, err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Applying %d allow and %d deny rules and %d verification commands from %s\n",
+		len(cfg.Allow), len(cfg.Deny), len(cfg.Verify), path)
+	for _, rule := range cfg.Allow {
+		fmt.Fprintf(os.Stderr, "  allow %s\n", rule)
+	}
+}
+
+// runProjectList prints every project with its directories, marking the default
+func runProjectList(args []string) error {
+	fs := flag.NewFlagSet("project list", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the projects as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	projects, err := st.ListProjects()
+	if err != nil {
+		return err
+	}
+	if len(projects) == 0 && !*asJSON {
+		fmt.Println("No projects")
+		return nil
+	}
+	repos, err := st.ListRepos("")
+	if err != nil {
+		return err
+	}
+	paths := map[string][]string{}
+	for _, r := range repos {
+		paths[r.ProjectID] = append(paths[r.ProjectID], r.Path)
+	}
+	defaultID, err := st.GetSetting(store.SettingCurrentProject)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+
+	if *asJSON {
+		out := make([]jsonProject, 0, len(projects))
+		for _, p := range projects {
+			out = append(out, jsonProject{ID: p.ID, Name: p.Name, Goal: p.Goal, Paths: append([]string{}, paths[p.ID]...), Default: p.ID == defaultID})
+		}
+		return printJSON(out)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tID\tNAME\tPATHS")
+	for _, p := range projects {
+		marker := ""
+		if p.ID == defaultID {
+			marker = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", marker, p.ID, p.Name, strings.Join(paths[p.ID], ", "))
+	}
+	return w.Flush()
+}
+
+// runProjectRemove deletes a project; its tasks, approvals and directories go with it
+func runProjectRemove(args []string) error {
+	fs := flag.NewFlagSet("project remove", flag.ContinueOnError)
+	force := fs.Bool("force", false, "remove the project even if it still has tasks")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: nerv-hook project remove [--force] <project-id>")
+	}
+	projectID := fs.Arg(0)
+
+	st, err := openOperatorStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	tasks, err := st.ListTasks(store.TaskFilter{ProjectID: projectID})
+	if err != nil {
+		return err
+	}
+	if len(tasks) > 0 && !*force {
+		return fmt.Errorf("project %s has %d tasks, which would be deleted with it; pass --force to remove it anyway", projectID, len(tasks))
+	}
+
+	if err := st.DeleteProject(projectID); errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("project not found: %s", projectID)
+	} else if err != nil {
+		return err
+	}
+	if defaultID, err := st.GetSetting(store.SettingCurrentProject); err == nil && defaultID == projectID {
+		if err := st.DeleteSetting(store.SettingCurrentProject); err != nil {
+			return err
+		}
+	}
+
+	details, _ := json.Marshal(map[string]interface{}{"project_id": projectID, "tasks": len(tasks), "source": "cli"})
+	if err := st.LogAudit("", "project_removed", string(details)); err != nil {
+		return err
+	}
+	fmt.Printf("Removed project %s\n", projectID)
+	return nil
+}
+
+// runProjectSetDefault makes a project the fallback when the working directory doesn't identify one
+func runProjectSetDefault(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: nerv-hook project set-default <project-id>")
+	}
+	projectID := args[0]
+
+	st, err := openOperatorStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	if _, err := st.GetProject(projectID); errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("project not found: %s", projectID)
+	} else if err != nil {
+		return err
+	}
+	if err := st.SetSetting(store.SettingCurrentProject, projectID); err != nil {
+		return err
+	}
+	fmt.Printf("Default project is %s\n", projectID)
+	return nil
+}
+
+// resolveProjectID picks the project for this process: NERV_PROJECT_ID if set,
+// otherwise the registered project containing the working directory, otherwise
+// the default project
+// Returns "" when none applies; lookup errors are treated the same, since an
+// older schema without the repos table simply has no registrations
+func resolveProjectID(st *store.DB) string {
+	if id := os.Getenv("NERV_PROJECT_ID"); id != "" {
+		return id
+	}
+	if st == nil {
+		return ""
+	}
+
+	if cwd, err := os.Getwd(); err == nil {
+		if id, err := st.ProjectForDir(cwd); err == nil {
+			return id
+		}
+	}
+	id, _ := st.GetSetting(store.SettingCurrentProject)
+	return id
+}
+
+// lookupProjectID resolves the project, opening the state database read-only only if the environment doesn't name one
+func lookupProjectID() string {
+	if id := os.Getenv("NERV_PROJECT_ID"); id != "" {
+		return id
+	}
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return ""
+	}
+	defer st.Close()
+	return resolveProjectID(st)
+}
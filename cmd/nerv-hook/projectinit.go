@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// projectStack is a toolchain project init recognises, with the rules and
+// verification commands it suggests for it
+type projectStack struct {
+	Name string
+	// Markers are files at the repository root that identify the stack
+	Markers []string
+	Allow   []string
+	Verify  []string
+}
+
+// projectStacks are checked in order; a repository can match several
+var projectStacks = []projectStack{
+	{
+		Name:    "Go",
+		Markers: []string{"go.mod"},
+		Allow:   []string{"Bash(go build:*)", "Bash(go test:*)", "Bash(go vet:*)", "Bash(gofmt:*)"},
+		Verify:  []string{"go build ./...", "go vet ./...", "go test ./..."},
+	},
+	{
+		Name:    "Rust",
+		Markers: []string{"Cargo.toml"},
+		Allow:   []string{"Bash(cargo build:*)", "Bash(cargo test:*)", "Bash(cargo clippy:*)", "Bash(cargo fmt:*)"},
+		Verify:  []string{"cargo build", "cargo test"},
+	},
+	{
+		Name:    "Python",
+		Markers: []string{"pyproject.toml", "setup.py", "requirements.txt"},
+		Allow:   []string{"Bash(pytest:*)", "Bash(python -m pytest:*)", "Bash(ruff check:*)"},
+		Verify:  []string{"python -m pytest"},
+	},
+	{
+		Name:    "Ruby",
+		Markers: []string{"Gemfile"},
+		Allow:   []string{"Bash(bundle exec rake:*)", "Bash(bundle exec rspec:*)"},
+		Verify:  []string{"bundle exec rake"},
+	},
+	{
+		Name:    "Maven",
+		Markers: []string{"pom.xml"},
+		Allow:   []string{"Bash(mvn test:*)", "Bash(mvn package:*)"},
+		Verify:  []string{"mvn -q test"},
+	},
+	{
+		Name:    "Gradle",
+		Markers: []string{"build.gradle", "build.gradle.kts"},
+		Allow:   []string{"Bash(./gradlew build:*)", "Bash(./gradlew test:*)"},
+		Verify:  []string{"./gradlew test"},
+	},
+}
+
+// detectStacks returns the stacks whose marker files are in dir
+func detectStacks(dir string) []projectStack {
+	var found []projectStack
+	if stack, ok := detectNodeStack(dir); ok {
+		found = append(found, stack)
+	}
+	for _, stack := range projectStacks {
+		for _, marker := range stack.Markers {
+			if _, err := os.Stat(filepath.Join(dir, marker)); err == nil {
+				found = append(found, stack)
+				break
+			}
+		}
+	}
+	return found
+}
+
+// detectNodeStack recognises a package.json, using the package manager its
+// lockfile points to and only the scripts it defines
+func detectNodeStack(dir string) (projectStack, bool) {
+	data, err := os.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		return projectStack{}, false
+	}
+	var pkg struct {
+		Scripts map[string]string `json:"scripts"`
+	}
+	// A package.json that doesn't parse still marks the stack; it just has no scripts
+	_ = json.Unmarshal(data, &pkg)
+
+	manager := "npm"
+	for _, lock := range []struct{ file, manager string }{{"pnpm-lock.yaml", "pnpm"}, {"yarn.lock", "yarn"}, {"bun.lockb", "bun"}} {
+		if _, err := os.Stat(filepath.Join(dir, lock.file)); err == nil {
+			manager = lock.manager
+			break
+		}
+	}
+
+	stack := projectStack{
+		Name:  "Node.js (" + manager + ")",
+		Allow: []string{fmt.Sprintf("Bash(%s test:*)", manager), fmt.Sprintf("Bash(%s run:*)", manager)},
+	}
+	for _, script := range []string{"typecheck", "lint", "build"} {
+		if _, ok := pkg.Scripts[script]; ok {
+			stack.Verify = append(stack.Verify, manager+" run "+script)
+		}
+	}
+	if _, ok := pkg.Scripts["test"]; ok {
+		stack.Verify = append(stack.Verify, manager+" test")
+	}
+	return stack, true
+}
+
+// prompter asks the questions of an interactive command
+// With yes set it takes every default without reading anything
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+	yes bool
+}
+
+// ask prints question and returns the answer, or def if it's left empty
+func (p *prompter) ask(question, def string) string {
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	if p.yes {
+		fmt.Fprintln(p.out)
+		return def
+	}
+	line, err := p.in.ReadString('\n')
+	if err != nil && line == "" {
+		// Treat a closed input as accepting the rest of the defaults
+		fmt.Fprintln(p.out)
+		p.yes = true
+		return def
+	}
+	if answer := strings.TrimSpace(line); answer != "" {
+		return answer
+	}
+	return def
+}
+
+// confirm asks a yes/no question
+func (p *prompter) confirm(question string, def bool) bool {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	answer := strings.ToLower(p.ask(question+" ("+hint+")", ""))
+	switch {
+	case answer == "":
+		return def
+	case strings.HasPrefix(answer, "y"):
+		return true
+	default:
+		return false
+	}
+}
+
+// projectInitOptions are the answers project init can take from flags
+type projectInitOptions struct {
+	dir, name, goal, task string
+	yes, noHooks, force   bool
+}
+
+// runProjectInit implements `nerv-hook project init`
+func runProjectInit(args []string) error {
+	var opts projectInitOptions
+	fs := flag.NewFlagSet("project init", flag.ContinueOnError)
+	fs.StringVar(&opts.name, "name", "", "project name (default the directory name)")
+	fs.StringVar(&opts.goal, "goal", "", "what the project is for")
+	fs.StringVar(&opts.task, "task", "", "title of a starter task to create")
+	fs.BoolVar(&opts.yes, "yes", false, "accept the defaults instead of asking")
+	fs.BoolVar(&opts.noHooks, "no-hooks", false, "don't register the hooks in the project's .claude/settings.json")
+	fs.BoolVar(&opts.force, "force", false, "replace an existing "+projectConfigFile)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return errors.New("usage: nerv-hook project init [--yes] [--name NAME] [--goal TEXT] [--task TITLE] [--no-hooks] [--force] [path]")
+	}
+	opts.dir = "."
+	if fs.NArg() == 1 {
+		opts.dir = fs.Arg(0)
+	}
+	return projectInit(opts, &prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout, yes: opts.yes})
+}
+
+// projectInit walks through setting up a directory as a NERV project
+func projectInit(opts projectInitOptions, p *prompter) error {
+	dir, err := filepath.Abs(opts.dir)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	out := p.out
+	fmt.Fprintf(out, "Setting up %s as a NERV project\n\n", dir)
+
+	// NERV itself, for a first run on this machine
+	if _, err := os.Stat(dbPath); errors.Is(err, os.ErrNotExist) && os.Getenv("NERV_DB_URL") == "" {
+		if err := setUpNerv(out, false); err != nil {
+			return err
+		}
+		fmt.Fprintln(out)
+	}
+	st, err := openOperatorStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	// The stack, which decides the suggested rules and checks
+	stacks := detectStacks(dir)
+	var allow, verify []string
+	if len(stacks) == 0 {
+		fmt.Fprintln(out, "Stack:       not recognised; the project file will start without rules")
+	} else {
+		names := make([]string, len(stacks))
+		for i, s := range stacks {
+			names[i] = s.Name
+			allow = append(allow, s.Allow...)
+			verify = append(verify, s.Verify...)
+		}
+		fmt.Fprintf(out, "Stack:       %s\n", strings.Join(names, ", "))
+	}
+
+	// The project's own permissions file
+	path := filepath.Join(dir, projectConfigFile)
+	_, statErr := os.Stat(path)
+	write := errors.Is(statErr, os.ErrNotExist) || opts.force
+	if !write {
+		write = p.confirm(fmt.Sprintf("%s exists. Replace it with the suggested rules?", projectConfigFile), false)
+	}
+	if write {
+		if err := writeProjectConfig(path, allow, verify); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Permissions: wrote %s (%d allow rules, %d verification commands)\n", path, len(allow), len(verify))
+	} else {
+		fmt.Fprintf(out, "Permissions: kept %s\n", path)
+	}
+
+	// The project and its directory
+	projectID, err := st.ProjectForDir(dir)
+	switch {
+	case err == nil:
+		fmt.Fprintf(out, "Project:     already registered as %s\n", projectID)
+	case errors.Is(err, store.ErrNotFound):
+		name := opts.name
+		if name == "" {
+			name = p.ask("Project name", filepath.Base(dir))
+		}
+		goal := opts.goal
+		if goal == "" {
+			goal = p.ask("Goal (optional)", "")
+		}
+		if projectID, err = registerProjectDir(st, dir, name, goal, ""); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Project:     registered %s as %s\n", name, projectID)
+	default:
+		return err
+	}
+
+	// Hooks for sessions in this directory, unless every project already has them
+	switch {
+	case opts.noHooks:
+		fmt.Fprintln(out, "Hooks:       skipped")
+	case userHooksInstalled():
+		fmt.Fprintln(out, "Hooks:       already registered for every project in ~/.claude/settings.json")
+	case p.confirm("Register the NERV hooks in this project's .claude/settings.json?", true):
+		if err := runInstall([]string{"--scope", "project", "--project-dir", dir}); err != nil {
+			return err
+		}
+	default:
+		fmt.Fprintln(out, "Hooks:       skipped; run nerv-hook install when you're ready")
+	}
+
+	// Something to work on
+	title := opts.task
+	if title == "" && !p.yes {
+		title = p.ask("Starter task title (leave empty to skip)", "")
+	}
+	if title != "" {
+		task := store.Task{ID: store.NewID(), ProjectID: projectID, Title: title}
+		if err := st.CreateTask(task); err != nil {
+			return err
+		}
+		details, _ := json.Marshal(map[string]string{"projectId": projectID, "title": title})
+		if err := st.LogAudit(task.ID, "task_created", string(details)); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Task:        created %s\n", task.ID)
+		fmt.Fprintf(out, "\nStart it with: eval \"$(nerv-hook task start %s)\"\n", task.ID)
+	}
+	return nil
+}
+
+// writeProjectConfig writes a project's .nerv/permissions.json
+func writeProjectConfig(path string, allow, verify []string) error {
+	doc := struct {
+		Comment []string `json:"$comment"`
+		Allow   []string `json:"allow"`
+		Deny    []string `json:"deny"`
+		Verify  []string `json:"verify,omitempty"`
+	}{
+		Comment: []string{
+			"NERV rules for this project, added to those in the user's permissions.json while it's registered.",
+			"deny in either file always wins; verify runs when a session stops, unless permissions.json lists commands for the project.",
+		},
+		Allow:  append([]string{}, allow...),
+		Deny:   []string{},
+		Verify: verify,
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// userHooksInstalled reports whether ~/.claude/settings.json already runs the hooks for every project
+// Registering them for the project too would run each hook twice
+func userHooksInstalled() bool {
+	path, err := claudeSettingsPath(installOptions{scope: "user"})
+	if err != nil {
+		return false
+	}
+	settings, err := readClaudeSettings(path)
+	if err != nil {
+		return false
+	}
+	self, _ := resolveHookBinary("")
+	return registeredHookCommand(settings, nervHookRegistrations[0], self) != ""
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/nerv/nerv-hook/internal/migrations"
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// storeRouter hands out the Store for a project
+// In per-project mode a project's audit events go to its own database under
+// ~/.nerv/projects/<id>/, so one noisy project's audit log doesn't slow the
+// rest down; everything else stays in the global database
+type storeRouter struct {
+	global     *store.DB
+	perProject bool
+
+	mu       sync.Mutex
+	projects map[string]*store.DB
+}
+
+// newStoreRouter routes by project if the config asks for it and the global database is SQLite
+func newStoreRouter(global *store.DB) *storeRouter {
+	cfg := loadConfig().Database
+	return &storeRouter{
+		global:     global,
+		perProject: cfg != nil && cfg.PerProject && global.Dialect() == migrations.SQLite,
+		projects:   map[string]*store.DB{},
+	}
+}
+
+// projectDBPath is where a project's database lives in per-project mode
+func projectDBPath(projectID string) string {
+	return filepath.Join(nervDir, "projects", projectID, "state.db")
+}
+
+// forProject returns the Store to use for events from projectID
+// Falls back to the global database when there is no usable project database
+func (r *storeRouter) forProject(projectID string) Store {
+	if !r.perProject || projectID == "" {
+		return r.global
+	}
+	// The ID becomes a directory name, so it must not reach outside projects/
+	if projectID != filepath.Base(projectID) || projectID == "." || projectID == ".." {
+		fmt.Fprintf(os.Stderr, "Invalid project ID %q, using the global database\n", projectID)
+		return r.global
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	project, ok := r.projects[projectID]
+	if !ok {
+		var err error
+		project, err = openProjectStore(projectDBPath(projectID))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open project database, using the global database: %v\n", err)
+			return r.global
+		}
+		r.projects[projectID] = project
+	}
+
+	return projectStore{Store: r.global, project: project}
+}
+
+// sqliteStores returns the open SQLite databases, global first
+func (r *storeRouter) sqliteStores() []*store.DB {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var stores []*store.DB
+	if r.global.Dialect() == migrations.SQLite {
+		stores = append(stores, r.global)
+	}
+	for _, project := range r.projects {
+		stores = append(stores, project)
+	}
+	return stores
+}
+
+// Close closes every project database and the global database
+func (r *storeRouter) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, project := range r.projects {
+		project.Close()
+		delete(r.projects, id)
+	}
+	return r.global.Close()
+}
+
+// openProjectStore opens (creating if needed) a project database and migrates it
+// It shares the global schema, but only audit_log is used
+func openProjectStore(path string) (*store.DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	st, err := store.OpenSQLite(path, "rwc", dbOptions())
+	if err != nil {
+		return nil, err
+	}
+	if err := migrations.Check(st.SQL(), st.Dialect()); err != nil {
+		st.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if _, err := st.Migrate(); err != nil {
+		st.Close()
+		return nil, fmt.Errorf("failed to migrate %s: %w", path, err)
+	}
+	return st, nil
+}
+
+// projectStore writes and reads audit events in the project's database and
+// sends everything else to the global database, where the dashboard looks for
+// tasks and pending approvals
+// An approval's approval_requested event stays with it in the global database,
+// so the two are still written in one transaction
+type projectStore struct {
+	Store
+	project Store
+}
+
+func (s projectStore) LogAudit(taskID, eventType, details string) error {
+	return s.project.LogAudit(taskID, eventType, details)
+}
+
+func (s projectStore) LogAuditBatch(events []store.AuditEvent) error {
+	return s.project.LogAuditBatch(events)
+}
+
+func (s projectStore) ListAudit(f store.AuditFilter) ([]store.AuditEvent, error) {
+	return s.project.ListAudit(f)
+}
+
+func (s projectStore) SessionEvents(sessionID string, limit int) ([]string, error) {
+	return s.project.SessionEvents(sessionID, limit)
+}
+
+func (s projectStore) SessionHalted(sessionID string) (bool, error) {
+	return s.project.SessionHalted(sessionID)
+}
+
+func (s projectStore) SessionTripped(sessionID string) (bool, error) {
+	return s.project.SessionTripped(sessionID)
+}
+
+func (s projectStore) SessionRewrote(sessionID, rule string) (bool, error) {
+	return s.project.SessionRewrote(sessionID, rule)
+}
+
+// Close is a no-op; the router owns both databases
+func (s projectStore) Close() error {
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+const queueUsage = "usage: nerv-hook queue add|list|remove"
+
+// runQueue implements `nerv-hook queue`
+func runQueue(args []string) error {
+	if len(args) < 1 {
+		return errors.New(queueUsage)
+	}
+
+	switch args[0] {
+	case "add":
+		return runQueueAdd(args[1:])
+	case "list":
+		return runQueueList(args[1:])
+	case "remove":
+		return runQueueRemove(args[1:])
+	default:
+		return errors.New(queueUsage)
+	}
+}
+
+// runQueueAdd queues tasks for nervd to launch, or changes the priority of queued ones
+func runQueueAdd(args []string) error {
+	fs := flag.NewFlagSet("queue add", flag.ContinueOnError)
+	priority := fs.Int("priority", 0, "higher priorities launch first; equal priorities launch oldest first")
+	prompt := fs.String("prompt", "", "prompt to start the session with (default built from the task's title and description)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("usage: nerv-hook queue add [--priority N] [--prompt TEXT] <task-id>...")
+	}
+
+	st, err := openOperatorStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	for _, id := range fs.Args() {
+		task, err := loadTask(st, id)
+		if err != nil {
+			return err
+		}
+		if err := checkQueueable(task); err != nil {
+			return err
+		}
+		if _, err := queueRepoDir(st, task); err != nil {
+			return err
+		}
+		if err := st.EnqueueTask(task.ID, *priority, *prompt); err != nil {
+			return err
+		}
+		details, _ := json.Marshal(map[string]interface{}{"priority": *priority, "source": "cli"})
+		if err := st.LogAudit(task.ID, "task_queued", string(details)); err != nil {
+			return err
+		}
+		fmt.Printf("Queued task %s\n", task.ID)
+	}
+	return nil
+}
+
+// checkQueueable reports why nervd couldn't launch a task, if it couldn't
+// Queued tasks run in their own worktree, so one already in progress must have one to resume in
+func checkQueueable(task store.Task) error {
+	if task.Status == store.TaskInProgress {
+		if task.WorktreePath == "" {
+			return fmt.Errorf("task %s is already in progress outside a worktree", task.ID)
+		}
+		return nil
+	}
+	if !store.CanTransition(task.Status, store.TaskInProgress) {
+		return fmt.Errorf("task %s: %w", task.ID, &store.TransitionError{From: task.Status, To: store.TaskInProgress})
+	}
+	return nil
+}
+
+// queueRepoDir returns the repository nervd creates the task's worktree from
+// nervd has no working directory of its own, so it uses the project's first registered directory
+// Returns "" if the task already has a worktree and the project has no directory
+func queueRepoDir(st *store.DB, task store.Task) (string, error) {
+	repos, err := st.ListRepos(task.ProjectID)
+	if err != nil {
+		return "", err
+	}
+	if len(repos) > 0 {
+		return repos[0].Path, nil
+	}
+	if task.WorktreePath != "" {
+		return "", nil
+	}
+	return "", fmt.Errorf("project %s has no registered directory to create a worktree from; add one with nerv-hook project add", task.ProjectID)
+}
+
+// runQueueList prints the queue in launch order
+func runQueueList(args []string) error {
+	fs := flag.NewFlagSet("queue list", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the queue as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	queue, err := st.QueuedTasks()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		out := make([]jsonQueued, 0, len(queue))
+		for _, q := range queue {
+			j := jsonQueued{TaskID: q.TaskID, ProjectID: q.ProjectID, Priority: q.Priority, Prompt: q.Prompt, EnqueuedAt: q.EnqueuedAt}
+			if task, err := st.GetTask(q.TaskID); err == nil {
+				j.Title = task.Title
+			}
+			out = append(out, j)
+		}
+		return printJSON(out)
+	}
+	if quiet := loadConfig().Tasks.quietHours(); quiet.active(time.Now()) {
+		fmt.Printf("Quiet hours until %s; nothing will launch before then\n", quiet.End)
+	}
+	if len(queue) == 0 {
+		fmt.Println("Queue is empty")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PRIORITY\tTASK\tPROJECT\tQUEUED\tTITLE")
+	for _, q := range queue {
+		title := ""
+		if task, err := st.GetTask(q.TaskID); err == nil {
+			title = task.Title
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", q.Priority, q.TaskID, q.ProjectID, q.EnqueuedAt.Local().Format("2006-01-02 15:04"), title)
+	}
+	return w.Flush()
+}
+
+// runQueueRemove takes a task off the queue without changing its status
+func runQueueRemove(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: nerv-hook queue remove <task-id>")
+	}
+
+	st, err := openOperatorStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	if err := st.DequeueTask(args[0]); errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("task %s is not queued", args[0])
+	} else if err != nil {
+		return err
+	}
+	details, _ := json.Marshal(map[string]string{"source": "cli"})
+	if err := st.LogAudit(args[0], "task_unqueued", string(details)); err != nil {
+		return err
+	}
+	fmt.Printf("Removed task %s from the queue\n", args[0])
+	return nil
+}
+
+// scheduleQueue launches queued tasks as slots free up, checking every interval
+// Settings are reread each time, so limits and quiet hours can change while nervd runs
+func scheduleQueue(st *store.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	quiet := false
+	for now := range ticker.C {
+		cfg := loadConfig().Tasks
+		if cfg.quietHours().active(now) {
+			if !quiet {
+				fmt.Fprintln(os.Stderr, "nervd: quiet hours, not launching queued tasks")
+				quiet = true
+			}
+			continue
+		}
+		quiet = false
+
+		if err := dispatchQueue(st, cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "nervd: queue: %v\n", err)
+		}
+	}
+}
+
+// dispatchQueue launches queued tasks in order until the global or a project's limit is reached
+// A task that can't be launched is dropped from the queue so it doesn't block the ones behind it
+func dispatchQueue(st *store.DB, cfg *TaskConfig) error {
+	queue, err := st.QueuedTasks()
+	if err != nil || len(queue) == 0 {
+		return err
+	}
+	live, err := reapRuns(st)
+	if err != nil {
+		return err
+	}
+	running := map[string]int{}
+	for _, r := range live {
+		running[r.ProjectID]++
+	}
+
+	total := len(live)
+	for _, q := range queue {
+		if total >= cfg.maxConcurrent() {
+			return nil
+		}
+		if limit := cfg.projectLimit(q.ProjectID); limit > 0 && running[q.ProjectID] >= limit {
+			continue
+		}
+
+		if err := st.DequeueTask(q.TaskID); err != nil {
+			return err
+		}
+		if err := launchQueued(st, q); err != nil {
+			fmt.Fprintf(os.Stderr, "nervd: dropped task %s from the queue: %v\n", q.TaskID, err)
+			details, _ := json.Marshal(map[string]string{"error": err.Error()})
+			logAudit(st, q.TaskID, "queue_launch_failed", string(details))
+			continue
+		}
+		total++
+		running[q.ProjectID]++
+	}
+	return nil
+}
+
+// launchQueued starts a queued task in its worktree and launches a headless agent for it
+// The agent is waited for in the background
+func launchQueued(st *store.DB, q store.QueuedTask) error {
+	task, err := loadTask(st, q.TaskID)
+	if err != nil {
+		return err
+	}
+	if err := checkQueueable(task); err != nil {
+		return err
+	}
+
+	if task.Status != store.TaskInProgress {
+		dir, err := queueRepoDir(st, task)
+		if err != nil {
+			return err
+		}
+		if task, err = startTask(st, task, dir, task.WorktreePath == "", false); err != nil {
+			return err
+		}
+	}
+
+	cmd, runID, err := launchRun(st, task, "headless", runOptions{claude: defaultAgentCommand, prompt: q.Prompt, headless: true})
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := waitRun(st, task, cmd, runID); err != nil {
+			fmt.Fprintf(os.Stderr, "nervd: task %s: %v\n", task.ID, err)
+		}
+	}()
+	return nil
+}
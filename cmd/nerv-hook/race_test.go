@@ -0,0 +1,6 @@
+//go:build race
+
+package main
+
+// raceEnabled skips timing checks the race detector would fail
+const raceEnabled = true
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Rate limit outcomes for calls over a limit
+const (
+	// rateLimitAsk sends calls over the limit for approval, even ones the rules allow (default)
+	rateLimitAsk = "ask"
+	// rateLimitDeny refuses calls over the limit
+	rateLimitDeny = "deny"
+)
+
+// rateLimitSession is the Per that counts a whole session's calls
+const rateLimitSession = "session"
+
+// RateLimitConfig caps how often a session may call some tools, so a looping
+// agent runs into a governor rather than only the approval queue
+type RateLimitConfig struct {
+	// Tools are the tool names counted together, e.g. ["Write", "Edit"]; empty counts every tool
+	Tools []string `json:"tools,omitempty"`
+	// Max is the most calls allowed in the window
+	Max int `json:"max"`
+	// Per is the window: a duration such as "1m", or "session" (default) for the whole session
+	Per string `json:"per,omitempty"`
+	// OnExceed is ask (default) or deny
+	OnExceed string `json:"on_exceed,omitempty"`
+}
+
+// window returns how far back calls are counted, or 0 for the whole session
+func (l RateLimitConfig) window() (time.Duration, error) {
+	if l.Per == "" || l.Per == rateLimitSession {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(l.Per)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("per: %q is not a positive duration or session", l.Per)
+	}
+	return d, nil
+}
+
+// covers reports whether the limit counts calls to a tool
+func (l RateLimitConfig) covers(toolName string) bool {
+	return len(l.Tools) == 0 || slices.Contains(l.Tools, toolName)
+}
+
+func (l RateLimitConfig) denies() bool {
+	return l.OnExceed == rateLimitDeny
+}
+
+// describe says how many calls were made against the limit, e.g. "21 Bash calls in the last 1m (limit 20)"
+func (l RateLimitConfig) describe(calls int) string {
+	tools := "tool"
+	if len(l.Tools) > 0 {
+		tools = strings.Join(l.Tools, "/")
+	}
+	window := "this session"
+	if l.Per != "" && l.Per != rateLimitSession {
+		window = "the last " + l.Per
+	}
+	return fmt.Sprintf("%d %s calls in %s (limit %d)", calls, tools, window, l.Max)
+}
+
+// validateRateLimits reports rate limits that can't be applied
+func validateRateLimits(limits []RateLimitConfig) error {
+	for i, l := range limits {
+		if l.Max <= 0 {
+			return fmt.Errorf("rate limit %d: max must be positive", i+1)
+		}
+		if _, err := l.window(); err != nil {
+			return fmt.Errorf("rate limit %d: %v", i+1, err)
+		}
+		if l.OnExceed != "" && l.OnExceed != rateLimitAsk && l.OnExceed != rateLimitDeny {
+			return fmt.Errorf("rate limit %d: unknown on_exceed %q (want ask or deny)", i+1, l.OnExceed)
+		}
+	}
+	return nil
+}
+
+// rateLimited reports whether any of limits counts calls to a tool
+func rateLimited(limits []RateLimitConfig, toolName string) bool {
+	return slices.ContainsFunc(limits, func(l RateLimitConfig) bool { return l.covers(toolName) })
+}
+
+// checkRateLimits records a session's call to a tool and returns a message for
+// a limit it has gone over, and whether that limit denies the call
+// Of several limits gone over, a denying one is reported
+func checkRateLimits(db Store, sessionID, toolName string, limits []RateLimitConfig) (string, bool) {
+	if db == nil || sessionID == "" || !rateLimited(limits, toolName) {
+		return "", false
+	}
+	now := time.Now()
+	if err := db.LogToolCall(sessionID, toolName, now); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record the tool call for rate limits: %v\n", err)
+		return "", false
+	}
+
+	message, deny := "", false
+	for _, l := range limits {
+		if !l.covers(toolName) || (deny && !l.denies()) {
+			continue
+		}
+		// Invalid limits are skipped; doctor reports them
+		window, err := l.window()
+		if err != nil || l.Max <= 0 {
+			continue
+		}
+		var since time.Time
+		if window > 0 {
+			since = now.Add(-window)
+		}
+		calls, err := db.ToolCallsSince(sessionID, l.Tools, since)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to count tool calls: %v\n", err)
+			continue
+		}
+		if calls > l.Max && (message == "" || l.denies()) {
+			message, deny = "NERV rate limit exceeded: "+l.describe(calls), l.denies()
+		}
+	}
+	return message, deny
+}
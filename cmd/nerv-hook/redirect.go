@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// RedirectConfig sends writes outside the project into a directory of the
+// session's own, so an exploratory session can go ahead without touching the
+// real filesystem
+// A write is redirected with updatedInput; a file an edit changes is copied in
+// first, and later reads of a redirected file read the copy
+type RedirectConfig struct {
+	// Dir holds a directory for each session (default nerv-redirect in the system temp directory)
+	Dir string `json:"dir,omitempty"`
+}
+
+// redirectLog is the file in a session's directory listing what was redirected, one write a line
+const redirectLog = "redirects.log"
+
+// redirectTools are the file tools whose paths are redirected, and the input key naming the path
+// Only writes are redirected when the copy doesn't exist yet
+var redirectTools = map[string]struct {
+	key   string
+	write bool
+}{
+	"Write":        {"file_path", true},
+	"Edit":         {"file_path", true},
+	"MultiEdit":    {"file_path", true},
+	"NotebookEdit": {"notebook_path", true},
+	"Read":         {"file_path", false},
+}
+
+// Validate checks the directory is absolute, since a relative one would land in each project
+func (c *RedirectConfig) Validate() error {
+	if c == nil || c.Dir == "" || filepath.IsAbs(expandHome(c.Dir)) {
+		return nil
+	}
+	return fmt.Errorf("dir %q must be absolute", c.Dir)
+}
+
+func (c *RedirectConfig) dir() string {
+	if c.Dir == "" {
+		return filepath.Join(os.TempDir(), "nerv-redirect")
+	}
+	return filepath.Clean(expandHome(c.Dir))
+}
+
+// sessionDir is where a session's redirected files go
+func (c *RedirectConfig) sessionDir(sessionID string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, sessionID)
+	return filepath.Join(c.dir(), strings.TrimLeft(safe, "."))
+}
+
+// redirectPath returns where a path is kept in the session's directory
+func (c *RedirectConfig) redirectPath(sessionID, p string) string {
+	rel := strings.TrimPrefix(p, filepath.VolumeName(p))
+	return filepath.Join(c.sessionDir(sessionID), rel)
+}
+
+// original returns the path a file in the redirect directory is a copy of, or "" for any other path
+func (c *RedirectConfig) original(p string) string {
+	rel, err := filepath.Rel(c.dir(), p)
+	if err != nil || !filepath.IsLocal(rel) {
+		return ""
+	}
+	// The first element is the session's directory
+	_, rest, ok := strings.Cut(rel, string(filepath.Separator))
+	if !ok {
+		return ""
+	}
+	return filepath.Join(string(filepath.Separator), rest)
+}
+
+// redirectTarget returns the absolute path a file tool call names and where
+// it's kept in the session's directory, or "" if the call isn't redirected
+func redirectTarget(c *RedirectConfig, projectDirs []string, input HookInput) (string, string) {
+	tool, ok := redirectTools[input.ToolName]
+	p, _ := input.ToolInput[tool.key].(string)
+	if c == nil || !ok || p == "" || input.SessionID == "" || input.Cwd == "" {
+		return "", ""
+	}
+	p = expandHome(p)
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(input.Cwd, p)
+	}
+	p = filepath.Clean(p)
+	if withinDir(p, c.dir()) {
+		return "", ""
+	}
+	for _, dir := range append([]string{input.Cwd}, projectDirs...) {
+		if withinDir(p, dir) {
+			return "", ""
+		}
+	}
+	target := c.redirectPath(input.SessionID, p)
+	if !tool.write {
+		// A read is only redirected to a file the session already wrote
+		if _, err := os.Stat(target); err != nil {
+			return "", ""
+		}
+	}
+	return p, target
+}
+
+// redirectedInput returns the input a file tool call outside the project runs
+// with instead of its own, or why it's denied; both are empty for calls that
+// aren't redirected, which the rules decide as usual
+// Only deny rules apply to a redirected call, since it can't touch the file it names
+func redirectedInput(db Store, projectID, taskID string, input HookInput, toolInput string) (map[string]interface{}, string) {
+	c := loadConfig().RedirectWrites
+	if c == nil {
+		return nil, ""
+	}
+	from, to := redirectTarget(c, projectDirs(db, projectID, taskID), input)
+	if to == "" {
+		return nil, ""
+	}
+	rules := permissionRules(db, projectID, taskID, input.Cwd)
+	if reason := (policy.Rules{Deny: rules.Deny, Dir: input.Cwd}).Check(input.ToolName, toolInput).DenyReason; reason != "" {
+		return nil, reason
+	}
+	if redirectTools[input.ToolName].write {
+		// The copy could be read freely, so nothing reads can't touch is copied
+		if reason := redirectRefusal(from, input.Cwd); reason != "" {
+			return nil, reason
+		}
+		if err := prepareRedirect(from, to); err != nil {
+			return nil, fmt.Sprintf("NERV could not redirect this write outside the project: %v", err)
+		}
+		logRedirect(c.sessionDir(input.SessionID), input.ToolName, from, to)
+		logAudit(db, taskID, "write_redirected", fmt.Sprintf(`{"tool":%q,"session_id":%q,"from":%q,"to":%q}`, input.ToolName, input.SessionID, from, to))
+	}
+
+	updated := make(map[string]interface{}, len(input.ToolInput))
+	for k, v := range input.ToolInput {
+		updated[k] = v
+	}
+	updated[redirectTools[input.ToolName].key] = to
+	return updated, ""
+}
+
+// redirectRefusal returns why a file mustn't be copied into the redirect directory, or ""
+// Self-protection and sensitive files are checked as a read of the original,
+// since that's what the copy would give the session
+func redirectRefusal(from, cwd string) string {
+	read := map[string]interface{}{"file_path": from}
+	if reason := selfProtection("Read", read, cwd); reason != "" {
+		return reason
+	}
+	if class, action := sensitiveFile(loadConfig().SensitiveFiles, "Read", read, cwd); action != "" {
+		return fmt.Sprintf("NERV won't redirect writes to sensitive files: %s is in the %s class", from, class)
+	}
+	return ""
+}
+
+// projectDirs are the directories a task's writes belong in: its worktrees and its project's registered directories
+func projectDirs(db Store, projectID, taskID string) []string {
+	var dirs []string
+	for _, w := range taskWorktrees(db, taskID) {
+		dirs = append(dirs, w.Path)
+	}
+	if db != nil && projectID != "" {
+		if repos, err := db.ListRepos(projectID); err == nil {
+			for _, r := range repos {
+				dirs = append(dirs, r.Path)
+			}
+		}
+	}
+	return dirs
+}
+
+// prepareRedirect makes the copy's directory, and copies in the real file the
+// first time, so an edit finds what it expects
+func prepareRedirect(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0700); err != nil {
+		return err
+	}
+	if _, err := os.Stat(to); err == nil {
+		return nil
+	}
+	src, err := os.Open(from)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// logRedirect adds a write to the session's redirect log
+func logRedirect(sessionDir, toolName, from, to string) {
+	f, err := os.OpenFile(filepath.Join(sessionDir, redirectLog), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to log the redirected write: %v\n", err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s\t%s\t%s\t%s\n", time.Now().UTC().Format(time.RFC3339), toolName, from, to)
+}
+
+// redirectReport summarizes what a session tried to write outside the project, for when it stops
+func redirectReport(input HookInput) HookOutput {
+	c := loadConfig().RedirectWrites
+	if c == nil || input.SessionID == "" {
+		return HookOutput{}
+	}
+	dir := c.sessionDir(input.SessionID)
+	f, err := os.Open(filepath.Join(dir, redirectLog))
+	if err != nil {
+		return HookOutput{}
+	}
+	defer f.Close()
+
+	var writes []string
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 4 || seen[fields[2]] {
+			continue
+		}
+		seen[fields[2]] = true
+		writes = append(writes, fields[2]+" ("+fields[1]+")")
+	}
+	if len(writes) == 0 {
+		return HookOutput{}
+	}
+	return HookOutput{SystemMessage: fmt.Sprintf("NERV redirected this session's writes outside the project to %s: %s. See %s for each one",
+		dir, strings.Join(writes, ", "), filepath.Join(dir, redirectLog))}
+}
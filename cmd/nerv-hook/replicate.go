@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// Restart backoff for a litestream process that exits while nervd is running
+const (
+	replicationRestartDelay    = 5 * time.Second
+	replicationMaxRestartDelay = time.Minute
+	// replicationStopTimeout bounds how long nervd waits for litestream to flush on shutdown
+	replicationStopTimeout = 10 * time.Second
+)
+
+// litestreamConfigPath is the generated litestream config, rewritten from permissions.json on every start
+func litestreamConfigPath() string {
+	return filepath.Join(nervDir, "litestream.yml")
+}
+
+// runReplicate implements `nerv-hook replicate run|restore`
+// Replication itself is done by litestream; NERV generates its config and supervises it
+func runReplicate(args []string) error {
+	if len(args) < 1 || (args[0] != "run" && args[0] != "restore") {
+		return fmt.Errorf("usage: nerv-hook replicate run|restore [--force]")
+	}
+
+	cfg := loadConfig().Replication
+	if cfg == nil || cfg.URL == "" {
+		return fmt.Errorf("replication is not configured: add a \"replication\" section with a url to %s", configPath)
+	}
+	if os.Getenv("NERV_DB_URL") != "" {
+		return fmt.Errorf("replication only applies to the SQLite state database, not NERV_DB_URL")
+	}
+
+	if args[0] == "run" {
+		cmd, err := litestreamCommand(cfg, "replicate")
+		if err != nil {
+			return err
+		}
+		cmd.Stdout = os.Stdout
+		return cmd.Run()
+	}
+
+	fs := flag.NewFlagSet("replicate restore", flag.ContinueOnError)
+	force := fs.Bool("force", false, "replace an existing state database (it is backed up first)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	return restoreReplica(cfg, *force)
+}
+
+// restoreReplica rebuilds the state database from the latest replica
+func restoreReplica(cfg *ReplicationConfig, force bool) error {
+	if _, err := os.Stat(dbPath); err == nil {
+		if !force {
+			return fmt.Errorf("%s already exists; pass --force to replace it", dbPath)
+		}
+
+		st, err := store.OpenSQLite(dbPath, "rw", dbOptions())
+		if err != nil {
+			return err
+		}
+		previous, _, err := backupState(st, backupDir(), time.Now())
+		st.Close()
+		if err != nil {
+			return fmt.Errorf("failed to save the current state before restoring: %w", err)
+		}
+		fmt.Printf("Saved current state to %s\n", previous)
+
+		for _, path := range []string{dbPath, dbPath + "-wal", dbPath + "-shm"} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+
+	cmd, err := litestreamCommand(cfg, "restore", "-o", dbPath)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = os.Stdout
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("litestream restore failed: %w", err)
+	}
+
+	fmt.Printf("Restored %s from %s\n", dbPath, cfg.URL)
+	return nil
+}
+
+// litestreamCommand writes the litestream config and builds a litestream invocation
+// extra arguments go between the subcommand's flags and the database path
+func litestreamCommand(cfg *ReplicationConfig, subcommand string, extra ...string) (*exec.Cmd, error) {
+	binary := cfg.Litestream
+	if binary == "" {
+		binary = "litestream"
+	}
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, fmt.Errorf("litestream not found (install it or set replication.litestream): %w", err)
+	}
+
+	if err := writeLitestreamConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	args := append([]string{subcommand, "-config", litestreamConfigPath()}, extra...)
+	if subcommand == "restore" {
+		args = append(args, dbPath)
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Stderr = os.Stderr
+	return cmd, nil
+}
+
+// writeLitestreamConfig renders cfg as a litestream.yml for the state database
+// Values are written as double-quoted strings, which YAML reads like JSON strings
+func writeLitestreamConfig(cfg *ReplicationConfig) error {
+	var b strings.Builder
+	b.WriteString("# Generated by nerv-hook from the replication section of permissions.json; edits are overwritten\n")
+	b.WriteString("dbs:\n")
+	fmt.Fprintf(&b, "  - path: %s\n", strconv.Quote(dbPath))
+	b.WriteString("    replicas:\n")
+	fmt.Fprintf(&b, "      - url: %s\n", strconv.Quote(cfg.URL))
+	if cfg.Endpoint != "" {
+		fmt.Fprintf(&b, "        endpoint: %s\n", strconv.Quote(cfg.Endpoint))
+	}
+	if cfg.Region != "" {
+		fmt.Fprintf(&b, "        region: %s\n", strconv.Quote(cfg.Region))
+	}
+	if cfg.SyncInterval != "" {
+		fmt.Fprintf(&b, "        sync-interval: %s\n", strconv.Quote(cfg.SyncInterval))
+	}
+
+	return os.WriteFile(litestreamConfigPath(), []byte(b.String()), 0600)
+}
+
+// superviseReplication keeps `litestream replicate` running until the returned stop function is called
+func superviseReplication(cfg *ReplicationConfig) (stop func()) {
+	var mu sync.Mutex
+	var current *exec.Cmd
+	done := make(chan struct{})
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+		delay := replicationRestartDelay
+		for {
+			cmd, err := litestreamCommand(cfg, "replicate")
+			if err == nil {
+				mu.Lock()
+				select {
+				case <-done:
+					// Stopped while the command was being prepared
+					mu.Unlock()
+					return
+				default:
+				}
+				err = cmd.Start()
+				if err == nil {
+					current = cmd
+				}
+				mu.Unlock()
+			}
+			if err == nil {
+				fmt.Fprintf(os.Stderr, "nervd: replicating %s to %s\n", dbPath, cfg.URL)
+				started := time.Now()
+				err = cmd.Wait()
+				// A long healthy run resets the backoff
+				if time.Since(started) > replicationMaxRestartDelay {
+					delay = replicationRestartDelay
+				}
+			}
+
+			select {
+			case <-done:
+				return
+			default:
+			}
+			fmt.Fprintf(os.Stderr, "nervd: replication stopped (%v), restarting in %s\n", err, delay)
+
+			select {
+			case <-done:
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > replicationMaxRestartDelay {
+				delay = replicationMaxRestartDelay
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		mu.Lock()
+		if current != nil && current.Process != nil {
+			// Interrupt lets litestream flush pending WAL; Windows can only kill
+			if err := current.Process.Signal(os.Interrupt); err != nil {
+				current.Process.Kill()
+			}
+		}
+		mu.Unlock()
+
+		select {
+		case <-exited:
+		case <-time.After(replicationStopTimeout):
+		}
+	}
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// reviewDiffLimit caps the diff kept in a review bundle, the same cap the dashboard's review view uses
+const reviewDiffLimit = 100000
+
+// testOutputTail is how much of a test command's output post-tool-use keeps
+const testOutputTail = 4000
+
+// testCommandPattern matches Bash commands that run a test suite
+var testCommandPattern = regexp.MustCompile(`(^|[\s;&|(])(go test|npm (run )?test|npx (vitest|jest|playwright test)|yarn test|pnpm (run )?test|pytest|python3? -m pytest|cargo test|make (check|test)|mvn test|gradle test|\./gradlew test|rspec|vitest|jest)\b`)
+
+// Test outcomes, guessed from the command's output
+const (
+	testPassed      = "passed"
+	testFailed      = "failed"
+	testInterrupted = "interrupted"
+	testUnknown     = "unknown"
+)
+
+// testFailurePattern and testPassPattern recognise the summaries of common test runners
+var (
+	testFailurePattern = regexp.MustCompile(`(?m)^(FAIL\b|--- FAIL|.*\b\d+ (failed|failing)\b|.*\bTests?:.*\bfailed\b|error\[E\d+\]|test result: FAILED|npm ERR! Test failed)`)
+	testPassPattern    = regexp.MustCompile(`(?m)^(ok\s|PASS\b|.*\b\d+ (passed|passing)\b|test result: ok|.*\bTests?:.*\bpassed\b)`)
+)
+
+// testRun is what post-tool-use records about a test command
+type testRun struct {
+	Outcome string `json:"outcome"`
+	Output  string `json:"output,omitempty"`
+}
+
+// toolTestRun reports the outcome of a Bash call that ran tests, or nil if it didn't run any
+func toolTestRun(input HookInput) *testRun {
+	if input.ToolName != "Bash" {
+		return nil
+	}
+	command, _ := input.ToolInput["command"].(string)
+	if !testCommandPattern.MatchString(command) {
+		return nil
+	}
+
+	stdout, _ := input.ToolResponse["stdout"].(string)
+	stderr, _ := input.ToolResponse["stderr"].(string)
+	output := strings.TrimSpace(strings.TrimSpace(stdout) + "\n" + strings.TrimSpace(stderr))
+	if len(output) > testOutputTail {
+		output = output[len(output)-testOutputTail:]
+	}
+
+	run := &testRun{Outcome: testUnknown, Output: output}
+	switch interrupted, _ := input.ToolResponse["interrupted"].(bool); {
+	case interrupted:
+		run.Outcome = testInterrupted
+	case testFailurePattern.MatchString(output):
+		run.Outcome = testFailed
+	case testPassPattern.MatchString(output):
+		run.Outcome = testPassed
+	}
+	return run
+}
+
+// reviewBundle is what a task's work looked like when it entered review
+// It's stored as JSON in review_bundles, where the dashboard reads it too
+type reviewBundle struct {
+	TaskID      string    `json:"task_id"`
+	Title       string    `json:"title"`
+	GeneratedAt time.Time `json:"generated_at"`
+
+	Branch string `json:"branch,omitempty"`
+	// Base is the ref the diff is taken against; Head is the commit it ends at
+	Base          string       `json:"base,omitempty"`
+	Head          string       `json:"head,omitempty"`
+	Files         []reviewFile `json:"files"`
+	Diff          string       `json:"diff"`
+	DiffTruncated bool         `json:"diff_truncated,omitempty"`
+	// Uncommitted lists changes left in the checkout, in git status --porcelain form
+	Uncommitted []string `json:"uncommitted,omitempty"`
+	// GitError explains a missing diff, e.g. when the task's directory isn't a git repository
+	GitError string `json:"git_error,omitempty"`
+
+	Commands  []reviewCommand  `json:"commands"`
+	Approvals []reviewApproval `json:"approvals"`
+	Tests     []reviewTest     `json:"tests"`
+	// TestsPass is nil when no tests were run
+	TestsPass *bool `json:"tests_pass"`
+	// Verification is the latest run of the project's verification commands, if any
+	Verification *reviewVerification `json:"verification,omitempty"`
+
+	Sessions      int     `json:"sessions"`
+	ActiveSeconds int64   `json:"active_seconds"`
+	WallSeconds   int64   `json:"wall_seconds"`
+	ToolCalls     int64   `json:"tool_calls"`
+	Tokens        int64   `json:"tokens"`
+	CostUSD       float64 `json:"cost_usd"`
+}
+
+type reviewFile struct {
+	Status string `json:"status"`
+	Path   string `json:"path"`
+}
+
+type reviewCommand struct {
+	At      time.Time `json:"at"`
+	Command string    `json:"command"`
+}
+
+type reviewApproval struct {
+	At         time.Time `json:"at"`
+	Tool       string    `json:"tool"`
+	Input      string    `json:"input"`
+	Status     string    `json:"status"`
+	DenyReason string    `json:"deny_reason,omitempty"`
+}
+
+type reviewTest struct {
+	At      time.Time `json:"at"`
+	Command string    `json:"command"`
+	Outcome string    `json:"outcome"`
+	Output  string    `json:"output,omitempty"`
+}
+
+type reviewVerification struct {
+	At     time.Time    `json:"at"`
+	Passed bool         `json:"passed"`
+	Steps  []verifyStep `json:"steps"`
+}
+
+// reviewBases are the refs a task's diff is taken against, in order of preference
+// The dashboard also tries the branch's upstream first, but a pushed task branch
+// would then only show what hasn't been pushed
+var reviewBases = []string{"main", "master", "origin/main", "origin/master"}
+
+// buildReviewBundle collects a task's diff, commands, approvals, tests and usage
+// dir is the checkout the task's work is in
+func buildReviewBundle(db Store, task store.Task, dir string) (reviewBundle, error) {
+	b := reviewBundle{TaskID: task.ID, Title: task.Title, GeneratedAt: time.Now().UTC(), Branch: task.Branch}
+	if err := b.addGit(dir); err != nil {
+		b.GitError = err.Error()
+	}
+
+	events, err := db.ListAudit(store.AuditFilter{TaskID: task.ID, EventType: "tool_completed"})
+	if err != nil {
+		return b, err
+	}
+	// ListAudit is newest first; the bundle reads in the order things happened
+	for i := len(events) - 1; i >= 0; i-- {
+		var details struct {
+			Tool  string                 `json:"tool"`
+			Input map[string]interface{} `json:"input"`
+			Test  *testRun               `json:"test"`
+		}
+		if json.Unmarshal([]byte(events[i].Details), &details) != nil || details.Tool != "Bash" {
+			continue
+		}
+		command, _ := details.Input["command"].(string)
+		b.Commands = append(b.Commands, reviewCommand{At: events[i].Timestamp, Command: command})
+		if details.Test != nil {
+			b.Tests = append(b.Tests, reviewTest{At: events[i].Timestamp, Command: command, Outcome: details.Test.Outcome, Output: details.Test.Output})
+		}
+	}
+	b.TestsPass = testsPass(b.Tests)
+
+	approvals, err := db.ListApprovals(task.ID)
+	if err != nil {
+		return b, err
+	}
+	for _, a := range approvals {
+		if a.Status == "pending" {
+			continue
+		}
+		b.Approvals = append(b.Approvals, reviewApproval{At: a.DecidedAt, Tool: a.ToolName, Input: a.ToolInput, Status: a.Status, DenyReason: a.DenyReason})
+	}
+
+	v, err := db.LatestVerification(task.ID)
+	switch {
+	case err == nil:
+		b.Verification = &reviewVerification{At: v.CreatedAt, Passed: v.Passed}
+		json.Unmarshal([]byte(v.Steps), &b.Verification.Steps)
+	case !errors.Is(err, store.ErrNotFound):
+		return b, err
+	}
+
+	sessions, err := db.ListSessions(task.ID)
+	if err != nil {
+		return b, err
+	}
+	wall, active := sessionTotals(sessions)
+	b.Sessions = len(sessions)
+	b.WallSeconds = int64(wall.Seconds())
+	b.ActiveSeconds = int64(active.Seconds())
+	for _, sess := range sessions {
+		b.ToolCalls += sess.ToolCalls
+		b.Tokens += sess.Tokens
+		b.CostUSD += sess.CostUSD
+	}
+	return b, nil
+}
+
+// addGit fills in the bundle's diff against the first base that exists
+// The diff is of the task's branch if it has one, otherwise of HEAD
+func (b *reviewBundle) addGit(dir string) error {
+	if !inGitRepo(dir) {
+		return fmt.Errorf("%s is not a git repository", dir)
+	}
+	ref := "HEAD"
+	if b.Branch != "" && branchExists(dir, b.Branch) {
+		ref = b.Branch
+	}
+	head, err := git(dir, "rev-parse", "--verify", ref)
+	if err != nil {
+		return err
+	}
+	b.Head = head
+
+	base := ""
+	for _, candidate := range reviewBases {
+		if _, err := git(dir, "rev-parse", "--verify", "--quiet", candidate); err == nil && candidate != b.Branch {
+			base = candidate
+			break
+		}
+	}
+	if base == "" {
+		base = ref + "~1"
+	}
+	b.Base = base
+
+	names, err := git(dir, "diff", "--name-status", base+"..."+ref)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(names, "\n") {
+		if status, path, ok := strings.Cut(line, "\t"); ok {
+			b.Files = append(b.Files, reviewFile{Status: status, Path: path})
+		}
+	}
+
+	diff, err := git(dir, "diff", base+"..."+ref)
+	if err != nil {
+		return err
+	}
+	if len(diff) > reviewDiffLimit {
+		diff = diff[:reviewDiffLimit]
+		b.DiffTruncated = true
+	}
+	b.Diff = diff
+
+	// Only meaningful when dir has the task's branch checked out
+	if current, _ := git(dir, "rev-parse", "HEAD"); current == head {
+		if status, err := git(dir, "status", "--porcelain"); err == nil && status != "" {
+			b.Uncommitted = strings.Split(status, "\n")
+		}
+	}
+	return nil
+}
+
+// testsPass reports whether the last run of each test command passed, or nil if no tests ran
+func testsPass(tests []reviewTest) *bool {
+	if len(tests) == 0 {
+		return nil
+	}
+	last := map[string]string{}
+	for _, t := range tests {
+		last[t.Command] = t.Outcome
+	}
+	pass := true
+	for _, outcome := range last {
+		if outcome != testPassed {
+			pass = false
+		}
+	}
+	return &pass
+}
+
+// saveReviewBundle builds a task's bundle and stores it against the task's pending review,
+// opening one if needed
+func saveReviewBundle(db Store, task store.Task, dir string) (reviewBundle, error) {
+	b, err := buildReviewBundle(db, task, dir)
+	if err != nil {
+		return b, err
+	}
+	review, err := db.RequestReview(task.ID)
+	if err != nil {
+		return b, err
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return b, err
+	}
+	id, err := db.SaveReviewBundle(store.ReviewBundle{TaskID: task.ID, ReviewID: review.ID, Head: b.Head, Bundle: string(data)})
+	if err != nil {
+		return b, err
+	}
+	details, _ := json.Marshal(map[string]interface{}{"bundle_id": id, "review_id": review.ID, "files": len(b.Files), "commands": len(b.Commands), "tests": len(b.Tests)})
+	logAudit(db, task.ID, "review_bundle_created", string(details))
+	return b, nil
+}
+
+// recordReviewBundle is saveReviewBundle for the stop hook, which reports failures instead of returning them
+func recordReviewBundle(db Store, taskID string) {
+	task, err := db.GetTask(taskID)
+	if err != nil {
+		return
+	}
+	dir := task.WorktreePath
+	if dir == "" {
+		if dir, err = os.Getwd(); err != nil {
+			return
+		}
+	}
+	if _, err := saveReviewBundle(db, task, dir); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to build the review bundle: %v\n", err)
+	}
+}
+
+// runTaskReview implements `nerv-hook task review`
+// An in-progress task is moved to review and bundled; a task in review has its
+// bundle shown, or is approved (done) or rejected (back to in_progress)
+func runTaskReview(args []string) error {
+	fs := flag.NewFlagSet("task review", flag.ContinueOnError)
+	approve := fs.Bool("approve", false, "approve the work and mark the task done")
+	reject := fs.Bool("reject", false, "send the task back to in_progress; needs --notes")
+	notes := fs.String("notes", "", "reviewer notes, saved with the decision")
+	showDiff := fs.Bool("diff", false, "print the full diff")
+	asJSON := fs.Bool("json", false, "print the bundle as JSON")
+	refresh := fs.Bool("refresh", false, "rebuild the bundle from the task's current state")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: nerv-hook task review [--approve | --reject --notes TEXT] [--diff] [--json] [--refresh] <task-id>")
+	}
+	if *approve && *reject {
+		return errors.New("--approve and --reject can't be combined")
+	}
+	if *reject && strings.TrimSpace(*notes) == "" {
+		return errors.New("--reject needs --notes saying what to change")
+	}
+
+	st, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	task, err := loadTask(st, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	// Viewing a review that's already built changes nothing, so viewers can
+	if *approve || *reject || *refresh || task.Status != store.TaskReview {
+		if err := actAsOperator(st); err != nil {
+			return err
+		}
+	}
+	if *approve || *reject {
+		return decideTaskReview(st, task, *approve, *notes)
+	}
+
+	if task.Status != store.TaskReview {
+		if err := moveTask(st, task, store.TaskReview); err != nil {
+			return err
+		}
+		task.Status = store.TaskReview
+		*refresh = true
+		fmt.Fprintf(os.Stderr, "Task %s is %s\n", task.ID, store.TaskReview)
+	}
+
+	b, err := taskReviewBundle(st, task, *refresh)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(b)
+	}
+	printReviewBundle(os.Stdout, b, *showDiff)
+	return nil
+}
+
+// taskReviewBundle returns a task's saved bundle, building one if it has none or refresh is set
+func taskReviewBundle(st *store.DB, task store.Task, refresh bool) (reviewBundle, error) {
+	var b reviewBundle
+	saved, err := st.LatestReviewBundle(task.ID)
+	if err == nil && !refresh {
+		if err := json.Unmarshal([]byte(saved.Bundle), &b); err != nil {
+			return b, fmt.Errorf("review bundle %d: %w", saved.ID, err)
+		}
+		return b, nil
+	}
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return b, err
+	}
+	dir := task.WorktreePath
+	if dir == "" {
+		if dir, err = os.Getwd(); err != nil {
+			return b, err
+		}
+	}
+	return saveReviewBundle(st, task, dir)
+}
+
+// decideTaskReview records a decision on a task in review and moves the task to match
+func decideTaskReview(st *store.DB, task store.Task, approve bool, notes string) error {
+	if task.Status != store.TaskReview {
+		return fmt.Errorf("task %s is %s, not %s", task.ID, task.Status, store.TaskReview)
+	}
+	review, err := st.RequestReview(task.ID)
+	if err != nil {
+		return err
+	}
+
+	status, to := store.ReviewRejected, store.TaskInProgress
+	if approve {
+		status, to = store.ReviewApproved, store.TaskDone
+	}
+	if err := st.DecideReview(review.ID, status, notes); err != nil {
+		return err
+	}
+	if err := moveTask(st, task, to); err != nil {
+		return err
+	}
+	if to == store.TaskDone {
+		if err := releaseWorktree(st, task); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Review %s %s; task %s is %s\n", review.ID, status, task.ID, to)
+	return nil
+}
+
+// printReviewBundle prints a bundle for the terminal, with the diff only when asked for
+func printReviewBundle(out io.Writer, b reviewBundle, showDiff bool) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Task:\t%s %s\n", b.TaskID, b.Title)
+	fmt.Fprintf(w, "Bundled:\t%s\n", b.GeneratedAt.Local().Format("2006-01-02 15:04"))
+	if b.GitError != "" {
+		fmt.Fprintf(w, "Diff:\tunavailable (%s)\n", b.GitError)
+	} else {
+		ref := b.Branch
+		if ref == "" {
+			ref = "HEAD"
+		}
+		fmt.Fprintf(w, "Diff:\t%s...%s (%s)\n", b.Base, ref, shortSHA(b.Head))
+	}
+	fmt.Fprintf(w, "Time:\t%s active, %s wall clock over %d sessions\n",
+		formatDuration(time.Duration(b.ActiveSeconds)*time.Second), formatDuration(time.Duration(b.WallSeconds)*time.Second), b.Sessions)
+	fmt.Fprintf(w, "Usage:\t%d tool calls, %d tokens, $%.2f\n", b.ToolCalls, b.Tokens, b.CostUSD)
+	switch {
+	case b.TestsPass == nil:
+		fmt.Fprintf(w, "Tests:\tnone run\n")
+	case *b.TestsPass:
+		fmt.Fprintf(w, "Tests:\tpassing\n")
+	default:
+		fmt.Fprintf(w, "Tests:\tfailing\n")
+	}
+	switch {
+	case b.Verification == nil:
+	case b.Verification.Passed:
+		fmt.Fprintf(w, "Verified:\tpassed %s\n", b.Verification.At.Local().Format("2006-01-02 15:04"))
+	default:
+		fmt.Fprintf(w, "Verified:\tfailed %s\n", b.Verification.At.Local().Format("2006-01-02 15:04"))
+	}
+	w.Flush()
+
+	fmt.Fprintf(out, "\nFiles (%d):\n", len(b.Files))
+	for _, f := range b.Files {
+		fmt.Fprintf(out, "  %s\t%s\n", f.Status, f.Path)
+	}
+	if len(b.Uncommitted) > 0 {
+		fmt.Fprintf(out, "\nUncommitted (%d):\n", len(b.Uncommitted))
+		for _, line := range b.Uncommitted {
+			fmt.Fprintf(out, "  %s\n", line)
+		}
+	}
+	fmt.Fprintf(out, "\nCommands (%d):\n", len(b.Commands))
+	for _, c := range b.Commands {
+		fmt.Fprintf(out, "  %s  %s\n", c.At.Local().Format("15:04:05"), firstLine(c.Command))
+	}
+	fmt.Fprintf(out, "\nApprovals (%d):\n", len(b.Approvals))
+	for _, a := range b.Approvals {
+		line := fmt.Sprintf("  %-8s %s %s", a.Status, a.Tool, firstLine(a.Input))
+		if a.DenyReason != "" {
+			line += " (" + a.DenyReason + ")"
+		}
+		fmt.Fprintln(out, line)
+	}
+	if b.Verification != nil {
+		fmt.Fprintf(out, "\nVerification (%d):\n", len(b.Verification.Steps))
+		printVerifySteps(out, b.Verification.Steps)
+	}
+	fmt.Fprintf(out, "\nTests (%d):\n", len(b.Tests))
+	for _, t := range b.Tests {
+		fmt.Fprintf(out, "  %-11s %s\n", t.Outcome, firstLine(t.Command))
+	}
+
+	if showDiff {
+		fmt.Fprintf(out, "\n%s\n", b.Diff)
+		if b.DiffTruncated {
+			fmt.Fprintf(out, "\n(diff truncated at %d bytes)\n", reviewDiffLimit)
+		}
+	}
+}
+
+// firstLine shortens multi-line commands to their first line
+func firstLine(s string) string {
+	if line, _, ok := strings.Cut(s, "\n"); ok {
+		return line + " ..."
+	}
+	return s
+}
+
+// shortSHA abbreviates a commit for display
+func shortSHA(sha string) string {
+	if len(sha) > 12 {
+		return sha[:12]
+	}
+	return sha
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// RewriteRule changes the arguments of the Bash commands it matches rather
+// than denying them, e.g. dropping --no-verify from git commit
+// Words are compared as the shell reads them; the rest of the command line,
+// quoting included, is left as written
+type RewriteRule struct {
+	// Match is the Bash rule for the commands rewritten, e.g. "Bash(git commit*)"
+	Match string `json:"match"`
+	// Strip removes these arguments, written alone or as --flag=value, e.g. ["--no-verify"]
+	Strip []string `json:"strip,omitempty"`
+	// Set forces options that take a value, replacing any value given, e.g. {"--depth": "1"}
+	Set map[string]string `json:"set,omitempty"`
+	// Append adds these arguments when they're missing, e.g. ["--dry-run"]
+	Append []string `json:"append,omitempty"`
+	// Once rewrites only the first command of a session the rule matches
+	Once bool `json:"once,omitempty"`
+}
+
+// validateRewrites reports rewrite rules that can't be applied
+func validateRewrites(rules []RewriteRule) error {
+	for i, r := range rules {
+		if !strings.HasPrefix(r.Match, "Bash(") || !strings.HasSuffix(r.Match, ")") {
+			return fmt.Errorf("rewrite %d: match must be a Bash rule such as Bash(git commit*)", i+1)
+		}
+		if len(r.Strip) == 0 && len(r.Set) == 0 && len(r.Append) == 0 {
+			return fmt.Errorf("rewrite %d: nothing to strip, set, or append", i+1)
+		}
+	}
+	return nil
+}
+
+// shellToken is a word or an operator of a command line, with its place in it
+type shellToken struct {
+	start, end int
+	// raw is the token as written
+	raw string
+	// value is the word as the shell reads it, with quoting removed
+	value string
+	// operator marks the ; & | newlines, parentheses, and backquotes between commands
+	operator bool
+}
+
+// shellTokens splits a command line the way policy.CommandArgs does, keeping where each token is
+func shellTokens(line string) []shellToken {
+	var tokens []shellToken
+	var word strings.Builder
+	start := -1
+
+	endWord := func(end int) {
+		if start >= 0 {
+			tokens = append(tokens, shellToken{start: start, end: end, raw: line[start:end], value: word.String()})
+			word.Reset()
+			start = -1
+		}
+	}
+	begin := func(i int) {
+		if start < 0 {
+			start = i
+		}
+	}
+
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; c {
+		case '\\':
+			begin(i)
+			if i+1 < len(line) {
+				i++
+				if line[i] != '\n' {
+					word.WriteByte(line[i])
+				}
+			}
+		case '\'':
+			begin(i)
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				word.WriteString(line[i+1:])
+				i = len(line) - 1
+				continue
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+		case '"':
+			begin(i)
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) && strings.IndexByte("$`\"\\\n", line[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(line[i])
+			}
+		case ' ', '\t':
+			endWord(i)
+		case ';', '&', '|', '\n', '(', ')', '`':
+			endWord(i)
+			tokens = append(tokens, shellToken{start: i, end: i + 1, raw: line[i : i+1], operator: true})
+		default:
+			begin(i)
+			word.WriteByte(c)
+		}
+	}
+	endWord(len(line))
+	return tokens
+}
+
+// shellEdit replaces line[start:end] with text
+type shellEdit struct {
+	start, end int
+	text       string
+}
+
+// rewriteCommand applies a rule to each command of a line it matches, returning
+// the line as rewritten and whether anything changed
+func rewriteCommand(r RewriteRule, line string) (string, bool) {
+	tokens := shellTokens(line)
+	var edits []shellEdit
+	for len(tokens) > 0 {
+		n := slices.IndexFunc(tokens, func(t shellToken) bool { return t.operator })
+		if n < 0 {
+			n = len(tokens)
+		}
+		if words := tokens[:n]; len(words) > 0 && policy.Match(r.Match, "Bash("+line[words[0].start:words[len(words)-1].end]+")") {
+			edits = append(edits, r.rewriteWords(words)...)
+		}
+		tokens = tokens[min(n+1, len(tokens)):]
+	}
+	// Edits are made from the end, so the earlier ones' places stay put
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	rewritten := line
+	for _, e := range edits {
+		rewritten = rewritten[:e.start] + e.text + rewritten[e.end:]
+	}
+	return rewritten, rewritten != line
+}
+
+// redirection matches a word that redirects, such as > or 2>>, capturing the target written with it
+var redirection = regexp.MustCompile(`^[0-9]*(?:>>?|<<?|>\|)(.*)$`)
+
+// rewriteWords returns the edits that apply the rule to one command's words
+func (r RewriteRule) rewriteWords(words []shellToken) []shellEdit {
+	var edits []shellEdit
+	// A word is removed with the space before it
+	remove := func(i int) {
+		edits = append(edits, shellEdit{start: words[i-1].end, end: words[i].end})
+	}
+
+	// Options come before a -- that ends them; what follows it is left alone
+	end := len(words)
+	if i := slices.IndexFunc(words[1:], func(t shellToken) bool { return t.value == "--" }); i >= 0 {
+		end = i + 1
+	}
+	last := 0
+	present := map[string]bool{}
+	satisfied := map[string]bool{}
+	for i := 1; i < end; i++ {
+		if m := redirection.FindStringSubmatch(words[i].raw); m != nil {
+			if m[1] == "" {
+				i++
+			}
+			continue
+		}
+		last = i
+		w := words[i].value
+		name, value, inline := strings.Cut(w, "=")
+		if want, set := r.Set[name]; set {
+			// j is the word holding the value: the next one, unless it's written as --flag=value
+			j := i
+			if !inline && i+1 < end {
+				j = i + 1
+				value = words[j].value
+			}
+			if value == want && !satisfied[name] {
+				satisfied[name] = true
+				last = j
+			} else {
+				for k := i; k <= j; k++ {
+					remove(k)
+				}
+			}
+			i = j
+			continue
+		}
+		if slices.Contains(r.Strip, name) {
+			remove(i)
+			continue
+		}
+		present[w] = true
+	}
+
+	var added []string
+	for _, name := range sortedKeys(r.Set) {
+		if !satisfied[name] {
+			added = append(added, shellQuote(name), shellQuote(r.Set[name]))
+		}
+	}
+	for _, arg := range r.Append {
+		if !present[arg] {
+			added = append(added, shellQuote(arg))
+		}
+	}
+	if len(added) > 0 {
+		at := words[last].end
+		edits = append(edits, shellEdit{start: at, end: at, text: " " + strings.Join(added, " ")})
+	}
+	return edits
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// rewriteInput applies the configured rewrite rules to a Bash call, returning
+// the input to run it with, or nil if no rule changed it
+// Each rule that changes it logs an input_rewritten event, which is also how a
+// Once rule knows it has been used in the session
+func rewriteInput(db Store, taskID string, rules []RewriteRule, input HookInput) map[string]interface{} {
+	command, _ := input.ToolInput["command"].(string)
+	if input.ToolName != "Bash" || command == "" || len(rules) == 0 {
+		return nil
+	}
+
+	rewritten := command
+	for _, r := range rules {
+		// Invalid rules are skipped; doctor reports them
+		if validateRewrites([]RewriteRule{r}) != nil || (r.Once && rewriteUsed(db, input.SessionID, r.Match)) {
+			continue
+		}
+		line, changed := rewriteCommand(r, rewritten)
+		if !changed {
+			continue
+		}
+		logAudit(db, taskID, "input_rewritten", fmt.Sprintf(`{"tool":"Bash","session_id":%q,"rule":%q,"from":%q,"to":%q}`, input.SessionID, r.Match, rewritten, line))
+		rewritten = line
+	}
+	if rewritten == command {
+		return nil
+	}
+
+	updated := make(map[string]interface{}, len(input.ToolInput))
+	for k, v := range input.ToolInput {
+		updated[k] = v
+	}
+	updated["command"] = rewritten
+	return updated
+}
+
+// rewriteUsed reports whether a rule already rewrote a command in the session
+func rewriteUsed(db Store, sessionID, rule string) bool {
+	if db == nil || sessionID == "" {
+		return false
+	}
+	used, err := db.SessionRewrote(sessionID, rule)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to check the rewrite rule %s: %v\n", rule, err)
+	}
+	return used
+}
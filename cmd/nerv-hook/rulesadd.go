@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/nerv/nerv-hook/internal/store"
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// `nerv-hook rules add` adds an allow or deny rule to the permissions file, or
+// to a registered repository's .nerv/permissions.json. With --interactive it
+// builds the rule a step at a time and tests each pattern against the calls
+// sessions made recently, so a pattern that matches nothing, or far more than
+// it was meant to, shows up before it's saved
+
+const rulesAddUsage = "usage: nerv-hook rules add [--deny] [--project DIR] [--interactive] [RULE]"
+
+// recentCallLimit is how many completed tool calls the wizard tests patterns against
+const recentCallLimit = 500
+
+// newRule is a rule and where it's saved
+type newRule struct {
+	rule string
+	deny bool
+	// repo is the root of the repository whose .nerv/permissions.json gets the rule, or "" for the permissions file
+	repo string
+}
+
+func (r newRule) list() string {
+	if r.deny {
+		return "deny"
+	}
+	return "allow"
+}
+
+func (r newRule) path() string {
+	if r.repo == "" {
+		return configPath
+	}
+	return filepath.Join(r.repo, projectConfigFile)
+}
+
+// recentCall is a tool call from the audit log
+type recentCall struct {
+	tool      string
+	signature string
+}
+
+// runRulesAdd implements `nerv-hook rules add`
+func runRulesAdd(args []string) error {
+	fs := flag.NewFlagSet("rules add", flag.ContinueOnError)
+	deny := fs.Bool("deny", false, "add a deny rule instead of an allow rule")
+	project := fs.String("project", "", "add the rule to the .nerv/permissions.json of the registered repository at `DIR`")
+	interactive := fs.Bool("interactive", false, "build the rule step by step, testing it against recent tool calls")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *interactive == (fs.NArg() == 1) || fs.NArg() > 1 {
+		return errors.New(rulesAddUsage)
+	}
+
+	r := newRule{deny: *deny}
+	if *project != "" {
+		repo, err := registeredRepo(*project)
+		if err != nil {
+			return err
+		}
+		r.repo = repo
+	}
+
+	if !*interactive {
+		r.rule = strings.TrimSpace(fs.Arg(0))
+		if problems := policy.Lint(r.rule); len(problems) > 0 {
+			return fmt.Errorf("%s: %s\nrun nerv-hook rules add --interactive to build it step by step", r.rule, strings.Join(problems, "; "))
+		}
+		return addRule(r)
+	}
+
+	// The repository the command runs in is offered as a place for the rule
+	var here string
+	if *project == "" {
+		if cwd, err := os.Getwd(); err == nil {
+			here, _ = registeredRepo(cwd)
+		}
+	}
+	p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	r, ok := rulesWizard(p, recentCalls(), r, here)
+	if !ok {
+		fmt.Println("No rule added")
+		return nil
+	}
+	return addRule(r)
+}
+
+// registeredRepo returns the root of the registered repository holding dir
+// Rules in any other directory's .nerv/permissions.json are never read
+func registeredRepo(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return "", err
+	}
+	defer st.Close()
+	repos, err := st.ListRepos("")
+	if err != nil {
+		return "", err
+	}
+	var best string
+	for _, r := range repos {
+		if withinDir(abs, r.Path) && len(r.Path) > len(best) {
+			best = r.Path
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("%s isn't in a registered repository, so rules there wouldn't apply; register it with nerv-hook project init", abs)
+	}
+	return best, nil
+}
+
+// recentCalls returns the latest completed tool calls, newest first
+// Without a database there's nothing to test against, and the wizard says so
+func recentCalls() []recentCall {
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return nil
+	}
+	defer st.Close()
+	events, err := st.ListAudit(store.AuditFilter{EventType: "tool_completed", Limit: recentCallLimit})
+	if err != nil {
+		return nil
+	}
+	var calls []recentCall
+	for _, e := range events {
+		var d struct {
+			Tool  string          `json:"tool"`
+			Input json.RawMessage `json:"input"`
+		}
+		if json.Unmarshal([]byte(e.Details), &d) != nil || d.Tool == "" {
+			continue
+		}
+		calls = append(calls, recentCall{tool: d.Tool, signature: policy.Signature(d.Tool, string(d.Input))})
+	}
+	return calls
+}
+
+// rulesWizard asks for a rule's tool, pattern, list and file, showing which
+// recent calls each pattern matches, and reports false if no rule was chosen
+// here is the registered repository the command runs in, offered as the rule's file
+func rulesWizard(p *prompter, calls []recentCall, r newRule, here string) (newRule, bool) {
+	counts := map[string]int{}
+	for _, c := range calls {
+		counts[c.tool]++
+	}
+	tools := make([]string, 0, len(counts))
+	for tool := range counts {
+		tools = append(tools, tool)
+	}
+	sort.Slice(tools, func(i, j int) bool {
+		if counts[tools[i]] != counts[tools[j]] {
+			return counts[tools[i]] > counts[tools[j]]
+		}
+		return tools[i] < tools[j]
+	})
+
+	if len(tools) == 0 {
+		fmt.Fprintln(p.out, "No recent tool calls to test rules against; matches can't be shown")
+	} else {
+		fmt.Fprintf(p.out, "Tools used in the last %d calls:\n", len(calls))
+		for _, tool := range tools {
+			fmt.Fprintf(p.out, "  %-14s %d\n", tool, counts[tool])
+		}
+	}
+	def := "Bash"
+	if len(tools) > 0 {
+		def = tools[0]
+	}
+	for {
+		tool := p.ask("Tool", def)
+		def = tool
+		rule := tool
+		if arg, ok := ruleArgument(tool); ok {
+			var examples []string
+			for _, c := range calls {
+				if c.tool == tool && len(examples) < 5 && !slices.Contains(examples, c.signature) {
+					examples = append(examples, c.signature)
+				}
+			}
+			if len(examples) > 0 {
+				fmt.Fprintf(p.out, "Recent %s calls:\n", tool)
+				for _, e := range examples {
+					fmt.Fprintf(p.out, "  %s\n", e)
+				}
+			}
+			pattern := p.ask(fmt.Sprintf("Pattern for the %s, where * matches anything (empty for every %s call)", arg, tool), "")
+			if pattern != "" {
+				rule = tool + "(" + pattern + ")"
+			}
+		}
+
+		problems := policy.Lint(rule)
+		for _, problem := range problems {
+			fmt.Fprintf(p.out, "Problem: %s\n", problem)
+		}
+		showMatches(p.out, rule, tool, calls)
+		if len(problems) == 0 && p.confirm("Use "+rule+"?", true) || len(problems) > 0 && p.confirm("Use "+rule+" anyway?", false) {
+			r.rule = rule
+			break
+		}
+		// Input that has run out only ever gives the same answer again
+		if p.yes {
+			return r, false
+		}
+	}
+
+	def = r.list()
+	for {
+		answer := strings.ToLower(p.ask("Allow or deny calls it matches", def))
+		if answer == "allow" || answer == "deny" {
+			r.deny = answer == "deny"
+			break
+		}
+		fmt.Fprintln(p.out, "Answer allow or deny")
+	}
+
+	if r.repo == "" && here != "" {
+		fmt.Fprintf(p.out, "Where should it go?\n  1) %s, for every project\n  2) %s, for this repository only\n", configPath, filepath.Join(here, projectConfigFile))
+		if p.ask("File", "1") == "2" {
+			r.repo = here
+		}
+	}
+	return r, p.confirm(fmt.Sprintf("Add %s to the %s list in %s?", r.rule, r.list(), r.path()), true)
+}
+
+// ruleArgument names what a tool's rule patterns match, and whether they match anything
+func ruleArgument(tool string) (string, bool) {
+	switch tool {
+	case "Bash":
+		return "command", true
+	case "Read", "Write", "Edit":
+		return "file path", true
+	}
+	return "", false
+}
+
+// showMatches prints how many of the recent calls to tool a rule matches, with a few of them
+func showMatches(out io.Writer, rule, tool string, calls []recentCall) {
+	var total int
+	var matched []string
+	for _, c := range calls {
+		if c.tool != tool {
+			continue
+		}
+		total++
+		if policy.Match(rule, c.signature) {
+			matched = append(matched, c.signature)
+		}
+	}
+	if total == 0 {
+		return
+	}
+	fmt.Fprintf(out, "Matches %d of the last %d %s calls\n", len(matched), total, tool)
+	for i, m := range matched {
+		if i == 5 {
+			fmt.Fprintf(out, "  and %d more\n", len(matched)-i)
+			break
+		}
+		fmt.Fprintf(out, "  %s\n", m)
+	}
+}
+
+// addRule appends a rule to its file's allow or deny list and logs it
+func addRule(r newRule) error {
+	if r.repo != "" {
+		st, err := openAdminStore("edit policy")
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+		if err := addProjectRule(r); err != nil {
+			return err
+		}
+		details, _ := json.Marshal(map[string]interface{}{"path": r.path(), "rule": r.rule, "list": r.list()})
+		if err := st.LogAudit("", "rule_added", string(details)); err != nil {
+			return err
+		}
+		fmt.Printf("Added %s to the %s list in %s\n", r.rule, r.list(), r.path())
+		return nil
+	}
+
+	if org, err := loadOrgPolicy(); err == nil && org != nil && slices.Contains(org.protected, r.list()) {
+		return fmt.Errorf("%s is set by your organisation's policy and can't be changed here", r.list())
+	}
+	doc, err := readConfigFile()
+	if err != nil {
+		return err
+	}
+	list, err := appendRule(doc, r)
+	if err != nil {
+		return err
+	}
+	doc[r.list()] = list
+	if err := saveConfigFile(doc, "rule_added", map[string]interface{}{"rule": r.rule, "list": r.list()}); err != nil {
+		return err
+	}
+	fmt.Printf("Added %s to the %s list in %s\n", r.rule, r.list(), r.path())
+	return nil
+}
+
+// appendRule returns a file's allow or deny list with the rule added
+func appendRule(doc map[string]interface{}, r newRule) ([]interface{}, error) {
+	var list []interface{}
+	switch v := doc[r.list()].(type) {
+	case nil:
+	case []interface{}:
+		list = v
+	default:
+		return nil, fmt.Errorf("%s in %s is not a list; fix it by hand first", r.list(), r.path())
+	}
+	if slices.Contains(list, interface{}(r.rule)) {
+		return nil, fmt.Errorf("%s is already in the %s list in %s", r.rule, r.list(), r.path())
+	}
+	return append(list, r.rule), nil
+}
+
+// addProjectRule adds a rule to a repository's .nerv/permissions.json,
+// keeping the rest of the file as it was
+func addProjectRule(r newRule) error {
+	doc := map[string]interface{}{}
+	data, err := os.ReadFile(r.path())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &doc); err != nil || doc == nil {
+			return fmt.Errorf("%s does not parse as an object (%v); fix it by hand first", r.path(), err)
+		}
+	}
+	list, err := appendRule(doc, r)
+	if err != nil {
+		return err
+	}
+	doc[r.list()] = list
+
+	data, err = json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path()), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(r.path(), append(data, '\n'), 0644)
+}
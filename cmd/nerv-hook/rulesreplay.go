@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// `nerv-hook rules replay` checks the tool calls in the audit log again, under
+// the permissions file as it is now or under a candidate file, and reports the
+// calls that would be decided differently. Calls that ran were allowed, calls
+// that queued an approval asked, and calls a rule blocked were denied. Without
+// --config the current rules are compared with what was recorded; with it, the
+// candidate is compared with the current rules, so only the change under review
+// shows up
+
+const rulesReplayUsage = "usage: nerv-hook rules replay [--since AGE] [--config FILE] [--json]"
+
+// Decisions a replayed call can have
+const (
+	replayAllow = "allow"
+	replayAsk   = "ask"
+	replayDeny  = "deny"
+)
+
+// replayCall is one recorded tool call and how it was decided
+type replayCall struct {
+	taskID   string
+	tool     string
+	input    string
+	decision string
+}
+
+// replayChange is the calls with one signature whose decision changes one way
+type replayChange struct {
+	Signature string `json:"signature"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Calls     int    `json:"calls"`
+	// Why is the rule that now allows or denies the calls, if one does
+	Why string `json:"why,omitempty"`
+}
+
+// replayReport is what nerv-hook rules replay prints
+type replayReport struct {
+	Since     time.Time `json:"since"`
+	Config    string    `json:"config"`
+	Candidate string    `json:"candidate,omitempty"`
+	Replayed  int       `json:"replayed"`
+	Unchanged int       `json:"unchanged"`
+	// Skipped counts denials recorded before their input was, which can't be checked again
+	Skipped int            `json:"skipped"`
+	Changes []replayChange `json:"changes"`
+}
+
+// runRulesReplay implements `nerv-hook rules replay`
+func runRulesReplay(args []string) error {
+	fs := flag.NewFlagSet("rules replay", flag.ContinueOnError)
+	since := fs.String("since", "30d", "replay calls made within `AGE`, e.g. 30d or 12h")
+	candidate := fs.String("config", "", "compare the candidate permissions `FILE` with the current rules")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New(rulesReplayUsage)
+	}
+	age, err := parseAge(*since)
+	if err != nil {
+		return err
+	}
+
+	current := loadPermissions()
+	var proposed *policy.Rules
+	if *candidate != "" {
+		rules, err := candidateRules(*candidate)
+		if err != nil {
+			return err
+		}
+		proposed = &rules
+	}
+
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	r := replayReport{Since: time.Now().Add(-age).UTC(), Config: configPath, Candidate: *candidate, Changes: []replayChange{}}
+	calls, skipped, err := recordedCalls(st, r.Since)
+	if err != nil {
+		return err
+	}
+	r.Skipped = skipped
+	replay(&r, calls, current, proposed, projectRules(st))
+
+	if *asJSON {
+		return printJSON(r)
+	}
+	return printReplay(os.Stdout, r)
+}
+
+// candidateRules reads a candidate permissions file, which has to be valid,
+// unlike the current one, and merges in the org policy as hooks would
+func candidateRules(path string) (policy.Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return policy.Rules{}, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return policy.Rules{}, fmt.Errorf("%s doesn't parse: %v", path, err)
+	}
+	if section, err := cfg.validate(); err != nil {
+		return policy.Rules{}, fmt.Errorf("%s: %s: %v", path, section, err)
+	}
+	return withOrgPolicy(cfg).Rules, nil
+}
+
+// recordedCalls reads the tool calls logged since a time, oldest first, with
+// how each was decided, and counts the denials that can't be replayed
+// A call that queued an approval is logged again when it runs; it counts once, as asked
+func recordedCalls(st *store.DB, since time.Time) ([]replayCall, int, error) {
+	events, err := st.ListAudit(store.AuditFilter{})
+	if err != nil {
+		return nil, 0, err
+	}
+	var calls []replayCall
+	var skipped int
+	// approved counts the approvals per session, tool and input not yet matched to the call that ran
+	approved := map[string]int{}
+	for i := len(events) - 1; i >= 0; i-- {
+		e := events[i]
+		if e.Timestamp.Before(since) {
+			continue
+		}
+		var d struct {
+			Tool       string          `json:"tool"`
+			Input      json.RawMessage `json:"input"`
+			Reason     string          `json:"reason"`
+			SessionID  string          `json:"session_id"`
+			ApprovalID int64           `json:"approval_id"`
+		}
+		if json.Unmarshal([]byte(e.Details), &d) != nil {
+			continue
+		}
+		switch e.EventType {
+		case "approval_requested":
+			a, err := st.GetApproval(d.ApprovalID)
+			if err != nil {
+				continue
+			}
+			calls = append(calls, replayCall{taskID: e.TaskID, tool: a.ToolName, input: a.ToolInput, decision: replayAsk})
+			approved[a.SessionID+"\x00"+a.ToolName+"\x00"+a.ToolInput]++
+		case "tool_denied":
+			// Only rules are replayed; budgets, rate limits and the like deny for other reasons
+			if !strings.HasPrefix(d.Reason, "Blocked by rule") && !strings.HasPrefix(d.Reason, "Blocked destructive command") {
+				continue
+			}
+			if len(d.Input) == 0 {
+				skipped++
+				continue
+			}
+			calls = append(calls, replayCall{taskID: e.TaskID, tool: d.Tool, input: string(d.Input), decision: replayDeny})
+		case "tool_completed":
+			if d.Tool == "" {
+				continue
+			}
+			key := d.SessionID + "\x00" + d.Tool + "\x00" + string(d.Input)
+			if approved[key] > 0 {
+				approved[key]--
+				continue
+			}
+			calls = append(calls, replayCall{taskID: e.TaskID, tool: d.Tool, input: string(d.Input), decision: replayAllow})
+		}
+	}
+	return calls, skipped, nil
+}
+
+// projectRules returns a function giving the rules a task's project repos add,
+// read once per task; every repo's rules apply, since where a call was made isn't logged
+func projectRules(st *store.DB) func(taskID string) (allow, deny []string) {
+	type added struct{ allow, deny []string }
+	cache := map[string]added{}
+	return func(taskID string) ([]string, []string) {
+		if a, ok := cache[taskID]; ok {
+			return a.allow, a.deny
+		}
+		var a added
+		if task, err := st.GetTask(taskID); err == nil && task.ProjectID != "" {
+			repos, _ := st.ListRepos(task.ProjectID)
+			for _, repo := range repos {
+				cfg, err := readProjectConfig(repo.Path)
+				if err != nil {
+					continue
+				}
+				allow, deny := repoRules(cfg.Rules, []string{repo.Path}, "")
+				a.allow = append(a.allow, allow...)
+				a.deny = append(a.deny, deny...)
+			}
+		}
+		cache[taskID] = a
+		return a.allow, a.deny
+	}
+}
+
+// replay decides each call under the current rules, and the candidate's if
+// there is one, and groups the calls whose decision changes
+func replay(r *replayReport, calls []replayCall, current policy.Rules, candidate *policy.Rules, project func(taskID string) (allow, deny []string)) {
+	type key struct{ signature, from, to string }
+	changes := map[key]*replayChange{}
+	for _, c := range calls {
+		allow, deny := project(c.taskID)
+		from := c.decision
+		to, why := replayDecision(withRules(current, allow, deny), c.tool, c.input)
+		if candidate != nil {
+			from = to
+			to, why = replayDecision(withRules(*candidate, allow, deny), c.tool, c.input)
+		}
+		r.Replayed++
+		if from == to {
+			r.Unchanged++
+			continue
+		}
+		k := key{policy.Signature(c.tool, c.input), from, to}
+		if changes[k] == nil {
+			changes[k] = &replayChange{Signature: k.signature, From: from, To: to, Why: why}
+		}
+		changes[k].Calls++
+	}
+	for _, c := range changes {
+		r.Changes = append(r.Changes, *c)
+	}
+	sort.Slice(r.Changes, func(i, j int) bool {
+		a, b := r.Changes[i], r.Changes[j]
+		if a.Calls != b.Calls {
+			return a.Calls > b.Calls
+		}
+		return a.Signature < b.Signature
+	})
+}
+
+// withRules returns rules with a project's allow and deny rules added
+func withRules(rules policy.Rules, allow, deny []string) policy.Rules {
+	rules.Allow = append(rules.Allow[:len(rules.Allow):len(rules.Allow)], allow...)
+	rules.Deny = append(rules.Deny[:len(rules.Deny):len(rules.Deny)], deny...)
+	return rules
+}
+
+// replayDecision checks a call under rules, returning its decision and the rule behind it
+func replayDecision(rules policy.Rules, tool, input string) (string, string) {
+	result := withHome(rules).Check(tool, input)
+	switch {
+	case result.DenyReason != "":
+		return replayDeny, result.DenyReason
+	case result.NeedsApproval:
+		return replayAsk, ""
+	case result.AllowRule != "":
+		return replayAllow, "allowed by " + result.AllowRule
+	default:
+		return replayAllow, ""
+	}
+}
+
+// printReplay writes the report for a person
+func printReplay(out io.Writer, r replayReport) error {
+	against := "the current rules in " + r.Config
+	if r.Candidate != "" {
+		against = "the candidate " + r.Candidate + ", compared with the current rules"
+	}
+	fmt.Fprintf(out, "Replayed %d calls since %s under %s\n", r.Replayed, r.Since.Local().Format("2006-01-02 15:04"), against)
+	if r.Skipped > 0 {
+		fmt.Fprintf(out, "Skipped %d denials logged without their input\n", r.Skipped)
+	}
+	if len(r.Changes) == 0 {
+		fmt.Fprintln(out, "No decisions change")
+		return nil
+	}
+	fmt.Fprintf(out, "%d unchanged, %d change:\n", r.Unchanged, r.Replayed-r.Unchanged)
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CALLS\tCHANGE\tSIGNATURE\tWHY")
+	for _, c := range r.Changes {
+		fmt.Fprintf(w, "%d\t%s -> %s\t%s\t%s\n", c.Calls, c.From, c.To, c.Signature, c.Why)
+	}
+	return w.Flush()
+}
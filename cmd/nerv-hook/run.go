@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// defaultMaxConcurrent caps running agent sessions unless tasks.max_concurrent overrides it
+const defaultMaxConcurrent = 3
+
+// defaultAgentCommand is the agent run and nervd's queue launch
+const defaultAgentCommand = "claude"
+
+// runSlotPoll is how often run checks for a free slot when it's at the cap
+const runSlotPoll = 2 * time.Second
+
+// runStartGrace is how long a run may go without a PID before it counts as abandoned
+// Covers a nerv-hook run that died between recording the run and starting the agent
+const runStartGrace = time.Minute
+
+// runOptions controls how runTasks launches agents
+type runOptions struct {
+	claude        string
+	prompt        string
+	headless      bool
+	maxConcurrent int
+}
+
+// runRun implements `nerv-hook run`
+func runRun(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	headless := fs.Bool("headless", false, "run the agent non-interactively (claude -p), logging to ~/.nerv/logs")
+	prompt := fs.String("prompt", "", "prompt to start the session with (default built from the task's title and description)")
+	maxConcurrent := fs.Int("max-concurrent", loadConfig().Tasks.maxConcurrent(), "most agent sessions to have running at once, counting ones started by other nerv-hook run processes")
+	worktree := fs.Bool("worktree", false, "give each task that doesn't have one its own git worktree")
+	claude := fs.String("claude", defaultAgentCommand, "agent command to launch")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("usage: nerv-hook run [--headless] [--worktree] [--prompt TEXT] [--max-concurrent N] <task-id>...")
+	}
+	if *maxConcurrent < 1 {
+		return errors.New("--max-concurrent must be at least 1")
+	}
+	if fs.NArg() > 1 && (!*headless || !*worktree) {
+		return errors.New("running several tasks at once needs --headless and --worktree, so the sessions don't share a terminal or a checkout")
+	}
+
+	st, err := openOperatorStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	var tasks []store.Task
+	for _, id := range fs.Args() {
+		task, err := loadTask(st, id)
+		if err != nil {
+			return err
+		}
+		if task.Status != store.TaskInProgress && !store.CanTransition(task.Status, store.TaskInProgress) {
+			return fmt.Errorf("task %s: %w", task.ID, &store.TransitionError{From: task.Status, To: store.TaskInProgress})
+		}
+		tasks = append(tasks, task)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	// An in-progress task is resumed as it is; the rest start the way task start would
+	for i, task := range tasks {
+		if task.Status == store.TaskInProgress {
+			continue
+		}
+		if tasks[i], err = startTask(st, task, cwd, *worktree && task.WorktreePath == "", false); err != nil {
+			return err
+		}
+	}
+
+	return runTasks(st, tasks, runOptions{claude: *claude, prompt: *prompt, headless: *headless, maxConcurrent: *maxConcurrent})
+}
+
+// runTasks launches an agent per task, never more than opts.maxConcurrent at once, and waits for them all
+func runTasks(st *store.DB, tasks []store.Task, opts runOptions) error {
+	if !opts.headless {
+		// The agent owns the terminal; Ctrl-C is for it, not for us
+		signal.Ignore(os.Interrupt)
+		defer signal.Reset(os.Interrupt)
+	}
+
+	// Launches are serialized so each one sees the PIDs of the ones before it
+	var launch sync.Mutex
+	var wg sync.WaitGroup
+	errs := make([]error, len(tasks))
+	for i, task := range tasks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = runTaskSession(st, task, opts, &launch)
+			if errs[i] != nil {
+				fmt.Fprintf(os.Stderr, "Task %s: %v\n", task.ID, errs[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed == 1 && len(tasks) == 1 {
+		return errs[0]
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d sessions failed", failed, len(tasks))
+	}
+	return nil
+}
+
+// runTaskSession waits for a free slot, launches the agent for one task, and records how it went
+func runTaskSession(st *store.DB, task store.Task, opts runOptions, launch *sync.Mutex) error {
+	mode := "interactive"
+	if opts.headless {
+		mode = "headless"
+	}
+
+	launch.Lock()
+	err := waitForRunSlot(st, opts.maxConcurrent)
+	var cmd *exec.Cmd
+	var runID int64
+	if err == nil {
+		cmd, runID, err = launchRun(st, task, mode, opts)
+	}
+	launch.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := waitRun(st, task, cmd, runID); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Task %s: agent finished\n", task.ID)
+	return nil
+}
+
+// waitRun waits for a launched agent to exit and records how it went
+// A non-zero exit is returned as an error
+func waitRun(st *store.DB, task store.Task, cmd *exec.Cmd, runID int64) error {
+	exitCode := 0
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			st.FinishRun(runID, -1)
+			return err
+		}
+		exitCode = exitErr.ExitCode()
+	}
+	if err := st.FinishRun(runID, exitCode); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record the end of run %d: %v\n", runID, err)
+	}
+	details, _ := json.Marshal(map[string]interface{}{"run_id": runID, "exit_code": exitCode})
+	logAudit(st, task.ID, "run_finished", string(details))
+
+	if exitCode != 0 {
+		return fmt.Errorf("agent exited with code %d", exitCode)
+	}
+	return nil
+}
+
+// launchRun records a run and starts its agent; the caller has already checked for a free slot
+func launchRun(st *store.DB, task store.Task, mode string, opts runOptions) (*exec.Cmd, int64, error) {
+	logPath := ""
+	var logFile *os.File
+	if opts.headless {
+		logPath = filepath.Join(nervDir, "logs", "run-"+task.ID+".log")
+		if err := os.MkdirAll(filepath.Dir(logPath), 0700); err != nil {
+			return nil, 0, err
+		}
+		var err error
+		if logFile, err = os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+			return nil, 0, err
+		}
+		// The agent holds its own copy of the descriptor once started
+		defer logFile.Close()
+	}
+	runID, err := st.CreateRun(task.ID, mode, logPath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cmd := agentCommand(task, runID, logFile, opts)
+	if err := cmd.Start(); err != nil {
+		st.FinishRun(runID, -1)
+		return nil, 0, err
+	}
+	if err := st.SetRunPID(runID, cmd.Process.Pid); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record the PID of run %d: %v\n", runID, err)
+	}
+
+	details, _ := json.Marshal(map[string]interface{}{"run_id": runID, "pid": cmd.Process.Pid, "mode": mode, "dir": cmd.Dir})
+	logAudit(st, task.ID, "run_started", string(details))
+	if logPath != "" {
+		fmt.Fprintf(os.Stderr, "Task %s: started agent (pid %d), logging to %s\n", task.ID, cmd.Process.Pid, logPath)
+	}
+	return cmd, runID, nil
+}
+
+// agentCommand builds the agent process for a task, in its worktree and with the NERV environment set
+// A headless agent writes to logFile; an interactive one gets the terminal
+func agentCommand(task store.Task, runID int64, logFile *os.File, opts runOptions) *exec.Cmd {
+	prompt := opts.prompt
+	if prompt == "" {
+		prompt = taskPrompt(task)
+	}
+
+	var cmd *exec.Cmd
+	if opts.headless {
+		cmd = exec.Command(opts.claude, "-p", prompt)
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+	} else {
+		cmd = exec.Command(opts.claude, prompt)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+
+	cmd.Dir = task.WorktreePath
+	cmd.Env = append(os.Environ(),
+		"NERV_PROJECT_ID="+task.ProjectID,
+		"NERV_TASK_ID="+task.ID,
+		"NERV_RUN_ID="+strconv.FormatInt(runID, 10),
+	)
+	return cmd
+}
+
+// taskPrompt is the opening prompt for a task when --prompt isn't given
+func taskPrompt(task store.Task) string {
+	prompt := fmt.Sprintf("You are working on NERV task %s: %s", task.ID, task.Title)
+	if task.Description != "" {
+		prompt += "\n\n" + task.Description
+	}
+	return prompt + "\n\nWhen the task is done, commit your work and stop."
+}
+
+// waitForRunSlot blocks until fewer than max runs are active
+func waitForRunSlot(st *store.DB, max int) error {
+	waiting := false
+	for {
+		live, err := reapRuns(st)
+		if err != nil {
+			return err
+		}
+		if len(live) < max {
+			return nil
+		}
+		if !waiting {
+			fmt.Fprintf(os.Stderr, "%d sessions running, waiting for one to finish\n", len(live))
+			waiting = true
+		}
+		time.Sleep(runSlotPoll)
+	}
+}
+
+// reapRuns marks runs whose process is gone as ended and returns the ones still running
+func reapRuns(st *store.DB) ([]store.TaskRun, error) {
+	runs, err := st.ActiveRuns()
+	if err != nil {
+		return nil, err
+	}
+
+	var live []store.TaskRun
+	for _, r := range runs {
+		switch {
+		case r.PID > 0 && processAlive(r.PID):
+			live = append(live, r)
+		case r.PID == 0 && time.Since(r.StartedAt) < runStartGrace:
+			// Still being launched
+			live = append(live, r)
+		default:
+			if err := st.FinishRun(r.ID, -1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return live, nil
+}
+
+// processAlive reports whether a process with this PID exists
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// On Windows FindProcess opens the process, so finding it is the answer
+	if runtime.GOOS == "windows" {
+		process.Release()
+		return true
+	}
+	err = process.Signal(syscall.Signal(0))
+	// EPERM means it exists but belongs to someone else
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
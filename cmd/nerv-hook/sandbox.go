@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// SandboxConfig makes some Bash commands run inside a container rather than on the host
+// A line that runs a matching command is allowed only as rewritten to
+// `docker run ... IMAGE sh -c LINE`; with no image configured, or when the line
+// can't run in the container as a whole, it's denied
+type SandboxConfig struct {
+	// Categories are built-in groups of commands to sandbox; see sandboxCategories
+	Categories []string `json:"categories,omitempty"`
+	// Commands are more Bash rules to sandbox, e.g. "Bash(make *)"
+	Commands []string `json:"commands,omitempty"`
+	// Image is the container image commands run in, e.g. "node:22"
+	Image string `json:"image,omitempty"`
+	// Runtime runs the container: docker (default) or podman
+	Runtime string `json:"runtime,omitempty"`
+	// Args are added to the run command before the image, e.g. ["--network=none"]
+	Args []string `json:"args,omitempty"`
+}
+
+// sandboxCategories are the command groups Categories can name
+var sandboxCategories = map[string][]string{
+	// install runs packages' install scripts, a common way in for malicious code
+	"install": {
+		"Bash(npm install*)", "Bash(npm i *)", "Bash(npm ci*)", "Bash(yarn add*)", "Bash(yarn install*)",
+		"Bash(pnpm add*)", "Bash(pnpm install*)", "Bash(pip install*)", "Bash(pip3 install*)",
+		"Bash(gem install*)", "Bash(cargo install*)", "Bash(go install*)",
+	},
+	// network fetches or sends data
+	"network": {"Bash(curl*)", "Bash(wget*)", "Bash(nc *)", "Bash(ssh *)", "Bash(scp *)"},
+	// scripts runs code the agent may have just written
+	"scripts": {"Bash(python*)", "Bash(node *)", "Bash(ruby *)", "Bash(perl *)", "Bash(sh *)", "Bash(bash *)", "Bash(./*)"},
+}
+
+// sandboxRuntimes are the container runtimes Runtime can name
+var sandboxRuntimes = map[string]bool{"docker": true, "podman": true}
+
+// Validate checks the categories and runtime are known
+func (c *SandboxConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	for _, name := range c.Categories {
+		if _, ok := sandboxCategories[name]; !ok {
+			return fmt.Errorf("unknown category %q (want install, network, or scripts)", name)
+		}
+	}
+	if c.Runtime != "" && !sandboxRuntimes[c.Runtime] {
+		return fmt.Errorf("unknown runtime %q (want docker or podman)", c.Runtime)
+	}
+	return nil
+}
+
+// runtime returns the configured container runtime or docker; a nil config means the default
+func (c *SandboxConfig) runtime() string {
+	if c == nil || c.Runtime == "" {
+		return "docker"
+	}
+	return c.Runtime
+}
+
+// match returns the rule that puts a Bash command line in the sandbox, or ""
+// Each command the line runs is matched on its own as well, without the
+// assignments and wrappers such as env before it, and by its name without its
+// directory, so neither cd app && npm install x nor FOO=1 /usr/bin/curl x gets past a rule
+func (c *SandboxConfig) match(command string) string {
+	if c == nil {
+		return ""
+	}
+	rules := append([]string{}, c.Commands...)
+	for _, name := range c.Categories {
+		rules = append(rules, sandboxCategories[name]...)
+	}
+	signatures := []string{"Bash(" + strings.TrimSpace(command) + ")"}
+	for _, args := range policy.CommandArgs(command) {
+		signatures = append(signatures, "Bash("+strings.Join(args, " ")+")")
+		if name := path.Base(args[0]); name != args[0] {
+			signatures = append(signatures, "Bash("+strings.Join(append([]string{name}, args[1:]...), " ")+")")
+		}
+	}
+	for _, rule := range rules {
+		for _, signature := range signatures {
+			if policy.Match(rule, signature) {
+				return rule
+			}
+		}
+	}
+	return ""
+}
+
+// unwrappable returns why a command line can't run in the container as a
+// whole, or "" if it can: it runs the container runtime itself, or changes to
+// a directory the container doesn't mount
+func unwrappable(command, cwd string) string {
+	for _, args := range policy.CommandArgs(command) {
+		name := path.Base(args[0])
+		if sandboxRuntimes[name] {
+			return "the line also runs " + name + ", which can't run inside it"
+		}
+		if name != "cd" && name != "pushd" {
+			continue
+		}
+		target := ""
+		for _, arg := range args[1:] {
+			if !strings.HasPrefix(arg, "-") {
+				target = arg
+				break
+			}
+		}
+		// cd alone goes home
+		if target != "" && !filepath.IsAbs(target) {
+			target = filepath.Join(cwd, target)
+		}
+		if cwd == "" || target == "" || strings.ContainsAny(target, "$~`*?[") || !withinDir(target, cwd) {
+			return "the line changes to a directory the container doesn't mount"
+		}
+	}
+	return ""
+}
+
+// sandboxedInput returns the tool input a Bash call must run with instead of its own,
+// or why it's denied when it must be sandboxed and can't be
+// Both are empty for calls that don't need the sandbox
+func sandboxedInput(c *SandboxConfig, toolName string, toolInput map[string]interface{}, cwd string) (map[string]interface{}, string) {
+	if toolName != "Bash" {
+		return nil, ""
+	}
+	command, _ := toolInput["command"].(string)
+	rule := c.match(command)
+	if rule == "" || inSandbox(c, command) {
+		return nil, ""
+	}
+	if c.Image == "" {
+		return nil, fmt.Sprintf("NERV only allows this command in a container (%s), and no sandbox image is configured", rule)
+	}
+	if reason := unwrappable(command, cwd); reason != "" {
+		return nil, fmt.Sprintf("NERV only allows this command in a container (%s), and %s; run it on its own", rule, reason)
+	}
+
+	updated := make(map[string]interface{}, len(toolInput))
+	for k, v := range toolInput {
+		updated[k] = v
+	}
+	updated["command"] = sandboxCommand(c, command, cwd)
+	return updated, ""
+}
+
+// inSandbox reports whether a command is already the sandbox's own run command
+func inSandbox(c *SandboxConfig, command string) bool {
+	all := policy.CommandArgs(command)
+	return len(all) == 1 && len(all[0]) > 1 && path.Base(all[0][0]) == c.runtime() && all[0][1] == "run" && slices.Contains(all[0], c.Image)
+}
+
+// sandboxCommand wraps a command to run in the container, with the working directory mounted at the same path
+func sandboxCommand(c *SandboxConfig, command, cwd string) string {
+	args := []string{c.runtime(), "run", "--rm", "-i"}
+	if cwd != "" {
+		args = append(args, "-v", cwd+":"+cwd, "-w", cwd)
+	}
+	args = append(args, c.Args...)
+	args = append(args, c.Image, "sh", "-c", command)
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote quotes a word for sh unless it's plainly safe as is
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=./:,+@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// updatedOutput makes an allowing output run the updated input, if there is one,
+// telling the user why with note
+func updatedOutput(output HookOutput, updated map[string]interface{}, note string) HookOutput {
+	if updated == nil || decisionBehavior(output) != "allow" {
+		return output
+	}
+	output.Decision = &Decision{Behavior: "allow"}
+	output.HookSpecificOutput = &HookSpecificOutput{
+		HookEventName:      "PreToolUse",
+		PermissionDecision: "allow",
+		UpdatedInput:       updated,
+	}
+	if output.SystemMessage == "" {
+		output.SystemMessage = "NERV: " + note
+	} else {
+		output.SystemMessage += "; " + note
+	}
+	return output
+}
+
+// unrewritable denies a call NERV allowed only with its input rewritten, by
+// the sandbox, a rewrite rule, or write redirection, for agents whose hook format can't rewrite a tool's input
+func unrewritable(output HookOutput) HookOutput {
+	if output.HookSpecificOutput == nil || output.HookSpecificOutput.UpdatedInput == nil {
+		return output
+	}
+	output.HookSpecificOutput = nil
+	output.Decision = &Decision{Behavior: "deny", Message: "NERV only allows this call rewritten, to run in a container, with its arguments changed, or with its write redirected, and this agent's hooks can't rewrite it"}
+	return output
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// Scripts are a person's own programs run after some pre-tool-use decisions,
+// for side effects NERV has no integration for, such as paging someone or
+// opening a ticket. Each is started with the decision as JSON on stdin and
+// left to run; the hook doesn't wait for it, and its answer changes nothing
+
+// Outcomes scripts can run after
+const (
+	outcomeDeny          = "deny"
+	outcomeTimeout       = "timeout"
+	outcomeHighRiskAllow = "high_risk_allow"
+)
+
+// ScriptsConfig lists the scripts run after each outcome
+type ScriptsConfig struct {
+	// OnDeny runs after a call is denied, by a rule, a check, a plugin, or a person
+	OnDeny []ScriptConfig `json:"on_deny,omitempty"`
+	// OnTimeout runs after an approval request times out
+	OnTimeout []ScriptConfig `json:"on_timeout,omitempty"`
+	// OnHighRiskAllow runs after a call NERV flagged as risky is allowed anyway:
+	// one that reveals secrets from the environment, reads a sensitive file, or a plugin asked about
+	OnHighRiskAllow []ScriptConfig `json:"on_high_risk_allow,omitempty"`
+}
+
+// ScriptConfig is a program run after an outcome
+type ScriptConfig struct {
+	// Command is the program and its arguments, e.g. ["/opt/acme/page", "--team", "infra"]
+	Command []string `json:"command"`
+	// Env names more environment variables the script is given, e.g. ["PAGERDUTY_TOKEN"]
+	Env []string `json:"env,omitempty"`
+}
+
+// Validate reports script settings that can't be run
+func (c *ScriptsConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	for _, outcome := range []string{outcomeDeny, outcomeTimeout, outcomeHighRiskAllow} {
+		for i, s := range c.scripts(outcome) {
+			if len(s.Command) == 0 || s.Command[0] == "" {
+				return fmt.Errorf("on_%s: script %d has an empty command", outcome, i+1)
+			}
+		}
+	}
+	return nil
+}
+
+// scripts returns the scripts run after an outcome
+func (c *ScriptsConfig) scripts(outcome string) []ScriptConfig {
+	if c == nil {
+		return nil
+	}
+	switch outcome {
+	case outcomeDeny:
+		return c.OnDeny
+	case outcomeTimeout:
+		return c.OnTimeout
+	case outcomeHighRiskAllow:
+		return c.OnHighRiskAllow
+	}
+	return nil
+}
+
+// scriptEvent is what a script reads on stdin
+type scriptEvent struct {
+	Outcome   string          `json:"outcome"`
+	ToolName  string          `json:"tool_name"`
+	ToolInput json.RawMessage `json:"tool_input"`
+	// Signature is the call as rules see it, e.g. Bash(npm test)
+	Signature string `json:"signature"`
+	// Reason is why the call was denied
+	Reason string `json:"reason,omitempty"`
+	// Risks are why an allowed call was flagged
+	Risks      []string  `json:"risks,omitempty"`
+	ApprovalID int64     `json:"approval_id,omitempty"`
+	SessionID  string    `json:"session_id,omitempty"`
+	TaskID     string    `json:"task_id,omitempty"`
+	ProjectID  string    `json:"project_id,omitempty"`
+	Cwd        string    `json:"cwd,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+// scriptLogPath is where scripts' output goes
+func scriptLogPath() string {
+	return filepath.Join(nervDir, "logs", "scripts.log")
+}
+
+// runScripts starts the scripts configured for an event's outcome
+// A script that can't be started is logged as a script_failed audit event
+func runScripts(db Store, event scriptEvent) {
+	scripts := loadConfig().Scripts.scripts(event.Outcome)
+	if len(scripts) == 0 {
+		return
+	}
+	event.Signature = policy.Signature(event.ToolName, string(event.ToolInput))
+	event.At = time.Now().UTC()
+	data, _ := json.Marshal(event)
+	for _, s := range scripts {
+		if err := startScript(s, event.Outcome, data, event.Cwd); err != nil {
+			details, _ := json.Marshal(map[string]string{"outcome": event.Outcome, "command": s.Command[0], "error": err.Error(), "session_id": event.SessionID})
+			logAudit(db, event.TaskID, "script_failed", string(details))
+		}
+	}
+}
+
+// startScript starts a script with the event on stdin and its output appended to the scripts log
+// The event is read from a file rather than a pipe, so the script can read it
+// after the hook has exited
+func startScript(s ScriptConfig, outcome string, event []byte, cwd string) error {
+	if err := os.MkdirAll(filepath.Dir(scriptLogPath()), 0700); err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(scriptLogPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	// The script holds its own copies of the descriptors once started
+	defer logFile.Close()
+	stdin, err := os.CreateTemp("", "nerv-event-*.json")
+	if err != nil {
+		return err
+	}
+	defer stdin.Close()
+	// On Windows an open file can't be removed, so the event is left to the temp directory's cleanup
+	defer os.Remove(stdin.Name())
+	if _, err := stdin.Write(event); err != nil {
+		return err
+	}
+	if _, err := stdin.Seek(0, 0); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(s.Command[0], s.Command[1:]...)
+	if info, err := os.Stat(cwd); err == nil && info.IsDir() {
+		cmd.Dir = cwd
+	}
+	cmd.Env = []string{"NERV_OUTCOME=" + outcome}
+	for _, name := range slices.Concat(pluginEnv, s.Env) {
+		if value, ok := os.LookupEnv(name); ok {
+			cmd.Env = append(cmd.Env, name+"="+value)
+		}
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, logFile, logFile
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Under nervd the script is reaped when it exits; a hook process exits first and leaves it running
+	go cmd.Wait()
+	return nil
+}
+
+// riskNotes returns why a call is high risk, one line of the notes its approval was asked with each
+func riskNotes(notes ...string) []string {
+	var risks []string
+	for _, n := range notes {
+		for _, line := range strings.Split(n, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				risks = append(risks, line)
+			}
+		}
+	}
+	return risks
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// Self-protection keeps agents away from NERV's own state, whatever the rules say
+// Deny globs such as Read(~/.nerv/*) only match the spelling they were written
+// with; these checks resolve each path a call touches, follow symlinks, and look
+// at every word of a shell command, so no config can let an agent approve its
+// own requests or rewrite its rules. A shell path the hook can't resolve, behind
+// a variable it doesn't know or a cd it can't follow, counts if it could name
+// NERV's state
+
+// dbClients are programs that can write a state database, by the kind they open:
+// a PostgreSQL client is caught by NERV_DB_URL's details, and a SQLite one by
+// the file it opens, however that file is named
+var dbClients = map[string]string{
+	"psql":       "postgres",
+	"pgcli":      "postgres",
+	"pg_restore": "postgres",
+	"sqlite3":    "sqlite",
+	"litecli":    "sqlite",
+}
+
+// fileToolKeys are the tool_input fields that name a path, for the tools that take one
+var fileToolKeys = map[string][]string{
+	"Read":         {"file_path"},
+	"Write":        {"file_path"},
+	"Edit":         {"file_path"},
+	"MultiEdit":    {"file_path"},
+	"NotebookEdit": {"notebook_path"},
+	"Grep":         {"path"},
+	"Glob":         {"path"},
+	"LS":           {"path"},
+}
+
+// selfProtection returns why a tool call must be denied to protect NERV, or "" if it's fine
+func selfProtection(toolName string, toolInput map[string]interface{}, cwd string) string {
+	if protected := protectedRoots().touchedBy(toolName, toolInput, cwd); protected != "" {
+		return protectedMessage(protected)
+	}
+	if keys, ok := fileToolKeys[toolName]; ok {
+		for _, key := range keys {
+			if p, _ := toolInput[key].(string); p != "" && writesProjectConfig(toolName, p) {
+				return "NERV protects its own state: agents can't change a repository's " + projectConfigFile
+			}
+		}
+		return ""
+	}
+
+	if toolName != "Bash" {
+		return ""
+	}
+	command, _ := toolInput["command"].(string)
+	dirs, unknownDir := shellDirs(command, cwd)
+	for _, words := range policy.ShellWords(command) {
+		for _, word := range words {
+			if namesProjectConfig(dirs, unknownDir, word) {
+				return "NERV protects its own state: shell commands can't touch a repository's " + projectConfigFile
+			}
+		}
+	}
+	for _, args := range policy.CommandArgs(command) {
+		client := path.Base(args[0])
+		if kind := dbClients[client]; kind == "postgres" && namesDatabaseURL(args[1:]) || kind == "sqlite" && opensDatabaseFile(dirs, args[1:]) {
+			return "NERV protects its own state: " + client + " can't open the NERV database"
+		}
+	}
+	return ""
+}
+
+// touchedBy returns the path in roots a tool call touches, or ""
+// File tools are checked by the paths they name, and Bash by every word of the
+// command, assignments included, against each directory it may run in
+func (roots protectedSet) touchedBy(toolName string, toolInput map[string]interface{}, cwd string) string {
+	if keys, ok := fileToolKeys[toolName]; ok {
+		for _, key := range keys {
+			if p, _ := toolInput[key].(string); p != "" {
+				if found := roots.find(cwd, p); found != "" {
+					return found
+				}
+			}
+		}
+		return ""
+	}
+
+	if toolName != "Bash" {
+		return ""
+	}
+	command, _ := toolInput["command"].(string)
+	dirs, unknownDir := shellDirs(command, cwd)
+	for _, words := range policy.ShellWords(command) {
+		for _, word := range words {
+			if found := roots.findInWord(dirs, unknownDir, word); found != "" {
+				return found
+			}
+		}
+	}
+	return ""
+}
+
+// shellDirs returns the directories a command line's commands may run in: cwd
+// and each directory it changes to with cd or pushd, resolved against the ones
+// before it. unknown is set when a cd's target can't be worked out, as with
+// cd $DIR or cd -
+func shellDirs(command, cwd string) (dirs []string, unknown bool) {
+	if cwd == "" {
+		cwd, _ = os.Getwd()
+	}
+	dirs = []string{cwd}
+	for _, args := range policy.CommandArgs(command) {
+		if name := path.Base(args[0]); name != "cd" && name != "pushd" {
+			continue
+		}
+		target := "~"
+		for _, arg := range args[1:] {
+			if arg == "-" || !strings.HasPrefix(arg, "-") {
+				target = arg
+				break
+			}
+		}
+		target = expandVariables(target)
+		if target == "-" || strings.ContainsAny(target, "$%*?[") {
+			unknown = true
+			continue
+		}
+		if filepath.IsAbs(target) {
+			dirs = append(dirs, filepath.Clean(target))
+			continue
+		}
+		for _, dir := range slices.Clone(dirs) {
+			dirs = append(dirs, filepath.Join(dir, target))
+		}
+	}
+	return dirs, unknown
+}
+
+func protectedMessage(p string) string {
+	return "NERV protects its own state: " + p + " is off limits to agents"
+}
+
+// protectedRoot is a protected path as written and with its symlinks resolved
+type protectedRoot struct{ path, canonical string }
+
+type protectedSet []protectedRoot
+
+// protectedRoots are NERV's state directory and files, which may sit elsewhere with
+// --config or --db, and the hook binary, wherever it was installed from
+func protectedRoots() protectedSet {
+	paths := []string{nervDir, dbPath, dbPath + "-wal", dbPath + "-shm", configPath}
+	if rec, ok := readBinaryRecord(); ok {
+		paths = append(paths, rec.Path)
+	}
+	if exe, err := os.Executable(); err == nil {
+		paths = append(paths, exe)
+	}
+	var roots protectedSet
+	for _, p := range paths {
+		roots = append(roots, protectedRoot{path: filepath.Clean(p), canonical: canonicalPath(p)})
+	}
+	return roots
+}
+
+// find returns the protected path p resolves into, or ""
+// p is resolved against cwd and through any symlinks in the part of it that exists;
+// a glob such as ~/.ner*/state.db finds the paths it would match
+func (roots protectedSet) find(cwd, p string) string {
+	p = expandHome(p)
+	if !filepath.IsAbs(p) {
+		if cwd == "" {
+			cwd, _ = os.Getwd()
+		}
+		p = filepath.Join(cwd, p)
+	}
+	clean, canonical := filepath.Clean(p), canonicalPath(p)
+	glob := strings.ContainsAny(clean, "*?[")
+	for _, root := range roots {
+		for _, r := range []string{root.path, root.canonical} {
+			if within(r, clean) || within(r, canonical) {
+				return root.path
+			}
+			if matched, _ := filepath.Match(clean, r); glob && matched {
+				return root.path
+			}
+		}
+	}
+	return ""
+}
+
+// findInWord checks one word of a shell command: as a path in each of dirs,
+// for a protected path written inside it, as in --db=$HOME/.nerv/state.db, and,
+// if it can't be resolved, by what it ends with, as in $D/state.db
+func (roots protectedSet) findInWord(dirs []string, unknownDir bool, word string) string {
+	word = redirectedPath(word)
+	if strings.ContainsAny(word, "/~$.") {
+		for _, dir := range dirs {
+			if protected := roots.find(dir, word); protected != "" {
+				return protected
+			}
+		}
+	}
+	expanded := expandVariables(word)
+	for _, root := range roots {
+		if containsPath(expanded, root.path) || containsPath(expanded, root.canonical) {
+			return root.path
+		}
+	}
+	if tail, ok := unresolvedTail(expanded, unknownDir); ok {
+		for _, root := range roots {
+			for _, r := range []string{root.path, root.canonical} {
+				if endsWithPath(r, tail) {
+					return root.path
+				}
+				if _, err := os.Lstat(filepath.Join(r, filepath.FromSlash(tail))); err == nil {
+					return root.path
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// shellVariable matches a parameter expansion, such as $D, ${D} or $1
+var shellVariable = regexp.MustCompile(`\$(\{[^}]*\}|[A-Za-z_][A-Za-z0-9_]*|[0-9@*#?$!-])`)
+
+// unresolvedTail returns the part of a path the hook can't resolve that it's
+// sure of: what follows its last variable, or all of a relative path when the
+// directory it's in is unknown
+func unresolvedTail(word string, unknownDir bool) (string, bool) {
+	var tail string
+	if vars := shellVariable.FindAllStringIndex(word, -1); len(vars) > 0 {
+		tail = word[vars[len(vars)-1][1]:]
+	} else if unknownDir && !filepath.IsAbs(word) && !strings.HasPrefix(word, "/") && strings.ContainsAny(word, "/.") {
+		tail = "/" + word
+	} else {
+		return "", false
+	}
+	tail = path.Clean(filepath.ToSlash(tail))
+	return tail, tail != "/" && tail != "."
+}
+
+// endsWithPath reports whether p could be named by a path ending in tail
+func endsWithPath(p, tail string) bool {
+	return strings.HasSuffix(filepath.ToSlash(p), tail)
+}
+
+// redirectedPath strips a redirection operator from the front of a word, so >permissions.json names permissions.json
+func redirectedPath(word string) string {
+	rest := strings.TrimLeft(word, "0123456789")
+	if rest == "" || rest[0] != '>' && rest[0] != '<' {
+		return word
+	}
+	return strings.TrimLeft(rest, "<>&|")
+}
+
+// containsPath reports whether s mentions root or something under it
+func containsPath(s, root string) bool {
+	for i := strings.Index(s, root); i >= 0; {
+		end := i + len(root)
+		if end == len(s) || s[end] == filepath.Separator || s[end] == '/' {
+			return true
+		}
+		next := strings.Index(s[end:], root)
+		if next < 0 {
+			break
+		}
+		i = end + next
+	}
+	return false
+}
+
+// windowsHomePrefixes are how cmd, PowerShell and Git Bash name the user profile
+var windowsHomePrefixes = []string{"%USERPROFILE%", "$env:USERPROFILE", "$USERPROFILE", "${USERPROFILE}"}
+
+// expandHome replaces a leading ~, $HOME, or ${HOME}, as the shell would
+// On Windows the user profile's names are replaced too, in any case, and
+// either separator may follow
+func expandHome(p string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	prefixes := []string{"~", "$HOME", "${HOME}"}
+	if runtime.GOOS == "windows" {
+		prefixes = append(prefixes, windowsHomePrefixes...)
+	}
+	for _, prefix := range prefixes {
+		if len(p) < len(prefix) || len(p) > len(prefix) && !os.IsPathSeparator(p[len(prefix)]) {
+			continue
+		}
+		if p[:len(prefix)] == prefix || runtime.GOOS == "windows" && strings.EqualFold(p[:len(prefix)], prefix) {
+			return home + filepath.FromSlash(p[len(prefix):])
+		}
+	}
+	return p
+}
+
+// expandVariables replaces $HOME and $NERV_DIR anywhere in a word, and ~ at its start or after = or :
+func expandVariables(word string) string {
+	home, _ := os.UserHomeDir()
+	if strings.HasPrefix(word, "~") {
+		word = home + word[1:]
+	}
+	pairs := []string{
+		"${HOME}", home, "$HOME", home,
+		"${NERV_DIR}", nervDir, "$NERV_DIR", nervDir,
+		"=~", "=" + home, ":~", ":" + home,
+	}
+	if runtime.GOOS == "windows" {
+		for _, prefix := range windowsHomePrefixes {
+			pairs = append(pairs, prefix, home)
+		}
+		pairs = append(pairs, "%NERV_DIR%", nervDir)
+	}
+	return strings.NewReplacer(pairs...).Replace(word)
+}
+
+// canonicalPath resolves symlinks in the longest existing prefix of p
+func canonicalPath(p string) string {
+	p = filepath.Clean(p)
+	var rest []string
+	for {
+		if resolved, err := filepath.EvalSymlinks(p); err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...)
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return filepath.Clean(filepath.Join(append([]string{p}, rest...)...))
+		}
+		rest = append([]string{filepath.Base(p)}, rest...)
+		p = parent
+	}
+}
+
+// within reports whether p is root or inside it
+func within(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// writesProjectConfig reports whether a file tool would change a repository's .nerv/permissions.json
+// Reading it is fine; writing it would let an agent grant itself rules
+func writesProjectConfig(toolName, p string) bool {
+	switch toolName {
+	case "Write", "Edit", "MultiEdit", "NotebookEdit":
+		p = filepath.ToSlash(filepath.Clean(p))
+		return p == projectConfigFile || strings.HasSuffix(p, "/"+projectConfigFile)
+	}
+	return false
+}
+
+// namesProjectConfig reports whether a shell word names a repository's
+// .nerv/permissions.json, in any of dirs or, if it can't be resolved, by what it ends with
+func namesProjectConfig(dirs []string, unknownDir bool, word string) bool {
+	word = redirectedPath(word)
+	if strings.Contains(word, projectConfigFile) {
+		return true
+	}
+	expanded := expandVariables(word)
+	for _, dir := range dirs {
+		p := expanded
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		if strings.HasSuffix(filepath.ToSlash(filepath.Clean(p)), "/"+projectConfigFile) {
+			return true
+		}
+	}
+	tail, ok := unresolvedTail(expanded, unknownDir)
+	return ok && endsWithPath("/"+projectConfigFile, tail)
+}
+
+// opensDatabaseFile reports whether a SQLite client's arguments name the state
+// database, by any path or hard link, in any of dirs
+func opensDatabaseFile(dirs []string, args []string) bool {
+	db, err := os.Stat(dbPath)
+	if err != nil {
+		return false
+	}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			continue
+		}
+		expanded := expandVariables(arg)
+		for _, dir := range dirs {
+			p := expanded
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(dir, p)
+			}
+			if info, err := os.Stat(p); err == nil && os.SameFile(info, db) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// namesDatabaseURL reports whether a database client's arguments point at NERV_DB_URL's database
+func namesDatabaseURL(args []string) bool {
+	u, err := url.Parse(os.Getenv("NERV_DB_URL"))
+	if err != nil || u.Host == "" {
+		return false
+	}
+	name := strings.TrimPrefix(u.Path, "/")
+	for _, arg := range args {
+		if strings.Contains(arg, u.Host) || (name != "" && (arg == name || strings.Contains(arg, "dbname="+name))) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// `nerv-hook self-update` replaces this binary, and every copy registered as
+// the hook in Claude settings, with the latest release. The release's
+// manifest, naming its version and the checksum of each binary, must carry a
+// valid signature from the release key, and the download must match its
+// checksum, before anything is replaced. A release older than the running
+// binary is never installed, so a feed can't roll back a fix. Each file is
+// replaced with a rename, so a hook starting mid-update runs the old binary or
+// the new one, never half of either
+
+// defaultUpdateFeed is NERV's GitHub releases
+const defaultUpdateFeed = "https://api.github.com/repos/gabino75/nerv/releases/latest"
+
+// releaseKey is the base64 ed25519 public key releases are signed with, set at
+// build time with -ldflags "-X main.releaseKey=..."
+var releaseKey = ""
+
+// updateTimeout bounds each download; maxUpdateBytes bounds its size
+const (
+	updateTimeout  = 5 * time.Minute
+	maxUpdateBytes = 256 << 20
+)
+
+// UpdatesConfig points self-update at another release feed, such as a mirror
+// inside a company network
+type UpdatesConfig struct {
+	// FeedURL serves the latest release as GitHub's releases API does, with the
+	// binaries and release.json as assets
+	FeedURL string `json:"feed_url,omitempty"`
+	// PublicKey is the base64 ed25519 key release.json is checked against, for feeds signed with another key
+	PublicKey string `json:"public_key,omitempty"`
+}
+
+func (c *UpdatesConfig) feedURL() string {
+	if c == nil || c.FeedURL == "" {
+		return defaultUpdateFeed
+	}
+	return c.FeedURL
+}
+
+func (c *UpdatesConfig) publicKey() string {
+	if c == nil || c.PublicKey == "" {
+		return releaseKey
+	}
+	return c.PublicKey
+}
+
+// Validate checks the public key decodes
+func (c *UpdatesConfig) Validate() error {
+	if c == nil || c.PublicKey == "" {
+		return nil
+	}
+	_, err := decodePublicKey(c.PublicKey)
+	return err
+}
+
+func decodePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("public_key is not a base64 ed25519 public key")
+	}
+	return key, nil
+}
+
+// releaseFeed is the part of a GitHub release self-update reads
+type releaseFeed struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (r releaseFeed) asset(name string) (string, bool) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL, true
+		}
+	}
+	return "", false
+}
+
+// releaseManifestAsset is the signed manifest a release publishes beside its binaries
+const releaseManifestAsset = "release.json"
+
+// signedManifest is release.json: a release's manifest and the release key's signature of it
+type signedManifest struct {
+	Manifest json.RawMessage `json:"manifest"`
+	// Signature is the base64 ed25519 signature of Manifest, exactly as written
+	Signature string `json:"signature"`
+}
+
+// releaseManifest names a release's version, so a signature can't be replayed
+// under another tag, and the SHA-256 of each of its binaries
+type releaseManifest struct {
+	Version string            `json:"version"`
+	SHA256  map[string]string `json:"sha256"`
+}
+
+// releaseAsset is the name this platform's binary is published under
+func releaseAsset() string {
+	name := fmt.Sprintf("nerv-hook-%s-%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+const selfUpdateUsage = "usage: nerv-hook self-update [--check] [--force] [--feed URL] | sign --key <file> --version <tag> SHA256SUMS"
+
+// runSelfUpdate implements `nerv-hook self-update`
+func runSelfUpdate(args []string) error {
+	if len(args) > 0 && args[0] == "sign" {
+		return runReleaseSign(args[1:])
+	}
+	fs := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	check := fs.Bool("check", false, "only report whether a newer release is available")
+	force := fs.Bool("force", false, "reinstall the latest release if it's the one installed")
+	feed := fs.String("feed", "", "release feed `URL`, overriding updates.feed_url")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New(selfUpdateUsage)
+	}
+
+	cfg := loadConfig().Updates
+	u := updater{feed: cfg.feedURL(), current: version, force: *force, out: os.Stdout, client: &http.Client{Timeout: updateTimeout}}
+	if *feed != "" {
+		u.feed = *feed
+	}
+	if k := cfg.publicKey(); k != "" {
+		key, err := decodePublicKey(k)
+		if err != nil {
+			return err
+		}
+		u.key = key
+	}
+	if !*check {
+		targets, err := updateTargets()
+		if err != nil {
+			return err
+		}
+		u.targets = targets
+	}
+
+	latest, replaced, err := u.run(*check)
+	if err != nil || len(replaced) == 0 {
+		return err
+	}
+
+	// The registered hook binary changed on purpose, so record it again
+	if rec, ok := readBinaryRecord(); ok && slices.Contains(replaced, rec.Path) {
+		if err := recordHookBinary(rec.Path); err != nil {
+			return fmt.Errorf("failed to record the hook binary: %w", err)
+		}
+	}
+	if st, err := openStore(); err == nil {
+		details, _ := json.Marshal(map[string]interface{}{"from": version, "to": latest, "paths": replaced})
+		st.LogAudit("", "self_updated", string(details))
+		st.Close()
+	}
+	return nil
+}
+
+// updater fetches, verifies and installs a release
+type updater struct {
+	feed    string
+	key     ed25519.PublicKey
+	current string
+	// targets are the binaries to replace
+	targets []string
+	force   bool
+	out     io.Writer
+	client  *http.Client
+}
+
+// run installs the latest release over the targets, or with check only
+// reports on it, returning the release and the paths replaced
+func (u updater) run(check bool) (string, []string, error) {
+	data, err := u.fetch(u.feed)
+	if err != nil {
+		return "", nil, fmt.Errorf("release feed: %w", err)
+	}
+	var release releaseFeed
+	if err := json.Unmarshal(data, &release); err != nil || release.TagName == "" {
+		return "", nil, fmt.Errorf("release feed %s: not a release", u.feed)
+	}
+	latest := release.TagName
+	fmt.Fprintf(u.out, "Installed: %s\nLatest:    %s\n", u.current, latest)
+	if newerVersion(u.current, latest) {
+		return "", nil, fmt.Errorf("release %s is older than the installed %s; self-update doesn't downgrade", latest, u.current)
+	}
+	if !newerVersion(latest, u.current) && !u.force {
+		fmt.Fprintln(u.out, "nerv-hook is up to date")
+		return latest, nil, nil
+	}
+	if check {
+		fmt.Fprintln(u.out, "Run nerv-hook self-update to install it")
+		return latest, nil, nil
+	}
+
+	if u.key == nil {
+		return "", nil, errors.New("no release key to verify the download with; this build wasn't signed for self-update, so set updates.public_key")
+	}
+	asset := releaseAsset()
+	binaryURL, ok := release.asset(asset)
+	manifestURL, manifestOK := release.asset(releaseManifestAsset)
+	if !ok || !manifestOK {
+		return "", nil, fmt.Errorf("release %s doesn't have %s and %s", latest, asset, releaseManifestAsset)
+	}
+
+	data, err = u.fetch(manifestURL)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %w", releaseManifestAsset, err)
+	}
+	manifest, err := verifyManifest(data, u.key)
+	if err != nil {
+		return "", nil, fmt.Errorf("release %s: %w; nothing was replaced", latest, err)
+	}
+	// The tag is only the feed's word; the signed version is the release's
+	if manifest.Version != latest {
+		return "", nil, fmt.Errorf("release %s: %s is signed for %s; nothing was replaced", latest, releaseManifestAsset, manifest.Version)
+	}
+	want, ok := manifest.SHA256[asset]
+	if !ok {
+		return "", nil, fmt.Errorf("release %s: %s has no checksum for %s", latest, releaseManifestAsset, asset)
+	}
+
+	binary, err := u.fetch(binaryURL)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %w", asset, err)
+	}
+	sum := sha256.Sum256(binary)
+	if hex.EncodeToString(sum[:]) != want {
+		return "", nil, fmt.Errorf("%s doesn't match its checksum in %s; nothing was replaced", asset, releaseManifestAsset)
+	}
+	fmt.Fprintf(u.out, "Verified %s against the signed %s\n", asset, releaseManifestAsset)
+
+	replaced, err := replaceBinaries(u.targets, binary)
+	for _, path := range replaced {
+		fmt.Fprintf(u.out, "Replaced %s\n", path)
+	}
+	return latest, replaced, err
+}
+
+// fetch GETs a URL, refusing bodies over maxUpdateBytes
+func (u updater) fetch(url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "nerv-hook/"+version)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxUpdateBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxUpdateBytes {
+		return nil, fmt.Errorf("%s: larger than %s", url, formatBytes(maxUpdateBytes))
+	}
+	return data, nil
+}
+
+// verifyManifest checks release.json is signed with key and returns its manifest
+func verifyManifest(data []byte, key ed25519.PublicKey) (releaseManifest, error) {
+	var signed signedManifest
+	var manifest releaseManifest
+	if err := json.Unmarshal(data, &signed); err != nil || len(signed.Manifest) == 0 {
+		return manifest, fmt.Errorf("%s is not a signed release manifest", releaseManifestAsset)
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil || !ed25519.Verify(key, signed.Manifest, signature) {
+		return manifest, fmt.Errorf("%s isn't signed with the release key", releaseManifestAsset)
+	}
+	if err := json.Unmarshal(signed.Manifest, &manifest); err != nil || manifest.Version == "" {
+		return manifest, fmt.Errorf("%s has no version", releaseManifestAsset)
+	}
+	return manifest, nil
+}
+
+// parseChecksums reads sha256sum output as checksums by file name
+func parseChecksums(sums []byte) map[string]string {
+	checksums := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			checksums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+		}
+	}
+	return checksums
+}
+
+// newerVersion reports whether latest is a later release than current
+// A development build is older than any release
+func newerVersion(latest, current string) bool {
+	l, lok := parseVersion(latest)
+	c, cok := parseVersion(current)
+	if !lok {
+		return false
+	}
+	if !cok {
+		return true
+	}
+	return slices.Compare(l, c) > 0
+}
+
+// parseVersion reads v1.2.3 as [1 2 3], ignoring a -prerelease or +build suffix
+func parseVersion(v string) ([]int, bool) {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	var parts []int
+	for _, p := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, false
+		}
+		parts = append(parts, n)
+	}
+	return parts, true
+}
+
+// updateTargets returns this binary, the registered hook binary, and the
+// binaries the user's Claude settings run as hooks, each once
+func updateTargets() ([]string, error) {
+	exe, err := resolveHookBinary("")
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{exe}
+	if rec, ok := readBinaryRecord(); ok {
+		paths = append(paths, rec.Path)
+	}
+	if settingsPath, err := claudeSettingsPath(installOptions{scope: "user"}); err == nil {
+		if settings, err := readClaudeSettings(settingsPath); err == nil {
+			paths = append(paths, settingsHookPaths(settings)...)
+		}
+	}
+
+	var targets []string
+	for _, p := range paths {
+		if resolved, err := filepath.EvalSymlinks(p); err == nil {
+			p = resolved
+		}
+		if _, err := os.Stat(p); err == nil && !slices.Contains(targets, p) {
+			targets = append(targets, p)
+		}
+	}
+	return targets, nil
+}
+
+// settingsHookPaths returns the binaries NERV's hook entries in Claude settings run
+func settingsHookPaths(settings map[string]interface{}) []string {
+	hooks, _ := settings["hooks"].(map[string]interface{})
+	var paths []string
+	for _, value := range hooks {
+		entries, _ := value.([]interface{})
+		for _, entry := range entries {
+			if !isNervHookEntry(entry, "") {
+				continue
+			}
+			commands, _ := entry.(map[string]interface{})["hooks"].([]interface{})
+			for _, c := range commands {
+				command, _ := c.(map[string]interface{})["command"].(string)
+				// install quotes the path
+				path, _, ok := strings.Cut(strings.TrimPrefix(command, `"`), `"`)
+				if !strings.HasPrefix(command, `"`) || !ok {
+					path, _, _ = strings.Cut(command, " ")
+				}
+				if strings.HasPrefix(filepath.Base(path), "nerv-hook") && !slices.Contains(paths, path) {
+					paths = append(paths, path)
+				}
+			}
+		}
+	}
+	return paths
+}
+
+// replaceBinaries writes binary beside each target, checks one copy runs, then
+// renames each over its target, returning the targets replaced
+func replaceBinaries(targets []string, binary []byte) ([]string, error) {
+	var staged []string
+	defer func() {
+		for _, s := range staged {
+			os.Remove(s)
+		}
+	}()
+	for _, target := range targets {
+		s, err := stageBinary(target, binary)
+		if err != nil {
+			return nil, fmt.Errorf("can't write beside %s: %w", target, err)
+		}
+		staged = append(staged, s)
+	}
+	if len(staged) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if out, err := exec.CommandContext(ctx, staged[0], "version").CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("the downloaded binary doesn't run (%v): %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	var replaced []string
+	for i, target := range targets {
+		// Windows can't replace a binary that's running, but can move it aside
+		if runtime.GOOS == "windows" {
+			os.Remove(target + ".old")
+			if err := os.Rename(target, target+".old"); err != nil {
+				return replaced, err
+			}
+		}
+		if err := os.Rename(staged[i], target); err != nil {
+			if runtime.GOOS == "windows" {
+				os.Rename(target+".old", target)
+			}
+			return replaced, err
+		}
+		replaced = append(replaced, target)
+	}
+	return replaced, nil
+}
+
+// stageBinary writes binary to an executable temporary file in target's directory
+func stageBinary(target string, binary []byte) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".update-*"+filepath.Ext(target))
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(binary); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Chmod(0755); err != nil && runtime.GOOS != "windows" {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// runReleaseSign writes a release's signed manifest to stdout, for
+// release.json, from its version and SHA256SUMS, with a key from nerv-hook org keygen
+func runReleaseSign(args []string) error {
+	fs := flag.NewFlagSet("self-update sign", flag.ContinueOnError)
+	keyFile := fs.String("key", "", "signing key written by nerv-hook org keygen")
+	releaseVersion := fs.String("version", "", "the release's tag, e.g. v1.3.0")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *keyFile == "" || *releaseVersion == "" {
+		return errors.New(selfUpdateUsage)
+	}
+	if _, ok := parseVersion(*releaseVersion); !ok {
+		return fmt.Errorf("--version %q is not a release version like v1.3.0", *releaseVersion)
+	}
+	key, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	priv, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(key)))
+	if err != nil || len(priv) != ed25519.PrivateKeySize {
+		return fmt.Errorf("%s is not a key written by nerv-hook org keygen", *keyFile)
+	}
+	sums, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	checksums := parseChecksums(sums)
+	if len(checksums) == 0 {
+		return fmt.Errorf("%s has no checksums", fs.Arg(0))
+	}
+	manifest, err := json.Marshal(releaseManifest{Version: *releaseVersion, SHA256: checksums})
+	if err != nil {
+		return err
+	}
+	// Not indented, which would change the signed bytes
+	data, err := json.Marshal(signedManifest{Manifest: manifest, Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, manifest))})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(string(data))
+	return err
+}
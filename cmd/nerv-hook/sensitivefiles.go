@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Reads of sensitive files are asked about or denied whatever the rules say,
+// by class: each class is a curated list of patterns, matched against the
+// path a Read or Grep names once it's resolved, ~ and symlinks included
+// A pattern starting with ~/ or / names a file or directory, with what's
+// inside a directory included; any other pattern is matched against file
+// names anywhere, as .env is
+
+// Sensitive file actions
+const (
+	// sensitiveAsk sends a read for approval, even if a rule allows it
+	sensitiveAsk = "ask"
+	// sensitiveDeny refuses a read
+	sensitiveDeny = "deny"
+	// sensitiveOff turns a class off
+	sensitiveOff = "off"
+)
+
+// sensitiveClass is a built-in group of sensitive files and what's done with reads of them by default
+type sensitiveClass struct {
+	action   string
+	patterns []string
+}
+
+// sensitiveClasses are the built-in classes, which SensitiveFilesConfig can extend or override
+var sensitiveClasses = map[string]sensitiveClass{
+	"ssh": {sensitiveDeny, []string{"~/.ssh", "id_rsa", "id_dsa", "id_ecdsa", "id_ed25519"}},
+	"cloud": {sensitiveDeny, []string{
+		"~/.aws", "~/.azure", "~/.config/gcloud", "~/.kube", "~/.docker/config.json",
+		"~/.oci", "~/.config/doctl", "~/.terraform.d/credentials.tfrc.json",
+		"~/.netrc", "~/.git-credentials", "~/.npmrc", "~/.pypirc", "~/.config/gh/hosts.yml",
+		"application_default_credentials.json", "*.tfstate",
+	}},
+	"browser": {sensitiveDeny, []string{
+		"~/.mozilla", "~/.config/google-chrome", "~/.config/chromium", "~/.config/BraveSoftware", "~/.config/microsoft-edge",
+		"~/Library/Application Support/Google/Chrome", "~/Library/Application Support/Firefox",
+		"~/Library/Application Support/BraveSoftware", "~/Library/Application Support/Microsoft Edge",
+		"~/Library/Safari", "~/Library/Cookies",
+	}},
+	"keychain": {sensitiveDeny, []string{
+		"~/Library/Keychains", "~/.local/share/keyrings", "~/.gnupg", "~/.password-store",
+		"*.keychain", "*.keychain-db", "*.kdbx",
+	}},
+	"keys": {sensitiveAsk, []string{"*.pem", "*.key", "*.p12", "*.pfx", "*.jks", "*.keystore"}},
+	"env":  {sensitiveAsk, []string{".env", ".env.*", "*.env"}},
+}
+
+// sensitiveExamples are file names the env class would match that are meant to be shared
+var sensitiveExamples = map[string]bool{
+	".env.example":  true,
+	".env.sample":   true,
+	".env.template": true,
+	".env.dist":     true,
+}
+
+// SensitiveFilesConfig adjusts the sensitive file classes
+type SensitiveFilesConfig struct {
+	// Classes sets a class's action: ask, deny, or off, e.g. {"env": "deny"}
+	Classes map[string]string `json:"classes,omitempty"`
+	// Paths adds patterns to a class, or makes a new one that's asked about
+	// unless Classes says otherwise, e.g. {"work": ["~/work/secrets"]}
+	Paths map[string][]string `json:"paths,omitempty"`
+}
+
+// Validate reports sensitive file settings that can't be applied
+func (c *SensitiveFilesConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	for class, action := range c.Classes {
+		if action != sensitiveAsk && action != sensitiveDeny && action != sensitiveOff {
+			return fmt.Errorf("%s: unknown action %q (want ask, deny, or off)", class, action)
+		}
+		if _, builtin := sensitiveClasses[class]; !builtin && len(c.Paths[class]) == 0 {
+			return fmt.Errorf("%s: no such class; add its patterns under paths", class)
+		}
+	}
+	for class, patterns := range c.Paths {
+		for _, p := range patterns {
+			if _, err := filepath.Match(p, ""); err != nil {
+				return fmt.Errorf("%s: bad pattern %q", class, p)
+			}
+		}
+	}
+	return nil
+}
+
+// classes returns every class with the config applied, sorted by name
+func (c *SensitiveFilesConfig) classes() ([]string, map[string]sensitiveClass) {
+	all := make(map[string]sensitiveClass, len(sensitiveClasses))
+	for name, class := range sensitiveClasses {
+		all[name] = class
+	}
+	if c != nil {
+		for name, patterns := range c.Paths {
+			class, ok := all[name]
+			if !ok {
+				class.action = sensitiveAsk
+			}
+			class.patterns = append(append([]string{}, class.patterns...), patterns...)
+			all[name] = class
+		}
+		for name, action := range c.Classes {
+			if class, ok := all[name]; ok {
+				class.action = action
+				all[name] = class
+			}
+		}
+	}
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, all
+}
+
+// sensitiveReadTools are the tools whose reads are checked, and the input key naming the path
+var sensitiveReadTools = map[string]string{
+	"Read": "file_path",
+	"Grep": "path",
+}
+
+// sensitiveFile returns the class of sensitive file a Read or Grep touches and
+// what's done with it, or "" if it touches none
+// A Grep searches cwd when it names no path; one of a directory touches the
+// class if a class's directory is inside it, or its glob names a class's files
+// When classes overlap, one that denies wins
+func sensitiveFile(c *SensitiveFilesConfig, toolName string, toolInput map[string]interface{}, cwd string) (string, string) {
+	key, ok := sensitiveReadTools[toolName]
+	p, _ := toolInput[key].(string)
+	if ok && p == "" && toolName == "Grep" {
+		p = cwd
+	}
+	if !ok || p == "" {
+		return "", ""
+	}
+	p = expandHome(p)
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(cwd, p)
+	}
+	paths := []string{filepath.Clean(p)}
+	if canonical := canonicalPath(p); canonical != paths[0] {
+		paths = append(paths, canonical)
+	}
+	// A copy in the redirect directory is as sensitive as the file it was copied from
+	if r := loadConfig().RedirectWrites; r != nil {
+		for _, p := range paths {
+			if original := r.original(p); original != "" {
+				paths = append(paths, original)
+				break
+			}
+		}
+	}
+
+	dir, glob := false, ""
+	if toolName == "Grep" {
+		info, err := os.Stat(paths[0])
+		dir = err == nil && info.IsDir()
+		glob, _ = toolInput["glob"].(string)
+	}
+
+	found, action := "", ""
+	names, classes := c.classes()
+	for _, name := range names {
+		class := classes[name]
+		if class.action == sensitiveOff || !class.matches(paths) && !(dir && class.inside(paths, glob)) {
+			continue
+		}
+		if action == "" || (class.action == sensitiveDeny && action != sensitiveDeny) {
+			found, action = name, class.action
+		}
+	}
+	return found, action
+}
+
+// matches reports whether any of paths is one of the class's files
+func (class sensitiveClass) matches(paths []string) bool {
+	for _, pattern := range class.patterns {
+		for _, p := range paths {
+			if sensitivePatternMatch(pattern, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inside reports whether a search of the directories dirs, limited to files
+// matching glob if it's set, can reach any of the class's files
+func (class sensitiveClass) inside(dirs []string, glob string) bool {
+	for _, pattern := range class.patterns {
+		if strings.HasPrefix(pattern, "~/") || filepath.IsAbs(pattern) {
+			root := filepath.Clean(expandHome(pattern))
+			for _, dir := range dirs {
+				if patternUnder(root, dir) {
+					return true
+				}
+			}
+			continue
+		}
+		if glob == "" {
+			continue
+		}
+		for _, name := range expandBraces(filepath.Base(filepath.ToSlash(glob))) {
+			// A glob of only wildcards filters nothing, like no glob
+			if sensitiveExamples[name] || strings.Trim(name, "*") == "" {
+				continue
+			}
+			// Either can be a pattern: *.pem names the keys class, and * names every file
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return true
+			}
+			if ok, _ := filepath.Match(name, pattern); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// patternUnder reports whether root, which may hold globs, can name a path inside dir
+func patternUnder(root, dir string) bool {
+	for {
+		if ok, _ := filepath.Match(root, dir); ok {
+			return true
+		}
+		parent := filepath.Dir(root)
+		if parent == root {
+			return false
+		}
+		root = parent
+	}
+}
+
+// expandBraces expands a glob's {a,b} alternatives, as ripgrep does
+func expandBraces(glob string) []string {
+	open := strings.Index(glob, "{")
+	if open < 0 {
+		return []string{glob}
+	}
+	end := strings.Index(glob[open:], "}")
+	if end < 0 {
+		return []string{glob}
+	}
+	end += open
+	var out []string
+	for _, alt := range strings.Split(glob[open+1:end], ",") {
+		out = append(out, expandBraces(glob[:open]+alt+glob[end+1:])...)
+	}
+	return out
+}
+
+// sensitivePatternMatch matches one pattern against a clean absolute path
+func sensitivePatternMatch(pattern, p string) bool {
+	if strings.HasPrefix(pattern, "~/") || filepath.IsAbs(pattern) {
+		root := filepath.Clean(expandHome(pattern))
+		if ok, _ := filepath.Match(root, p); ok {
+			return true
+		}
+		return withinDir(p, root)
+	}
+	base := filepath.Base(p)
+	if sensitiveExamples[base] {
+		return false
+	}
+	ok, _ := filepath.Match(pattern, base)
+	return ok
+}
+
+// sensitiveNote tells whoever decides an approval that it was asked for because of a sensitive file
+func sensitiveNote(class, action string) string {
+	if action != sensitiveAsk {
+		return ""
+	}
+	return "Reads a sensitive file, in the " + class + " class"
+}
+
+// sensitiveMessage says why a read of a sensitive file was denied
+func sensitiveMessage(class, toolName string, toolInput map[string]interface{}) string {
+	p, _ := toolInput[sensitiveReadTools[toolName]].(string)
+	return fmt.Sprintf("NERV denies reads of sensitive files: %s is in the %s class", p, class)
+}
@@ -0,0 +1,738 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+	"github.com/nerv/nerv-hook/pkg/approvals"
+)
+
+// nerv-hook serve is NERV's HTTP API, for teammates away from the dashboard's
+// machine and for tools: it lists pending approvals and decides them, and
+// reads the audit log. People sign in through the OpenID Connect provider in
+// the serve.oidc section (see oidc.go), which makes them an operator with the
+// role their groups map to, and tools send an API token (see token.go); each
+// request then acts as that operator, checked and attributed as in team mode
+
+const serveUsage = "usage: nerv-hook serve [--addr ADDR] | serve logins [--json] | serve revoke <operator>"
+
+const (
+	defaultServeAddr  = "127.0.0.1:7777"
+	defaultSessionTTL = 12 * time.Hour
+	sessionCookie     = "nerv_session"
+	// pendingLoginTTL is how long a person has to finish signing in at the provider
+	pendingLoginTTL = 10 * time.Minute
+	// maxPendingLogins bounds the sign-ins in progress, so abandoned ones can't use up memory
+	maxPendingLogins = 1000
+	// loginTouchInterval is how stale a login's last_seen_at may get before a request updates it
+	loginTouchInterval = time.Minute
+)
+
+//go:embed serve/index.html
+var serveIndexPage []byte
+
+// ServeConfig configures nerv-hook serve
+type ServeConfig struct {
+	// Addr is where the server listens (default 127.0.0.1:7777)
+	Addr string `json:"addr,omitempty"`
+	// URL is the address people reach the server at, e.g. https://nerv.acme.internal;
+	// the provider sends them back to URL/auth/callback (default http://ADDR)
+	URL string `json:"url,omitempty"`
+	// SessionTTL is how long a sign-in lasts, e.g. "8h" (default 12h)
+	SessionTTL string `json:"session_ttl,omitempty"`
+	// OIDC signs people in with an OpenID Connect provider
+	OIDC *OIDCConfig `json:"oidc,omitempty"`
+}
+
+// Validate reports settings nerv-hook serve can't start with
+func (c *ServeConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if _, err := c.baseURL(); err != nil {
+		return err
+	}
+	if _, err := c.sessionTTL(); err != nil {
+		return err
+	}
+	return c.OIDC.Validate()
+}
+
+func (c *ServeConfig) addr() string {
+	if c.Addr != "" {
+		return c.Addr
+	}
+	return defaultServeAddr
+}
+
+// baseURL is the server's address as people reach it
+func (c *ServeConfig) baseURL() (*url.URL, error) {
+	raw := c.URL
+	if raw == "" {
+		raw = "http://" + c.addr()
+	}
+	u, err := url.Parse(strings.TrimSuffix(raw, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("url %q is not an http or https URL", raw)
+	}
+	return u, nil
+}
+
+func (c *ServeConfig) sessionTTL() (time.Duration, error) {
+	if c.SessionTTL == "" {
+		return defaultSessionTTL, nil
+	}
+	d, err := time.ParseDuration(c.SessionTTL)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("session_ttl %q is not a positive duration", c.SessionTTL)
+	}
+	return d, nil
+}
+
+// runServe implements `nerv-hook serve`
+func runServe(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "logins":
+			return runServeLogins(args[1:])
+		case "revoke":
+			return runServeRevoke(args[1:])
+		}
+	}
+
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", "", "listen on `ADDR` instead of serve.addr")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New(serveUsage)
+	}
+	// Without serve.oidc no one signs in, and only API tokens are accepted
+	var cfg ServeConfig
+	if c := loadConfig().Serve; c != nil {
+		cfg = *c
+	}
+	if *addr != "" {
+		cfg.Addr = *addr
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("serve: %w", err)
+	}
+
+	st, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	srv, err := newServer(st, &cfg)
+	if err != nil {
+		return err
+	}
+	httpServer := &http.Server{Addr: cfg.addr(), Handler: srv.handler(), ReadHeaderTimeout: 10 * time.Second}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		httpServer.Shutdown(ctx)
+	}()
+
+	fmt.Fprintf(os.Stderr, "nerv-hook serve listening on %s for %s (database %s)\n", cfg.addr(), srv.base, st.Location())
+	if srv.oidc == nil {
+		fmt.Fprintln(os.Stderr, "Sign-in is off until serve.oidc is configured; only API tokens are accepted")
+	}
+	if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// server is nerv-hook serve's state
+type server struct {
+	st   *store.DB
+	oidc *oidcProvider
+	base *url.URL
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]pendingLogin
+}
+
+// pendingLogin is a sign-in sent to the provider, keyed by its state parameter
+type pendingLogin struct {
+	nonce    string
+	verifier string
+	// next is where to go once signed in
+	next    string
+	expires time.Time
+}
+
+func newServer(st *store.DB, cfg *ServeConfig) (*server, error) {
+	base, err := cfg.baseURL()
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := cfg.sessionTTL()
+	if err != nil {
+		return nil, err
+	}
+	s := &server{st: st, base: base, ttl: ttl, now: time.Now, pending: map[string]pendingLogin{}}
+	if cfg.OIDC != nil {
+		s.oidc = newOIDCProvider(cfg.OIDC)
+	}
+	return s, nil
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	// The page and sign-in are only for people, who can only sign in through a provider
+	if s.oidc != nil {
+		mux.HandleFunc("GET /{$}", s.handleIndex)
+		mux.HandleFunc("GET /login", s.handleLogin)
+		mux.HandleFunc("GET /auth/callback", s.handleCallback)
+		mux.HandleFunc("POST /logout", s.handleLogout)
+	}
+	mux.Handle("GET /api/whoami", s.api(store.RoleViewer, "", s.handleWhoami))
+	mux.Handle("GET /api/approvals", s.api(store.RoleViewer, scopeApprovalsRead, s.handlePendingApprovals))
+	mux.Handle("POST /api/approvals/{id}", s.api(store.RoleApprover, scopeApprovalsWrite, s.handleDecide))
+	mux.Handle("GET /api/audit", s.api(store.RoleViewer, scopeAuditRead, s.handleAudit))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Cache-Control", "no-store")
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) redirectURI() string {
+	return s.base.JoinPath("auth", "callback").String()
+}
+
+// randomToken returns n random bytes, URL-safe base64 encoded
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// secretHash is what a session cookie or API token is stored as, so the
+// database can't be used to sign in
+func secretHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// localPath returns next if it's a path on this server, or /
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, `/\`) {
+		return "/"
+	}
+	return next
+}
+
+func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Write(serveIndexPage)
+}
+
+// handleLogin sends a person to the provider to sign in
+func (s *server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	state, login := randomToken(32), pendingLogin{
+		nonce:    randomToken(32),
+		verifier: randomToken(32),
+		next:     localPath(r.URL.Query().Get("next")),
+		expires:  s.now().Add(pendingLoginTTL),
+	}
+	target, err := s.oidc.authURL(r.Context(), s.redirectURI(), state, login.nonce, login.verifier)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "nerv-hook serve: %v\n", err)
+		http.Error(w, "The identity provider can't be reached", http.StatusBadGateway)
+		return
+	}
+
+	s.mu.Lock()
+	now := s.now()
+	for k, p := range s.pending {
+		if now.After(p.expires) {
+			delete(s.pending, k)
+		}
+	}
+	full := len(s.pending) >= maxPendingLogins
+	if !full {
+		s.pending[state] = login
+	}
+	s.mu.Unlock()
+	if full {
+		http.Error(w, "Too many sign-ins in progress; try again in a few minutes", http.StatusServiceUnavailable)
+		return
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// handleCallback finishes a sign-in: it checks the provider's answer, makes
+// the person an operator with the role their claims map to, and starts a session
+func (s *server) handleCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s.mu.Lock()
+	login, ok := s.pending[q.Get("state")]
+	delete(s.pending, q.Get("state"))
+	s.mu.Unlock()
+	if !ok || s.now().After(login.expires) {
+		http.Error(w, "This sign-in has expired or was already used; sign in again", http.StatusBadRequest)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		s.loginFailed(w, "", fmt.Sprintf("the provider refused: %s %s", e, q.Get("error_description")))
+		return
+	}
+
+	idToken, err := s.oidc.exchange(r.Context(), q.Get("code"), s.redirectURI(), login.verifier)
+	if err != nil {
+		s.loginFailed(w, "", err.Error())
+		return
+	}
+	claims, err := s.oidc.verify(r.Context(), idToken, login.nonce, s.now())
+	if err != nil {
+		s.loginFailed(w, "", err.Error())
+		return
+	}
+	subject, _ := claims["sub"].(string)
+	role := s.oidc.cfg.role(claims)
+	if role == "" {
+		s.loginFailed(w, subject, fmt.Sprintf("none of the person's %s map to a NERV role", s.oidc.cfg.rolesClaim()))
+		return
+	}
+	name, err := s.syncOperator(subject, claims, role)
+	if err != nil {
+		s.loginFailed(w, subject, err.Error())
+		return
+	}
+
+	cookie := randomToken(32)
+	expires := s.now().Add(s.ttl)
+	if _, err := s.st.DeleteExpiredLogins(s.now()); err != nil {
+		fmt.Fprintf(os.Stderr, "nerv-hook serve: %v\n", err)
+	}
+	if err := s.st.CreateLogin(store.Login{ID: secretHash(cookie), Operator: name, Issuer: s.oidc.cfg.Issuer, Subject: subject, ExpiresAt: expires}); err != nil {
+		fmt.Fprintf(os.Stderr, "nerv-hook serve: %v\n", err)
+		http.Error(w, "The sign-in couldn't be recorded", http.StatusInternalServerError)
+		return
+	}
+	details, _ := json.Marshal(map[string]string{"issuer": s.oidc.cfg.Issuer, "subject": subject, "role": role})
+	if err := s.st.As(name).LogAudit("", "login", string(details)); err != nil {
+		fmt.Fprintf(os.Stderr, "nerv-hook serve: %v\n", err)
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: cookie, Path: "/", Expires: expires, HttpOnly: true, Secure: s.base.Scheme == "https", SameSite: http.SameSiteLaxMode})
+	http.Redirect(w, r, login.next, http.StatusFound)
+}
+
+// syncOperator returns the operator the person signing in is, registering
+// them the first time, and updates their role to what the provider says it is now
+// Operators are found by the provider's issuer and subject, never by a name or
+// email, so signing in can't take over an operator registered any other way
+// A disabled operator stays disabled, whatever the provider says
+func (s *server) syncOperator(subject string, claims map[string]interface{}, role string) (string, error) {
+	issuer := s.oidc.cfg.Issuer
+	u, err := s.st.UserByIdentity(issuer, subject)
+	if errors.Is(err, store.ErrNotFound) {
+		name := s.oidc.cfg.username(claims)
+		if !operatorNamePattern.MatchString(name) {
+			return "", fmt.Errorf("the provider gave no usable operator name (%q)", name)
+		}
+		if _, err := s.st.GetUser(name); err == nil {
+			return "", fmt.Errorf("operator %s is already registered, and not by this sign-in", name)
+		} else if !errors.Is(err, store.ErrNotFound) {
+			return "", err
+		}
+		email := ""
+		if emailVerified(claims) {
+			email, _ = claims["email"].(string)
+		}
+		if err := s.st.CreateUser(store.User{Name: name, Email: email, Role: role, CreatedBy: "oidc", OIDCIssuer: issuer, OIDCSubject: subject}); err != nil {
+			return "", err
+		}
+		details, _ := json.Marshal(map[string]string{"user": name, "role": role, "issuer": issuer, "subject": subject})
+		return name, s.st.As(name).LogAudit("", "user_added", string(details))
+	}
+	if err != nil {
+		return "", err
+	}
+	if u.Disabled() {
+		return "", fmt.Errorf("operator %s is disabled", u.Name)
+	}
+	if u.Role == role {
+		return u.Name, nil
+	}
+	// An approver keeps the risk limit an admin gave them
+	maxRisk := ""
+	if role == store.RoleApprover {
+		maxRisk = u.MaxRisk
+	}
+	if err := s.st.SetUserRole(u.Name, role, maxRisk); err != nil {
+		return "", err
+	}
+	details, _ := json.Marshal(map[string]string{"user": u.Name, "role": role, "max_risk": maxRisk, "previous": u.Role})
+	return u.Name, s.st.As(u.Name).LogAudit("", "user_role_changed", string(details))
+}
+
+// loginFailed records a refused sign-in and tells the person why
+func (s *server) loginFailed(w http.ResponseWriter, subject, reason string) {
+	details, _ := json.Marshal(map[string]string{"issuer": s.oidc.cfg.Issuer, "subject": subject, "reason": reason})
+	if err := s.st.LogAudit("", "login_failed", string(details)); err != nil {
+		fmt.Fprintf(os.Stderr, "nerv-hook serve: %v\n", err)
+	}
+	http.Error(w, "Sign-in failed: "+reason, http.StatusForbidden)
+}
+
+// handleLogout ends the session the request carries
+func (s *server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if !s.sameOrigin(r) {
+		writeAPIError(w, http.StatusForbidden, "cross-site request refused")
+		return
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if l, err := s.st.GetLogin(secretHash(c.Value)); err == nil {
+			if err := s.st.DeleteLogin(l.ID); err == nil {
+				s.st.As(l.Operator).LogAudit("", "logout", "{}")
+			}
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: s.base.Scheme == "https", SameSite: http.SameSiteLaxMode})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sameOrigin refuses requests a browser sent from another site
+// Browsers send Origin with every POST; clients that aren't browsers may leave it out
+func (s *server) sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || origin == s.base.Scheme+"://"+s.base.Host
+}
+
+// apiCaller is the operator an API request acts as
+type apiCaller struct {
+	user store.User
+	// st writes as the operator
+	st *store.DB
+	// token is the API token the request came with, or nil for a signed-in session
+	token *store.Token
+}
+
+// api wraps an API handler: the request must come from a signed-in operator, or
+// an API token with scope, whose operator's role is at least role
+// An empty scope lets any token through
+func (s *server) api(role, scope string, h func(w http.ResponseWriter, r *http.Request, c apiCaller)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && !s.sameOrigin(r) {
+			writeAPIError(w, http.StatusForbidden, "cross-site request refused")
+			return
+		}
+		var (
+			u      store.User
+			token  *store.Token
+			status int
+			err    error
+		)
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			u, token, status, err = s.authenticateToken(bearer)
+		} else {
+			u, status, err = s.authenticate(r)
+		}
+		if err != nil {
+			writeAPIError(w, status, err.Error())
+			return
+		}
+		if token != nil && scope != "" && !hasScope(token.Scopes, scope) {
+			writeAPIError(w, http.StatusForbidden, fmt.Sprintf("token %s doesn't have the %s scope", token.ID, scope))
+			return
+		}
+		if !store.RoleAtLeast(u.Role, role) {
+			writeAPIError(w, http.StatusForbidden, fmt.Sprintf("%s is a%s %s, and this needs a%s %s", u.Name, article(u.Role), u.Role, article(role), role))
+			return
+		}
+		h(w, r, apiCaller{user: u, st: s.st.As(u.Name), token: token})
+	})
+}
+
+// authenticate returns the operator a request's session is for
+func (s *server) authenticate(r *http.Request) (store.User, int, error) {
+	// Sessions only last while sign-in is configured
+	if s.oidc == nil {
+		return store.User{}, http.StatusUnauthorized, errors.New("send an API token as Authorization: Bearer TOKEN")
+	}
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return store.User{}, http.StatusUnauthorized, errors.New("sign in at /login, or send an API token as Authorization: Bearer TOKEN")
+	}
+	l, err := s.st.GetLogin(secretHash(c.Value))
+	if errors.Is(err, store.ErrNotFound) || err == nil && l.Expired(s.now()) {
+		return store.User{}, http.StatusUnauthorized, errors.New("your session has ended; sign in at /login")
+	}
+	if err != nil {
+		return store.User{}, http.StatusInternalServerError, err
+	}
+	u, status, err := s.operator(l.Operator)
+	if err != nil {
+		return u, status, err
+	}
+	if s.now().Sub(l.LastSeenAt) > loginTouchInterval {
+		s.st.TouchLogin(l.ID, s.now())
+	}
+	return u, http.StatusOK, nil
+}
+
+// authenticateToken returns the operator an API token acts as, and the token
+func (s *server) authenticateToken(bearer string) (store.User, *store.Token, int, error) {
+	t, err := s.st.TokenByHash(secretHash(strings.TrimSpace(bearer)))
+	if errors.Is(err, store.ErrNotFound) || err == nil && !t.Usable(s.now()) {
+		return store.User{}, nil, http.StatusUnauthorized, errors.New("the API token is unknown, expired, or revoked")
+	}
+	if err != nil {
+		return store.User{}, nil, http.StatusInternalServerError, err
+	}
+	u, status, err := s.operator(t.Operator)
+	if err != nil {
+		return u, nil, status, err
+	}
+	if s.now().Sub(t.LastUsedAt) > loginTouchInterval {
+		s.st.TouchToken(t.ID, s.now())
+	}
+	return u, &t, http.StatusOK, nil
+}
+
+// operator loads the operator a session or token is for, who must still be registered and enabled
+func (s *server) operator(name string) (store.User, int, error) {
+	u, err := s.st.GetUser(name)
+	if errors.Is(err, store.ErrNotFound) {
+		return u, http.StatusForbidden, fmt.Errorf("%s is no longer a registered operator", name)
+	}
+	if err != nil {
+		return u, http.StatusInternalServerError, err
+	}
+	if u.Disabled() {
+		return u, http.StatusForbidden, fmt.Errorf("operator %s is disabled", u.Name)
+	}
+	return u, http.StatusOK, nil
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIJSON(w, status, map[string]string{"error": message})
+}
+
+// jsonWhoami is the operator a request acts as, and the token it came with
+type jsonWhoami struct {
+	jsonUser
+	Token  string   `json:"token,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+func (s *server) handleWhoami(w http.ResponseWriter, r *http.Request, c apiCaller) {
+	out := jsonWhoami{jsonUser: jsonUser{Name: c.user.Name, Email: c.user.Email, Role: c.user.Role, CreatedAt: c.user.CreatedAt, CreatedBy: c.user.CreatedBy, MaxRisk: c.user.MaxRisk}}
+	if c.token != nil {
+		out.Token, out.Scopes = c.token.ID, c.token.Scopes
+	}
+	writeAPIJSON(w, http.StatusOK, out)
+}
+
+func (s *server) handlePendingApprovals(w http.ResponseWriter, r *http.Request, c apiCaller) {
+	pending, err := s.st.PendingApprovals()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	out := make([]jsonApproval, 0, len(pending))
+	for _, a := range pending {
+		out = append(out, approvalJSON(a))
+	}
+	writeAPIJSON(w, http.StatusOK, out)
+}
+
+// handleDecide approves or denies a pending approval, if the operator may decide one of its risk
+func (s *server) handleDecide(w http.ResponseWriter, r *http.Request, c apiCaller) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "no such approval")
+		return
+	}
+	var body struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&body); err != nil || (body.Status != approvals.Approved && body.Status != approvals.Denied) {
+		writeAPIError(w, http.StatusBadRequest, `give {"status": "approved"} or {"status": "denied", "reason": "..."}`)
+		return
+	}
+
+	a, err := s.st.GetApproval(id)
+	if errors.Is(err, store.ErrNotFound) {
+		writeAPIError(w, http.StatusNotFound, "no such approval")
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !c.user.CanDecide(a.Risk) {
+		writeAPIError(w, http.StatusForbidden, fmt.Sprintf("%s may decide approvals of up to %s risk, and this one is %s risk", c.user.Name, c.user.MaxRisk, orHigh(a.Risk)))
+		return
+	}
+
+	decided, err := c.st.DecideApproval(id, body.Status, body.Reason)
+	var conflict *approvals.ConflictError
+	if errors.As(err, &conflict) {
+		writeAPIJSON(w, http.StatusConflict, map[string]interface{}{"error": conflict.Error(), "approval": approvalJSON(conflict.Current)})
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	markDecision(id)
+	writeAPIJSON(w, http.StatusOK, approvalJSON(decided))
+}
+
+// orHigh names an approval's risk, counting one queued before risks were recorded as high
+func orHigh(risk string) string {
+	if risk == "" {
+		return approvals.RiskHigh
+	}
+	return risk
+}
+
+// handleAudit lists audit events, newest first, filtered as nerv-hook audit's flags do
+func (s *server) handleAudit(w http.ResponseWriter, r *http.Request, c apiCaller) {
+	q := r.URL.Query()
+	limit := 50
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > 1000 {
+			writeAPIError(w, http.StatusBadRequest, "limit must be from 1 to 1000")
+			return
+		}
+		limit = n
+	}
+	events, err := s.st.ListAudit(store.AuditFilter{TaskID: q.Get("task"), EventType: q.Get("type"), Operator: q.Get("operator"), Limit: limit})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	out := make([]jsonEvent, 0, len(events))
+	for _, e := range events {
+		out = append(out, eventJSON(e))
+	}
+	writeAPIJSON(w, http.StatusOK, out)
+}
+
+// jsonLogin is a signed-in session
+type jsonLogin struct {
+	Operator   string     `json:"operator"`
+	Subject    string     `json:"subject,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+}
+
+// runServeLogins lists the sessions signed in to nerv-hook serve
+func runServeLogins(args []string) error {
+	fs := flag.NewFlagSet("serve logins", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the logins as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	if err := readAsOperator(st); err != nil {
+		return err
+	}
+
+	logins, err := st.ListLogins(time.Now())
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		out := make([]jsonLogin, 0, len(logins))
+		for _, l := range logins {
+			out = append(out, jsonLogin{Operator: l.Operator, Subject: l.Subject, CreatedAt: l.CreatedAt, ExpiresAt: l.ExpiresAt, LastSeenAt: optionalTime(l.LastSeenAt)})
+		}
+		return printJSON(out)
+	}
+	if len(logins) == 0 {
+		fmt.Println("No one is signed in to nerv-hook serve")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "OPERATOR\tSIGNED IN\tLAST SEEN\tEXPIRES")
+	format := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Local().Format("2006-01-02 15:04")
+	}
+	for _, l := range logins {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", l.Operator, format(l.CreatedAt), format(l.LastSeenAt), format(l.ExpiresAt))
+	}
+	return w.Flush()
+}
+
+// runServeRevoke signs an operator out of every session
+func runServeRevoke(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: nerv-hook serve revoke <operator>")
+	}
+	name := args[0]
+
+	st, err := openAdminStore("end other operators' sessions")
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	n, err := st.DeleteOperatorLogins(name)
+	if err != nil {
+		return err
+	}
+	details, _ := json.Marshal(map[string]interface{}{"user": name, "sessions": n})
+	if err := st.LogAudit("", "logins_revoked", string(details)); err != nil {
+		return err
+	}
+	fmt.Printf("Ended %d session(s) for %s\n", n, name)
+	return nil
+}
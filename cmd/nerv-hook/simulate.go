@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+	"github.com/nerv/nerv-hook/pkg/approvals"
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// `nerv-hook simulate` runs crafted hook events through the same path a hook
+// invocation takes, against a scratch NERV directory holding a copy of the
+// permissions file and a fresh database, and prints each decision with the
+// rows it wrote. Nothing reaches the real database, and settings that act
+// outside NERV are left out of the copy
+
+const simulateUsage = "usage: nerv-hook simulate [--tool NAME --input JSON | --command CMD] [--event EVENT] [--session ID] [--cwd DIR] [--repo DIR] [--approvals approve|deny] [--protocol NAME] [--keep DIR] [--json] [PAYLOAD_FILE...]"
+
+// The scratch project and task simulated events belong to
+const (
+	simulateProject = "simulate"
+	simulateTask    = "simulate-task"
+)
+
+// simulateDropped are the permissions file sections left out of the scratch
+// copy, since they send requests, run commands, or move the database
+var simulateDropped = []string{"database", "replication", "github", "trackers", "webhooks", "verify"}
+
+// hookEventCommands maps Claude Code's hook_event_name to the hook commands
+var hookEventCommands = map[string]string{
+	"PreToolUse":       "pre-tool-use",
+	"PostToolUse":      "post-tool-use",
+	"SessionStart":     "session-start",
+	"UserPromptSubmit": "user-prompt-submit",
+	"Stop":             "stop",
+}
+
+// simulatedEvent is one event's decision and the rows it wrote
+type simulatedEvent struct {
+	Event string `json:"event"`
+	Tool  string `json:"tool,omitempty"`
+	// Decision is allow or deny for pre-tool-use, once any approval is answered, and empty for other events
+	Decision string `json:"decision,omitempty"`
+	// Output is the response as the agent receives it
+	Output    json.RawMessage `json:"output"`
+	Audit     []jsonEvent     `json:"audit"`
+	Approvals []jsonApproval  `json:"approvals"`
+}
+
+// simulation is a scratch NERV directory events run against
+type simulation struct {
+	st       *store.DB
+	protocol Protocol
+	cwd      string
+	// lastAudit and lastApproval are the newest rows already reported
+	lastAudit, lastApproval int64
+}
+
+// runSimulate implements `nerv-hook simulate`
+func runSimulate(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	tool := fs.String("tool", "", "simulate a call to the tool `NAME`: pre-tool-use, post-tool-use unless denied, then stop")
+	input := fs.String("input", "{}", "the call's tool input as `JSON`")
+	command := fs.String("command", "", "simulate a Bash call running `CMD`")
+	event := fs.String("event", "", "the hook `EVENT` of payloads that don't name one")
+	session := fs.String("session", "simulated", "the session `ID` of calls built from flags")
+	cwd := fs.String("cwd", "", "the working `DIR` of events that don't give one (default the current directory)")
+	var repos []string
+	fs.Func("repo", "register the repository at `DIR` in the scratch project, so its .nerv/permissions.json applies (repeatable)", func(dir string) error {
+		abs, err := filepath.Abs(dir)
+		repos = append(repos, abs)
+		return err
+	})
+	decide := fs.String("approvals", approvals.Denied, "answer approval requests: approve or deny")
+	protocolName := fs.String("protocol", "claude", "the `NAME` of the payloads' wire format: claude, cursor, openhands, or aider")
+	keep := fs.String("keep", "", "use and keep the scratch directory `DIR`, to look at afterwards")
+	asJSON := fs.Bool("json", false, "print each event as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *command != "" {
+		if *tool != "" && *tool != "Bash" {
+			return errors.New(simulateUsage)
+		}
+		*tool = "Bash"
+		data, _ := json.Marshal(map[string]string{"command": *command})
+		*input = string(data)
+	}
+	if (*tool == "") == (fs.NArg() == 0) {
+		return errors.New(simulateUsage)
+	}
+	switch *decide {
+	case "approve":
+		*decide = approvals.Approved
+	case "deny", approvals.Denied:
+		*decide = approvals.Denied
+	default:
+		return fmt.Errorf("--approvals must be approve or deny, not %q", *decide)
+	}
+	protocol, err := lookupProtocol(*protocolName)
+	if err != nil {
+		return err
+	}
+	if *cwd == "" {
+		if *cwd, err = os.Getwd(); err != nil {
+			return err
+		}
+	}
+
+	// The events to run, read before the scratch directory replaces the real one
+	type step struct {
+		command string
+		payload []byte
+	}
+	var steps []step
+	if *tool != "" {
+		var toolInput map[string]interface{}
+		if err := json.Unmarshal([]byte(*input), &toolInput); err != nil {
+			return fmt.Errorf("--input: %v", err)
+		}
+		for _, name := range []string{"PreToolUse", "PostToolUse"} {
+			data, _ := json.Marshal(map[string]interface{}{"session_id": *session, "hook_event_name": name, "tool_name": *tool, "tool_input": toolInput, "cwd": *cwd})
+			steps = append(steps, step{hookEventCommands[name], data})
+		}
+		data, _ := json.Marshal(map[string]interface{}{"session_id": *session, "hook_event_name": "Stop", "cwd": *cwd})
+		steps = append(steps, step{"stop", data})
+	}
+	for _, path := range fs.Args() {
+		payloads, err := readPayloads(path)
+		if err != nil {
+			return err
+		}
+		for i, p := range payloads {
+			command := *event
+			if command == "" {
+				var named struct {
+					HookEventName string `json:"hook_event_name"`
+				}
+				json.Unmarshal(p, &named)
+				command = hookEventCommands[named.HookEventName]
+			}
+			if command == "" {
+				return fmt.Errorf("%s: payload %d doesn't name a Claude Code hook event; give one with --event", path, i+1)
+			}
+			steps = append(steps, step{command, p})
+		}
+	}
+	sim, cleanup, err := startSimulation(*keep, repos)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	sim.protocol, sim.cwd = protocol, *cwd
+	stop := sim.answerApprovals(*decide)
+	defer stop()
+
+	var results []simulatedEvent
+	for i, s := range steps {
+		// A denied call never runs, so a call built from flags stops there
+		if *tool != "" && i == 1 && results[0].Decision == "deny" {
+			continue
+		}
+		result, err := sim.run(s.command, s.payload)
+		if err != nil {
+			return err
+		}
+		results = append(results, result)
+		if !*asJSON {
+			printSimulated(os.Stdout, result)
+		}
+	}
+	if *asJSON {
+		return printJSON(results)
+	}
+	if *keep != "" {
+		fmt.Printf("Scratch directory kept in %s; look at it with nerv-hook --db %s audit\n", *keep, dbPath)
+	}
+	return nil
+}
+
+// readPayloads reads the hook payloads in a file, or stdin for -: one JSON
+// object, or several one after another
+func readPayloads(path string) ([]json.RawMessage, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var payloads []json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var p json.RawMessage
+		if err := dec.Decode(&p); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		payloads = append(payloads, p)
+	}
+	if len(payloads) == 0 {
+		return nil, fmt.Errorf("%s holds no payloads", path)
+	}
+	return payloads, nil
+}
+
+// startSimulation points every state path at a scratch directory, with a copy
+// of the permissions file and org policy, a fresh database and an in-progress
+// task, and returns a function restoring the real paths
+func startSimulation(keep string, repos []string) (*simulation, func(), error) {
+	config, err := simulatedConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	dir := keep
+	if dir == "" {
+		if dir, err = os.MkdirTemp("", "nerv-simulate-"); err != nil {
+			return nil, nil, err
+		}
+	} else if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, err
+	}
+	var copies [][2]string
+	for _, path := range []string{orgBundlePath(), orgKeyPath()} {
+		copies = append(copies, [2]string{path, filepath.Join(dir, filepath.Base(path))})
+	}
+
+	// The database must be the scratch one, whatever the environment says
+	realDir, realConfig, realDB := nervDir, configPath, dbPath
+	dbURL, hadURL := os.LookupEnv("NERV_DB_URL")
+	os.Unsetenv("NERV_DB_URL")
+	setNervDir(dir)
+	restore := func() {
+		setNervDir(realDir)
+		configPath, dbPath = realConfig, realDB
+		if hadURL {
+			os.Setenv("NERV_DB_URL", dbURL)
+		}
+		if keep == "" {
+			os.RemoveAll(dir)
+		}
+	}
+	fail := func(err error) (*simulation, func(), error) {
+		restore()
+		return nil, nil, err
+	}
+
+	if config != nil {
+		if err := os.WriteFile(configPath, config, 0600); err != nil {
+			return fail(err)
+		}
+	}
+	for _, c := range copies {
+		if data, err := os.ReadFile(c[0]); err == nil {
+			if err := os.WriteFile(c[1], data, 0600); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	st, err := store.OpenSQLite(dbPath, "rwc", dbOptions())
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := st.Migrate(); err != nil {
+		st.Close()
+		return fail(err)
+	}
+	sim := &simulation{st: st}
+	if err := sim.seed(repos); err != nil {
+		st.Close()
+		return fail(err)
+	}
+	return sim, func() { st.Close(); restore() }, nil
+}
+
+// simulatedConfig returns the permissions file to simulate with, minus the
+// sections that act outside NERV, or nil when there's none and the built-in
+// rules apply
+func simulatedConfig() ([]byte, error) {
+	if _, err := os.Stat(configPath); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	doc, err := readConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	for _, section := range simulateDropped {
+		delete(doc, section)
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// seed creates the scratch project, its repositories and an in-progress task,
+// or finds them in a kept directory
+func (s *simulation) seed(repos []string) error {
+	if _, err := s.st.GetProject(simulateProject); errors.Is(err, store.ErrNotFound) {
+		if err := s.st.CreateProject(store.Project{ID: simulateProject, Name: "Simulation"}); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	existing, err := s.st.ListRepos(simulateProject)
+	if err != nil {
+		return err
+	}
+	for i, path := range repos {
+		if slices.ContainsFunc(existing, func(r store.Repo) bool { return r.Path == path }) {
+			continue
+		}
+		id := fmt.Sprintf("simulate-repo-%d", len(existing)+i+1)
+		if err := s.st.CreateRepo(store.Repo{ID: id, ProjectID: simulateProject, Name: filepath.Base(path), Path: path}); err != nil {
+			return err
+		}
+	}
+
+	task, err := s.st.GetTask(simulateTask)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		if err := s.st.CreateTask(store.Task{ID: simulateTask, ProjectID: simulateProject, Title: "Simulated task", Status: store.TaskInProgress}); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case task.Status != store.TaskInProgress:
+		// A kept directory's task went to review when its last simulation stopped
+		if _, err := s.st.SetTaskStatus(simulateTask, task.Status, store.TaskInProgress, "simulate"); err != nil {
+			return err
+		}
+	}
+	s.lastAudit, s.lastApproval = s.newest()
+	return nil
+}
+
+// newest returns the IDs of the newest audit row and approval
+func (s *simulation) newest() (audit, approval int64) {
+	if events, err := s.st.ListAudit(store.AuditFilter{Limit: 1}); err == nil && len(events) > 0 {
+		audit = events[0].ID
+	}
+	if list, err := s.st.ListApprovals(simulateTask); err == nil && len(list) > 0 {
+		approval = list[len(list)-1].ID
+	}
+	return audit, approval
+}
+
+// answerApprovals decides every approval request as status until stopped,
+// standing in for the person at the dashboard
+func (s *simulation) answerApprovals(status string) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(approvals.DefaultBackoff.Initial / 2):
+			}
+			pending, err := s.st.PendingApprovals()
+			if err != nil {
+				continue
+			}
+			for _, a := range pending {
+				reason := ""
+				if status == approvals.Denied {
+					reason = "Denied by nerv-hook simulate"
+				}
+				s.st.DecideApproval(a.ID, status, reason)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// run handles one event as a hook invocation would and collects the rows it wrote
+func (s *simulation) run(command string, payload []byte) (simulatedEvent, error) {
+	input, inputErr := s.protocol.ParseInput(command, payload)
+	if inputErr == nil {
+		inputErr = validateHookInput(command, input)
+	}
+	// Only pre-tool-use can refuse the tool; a hook fails on anything else
+	if inputErr != nil && command != "pre-tool-use" {
+		return simulatedEvent{}, fmt.Errorf("%s: %v", command, inputErr)
+	}
+	if input.Cwd == "" {
+		input.Cwd = s.cwd
+	}
+
+	output := processEvent(command, simulateProject, simulateTask, input, inputErr)
+	traceDecision(command, input, output)
+	var decision string
+	if output.Decision != nil {
+		decision = output.Decision.Behavior
+	} else if command == "pre-tool-use" {
+		decision = "allow"
+	}
+	output = applyTranscriptVisibility(output, loadConfig().transcriptVisibility(command))
+	data, err := s.protocol.FormatOutput(command, output)
+	if err != nil {
+		return simulatedEvent{}, err
+	}
+
+	result := simulatedEvent{Event: command, Tool: input.ToolName, Decision: decision, Output: data, Audit: []jsonEvent{}, Approvals: []jsonApproval{}}
+	events, err := s.st.ListAudit(store.AuditFilter{})
+	if err != nil {
+		return result, err
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].ID > s.lastAudit {
+			result.Audit = append(result.Audit, eventJSON(events[i]))
+		}
+	}
+	list, err := s.st.ListApprovals(simulateTask)
+	if err != nil {
+		return result, err
+	}
+	for _, a := range list {
+		if a.ID > s.lastApproval {
+			result.Approvals = append(result.Approvals, approvalJSON(a))
+		}
+	}
+	s.lastAudit, s.lastApproval = s.newest()
+	return result, nil
+}
+
+// printSimulated writes one event for a person
+func printSimulated(out io.Writer, e simulatedEvent) {
+	title := e.Event
+	if e.Tool != "" {
+		title += " " + e.Tool
+	}
+	if e.Decision != "" {
+		title += ": " + e.Decision
+	}
+	fmt.Fprintf(out, "%s\n  output    %s\n", title, bytes.TrimSpace(e.Output))
+	for _, ev := range e.Audit {
+		fmt.Fprintf(out, "  audit     %s %s\n", ev.Event, ev.Details)
+	}
+	for _, a := range e.Approvals {
+		line := fmt.Sprintf("  approval  #%d %s %s", a.ID, policy.Signature(a.Tool, a.Input), a.Status)
+		if a.DenyReason != "" {
+			line += ": " + a.DenyReason
+		}
+		fmt.Fprintln(out, line)
+	}
+}
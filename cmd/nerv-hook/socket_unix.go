@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// restrictSocket lets only the owner connect to nervd's socket
+func restrictSocket(path string) error {
+	return os.Chmod(path, 0600)
+}
+
+// socketError explains a failure to listen on nervd's socket
+func socketError(err error) error {
+	return err
+}
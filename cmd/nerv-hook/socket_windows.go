@@ -0,0 +1,16 @@
+package main
+
+import "fmt"
+
+// restrictSocket does nothing on Windows, which ignores a socket file's mode
+// The socket is in NERV_DIR, by default in the user's profile, whose ACL
+// already keeps other users out
+func restrictSocket(path string) error {
+	return nil
+}
+
+// socketError explains a failure to listen on nervd's socket
+// Windows has had Unix sockets since Windows 10 version 1803
+func socketError(err error) error {
+	return fmt.Errorf("%w (nervd needs Unix socket support, added in Windows 10 version 1803; until then each hook handles its own events)", err)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/migrations"
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// statusActiveWindow is how recently a session that hasn't stopped must have
+// had a hook event to count as active, allowing for waits on approvals
+const statusActiveWindow = 15 * time.Minute
+
+// statusDenials is how many recent denials status shows
+const statusDenials = 5
+
+// statusReport is what's going on right now, across every project
+type statusReport struct {
+	Daemon    string           `json:"daemon"`
+	Database  statusDatabase   `json:"database"`
+	Sessions  []statusSession  `json:"sessions"`
+	Approvals statusApprovals  `json:"approvals"`
+	Tasks     []statusTask     `json:"tasks"`
+	Denials   []statusDenial   `json:"denials"`
+	Notifiers []notifierStatus `json:"notifiers"`
+}
+
+type statusDatabase struct {
+	Location string `json:"location"`
+	// Bytes is the database's size, including SQLite's WAL
+	Bytes int64 `json:"bytes"`
+}
+
+type statusSession struct {
+	ID         string    `json:"id"`
+	TaskID     string    `json:"task_id,omitempty"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ToolCalls  int64     `json:"tool_calls"`
+}
+
+type statusApprovals struct {
+	Pending int `json:"pending"`
+	// Oldest is the request that has waited longest, if any are pending
+	Oldest *jsonApproval `json:"oldest,omitempty"`
+}
+
+type statusTask struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Title  string `json:"title"`
+}
+
+type statusDenial struct {
+	At     time.Time `json:"at"`
+	TaskID string    `json:"task_id,omitempty"`
+	Tool   string    `json:"tool"`
+	Reason string    `json:"reason"`
+}
+
+// runStatus implements `nerv-hook status`
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("usage: nerv-hook status [--json]")
+	}
+
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	r, err := gatherStatus(st, time.Now())
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(r)
+	}
+	return printStatus(os.Stdout, r, time.Now())
+}
+
+// gatherStatus reads the report from the database and nervd's socket
+func gatherStatus(st *store.DB, now time.Time) (statusReport, error) {
+	r := statusReport{
+		Daemon:   checkDaemon().detail,
+		Database: statusDatabase{Location: st.Location()},
+		Sessions: []statusSession{},
+		Tasks:    []statusTask{},
+		Denials:  []statusDenial{},
+	}
+	// Settings that don't build are reported by nerv-hook doctor, not here
+	if notifiers, err := notifierStatuses(st, loadConfig()); err == nil {
+		r.Notifiers = notifiers
+	} else {
+		r.Notifiers = []notifierStatus{}
+	}
+
+	if st.Dialect() == migrations.SQLite {
+		stats, err := databaseStats(st)
+		if err != nil {
+			return r, err
+		}
+		r.Database.Bytes = stats.FileBytes + stats.WALBytes
+	} else if err := st.SQL().QueryRow("SELECT pg_database_size(current_database())").Scan(&r.Database.Bytes); err != nil {
+		return r, err
+	}
+
+	sessions, err := st.ActiveSessions(now.Add(-statusActiveWindow))
+	if err != nil {
+		return r, err
+	}
+	for _, sess := range sessions {
+		r.Sessions = append(r.Sessions, statusSession{ID: sess.ID, TaskID: sess.TaskID, LastSeenAt: sess.LastSeenAt, ToolCalls: sess.ToolCalls})
+	}
+
+	pending, err := st.PendingApprovals()
+	if err != nil {
+		return r, err
+	}
+	r.Approvals.Pending = len(pending)
+	if len(pending) > 0 {
+		oldest := approvalJSON(pending[0])
+		r.Approvals.Oldest = &oldest
+	}
+
+	for _, status := range []string{store.TaskInProgress, store.TaskReview} {
+		tasks, err := st.ListTasks(store.TaskFilter{Status: status})
+		if err != nil {
+			return r, err
+		}
+		for _, t := range tasks {
+			r.Tasks = append(r.Tasks, statusTask{ID: t.ID, Status: t.Status, Title: t.Title})
+		}
+	}
+
+	events, err := st.ListAudit(store.AuditFilter{EventType: "tool_denied", Limit: statusDenials})
+	if err != nil {
+		return r, err
+	}
+	for _, e := range events {
+		var d struct {
+			Tool   string `json:"tool"`
+			Reason string `json:"reason"`
+		}
+		json.Unmarshal([]byte(e.Details), &d)
+		r.Denials = append(r.Denials, statusDenial{At: e.Timestamp, TaskID: e.TaskID, Tool: d.Tool, Reason: d.Reason})
+	}
+	return r, nil
+}
+
+// printStatus writes the report for a person, with times relative to now
+func printStatus(out io.Writer, r statusReport, now time.Time) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Daemon:\t%s\n", r.Daemon)
+	fmt.Fprintf(w, "Database:\t%s (%s)\n", r.Database.Location, formatBytes(r.Database.Bytes))
+	fmt.Fprintf(w, "Sessions:\t%d active in the last %s\n", len(r.Sessions), formatDuration(statusActiveWindow))
+	for _, sess := range r.Sessions {
+		fmt.Fprintf(w, "\t  %s\ttask %s, %d tool calls, last seen %s ago\n", sess.ID, orNone(sess.TaskID), sess.ToolCalls, formatDuration(now.Sub(sess.LastSeenAt)))
+	}
+	if a := r.Approvals.Oldest; a != nil {
+		fmt.Fprintf(w, "Approvals:\t%d pending, oldest waiting %s (#%d, %s for task %s)\n", r.Approvals.Pending, formatDuration(now.Sub(a.At)), a.ID, a.Tool, orNone(a.TaskID))
+	} else {
+		fmt.Fprintln(w, "Approvals:\tnone pending")
+	}
+	fmt.Fprintf(w, "Tasks:\t%d in progress or in review\n", len(r.Tasks))
+	for _, t := range r.Tasks {
+		fmt.Fprintf(w, "\t  %s\t%s: %s\n", t.ID, t.Status, t.Title)
+	}
+	if len(r.Denials) == 0 {
+		fmt.Fprintln(w, "Denials:\tnone")
+	} else {
+		fmt.Fprintf(w, "Denials:\tlatest %d\n", len(r.Denials))
+	}
+	for _, d := range r.Denials {
+		fmt.Fprintf(w, "\t  %s\t%s in task %s: %s\n", d.At.Local().Format("2006-01-02 15:04:05"), d.Tool, orNone(d.TaskID), d.Reason)
+	}
+	if len(r.Notifiers) == 0 {
+		fmt.Fprintln(w, "Notifiers:\tnone configured")
+	} else {
+		fmt.Fprintf(w, "Notifiers:\t%d configured\n", len(r.Notifiers))
+	}
+	for _, n := range r.Notifiers {
+		fmt.Fprintf(w, "\t  %s\t%s\n", n.Name, describeNotifier(n, now))
+	}
+	return w.Flush()
+}
+
+// orNone prints an optional ID
+func orNone(id string) string {
+	if id == "" {
+		return "none"
+	}
+	return id
+}
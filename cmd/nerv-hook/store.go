@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/migrations"
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// Store is the state the hook reads and writes
+// *store.DB implements it for both SQLite and PostgreSQL; wrappers such as
+// projectStore route or decorate individual calls
+type Store interface {
+	LogAudit(taskID, eventType, details string) error
+	LogAuditBatch(events []store.AuditEvent) error
+	QueueApproval(a store.Approval, auditDetails func(approvalID int64) string) (int64, error)
+	GetApproval(id int64) (store.Approval, error)
+	DecideApproval(id int64, status, denyReason string) (store.Approval, error)
+	PendingApprovalCount() (int, error)
+	PendingApprovalsFor(sessionID, projectID string) (session, project int, err error)
+	ApprovedSince(taskID, toolName string, since time.Time) ([]store.Approval, error)
+	UseApproval(id int64) (bool, error)
+	SessionEvents(sessionID string, limit int) ([]string, error)
+	SessionHalted(sessionID string) (bool, error)
+	SessionTripped(sessionID string) (bool, error)
+	SessionRewrote(sessionID, rule string) (bool, error)
+	GetTask(id string) (store.Task, error)
+	CreateTask(t store.Task) error
+	SetTaskStatus(id, from, to, source string) (bool, error)
+	SetTaskBranchHead(id, sha string) error
+	LinkRunSession(id int64, sessionID string) error
+	TouchSession(sess store.Session, at time.Time, stopped bool) error
+	CountToolCall(sessionID string) error
+	LogToolCall(sessionID, toolName string, at time.Time) error
+	ToolCallsSince(sessionID string, tools []string, since time.Time) (int, error)
+	LogDenial(sessionID, signature string, at time.Time) error
+	DenialsSince(sessionID string, since time.Time) ([]string, error)
+	ObserveActivity(projectID, kind, key string, at time.Time) (store.Baseline, error)
+	SetSessionUsage(sessionID string, tokens int64, costUSD float64) error
+	GetBudget(scope, scopeID string) (store.Budget, error)
+	BudgetUsage(scope, scopeID string) (store.Usage, error)
+	ListAudit(f store.AuditFilter) ([]store.AuditEvent, error)
+	ListApprovals(taskID string) ([]store.Approval, error)
+	ListSessions(taskID string) ([]store.Session, error)
+	GetSession(id string) (store.Session, error)
+	MarkSessionNotesSeen(sessionID string, noteID int64) error
+	ListTaskNotes(taskID string, afterID int64) ([]store.TaskNote, error)
+	ListTasks(f store.TaskFilter) ([]store.Task, error)
+	ListRepos(projectID string) ([]store.Repo, error)
+	ListTaskWorktrees(taskID string) ([]store.TaskWorktree, error)
+	RequestReview(taskID string) (store.Review, error)
+	SaveReviewBundle(b store.ReviewBundle) (int64, error)
+	SaveVerification(v store.Verification) (int64, error)
+	LatestVerification(taskID string) (store.Verification, error)
+	GetGitHubLink(taskID string) (store.GitHubLink, error)
+	SetGitHubPR(taskID, repo string, prNumber int) error
+	GetSetting(key string) (string, error)
+	Close() error
+}
+
+// openStore opens the state database and brings its schema up to date
+func openStore() (*store.DB, error) {
+	st, err := openRawStore()
+	if err != nil {
+		return nil, err
+	}
+
+	// A migration failure shouldn't stop the hook
+	if _, err := st.Migrate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to migrate database: %v\n", err)
+	}
+
+	return st, nil
+}
+
+// openRawStore opens the state database without running migrations
+// NERV_DB_URL selects a shared PostgreSQL database; otherwise the local SQLite file is used
+func openRawStore() (*store.DB, error) {
+	return openStateDB(false)
+}
+
+// openReadOnlyStore opens the state database for commands that only view state
+// Writes through it fail with store.ErrReadOnly, so observers can't change anything by accident
+func openReadOnlyStore() (*store.DB, error) {
+	return openStateDB(true)
+}
+
+// openStateDB opens the state database, refusing one a newer release has migrated
+func openStateDB(readOnly bool) (*store.DB, error) {
+	st, err := openUncheckedStore(readOnly)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrations.Check(st.SQL(), st.Dialect()); err != nil {
+		st.Close()
+		return nil, fmt.Errorf("%s: %w", st.Location(), err)
+	}
+	return st, nil
+}
+
+// openUncheckedStore opens the state database whatever its schema version,
+// for commands that report the version
+func openUncheckedStore(readOnly bool) (*store.DB, error) {
+	if dbURL := os.Getenv("NERV_DB_URL"); dbURL != "" {
+		st, err := store.OpenPostgres(dbURL, readOnly, dbOptions())
+		if err != nil {
+			return nil, fmt.Errorf("NERV_DB_URL: %w", err)
+		}
+		return st, nil
+	}
+
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("database not found: %s (run nerv-hook init)", dbPath)
+	}
+	mode := "rw"
+	if readOnly {
+		mode = "ro"
+	}
+	return store.OpenSQLite(dbPath, mode, dbOptions())
+}
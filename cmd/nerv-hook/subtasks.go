@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// maxTaskDepth bounds how far taskAncestors follows parent links
+const maxTaskDepth = 16
+
+// taskAncestors returns the tasks a task is a subtask of, its parent first
+func taskAncestors(db Store, task store.Task) []store.Task {
+	var ancestors []store.Task
+	for id := task.ParentID; id != "" && len(ancestors) < maxTaskDepth; {
+		parent, err := db.GetTask(id)
+		if err != nil {
+			if !errors.Is(err, store.ErrNotFound) {
+				fmt.Fprintf(os.Stderr, "Failed to load parent task %s: %v\n", id, err)
+			}
+			break
+		}
+		ancestors = append(ancestors, parent)
+		id = parent.ParentID
+	}
+	return ancestors
+}
+
+// subtaskProgress counts a task's done subtasks against all of them
+// Abandoned subtasks count toward neither, since they no longer need doing
+func subtaskProgress(children []store.Task) (done, total int) {
+	for _, c := range children {
+		switch c.Status {
+		case store.TaskAbandoned:
+			continue
+		case store.TaskDone:
+			done++
+		}
+		total++
+	}
+	return done, total
+}
+
+// describeProgress summarizes subtask progress, e.g. "2 of 5 done", or "" without subtasks
+func describeProgress(children []store.Task) string {
+	done, total := subtaskProgress(children)
+	if len(children) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d of %d done", done, total)
+}
+
+// createSubtask adds a subtask to parent, in parent's project, and logs task_created
+func createSubtask(db Store, parent store.Task, title, description, source string) (store.Task, error) {
+	if strings.TrimSpace(title) == "" {
+		return store.Task{}, errors.New("a subtask needs a title")
+	}
+	task := store.Task{ID: store.NewID(), ProjectID: parent.ProjectID, ParentID: parent.ID, Title: strings.TrimSpace(title), Description: description, Status: store.TaskTodo}
+	if err := db.CreateTask(task); err != nil {
+		return task, err
+	}
+	details, _ := json.Marshal(map[string]string{"projectId": task.ProjectID, "title": task.Title, "parentId": parent.ID, "source": source})
+	if err := db.LogAudit(task.ID, "task_created", string(details)); err != nil {
+		return task, err
+	}
+	return task, nil
+}
+
+// runTaskSubtasks implements `nerv-hook task subtasks`, listing a task's subtasks and its progress
+func runTaskSubtasks(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: nerv-hook task subtasks <task-id>")
+	}
+
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	task, err := loadTask(st, args[0])
+	if err != nil {
+		return err
+	}
+	children, err := st.ListTasks(store.TaskFilter{ParentID: task.ID})
+	if err != nil {
+		return err
+	}
+	if len(children) == 0 {
+		fmt.Printf("Task %s has no subtasks; add one with nerv-hook task create --parent %s <title>\n", task.ID, task.ID)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tSUBTASKS\tTITLE")
+	for _, c := range children {
+		grandchildren, err := st.ListTasks(store.TaskFilter{ParentID: c.ID})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.ID, c.Status, describeProgress(grandchildren), c.Title)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("\n%s: %s\n", task.Title, describeProgress(children))
+	return nil
+}
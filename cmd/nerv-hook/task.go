@@ -0,0 +1,681 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// taskMoves maps each lifecycle command to the status it moves a task to
+// Which moves are allowed from which status is up to the store's state machine
+var taskMoves = map[string]string{
+	"start":    store.TaskInProgress,
+	"review":   store.TaskReview,
+	"complete": store.TaskDone,
+	"reopen":   store.TaskTodo,
+	"block":    store.TaskBlocked,
+	"abandon":  store.TaskAbandoned,
+}
+
+const taskUsage = "usage: nerv-hook task create|list|show|history|report|start|review|verify|note|label|priority|filter|repos|subtasks|export|archive|complete|reopen|block|abandon"
+
+// runTask implements `nerv-hook task`
+func runTask(args []string) error {
+	if len(args) < 1 {
+		return errors.New(taskUsage)
+	}
+
+	switch args[0] {
+	case "create":
+		return runTaskCreate(args[1:])
+	case "list":
+		return runTaskList(args[1:])
+	case "show":
+		return runTaskShow(args[1:])
+	case "history":
+		return runTaskHistory(args[1:])
+	case "report":
+		return runTaskReport(args[1:])
+	case "review":
+		return runTaskReview(args[1:])
+	case "verify":
+		return runTaskVerify(args[1:])
+	case "note":
+		return runTaskNote(args[1:])
+	case "label":
+		return runTaskLabel(args[1:])
+	case "priority":
+		return runTaskPriority(args[1:])
+	case "filter":
+		return runTaskFilter(args[1:])
+	case "repos":
+		return runTaskRepos(args[1:])
+	case "subtasks":
+		return runTaskSubtasks(args[1:])
+	case "export":
+		return runTaskExport(args[1:])
+	case "archive":
+		return runTaskArchive(args[1:])
+	}
+
+	if args[0] == "start" {
+		return runTaskStart(args[1:])
+	}
+	to, ok := taskMoves[args[0]]
+	if !ok {
+		return errors.New(taskUsage)
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("usage: nerv-hook task %s <task-id>", args[0])
+	}
+
+	st, err := openOperatorStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	task, err := loadTask(st, args[1])
+	if err != nil {
+		return err
+	}
+	if err := moveTask(st, task, to); err != nil {
+		return err
+	}
+
+	if to == store.TaskDone || to == store.TaskAbandoned {
+		if err := releaseWorktree(st, task); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Task %s is %s\n", task.ID, to)
+	return nil
+}
+
+// releaseWorktree removes a finished task's worktrees, if it has any
+// The branch stays for review; only the checkouts go
+func releaseWorktree(st *store.DB, task store.Task) error {
+	worktrees, err := st.ListTaskWorktrees(task.ID)
+	if err != nil {
+		return err
+	}
+	for _, w := range worktrees {
+		if err := removeTaskWorktree(w.Path); err != nil {
+			fmt.Fprintf(os.Stderr, "Kept worktree %s: %v\n", w.Path, err)
+			continue
+		}
+		if err := st.DeleteTaskWorktree(task.ID, w.RepoID); err != nil {
+			return err
+		}
+		if w.Path != task.WorktreePath {
+			fmt.Fprintf(os.Stderr, "Removed worktree %s\n", w.Path)
+		}
+	}
+
+	if task.WorktreePath == "" {
+		return nil
+	}
+	if err := removeTaskWorktree(task.WorktreePath); err != nil {
+		fmt.Fprintf(os.Stderr, "Kept worktree %s: %v\n", task.WorktreePath, err)
+		return nil
+	}
+	if err := st.SetTaskWorktree(task.ID, ""); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Removed worktree %s\n", task.WorktreePath)
+	return nil
+}
+
+// runTaskStart moves a task to in_progress and puts its branch, or a worktree on it, in place
+func runTaskStart(args []string) error {
+	fs := flag.NewFlagSet("task start", flag.ContinueOnError)
+	worktree := fs.Bool("worktree", false, "run the task in its own git worktree, created from the current repository")
+	noBranch := fs.Bool("no-branch", false, "stay on the current branch instead of switching to the task's branch")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: nerv-hook task start [--worktree | --no-branch] <task-id>")
+	}
+	if *worktree && *noBranch {
+		return errors.New("--worktree always checks out the task's branch, so it can't be combined with --no-branch")
+	}
+
+	st, err := openOperatorStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	task, err := loadTask(st, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *worktree && task.WorktreePath != "" {
+		return fmt.Errorf("task %s already has a worktree at %s", task.ID, task.WorktreePath)
+	}
+	if task.Status == store.TaskInProgress {
+		return fmt.Errorf("task %s is already %s", task.ID, store.TaskInProgress)
+	}
+	if !store.CanTransition(task.Status, store.TaskInProgress) {
+		return fmt.Errorf("task %s: %w", task.ID, &store.TransitionError{From: task.Status, To: store.TaskInProgress})
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if task, err = startTask(st, task, cwd, *worktree, *noBranch); err != nil {
+		return err
+	}
+
+	// A child process can't change its parent's environment, so print the
+	// exports for eval "$(nerv-hook task start ID)"
+	fmt.Fprintf(os.Stderr, "Task %s is in progress\n", task.ID)
+	fmt.Printf("export NERV_TASK_ID=%s\n", task.ID)
+	if task.WorktreePath != "" {
+		fmt.Printf("cd %q\n", task.WorktreePath)
+	}
+	return nil
+}
+
+// startTask puts the task's branch in place in the repository at dir, or a
+// worktree on it beside that repository, and moves the task to in_progress
+// Returns the task as updated
+func startTask(st *store.DB, task store.Task, dir string, worktree, noBranch bool) (store.Task, error) {
+	var err error
+	branch := task.Branch
+	if branch == "" && !noBranch {
+		if branch, err = taskBranchName(loadConfig().Tasks.branchTemplate(), task); err != nil {
+			return task, err
+		}
+	}
+
+	repos, err := taskRepos(st, task)
+	if err != nil {
+		return task, err
+	}
+
+	var worktreePath string
+	var worktrees []store.TaskWorktree
+	switch {
+	case worktree:
+		if worktreePath, worktrees, err = createTaskWorktrees(st, task, repos, dir, branch); err != nil {
+			return task, err
+		}
+	case noBranch || task.WorktreePath != "":
+		// Leave the checkout alone; an existing worktree is already on the task's branch
+	case len(repos) > 0:
+		for _, repo := range repos {
+			if err := switchToBranch(repo.Path, branch); err != nil {
+				return task, fmt.Errorf("repo %s: %w", repo.Name, err)
+			}
+			fmt.Fprintf(os.Stderr, "Switched %s to branch %s\n", repo.Path, branch)
+		}
+	case !inGitRepo(dir):
+		fmt.Fprintln(os.Stderr, "Not in a git repository, so no branch was created")
+		branch = task.Branch
+	default:
+		if err := switchToBranch(dir, branch); err != nil {
+			return task, err
+		}
+		fmt.Fprintf(os.Stderr, "Switched to branch %s\n", branch)
+	}
+
+	if err := moveTask(st, task, store.TaskInProgress); err != nil {
+		if worktreePath != "" {
+			removeTaskWorktree(worktreePath)
+		}
+		for _, w := range worktrees {
+			if w.Path != worktreePath {
+				removeTaskWorktree(w.Path)
+			}
+		}
+		return task, err
+	}
+	task.Status = store.TaskInProgress
+	if worktreePath != "" {
+		if err := st.SetTaskWorktree(task.ID, worktreePath); err != nil {
+			return task, err
+		}
+	}
+	for _, w := range worktrees {
+		if err := st.AddTaskWorktree(w); err != nil {
+			return task, err
+		}
+	}
+	if branch != "" && branch != task.Branch {
+		if err := st.SetTaskBranch(task.ID, branch); err != nil {
+			return task, err
+		}
+	}
+
+	if worktreePath != "" {
+		task.WorktreePath = worktreePath
+	}
+	task.Branch = branch
+	return task, nil
+}
+
+// loadTask looks up a task for a CLI command, with a readable error if it doesn't exist
+func loadTask(st *store.DB, taskID string) (store.Task, error) {
+	task, err := st.GetTask(taskID)
+	if errors.Is(err, store.ErrNotFound) {
+		return task, fmt.Errorf("task not found: %s", taskID)
+	}
+	return task, err
+}
+
+// moveTask applies a lifecycle change to a loaded task and records it in the audit log
+func moveTask(st *store.DB, task store.Task, to string) error {
+	if task.Status == to {
+		return fmt.Errorf("task %s is already %s", task.ID, to)
+	}
+
+	moved, err := st.SetTaskStatus(task.ID, task.Status, to, "cli")
+	if err != nil {
+		return fmt.Errorf("task %s: %w", task.ID, err)
+	}
+	if !moved {
+		return fmt.Errorf("task %s changed while it was being updated; try again", task.ID)
+	}
+
+	details, _ := json.Marshal(map[string]string{"status": to, "source": "cli"})
+	return st.LogAudit(task.ID, "task_status_changed", string(details))
+}
+
+// runTaskHistory prints a task's recorded status changes
+func runTaskHistory(args []string) error {
+	fs := flag.NewFlagSet("task history", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the changes as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: nerv-hook task history [--json] <task-id>")
+	}
+
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	task, err := loadTask(st, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	history, err := st.TaskHistory(task.ID)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		out := make([]archivedChange, 0, len(history))
+		for _, tr := range history {
+			out = append(out, archivedChange{At: tr.CreatedAt, From: tr.From, To: tr.To, Source: tr.Source, Operator: tr.Operator})
+		}
+		return printJSON(out)
+	}
+
+	fmt.Printf("%s: %s (%s)\n", task.ID, task.Title, task.Status)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, tr := range history {
+		by := tr.Source
+		if tr.Operator != "" {
+			by += " by " + tr.Operator
+		}
+		fmt.Fprintf(w, "  %s\t%s → %s\t%s\n", tr.CreatedAt.Local().Format("2006-01-02 15:04:05"), tr.From, tr.To, by)
+	}
+	return w.Flush()
+}
+
+// runTaskShow prints a task's details and the time its sessions spent on it
+func runTaskShow(args []string) error {
+	fs := flag.NewFlagSet("task show", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the task as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: nerv-hook task show [--json] <task-id>")
+	}
+
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	task, err := loadTask(st, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	sessions, err := st.ListSessions(task.ID)
+	if err != nil {
+		return err
+	}
+	worktrees, err := st.ListTaskWorktrees(task.ID)
+	if err != nil {
+		return err
+	}
+	children, err := st.ListTasks(store.TaskFilter{ParentID: task.ID})
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(taskDetailJSON(task, sessions, worktrees, children))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", task.ID)
+	fmt.Fprintf(w, "Title:\t%s\n", task.Title)
+	fmt.Fprintf(w, "Status:\t%s\n", task.Status)
+	fmt.Fprintf(w, "Project:\t%s\n", task.ProjectID)
+	if task.ParentID != "" {
+		fmt.Fprintf(w, "Parent:\t%s\n", task.ParentID)
+	}
+	if len(children) > 0 {
+		fmt.Fprintf(w, "Subtasks:\t%s\n", describeProgress(children))
+	}
+	if task.Priority != "" {
+		fmt.Fprintf(w, "Priority:\t%s\n", task.Priority)
+	}
+	if len(task.Labels) > 0 {
+		fmt.Fprintf(w, "Labels:\t%s\n", strings.Join(task.Labels, " "))
+	}
+	if task.Description != "" {
+		fmt.Fprintf(w, "Description:\t%s\n", task.Description)
+	}
+	if task.Branch != "" {
+		branch := task.Branch
+		if task.BranchHead != "" {
+			branch += fmt.Sprintf(" (at %.12s)", task.BranchHead)
+		}
+		fmt.Fprintf(w, "Branch:\t%s\n", branch)
+	}
+	if task.Repos != "" {
+		fmt.Fprintf(w, "Repos:\t%s\n", strings.Join(splitRepoNames(task.Repos), " "))
+	}
+	if task.WorktreePath != "" {
+		fmt.Fprintf(w, "Worktree:\t%s\n", task.WorktreePath)
+	}
+	for _, wt := range worktrees {
+		if wt.Path != task.WorktreePath {
+			fmt.Fprintf(w, "Worktree:\t%s\n", wt.Path)
+		}
+	}
+	wall, active := sessionTotals(sessions)
+	fmt.Fprintf(w, "Sessions:\t%d\n", len(sessions))
+	fmt.Fprintf(w, "Wall clock:\t%s\n", formatDuration(wall))
+	fmt.Fprintf(w, "Active:\t%s\n", formatDuration(active))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SESSION\tSTARTED\tWALL CLOCK\tACTIVE\tSTATE")
+	for _, sess := range sessions {
+		state := "working"
+		if !sess.EndedAt.IsZero() {
+			state = "stopped"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", sess.ID, sess.StartedAt.Local().Format("2006-01-02 15:04"),
+			formatDuration(sess.WallClock()), formatDuration(sess.Active), state)
+	}
+	return w.Flush()
+}
+
+// runTaskReport totals the time agents spent on each task
+func runTaskReport(args []string) error {
+	fs := flag.NewFlagSet("task report", flag.ContinueOnError)
+	projectID := fs.String("project", "", "only tasks in this project")
+	since := fs.String("since", "", "only sessions started on or after this date (YYYY-MM-DD, local time)")
+	asJSON := fs.Bool("json", false, "print the report as JSON, without the total")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var from time.Time
+	if *since != "" {
+		var err error
+		if from, err = time.ParseInLocation("2006-01-02", *since, time.Local); err != nil {
+			return fmt.Errorf("--since: %q is not a YYYY-MM-DD date", *since)
+		}
+	}
+
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	tasks, err := st.ListTasks(store.TaskFilter{ProjectID: *projectID})
+	if err != nil {
+		return err
+	}
+	sessions, err := st.ListSessions("")
+	if err != nil {
+		return err
+	}
+	byTask := map[string][]store.Session{}
+	for _, sess := range sessions {
+		if !sess.StartedAt.Before(from) {
+			byTask[sess.TaskID] = append(byTask[sess.TaskID], sess)
+		}
+	}
+	if *asJSON {
+		out := []jsonTaskTime{}
+		for _, t := range tasks {
+			if taskSessions := byTask[t.ID]; len(taskSessions) > 0 {
+				wall, active := sessionTotals(taskSessions)
+				out = append(out, jsonTaskTime{TaskID: t.ID, Status: t.Status, Title: t.Title, Sessions: len(taskSessions),
+					WallClockSeconds: int64(wall.Seconds()), ActiveSeconds: int64(active.Seconds())})
+			}
+		}
+		return printJSON(out)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK\tSTATUS\tSESSIONS\tWALL CLOCK\tACTIVE\tTITLE")
+	var count int
+	var totalWall, totalActive time.Duration
+	for _, t := range tasks {
+		taskSessions := byTask[t.ID]
+		if len(taskSessions) == 0 {
+			continue
+		}
+		wall, active := sessionTotals(taskSessions)
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", t.ID, t.Status, len(taskSessions), formatDuration(wall), formatDuration(active), t.Title)
+		count += len(taskSessions)
+		totalWall += wall
+		totalActive += active
+	}
+	fmt.Fprintf(w, "TOTAL\t\t%d\t%s\t%s\t\n", count, formatDuration(totalWall), formatDuration(totalActive))
+	return w.Flush()
+}
+
+// sessionTotals sums the wall-clock and active time of sessions
+func sessionTotals(sessions []store.Session) (wall, active time.Duration) {
+	for _, sess := range sessions {
+		wall += sess.WallClock()
+		active += sess.Active
+	}
+	return wall, active
+}
+
+// formatDuration prints a duration to the second, e.g. 1h2m3s
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
+
+// runTaskCreate implements `nerv-hook task create`
+func runTaskCreate(args []string) error {
+	fs := flag.NewFlagSet("task create", flag.ContinueOnError)
+	projectID := fs.String("project", "", "project the task belongs to (default $NERV_PROJECT_ID, the project registered for the working directory, or the default project)")
+	description := fs.String("description", "", "what the task should accomplish")
+	priorityFlag := fs.String("priority", "", "low, medium, high, or urgent")
+	labelFlag := fs.String("label", "", "comma-separated labels, e.g. infra,backend")
+	reposFlag := fs.String("repos", "", "comma-separated names of the project's repos the task spans, e.g. api,web")
+	parentID := fs.String("parent", "", "make the task a subtask of this one, in its project")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	title := strings.TrimSpace(strings.Join(fs.Args(), " "))
+	if title == "" {
+		return errors.New("usage: nerv-hook task create [--project ID] [--description TEXT] [--priority P] [--label L,...] [--repos NAME,...] [--parent ID] <title>")
+	}
+	var priority string
+	var labels []string
+	var err error
+	if *priorityFlag != "" {
+		if priority, err = parsePriority(*priorityFlag); err != nil {
+			return fmt.Errorf("--priority: %w", err)
+		}
+	}
+	if *labelFlag != "" {
+		if labels, err = parseLabels(*labelFlag); err != nil {
+			return fmt.Errorf("--label: %w", err)
+		}
+	}
+
+	st, err := openOperatorStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	var parent store.Task
+	if *parentID != "" {
+		if parent, err = loadTask(st, *parentID); err != nil {
+			return err
+		}
+		if *projectID != "" && *projectID != parent.ProjectID {
+			return fmt.Errorf("--parent: task %s is in project %s, not %s", parent.ID, parent.ProjectID, *projectID)
+		}
+		*projectID = parent.ProjectID
+	}
+	if *projectID == "" {
+		*projectID = resolveProjectID(st)
+	}
+	if *projectID == "" {
+		return errors.New("no project: pass --project, run from a directory added with nerv-hook project add, or set a default with nerv-hook project set-default")
+	}
+
+	if _, err := st.GetProject(*projectID); errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("project not found: %s", *projectID)
+	} else if err != nil {
+		return err
+	}
+
+	task := store.Task{ID: store.NewID(), ProjectID: *projectID, ParentID: parent.ID, Title: title, Description: *description, Priority: priority, Labels: labels}
+	if *reposFlag != "" {
+		task.Repos = strings.Join(splitRepoNames(*reposFlag), ",")
+		if _, err := taskRepos(st, task); err != nil {
+			return fmt.Errorf("--repos: %w", err)
+		}
+	}
+	if err := st.CreateTask(task); err != nil {
+		return err
+	}
+	created := map[string]interface{}{"projectId": task.ProjectID, "title": task.Title}
+	if task.Priority != "" {
+		created["priority"] = task.Priority
+	}
+	if len(task.Labels) > 0 {
+		created["labels"] = task.Labels
+	}
+	if task.Repos != "" {
+		created["repos"] = task.Repos
+	}
+	if task.ParentID != "" {
+		created["parentId"] = task.ParentID
+	}
+	details, _ := json.Marshal(created)
+	if err := st.LogAudit(task.ID, "task_created", string(details)); err != nil {
+		return err
+	}
+
+	fmt.Println(task.ID)
+	return nil
+}
+
+// runTaskList implements `nerv-hook task list`
+func runTaskList(args []string) error {
+	fs := flag.NewFlagSet("task list", flag.ContinueOnError)
+	filterFlags := addTaskFilterFlags(fs)
+	status := fs.String("status", "", "only tasks with this status: todo, in_progress, interrupted, blocked, review, done, or abandoned")
+	save := fs.String("save", "", "save the filter under this name for --filter")
+	byPriority := fs.Bool("by-priority", false, "list the most urgent tasks first")
+	asJSON := fs.Bool("json", false, "print the tasks as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("usage: nerv-hook task list [--project ID] [--status S] [--label L,...] [--priority P] [--filter NAME] [--save NAME] [--by-priority] [--json]")
+	}
+
+	// Saving a filter writes; plain listing doesn't need to
+	open := openReadOnlyStore
+	if *save != "" {
+		open = openStore
+	}
+	st, err := open()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	filter, err := filterFlags.resolve(st)
+	if err != nil {
+		return err
+	}
+	if *status != "" {
+		filter.Status = *status
+	}
+	if *save != "" {
+		if err := st.SaveTaskFilter(*save, filter); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Saved filter %s: %s\n", *save, describeFilter(filter))
+	}
+
+	tasks, err := st.ListTasks(filter)
+	if err != nil {
+		return err
+	}
+	if *byPriority {
+		sort.SliceStable(tasks, func(i, j int) bool {
+			return store.PriorityRank(tasks[i].Priority) > store.PriorityRank(tasks[j].Priority)
+		})
+	}
+	if *asJSON {
+		out := make([]jsonTask, 0, len(tasks))
+		for _, t := range tasks {
+			out = append(out, taskJSON(t))
+		}
+		return printJSON(out)
+	}
+	if len(tasks) == 0 {
+		fmt.Println("No tasks")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tPRIORITY\tPROJECT\tLABELS\tTITLE")
+	for _, t := range tasks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.Status, t.Priority, t.ProjectID, strings.Join(t.Labels, ","), t.Title)
+	}
+	return w.Flush()
+}
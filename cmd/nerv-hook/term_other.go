@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func rawTerminal(in, out *os.File) (func(), error) {
+	return nil, fmt.Errorf("interactive terminals aren't supported on %s", runtime.GOOS)
+}
+
+func terminalSize(out *os.File) (width, height int, err error) {
+	return 0, 0, fmt.Errorf("interactive terminals aren't supported on %s", runtime.GOOS)
+}
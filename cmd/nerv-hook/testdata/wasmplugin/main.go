@@ -0,0 +1,47 @@
+// wasmplugin is the WASM policy plugin TestWasmPlugins builds with GOOS=wasip1 GOARCH=wasm
+// It denies writes of GPL code, scores Bash commands by length, and denies
+// everything if it can see a filesystem or environment it shouldn't
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	var request struct {
+		Protocol  string                 `json:"protocol"`
+		ToolName  string                 `json:"tool_name"`
+		ToolInput map[string]interface{} `json:"tool_input"`
+	}
+	if err := json.NewDecoder(os.Stdin).Decode(&request); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	answer := func(v map[string]interface{}) {
+		json.NewEncoder(os.Stdout).Encode(v)
+	}
+	if _, err := os.ReadDir("/"); err == nil || os.Getenv("NERV_TEST_SECRET") != "" || request.Protocol != os.Getenv("NERV_PLUGIN_PROTOCOL") {
+		answer(map[string]interface{}{"decision": "deny", "reason": "escaped the sandbox"})
+		return
+	}
+	switch request.ToolName {
+	case "Write":
+		content, _ := request.ToolInput["content"].(string)
+		if strings.Contains(content, "GPL") {
+			answer(map[string]interface{}{"decision": "deny", "reason": "GPL code"})
+			return
+		}
+	case "Bash":
+		command, _ := request.ToolInput["command"].(string)
+		if command == "loop" {
+			for {
+			}
+		}
+		answer(map[string]interface{}{"score": min(float64(len(command))/40, 1), "reason": "long command"})
+		return
+	}
+	answer(map[string]interface{}{"decision": "allow"})
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// API tokens let bots and scripts use nerv-hook serve without signing in:
+// each acts as an operator, but only for the scopes it was issued with, so a
+// script that approves deploys needn't be able to read the audit log
+
+const tokenUsage = "usage: nerv-hook token create --scope SCOPE [--scope SCOPE] [--expires 30d] [--name NAME] [--for OPERATOR] | token list [--all] [--json] | token revoke <id>"
+
+// Token scopes
+const (
+	scopeApprovalsRead = "approvals:read"
+	// scopeApprovalsWrite decides approvals, and includes approvals:read
+	scopeApprovalsWrite = "approvals:write"
+	scopeAuditRead      = "audit:read"
+)
+
+// tokenScopes lists the scopes with the least role an operator needs for a token to have each
+var tokenScopes = []struct{ scope, role string }{
+	{scopeApprovalsRead, store.RoleViewer},
+	{scopeApprovalsWrite, store.RoleApprover},
+	{scopeAuditRead, store.RoleViewer},
+}
+
+const (
+	maxTokenTTL = 365 * 24 * time.Hour
+	// tokenPrefix starts every token, so one pasted somewhere it shouldn't be is easy to spot
+	tokenPrefix = "nerv_"
+)
+
+// scopeRole returns the least role a scope needs, or "" for an unknown scope
+func scopeRole(scope string) string {
+	for _, s := range tokenScopes {
+		if s.scope == scope {
+			return s.role
+		}
+	}
+	return ""
+}
+
+// hasScope reports whether scopes grant want
+func hasScope(scopes []string, want string) bool {
+	return slices.Contains(scopes, want) || want == scopeApprovalsRead && slices.Contains(scopes, scopeApprovalsWrite)
+}
+
+// newToken returns a token and its public ID
+func newToken() (token, id string) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	id = hex.EncodeToString(b)
+	return tokenPrefix + id + "_" + randomToken(32), id
+}
+
+// runToken implements `nerv-hook token`
+func runToken(args []string) error {
+	if len(args) < 1 {
+		return errors.New(tokenUsage)
+	}
+
+	switch args[0] {
+	case "create":
+		return runTokenCreate(args[1:])
+	case "list":
+		return runTokenList(args[1:])
+	case "revoke":
+		return runTokenRevoke(args[1:])
+	default:
+		return errors.New(tokenUsage)
+	}
+}
+
+// tokenOperator returns the operator running a token command; tokens only exist in team mode
+// The operator is the OS account running the command (see operatorName), so
+// no one can issue a token as someone else
+func tokenOperator(st *store.DB) (store.User, error) {
+	u, ok, err := currentOperator(st)
+	if err != nil {
+		return u, err
+	}
+	if !ok {
+		return u, errors.New("API tokens act as an operator; register operators with nerv-hook user add first")
+	}
+	return u, nil
+}
+
+// runTokenCreate issues a token, printing it once; only its hash is kept
+func runTokenCreate(args []string) error {
+	fs := flag.NewFlagSet("token create", flag.ContinueOnError)
+	var scopes []string
+	fs.Func("scope", "grant `SCOPE`: approvals:read, approvals:write, or audit:read (repeatable, or comma-separated)", func(s string) error {
+		for _, scope := range strings.Split(s, ",") {
+			scope = strings.TrimSpace(scope)
+			if scopeRole(scope) == "" {
+				return fmt.Errorf("unknown scope %q (want approvals:read, approvals:write, or audit:read)", scope)
+			}
+			if !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+		return nil
+	})
+	expires := fs.String("expires", "30d", "expire after `AGE`, e.g. 12h or 90d (at most 365d)")
+	name := fs.String("name", "", "what the token is for, e.g. deploy-bot")
+	operator := fs.String("for", "", "act as `OPERATOR` instead of yourself (admins only)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || len(scopes) == 0 {
+		return errors.New(tokenUsage)
+	}
+	ttl, err := parseAge(*expires)
+	if err != nil || ttl == 0 || ttl > maxTokenTTL {
+		return fmt.Errorf("--expires %q must be a positive age of at most 365d", *expires)
+	}
+
+	st, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	me, err := tokenOperator(st)
+	if err != nil {
+		return err
+	}
+	token, t, err := issueToken(st, me, *operator, *name, scopes, ttl)
+	if err != nil {
+		return err
+	}
+
+	// The token goes to stdout alone, so TOKEN=$(nerv-hook token create ...) works
+	fmt.Fprintf(os.Stderr, "Created token %s for %s with %s, expiring %s\nIt won't be shown again:\n", t.ID, t.Operator, strings.Join(scopes, ", "), t.ExpiresAt.Local().Format("2006-01-02 15:04"))
+	fmt.Println(token)
+	return nil
+}
+
+// issueToken issues a token with scopes, acting as operator or else as me,
+// and returns it; it checks me may issue it, and that both me's role and the
+// operator's cover the scopes, so no token can do more than whoever issued it
+func issueToken(st *store.DB, me store.User, operator, name string, scopes []string, ttl time.Duration) (string, store.Token, error) {
+	u := me
+	if operator != "" && operator != me.Name {
+		if !store.RoleAtLeast(me.Role, store.RoleAdmin) {
+			return "", store.Token{}, fmt.Errorf("%s is a%s %s and can't issue tokens for other operators", me.Name, article(me.Role), me.Role)
+		}
+		var err error
+		u, err = st.GetUser(operator)
+		if errors.Is(err, store.ErrNotFound) {
+			return "", store.Token{}, fmt.Errorf("no operator named %s", operator)
+		} else if err != nil {
+			return "", store.Token{}, err
+		}
+		if u.Disabled() {
+			return "", store.Token{}, fmt.Errorf("operator %s is disabled", u.Name)
+		}
+	}
+	for _, scope := range scopes {
+		role := scopeRole(scope)
+		for _, who := range []store.User{me, u} {
+			if !store.RoleAtLeast(who.Role, role) {
+				return "", store.Token{}, fmt.Errorf("%s is a%s %s, and a token with %s needs a%s %s", who.Name, article(who.Role), who.Role, scope, article(role), role)
+			}
+		}
+	}
+	st.SetOperator(me.Name)
+
+	token, id := newToken()
+	t := store.Token{ID: id, Hash: secretHash(token), Name: name, Operator: u.Name, Scopes: scopes, CreatedBy: me.Name, ExpiresAt: time.Now().Add(ttl)}
+	if err := st.CreateToken(t); err != nil {
+		return "", t, err
+	}
+	details, _ := json.Marshal(map[string]interface{}{"token": id, "name": t.Name, "user": t.Operator, "scopes": scopes, "expires_at": t.ExpiresAt.UTC()})
+	return token, t, st.LogAudit("", "token_created", string(details))
+}
+
+// jsonToken is an API token, without the token itself
+type jsonToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name,omitempty"`
+	Operator   string     `json:"operator"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// runTokenList lists tokens: an admin's lists everyone's, anyone else's their own
+func runTokenList(args []string) error {
+	fs := flag.NewFlagSet("token list", flag.ContinueOnError)
+	all := fs.Bool("all", false, "include revoked and expired tokens")
+	asJSON := fs.Bool("json", false, "print the tokens as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	me, err := tokenOperator(st)
+	if err != nil {
+		return err
+	}
+	operator := me.Name
+	if store.RoleAtLeast(me.Role, store.RoleAdmin) {
+		operator = ""
+	}
+
+	tokens, err := st.ListTokens(operator)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if !*all {
+		tokens = slices.DeleteFunc(tokens, func(t store.Token) bool { return !t.Usable(now) })
+	}
+	if *asJSON {
+		out := make([]jsonToken, 0, len(tokens))
+		for _, t := range tokens {
+			out = append(out, jsonToken{ID: t.ID, Name: t.Name, Operator: t.Operator, Scopes: t.Scopes, CreatedBy: t.CreatedBy, CreatedAt: t.CreatedAt, ExpiresAt: t.ExpiresAt, LastUsedAt: optionalTime(t.LastUsedAt), RevokedAt: optionalTime(t.RevokedAt)})
+		}
+		return printJSON(out)
+	}
+	if len(tokens) == 0 {
+		fmt.Println("No API tokens")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tOPERATOR\tSCOPES\tEXPIRES\tLAST USED")
+	format := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Local().Format("2006-01-02 15:04")
+	}
+	for _, t := range tokens {
+		expires := format(t.ExpiresAt)
+		if !t.RevokedAt.IsZero() {
+			expires = "revoked"
+		}
+		name := t.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, name, t.Operator, strings.Join(t.Scopes, ","), expires, format(t.LastUsedAt))
+	}
+	return w.Flush()
+}
+
+// runTokenRevoke revokes a token; its operator, whoever issued it, and admins may
+func runTokenRevoke(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: nerv-hook token revoke <id>")
+	}
+	id := args[0]
+
+	st, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	me, err := tokenOperator(st)
+	if err != nil {
+		return err
+	}
+	t, err := st.GetToken(id)
+	if errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("no token %s", id)
+	} else if err != nil {
+		return err
+	}
+	if me.Name != t.Operator && me.Name != t.CreatedBy && !store.RoleAtLeast(me.Role, store.RoleAdmin) {
+		return fmt.Errorf("%s is a%s %s and can't revoke %s's tokens", me.Name, article(me.Role), me.Role, t.Operator)
+	}
+	st.SetOperator(me.Name)
+
+	if err := st.RevokeToken(id, time.Now()); errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("token %s was already revoked", id)
+	} else if err != nil {
+		return err
+	}
+	details, _ := json.Marshal(map[string]string{"token": id, "user": t.Operator})
+	if err := st.LogAudit("", "token_revoked", string(details)); err != nil {
+		return err
+	}
+	fmt.Printf("Revoked token %s\n", id)
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// Tracing writes how this process reaches its decisions, for rules that don't
+// behave as expected. -v or NERV_DEBUG=1 traces the config layers loaded, each
+// tool call's signature and its decision; -vv or NERV_DEBUG=2 adds every rule
+// tried and whether it matched. Traces go to stderr, or are appended to the
+// file NERV_DEBUG_LOG names, since agents rarely show a hook's stderr
+
+// traceLevel is 0 for no tracing, 1 for decisions, 2 for every rule
+var traceLevel int
+
+// traceOut is where traces go; tracef serializes writes, since nervd handles events at once
+var (
+	traceMu  sync.Mutex
+	traceOut io.Writer = os.Stderr
+)
+
+// startTrace sets the trace level from -v/-vv and NERV_DEBUG, whichever is higher
+func startTrace(verbose, veryVerbose bool) {
+	level := 0
+	if v := os.Getenv("NERV_DEBUG"); v != "" && v != "0" {
+		level = 1
+		if n, err := strconv.Atoi(v); err == nil && n > 1 {
+			level = 2
+		}
+	}
+	if verbose {
+		level = max(level, 1)
+	}
+	if veryVerbose {
+		level = 2
+	}
+	traceLevel = level
+	if level == 0 {
+		return
+	}
+	if path := os.Getenv("NERV_DEBUG_LOG"); path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "NERV_DEBUG_LOG: %v\n", err)
+			return
+		}
+		// Left open for the life of the process
+		traceOut = f
+	}
+}
+
+// tracef writes one trace line when tracing is at least level
+func tracef(level int, format string, args ...interface{}) {
+	if traceLevel < level {
+		return
+	}
+	line := fmt.Sprintf("%s nerv-hook[%d] %s\n", time.Now().Format("15:04:05.000"), os.Getpid(), fmt.Sprintf(format, args...))
+	traceMu.Lock()
+	defer traceMu.Unlock()
+	io.WriteString(traceOut, line)
+}
+
+// traceConfig writes the config layers this process loaded
+func traceConfig(cfg Config) {
+	if traceLevel < 1 {
+		return
+	}
+	data, err := os.ReadFile(configPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		tracef(1, "config: %s not found, using the built-in rules", configPath)
+	case err != nil:
+		tracef(1, "config: %s can't be read (%v), using the built-in rules", configPath, err)
+	default:
+		var raw Config
+		if err := json.Unmarshal(data, &raw); err != nil {
+			tracef(1, "config: %s doesn't parse (%v), using the built-in rules", configPath, err)
+		} else {
+			tracef(1, "config: %s, %d allow and %d deny rules", configPath, len(raw.Rules.Allow), len(raw.Rules.Deny))
+		}
+	}
+	switch org, err := loadOrgPolicy(); {
+	case err != nil:
+		tracef(1, "config: org policy %s can't be used: %v", orgBundlePath(), err)
+	case org != nil:
+		tracef(1, "config: org policy %s merged in", orgBundlePath())
+	}
+	profile := cfg.Profile
+	if profile == "" {
+		profile = "default"
+	}
+	tracef(1, "config: %d allow and %d deny rules in all, %s profile", len(cfg.Rules.Allow), len(cfg.Rules.Deny), profile)
+}
+
+// traceProjectConfig writes what a repository's .nerv/permissions.json added to the rules
+func traceProjectConfig(dir string, allow, deny []string, err error) {
+	path := filepath.Join(dir, projectConfigFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		tracef(1, "config: %s not found", path)
+	case err != nil:
+		tracef(1, "config: %s ignored: %v", path, err)
+	default:
+		tracef(1, "config: %s adds %d allow and %d deny rules", path, len(allow), len(deny))
+	}
+}
+
+// traceCheck checks a call against rules, tracing its signature and outcome,
+// and at level 2 every step between
+func traceCheck(rules policy.Rules, toolName, toolInput string) policy.Result {
+	rules = withHome(rules)
+	if traceLevel < 1 {
+		return rules.Check(toolName, toolInput)
+	}
+	var result policy.Result
+	if traceLevel < 2 {
+		tracef(1, "rules: signature %s", policy.SignatureIn(rules.Dir, toolName, toolInput))
+		result = rules.Check(toolName, toolInput)
+	} else {
+		result = rules.CheckTrace(toolName, toolInput, func(step string) { tracef(2, "rules: %s", step) })
+	}
+	switch {
+	case result.DenyReason != "":
+		tracef(1, "rules: denied: %s", result.DenyReason)
+	case result.NeedsApproval:
+		tracef(1, "rules: needs approval")
+	case result.AllowRule != "":
+		tracef(1, "rules: allowed by %s", result.AllowRule)
+	default:
+		tracef(1, "rules: allowed, no rule needed")
+	}
+	return result
+}
+
+// traceDecision writes what a hook event decided
+func traceDecision(command string, input HookInput, output HookOutput) {
+	if traceLevel < 1 {
+		return
+	}
+	switch {
+	case output.Decision != nil && output.Decision.Message != "":
+		tracef(1, "%s %s: %s (%s)", command, input.ToolName, output.Decision.Behavior, output.Decision.Message)
+	case output.Decision != nil:
+		tracef(1, "%s %s: %s", command, input.ToolName, output.Decision.Behavior)
+	case command == "pre-tool-use":
+		tracef(1, "%s %s: allow", command, input.ToolName)
+	default:
+		tracef(1, "%s handled", command)
+	}
+	if output.Continue != nil && !*output.Continue {
+		tracef(1, "%s: session stopped (%s)", command, output.StopReason)
+	}
+}
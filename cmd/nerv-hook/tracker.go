@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+const trackerUsage = "usage: nerv-hook tracker sync|status"
+
+// trackerTimeout bounds each tracker API request
+const trackerTimeout = 30 * time.Second
+
+// TrackersConfig connects projects to Linear teams and Jira projects
+// Credentials come from the environment, never the config itself
+type TrackersConfig struct {
+	// Projects maps a project ID to its trackers
+	Projects map[string]*TrackerProject `json:"projects,omitempty"`
+}
+
+// TrackerProject is one project's trackers; either or both may be set
+type TrackerProject struct {
+	Linear *LinearConfig `json:"linear,omitempty"`
+	Jira   *JiraConfig   `json:"jira,omitempty"`
+}
+
+// TrackerMapping maps tracker fields and states onto tasks
+type TrackerMapping struct {
+	// Statuses maps a task status to the ticket state it sets, e.g. "review": "In Review"
+	// A ticket moved to one of these states on the tracker moves its task the other way
+	Statuses map[string]string `json:"statuses,omitempty"`
+	// Title and Description name the ticket fields a task's title and description come from
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Comment posts a comment on the ticket with each status change (default true)
+	Comment *bool `json:"comment,omitempty"`
+}
+
+// project returns a project's trackers, or nil if it has none
+func (c *TrackersConfig) project(projectID string) *TrackerProject {
+	if c == nil {
+		return nil
+	}
+	return c.Projects[projectID]
+}
+
+// Validate reports tracker settings that can't be used
+func (c *TrackersConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	for id, p := range c.Projects {
+		if p == nil || (p.Linear == nil && p.Jira == nil) {
+			return fmt.Errorf("projects: %s has neither linear nor jira", id)
+		}
+		if p.Linear != nil {
+			if err := p.Linear.Mapping.validate(); err != nil {
+				return fmt.Errorf("projects: %s: linear: %w", id, err)
+			}
+		}
+		if p.Jira != nil {
+			if err := p.Jira.validate(); err != nil {
+				return fmt.Errorf("projects: %s: jira: %w", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (m TrackerMapping) validate() error {
+	seen := map[string]string{}
+	for status, state := range m.Statuses {
+		if !store.IsTaskStatus(status) {
+			return fmt.Errorf("statuses: %q is not a task status", status)
+		}
+		if other, ok := seen[state]; ok {
+			return fmt.Errorf("statuses: %s and %s both map to %q", other, status, state)
+		}
+		seen[state] = status
+	}
+	return nil
+}
+
+// statuses returns the mapping's statuses over defaults
+func (m TrackerMapping) statuses(defaults map[string]string) map[string]string {
+	if len(m.Statuses) > 0 {
+		return m.Statuses
+	}
+	return defaults
+}
+
+// comment reports whether status changes are commented on
+func (m TrackerMapping) comment() bool {
+	return m.Comment == nil || *m.Comment
+}
+
+// field returns a mapped field name or the tracker's default
+func field(name, fallback string) string {
+	if name != "" {
+		return name
+	}
+	return fallback
+}
+
+// ticket is a tracker's issue, reduced to what the sync needs
+type ticket struct {
+	ID          string
+	Key         string
+	URL         string
+	State       string
+	Title       string
+	Description string
+	// Scope is context the connector needs to update the ticket, e.g. its Linear team
+	Scope string
+}
+
+// trackerConnector is one tracker's API, seen from the sync
+type trackerConnector interface {
+	// name identifies the tracker in tracker_links, e.g. linear or jira:acme.atlassian.net
+	name() string
+	// assigned returns the open tickets assigned to the token's user
+	assigned() ([]ticket, error)
+	// ticket loads one ticket by ID
+	ticket(id string) (ticket, error)
+	// setState moves a ticket to the named state
+	setState(t ticket, state string) error
+	// addComment posts a comment on a ticket
+	addComment(t ticket, body string) error
+	// statuses maps task statuses to ticket states
+	statuses() map[string]string
+	// mapping is the project's field and comment settings
+	mapping() TrackerMapping
+}
+
+// trackerConnectors returns the connectors configured for a project
+func trackerConnectors(p *TrackerProject) []trackerConnector {
+	var conns []trackerConnector
+	if p.Linear != nil {
+		conns = append(conns, newLinearConnector(p.Linear))
+	}
+	if p.Jira != nil {
+		conns = append(conns, newJiraConnector(p.Jira))
+	}
+	return conns
+}
+
+// runTracker implements `nerv-hook tracker`
+func runTracker(args []string) error {
+	if len(args) < 1 {
+		return errors.New(trackerUsage)
+	}
+
+	switch args[0] {
+	case "sync":
+		return runTrackerSync(args[1:])
+	case "status":
+		return runTrackerStatus(args[1:])
+	default:
+		return errors.New(trackerUsage)
+	}
+}
+
+// runTrackerSync syncs projects with their trackers once, the same pass nervd makes on a schedule
+func runTrackerSync(args []string) error {
+	fs := flag.NewFlagSet("tracker sync", flag.ContinueOnError)
+	projectID := fs.String("project", "", "sync only this project (default every project with a tracker)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg := loadConfig().Trackers
+	projects, err := trackerProjects(cfg, *projectID)
+	if err != nil {
+		return err
+	}
+
+	st, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	failed, total := 0, 0
+	for _, id := range projects {
+		for _, conn := range trackerConnectors(cfg.project(id)) {
+			total++
+			result, err := syncTracker(st, id, conn)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Project %s (%s): %v\n", id, conn.name(), err)
+				failed++
+				continue
+			}
+			fmt.Printf("Project %s (%s): %d imported, %d tickets updated, %d tasks moved by the tracker\n",
+				id, conn.name(), result.Imported, result.Updated, result.Moved)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d trackers failed to sync", failed, total)
+	}
+	return nil
+}
+
+// runTrackerStatus lists the tasks imported from trackers
+func runTrackerStatus(args []string) error {
+	fs := flag.NewFlagSet("tracker status", flag.ContinueOnError)
+	projectID := fs.String("project", "", "only this project's tasks")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	st, err := openReadOnlyStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	links, err := st.ListTrackerLinks(*projectID)
+	if err != nil {
+		return err
+	}
+	if len(links) == 0 {
+		fmt.Println("No tasks were imported from a tracker")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK\tPROJECT\tTRACKER\tTICKET\tSTATUS\tTICKET STATE")
+	for _, l := range links {
+		state := l.TrackerState
+		if l.SyncedStatus != l.Status {
+			state += " (update pending)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", l.TaskID, l.ProjectID, l.Tracker, l.Key, l.Status, state)
+	}
+	return w.Flush()
+}
+
+// trackerProjects returns the projects with trackers to sync, in a stable order
+func trackerProjects(cfg *TrackersConfig, only string) ([]string, error) {
+	if only != "" {
+		if cfg.project(only) == nil {
+			return nil, fmt.Errorf("project %s has no tracker; add one under trackers.projects in %s", only, configPath)
+		}
+		return []string{only}, nil
+	}
+	if cfg == nil || len(cfg.Projects) == 0 {
+		return nil, fmt.Errorf("no projects have a tracker; add them under trackers.projects in %s", configPath)
+	}
+	var ids []string
+	for id := range cfg.Projects {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// scheduleTrackerSync syncs every project's trackers each interval
+// Settings are reread each time, so trackers can be added while nervd runs
+func scheduleTrackerSync(st *store.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cfg := loadConfig().Trackers
+		if cfg == nil {
+			continue
+		}
+		projects, _ := trackerProjects(cfg, "")
+		for _, id := range projects {
+			for _, conn := range trackerConnectors(cfg.project(id)) {
+				if _, err := syncTracker(st, id, conn); err != nil {
+					fmt.Fprintf(os.Stderr, "nervd: tracker: project %s (%s): %v\n", id, conn.name(), err)
+				}
+			}
+		}
+	}
+}
+
+// trackerSyncResult counts what one sync changed
+type trackerSyncResult struct {
+	Imported int
+	Updated  int
+	Moved    int
+}
+
+// syncTracker makes one pass in each direction between a project and a tracker
+// Assigned tickets without a task are imported; a ticket moved to a mapped state
+// moves its task, since the tracker is the source of truth; otherwise task status
+// changes are written to the ticket
+func syncTracker(st *store.DB, projectID string, conn trackerConnector) (trackerSyncResult, error) {
+	var result trackerSyncResult
+
+	tickets, err := conn.assigned()
+	if err != nil {
+		return result, err
+	}
+	current := map[string]ticket{}
+	for _, t := range tickets {
+		current[t.ID] = t
+		if _, err := st.TrackerLinkForTicket(conn.name(), t.ID); errors.Is(err, store.ErrNotFound) {
+			if err := importTicket(st, projectID, conn, t); err != nil {
+				return result, err
+			}
+			result.Imported++
+		} else if err != nil {
+			return result, err
+		}
+	}
+
+	// Ticket state back to task status
+	reverse := map[string]string{}
+	for status, state := range conn.statuses() {
+		reverse[strings.ToLower(state)] = status
+	}
+
+	links, err := st.ListTrackerLinks(projectID)
+	if err != nil {
+		return result, err
+	}
+	for _, link := range links {
+		if link.Tracker != conn.name() {
+			continue
+		}
+		t, ok := current[link.ExternalID]
+		if !ok {
+			// No longer assigned or open; a finished task has nothing left to sync
+			if finished(link.Status) && link.Status == link.SyncedStatus {
+				continue
+			}
+			if t, err = conn.ticket(link.ExternalID); err != nil {
+				return result, fmt.Errorf("%s: %w", link.Key, err)
+			}
+		}
+
+		if !strings.EqualFold(t.State, link.TrackerState) {
+			if to, ok := reverse[strings.ToLower(t.State)]; ok && to != link.Status {
+				if err := moveFromTracker(st, link, t, to); err != nil {
+					return result, err
+				}
+				result.Moved++
+				continue
+			}
+		}
+
+		if link.Status == link.SyncedStatus {
+			if !strings.EqualFold(t.State, link.TrackerState) {
+				if err := st.MarkTrackerSynced(link.TaskID, link.Status, t.State); err != nil {
+					return result, err
+				}
+			}
+			continue
+		}
+		state, err := pushTicketStatus(conn, link, t)
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", link.Key, err)
+		}
+		if err := st.MarkTrackerSynced(link.TaskID, link.Status, state); err != nil {
+			return result, err
+		}
+		details, _ := json.Marshal(map[string]string{"tracker": link.Tracker, "ticket": link.Key, "status": link.Status, "state": state})
+		logAudit(st, link.TaskID, "tracker_ticket_updated", string(details))
+		result.Updated++
+	}
+	return result, nil
+}
+
+// importTicket creates a todo task for a ticket
+func importTicket(st *store.DB, projectID string, conn trackerConnector, t ticket) error {
+	description := strings.TrimSpace(t.Description)
+	if t.URL != "" {
+		if description != "" {
+			description += "\n\n"
+		}
+		description += t.URL
+	}
+	title := t.Title
+	if title == "" {
+		title = t.Key
+	}
+
+	task := store.Task{ID: store.NewID(), ProjectID: projectID, Title: title, Description: description}
+	link := store.TrackerLink{Tracker: conn.name(), ExternalID: t.ID, Key: t.Key, URL: t.URL, TrackerState: t.State}
+	details, _ := json.Marshal(map[string]string{"projectId": projectID, "title": title, "source": conn.name(), "ticket": t.Key})
+	return st.ImportTicketTask(task, link, string(details))
+}
+
+// moveFromTracker applies a ticket's state to its task, if the state machine allows it,
+// and marks the ticket synced so the change isn't echoed back
+func moveFromTracker(st *store.DB, link store.TrackerLink, t ticket, to string) error {
+	moved := false
+	if store.CanTransition(link.Status, to) {
+		var err error
+		if moved, err = st.SetTaskStatus(link.TaskID, link.Status, to, "tracker"); err != nil {
+			return err
+		}
+	}
+	if moved {
+		details, _ := json.Marshal(map[string]string{"status": to, "source": link.Tracker})
+		logAudit(st, link.TaskID, "task_status_changed", string(details))
+	} else {
+		to = link.Status
+	}
+
+	details, _ := json.Marshal(map[string]string{"tracker": link.Tracker, "ticket": link.Key, "state": t.State, "status": to})
+	logAudit(st, link.TaskID, "tracker_ticket_moved", string(details))
+	return st.MarkTrackerSynced(link.TaskID, to, t.State)
+}
+
+// pushTicketStatus writes a task's status to its ticket and returns the ticket's state afterwards
+// Statuses with no mapped state only get the comment
+func pushTicketStatus(conn trackerConnector, link store.TrackerLink, t ticket) (string, error) {
+	state := t.State
+	if target, ok := conn.statuses()[link.Status]; ok && !strings.EqualFold(target, t.State) {
+		if err := conn.setState(t, target); err != nil {
+			return "", err
+		}
+		state = target
+	}
+	if conn.mapping().comment() {
+		body := fmt.Sprintf("NERV task %s is now %s.", link.TaskID, link.Status)
+		if err := conn.addComment(t, body); err != nil {
+			return "", err
+		}
+	}
+	return state, nil
+}
+
+// trackerError is a failed tracker API response
+type trackerError struct {
+	Status int
+	Body   string
+}
+
+func (e *trackerError) Error() string {
+	return fmt.Sprintf("%d %s", e.Status, e.Body)
+}
+
+// trackerRequest sends a JSON request and decodes the JSON response into out
+func trackerRequest(method, url string, header http.Header, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := (&http.Client{Timeout: trackerTimeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &trackerError{Status: resp.StatusCode, Body: strings.TrimSpace(string(msg))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// envToken reads a credential from the environment
+func envToken(env, fallback string) (string, error) {
+	if env == "" {
+		env = fallback
+	}
+	if token := os.Getenv(env); token != "" {
+		return token, nil
+	}
+	return "", fmt.Errorf("%s is not set", env)
+}
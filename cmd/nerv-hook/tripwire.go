@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Tripwires are decoy paths a person registers under tripwires in the config,
+// such as ~/secrets/aws_keys.txt, that no task has any reason to touch
+// A call that touches one, by file tool or by any word of a shell command, is
+// denied and raised at once: an agent reaching for it has gone off-script
+
+// tripwireRoots resolves the configured decoys the way protected paths are
+func tripwireRoots(paths []string) protectedSet {
+	var roots protectedSet
+	for _, p := range paths {
+		p = filepath.Clean(expandHome(p))
+		roots = append(roots, protectedRoot{path: p, canonical: canonicalPath(p)})
+	}
+	return roots
+}
+
+// tripwire returns the decoy a tool call touches, or ""
+func tripwire(paths []string, toolName string, toolInput map[string]interface{}, cwd string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+	return tripwireRoots(paths).touchedBy(toolName, toolInput, cwd)
+}
+
+// trippedOutput denies a call that touched a decoy, logging it as critical and telling the user
+// The agent is only told it was denied, so it doesn't learn which paths are decoys
+func trippedOutput(db Store, taskID, decoy string, input HookInput) HookOutput {
+	logAudit(db, taskID, "tripwire_triggered", fmt.Sprintf(`{"path":%q,"tool":%q,"session_id":%q,"severity":"critical"}`, decoy, input.ToolName, input.SessionID))
+	notice := fmt.Sprintf("NERV: tripwire %s was touched by %s in session %s; the agent may be compromised", decoy, input.ToolName, input.SessionID)
+	fmt.Fprintln(os.Stderr, notice)
+	return HookOutput{
+		SystemMessage: notice,
+		Decision:      &Decision{Behavior: "deny", Message: hiddenDenyMessage},
+	}
+}
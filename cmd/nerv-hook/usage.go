@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+	"github.com/nerv/nerv-hook/pkg/policy"
+)
+
+// Usage statistics are rolled up from the audit log into usage_stats, by day,
+// project, and kind, so that reading them costs the same however long the log
+// grows. nervd folds in new audit rows each interval, and nerv-hook stats does
+// the same before it reports; the dashboard's usage view reads the table as is
+
+const statsUsage = "usage: nerv-hook stats [--since AGE] [--project ID] [--top N] [--json]"
+
+// usageBatch is how many audit rows are folded in at a time
+const usageBatch = 1000
+
+// usageReasonLimit is the longest a denial reason is kept, in bytes
+const usageReasonLimit = 120
+
+// Steps of the approval funnel, in order
+const (
+	funnelRan       = "ran"
+	funnelBlocked   = "blocked"
+	funnelAsked     = "asked"
+	funnelReused    = "reused"
+	funnelApproved  = "approved"
+	funnelDenied    = "denied"
+	funnelTimedOut  = "timed_out"
+	funnelCancelled = "cancelled"
+)
+
+// funnelEvents maps the audit events that count toward the funnel to their step
+var funnelEvents = map[string]string{
+	"tool_completed":     funnelRan,
+	"tool_denied":        funnelBlocked,
+	"approval_requested": funnelAsked,
+	"approval_reused":    funnelReused,
+	"approval_granted":   funnelApproved,
+	"approval_denied":    funnelDenied,
+	"approval_timeout":   funnelTimedOut,
+	"approval_cancelled": funnelCancelled,
+}
+
+// refreshUsage folds the audit rows written since the last refresh into usage_stats, returning how many it read
+func refreshUsage(st *store.DB) (int, error) {
+	cursor, err := st.UsageCursor()
+	if err != nil {
+		return 0, err
+	}
+	// Tasks are looked up once each, for their project
+	projects := map[string]string{}
+	projectOf := func(taskID string) string {
+		if taskID == "" {
+			return ""
+		}
+		if p, ok := projects[taskID]; ok {
+			return p
+		}
+		task, _ := st.GetTask(taskID)
+		projects[taskID] = task.ProjectID
+		return task.ProjectID
+	}
+
+	read := 0
+	for {
+		events, err := st.AuditSince(cursor, usageBatch)
+		if err != nil || len(events) == 0 {
+			return read, err
+		}
+		counts := map[store.UsageCount]int64{}
+		for _, e := range events {
+			for _, c := range usageCounts(e) {
+				c.Day, c.ProjectID = e.Timestamp.UTC().Format(time.DateOnly), projectOf(e.TaskID)
+				counts[c]++
+			}
+		}
+		var rows []store.UsageCount
+		for c, n := range counts {
+			c.Count = n
+			rows = append(rows, c)
+		}
+		cursor = events[len(events)-1].ID
+		if err := st.AddUsage(rows, cursor); err != nil {
+			return read, err
+		}
+		read += len(events)
+	}
+}
+
+// usageCounts returns what an audit event counts toward, without its day or project
+func usageCounts(e store.AuditEvent) []store.UsageCount {
+	step, ok := funnelEvents[e.EventType]
+	if !ok {
+		return nil
+	}
+	counts := []store.UsageCount{{Kind: store.UsageFunnel, Key: step}}
+	var d struct {
+		Tool   string `json:"tool"`
+		Reason string `json:"reason"`
+		Input  struct {
+			Command string `json:"command"`
+		} `json:"input"`
+	}
+	json.Unmarshal([]byte(e.Details), &d)
+	switch e.EventType {
+	case "tool_completed":
+		if d.Tool == "" {
+			break
+		}
+		counts = append(counts, store.UsageCount{Kind: store.UsageTool, Key: d.Tool})
+		if d.Tool == "Bash" {
+			for _, program := range commandPrograms(d.Input.Command) {
+				counts = append(counts, store.UsageCount{Kind: store.UsageCommand, Key: program})
+			}
+		}
+	case "tool_denied":
+		counts = append(counts, store.UsageCount{Kind: store.UsageDenial, Key: denialKey(d.Reason)})
+	case "approval_denied":
+		counts = append(counts, store.UsageCount{Kind: store.UsageDenial, Key: denialKey("Denied by a person: " + d.Reason)})
+	}
+	return counts
+}
+
+// commandPrograms returns the programs a command line runs, each once, e.g. git and grep for git log | grep fix
+func commandPrograms(command string) []string {
+	var programs []string
+	for _, args := range policy.CommandArgs(command) {
+		if len(args) == 0 {
+			continue
+		}
+		if program := filepath.Base(args[0]); !slices.Contains(programs, program) {
+			programs = append(programs, program)
+		}
+	}
+	return programs
+}
+
+// denialKey shortens a denial reason to what's counted
+func denialKey(reason string) string {
+	reason = strings.TrimSpace(strings.TrimSuffix(reason, ": "))
+	if reason == "" {
+		return "no reason given"
+	}
+	if len(reason) > usageReasonLimit {
+		reason = strings.ToValidUTF8(reason[:usageReasonLimit], "") + "..."
+	}
+	return reason
+}
+
+// scheduleUsage folds new audit rows into usage_stats each interval
+func scheduleUsage(st *store.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := refreshUsage(st); err != nil {
+			fmt.Fprintf(os.Stderr, "nervd: usage stats: %v\n", err)
+		}
+	}
+}
+
+// usageReport is what nerv-hook stats prints
+type usageReport struct {
+	Since     string `json:"since"`
+	ProjectID string `json:"project_id,omitempty"`
+	// Days are the calls that ran each day, oldest first, including days with none
+	Days     []usageDay     `json:"days"`
+	Tools    []usageKey     `json:"tools"`
+	Commands []usageKey     `json:"commands"`
+	Funnel   usageFunnel    `json:"funnel"`
+	Denials  []usageKey     `json:"denials"`
+	Projects []usageProject `json:"projects"`
+}
+
+type usageDay struct {
+	Day   string `json:"day"`
+	Calls int64  `json:"calls"`
+}
+
+type usageKey struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// usageFunnel counts calls at each step: calls ran or were blocked outright, or
+// were asked about and then approved, reused an approval, were denied, timed
+// out, or were cancelled
+type usageFunnel struct {
+	Ran       int64 `json:"ran"`
+	Blocked   int64 `json:"blocked"`
+	Asked     int64 `json:"asked"`
+	Reused    int64 `json:"reused"`
+	Approved  int64 `json:"approved"`
+	Denied    int64 `json:"denied"`
+	TimedOut  int64 `json:"timed_out"`
+	Cancelled int64 `json:"cancelled"`
+}
+
+func (f *usageFunnel) add(step string, n int64) {
+	switch step {
+	case funnelRan:
+		f.Ran += n
+	case funnelBlocked:
+		f.Blocked += n
+	case funnelAsked:
+		f.Asked += n
+	case funnelReused:
+		f.Reused += n
+	case funnelApproved:
+		f.Approved += n
+	case funnelDenied:
+		f.Denied += n
+	case funnelTimedOut:
+		f.TimedOut += n
+	case funnelCancelled:
+		f.Cancelled += n
+	}
+}
+
+// usageProject compares one project with the others
+type usageProject struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	usageFunnel
+}
+
+// buildUsageReport sums usage_stats from a day on into the report, keeping the top n of each list
+func buildUsageReport(st *store.DB, since time.Time, projectID string, top int) (usageReport, error) {
+	r := usageReport{Since: since.UTC().Format(time.DateOnly), ProjectID: projectID, Days: []usageDay{}, Projects: []usageProject{}}
+	counts, err := st.Usage(store.UsageFilter{Since: r.Since, ProjectID: projectID})
+	if err != nil {
+		return r, err
+	}
+
+	calls := map[string]int64{}
+	totals := map[string]map[string]int64{store.UsageTool: {}, store.UsageCommand: {}, store.UsageDenial: {}}
+	projects := map[string]*usageProject{}
+	for _, c := range counts {
+		switch c.Kind {
+		case store.UsageFunnel:
+			r.Funnel.add(c.Key, c.Count)
+			if projects[c.ProjectID] == nil {
+				projects[c.ProjectID] = &usageProject{ID: c.ProjectID}
+			}
+			projects[c.ProjectID].add(c.Key, c.Count)
+		case store.UsageTool:
+			calls[c.Day] += c.Count
+			fallthrough
+		default:
+			if totals[c.Kind] != nil {
+				totals[c.Kind][c.Key] += c.Count
+			}
+		}
+	}
+
+	today := time.Now().UTC().Format(time.DateOnly)
+	for day := since.UTC(); day.Format(time.DateOnly) <= today; day = day.AddDate(0, 0, 1) {
+		r.Days = append(r.Days, usageDay{Day: day.Format(time.DateOnly), Calls: calls[day.Format(time.DateOnly)]})
+	}
+	r.Tools = topKeys(totals[store.UsageTool], top)
+	r.Commands = topKeys(totals[store.UsageCommand], top)
+	r.Denials = topKeys(totals[store.UsageDenial], top)
+	for _, p := range projects {
+		if project, err := st.GetProject(p.ID); err == nil {
+			p.Name = project.Name
+		}
+		r.Projects = append(r.Projects, *p)
+	}
+	sort.Slice(r.Projects, func(i, j int) bool {
+		a, b := r.Projects[i], r.Projects[j]
+		if a.Ran != b.Ran {
+			return a.Ran > b.Ran
+		}
+		return a.ID < b.ID
+	})
+	return r, nil
+}
+
+// topKeys returns the n keys counted most, most first
+func topKeys(counts map[string]int64, n int) []usageKey {
+	keys := []usageKey{}
+	for key, count := range counts {
+		keys = append(keys, usageKey{key, count})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Count != keys[j].Count {
+			return keys[i].Count > keys[j].Count
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// runStats implements `nerv-hook stats`
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	since := fs.String("since", "30d", "count usage within `AGE`, e.g. 30d or 12h")
+	project := fs.String("project", "", "count only the project with this `ID`")
+	top := fs.Int("top", 10, "list the `N` most used tools and commands and the most common denials")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *top < 1 {
+		return errors.New(statsUsage)
+	}
+	age, err := parseAge(*since)
+	if err != nil {
+		return err
+	}
+
+	st, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	// Whatever nervd hasn't folded in yet is, so the report is current
+	if _, err := refreshUsage(st); err != nil {
+		return err
+	}
+	r, err := buildUsageReport(st, time.Now().Add(-age), *project, *top)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(r)
+	}
+	return printUsage(os.Stdout, r)
+}
+
+// usageBarWidth is the widest a bar in the calls-per-day chart gets
+const usageBarWidth = 40
+
+// printUsage writes the report for a person
+func printUsage(out io.Writer, r usageReport) error {
+	scope := "every project"
+	if r.ProjectID != "" {
+		scope = "project " + r.ProjectID
+	}
+	fmt.Fprintf(out, "Usage since %s, %s\n\n", r.Since, scope)
+
+	var most int64
+	for _, d := range r.Days {
+		most = max(most, d.Calls)
+	}
+	fmt.Fprintln(out, "Calls per day:")
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, d := range r.Days {
+		bar := ""
+		if most > 0 {
+			bar = strings.Repeat("#", int((d.Calls*usageBarWidth+most-1)/most))
+		}
+		fmt.Fprintf(w, "  %s\t%d\t%s\n", d.Day, d.Calls, bar)
+	}
+	w.Flush()
+
+	f := r.Funnel
+	fmt.Fprintln(out, "\nApproval funnel:")
+	fmt.Fprintf(out, "  %d ran, %d blocked by a rule or check\n", f.Ran, f.Blocked)
+	fmt.Fprintf(out, "  %d asked: %d approved (%s), %d denied, %d timed out, %d cancelled\n", f.Asked, f.Approved, percent(f.Approved, f.Asked), f.Denied, f.TimedOut, f.Cancelled)
+	if f.Reused > 0 {
+		fmt.Fprintf(out, "  %d ran on an approval asked for ahead\n", f.Reused)
+	}
+
+	for _, list := range []struct {
+		title string
+		keys  []usageKey
+	}{
+		{"Top tools", r.Tools},
+		{"Top commands", r.Commands},
+		{"Denial reasons", r.Denials},
+	} {
+		fmt.Fprintf(out, "\n%s:\n", list.title)
+		if len(list.keys) == 0 {
+			fmt.Fprintln(out, "  none")
+			continue
+		}
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		for _, k := range list.keys {
+			fmt.Fprintf(w, "  %d\t%s\n", k.Count, k.Key)
+		}
+		w.Flush()
+	}
+
+	if r.ProjectID == "" && len(r.Projects) > 0 {
+		fmt.Fprintln(out, "\nProjects:")
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  PROJECT\tRAN\tBLOCKED\tASKED\tAPPROVED\tDENIED\tTIMED OUT")
+		for _, p := range r.Projects {
+			name := p.Name
+			if name == "" {
+				name = orNone(p.ID)
+			}
+			fmt.Fprintf(w, "  %s\t%d\t%d\t%d\t%s\t%d\t%d\n", name, p.Ran, p.Blocked, p.Asked, percent(p.Approved, p.Asked), p.Denied, p.TimedOut)
+		}
+		w.Flush()
+	}
+	return nil
+}
+
+// percent formats part as a share of whole
+func percent(part, whole int64) string {
+	if whole == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", float64(part)*100/float64(whole))
+}
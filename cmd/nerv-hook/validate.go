@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Claude Code hook payload versions
+// v1 is the original shape (stop_reason/stop_gen_index); v2 adds hook_event_name, cwd, and transcript_path
+const (
+	claudeProtocolV1 = "claude/1"
+	claudeProtocolV2 = "claude/2"
+)
+
+// claudeInputFields are the payload keys Claude Code is known to send, across versions
+var claudeInputFields = map[string]bool{
+	"session_id":          true,
+	"transcript_path":     true,
+	"cwd":                 true,
+	"permission_mode":     true,
+	"hook_event_name":     true,
+	"tool_name":           true,
+	"tool_input":          true,
+	"tool_response":       true,
+	"tool_use_id":         true,
+	"stop_hook_active":    true,
+	"stop_reason":         true,
+	"stop_gen_index":      true,
+	"prompt":              true,
+	"message":             true,
+	"source":              true,
+	"reason":              true,
+	"trigger":             true,
+	"custom_instructions": true,
+}
+
+// claudeEventNames maps nerv-hook event commands to Claude's hook_event_name
+var claudeEventNames = map[string]string{
+	"pre-tool-use":       "PreToolUse",
+	"post-tool-use":      "PostToolUse",
+	"session-start":      "SessionStart",
+	"user-prompt-submit": "UserPromptSubmit",
+	"stop":               "Stop",
+}
+
+// signatureFields are the tool_input keys policy.Signature needs for each tool
+var signatureFields = map[string]string{
+	"Bash":  "command",
+	"Read":  "file_path",
+	"Write": "file_path",
+	"Edit":  "file_path",
+}
+
+// detectClaudeVersion returns the Claude payload version and any keys it doesn't recognise
+func detectClaudeVersion(data []byte) (string, []string) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return claudeProtocolV1, nil
+	}
+
+	var unknown []string
+	for key := range raw {
+		if !claudeInputFields[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+
+	if _, ok := raw["hook_event_name"]; ok {
+		return claudeProtocolV2, unknown
+	}
+	return claudeProtocolV1, unknown
+}
+
+// validateHookInput checks a parsed event against the schema for its event type
+// Returns an error describing every problem found
+func validateHookInput(event string, input HookInput) error {
+	var problems []string
+
+	if input.HookEventName != "" {
+		if expected, ok := claudeEventNames[event]; ok && input.HookEventName != expected {
+			problems = append(problems, fmt.Sprintf("hook_event_name %q does not match event %s", input.HookEventName, event))
+		}
+	}
+
+	switch event {
+	case "pre-tool-use", "post-tool-use":
+		if input.ToolName == "" {
+			problems = append(problems, "tool_name is required")
+		}
+		if input.ToolInput == nil {
+			problems = append(problems, "tool_input must be an object")
+		}
+		// An empty signature would match no rule, so require the fields rules match on
+		if field, ok := signatureFields[input.ToolName]; ok && input.ToolInput != nil {
+			if value, ok := input.ToolInput[field].(string); !ok || value == "" {
+				problems = append(problems, fmt.Sprintf("tool_input.%s must be a non-empty string for %s", field, input.ToolName))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid %s input: %s", event, strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// defaultVerifyTimeout bounds each verification command; the stop hook's own
+// timeout (see install) has to cover all of them
+const defaultVerifyTimeout = 5 * time.Minute
+
+// verifyOutputLimit is how much of the end of a command's output is kept
+const verifyOutputLimit = 8000
+
+// VerifyConfig lists the commands that check a task's work when its session stops
+type VerifyConfig struct {
+	// Commands run for every project without its own, in order, e.g. "make test"
+	Commands []string `json:"commands,omitempty"`
+	// Projects overrides Commands for individual projects, keyed by project ID
+	// An empty list turns verification off for the project
+	Projects map[string][]string `json:"projects,omitempty"`
+	// Timeout bounds each command, e.g. "10m" (default 5m)
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// commands returns the verification commands for a project, or nil if it has none
+// An entry under projects wins, then the project's own list (from its
+// .nerv/permissions.json), then the commands for every project
+func (c *VerifyConfig) commands(projectID string, projectCommands []string) []string {
+	if c != nil {
+		if commands, ok := c.Projects[projectID]; ok {
+			return commands
+		}
+	}
+	if len(projectCommands) > 0 {
+		return projectCommands
+	}
+	if c == nil {
+		return nil
+	}
+	return c.Commands
+}
+
+// timeout returns the configured per-command timeout or the default
+func (c *VerifyConfig) timeout() time.Duration {
+	if c == nil || c.Timeout == "" {
+		return defaultVerifyTimeout
+	}
+	d, err := time.ParseDuration(c.Timeout)
+	if err != nil || d <= 0 {
+		return defaultVerifyTimeout
+	}
+	return d
+}
+
+// Validate reports verification settings that can't be applied
+func (c *VerifyConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Timeout != "" {
+		if d, err := time.ParseDuration(c.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("timeout %q is not a positive duration", c.Timeout)
+		}
+	}
+	for _, command := range c.Commands {
+		if strings.TrimSpace(command) == "" {
+			return errors.New("commands: empty command")
+		}
+	}
+	for id, commands := range c.Projects {
+		for _, command := range commands {
+			if strings.TrimSpace(command) == "" {
+				return fmt.Errorf("projects: %s: empty command", id)
+			}
+		}
+	}
+	return nil
+}
+
+// verifyStep is one command's result, as stored in verifications.steps
+type verifyStep struct {
+	Command    string `json:"command"`
+	ExitCode   int    `json:"exit_code"`
+	TimedOut   bool   `json:"timed_out,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+	// Output is the end of the combined stdout and stderr
+	Output string `json:"output"`
+}
+
+// runVerification runs commands in dir until one fails
+// Later commands usually depend on earlier ones (build before test), so they're skipped
+func runVerification(dir string, commands []string, timeout time.Duration) (steps []verifyStep, passed bool) {
+	for _, command := range commands {
+		step := runVerifyCommand(dir, command, timeout)
+		steps = append(steps, step)
+		if step.ExitCode != 0 {
+			return steps, false
+		}
+	}
+	return steps, true
+}
+
+// runVerifyCommand runs one command through the shell
+func runVerifyCommand(dir, command string, timeout time.Duration) verifyStep {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Dir = dir
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// Don't wait on grandchildren still holding the output open after a timeout
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+	err := cmd.Run()
+	step := verifyStep{Command: command, DurationMS: time.Since(start).Milliseconds(), Output: tail(out.String(), verifyOutputLimit)}
+
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		step.ExitCode, step.TimedOut = -1, true
+	case errors.As(err, &exitErr):
+		step.ExitCode = exitErr.ExitCode()
+	case err != nil:
+		step.ExitCode = -1
+		step.Output = err.Error()
+	}
+	return step
+}
+
+// tail returns the last limit bytes of s
+func tail(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	return "..." + s[len(s)-limit:]
+}
+
+// verifyTask runs the commands against a task's checkout and records the run
+func verifyTask(db Store, task store.Task, dir string, commands []string, timeout time.Duration) (store.Verification, []verifyStep, error) {
+	start := time.Now()
+	steps, passed := runVerification(dir, commands, timeout)
+	data, err := json.Marshal(steps)
+	if err != nil {
+		return store.Verification{}, steps, err
+	}
+	v := store.Verification{TaskID: task.ID, Head: task.BranchHead, Passed: passed, Steps: string(data), DurationMS: time.Since(start).Milliseconds()}
+	if v.ID, err = db.SaveVerification(v); err != nil {
+		return v, steps, err
+	}
+
+	details := map[string]interface{}{"verification_id": v.ID, "passed": passed, "steps": len(steps)}
+	if !passed {
+		failed := steps[len(steps)-1]
+		details["failed"] = failed.Command
+		details["exit_code"] = failed.ExitCode
+	}
+	data, _ = json.Marshal(details)
+	logAudit(db, task.ID, "verification_completed", string(data))
+	return v, steps, nil
+}
+
+// verifyOnStop runs a project's verification commands for an in-progress task
+// and returns the status the task should move to: review if they pass or there
+// are none, blocked if one fails
+func verifyOnStop(db Store, projectID, taskID string) string {
+	cfg := loadConfig().Verify
+	commands := cfg.commands(projectID, loadProjectConfig(db, projectID).Verify)
+	if len(commands) == 0 {
+		return store.TaskReview
+	}
+	task, err := db.GetTask(taskID)
+	if err != nil || task.Status != store.TaskInProgress {
+		return store.TaskReview
+	}
+	dir := task.WorktreePath
+	if dir == "" {
+		if dir, err = os.Getwd(); err != nil {
+			return store.TaskReview
+		}
+	}
+
+	v, _, err := verifyTask(db, task, dir, commands, cfg.timeout())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record verification: %v\n", err)
+	}
+	if !v.Passed {
+		return store.TaskBlocked
+	}
+	return store.TaskReview
+}
+
+// runTaskVerify implements `nerv-hook task verify`, running the project's
+// verification commands against a task without moving it
+func runTaskVerify(args []string) error {
+	fs := flag.NewFlagSet("task verify", flag.ContinueOnError)
+	dirFlag := fs.String("dir", "", "directory to run the commands in (default the task's worktree, then the current directory)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: nerv-hook task verify [--dir DIR] <task-id>")
+	}
+
+	st, err := openOperatorStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	task, err := loadTask(st, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	cfg := loadConfig().Verify
+	commands := cfg.commands(task.ProjectID, loadProjectConfig(st, task.ProjectID).Verify)
+	if len(commands) == 0 {
+		return fmt.Errorf("project %s has no verification commands; add them under verify in %s", task.ProjectID, configPath)
+	}
+	dir := *dirFlag
+	if dir == "" {
+		if dir = task.WorktreePath; dir == "" {
+			if dir, err = os.Getwd(); err != nil {
+				return err
+			}
+		}
+	}
+
+	v, steps, err := verifyTask(st, task, dir, commands, cfg.timeout())
+	if err != nil {
+		return err
+	}
+	printVerifySteps(os.Stdout, steps)
+	if !v.Passed {
+		return fmt.Errorf("verification failed for task %s", task.ID)
+	}
+	fmt.Printf("Verification passed for task %s\n", task.ID)
+	return nil
+}
+
+// printVerifySteps lists each command's outcome, with the output of a failed one
+func printVerifySteps(out io.Writer, steps []verifyStep) {
+	for _, s := range steps {
+		outcome := "passed"
+		switch {
+		case s.TimedOut:
+			outcome = "timed out"
+		case s.ExitCode != 0:
+			outcome = fmt.Sprintf("exit %d", s.ExitCode)
+		}
+		fmt.Fprintf(out, "  %-10s %s (%s)\n", outcome, s.Command, formatDuration(time.Duration(s.DurationMS)*time.Millisecond))
+		if s.ExitCode != 0 && s.Output != "" {
+			for _, line := range strings.Split(strings.TrimRight(s.Output, "\n"), "\n") {
+				fmt.Fprintf(out, "      %s\n", line)
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"text/tabwriter"
+
+	"github.com/nerv/nerv-hook/internal/migrations"
+)
+
+// version is the release, set at build time with -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
+// configSchemaVersion is the newest permissions file format this binary understands
+// A file with a higher schema_version fails validation, and hooks deny every
+// tool call rather than apply rules they may misread
+const configSchemaVersion = 1
+
+// configSchemaDenyReason returns why every tool call is denied, or "" unless
+// the permissions file was written for a newer release
+func configSchemaDenyReason() string {
+	if v := loadConfig().SchemaVersion; v > configSchemaVersion {
+		return fmt.Sprintf("NERV's permissions file (%s) is schema version %d, newer than this nerv-hook supports (%d), so every tool call is denied. Ask the user to upgrade nerv-hook", configPath, v, configSchemaVersion)
+	}
+	return ""
+}
+
+// versionReport is what nerv-hook version prints
+type versionReport struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit,omitempty"`
+	CommitTime string `json:"commit_time,omitempty"`
+	// Modified is set when the binary was built from a tree with uncommitted changes
+	Modified  bool          `json:"modified,omitempty"`
+	GoVersion string        `json:"go_version"`
+	Platform  string        `json:"platform"`
+	Database  versionSchema `json:"database"`
+	Config    versionSchema `json:"config"`
+}
+
+// versionSchema is a file's schema version next to the newest this binary supports
+// Current is omitted when the file can't be read, and Error says why
+type versionSchema struct {
+	Location  string `json:"location"`
+	Current   *int   `json:"current,omitempty"`
+	Supported int    `json:"supported"`
+	Error     string `json:"error,omitempty"`
+}
+
+// runVersion implements `nerv-hook version`
+func runVersion(args []string) error {
+	fs := flag.NewFlagSet("version", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("usage: nerv-hook version [--json]")
+	}
+
+	r := gatherVersion()
+	if *asJSON {
+		return printJSON(r)
+	}
+	return printVersion(os.Stdout, r)
+}
+
+// gatherVersion reads the build info embedded in the binary and the schema
+// versions of the state database and permissions file
+func gatherVersion() versionReport {
+	r := versionReport{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Database:  versionSchema{Location: dbPath, Supported: migrations.Latest(migrations.SQLite)},
+		Config:    versionSchema{Location: configPath, Supported: configSchemaVersion},
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		// go install of a tagged module records its version
+		if r.Version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			r.Version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				r.Commit = s.Value
+			case "vcs.time":
+				r.CommitTime = s.Value
+			case "vcs.modified":
+				r.Modified = s.Value == "true"
+			}
+		}
+	}
+
+	if st, err := openUncheckedStore(true); err != nil {
+		r.Database.Error = err.Error()
+	} else {
+		r.Database.Location = st.Location()
+		r.Database.Supported = migrations.Latest(st.Dialect())
+		if current, err := migrations.Current(st.SQL(), st.Dialect()); err != nil {
+			r.Database.Error = err.Error()
+		} else {
+			r.Database.Current = &current
+		}
+		st.Close()
+	}
+
+	data, err := os.ReadFile(configPath)
+	var doc struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		r.Config.Error = configPath + " not found; the built-in rules apply"
+	case err != nil:
+		r.Config.Error = err.Error()
+	default:
+		if err := json.Unmarshal(data, &doc); err != nil {
+			r.Config.Error = fmt.Sprintf("%s doesn't parse: %v", configPath, err)
+		} else {
+			current := max(doc.SchemaVersion, 1)
+			r.Config.Current = &current
+		}
+	}
+	return r
+}
+
+// printVersion writes the report for a person
+func printVersion(out io.Writer, r versionReport) error {
+	fmt.Fprintf(out, "nerv-hook %s\n", r.Version)
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	commit := "unknown"
+	if r.Commit != "" {
+		commit = r.Commit
+		if r.CommitTime != "" {
+			commit += " (" + r.CommitTime + ")"
+		}
+		if r.Modified {
+			commit += ", modified"
+		}
+	}
+	fmt.Fprintf(w, "Commit:\t%s\n", commit)
+	fmt.Fprintf(w, "Go:\t%s %s\n", r.GoVersion, r.Platform)
+	fmt.Fprintf(w, "Database schema:\t%s\n", schemaLine(r.Database))
+	fmt.Fprintf(w, "Config schema:\t%s\n", schemaLine(r.Config))
+	return w.Flush()
+}
+
+// schemaLine describes a file's schema version and whether this binary supports it
+func schemaLine(s versionSchema) string {
+	switch {
+	case s.Current == nil:
+		return fmt.Sprintf("%s (supports %d)", s.Error, s.Supported)
+	case *s.Current > s.Supported:
+		return fmt.Sprintf("%d in %s, newer than this binary supports (%d); upgrade nerv-hook", *s.Current, s.Location, s.Supported)
+	case *s.Current < s.Supported:
+		return fmt.Sprintf("%d in %s (supports %d; run nerv-hook migrate up)", *s.Current, s.Location, s.Supported)
+	default:
+		return fmt.Sprintf("%d in %s (supports %d)", *s.Current, s.Location, s.Supported)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// A plugin can be a WebAssembly module instead of a program. It's a WASI
+// command, such as Go built with GOOS=wasip1 or Rust's wasm32-wasip1 target,
+// and speaks the same protocol: the request on stdin, the response on stdout
+// It runs inside nerv-hook with no filesystem, network, or real clock, so it
+// can't read the repository or reach anything the request doesn't hold, and
+// it costs no process start
+// Modules are compiled once per process, and the machine code is cached on
+// disk, so a hook invocation only instantiates them
+
+// wasmMemoryLimit caps a module's memory, in 64 KiB pages (256 MiB)
+const wasmMemoryLimit = 4096
+
+// wasmPlugins holds the runtime and compiled modules shared by every WASM plugin in the process
+var wasmPlugins struct {
+	sync.Mutex
+	runtime wazero.Runtime
+	// modules are keyed by path, and recompiled when the file changes under nervd
+	modules map[string]*wasmModule
+}
+
+// wasmModule is a compiled module and the file it was compiled from
+type wasmModule struct {
+	compiled wazero.CompiledModule
+	size     int64
+	modTime  time.Time
+}
+
+// wasmCacheDir is where compiled modules are cached between hook invocations
+func wasmCacheDir() string {
+	return filepath.Join(nervDir, "cache", "wasm")
+}
+
+// compiledWasmPlugin returns the runtime and the compiled module at path, compiling it if needed
+func compiledWasmPlugin(path string) (wazero.Runtime, wazero.CompiledModule, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wasmPlugins.Lock()
+	defer wasmPlugins.Unlock()
+	if wasmPlugins.runtime == nil {
+		config := wazero.NewRuntimeConfig().WithCloseOnContextDone(true).WithMemoryLimitPages(wasmMemoryLimit)
+		// Without the cache every hook invocation compiles the module again; it still works
+		if err := os.MkdirAll(wasmCacheDir(), 0700); err == nil {
+			if cache, err := wazero.NewCompilationCacheWithDir(wasmCacheDir()); err == nil {
+				config = config.WithCompilationCache(cache)
+			}
+		}
+		// The runtime outlives any one call, so it isn't closed with the call's context
+		rt := wazero.NewRuntimeWithConfig(context.Background(), config)
+		if _, err := wasi_snapshot_preview1.Instantiate(context.Background(), rt); err != nil {
+			rt.Close(context.Background())
+			return nil, nil, err
+		}
+		wasmPlugins.runtime = rt
+		wasmPlugins.modules = map[string]*wasmModule{}
+	}
+
+	if m := wasmPlugins.modules[path]; m != nil && m.size == info.Size() && m.modTime.Equal(info.ModTime()) {
+		return wasmPlugins.runtime, m.compiled, nil
+	}
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	compiled, err := wasmPlugins.runtime.CompileModule(context.Background(), code)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s doesn't compile: %v", path, err)
+	}
+	// A replaced module isn't closed, since a call running at the same time may still be using it
+	wasmPlugins.modules[path] = &wasmModule{compiled: compiled, size: info.Size(), modTime: info.ModTime()}
+	return wasmPlugins.runtime, compiled, nil
+}
+
+// runWasmPlugin runs a WASM plugin's module on a request, writing its output to stdout and stderr
+func runWasmPlugin(ctx context.Context, p PluginConfig, request []byte, stdout, stderr io.Writer) error {
+	rt, compiled, err := compiledWasmPlugin(p.Wasm)
+	if err != nil {
+		return err
+	}
+	config := wazero.NewModuleConfig().
+		// Unnamed, so the same module can run for calls at the same time
+		WithName("").
+		WithArgs(filepath.Base(p.Wasm)).
+		WithStdin(bytes.NewReader(request)).
+		WithStdout(stdout).
+		WithStderr(stderr).
+		WithEnv("NERV_PLUGIN_PROTOCOL", pluginProtocol)
+	for _, name := range p.Env {
+		if value, ok := os.LookupEnv(name); ok {
+			config = config.WithEnv(name, value)
+		}
+	}
+
+	// Instantiating a command runs it to the end
+	mod, err := rt.InstantiateModule(ctx, compiled, config)
+	if mod != nil {
+		mod.Close(context.Background())
+	}
+	if exit := (*sys.ExitError)(nil); errors.As(err, &exit) && exit.ExitCode() == 0 {
+		return nil
+	}
+	return err
+}
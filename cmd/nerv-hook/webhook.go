@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// webhookTimeout bounds each delivery
+const webhookTimeout = 15 * time.Second
+
+// WebhookConfig is a URL that's sent task status changes, the first kind of notifier
+// The signing secret comes from the environment, never the config itself
+type WebhookConfig struct {
+	// Name identifies the webhook; delivery progress is kept under it
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Events limits the webhook to some of started, review, done, blocked,
+	// tripwire, anomaly, circuit_breaker, and backpressure (default all)
+	Events []string `json:"events,omitempty"`
+	// Projects limits the webhook to some projects' tasks (default every project)
+	Projects []string `json:"projects,omitempty"`
+	// SecretEnv names the environment variable holding the HMAC key; without it deliveries aren't signed
+	SecretEnv string `json:"secret_env,omitempty"`
+}
+
+// webhookNotifier is a notifier that posts notifications to a URL
+type webhookNotifier struct {
+	WebhookConfig
+}
+
+// newWebhookNotifier builds a webhook from a notifier's settings: url, and secret_env if deliveries are signed
+func newWebhookNotifier(c NotifierConfig) (Notifier, error) {
+	var settings struct {
+		URL       string `json:"url"`
+		SecretEnv string `json:"secret_env"`
+	}
+	if len(c.Settings) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(c.Settings))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&settings); err != nil {
+			return nil, fmt.Errorf("settings: %v", err)
+		}
+	}
+	w := WebhookConfig{Name: c.Name, URL: settings.URL, Events: c.Events, Projects: c.Projects, SecretEnv: settings.SecretEnv}
+	if err := validateWebhooks([]WebhookConfig{w}); err != nil {
+		return nil, errors.New(strings.TrimPrefix(err.Error(), c.Name+": "))
+	}
+	return webhookNotifier{w}, nil
+}
+
+func (w webhookNotifier) Name() string {
+	return w.WebhookConfig.Name
+}
+
+func (w webhookNotifier) Wants(event, projectID string) bool {
+	return notifierFilter{w.Events, w.Projects}.Wants(event, projectID)
+}
+
+func (w webhookNotifier) Notify(id string, n notification) error {
+	return postWebhook(w.WebhookConfig, id, n)
+}
+
+// secret returns the signing key, or nil when deliveries go unsigned
+func (w WebhookConfig) secret() ([]byte, error) {
+	if w.SecretEnv == "" {
+		return nil, nil
+	}
+	secret, err := envToken(w.SecretEnv, "")
+	return []byte(secret), err
+}
+
+// validateWebhooks reports webhook settings that can't be used
+func validateWebhooks(hooks []WebhookConfig) error {
+	names := map[string]bool{}
+	for i, w := range hooks {
+		if w.Name == "" {
+			return fmt.Errorf("webhook %d has no name", i+1)
+		}
+		if names[w.Name] {
+			return fmt.Errorf("more than one webhook is named %s", w.Name)
+		}
+		names[w.Name] = true
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s: url must be an http or https URL", w.Name)
+		}
+		for _, event := range w.Events {
+			if !isNotifyEvent(event) {
+				return fmt.Errorf("%s: unknown event %q (want %s)", w.Name, event, orList(notifyEventNames()))
+			}
+		}
+	}
+	return nil
+}
+
+// webhookError is a delivery the endpoint answered with an error status
+type webhookError struct {
+	Status int
+	Body   string
+}
+
+func (e *webhookError) Error() string {
+	return fmt.Sprintf("%d %s", e.Status, e.Body)
+}
+
+// retryable reports whether sending the delivery again could succeed
+// Other client errors mean the endpoint will never take it
+func (e *webhookError) retryable() bool {
+	return e.Status >= 500 || e.Status == http.StatusRequestTimeout || e.Status == http.StatusTooManyRequests
+}
+
+// postWebhook sends one delivery, signing the body with the webhook's secret
+// X-Nerv-Signature is sha256= and the hex HMAC-SHA256 of the exact body
+func postWebhook(w WebhookConfig, delivery string, payload notification) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	secret, err := w.secret()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nerv-hook")
+	req.Header.Set("X-Nerv-Event", payload.Event)
+	req.Header.Set("X-Nerv-Delivery", delivery)
+	if secret != nil {
+		req.Header.Set("X-Nerv-Signature", signWebhook(secret, body))
+	}
+
+	resp, err := (&http.Client{Timeout: webhookTimeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &webhookError{Status: resp.StatusCode, Body: strings.TrimSpace(string(msg))}
+	}
+	return nil
+}
+
+// signWebhook returns the X-Nerv-Signature value for a body
+func signWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
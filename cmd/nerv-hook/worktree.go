@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/nerv/nerv-hook/internal/store"
+)
+
+// git runs a git command in dir and returns its trimmed stdout
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// taskWorktreePath is where a task's worktree goes: <repo>-worktrees/<task-id>
+// beside the repository, the same layout the dashboard uses
+func taskWorktreePath(repoRoot, taskID string) string {
+	return filepath.Join(filepath.Dir(repoRoot), filepath.Base(repoRoot)+"-worktrees", taskID)
+}
+
+// defaultBranchTemplate names task branches unless tasks.branch_template overrides it
+const defaultBranchTemplate = "nerv/{task_id}-{slug}"
+
+// maxSlugLength keeps branch names readable when titles are long
+const maxSlugLength = 40
+
+// taskBranchName fills in a branch template for a task
+// Placeholders are {task_id}, {project_id}, and {slug}, a lowercased, dash-separated form of the title
+func taskBranchName(template string, task store.Task) (string, error) {
+	name := strings.NewReplacer(
+		"{task_id}", task.ID,
+		"{project_id}", task.ProjectID,
+		"{slug}", slugify(task.Title),
+	).Replace(template)
+	name = strings.TrimRight(strings.ReplaceAll(name, "--", "-"), "-/")
+
+	// Same rules git applies, without needing a repository
+	if name == "" || strings.ContainsAny(name, " ~^:?*[\\") || strings.Contains(name, "..") ||
+		strings.HasPrefix(name, "-") || strings.HasSuffix(name, ".lock") || strings.Contains(name, "@{") {
+		return "", fmt.Errorf("branch template %q gives an invalid branch name %q", template, name)
+	}
+	return name, nil
+}
+
+// slugify lowercases s and joins its words with dashes, e.g. "Fix the Login test!" becomes fix-the-login-test
+func slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	slug := b.String()
+	if len(slug) > maxSlugLength {
+		slug = strings.TrimRight(slug[:maxSlugLength], "-")
+	}
+	return slug
+}
+
+// inGitRepo reports whether dir is inside a git working tree
+func inGitRepo(dir string) bool {
+	out, err := git(dir, "rev-parse", "--is-inside-work-tree")
+	return err == nil && out == "true"
+}
+
+// branchExists reports whether a local branch exists in the repository containing dir
+func branchExists(dir, branch string) bool {
+	_, err := git(dir, "rev-parse", "--verify", "--quiet", "refs/heads/"+branch)
+	return err == nil
+}
+
+// switchToBranch checks out branch in dir, creating it from HEAD if it doesn't exist
+// Uncommitted changes come along; git refuses if they would be overwritten
+func switchToBranch(dir, branch string) error {
+	if branchExists(dir, branch) {
+		_, err := git(dir, "switch", branch)
+		return err
+	}
+	_, err := git(dir, "switch", "-c", branch)
+	return err
+}
+
+// branchHead returns the commit a local branch points at
+func branchHead(dir, branch string) (string, error) {
+	return git(dir, "rev-parse", "--verify", "refs/heads/"+branch)
+}
+
+// createTaskWorktree adds a worktree for the task on branch, based on the current HEAD
+// of the repository containing dir; an existing branch is checked out as it is
+// Returns the worktree path
+func createTaskWorktree(dir, taskID, branch string) (string, error) {
+	repoRoot, err := git(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", fmt.Errorf("not in a git repository: %w", err)
+	}
+
+	path := taskWorktreePath(repoRoot, taskID)
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("%s already exists", path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	// A restarted task picks its branch back up
+	args := []string{"worktree", "add", "-b", branch, path}
+	if branchExists(repoRoot, branch) {
+		args = []string{"worktree", "add", path, branch}
+	}
+	if _, err := git(repoRoot, args...); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// removeTaskWorktree removes a task's worktree, keeping its branch for review
+// git refuses if the worktree has uncommitted changes, so nothing is lost
+func removeTaskWorktree(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	_, err := git(path, "worktree", "remove", path)
+	return err
+}
+
+// splitRepoNames parses a task's repos field, a comma-separated list of repo names
+func splitRepoNames(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// taskRepos returns the registered repos a task spans, in the order its repos field lists them
+// A task without any works in whichever repository it's started in
+func taskRepos(st *store.DB, task store.Task) ([]store.Repo, error) {
+	names := splitRepoNames(task.Repos)
+	if len(names) == 0 {
+		return nil, nil
+	}
+	registered, err := st.ListRepos(task.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+	var repos []store.Repo
+	for _, name := range names {
+		i := slices.IndexFunc(registered, func(r store.Repo) bool { return r.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("task %s spans repo %q, which isn't registered to project %s", task.ID, name, task.ProjectID)
+		}
+		repos = append(repos, registered[i])
+	}
+	return repos, nil
+}
+
+// repoForDir returns the repo that contains dir, preferring the deepest
+func repoForDir(repos []store.Repo, dir string) (store.Repo, bool) {
+	var best store.Repo
+	for _, r := range repos {
+		if withinDir(dir, r.Path) && len(r.Path) > len(best.Path) {
+			best = r
+		}
+	}
+	return best, best.ID != ""
+}
+
+// createTaskWorktrees adds a worktree on branch in each of repos, or in the
+// repository containing dir when there are none
+// Returns the primary worktree, the one sessions start in: the worktree of the
+// repo containing dir, or else of the first repo. The returned rows are for
+// task_worktrees; if one worktree can't be created, those already made are removed
+func createTaskWorktrees(st *store.DB, task store.Task, repos []store.Repo, dir, branch string) (string, []store.TaskWorktree, error) {
+	var worktrees []store.TaskWorktree
+	if len(repos) == 0 {
+		path, err := createTaskWorktree(dir, task.ID, branch)
+		if err != nil {
+			return "", nil, err
+		}
+		fmt.Fprintf(os.Stderr, "Created worktree %s on branch %s\n", path, branch)
+		// Remember the registered repo it belongs to, so that repo's own rules cover it
+		if registered, err := st.ListRepos(task.ProjectID); err == nil {
+			if repo, ok := repoForDir(registered, dir); ok {
+				worktrees = append(worktrees, store.TaskWorktree{TaskID: task.ID, RepoID: repo.ID, Path: path})
+			}
+		}
+		return path, worktrees, nil
+	}
+
+	primary := repos[0]
+	if repo, ok := repoForDir(repos, dir); ok {
+		primary = repo
+	}
+	var primaryPath string
+	for _, repo := range repos {
+		path, err := createTaskWorktree(repo.Path, task.ID, branch)
+		if err != nil {
+			for _, w := range worktrees {
+				removeTaskWorktree(w.Path)
+			}
+			return "", nil, fmt.Errorf("repo %s: %w", repo.Name, err)
+		}
+		fmt.Fprintf(os.Stderr, "Created worktree %s on branch %s\n", path, branch)
+		worktrees = append(worktrees, store.TaskWorktree{TaskID: task.ID, RepoID: repo.ID, Path: path})
+		if repo.ID == primary.ID {
+			primaryPath = path
+		}
+	}
+	return primaryPath, worktrees, nil
+}
+
+// runTaskRepos implements `nerv-hook task repos`: show or set the repos a task spans
+// The repos take effect the next time the task starts
+func runTaskRepos(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: nerv-hook task repos <task-id> [NAME,...|none]")
+	}
+
+	st, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	task, err := loadTask(st, args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 2 {
+		if err := actAsOperator(st); err != nil {
+			return err
+		}
+	}
+	if len(args) == 1 {
+		if task.Repos == "" {
+			fmt.Printf("Task %s works in the repository it's started in\n", task.ID)
+			return nil
+		}
+		repos, err := taskRepos(st, task)
+		if err != nil {
+			return err
+		}
+		for _, r := range repos {
+			fmt.Printf("%s\t%s\n", r.Name, r.Path)
+		}
+		return nil
+	}
+
+	task.Repos = ""
+	if args[1] != "none" {
+		task.Repos = strings.Join(splitRepoNames(args[1]), ",")
+		if _, err := taskRepos(st, task); err != nil {
+			return err
+		}
+	}
+	if err := st.SetTaskRepos(task.ID, task.Repos); err != nil {
+		return err
+	}
+	if task.Repos == "" {
+		fmt.Printf("Task %s works in the repository it's started in\n", task.ID)
+	} else {
+		fmt.Printf("Task %s spans %s\n", task.ID, strings.ReplaceAll(task.Repos, ",", ", "))
+	}
+	return nil
+}
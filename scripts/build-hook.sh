@@ -17,27 +17,31 @@ OUT_DIR="$PROJECT_ROOT/resources"
 
 cd "$HOOK_DIR"
 
+# nerv-hook version reports the release it was built from
+VERSION="$(node -p "require('$PROJECT_ROOT/package.json').version")"
+LDFLAGS="-s -w -X main.version=$VERSION"
+
 echo "Building nerv-hook for all platforms..."
 
 # Windows amd64
 echo "  - windows/amd64"
-GOOS=windows GOARCH=amd64 go build -ldflags="-s -w" -o "$OUT_DIR/nerv-hook-windows-amd64.exe" .
+GOOS=windows GOARCH=amd64 go build -ldflags="$LDFLAGS" -o "$OUT_DIR/nerv-hook-windows-amd64.exe" .
 
 # macOS amd64 (Intel)
 echo "  - darwin/amd64"
-GOOS=darwin GOARCH=amd64 go build -ldflags="-s -w" -o "$OUT_DIR/nerv-hook-darwin-x64" .
+GOOS=darwin GOARCH=amd64 go build -ldflags="$LDFLAGS" -o "$OUT_DIR/nerv-hook-darwin-x64" .
 
 # macOS arm64 (Apple Silicon)
 echo "  - darwin/arm64"
-GOOS=darwin GOARCH=arm64 go build -ldflags="-s -w" -o "$OUT_DIR/nerv-hook-darwin-arm64" .
+GOOS=darwin GOARCH=arm64 go build -ldflags="$LDFLAGS" -o "$OUT_DIR/nerv-hook-darwin-arm64" .
 
 # Linux amd64
 echo "  - linux/amd64"
-GOOS=linux GOARCH=amd64 go build -ldflags="-s -w" -o "$OUT_DIR/nerv-hook-linux-x64" .
+GOOS=linux GOARCH=amd64 go build -ldflags="$LDFLAGS" -o "$OUT_DIR/nerv-hook-linux-x64" .
 
 # Linux arm64
 echo "  - linux/arm64"
-GOOS=linux GOARCH=arm64 go build -ldflags="-s -w" -o "$OUT_DIR/nerv-hook-linux-arm64" .
+GOOS=linux GOARCH=arm64 go build -ldflags="$LDFLAGS" -o "$OUT_DIR/nerv-hook-linux-arm64" .
 
 echo ""
 echo "Build complete! Binaries in $OUT_DIR:"
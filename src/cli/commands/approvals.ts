@@ -9,6 +9,7 @@
 import type { DatabaseService } from '../../core/database.js'
 import type { Approval } from '../../shared/types.js'
 import { CLI_EXIT_CODES } from '../../shared/constants.js'
+import { ApprovalConflictError } from '../../shared/approval-conflict.js'
 import { colors } from '../colors.js'
 
 function formatApproval(approval: Approval): void {
@@ -79,6 +80,21 @@ function handleApprovalsList(args: string[], db: DatabaseService): void {
   }
 }
 
+/**
+ * Resolve an approval, exiting with an error if someone else decided it since it was listed
+ */
+function resolveOrReport(db: DatabaseService, id: number, status: 'approved' | 'denied', reason?: string): Approval | undefined {
+  try {
+    return db.resolveApproval(id, status, reason)
+  } catch (err) {
+    if (err instanceof ApprovalConflictError) {
+      console.error(`${colors.yellow}Approval ${id} was already ${err.current.status} by someone else${colors.reset}`)
+      process.exit(CLI_EXIT_CODES.GENERAL_ERROR)
+    }
+    throw err
+  }
+}
+
 /**
  * Approve a pending request
  */
@@ -104,7 +120,7 @@ function handleApprove(args: string[], db: DatabaseService): void {
     process.exit(CLI_EXIT_CODES.GENERAL_ERROR)
   }
 
-  const resolved = db.resolveApproval(approval.id, 'approved')
+  const resolved = resolveOrReport(db, approval.id, 'approved')
   if (resolved) {
     console.log(`${colors.green}✓${colors.reset} Approved: ${colors.bold}${resolved.tool_name}${colors.reset}`)
     if (resolved.tool_input) {
@@ -145,7 +161,7 @@ function handleDeny(args: string[], db: DatabaseService): void {
     process.exit(CLI_EXIT_CODES.GENERAL_ERROR)
   }
 
-  const resolved = db.resolveApproval(approval.id, 'denied', reason)
+  const resolved = resolveOrReport(db, approval.id, 'denied', reason)
   if (resolved) {
     console.log(`${colors.red}✗${colors.reset} Denied: ${colors.bold}${resolved.tool_name}${colors.reset}`)
     if (reason) {
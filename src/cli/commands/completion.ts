@@ -0,0 +1,268 @@
+/**
+ * Shell completion for the nerv CLI
+ *
+ * nerv completion bash|zsh|fish   - Print a completion script for the shell
+ * nerv __complete <shell> <words> - Print the completions for a partial command
+ *                                   line; the scripts run this on every Tab
+ *
+ * Task, approval and project IDs are read from the database as completion
+ * runs, and rule patterns from permissions.json, so they're always current
+ */
+
+import type { DatabaseService } from '../../core/database.js'
+import { DEFAULT_SETTINGS, CLI_EXIT_CODES } from '../../shared/constants.js'
+import type { TaskStatus } from '../../shared/types.js'
+import { loadPermissions } from './permissions.js'
+import { colors } from '../colors.js'
+
+const SHELLS = ['bash', 'zsh', 'fish']
+
+// Each command and its subcommands, as listed by nerv help
+const COMMANDS: Record<string, string[]> = {
+  init: [],
+  project: ['create', 'list', 'info', 'switch', 'add-repo', 'scan'],
+  task: ['list', 'create', 'update', 'verify'],
+  start: [],
+  resume: [],
+  sessions: [],
+  session: ['fork', 'compare', 'merge'],
+  agents: [],
+  agent: ['create', 'edit', 'delete'],
+  skills: [],
+  yolo: [],
+  benchmark: ['score', 'history', 'compare'],
+  context: ['show', 'generate'],
+  learn: [],
+  learnings: [],
+  decide: [],
+  decisions: [],
+  cycle: ['create', 'list', 'complete', 'audit', 'plan'],
+  config: ['list', 'get', 'set', 'unset', 'path'],
+  permissions: ['list', 'learn', 'add', 'deny', 'remove'],
+  profile: ['default', 'strict'],
+  approvals: [],
+  approve: [],
+  deny: [],
+  terminal: ['profiles', 'open'],
+  terminals: ['list', 'add', 'remove'],
+  org: ['status', 'sync', 'show', 'agents', 'skills'],
+  update: ['status', 'check', 'install', 'notes'],
+  status: [],
+  recommend: [],
+  completion: SHELLS,
+  help: [],
+  version: [],
+}
+
+const TASK_STATUSES: TaskStatus[] = ['todo', 'in_progress', 'interrupted', 'review', 'done']
+
+// Tools rules are written for; a pattern is added inside the parentheses
+const RULE_TOOLS = ['Bash(', 'Read(', 'Write(', 'Edit(']
+
+/**
+ * Where live values come from, so completion can be tested without a database
+ */
+export interface CompletionSources {
+  taskIds(): string[]
+  approvalIds(): string[]
+  projectIds(): string[]
+  rules(): string[]
+}
+
+function databaseSources(db: DatabaseService): CompletionSources {
+  return {
+    taskIds: () => {
+      const project = db.getCurrentProject()
+      return project ? db.getTasksForProject(project.id).map(t => t.id) : []
+    },
+    approvalIds: () => db.getPendingApprovals().map(a => String(a.id)),
+    projectIds: () => db.getAllProjects().map(p => p.id),
+    rules: () => {
+      const perms = loadPermissions()
+      return [...perms.allow, ...perms.deny]
+    },
+  }
+}
+
+/**
+ * The candidates for the last of words, which is the one being completed
+ * and may be empty. words doesn't include nerv itself
+ */
+export function completeWords(words: string[], sources: CompletionSources): string[] {
+  const current = words[words.length - 1] ?? ''
+  const [command, subcommand] = words
+  const previous = words[words.length - 2]
+  let candidates: string[] = []
+
+  if (words.length <= 1) {
+    candidates = Object.keys(COMMANDS)
+  } else if (previous === '--status' && command === 'task') {
+    candidates = TASK_STATUSES
+  } else if (words.length === 2) {
+    switch (command) {
+      case 'start':
+        candidates = sources.taskIds()
+        break
+      case 'approve':
+      case 'deny':
+        candidates = sources.approvalIds()
+        break
+      default:
+        candidates = COMMANDS[command] ?? []
+    }
+  } else if (words.length === 3) {
+    switch (`${command} ${subcommand}`) {
+      case 'task update':
+      case 'task verify':
+        candidates = sources.taskIds()
+        break
+      case 'project info':
+      case 'project switch':
+        candidates = sources.projectIds()
+        break
+      case 'config get':
+      case 'config set':
+      case 'config unset':
+        candidates = Object.keys(DEFAULT_SETTINGS)
+        break
+      case 'permissions remove':
+        candidates = sources.rules()
+        break
+      case 'permissions add':
+      case 'permissions deny':
+        candidates = [...RULE_TOOLS, ...sources.rules()]
+        break
+    }
+  }
+  if (candidates.length === 0 && command === 'task' && subcommand === 'update' && words.length > 3) {
+    candidates = ['--status']
+  }
+
+  return [...new Set(candidates)].filter(c => c.startsWith(current))
+}
+
+// Characters bash splits words at for completion (COMP_WORDBREAKS), other than quotes
+const BASH_WORDBREAKS = '><=;|&(:'
+
+/**
+ * Split a bash command line into words the way the shell would, noting a
+ * quote left open in the last word, and how much of the last word comes before
+ * its last word-break character, which bash completes after
+ */
+export function splitLine(line: string): { words: string[]; quote: string; cut: number } {
+  const words: string[] = []
+  let word = ''
+  let quote = ''
+  let cut = 0
+  let started = false
+  for (let i = 0; i < line.length; i++) {
+    const c = line[i]
+    if (quote) {
+      if (c === quote) {
+        quote = ''
+      } else {
+        word += c
+      }
+    } else if (c === '\\' && i + 1 < line.length) {
+      word += line[++i]
+      started = true
+    } else if (c === "'" || c === '"') {
+      quote = c
+      started = true
+    } else if (/\s/.test(c)) {
+      if (started) {
+        words.push(word)
+      }
+      word = ''
+      cut = 0
+      started = false
+    } else {
+      word += c
+      started = true
+      if (BASH_WORDBREAKS.includes(c)) {
+        cut = word.length
+      }
+    }
+  }
+  words.push(word)
+  return { words, quote, cut }
+}
+
+/**
+ * Bash replaces only the part of a word after its last word-break character,
+ * such as the ( in Bash(npm, so it gets that part of each candidate, escaped
+ * Inside quotes it gets the whole word, quote included
+ */
+export function bashReplies(line: string, sources: CompletionSources): string[] {
+  const { words, quote, cut } = splitLine(line)
+  const candidates = completeWords(words.slice(1), sources)
+  if (quote) {
+    return candidates.map(c => quote + c)
+  }
+  return candidates.map(c => c.slice(cut).replace(/[\s'"\\$`&;|<>()*?![\]{}#~]/g, '\\$&'))
+}
+
+const BASH_SCRIPT = `# nerv completion for bash; add to ~/.bashrc:
+#   eval "$(nerv completion bash)"
+_nerv() {
+  local IFS=$'\\n'
+  COMPREPLY=($(nerv __complete bash "\${COMP_LINE:0:COMP_POINT}" 2>/dev/null))
+}
+complete -F _nerv nerv
+`
+
+const ZSH_SCRIPT = `#compdef nerv
+# nerv completion for zsh; add to ~/.zshrc:
+#   eval "$(nerv completion zsh)"
+_nerv() {
+  local -a candidates
+  candidates=(\${(f)"$(nerv __complete zsh "\${(@Q)words[2,CURRENT]}" 2>/dev/null)"})
+  compadd -a candidates
+}
+compdef _nerv nerv
+`
+
+// The current token is quoted so an empty one is still passed
+const FISH_SCRIPT = `# nerv completion for fish; add to ~/.config/fish/config.fish:
+#   nerv completion fish | source
+function __nerv_complete
+    set -l current (commandline -ct)
+    nerv __complete fish (commandline -opc)[2..-1] "$current" 2>/dev/null
+end
+complete -c nerv -f -a '(__nerv_complete)'
+`
+
+/**
+ * nerv completion <shell>
+ */
+export async function completionCommand(args: string[]): Promise<void> {
+  const scripts: Record<string, string> = { bash: BASH_SCRIPT, zsh: ZSH_SCRIPT, fish: FISH_SCRIPT }
+  const script = scripts[args[0]]
+  if (!script) {
+    console.error(`${colors.yellow}Usage: nerv completion ${SHELLS.join('|')}${colors.reset}`)
+    console.log(`\n  ${colors.gray}# bash${colors.reset}   eval "$(nerv completion bash)"`)
+    console.log(`  ${colors.gray}# zsh${colors.reset}    eval "$(nerv completion zsh)"`)
+    console.log(`  ${colors.gray}# fish${colors.reset}   nerv completion fish | source`)
+    process.exit(CLI_EXIT_CODES.INVALID_ARGS)
+  }
+  process.stdout.write(script)
+}
+
+/**
+ * nerv __complete <shell> <words...>: one candidate per line. A failure prints
+ * nothing, so a Tab never fills the terminal with an error
+ */
+export async function completeCommand(args: string[], db: DatabaseService): Promise<void> {
+  const [shell, ...words] = args
+  try {
+    const sources = databaseSources(db)
+    const replies = shell === 'bash'
+      ? bashReplies(words[0] ?? '', sources)
+      : completeWords(words.length > 0 ? words : [''], sources)
+    if (replies.length > 0) {
+      console.log(replies.join('\n'))
+    }
+  } catch {
+    // Completion is best effort
+  }
+}
@@ -122,14 +122,26 @@ function listSettings(settings: ReturnType<typeof getSettingsService>, jsonOutpu
   }
 }
 
+/**
+ * Exit for a key that isn't a CLI setting. Dotted keys such as approvals.poll_max
+ * are the hook's, in permissions.json, which nerv-hook config edits and validates
+ */
+function exitUnknownSetting(key: string): never {
+  console.error(`${colors.red}Unknown setting: ${key}${colors.reset}`)
+  if (key.includes('.')) {
+    console.log(`\nHook settings live in permissions.json; use ${colors.bold}nerv-hook config get|set|unset ${key}${colors.reset}`)
+  } else {
+    console.log(`\nAvailable settings: ${Object.keys(DEFAULT_SETTINGS).join(', ')}`)
+  }
+  process.exit(CLI_EXIT_CODES.GENERAL_ERROR)
+}
+
 /**
  * Get a specific setting
  */
 function getSetting(settings: ReturnType<typeof getSettingsService>, key: string, jsonOutput: boolean): void {
   if (!(key in DEFAULT_SETTINGS)) {
-    console.error(`${colors.red}Unknown setting: ${key}${colors.reset}`)
-    console.log(`\nAvailable settings: ${Object.keys(DEFAULT_SETTINGS).join(', ')}`)
-    process.exit(CLI_EXIT_CODES.GENERAL_ERROR)
+    exitUnknownSetting(key)
   }
 
   const resolved = settings.getWithSource(key as keyof NervSettings)
@@ -152,9 +164,7 @@ function setSetting(
   isProject: boolean
 ): void {
   if (!(key in DEFAULT_SETTINGS)) {
-    console.error(`${colors.red}Unknown setting: ${key}${colors.reset}`)
-    console.log(`\nAvailable settings: ${Object.keys(DEFAULT_SETTINGS).join(', ')}`)
-    process.exit(CLI_EXIT_CODES.GENERAL_ERROR)
+    exitUnknownSetting(key)
   }
 
   try {
@@ -182,8 +192,7 @@ function unsetSetting(
   isProject: boolean
 ): void {
   if (!(key in DEFAULT_SETTINGS)) {
-    console.error(`${colors.red}Unknown setting: ${key}${colors.reset}`)
-    process.exit(CLI_EXIT_CODES.GENERAL_ERROR)
+    exitUnknownSetting(key)
   }
 
   if (isProject) {
@@ -268,6 +277,9 @@ ${colors.bold}EXAMPLES${colors.reset}
   ${colors.gray}# Set project-specific budget${colors.reset}
   nerv config set monthly_budget_usd 100 --project
 
+  ${colors.gray}# Hook settings (permissions.json) have their own command${colors.reset}
+  nerv-hook config set approvals.poll_max 5s
+
   ${colors.gray}# Use environment variable${colors.reset}
   NERV_LOG_LEVEL=debug nerv start
 `)
@@ -9,11 +9,13 @@
  *   nerv permissions add <pattern>     - Add an allow rule
  *   nerv permissions deny <pattern>    - Add a deny rule
  *   nerv permissions remove <pattern>  - Remove a rule
+ *   nerv profile [default|strict]      - Show or switch the permission profile
  */
 
 import type { DatabaseService } from '../../core/database.js'
 import type { Approval } from '../../shared/types.js'
 import { getNervDir } from '../../core/platform.js'
+import { registerPermissionsFile } from '../../core/config-registration.js'
 import { CLI_EXIT_CODES } from '../../shared/constants.js'
 import { existsSync, readFileSync, writeFileSync, mkdirSync } from 'fs'
 import { join, dirname } from 'path'
@@ -26,8 +28,13 @@ import { colors } from '../colors.js'
 interface PermissionConfig {
   allow: string[]
   deny: string[]
+  profile?: string
 }
 
+// Profiles nerv-hook understands; strict asks about every call no allow rule
+// names and denies whenever it can't record or check a call
+const PROFILES = ['default', 'strict']
+
 const DEFAULT_PERMISSIONS: PermissionConfig = {
   allow: [
     'Read',
@@ -58,7 +65,7 @@ function getPermissionsPath(): string {
   return join(getNervDir(), 'permissions.json')
 }
 
-function loadPermissions(): PermissionConfig {
+export function loadPermissions(): PermissionConfig {
   const permPath = getPermissionsPath()
 
   if (!existsSync(permPath)) {
@@ -68,7 +75,9 @@ function loadPermissions(): PermissionConfig {
   try {
     const data = readFileSync(permPath, 'utf-8')
     const perms = JSON.parse(data) as PermissionConfig
+    // Keep the hook's other settings (profile, sandbox, approvals...) when saving
     return {
+      ...perms,
       allow: perms.allow || DEFAULT_PERMISSIONS.allow,
       deny: perms.deny || DEFAULT_PERMISSIONS.deny,
     }
@@ -77,7 +86,41 @@ function loadPermissions(): PermissionConfig {
   }
 }
 
-function savePermissions(permissions: PermissionConfig): void {
+/**
+ * Sections of permissions.json the org policy bundle protects. The hook only
+ * takes them from the signed bundle, so editing them here would do nothing
+ */
+function orgProtectedSections(): string[] {
+  const bundlePath = join(getNervDir(), 'org-policy.json')
+  if (!existsSync(bundlePath)) {
+    return []
+  }
+  try {
+    const bundle = JSON.parse(readFileSync(bundlePath, 'utf-8')) as { policy?: { protected?: string[] } }
+    return bundle.policy?.protected || []
+  } catch {
+    return []
+  }
+}
+
+/**
+ * Exit if the org policy protects a section, rather than saving an edit the hook ignores
+ */
+function refuseProtected(section: string): void {
+  if (orgProtectedSections().includes(section)) {
+    console.error(`${colors.red}Error: ${section} is set by your organisation's policy and can't be changed here${colors.reset}`)
+    process.exit(CLI_EXIT_CODES.GENERAL_ERROR)
+  }
+}
+
+function savePermissions(permissions: PermissionConfig, db: DatabaseService): void {
+  // In team mode only admins edit policy, so that's checked before writing
+  try {
+    db.requireAdmin('edit policy')
+  } catch (err) {
+    console.error(`${colors.red}Error: ${err instanceof Error ? err.message : String(err)}${colors.reset}`)
+    process.exit(CLI_EXIT_CODES.GENERAL_ERROR)
+  }
   const nervDir = getNervDir()
 
   if (!existsSync(nervDir)) {
@@ -85,7 +128,9 @@ function savePermissions(permissions: PermissionConfig): void {
   }
 
   const permPath = getPermissionsPath()
-  writeFileSync(permPath, JSON.stringify(permissions, null, 2))
+  const contents = JSON.stringify(permissions, null, 2)
+  writeFileSync(permPath, contents)
+  registerPermissionsFile(db, contents)
 }
 
 // ============================================================================
@@ -309,39 +354,41 @@ function learnPermissions(db: DatabaseService, jsonOutput: boolean): void {
 /**
  * Add an allow rule
  */
-function addAllowRule(pattern: string): void {
+function addAllowRule(pattern: string, db: DatabaseService): void {
+  refuseProtected('allow')
   const perms = loadPermissions()
   if (perms.allow.includes(pattern)) {
     console.log(`${colors.yellow}Rule already exists:${colors.reset} ${pattern}`)
     return
   }
   perms.allow.push(pattern)
-  savePermissions(perms)
+  savePermissions(perms, db)
   console.log(`${colors.green}Added allow rule:${colors.reset} ${pattern}`)
 }
 
 /**
  * Add a deny rule
  */
-function addDenyRule(pattern: string): void {
+function addDenyRule(pattern: string, db: DatabaseService): void {
   const perms = loadPermissions()
   if (perms.deny.includes(pattern)) {
     console.log(`${colors.yellow}Rule already exists:${colors.reset} ${pattern}`)
     return
   }
   perms.deny.push(pattern)
-  savePermissions(perms)
+  savePermissions(perms, db)
   console.log(`${colors.green}Added deny rule:${colors.reset} ${pattern}`)
 }
 
 /**
  * Remove a rule (from either allow or deny)
  */
-function removeRule(pattern: string): void {
+function removeRule(pattern: string, db: DatabaseService): void {
   const perms = loadPermissions()
   let removed = false
 
   if (perms.allow.includes(pattern)) {
+    refuseProtected('allow')
     perms.allow = perms.allow.filter(r => r !== pattern)
     removed = true
   }
@@ -352,13 +399,49 @@ function removeRule(pattern: string): void {
   }
 
   if (removed) {
-    savePermissions(perms)
+    savePermissions(perms, db)
     console.log(`${colors.green}Removed rule:${colors.reset} ${pattern}`)
   } else {
     console.log(`${colors.yellow}Rule not found:${colors.reset} ${pattern}`)
   }
 }
 
+/**
+ * Show or switch the permission profile
+ */
+export async function profileCommand(args: string[], db: DatabaseService): Promise<void> {
+  const perms = loadPermissions()
+  const current = perms.profile || 'default'
+  const profile = args[0]
+
+  if (!profile) {
+    console.log(`Permission profile: ${colors.bold}${current}${colors.reset}`)
+    console.log(`${colors.gray}Switch with: nerv profile ${PROFILES.join('|')}${colors.reset}`)
+    return
+  }
+  if (!PROFILES.includes(profile)) {
+    console.error(`${colors.red}Error: Unknown profile: ${profile}${colors.reset}`)
+    console.log(`Usage: nerv profile [${PROFILES.join('|')}]`)
+    process.exit(CLI_EXIT_CODES.GENERAL_ERROR)
+  }
+  if (profile === current) {
+    console.log(`${colors.yellow}Already using the ${profile} profile${colors.reset}`)
+    return
+  }
+
+  refuseProtected('profile')
+  if (profile === 'default') {
+    delete perms.profile
+  } else {
+    perms.profile = profile
+  }
+  savePermissions(perms, db)
+  console.log(`${colors.green}Switched to the ${profile} profile${colors.reset}`)
+  if (profile === 'strict') {
+    console.log(`${colors.gray}Only calls an allow rule names run without approval, and failures deny.${colors.reset}`)
+  }
+}
+
 /**
  * Show command help
  */
@@ -438,7 +521,7 @@ export async function permissionsCommand(args: string[], db: DatabaseService): P
         console.log('Usage: nerv permissions add <pattern>')
         process.exit(CLI_EXIT_CODES.GENERAL_ERROR)
       }
-      addAllowRule(filteredArgs[1])
+      addAllowRule(filteredArgs[1], db)
       break
 
     case 'deny':
@@ -448,7 +531,7 @@ export async function permissionsCommand(args: string[], db: DatabaseService): P
         console.log('Usage: nerv permissions deny <pattern>')
         process.exit(CLI_EXIT_CODES.GENERAL_ERROR)
       }
-      addDenyRule(filteredArgs[1])
+      addDenyRule(filteredArgs[1], db)
       break
 
     case 'remove':
@@ -459,7 +542,7 @@ export async function permissionsCommand(args: string[], db: DatabaseService): P
         console.log('Usage: nerv permissions remove <pattern>')
         process.exit(CLI_EXIT_CODES.GENERAL_ERROR)
       }
-      removeRule(filteredArgs[1])
+      removeRule(filteredArgs[1], db)
       break
 
     default:
@@ -20,7 +20,7 @@ import { learnCommand, learningsCommand } from './learn.js'
 import { decideCommand, decisionsCommand } from './decide.js'
 import { cycleCommand } from './cycle.js'
 import { configCommand } from './config.js'
-import { permissionsCommand } from './permissions.js'
+import { permissionsCommand, profileCommand } from './permissions.js'
 import { terminalCommand, terminalsCommand } from './terminal.js'
 import { orgCommand } from './org.js'
 import { updateCommand } from './update.js'
@@ -115,6 +115,10 @@ async function runReplCommand(
       await permissionsCommand(args, db)
       return true
 
+    case 'profile':
+      await profileCommand(args, db)
+      return true
+
     case 'terminal':
       await terminalCommand(args)
       return true
@@ -30,7 +30,7 @@ import { learnCommand, learningsCommand } from './commands/learn.js'
 import { decideCommand, decisionsCommand } from './commands/decide.js'
 import { cycleCommand } from './commands/cycle.js'
 import { configCommand } from './commands/config.js'
-import { permissionsCommand } from './commands/permissions.js'
+import { permissionsCommand, profileCommand } from './commands/permissions.js'
 import { terminalCommand, terminalsCommand } from './commands/terminal.js'
 import { orgCommand } from './commands/org.js'
 import { updateCommand } from './commands/update.js'
@@ -41,6 +41,7 @@ import { startRepl } from './commands/repl.js'
 import { skillCommand, isSlashCommand, listSkills } from './commands/skill.js'
 import { recommendCommand } from './commands/recommend.js'
 import { statusCommand } from './commands/status.js'
+import { completionCommand, completeCommand } from './commands/completion.js'
 import { colors } from './colors.js'
 
 // Version from package.json
@@ -132,6 +133,7 @@ ${colors.bold}COMMANDS${colors.reset}
     permissions add <pattern> Add an allow rule
     permissions deny <pattern> Add a deny rule
     permissions remove <pattern> Remove a rule
+    profile [default|strict]  Show or switch the permission profile
 
   ${colors.cyan}Approvals${colors.reset}
     approvals                 View pending approvals
@@ -168,6 +170,7 @@ ${colors.bold}COMMANDS${colors.reset}
     recommend --json          Output recommendation as JSON
 
   ${colors.cyan}Other${colors.reset}
+    completion <shell>        Print a bash, zsh or fish completion script
     help                      Show this help message
     version                   Show version
 
@@ -278,6 +281,9 @@ async function runCommand(command: string, args: string[], database: DatabaseSer
     case 'perms':
       await permissionsCommand(args.slice(1), database)
       break
+    case 'profile':
+      await profileCommand(args.slice(1), database)
+      break
     case 'terminal':
       await terminalCommand(args.slice(1))
       break
@@ -326,6 +332,12 @@ async function runCommand(command: string, args: string[], database: DatabaseSer
     case 'status':
       await statusCommand(args.slice(1), database)
       break
+    case 'completion':
+      await completionCommand(args.slice(1))
+      break
+    case '__complete':
+      await completeCommand(args.slice(1), database)
+      break
     default:
       // Handle slash commands (skills) per PRD Section 12
       if (isSlashCommand(command)) {
@@ -0,0 +1,33 @@
+/**
+ * nerv-hook checks the permissions file against the checksum registered each
+ * time a person saves it. A file saved any other way, perhaps by an agent
+ * rewriting its own rules, is treated as suspect and its rules aren't used.
+ *
+ * Anything that writes the permissions file on a person's behalf registers it
+ * here, with the same settings keys nerv-hook reads.
+ */
+
+import { createHash } from 'crypto'
+import { mkdirSync, writeFileSync } from 'fs'
+import { join } from 'path'
+import { getNervDir } from './platform.js'
+
+const CHECKSUM_KEY = 'permissions_config_sha256'
+const KNOWN_GOOD_KEY = 'permissions_config_known_good'
+
+interface SettingsWriter {
+  setSetting(key: string, value: string | null): void
+}
+
+// Read by nerv-hook's fast path for reads, which doesn't open the database
+const CHECKSUM_RECORD = 'permissions.sha256'
+
+export function registerPermissionsFile(db: SettingsWriter, contents: string): void {
+  const checksum = createHash('sha256').update(contents).digest('hex')
+  db.setSetting(CHECKSUM_KEY, checksum)
+  db.setSetting(KNOWN_GOOD_KEY, contents)
+
+  const nervDir = getNervDir()
+  mkdirSync(nervDir, { recursive: true, mode: 0o700 })
+  writeFileSync(join(nervDir, CHECKSUM_RECORD), checksum + '\n', { mode: 0o600 })
+}
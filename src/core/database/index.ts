@@ -22,6 +22,7 @@ import { YoloOperations } from './yolo.js'
 import { SubagentOperations } from './subagents.js'
 import { LearningsOperations } from './learnings.js'
 import { VerificationOperations } from './verification.js'
+import { requireRole } from '../operator.js'
 
 // Re-export config type
 export type { DatabaseServiceConfig } from './core.js'
@@ -108,6 +109,8 @@ export class DatabaseService extends DatabaseCore {
   deleteProject = (id: string) => this._projects.deleteProject(id)
   getSetting = (key: string) => this._projects.getSetting(key)
   setSetting = (key: string, value: string | null) => this._projects.setSetting(key, value)
+  // In team mode only admins edit policy; throws for anyone else
+  requireAdmin = (what: string) => requireRole(this.ensureDb(), 'admin', what)
   getCurrentProjectId = () => this._projects.getCurrentProjectId()
   setCurrentProjectId = (projectId: string | null) => this._projects.setCurrentProjectId(projectId)
   getCurrentProject = () => this._projects.getCurrentProject()
@@ -0,0 +1,24 @@
+/**
+ * Decision markers wake nerv-hook when an approval is decided
+ *
+ * A hook waiting on an approval watches the decisions directory beside the
+ * state database. Touching the approval's ID there makes it read the decision
+ * at once instead of at its next poll. Markers are best effort: the hook
+ * still polls, and removes the marker once it has its answer.
+ */
+
+import { mkdirSync, writeFileSync } from 'fs'
+import { dirname, join } from 'path'
+
+export function markDecision(databasePath: string, approvalId: number): void {
+  if (!databasePath || databasePath === ':memory:') {
+    return
+  }
+  try {
+    const dir = join(dirname(databasePath), 'decisions')
+    mkdirSync(dir, { recursive: true, mode: 0o700 })
+    writeFileSync(join(dir, String(approvalId)), '')
+  } catch {
+    // The hook falls back to polling
+  }
+}
@@ -0,0 +1,107 @@
+/**
+ * Operators decide approvals and edit policy in team mode
+ *
+ * nerv-hook attributes what people do to the OS account they run as, by its
+ * login name; nothing the caller sets changes it. Once an operator is registered in the users table, only
+ * registered operators may act, as their role allows: admins edit policy,
+ * approvers decide approvals up to their risk limit, and viewers only read.
+ * The dashboard and the nerv CLI follow the same rules as nerv-hook, so a
+ * decision made anywhere is checked and attributed the same way.
+ */
+
+import { userInfo } from 'os'
+import type Database from 'better-sqlite3'
+
+export function operatorName(): string {
+  try {
+    const name = userInfo().username
+    // Windows login names come as DOMAIN\name
+    return name.slice(name.lastIndexOf('\\') + 1)
+  } catch {
+    return ''
+  }
+}
+
+interface Operator {
+  name: string
+  role: string
+  max_risk?: string | null
+}
+
+// Most privileged first, as nerv-hook lists them
+const ROLES = ['admin', 'approver', 'viewer']
+
+// Lowest first; nerv-hook records one on each approval it queues
+const RISKS = ['low', 'medium', 'high']
+
+/**
+ * Returns the registered operator running this, or null outside team mode
+ * Throws if team mode is on and they aren't registered, or are disabled
+ */
+function teamOperator(db: Database.Database): Operator | null {
+  let users: number
+  try {
+    users = (db.prepare('SELECT COUNT(*) as n FROM users').get() as { n: number }).n
+  } catch {
+    // nerv-hook hasn't added the users table, so there's no team
+    return null
+  }
+  if (users === 0) {
+    return null
+  }
+
+  const name = operatorName()
+  const user = db.prepare('SELECT * FROM users WHERE name = ?').get(name) as
+    | (Operator & { disabled_at: string | null })
+    | undefined
+  if (!user) {
+    throw new Error(`"${name}" isn't a registered operator; ask an admin to run nerv-hook user add ${name}`)
+  }
+  if (user.disabled_at) {
+    throw new Error(`Operator ${name} is disabled`)
+  }
+  return user
+}
+
+function checkRole(operator: Operator, role: string, what: string): void {
+  const rank = ROLES.indexOf(operator.role)
+  if (rank < 0 || rank > ROLES.indexOf(role)) {
+    const article = /^[aeiou]/.test(operator.role) ? 'an' : 'a'
+    throw new Error(`${operator.name} is ${article} ${operator.role} and can't ${what}`)
+  }
+}
+
+/**
+ * Returns who a change is attributed to, or null outside team mode
+ * Throws if team mode is on and this operator's role is below role
+ */
+export function requireRole(db: Database.Database, role: string, what: string): string | null {
+  const operator = teamOperator(db)
+  if (!operator) {
+    return null
+  }
+  checkRole(operator, role, what)
+  return operator.name
+}
+
+/**
+ * Returns who a decision on an approval is attributed to, or null outside team mode
+ * Throws if team mode is on and this operator may not decide it: viewers
+ * decide nothing, and approvers nothing riskier than their limit
+ */
+export function decidingOperator(db: Database.Database, approvalId: number): string | null {
+  const operator = teamOperator(db)
+  if (!operator) {
+    return null
+  }
+  checkRole(operator, 'approver', 'decide approvals')
+  if (operator.role === 'approver' && operator.max_risk) {
+    const approval = db.prepare('SELECT * FROM approvals WHERE id = ?').get(approvalId) as { risk?: string | null } | undefined
+    // An approval queued before risks were recorded counts as high
+    const risk = approval?.risk && RISKS.includes(approval.risk) ? approval.risk : 'high'
+    if (RISKS.indexOf(risk) > RISKS.indexOf(operator.max_risk)) {
+      throw new Error(`${operator.name} may decide approvals of up to ${operator.max_risk} risk, and this one is ${risk} risk`)
+    }
+  }
+  return operator.name
+}
@@ -0,0 +1,33 @@
+/**
+ * nerv-hook compresses large approval inputs, approval context, and review
+ * bundles before storing them
+ *
+ * A compressed value is "zstd:" followed by the base64 of the zstd frame.
+ * Node has had zstd since 22.15; on an older runtime, or for a value that
+ * only looks compressed, the stored text is returned as is.
+ */
+
+import * as zlib from 'zlib'
+import type { Approval } from '../shared/types.js'
+
+const COMPRESSED_PREFIX = 'zstd:'
+
+const zstdDecompressSync = (zlib as unknown as { zstdDecompressSync?: (data: Buffer) => Buffer }).zstdDecompressSync
+
+export function decodeStoredText(value: string | null): string | null {
+  if (!value || !value.startsWith(COMPRESSED_PREFIX) || !zstdDecompressSync) {
+    return value
+  }
+  try {
+    return zstdDecompressSync(Buffer.from(value.slice(COMPRESSED_PREFIX.length), 'base64')).toString('utf8')
+  } catch {
+    return value
+  }
+}
+
+export function decodeApproval<T extends Approval | undefined>(approval: T): T {
+  if (!approval) {
+    return approval
+  }
+  return { ...approval, tool_input: decodeStoredText(approval.tool_input), context: decodeStoredText(approval.context) }
+}
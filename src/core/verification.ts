@@ -5,6 +5,7 @@
 
 import { spawn } from 'child_process'
 import { existsSync, readFileSync } from 'fs'
+import { isAbsolute, join } from 'path'
 import type {
   AcceptanceCriterion,
   VerifierResult,
@@ -124,9 +125,9 @@ function runFileExistsVerifier(
     }
   }
 
-  const fullPath = criterion.file_path.startsWith('/')
+  const fullPath = isAbsolute(criterion.file_path)
     ? criterion.file_path
-    : `${cwd}/${criterion.file_path}`
+    : join(cwd, criterion.file_path)
 
   const exists = existsSync(fullPath)
 
@@ -158,9 +159,9 @@ function runGrepVerifier(
     }
   }
 
-  const fullPath = criterion.grep_file.startsWith('/')
+  const fullPath = isAbsolute(criterion.grep_file)
     ? criterion.grep_file
-    : `${cwd}/${criterion.grep_file}`
+    : join(cwd, criterion.grep_file)
 
   if (!existsSync(fullPath)) {
     return {
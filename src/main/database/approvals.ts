@@ -1,5 +1,9 @@
 import type { Approval } from '../../shared/types'
 import type Database from 'better-sqlite3'
+import { ApprovalConflictError } from '../../shared/approval-conflict'
+import { markDecision } from '../../core/decision-markers'
+import { decodeApproval } from '../../core/stored-text'
+import { decidingOperator } from '../../core/operator'
 
 /**
  * Approval database operations
@@ -12,17 +16,17 @@ export class ApprovalOperations {
 
   getPendingApprovals(taskId?: string): Approval[] {
     if (taskId) {
-      return this.getDb().prepare(
+      return (this.getDb().prepare(
         "SELECT * FROM approvals WHERE task_id = ? AND status = 'pending' ORDER BY created_at ASC"
-      ).all(taskId) as Approval[]
+      ).all(taskId) as Approval[]).map(decodeApproval)
     }
-    return this.getDb().prepare(
+    return (this.getDb().prepare(
       "SELECT * FROM approvals WHERE status = 'pending' ORDER BY created_at ASC"
-    ).all() as Approval[]
+    ).all() as Approval[]).map(decodeApproval)
   }
 
   getAllApprovals(): Approval[] {
-    return this.getDb().prepare('SELECT * FROM approvals ORDER BY created_at DESC').all() as Approval[]
+    return (this.getDb().prepare('SELECT * FROM approvals ORDER BY created_at DESC').all() as Approval[]).map(decodeApproval)
   }
 
   createApproval(taskId: string, toolName: string, toolInput?: string, context?: string): Approval {
@@ -36,16 +40,33 @@ export class ApprovalOperations {
     return this.getDb().prepare('SELECT * FROM approvals WHERE id = ?').get(result.lastInsertRowid) as Approval
   }
 
+  /**
+   * Record a decision, but only if the approval is still pending
+   * Throws ApprovalConflictError if another surface decided it first
+   */
   resolveApproval(id: number, status: 'approved' | 'denied', denyReason?: string): Approval | undefined {
     const decidedAt = new Date().toISOString()
-    this.getDb().prepare(
-      'UPDATE approvals SET status = ?, deny_reason = ?, decided_at = ? WHERE id = ?'
-    ).run(status, denyReason || null, decidedAt, id)
+    const decidedBy = decidingOperator(this.getDb(), id)
+    const result = decidedBy
+      ? this.getDb().prepare(
+        "UPDATE approvals SET status = ?, deny_reason = ?, decided_at = ?, decided_by = ? WHERE id = ? AND status = 'pending'"
+      ).run(status, denyReason || null, decidedAt, decidedBy, id)
+      : this.getDb().prepare(
+        "UPDATE approvals SET status = ?, deny_reason = ?, decided_at = ? WHERE id = ? AND status = 'pending'"
+      ).run(status, denyReason || null, decidedAt, id)
 
-    const approval = this.getDb().prepare('SELECT * FROM approvals WHERE id = ?').get(id) as Approval
-    if (approval) {
-      this.logAuditEvent(approval.task_id, 'approval_resolved', JSON.stringify({ status, denyReason }))
+    const approval = decodeApproval(this.getDb().prepare('SELECT * FROM approvals WHERE id = ?').get(id) as Approval | undefined)
+    if (!approval) {
+      return undefined
     }
+
+    if (result.changes === 0) {
+      this.logAuditEvent(approval.task_id, 'approval_conflict', JSON.stringify({ approvalId: id, attempted: status, current: approval.status }))
+      throw new ApprovalConflictError(approval)
+    }
+
+    this.logAuditEvent(approval.task_id, 'approval_resolved', JSON.stringify({ status, denyReason, decidedBy: decidedBy ?? undefined }))
+    markDecision(this.getDb().name, id)
     return approval
   }
 }
@@ -35,6 +35,7 @@ import { VerificationOperations } from './verification'
 import { SuccessMetricsOperations } from './success-metrics'
 import { UserStatementOperations } from './user-statements'
 import { SpecProposalOperations } from './spec-proposals'
+import { requireRole } from '../../core/operator'
 
 // Re-export types for backwards compatibility
 export type {
@@ -157,6 +158,8 @@ class DatabaseService extends DatabaseCore {
   deleteProject = (id: string) => this._projects.deleteProject(id)
   getSetting = (key: string) => this._projects.getSetting(key)
   setSetting = (key: string, value: string | null) => this._projects.setSetting(key, value)
+  // In team mode only admins edit policy; throws for anyone else
+  requireAdmin = (what: string) => requireRole(this.ensureDb(), 'admin', what)
   getCurrentProjectId = () => this._projects.getCurrentProjectId()
   setCurrentProjectId = (projectId: string | null) => this._projects.setCurrentProjectId(projectId)
   getCurrentProject = () => this._projects.getCurrentProject()
@@ -210,6 +213,7 @@ class DatabaseService extends DatabaseCore {
   getMonthlyTotalCost = () => this._metrics.getMonthlyTotalCost()
   getDailyCostBreakdown = () => this._metrics.getDailyCostBreakdown()
   getCostByProject = () => this._metrics.getCostByProject()
+  getUsageStats = (since: string, projectId?: string) => this._metrics.getUsageStats(since, projectId)
   exportCostsCsv = () => this._metrics.exportCostsCsv()
   checkBudgetAlerts = (...args: Parameters<MetricsOperations['checkBudgetAlerts']>) => this._metrics.checkBudgetAlerts(...args)
   getRecentTasks = (limit?: number) => this._metrics.getRecentTasks(limit)
@@ -291,6 +295,7 @@ class DatabaseService extends DatabaseCore {
   approveReview = (taskId: string, notes?: string) => this._reviews.approveReview(taskId, notes)
   rejectReview = (taskId: string, notes: string) => this._reviews.rejectReview(taskId, notes)
   setReviewClaudeSummary = (taskId: string, summary: string) => this._reviews.setClaudeSummary(taskId, summary)
+  getReviewBundle = (taskId: string) => this._reviews.getReviewBundle(taskId)
 
   // =====================
   // Debug Findings Operations
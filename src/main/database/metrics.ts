@@ -1,4 +1,4 @@
-import type { SessionMetrics, AuditLogEntry, BudgetAlert, CostSummary, ModelCost, CostDataPoint } from '../../shared/types'
+import type { SessionMetrics, AuditLogEntry, BudgetAlert, CostSummary, ModelCost, CostDataPoint, UsageStat } from '../../shared/types'
 import type Database from 'better-sqlite3'
 
 /**
@@ -205,6 +205,30 @@ export class MetricsOperations {
     `).all(monthStart) as Array<{ date: string; cost: number; taskCount: number }>
   }
 
+  /**
+   * Get usage statistics from a day (YYYY-MM-DD) on, optionally for one project
+   * nervd keeps usage_stats up to date; until it has run, there are none
+   */
+  getUsageStats(since: string, projectId?: string): UsageStat[] {
+    try {
+      return this.getDb().prepare(`
+        SELECT
+          s.day,
+          s.project_id as projectId,
+          p.name as projectName,
+          s.kind,
+          s.key,
+          s.count
+        FROM usage_stats s
+        LEFT JOIN projects p ON p.id = s.project_id
+        WHERE s.day >= ? AND (? IS NULL OR s.project_id = ?)
+        ORDER BY s.day ASC
+      `).all(since, projectId ?? null, projectId ?? null) as UsageStat[]
+    } catch {
+      return []
+    }
+  }
+
   /**
    * Get cost breakdown by project for the current month
    */
@@ -1,5 +1,6 @@
 import type { TaskReview } from '../../shared/types'
 import type Database from 'better-sqlite3'
+import { decodeStoredText } from '../../core/stored-text'
 
 /**
  * Task review database operations for review gate before merge (PRD Section 2)
@@ -85,4 +86,19 @@ export class ReviewOperations {
     this.logAuditEvent(taskId, 'review_rejected', JSON.stringify({ reviewId: review.id, notes }))
     return this.getDb().prepare('SELECT * FROM task_reviews WHERE id = ?').get(review.id) as TaskReview
   }
+
+  /**
+   * Get the latest review bundle nerv-hook built for a task, as JSON
+   * review_bundles is created by nerv-hook's migrations, so it may not exist
+   */
+  getReviewBundle(taskId: string): string | undefined {
+    try {
+      const row = this.getDb().prepare(
+        'SELECT bundle FROM review_bundles WHERE task_id = ? ORDER BY id DESC LIMIT 1'
+      ).get(taskId) as { bundle: string } | undefined
+      return decodeStoredText(row?.bundle ?? null) ?? undefined
+    } catch {
+      return undefined
+    }
+  }
 }
@@ -4,9 +4,12 @@
  */
 
 import { app } from 'electron'
-import { existsSync, mkdirSync, copyFileSync, chmodSync, writeFileSync, readFileSync } from 'fs'
+import { existsSync, mkdirSync, copyFileSync, chmodSync, writeFileSync, readFileSync, statSync } from 'fs'
+import { createHash } from 'crypto'
 import { join, dirname } from 'path'
 import { platform, arch } from 'os'
+import { databaseService } from './database'
+import { registerPermissionsFile } from '../core/config-registration'
 
 // ============================================================================
 // Types
@@ -16,6 +19,8 @@ export interface HookConfig {
   hooks: {
     PreToolUse?: HookEntry[]
     PostToolUse?: HookEntry[]
+    SessionStart?: HookEntry[]
+    UserPromptSubmit?: HookEntry[]
     Stop?: HookEntry[]
   }
   permissions: {
@@ -37,6 +42,8 @@ interface HookDefinition {
 export interface PermissionConfig {
   allow: string[]
   deny: string[]
+  // 'strict' asks about every tool call no allow rule names; see nerv profile
+  profile?: string
 }
 
 // ============================================================================
@@ -84,6 +91,21 @@ function getResourcePath(): string {
 // Binary Installation
 // ============================================================================
 
+/**
+ * Records the installed binary's checksum in hook-binary.json, the same record
+ * `nerv-hook install` writes, so hooks notice if the binary is later replaced
+ */
+function recordHookBinary(hookPath: string): void {
+  const info = statSync(hookPath)
+  const record = {
+    path: hookPath,
+    sha256: createHash('sha256').update(readFileSync(hookPath)).digest('hex'),
+    size: info.size,
+    mod_time_ms: Math.floor(info.mtimeMs),
+  }
+  writeFileSync(join(getNervDir(), 'hook-binary.json'), JSON.stringify(record, null, 2) + '\n', { mode: 0o600 })
+}
+
 /**
  * Ensures the nerv-hook binary is installed and executable
  */
@@ -122,6 +144,7 @@ export function ensureHookBinary(): string {
     chmodSync(hookPath, 0o755)
   }
 
+  recordHookBinary(hookPath)
   console.log(`Installed nerv-hook binary to: ${hookPath}`)
   return hookPath
 }
@@ -177,7 +200,8 @@ export function generateHookConfig(
 
   // Build environment variable prefix for hook commands
   const envPrefix = platform() === 'win32'
-    ? `set NERV_PROJECT_ID=${projectId} && set NERV_TASK_ID=${taskId} && `
+    // Quoted so cmd doesn't keep the space before && in the value
+    ? `set "NERV_PROJECT_ID=${projectId}" && set "NERV_TASK_ID=${taskId}" && `
     : `NERV_PROJECT_ID=${projectId} NERV_TASK_ID=${taskId} `
 
   return {
@@ -204,7 +228,7 @@ export function generateHookConfig(
       ],
       PostToolUse: [
         {
-          matcher: 'Write|Edit',
+          matcher: 'Bash|Write|Edit',
           hooks: [
             {
               type: 'command',
@@ -213,6 +237,26 @@ export function generateHookConfig(
           ],
         },
       ],
+      SessionStart: [
+        {
+          hooks: [
+            {
+              type: 'command',
+              command: `${envPrefix}"${hookPath}" session-start`,
+            },
+          ],
+        },
+      ],
+      UserPromptSubmit: [
+        {
+          hooks: [
+            {
+              type: 'command',
+              command: `${envPrefix}"${hookPath}" user-prompt-submit`,
+            },
+          ],
+        },
+      ],
       Stop: [
         {
           hooks: [
@@ -287,7 +331,9 @@ export function loadGlobalPermissions(): PermissionConfig {
   try {
     const data = readFileSync(permPath, 'utf-8')
     const perms = JSON.parse(data) as PermissionConfig
+    // The hook's other settings (profile, sandbox, approvals...) are kept so saving doesn't drop them
     return {
+      ...perms,
       allow: perms.allow || DEFAULT_PERMISSIONS.allow,
       deny: perms.deny || DEFAULT_PERMISSIONS.deny,
     }
@@ -300,6 +346,8 @@ export function loadGlobalPermissions(): PermissionConfig {
  * Saves global permission configuration
  */
 export function saveGlobalPermissions(permissions: PermissionConfig): void {
+  // In team mode only admins edit policy, so that's checked before writing
+  databaseService.requireAdmin('edit policy')
   const nervDir = getNervDir()
 
   if (!existsSync(nervDir)) {
@@ -307,7 +355,9 @@ export function saveGlobalPermissions(permissions: PermissionConfig): void {
   }
 
   const permPath = join(nervDir, 'permissions.json')
-  writeFileSync(permPath, JSON.stringify(permissions, null, 2))
+  const contents = JSON.stringify(permissions, null, 2)
+  writeFileSync(permPath, contents)
+  registerPermissionsFile(databaseService, contents)
   console.log(`Saved permissions to: ${permPath}`)
 }
 
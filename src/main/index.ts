@@ -186,7 +186,8 @@ app.whenReady().then(() => {
   }
 
   // Set app user model id for windows
-  electronApp.setAppUserModelId('com.nerv')
+  // Has to match electron-builder's appId or Windows drops the app's toasts
+  electronApp.setAppUserModelId('com.nerv.app')
 
   // Default open or close DevTools by F12 in development
   // and ignore CommandOrControl + R in production.
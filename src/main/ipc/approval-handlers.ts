@@ -9,6 +9,7 @@ import { safeHandle } from './safe-handle'
 import { broadcastToRenderers } from '../utils'
 import { shouldAutoApproveDangerousTools } from '../yolo-benchmark/lifecycle'
 import { trackPendingApproval, untrackApproval } from '../recovery'
+import { ApprovalConflictError } from '../../shared/approval-conflict'
 import type { Approval } from '../../shared/types'
 
 export function registerApprovalHandlers(): void {
@@ -26,7 +27,14 @@ export function registerApprovalHandlers(): void {
     // Check if YOLO mode should auto-approve this dangerous tool
     if (shouldAutoApproveDangerousTools(taskId)) {
       console.log(`[YOLO] Auto-approving dangerous tool: ${toolName} for task ${taskId}`)
-      const resolved = databaseService.resolveApproval(approval.id, 'approved')
+      let resolved: Approval | undefined
+      try {
+        resolved = databaseService.resolveApproval(approval.id, 'approved')
+      } catch (err) {
+        // Already decided elsewhere; that decision stands
+        if (!(err instanceof ApprovalConflictError)) throw err
+        return err.current
+      }
       if (resolved) {
         broadcastToRenderers('notification:approvalAutoApproved', {
           approvalId: approval.id,
@@ -6,7 +6,7 @@
 
 import { databaseService } from '../database'
 import { safeHandle } from './safe-handle'
-import type { SessionMetrics, BudgetAlert, CostSummary } from '../../shared/types'
+import type { SessionMetrics, BudgetAlert, CostSummary, UsageStat } from '../../shared/types'
 
 export function registerMetricsHandlers(): void {
   safeHandle('db:metrics:get', (_event, taskId: string): SessionMetrics | undefined => {
@@ -63,6 +63,10 @@ export function registerMetricsHandlers(): void {
     return databaseService.getCostByProject()
   })
 
+  safeHandle('db:metrics:getUsageStats', (_event, since: string, projectId?: string): UsageStat[] => {
+    return databaseService.getUsageStats(since, projectId)
+  })
+
   safeHandle('db:metrics:exportCostsCsv', (): string => {
     return databaseService.exportCostsCsv()
   })
@@ -182,11 +182,32 @@ export function registerReviewHandlers(): void {
       }
     }
 
+    // Test runs come from the review bundle nerv-hook builds when the task enters review
+    let testResults: string | null = null
+    let testsPass: boolean | null = null
+    const bundle = databaseService.getReviewBundle(taskId)
+    if (bundle) {
+      try {
+        const parsed = JSON.parse(bundle) as {
+          tests?: { command: string; outcome: string; output?: string }[] | null
+          tests_pass?: boolean | null
+        }
+        if (parsed.tests?.length) {
+          testResults = parsed.tests
+            .map(t => `$ ${t.command}  [${t.outcome}]${t.output ? `\n${t.output}` : ''}`)
+            .join('\n\n')
+          testsPass = parsed.tests_pass ?? null
+        }
+      } catch {
+        // A malformed bundle just means no test results
+      }
+    }
+
     return {
       gitDiff,
       gitDiffStats,
-      testResults: null,
-      testsPass: null,
+      testResults,
+      testsPass,
       claudeSummary
     }
   })
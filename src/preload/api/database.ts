@@ -35,7 +35,8 @@ import type {
   SpecProposal,
   SpecProposalStatus,
   CostSummary,
-  CycleSuggestion
+  CycleSuggestion,
+  UsageStat
 } from '../../shared/types'
 import type {
   NervSettings,
@@ -137,6 +138,8 @@ export const db = {
       inputTokens: number
       outputTokens: number
     }>> => ipcRenderer.invoke('db:metrics:getCostByProject'),
+    getUsageStats: (since: string, projectId?: string): Promise<UsageStat[]> =>
+      ipcRenderer.invoke('db:metrics:getUsageStats', since, projectId),
     exportCostsCsv: (): Promise<string> =>
       ipcRenderer.invoke('db:metrics:exportCostsCsv'),
     checkBudgetAlerts: (monthlyBudget: number, warningThreshold?: number, criticalThreshold?: number, dailyBudget?: number): Promise<BudgetAlert[]> =>
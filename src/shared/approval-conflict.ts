@@ -0,0 +1,13 @@
+/**
+ * Error raised when an approval was already decided by another surface
+ * (dashboard, CLI, or YOLO auto-approval) before this decision was written
+ */
+
+import type { Approval } from './types'
+
+export class ApprovalConflictError extends Error {
+  constructor(public readonly current: Approval) {
+    super(`Approval ${current.id} was already ${current.status}`)
+    this.name = 'ApprovalConflictError'
+  }
+}
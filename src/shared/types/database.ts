@@ -48,9 +48,14 @@ export interface Approval {
   deny_reason: string | null
   created_at: string
   decided_at: string | null
+  session_id?: string | null
+  // The operator who decided it, in team mode
+  decided_by?: string | null
+  // low, medium, or high, set by nerv-hook when it queued the approval
+  risk?: 'low' | 'medium' | 'high' | null
 }
 
-export type ApprovalStatus = 'pending' | 'approved' | 'denied'
+export type ApprovalStatus = 'pending' | 'approved' | 'denied' | 'cancelled'
 
 export interface Cycle {
   id: string
@@ -415,6 +420,19 @@ export interface CostDataPoint {
   outputTokens: number
 }
 
+/**
+ * One row of usage statistics, rolled up from the audit log by nervd
+ * kind is 'tool', 'command', 'funnel' (key is a step such as 'asked' or 'approved') or 'denial'
+ */
+export interface UsageStat {
+  day: string
+  projectId: string
+  projectName: string | null
+  kind: 'tool' | 'command' | 'funnel' | 'denial'
+  key: string
+  count: number
+}
+
 /**
  * Budget alert notification (PRD Section 14)
  */
@@ -17,6 +17,12 @@ export interface HookConfig {
       matcher?: string
       hooks: Array<{ type: 'command'; command: string }>
     }>
+    SessionStart?: Array<{
+      hooks: Array<{ type: 'command'; command: string }>
+    }>
+    UserPromptSubmit?: Array<{
+      hooks: Array<{ type: 'command'; command: string }>
+    }>
     Stop?: Array<{
       hooks: Array<{ type: 'command'; command: string }>
     }>
@@ -52,7 +52,8 @@ export type {
   SpecDriftContradiction,
   Learning,
   LearningCategory,
-  LearningSource
+  LearningSource,
+  UsageStat
 } from './database'
 
 // Claude Code types
@@ -26,6 +26,7 @@ import { UserStatementOperations } from '../../src/main/database/user-statements
 import { VerificationOperations } from '../../src/main/database/verification'
 import { SuccessMetricsOperations } from '../../src/main/database/success-metrics'
 import { SpecProposalOperations } from '../../src/main/database/spec-proposals'
+import { ApprovalConflictError } from '../../src/shared/approval-conflict'
 import type { AuditIssue } from '../../src/shared/types'
 
 let db: Database.Database
@@ -547,6 +548,24 @@ describe('Permission Integration', () => {
     expect(approvalEvents).toHaveLength(4)
   })
 
+  it('should reject a second decision on the same approval', () => {
+    const project = projects.createProject('Conflict Project')
+    const task = tasks.createTask(project.id, 'Conflict Task')
+    const approval = approvals.createApproval(task.id, 'Bash', 'rm -rf ./build')
+
+    approvals.resolveApproval(approval.id, 'approved')
+
+    // A second surface deciding the same request loses and sees the first decision
+    expect(() => approvals.resolveApproval(approval.id, 'denied', 'Too risky')).toThrow(ApprovalConflictError)
+    const current = approvals.getAllApprovals().find(a => a.id === approval.id)
+    expect(current!.status).toBe('approved')
+    expect(current!.deny_reason).toBeNull()
+
+    const eventTypes = metrics.getAuditLog(task.id).map(e => e.event_type)
+    expect(eventTypes.filter(t => t === 'approval_resolved')).toHaveLength(1)
+    expect(eventTypes).toContain('approval_conflict')
+  })
+
   it('should update settings from always/never rules', () => {
     // Simulate storing permission learning as settings
     // When a user says "always allow" or "never allow", it becomes a setting
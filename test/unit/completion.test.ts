@@ -0,0 +1,57 @@
+/**
+ * Unit tests for shell completion (src/cli/commands/completion.ts)
+ */
+
+import { describe, it, expect, vi } from 'vitest'
+
+vi.mock('../../src/cli/commands/permissions.js', () => ({
+  loadPermissions: vi.fn(() => ({ allow: [], deny: [] }))
+}))
+
+import { completeWords, bashReplies, splitLine, type CompletionSources } from '../../src/cli/commands/completion.js'
+
+const sources: CompletionSources = {
+  taskIds: () => ['task-001', 'task-002'],
+  approvalIds: () => ['4', '12'],
+  projectIds: () => ['proj-1'],
+  rules: () => ['Bash(npm test:*)', 'Read'],
+}
+
+describe('completeWords', () => {
+  it('completes commands and subcommands', () => {
+    expect(completeWords(['ta'], sources)).toEqual(['task'])
+    expect(completeWords(['task', ''], sources)).toEqual(['list', 'create', 'update', 'verify'])
+  })
+
+  it('completes live IDs', () => {
+    expect(completeWords(['task', 'update', ''], sources)).toEqual(['task-001', 'task-002'])
+    expect(completeWords(['approve', '1'], sources)).toEqual(['12'])
+    expect(completeWords(['start', 'task-002'], sources)).toEqual(['task-002'])
+    expect(completeWords(['project', 'switch', ''], sources)).toEqual(['proj-1'])
+  })
+
+  it('completes rule patterns', () => {
+    expect(completeWords(['permissions', 'remove', 'B'], sources)).toEqual(['Bash(npm test:*)'])
+    expect(completeWords(['permissions', 'add', 'B'], sources)).toEqual(['Bash(', 'Bash(npm test:*)'])
+  })
+
+  it('completes task statuses after --status', () => {
+    expect(completeWords(['task', 'list', '--status', 'in'], sources)).toEqual(['in_progress', 'interrupted'])
+  })
+})
+
+describe('bashReplies', () => {
+  it('splits words as bash does', () => {
+    expect(splitLine('nerv task update ')).toEqual({ words: ['nerv', 'task', 'update', ''], quote: '', cut: 0 })
+    expect(splitLine(`nerv permissions remove 'Bash(npm`)).toEqual({ words: ['nerv', 'permissions', 'remove', 'Bash(npm'], quote: "'", cut: 0 })
+  })
+
+  it('completes after the last word break, escaped', () => {
+    expect(bashReplies('nerv permissions remove Bash(', sources)).toEqual(['npm\\ test:\\*\\)'])
+    expect(bashReplies('nerv permissions remove Bash\\(n', sources)).toEqual(['Bash\\(npm\\ test:\\*\\)'])
+  })
+
+  it('keeps an open quote', () => {
+    expect(bashReplies(`nerv permissions remove 'Bash(`, sources)).toEqual([`'Bash(npm test:*)`])
+  })
+})